@@ -11,13 +11,41 @@ export GOFLAGS="${GOFLAGS} -mod=vendor"
 mkdir -p "${PWD}/bin"
 
 echo "Building plugins ${GOOS}"
+# Set MULTICALL to the names of plugins, or to "all", to build a single
+# cni-plugins binary of them instead, with a link named after each plugin.
 PLUGINS="plugins/meta/* plugins/main/* plugins/ipam/*"
+TAGS="minimal"
+LINKS=""
 for d in $PLUGINS; do
 	if [ -d "$d" ]; then
 		plugin="$(basename "$d")"
 		if [ "${plugin}" != "windows" ]; then
-			echo "  $plugin"
-			${GO:-go} build -o "${PWD}/bin/$plugin" "$@" ./"$d"
+			if [ -z "${MULTICALL}" ]; then
+				echo "  $plugin"
+				${GO:-go} build -o "${PWD}/bin/$plugin" "$@" ./"$d"
+			elif [ "${MULTICALL}" = "all" ] || echo " ${MULTICALL} " | grep -q " $plugin "; then
+				TAGS="$TAGS,plugin_$(echo "$plugin" | tr - _)"
+				LINKS="$LINKS $plugin"
+			fi
 		fi
 	fi
 done
+if [ -n "${MULTICALL}" ]; then
+	echo "  cni-plugins:$LINKS"
+	${GO:-go} build -tags "$TAGS" -o "${PWD}/bin/cni-plugins" "$@" ./cmd/cni-plugins
+	for plugin in $LINKS; do
+		ln -sf cni-plugins "${PWD}/bin/$plugin"
+	done
+fi
+
+echo "Building tools ${GOOS}"
+for d in cmd/*; do
+	if [ -d "$d" ]; then
+		tool="$(basename "$d")"
+		if [ "${tool}" = "cni-plugins" ]; then
+			continue
+		fi
+		echo "  $tool"
+		${GO:-go} build -o "${PWD}/bin/$tool" "$@" ./"$d"
+	fi
+done
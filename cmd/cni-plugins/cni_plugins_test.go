@@ -0,0 +1,75 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("cni-plugins", func() {
+	run := func(path string, args ...string) *gexec.Session {
+		session, err := gexec.Start(exec.Command(path, args...), GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(session).Should(gexec.Exit())
+		return session
+	}
+
+	It("lists the built-in plugins only", func() {
+		session := run(binPath, "-list")
+		Expect(session.ExitCode()).To(Equal(0))
+		Expect(string(session.Out.Contents())).To(Equal("host-local\nloopback\n"))
+	})
+
+	It("runs the plugin named as the first argument", func() {
+		session := run(binPath, "host-local")
+		Expect(session.ExitCode()).To(Equal(0))
+		Expect(session.Err).To(gbytes.Say("CNI host-local plugin"))
+	})
+
+	It("prints its usage when no plugin is named", func() {
+		session := run(binPath, "bridge")
+		Expect(session.ExitCode()).To(Equal(2))
+		Expect(session.Err).To(gbytes.Say("Plugins: host-local, loopback"))
+	})
+
+	It("installs links running the plugin they're named after", func() {
+		dir := GinkgoT().TempDir()
+		Expect(run(binPath, "-install", dir).ExitCode()).To(Equal(0))
+		// Installing again replaces the links
+		Expect(run(binPath, "-install", dir).ExitCode()).To(Equal(0))
+
+		for _, name := range []string{"host-local", "loopback"} {
+			session := run(filepath.Join(dir, name))
+			Expect(session.ExitCode()).To(Equal(0))
+			Expect(session.Err).To(gbytes.Say("CNI " + name + " plugin"))
+		}
+	})
+
+	It("doesn't replace files which aren't links", func() {
+		dir := GinkgoT().TempDir()
+		Expect(os.WriteFile(filepath.Join(dir, "loopback"), []byte("#!/bin/sh\n"), 0o755)).To(Succeed())
+
+		session := run(binPath, "-install", dir)
+		Expect(session.ExitCode()).To(Equal(1))
+		Expect(session.Err).To(gbytes.Say("loopback exists and is not a link"))
+	})
+})
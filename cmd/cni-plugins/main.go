@@ -0,0 +1,132 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// cni-plugins is a multi-call binary of the plugins, running the one it is
+// invoked as, busybox-style. All plugins of the OS are built in by default;
+// build with the tag minimal and a plugin_<name> tag per plugin to pick
+// them, e.g. -tags minimal,plugin_bridge,plugin_host_local.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const usage = `Usage: cni-plugins <plugin> [args]
+       cni-plugins -list
+       cni-plugins -install <dir>
+
+Runs the plugin named by the name the binary is invoked as, so a link named
+after a plugin runs it. -install links all built-in plugins into <dir>.
+`
+
+// plugins maps the names of the built-in plugins to their mains.
+var plugins = map[string]func(){}
+
+func register(name string, main func()) {
+	plugins[name] = main
+}
+
+func main() {
+	if main, ok := plugins[pluginName(os.Args[0])]; ok {
+		main()
+		return
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "-list":
+			for _, name := range names() {
+				fmt.Println(name)
+			}
+			return
+		case "-install":
+			if len(os.Args) != 3 {
+				break
+			}
+			if err := install(os.Args[2]); err != nil {
+				fmt.Fprintf(os.Stderr, "cni-plugins: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		default:
+			if main, ok := plugins[os.Args[1]]; ok {
+				os.Args = os.Args[1:]
+				main()
+				return
+			}
+		}
+	}
+
+	// A build of a single plugin runs it whatever it's named
+	if len(plugins) == 1 {
+		for _, main := range plugins {
+			main()
+		}
+		return
+	}
+
+	fmt.Fprint(os.Stderr, usage)
+	fmt.Fprintf(os.Stderr, "\nPlugins: %s\n", strings.Join(names(), ", "))
+	os.Exit(2)
+}
+
+// pluginName returns the plugin name of the binary path, without the
+// extension of Windows executables.
+func pluginName(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), ".exe")
+}
+
+func names() []string {
+	names := make([]string, 0, len(plugins))
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// install links the built-in plugins to the binary in dir, replacing links
+// of earlier installs but no other files.
+func install(dir string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the binary: %v", err)
+	}
+	if self, err = filepath.EvalSymlinks(self); err != nil {
+		return fmt.Errorf("failed to resolve the binary: %v", err)
+	}
+
+	for _, name := range names() {
+		if filepath.Ext(self) == ".exe" {
+			name += ".exe"
+		}
+		link := filepath.Join(dir, name)
+		if fi, err := os.Lstat(link); err == nil {
+			if fi.Mode()&os.ModeSymlink == 0 {
+				return fmt.Errorf("%s exists and is not a link", link)
+			}
+			if err := os.Remove(link); err != nil {
+				return fmt.Errorf("failed to replace %s: %v", link, err)
+			}
+		}
+		if err := os.Symlink(self, link); err != nil {
+			return fmt.Errorf("failed to link %s: %v", link, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+)
+
+var _ = Describe("flatcni", func() {
+	var (
+		targetNS ns.NetNS
+		tmpDir   string
+		opts     *options
+	)
+
+	BeforeEach(func() {
+		var err error
+		targetNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		tmpDir = GinkgoT().TempDir()
+		opts = &options{
+			path:     pluginDir,
+			cacheDir: filepath.Join(tmpDir, "cache"),
+			ifName:   "lo",
+		}
+	})
+
+	AfterEach(func() {
+		Expect(targetNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(targetNS)).To(Succeed())
+	})
+
+	loUp := func() bool {
+		up := false
+		err := targetNS.Do(func(ns.NetNS) error {
+			lo, err := net.InterfaceByName("lo")
+			up = lo.Flags&net.FlagUp != 0
+			return err
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return up
+	}
+
+	writeConf := func(conf string) string {
+		file := filepath.Join(tmpDir, "net.conf")
+		Expect(os.WriteFile(file, []byte(conf), 0o644)).To(Succeed())
+		return file
+	}
+
+	for _, conf := range []string{
+		`{"cniVersion": "1.0.0", "name": "lo", "plugins": [{"type": "loopback"}]}`,
+		`{"cniVersion": "1.0.0", "name": "lo", "type": "loopback"}`,
+	} {
+		conf := conf
+		It("runs ADD, CHECK and DEL of "+conf, func() {
+			file := writeConf(conf)
+
+			out := &bytes.Buffer{}
+			Expect(run(context.TODO(), out, opts, "add", file, targetNS.Path())).To(Succeed())
+			Expect(out.String()).To(ContainSubstring(`"cniVersion": "1.0.0"`))
+			Expect(loUp()).To(BeTrue())
+
+			Expect(run(context.TODO(), out, opts, "check", file, targetNS.Path())).To(Succeed())
+
+			Expect(run(context.TODO(), out, opts, "del", file, targetNS.Path())).To(Succeed())
+			Expect(loUp()).To(BeFalse())
+		})
+	}
+
+	It("reports bad invocations", func() {
+		file := writeConf(`{"cniVersion": "1.0.0", "name": "lo", "type": "loopback"}`)
+		Expect(run(context.TODO(), nil, opts, "status", file, targetNS.Path())).To(MatchError(`unknown command "status", must be one of add, check or del`))
+
+		opts.args = "K8S_POD_NAME"
+		Expect(run(context.TODO(), nil, opts, "add", file, targetNS.Path())).To(MatchError(`invalid CNI_ARGS pair "K8S_POD_NAME"`))
+
+		opts.path = tmpDir
+		opts.args = ""
+		Expect(run(context.TODO(), nil, opts, "add", file, targetNS.Path())).To(MatchError(ContainSubstring(`failed to find plugin "loopback"`)))
+	})
+
+	It("derives a stable container ID from the netns path", func() {
+		rt1, err := runtimeConf(opts, targetNS.Path())
+		Expect(err).NotTo(HaveOccurred())
+		rt2, err := runtimeConf(opts, targetNS.Path())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rt1.ContainerID).To(HaveLen(64))
+		Expect(rt1.ContainerID).To(Equal(rt2.ContainerID))
+
+		opts.containerID = "ctr"
+		opts.args = "IgnoreUnknown=1;K8S_POD_NAME=web"
+		rt, err := runtimeConf(opts, targetNS.Path())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rt.ContainerID).To(Equal("ctr"))
+		Expect(rt.Args).To(Equal([][2]string{{"IgnoreUnknown", "1"}, {"K8S_POD_NAME", "web"}}))
+	})
+})
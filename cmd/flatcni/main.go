@@ -0,0 +1,165 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// flatcni runs the plugins of a network configuration against a network
+// namespace, for runtimes and test rigs that don't integrate libcni.
+package main
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/libcni"
+)
+
+const usage = `Usage: flatcni [options] add|check|del <config> <netns>
+
+Runs the plugins of the network configuration in <config>, a .conflist or a
+single plugin .conf, against the network namespace at <netns>. ADD prints
+the result on stdout.
+
+Options:
+`
+
+type options struct {
+	path        string
+	cacheDir    string
+	containerID string
+	ifName      string
+	args        string
+	capArgs     string
+}
+
+func main() {
+	opts := options{}
+	flags := flag.NewFlagSet("flatcni", flag.ContinueOnError)
+	flags.StringVar(&opts.path, "path", envOr("CNI_PATH", "/opt/cni/bin"), "`dirs` to search for plugins, separated by "+string(os.PathListSeparator))
+	flags.StringVar(&opts.cacheDir, "cache-dir", "", "`dir` to cache results in (default the libcni cache dir)")
+	flags.StringVar(&opts.containerID, "id", "", "container `ID` (default derived from the netns path)")
+	flags.StringVar(&opts.ifName, "ifname", "eth0", "`name` of the interface in the container")
+	flags.StringVar(&opts.args, "args", os.Getenv("CNI_ARGS"), "CNI_ARGS to pass, as `K=V;K=V`")
+	flags.StringVar(&opts.capArgs, "cap-args", "", "capability arguments as a JSON `object`, e.g. '{\"portMappings\": [...]}'")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		os.Exit(2)
+	}
+	if flags.NArg() != 3 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(context.Background(), os.Stdout, &opts, flags.Arg(0), flags.Arg(1), flags.Arg(2)); err != nil {
+		fmt.Fprintf(os.Stderr, "flatcni: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, out io.Writer, opts *options, cmd, confFile, netns string) error {
+	list, err := loadConfList(confFile)
+	if err != nil {
+		return err
+	}
+	rt, err := runtimeConf(opts, netns)
+	if err != nil {
+		return err
+	}
+	cni := libcni.NewCNIConfigWithCacheDir(filepath.SplitList(opts.path), opts.cacheDir, nil)
+
+	switch cmd {
+	case "add":
+		result, err := cni.AddNetworkList(ctx, list, rt)
+		if err != nil {
+			return err
+		}
+		return result.PrintTo(out)
+	case "check":
+		return cni.CheckNetworkList(ctx, list, rt)
+	case "del":
+		return cni.DelNetworkList(ctx, list, rt)
+	}
+	return fmt.Errorf("unknown command %q, must be one of add, check or del", cmd)
+}
+
+// loadConfList loads a configuration list, wrapping a single plugin
+// configuration into a list of its own.
+func loadConfList(file string) (*libcni.NetworkConfigList, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse config %q: %v", file, err)
+	}
+	if _, ok := raw["plugins"]; ok {
+		return libcni.ConfListFromBytes(data)
+	}
+	conf, err := libcni.ConfFromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return libcni.ConfListFromConf(conf)
+}
+
+func runtimeConf(opts *options, netns string) (*libcni.RuntimeConf, error) {
+	netns, err := filepath.Abs(netns)
+	if err != nil {
+		return nil, err
+	}
+
+	rt := &libcni.RuntimeConf{
+		ContainerID: opts.containerID,
+		NetNS:       netns,
+		IfName:      opts.ifName,
+	}
+	if rt.ContainerID == "" {
+		// Stable across invocations, so DEL and CHECK find what ADD cached
+		rt.ContainerID = fmt.Sprintf("%x", sha512.Sum512([]byte(netns)))[:64]
+	}
+
+	for _, kv := range strings.Split(opts.args, ";") {
+		if kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid CNI_ARGS pair %q", kv)
+		}
+		rt.Args = append(rt.Args, [2]string{k, v})
+	}
+
+	if opts.capArgs != "" {
+		if err := json.Unmarshal([]byte(opts.capArgs), &rt.CapabilityArgs); err != nil {
+			return nil, fmt.Errorf("failed to parse capability arguments: %v", err)
+		}
+	}
+	return rt, nil
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package dhcp
 
 import (
 	"github.com/d2g/dhcp4"
@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package dhcp
 
 import (
 	"context"
@@ -31,6 +31,7 @@ import (
 	"time"
 
 	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/opencontainers/selinux/go-selinux"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	current "github.com/containernetworking/cni/pkg/types/100"
@@ -45,6 +46,8 @@ type DHCP struct {
 	clientTimeout   time.Duration
 	clientResendMax time.Duration
 	broadcast       bool
+	// networks are the names of the only networks served, if any
+	networks []string
 }
 
 func newDHCP(clientTimeout, clientResendMax time.Duration) *DHCP {
@@ -73,6 +76,9 @@ func (d *DHCP) Allocate(args *skel.CmdArgs, result *current.Result) error {
 	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
 		return fmt.Errorf("error parsing netconf: %v", err)
 	}
+	if err := d.serves(conf.Name); err != nil {
+		return err
+	}
 
 	optsRequesting, optsProviding, err := prepareOptions(args.Args, conf.IPAM.ProvideOptions, conf.IPAM.RequestOptions)
 	if err != nil {
@@ -120,6 +126,9 @@ func (d *DHCP) Release(args *skel.CmdArgs, _ *struct{}) error {
 	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
 		return fmt.Errorf("error parsing netconf: %v", err)
 	}
+	if err := d.serves(conf.Name); err != nil {
+		return err
+	}
 
 	clientID := generateClientID(args.ContainerID, conf.Name, args.IfName)
 	if l := d.getLease(clientID); l != nil {
@@ -130,6 +139,20 @@ func (d *DHCP) Release(args *skel.CmdArgs, _ *struct{}) error {
 	return nil
 }
 
+// serves fails for a network the daemon isn't configured to serve, so a
+// network pointed at the wrong instance is noticed rather than sharing it.
+func (d *DHCP) serves(netName string) error {
+	if len(d.networks) == 0 {
+		return nil
+	}
+	for _, n := range d.networks {
+		if n == netName {
+			return nil
+		}
+	}
+	return fmt.Errorf("network %q is not served by this dhcp daemon", netName)
+}
+
 func (d *DHCP) getLease(clientID string) *DHCPLease {
 	d.mux.Lock()
 	defer d.mux.Unlock()
@@ -159,7 +182,7 @@ func (d *DHCP) clearLease(clientID string) {
 	delete(d.leases, clientID)
 }
 
-func getListener(socketPath string) (net.Listener, error) {
+func getListener(socketPath, socketLabel string) (net.Listener, error) {
 	l, err := activation.Listeners()
 	if err != nil {
 		return nil, err
@@ -170,7 +193,18 @@ func getListener(socketPath string) (net.Listener, error) {
 		if err := os.MkdirAll(filepath.Dir(socketPath), 0o700); err != nil {
 			return nil, err
 		}
-		return net.Listen("unix", socketPath)
+		listener, err := net.Listen("unix", socketPath)
+		if err != nil {
+			return nil, err
+		}
+		// a socket passed by systemd is labeled by its unit
+		if socketLabel != "" && selinux.GetEnabled() {
+			if err := selinux.SetFileLabel(socketPath, socketLabel); err != nil {
+				listener.Close()
+				return nil, fmt.Errorf("failed to label %s as %s: %v", socketPath, socketLabel, err)
+			}
+		}
+		return listener, nil
 
 	case len(l) == 1:
 		if l[0] == nil {
@@ -184,8 +218,9 @@ func getListener(socketPath string) (net.Listener, error) {
 }
 
 func runDaemon(
-	pidfilePath, hostPrefix, socketPath string,
+	pidfilePath, hostPrefix, socketPath, socketLabel string,
 	dhcpClientTimeout time.Duration, resendMax time.Duration, broadcast bool,
+	networks []string,
 ) error {
 	// since other goroutines (on separate threads) will change namespaces,
 	// ensure the RPC server does not get scheduled onto those
@@ -201,7 +236,7 @@ func runDaemon(
 		}
 	}
 
-	l, err := getListener(hostPrefix + socketPath)
+	l, err := getListener(hostPrefix+socketPath, socketLabel)
 	if err != nil {
 		return fmt.Errorf("Error getting listener: %v", err)
 	}
@@ -223,6 +258,7 @@ func runDaemon(
 	dhcp := newDHCP(dhcpClientTimeout, resendMax)
 	dhcp.hostNetnsPrefix = hostPrefix
 	dhcp.broadcast = broadcast
+	dhcp.networks = networks
 	rpc.Register(dhcp)
 	rpc.HandleHTTP()
 	srv.Serve(l)
@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package dhcp
 
 import (
 	"bytes"
@@ -652,3 +652,50 @@ var _ = Describe("DHCP Lease Unavailable Operations", func() {
 		})
 	}
 })
+
+var _ = Describe("DHCP daemon instances", func() {
+	socketPath := func(ipam string) (string, error) {
+		return getSocketPath([]byte(fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testnet",
+			"type": "macvlan",
+			"ipam": %s
+		}`, ipam)))
+	}
+
+	It("selects the socket of the network's daemon", func() {
+		path, err := socketPath(`{"type": "dhcp"}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(path).To(Equal("/run/cni/dhcp.sock"))
+
+		path, err = socketPath(`{"type": "dhcp", "daemon": "vlan10"}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(path).To(Equal("/run/cni/dhcp-vlan10.sock"))
+
+		path, err = socketPath(`{"type": "dhcp", "daemonSocketPath": "/run/vrf-a/dhcp.sock"}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(path).To(Equal("/run/vrf-a/dhcp.sock"))
+
+		_, err = socketPath(`{"type": "dhcp", "daemon": "../vlan10"}`)
+		Expect(err).To(MatchError(`invalid dhcp daemon instance name "../vlan10"`))
+		_, err = socketPath(`{"type": "dhcp", "daemon": "vlan10", "daemonSocketPath": "/run/vrf-a/dhcp.sock"}`)
+		Expect(err).To(MatchError("only one of daemonSocketPath and daemon may be set"))
+	})
+
+	It("only serves the configured networks", func() {
+		d := newDHCP(time.Second, time.Second)
+		Expect(d.serves("testnet")).To(Succeed())
+
+		d.networks = []string{"vlan10", "vlan20"}
+		Expect(d.serves("vlan20")).To(Succeed())
+		Expect(d.serves("testnet")).To(MatchError(`network "testnet" is not served by this dhcp daemon`))
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			IfName:      "eth0",
+			StdinData:   []byte(`{"cniVersion": "1.0.0", "name": "testnet", "type": "macvlan", "ipam": {"type": "dhcp"}}`),
+		}
+		Expect(d.Allocate(args, &types100.Result{})).To(MatchError(`network "testnet" is not served by this dhcp daemon`))
+		Expect(d.Release(args, &struct{}{})).To(MatchError(`network "testnet" is not served by this dhcp daemon`))
+	})
+})
@@ -12,14 +12,13 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package dhcp
 
 import (
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -29,6 +28,7 @@ import (
 	"github.com/vishvananda/netlink"
 
 	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/cniargs"
 	"github.com/containernetworking/plugins/pkg/ns"
 )
 
@@ -90,12 +90,9 @@ func prepareOptions(cniArgs string, provideOptions []ProvideOption, requestOptio
 	var optsProviding map[dhcp4.OptionCode][]byte
 	var err error
 	// parse CNI args
-	cniArgsParsed := map[string]string{}
-	for _, argPair := range strings.Split(cniArgs, ";") {
-		args := strings.SplitN(argPair, "=", 2)
-		if len(args) > 1 {
-			cniArgsParsed[args[0]] = args[1]
-		}
+	cniArgsParsed, err := cniargs.ParseEnv(cniArgs)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// parse providing options map
@@ -0,0 +1,230 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/include"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+)
+
+const defaultSocketPath = "/run/cni/dhcp.sock"
+
+// instanceRegexp matches the names of daemon instances, which end up in
+// their socket path.
+var instanceRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// instanceSocketPath returns the default socket path of the daemon instance
+// name, e.g. /run/cni/dhcp-vlan10.sock. The unnamed instance uses the
+// default socket path.
+func instanceSocketPath(name string) (string, error) {
+	if name == "" {
+		return defaultSocketPath, nil
+	}
+	if !instanceRegexp.MatchString(name) {
+		return "", fmt.Errorf("invalid dhcp daemon instance name %q", name)
+	}
+	return filepath.Join(filepath.Dir(defaultSocketPath), "dhcp-"+name+".sock"), nil
+}
+
+// The top-level network config - IPAM plugins are passed the full configuration
+// of the calling plugin, not just the IPAM section.
+type NetConf struct {
+	types.NetConf
+	IPAM *IPAMConfig `json:"ipam"`
+}
+
+type IPAMConfig struct {
+	types.IPAM
+	DaemonSocketPath string `json:"daemonSocketPath"`
+	// Daemon is the name of the daemon instance serving the network, which
+	// listens on /run/cni/dhcp-<name>.sock. Running one instance per VRF or
+	// VLAN isolates the networks from each other's daemon.
+	Daemon string `json:"daemon,omitempty"`
+	// When requesting IP from DHCP server, carry these options for management purpose.
+	// Some fields have default values, and can be override by setting a new option with the same name at here.
+	ProvideOptions []ProvideOption `json:"provide"`
+	// When requesting IP from DHCP server, claiming these options are necessary. Options are necessary unless `optional`
+	// is set to `false`.
+	// To override default requesting fields, set `skipDefault` to `false`.
+	// If an field is not optional, but the server failed to provide it, error will be raised.
+	RequestOptions []RequestOption `json:"request"`
+	// Timeout bounds an invocation, see ipam.ExecTimeout
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// DHCPOption represents a DHCP option. It can be a number, or a string defined in manual dhcp-options(5).
+// Note that not all DHCP options are supported at all time. Error will be raised if unsupported options are used.
+type DHCPOption string
+
+type ProvideOption struct {
+	Option DHCPOption `json:"option"`
+
+	Value           string `json:"value"`
+	ValueFromCNIArg string `json:"fromArg"`
+}
+
+type RequestOption struct {
+	SkipDefault bool `json:"skipDefault"`
+
+	Option DHCPOption `json:"option"`
+}
+
+// Main runs the dhcp plugin.
+func Main() {
+	if len(os.Args) > 1 && os.Args[1] == "daemon" {
+		var pidfilePath string
+		var hostPrefix string
+		var socketPath string
+		var instance string
+		var networks string
+		var socketLabel string
+		var broadcast bool
+		var timeout time.Duration
+		var resendMax time.Duration
+		daemonFlags := flag.NewFlagSet("daemon", flag.ExitOnError)
+		daemonFlags.StringVar(&pidfilePath, "pidfile", "", "optional path to write daemon PID to")
+		daemonFlags.StringVar(&hostPrefix, "hostprefix", "", "optional prefix to host root")
+		daemonFlags.StringVar(&socketPath, "socketpath", "", "optional dhcp server socketpath")
+		daemonFlags.StringVar(&instance, "instance", "", "optional instance name, selecting the socketpath /run/cni/dhcp-<instance>.sock")
+		daemonFlags.StringVar(&networks, "networks", "", "optional comma separated names of the only networks to serve")
+		daemonFlags.StringVar(&socketLabel, "selinuxcontext", "", "optional SELinux context to label the socket with, so confined plugins may connect")
+		daemonFlags.BoolVar(&broadcast, "broadcast", false, "broadcast DHCP leases")
+		daemonFlags.DurationVar(&timeout, "timeout", 10*time.Second, "optional dhcp client timeout duration")
+		daemonFlags.DurationVar(&resendMax, "resendmax", resendDelayMax, "optional dhcp client resend max duration")
+		daemonFlags.Parse(os.Args[2:])
+
+		if socketPath == "" {
+			var err error
+			if socketPath, err = instanceSocketPath(instance); err != nil {
+				log.Print(err.Error())
+				os.Exit(1)
+			}
+		} else if instance != "" {
+			log.Print("only one of -socketpath and -instance may be given")
+			os.Exit(1)
+		}
+
+		var served []string
+		if networks != "" {
+			served = strings.Split(networks, ",")
+		}
+
+		if err := runDaemon(pidfilePath, hostPrefix, socketPath, socketLabel, timeout, resendMax, broadcast, served); err != nil {
+			log.Print(err.Error())
+			os.Exit(1)
+		}
+	} else {
+		crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}), version.All, bv.BuildString("dhcp"))
+	}
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	// Plugin must return result in same version as specified in netconf
+	versionDecoder := &version.ConfigDecoder{}
+	confVersion, err := versionDecoder.Decode(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if err := config.ValidateField(args.StdinData, "ipam", &IPAMConfig{}); err != nil {
+		return fmt.Errorf("invalid IPAM configuration: %v", err)
+	}
+
+	result := &current.Result{CNIVersion: current.ImplementedSpecVersion}
+	if err := rpcCall("DHCP.Allocate", args, result); err != nil {
+		return err
+	}
+
+	return types.PrintResult(result, confVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	result := struct{}{}
+	return rpcCall("DHCP.Release", args, &result)
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	// Plugin must return result in same version as specified in netconf
+	versionDecoder := &version.ConfigDecoder{}
+	// confVersion, err := versionDecoder.Decode(args.StdinData)
+	_, err := versionDecoder.Decode(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	result := &current.Result{CNIVersion: current.ImplementedSpecVersion}
+	return rpcCall("DHCP.Allocate", args, result)
+}
+
+func getSocketPath(stdinData []byte) (string, error) {
+	conf := NetConf{}
+	if err := json.Unmarshal(stdinData, &conf); err != nil {
+		return "", fmt.Errorf("error parsing socket path conf: %v", err)
+	}
+	if conf.IPAM == nil {
+		return defaultSocketPath, nil
+	}
+	if conf.IPAM.DaemonSocketPath == "" {
+		return instanceSocketPath(conf.IPAM.Daemon)
+	}
+	if conf.IPAM.Daemon != "" {
+		return "", fmt.Errorf("only one of daemonSocketPath and daemon may be set")
+	}
+	return conf.IPAM.DaemonSocketPath, nil
+}
+
+func rpcCall(method string, args *skel.CmdArgs, result interface{}) error {
+	socketPath, err := getSocketPath(args.StdinData)
+	if err != nil {
+		return fmt.Errorf("error obtaining socketPath: %v", err)
+	}
+
+	client, err := rpc.DialHTTP("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("error dialing DHCP daemon: %v", err)
+	}
+
+	// The daemon may be running under a different working dir
+	// so make sure the netns path is absolute.
+	netns, err := filepath.Abs(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to make %q an absolute path: %v", args.Netns, err)
+	}
+	args.Netns = netns
+
+	err = client.Call(method, args, result)
+	if err != nil {
+		return fmt.Errorf("error calling %v: %v", method, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostlocal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+)
+
+// parsePrevResult returns the prevResult of the network configuration, or
+// nil if there is none.
+func parsePrevResult(stdin []byte) (*current.Result, error) {
+	conf := types.NetConf{}
+	if err := json.Unmarshal(stdin, &conf); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+	}
+	if conf.RawPrevResult == nil {
+		return nil, nil
+	}
+	if err := version.ParsePrevResult(&conf); err != nil {
+		return nil, fmt.Errorf("could not parse prevResult: %v", err)
+	}
+	result, err := current.NewResultFromResult(conf.PrevResult)
+	if err != nil {
+		return nil, fmt.Errorf("could not convert result to current version: %v", err)
+	}
+	return result, nil
+}
+
+// diffAllocation compares the addresses allocated to the attachment from
+// each range set with the ones in prevResult and describes every
+// difference: addresses missing on either side, and addresses whose prefix
+// or gateway differ. Addresses of prevResult outside of all range sets are
+// another IPAM's and ignored. The store must be locked.
+func diffAllocation(ipamConf *allocator.IPAMConfig, store *disk.Store, id, ifName string, prev *current.Result) []string {
+	var diffs []string
+
+	for idx := range ipamConf.Ranges {
+		rangeset := &ipamConf.Ranges[idx]
+		alloc := allocator.NewIPAllocator(rangeset, store, idx)
+
+		// addresses on both sides are compared, the others are paired
+		// up in order, e.g. an address which changed
+		var allocated, found []*current.IPConfig
+		matched := map[string]*current.IPConfig{}
+		all := alloc.AllocatedAll(id, ifName)
+		for _, ipc := range prev.IPs {
+			if !rangeset.Contains(ipc.Address.IP) {
+				continue
+			}
+			if containsIP(all, ipc.Address.IP) {
+				matched[ipc.Address.IP.String()] = ipc
+			} else {
+				found = append(found, ipc)
+			}
+		}
+		for _, ipc := range all {
+			f, ok := matched[ipc.Address.IP.String()]
+			if !ok {
+				allocated = append(allocated, ipc)
+				continue
+			}
+			if prefixLen(f.Address) != prefixLen(ipc.Address) {
+				diffs = append(diffs, fmt.Sprintf("prevResult has %s, allocated is %s", f.Address.String(), ipc.Address.String()))
+			}
+			if !f.Gateway.Equal(ipc.Gateway) {
+				diffs = append(diffs, fmt.Sprintf("gateway of %s is %s in prevResult, allocated is %s", f.Address.IP, ipString(f.Gateway), ipString(ipc.Gateway)))
+			}
+		}
+
+		for len(found) > 0 && len(allocated) > 0 {
+			diffs = append(diffs, fmt.Sprintf("prevResult has %s, allocated is %s", found[0].Address.String(), allocated[0].Address.String()))
+			found, allocated = found[1:], allocated[1:]
+		}
+		for _, f := range found {
+			diffs = append(diffs, fmt.Sprintf("%s of prevResult is not allocated", f.Address.String()))
+		}
+		for _, a := range allocated {
+			diffs = append(diffs, fmt.Sprintf("allocated %s is missing from prevResult", a.Address.String()))
+		}
+	}
+	return diffs
+}
+
+func prefixLen(ipn net.IPNet) int {
+	ones, _ := ipn.Mask.Size()
+	return ones
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return "none"
+	}
+	return ip.String()
+}
+
+// checkPrevResult fails with the differences between the allocation and
+// prevResult, if any.
+func checkPrevResult(ipamConf *allocator.IPAMConfig, store *disk.Store, id, ifName string, prev *current.Result) error {
+	if diffs := diffAllocation(ipamConf, store, id, ifName, prev); len(diffs) > 0 {
+		return fmt.Errorf("host-local: allocation of container %v doesn't match prevResult: %s", id, strings.Join(diffs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostlocal
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+)
+
+// resolvConfVars are the variables that may be interpolated into a
+// resolv.conf, e.g. "nameserver ${NODE_IP}" for a node-local DNS cache. They
+// are taken from the environment of the plugin; NODE_NAME defaults to the
+// hostname.
+var resolvConfVars = []string{"NODE_NAME", "NODE_IP", "NODE_IPV6"}
+
+// parseResolvConf parses an existing resolv.conf in to a DNS struct.
+// sortlist lines are checked but dropped, as a CNI result can't carry them.
+func parseResolvConf(filename string) (*types.DNS, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	dns := types.DNS{}
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		line := scanner.Text()
+		line = strings.TrimSpace(line)
+
+		// Skip comments, empty lines
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		line, err = interpolateResolvConf(line)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", filename, err)
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			dns.Nameservers = append(dns.Nameservers, fields[1])
+		case "domain":
+			dns.Domain = fields[1]
+		case "search":
+			dns.Search = append(dns.Search, fields[1:]...)
+		case "options":
+			for _, opt := range fields[1:] {
+				if err := checkResolvOption(opt); err != nil {
+					return nil, fmt.Errorf("failed to parse %s: %v", filename, err)
+				}
+				dns.Options = setResolvOption(dns.Options, opt)
+			}
+		case "sortlist":
+			for _, entry := range fields[1:] {
+				if err := checkSortlistEntry(entry); err != nil {
+					return nil, fmt.Errorf("failed to parse %s: %v", filename, err)
+				}
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &dns, nil
+}
+
+// interpolateResolvConf replaces ${VAR} by the value of one of the
+// resolvConfVars.
+func interpolateResolvConf(line string) (string, error) {
+	var err error
+	line = os.Expand(line, func(name string) string {
+		if !slices.Contains(resolvConfVars, name) {
+			if err == nil {
+				err = fmt.Errorf("unknown variable %q, must be one of %q", name, resolvConfVars)
+			}
+			return ""
+		}
+		value := os.Getenv(name)
+		if value == "" && name == "NODE_NAME" {
+			value, _ = os.Hostname()
+		}
+		if value == "" && err == nil {
+			err = fmt.Errorf("variable %q is not set", name)
+		}
+		return value
+	})
+	return line, err
+}
+
+// setResolvOption adds opt to options. Like the resolver, a later option
+// overrides an earlier one of the same name, e.g. "ndots:5" overrides
+// "ndots:1".
+func setResolvOption(options []string, opt string) []string {
+	name, _, _ := strings.Cut(opt, ":")
+	options = slices.DeleteFunc(options, func(o string) bool {
+		n, _, _ := strings.Cut(o, ":")
+		return n == name
+	})
+	return append(options, opt)
+}
+
+// checkResolvOption validates the value of the numeric options.
+func checkResolvOption(opt string) error {
+	name, value, ok := strings.Cut(opt, ":")
+	switch name {
+	case "ndots", "timeout", "attempts":
+		if n, err := strconv.Atoi(value); !ok || err != nil || n < 0 {
+			return fmt.Errorf("invalid option %q", opt)
+		}
+	}
+	return nil
+}
+
+// checkSortlistEntry validates a sortlist "address[/netmask]" entry.
+func checkSortlistEntry(entry string) error {
+	addr, mask, hasMask := strings.Cut(entry, "/")
+	if net.ParseIP(addr) == nil || (hasMask && net.ParseIP(mask) == nil) {
+		return fmt.Errorf("invalid sortlist entry %q", entry)
+	}
+	return nil
+}
+
+// mergeDNS combines the DNS read from resolvConf, nil if none is configured,
+// with the provided DNS according to the dnsPolicy.
+func mergeDNS(policy string, provided []types.DNS, resolv *types.DNS) types.DNS {
+	switch policy {
+	case allocator.DNSAppend:
+		if resolv != nil {
+			provided = append(provided, *resolv)
+		}
+		return appendDNS(provided)
+	case allocator.DNSIgnore:
+		if dns := appendDNS(provided); !dns.IsEmpty() || resolv == nil {
+			return dns
+		}
+		return *resolv
+	}
+	if resolv == nil {
+		return types.DNS{}
+	}
+	return *resolv
+}
+
+// appendDNS concatenates the DNS settings, dropping duplicate entries. The
+// first domain set wins.
+func appendDNS(all []types.DNS) types.DNS {
+	dns := types.DNS{}
+	for _, d := range all {
+		if dns.Domain == "" {
+			dns.Domain = d.Domain
+		}
+		dns.Nameservers = appendUnique(dns.Nameservers, d.Nameservers)
+		dns.Search = appendUnique(dns.Search, d.Search)
+		dns.Options = appendUnique(dns.Options, d.Options)
+	}
+	return dns
+}
+
+func appendUnique(list, items []string) []string {
+	for _, item := range items {
+		if !slices.Contains(list, item) {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,149 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostlocal
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+)
+
+var _ = Describe("parsing resolv.conf", func() {
+	It("parses a simple resolv.conf file", func() {
+		contents := `
+		nameserver 192.0.2.0
+		nameserver 192.0.2.1
+		`
+		dns, err := parse(contents)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*dns).Should(Equal(types.DNS{Nameservers: []string{"192.0.2.0", "192.0.2.1"}}))
+	})
+	It("ignores comments", func() {
+		dns, err := parse(`
+nameserver 192.0.2.0
+;nameserver 192.0.2.1
+`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*dns).Should(Equal(types.DNS{Nameservers: []string{"192.0.2.0"}}))
+	})
+	It("parses all fields", func() {
+		dns, err := parse(`
+nameserver 192.0.2.0
+nameserver 192.0.2.2
+domain example.com
+;nameserver comment
+#nameserver comment
+search example.net example.org
+search example.gov
+options one two three
+options four
+`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*dns).Should(Equal(types.DNS{
+			Nameservers: []string{"192.0.2.0", "192.0.2.2"},
+			Domain:      "example.com",
+			Search:      []string{"example.net", "example.org", "example.gov"},
+			Options:     []string{"one", "two", "three", "four"},
+		}))
+	})
+	It("lets later options override earlier ones", func() {
+		dns, err := parse(`
+options ndots:1 edns0
+options ndots:5 timeout:2
+`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dns.Options).To(Equal([]string{"edns0", "ndots:5", "timeout:2"}))
+
+		_, err = parse("options ndots:many\n")
+		Expect(err).To(MatchError(ContainSubstring(`invalid option "ndots:many"`)))
+	})
+	It("checks but drops sortlist entries", func() {
+		dns, err := parse(`
+nameserver 192.0.2.0
+sortlist 130.155.160.0/255.255.240.0 130.155.0.0
+`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*dns).Should(Equal(types.DNS{Nameservers: []string{"192.0.2.0"}}))
+
+		_, err = parse("sortlist 130.155.160.0/20\n")
+		Expect(err).To(MatchError(ContainSubstring(`invalid sortlist entry "130.155.160.0/20"`)))
+	})
+	It("interpolates the allowed variables", func() {
+		os.Setenv("NODE_IP", "192.0.2.10")
+		DeferCleanup(os.Unsetenv, "NODE_IP")
+
+		dns, err := parse(`
+nameserver ${NODE_IP}
+nameserver 192.0.2.1
+`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dns.Nameservers).To(Equal([]string{"192.0.2.10", "192.0.2.1"}))
+
+		_, err = parse("nameserver ${NODE_IPV6}\n")
+		Expect(err).To(MatchError(ContainSubstring(`variable "NODE_IPV6" is not set`)))
+		_, err = parse("nameserver ${HOME}\n")
+		Expect(err).To(MatchError(ContainSubstring(`unknown variable "HOME"`)))
+	})
+})
+
+var _ = Describe("merging DNS", func() {
+	resolv := &types.DNS{
+		Nameservers: []string{"192.0.2.53"},
+		Domain:      "node.local",
+		Search:      []string{"node.local"},
+	}
+	provided := []types.DNS{
+		{Nameservers: []string{"10.96.0.10"}, Search: []string{"svc.cluster.local"}},
+		{Nameservers: []string{"10.96.0.10"}, Options: []string{"ndots:5"}},
+	}
+
+	It("replaces the provided DNS by default", func() {
+		Expect(mergeDNS("", provided, resolv)).To(Equal(*resolv))
+		Expect(mergeDNS(allocator.DNSReplace, provided, nil)).To(Equal(types.DNS{}))
+	})
+
+	It("appends the resolv.conf DNS to the provided DNS", func() {
+		Expect(mergeDNS(allocator.DNSAppend, provided, resolv)).To(Equal(types.DNS{
+			Nameservers: []string{"10.96.0.10", "192.0.2.53"},
+			Domain:      "node.local",
+			Search:      []string{"svc.cluster.local", "node.local"},
+			Options:     []string{"ndots:5"},
+		}))
+	})
+
+	It("ignores the resolv.conf DNS unless none is provided", func() {
+		Expect(mergeDNS(allocator.DNSIgnore, provided, resolv).Nameservers).To(Equal([]string{"10.96.0.10"}))
+		Expect(mergeDNS(allocator.DNSIgnore, []types.DNS{{}}, resolv)).To(Equal(*resolv))
+	})
+})
+
+func parse(contents string) (*types.DNS, error) {
+	f, err := os.CreateTemp("", "host_local_resolv")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(contents); err != nil {
+		return nil, err
+	}
+
+	return parseResolvConf(f.Name())
+}
@@ -0,0 +1,279 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostlocal
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+)
+
+// Kinds of the problems "host-local doctor" finds.
+const (
+	// ProblemCrossLinked is an address with several lease files, spelling
+	// it differently
+	ProblemCrossLinked = "CrossLinked"
+	// ProblemOrphanLastReserved is a last reserved address of a range set
+	// the network no longer has, or outside of it
+	ProblemOrphanLastReserved = "OrphanLastReserved"
+	// ProblemOutOfRange is a lease on an address of none of the range sets
+	// of the network
+	ProblemOutOfRange = "OutOfRange"
+)
+
+// Problem is an inconsistency of the store of a network.
+type Problem struct {
+	Kind    string   `json:"kind"`
+	IP      string   `json:"ip,omitempty"`
+	RangeID string   `json:"rangeID,omitempty"`
+	Holders []string `json:"holders,omitempty"`
+	Detail  string   `json:"detail"`
+	Fixed   bool     `json:"fixed,omitempty"`
+}
+
+func (p Problem) String() string {
+	subject := p.IP
+	if p.RangeID != "" {
+		subject = "range set " + p.RangeID
+	}
+	s := fmt.Sprintf("%s %s: %s", p.Kind, subject, p.Detail)
+	if p.Fixed {
+		s += " (fixed)"
+	}
+	return s
+}
+
+// DoctorReport is the outcome of "host-local doctor" for a network.
+type DoctorReport struct {
+	Network  string    `json:"network"`
+	Problems []Problem `json:"problems"`
+}
+
+// runDoctor implements "host-local doctor", which checks the store of a
+// network against itself and the configuration:
+//
+//	host-local doctor -config /etc/cni/net.d/10-mynet.conflist
+//	host-local doctor -config /etc/cni/net.d/10-mynet.conflist -fix -json
+//
+// With -fix, the problems which can be repaired without taking an address
+// from a container that may use it are: duplicate lease files of the same
+// attachment are removed, and orphan last reserved addresses forgotten.
+// Addresses leased to several containers or outside of the ranges are left
+// to the operator, see "host-local release". It fails if problems are
+// left.
+func runDoctor(args []string, out io.Writer) error {
+	var configFile string
+	var fix, asJSON bool
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.StringVar(&configFile, "config", "", "network configuration file")
+	flags.BoolVar(&fix, "fix", false, "repair the problems which can be repaired safely")
+	flags.BoolVar(&asJSON, "json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if configFile == "" {
+		return fmt.Errorf("-config is required")
+	}
+
+	data, err := loadReportConf(configFile)
+	if err != nil {
+		return err
+	}
+	ipamConf, _, err := allocator.LoadIPAMConfig(data, "")
+	if err != nil {
+		return err
+	}
+	store, err := openStore(ipamConf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err := store.Lock(); err != nil {
+		return err
+	}
+	defer store.Unlock()
+	if err := allocator.ResolveGeneratedRanges(ipamConf, store); err != nil {
+		return err
+	}
+
+	problems, err := diagnose(ipamConf, store, fix)
+	if err != nil {
+		return fmt.Errorf("failed to check network %s: %v", ipamConf.Name, err)
+	}
+
+	if asJSON {
+		report := DoctorReport{Network: ipamConf.Name, Problems: problems}
+		if report.Problems == nil {
+			report.Problems = []Problem{}
+		}
+		if err := json.NewEncoder(out).Encode(report); err != nil {
+			return err
+		}
+	} else {
+		for _, p := range problems {
+			fmt.Fprintln(out, p)
+		}
+	}
+
+	left := 0
+	for _, p := range problems {
+		if !p.Fixed {
+			left++
+		}
+	}
+	if left > 0 {
+		return fmt.Errorf("%d problems of network %s are left", left, ipamConf.Name)
+	}
+	return nil
+}
+
+// diagnose returns the problems of the store, repairing the safe ones with
+// fix. The store must be locked.
+func diagnose(ipamConf *allocator.IPAMConfig, store *disk.Store, fix bool) ([]Problem, error) {
+	var problems []Problem
+
+	files, err := store.LeaseFiles()
+	if err != nil {
+		return nil, err
+	}
+	byIP := map[string][]disk.LeaseFile{}
+	var ips []string
+	for _, f := range files {
+		if byIP[f.IP] == nil {
+			ips = append(ips, f.IP)
+		}
+		byIP[f.IP] = append(byIP[f.IP], f)
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		if len(byIP[ip]) < 2 {
+			continue
+		}
+		p, err := crossLinked(store, byIP[ip], fix)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, p)
+	}
+
+	lastIPs, err := store.LastReservedIPs()
+	if err != nil {
+		return nil, err
+	}
+	rangeIDs := make([]string, 0, len(lastIPs))
+	for rangeID := range lastIPs {
+		rangeIDs = append(rangeIDs, rangeID)
+	}
+	sort.Strings(rangeIDs)
+	for _, rangeID := range rangeIDs {
+		detail := orphanLastReserved(ipamConf, rangeID, lastIPs[rangeID])
+		if detail == "" {
+			continue
+		}
+		p := Problem{Kind: ProblemOrphanLastReserved, RangeID: rangeID, Detail: detail}
+		if fix {
+			if err := store.RemoveLastReservedIP(rangeID); err != nil {
+				return nil, err
+			}
+			p.Fixed = true
+		}
+		problems = append(problems, p)
+	}
+
+	leases, err := store.Leases()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range leases {
+		if inRanges(ipamConf, net.ParseIP(l.IP)) {
+			continue
+		}
+		problems = append(problems, Problem{
+			Kind:    ProblemOutOfRange,
+			IP:      l.IP,
+			Holders: []string{l.String()},
+			Detail:  "leased outside of the ranges of the network, release it once its container is gone",
+		})
+	}
+	return problems, nil
+}
+
+// crossLinked returns the problem of an address with several lease files.
+// With fix, the files other than the canonical one are removed if they are
+// all of the same attachment.
+func crossLinked(store *disk.Store, files []disk.LeaseFile, fix bool) (Problem, error) {
+	p := Problem{Kind: ProblemCrossLinked, IP: files[0].IP}
+	var names []string
+	var canonical *disk.LeaseFile
+	holders := map[string]bool{}
+	for i, f := range files {
+		names = append(names, f.Name)
+		holder := f.ID + "/" + f.IfName
+		if !holders[holder] {
+			holders[holder] = true
+			p.Holders = append(p.Holders, holder)
+		}
+		if f.Canonical() {
+			canonical = &files[i]
+		}
+	}
+	sort.Strings(p.Holders)
+	p.Detail = "leased in the files " + strings.Join(names, ", ")
+	if len(p.Holders) > 1 {
+		p.Detail += " to several containers, only one of them can use it"
+		return p, nil
+	}
+	if canonical == nil {
+		p.Detail += ", none of them the one the store uses"
+		return p, nil
+	}
+	if fix {
+		for _, f := range files {
+			if f.Name == canonical.Name {
+				continue
+			}
+			if err := store.RemoveLeaseFile(f.Name); err != nil {
+				return p, err
+			}
+		}
+		p.Fixed = true
+	}
+	return p, nil
+}
+
+// orphanLastReserved tells what is wrong with the last reserved address of
+// a range set, or returns "" if nothing is.
+func orphanLastReserved(ipamConf *allocator.IPAMConfig, rangeID string, ip net.IP) string {
+	idx, err := strconv.Atoi(rangeID)
+	if err != nil || idx < 0 || idx >= len(ipamConf.Ranges) {
+		return "the network has no such range set"
+	}
+	if ip == nil {
+		return "the last reserved address can't be read"
+	}
+	if !ipamConf.Ranges[idx].Contains(ip) {
+		return fmt.Sprintf("the last reserved address %s is outside of the range set", ip)
+	}
+	return ""
+}
@@ -0,0 +1,104 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostlocal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/annotations"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+)
+
+// reclaimExpired releases the addresses whose leases expired, and removes
+// the expiry files and annotations of their attachments. The store must be
+// locked.
+func reclaimExpired(ipamConf *allocator.IPAMConfig, store *disk.Store) error {
+	reclaimed, err := store.ReclaimExpired(time.Now())
+	for _, e := range reclaimed {
+		if e.File != "" {
+			_ = os.Remove(e.File)
+		}
+		if ipamConf.Annotate {
+			_ = annotations.Remove(ipamConf.AnnotationsDir, ipamConf.Name, e.ID, e.IfName)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reclaim expired leases: %v", err)
+	}
+	return nil
+}
+
+// recordExpiry starts the leases of the addresses of an ADD, renewing those
+// it reused, sets their expiry in the annotations and writes the expiry
+// file of the attachment. The store must be locked.
+func recordExpiry(ipamConf *allocator.IPAMConfig, store *disk.Store, containerID, ifName string, annotated []annotations.Address) error {
+	until := time.Now().Add(ipamConf.LeaseTTL.Expire).UTC().Truncate(time.Second)
+	file := ipamConf.ExpiryFileOf(containerID, ifName)
+
+	expiries := make([]disk.Expiry, 0, len(annotated))
+	for i := range annotated {
+		annotated[i].Expires = until.Format(time.RFC3339)
+		expiries = append(expiries, disk.Expiry{IP: annotated[i].IP, ID: containerID, IfName: ifName, Until: until, File: file})
+	}
+	if err := store.SetExpiries(expiries); err != nil {
+		return fmt.Errorf("failed to record the expiry of the leases: %v", err)
+	}
+	if file == "" {
+		return nil
+	}
+	if err := writeExpiryFile(file, until); err != nil {
+		return fmt.Errorf("failed to write the expiry file: %v", err)
+	}
+	return nil
+}
+
+// forgetExpiry drops the expiries of the attachment's leases and removes
+// its expiry file. The store must be locked.
+func forgetExpiry(store *disk.Store, containerID, ifName string) error {
+	dropped, err := store.DropExpiries(containerID, ifName)
+	if err != nil {
+		return err
+	}
+	for _, e := range dropped {
+		if e.File == "" {
+			continue
+		}
+		if err := os.Remove(e.File); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeExpiryFile replaces file with the expiry, readable by the pod it is
+// mounted into.
+func writeExpiryFile(file string, until time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, []byte(until.Format(time.RFC3339)+"\n"), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
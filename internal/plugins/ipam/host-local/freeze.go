@@ -0,0 +1,82 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostlocal
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+)
+
+// runFreeze implements "host-local freeze" and "host-local thaw", which
+// stop and resume the allocation of addresses of a network, e.g. while its
+// store is backed up or migrated during a node drain. ADDs fail with a
+// retryable error while the network is frozen, DELs and GC go on:
+//
+//	host-local freeze -network mynet -reason "node drain"
+//	host-local thaw -network mynet
+func runFreeze(args []string, out io.Writer, freeze bool) error {
+	var sf snapshotFlags
+	var reason string
+	name := "thaw"
+	if freeze {
+		name = "freeze"
+	}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.StringVar(&sf.network, "network", "", "name of the network")
+	flags.StringVar(&sf.dataDir, "datadir", "", "optional data directory of the network")
+	if freeze {
+		flags.StringVar(&reason, "reason", "", "reason reported to the ADDs refused")
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	store, err := sf.openLocked()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	defer store.Unlock()
+
+	if !freeze {
+		if err := store.Thaw(); err != nil {
+			return fmt.Errorf("failed to thaw network %s: %v", sf.network, err)
+		}
+		fmt.Fprintf(out, "thawed network %s\n", sf.network)
+		return nil
+	}
+	if err := store.Freeze(reason); err != nil {
+		return fmt.Errorf("failed to freeze network %s: %v", sf.network, err)
+	}
+	fmt.Fprintf(out, "froze network %s\n", sf.network)
+	return nil
+}
+
+// frozenError describes the freeze of a network to the ADDs it refuses.
+func frozenError(network string, f disk.Freeze) error {
+	msg := fmt.Sprintf("network %s is frozen", network)
+	if !f.Since.IsZero() {
+		msg += " since " + f.Since.Format(time.RFC3339)
+	}
+	if f.Reason != "" {
+		msg += ": " + f.Reason
+	}
+	return fmt.Errorf("%s, no addresses are allocated until it is thawed", msg)
+}
@@ -0,0 +1,77 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostlocal
+
+import (
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/annotations"
+	cnierrors "github.com/containernetworking/plugins/pkg/errors"
+	"github.com/containernetworking/plugins/pkg/gc"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+)
+
+// cmdGC releases the leases of all attachments the runtime no longer
+// lists, including those on addresses handed over to a newer container.
+func cmdGC(args *skel.CmdArgs) error {
+	ipamConf, _, err := allocator.LoadIPAMConfig(args.StdinData, args.Args)
+	if err != nil {
+		return err
+	}
+	valid, err := gc.ValidAttachments(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	store, err := openStore(ipamConf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	ctx, cancel := ipam.InvocationContext(ipamConf.ExecTimeout)
+	defer cancel()
+
+	if err := store.LockContext(ctx); err != nil {
+		return cnierrors.StoreUnavailable(err)
+	}
+	defer store.Unlock()
+
+	err = gc.Collect(valid, store.Attachments, func(a types.GCAttachment) error {
+		released := store.GetByID(a.ContainerID, a.IfName)
+		if err := store.ReleaseByID(a.ContainerID, a.IfName); err != nil {
+			return err
+		}
+		if ipamConf.Quarantine != nil {
+			if err := quarantine(ipamConf, store, a.ContainerID, a.IfName, released); err != nil {
+				return err
+			}
+		}
+		if ipamConf.Annotate {
+			if err := annotations.Remove(ipamConf.AnnotationsDir, ipamConf.Name, a.ContainerID, a.IfName); err != nil {
+				return err
+			}
+		}
+		if ipamConf.LeaseTTL != nil {
+			if err := forgetExpiry(store, a.ContainerID, a.IfName); err != nil {
+				return err
+			}
+		}
+		return store.ReleaseHandover(a.ContainerID, a.IfName)
+	})
+	mirror(ipamConf, store)
+	return err
+}
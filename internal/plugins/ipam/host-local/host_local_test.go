@@ -0,0 +1,2200 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostlocal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/annotations"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+)
+
+const LineBreak = "\r\n"
+
+var _ = Describe("host-local Operations", func() {
+	var tmpDir string
+	const (
+		ifname string = "eth0"
+		nspath string = "/some/where"
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "host-local_test")
+		Expect(err).NotTo(HaveOccurred())
+		tmpDir = filepath.ToSlash(tmpDir)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	for _, ver := range testutils.AllSpecVersions {
+		// Redefine ver inside for scope so real value is picked up by each dynamically defined It()
+		// See Gingkgo's "Patterns for dynamically generating tests" documentation.
+		ver := ver
+
+		It(fmt.Sprintf("[%s] allocates and releases addresses with ADD/DEL", ver), func() {
+			err := os.WriteFile(filepath.Join(tmpDir, "resolv.conf"), []byte("nameserver 192.0.2.3"), 0o644)
+			Expect(err).NotTo(HaveOccurred())
+
+			conf := fmt.Sprintf(`{
+			"cniVersion": "%s",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"dataDir": "%s",
+					"resolvConf": "%s/resolv.conf",
+					"ranges": [
+						[{ "subnet": "10.1.2.0/24" }, {"subnet": "10.2.2.0/24"}],
+						[{ "subnet": "2001:db8:1::0/64" }]
+					],
+					"routes": [
+						{"dst": "0.0.0.0/0"},
+						{"dst": "::/0"},
+						{"dst": "192.168.0.0/16", "gw": "1.1.1.1"},
+						{"dst": "2001:db8:2::0/64", "gw": "2001:db8:3::1"}
+					]
+				}
+			}`, ver, tmpDir, tmpDir)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+			}
+
+			// Allocate the IP
+			r, raw, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			if testutils.SpecVersionHasIPVersion(ver) {
+				Expect(strings.Index(string(raw), "\"version\":")).Should(BeNumerically(">", 0))
+			}
+
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			// Gomega is cranky about slices with different caps
+			Expect(*result.IPs[0]).To(Equal(
+				types100.IPConfig{
+					Address: mustCIDR("10.1.2.2/24"),
+					Gateway: net.ParseIP("10.1.2.1"),
+				}))
+
+			Expect(*result.IPs[1]).To(Equal(
+				types100.IPConfig{
+					Address: mustCIDR("2001:db8:1::2/64"),
+					Gateway: net.ParseIP("2001:db8:1::1"),
+				},
+			))
+			Expect(result.IPs).To(HaveLen(2))
+
+			for _, expectedRoute := range []*types.Route{
+				{Dst: mustCIDR("0.0.0.0/0"), GW: nil},
+				{Dst: mustCIDR("::/0"), GW: nil},
+				{Dst: mustCIDR("192.168.0.0/16"), GW: net.ParseIP("1.1.1.1")},
+				{Dst: mustCIDR("2001:db8:2::0/64"), GW: net.ParseIP("2001:db8:3::1")},
+			} {
+				found := false
+				for _, foundRoute := range result.Routes {
+					if foundRoute.String() == expectedRoute.String() {
+						found = true
+						break
+					}
+				}
+				Expect(found).To(BeTrue())
+			}
+
+			ipFilePath1 := filepath.Join(tmpDir, "mynet", "10.1.2.2")
+			contents, err := os.ReadFile(ipFilePath1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal(args.ContainerID + LineBreak + ifname))
+
+			ipFilePath2 := filepath.Join(tmpDir, disk.GetEscapedPath("mynet", "2001:db8:1::2"))
+			contents, err = os.ReadFile(ipFilePath2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal(args.ContainerID + LineBreak + ifname))
+
+			lastFilePath1 := filepath.Join(tmpDir, "mynet", "last_reserved_ip.0")
+			contents, err = os.ReadFile(lastFilePath1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal("10.1.2.2"))
+
+			lastFilePath2 := filepath.Join(tmpDir, "mynet", "last_reserved_ip.1")
+			contents, err = os.ReadFile(lastFilePath2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal("2001:db8:1::2"))
+			// Release the IP
+			err = testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = os.Stat(ipFilePath1)
+			Expect(err).To(HaveOccurred())
+			_, err = os.Stat(ipFilePath2)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It(fmt.Sprintf("[%s] allocates and releases addresses on specific interface with ADD/DEL", ver), func() {
+			const ifname1 string = "eth1"
+
+			err := os.WriteFile(filepath.Join(tmpDir, "resolv.conf"), []byte("nameserver 192.0.2.3"), 0o644)
+			Expect(err).NotTo(HaveOccurred())
+
+			conf0 := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet0",
+				"type": "ipvlan",
+				"master": "foo0",
+					"ipam": {
+						"type": "host-local",
+						"dataDir": "%s",
+						"resolvConf": "%s/resolv.conf",
+						"ranges": [
+							[{ "subnet": "10.1.2.0/24" }]
+						]
+					}
+			}`, ver, tmpDir, tmpDir)
+
+			conf1 := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet1",
+				"type": "ipvlan",
+				"master": "foo1",
+					"ipam": {
+						"type": "host-local",
+						"dataDir": "%s",
+						"resolvConf": "%s/resolv.conf",
+						"ranges": [
+							[{ "subnet": "10.2.2.0/24" }]
+						]
+					}
+			}`, ver, tmpDir, tmpDir)
+
+			args0 := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf0),
+			}
+
+			// Allocate the IP
+			r0, raw, err := testutils.CmdAddWithArgs(args0, func() error {
+				return cmdAdd(args0)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			if testutils.SpecVersionHasIPVersion(ver) {
+				Expect(strings.Index(string(raw), "\"version\":")).Should(BeNumerically(">", 0))
+			}
+
+			_, err = types100.GetResult(r0)
+			Expect(err).NotTo(HaveOccurred())
+
+			args1 := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       nspath,
+				IfName:      ifname1,
+				StdinData:   []byte(conf1),
+			}
+
+			// Allocate the IP
+			r1, raw, err := testutils.CmdAddWithArgs(args1, func() error {
+				return cmdAdd(args1)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			if testutils.SpecVersionHasIPVersion(ver) {
+				Expect(strings.Index(string(raw), "\"version\":")).Should(BeNumerically(">", 0))
+			}
+
+			_, err = types100.GetResult(r1)
+			Expect(err).NotTo(HaveOccurred())
+
+			ipFilePath0 := filepath.Join(tmpDir, "mynet0", "10.1.2.2")
+			contents, err := os.ReadFile(ipFilePath0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal(args0.ContainerID + LineBreak + ifname))
+
+			ipFilePath1 := filepath.Join(tmpDir, "mynet1", "10.2.2.2")
+			contents, err = os.ReadFile(ipFilePath1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal(args1.ContainerID + LineBreak + ifname1))
+
+			// Release the IP on ifname
+			err = testutils.CmdDelWithArgs(args0, func() error {
+				return cmdDel(args0)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = os.Stat(ipFilePath0)
+			Expect(err).To(HaveOccurred())
+
+			// reread ipFilePath1, ensure that ifname1 didn't get deleted
+			contents, err = os.ReadFile(ipFilePath1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal(args1.ContainerID + LineBreak + ifname1))
+
+			// Release the IP on ifname1
+			err = testutils.CmdDelWithArgs(args1, func() error {
+				return cmdDel(args1)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = os.Stat(ipFilePath1)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It(fmt.Sprintf("[%s] repeat allocating addresses on specific interface for same container ID with ADD", ver), func() {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet0",
+				"type": "ipvlan",
+				"master": "foo0",
+					"ipam": {
+						"type": "host-local",
+						"dataDir": "%s",
+						"ranges": [
+							[{ "subnet": "10.1.2.0/24" }]
+						]
+					}
+			}`, ver, tmpDir)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+			}
+
+			args1 := &skel.CmdArgs{
+				ContainerID: "dummy1",
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+			}
+
+			// Allocate the IP
+			r0, raw, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			if testutils.SpecVersionHasIPVersion(ver) {
+				Expect(strings.Index(string(raw), "\"version\":")).Should(BeNumerically(">", 0))
+			}
+
+			result0, err := types100.GetResult(r0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result0.IPs).Should(HaveLen(1))
+			Expect(result0.IPs[0].Address.String()).Should(Equal("10.1.2.2/24"))
+
+			// Allocate the IP with the same container ID
+			_, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(HaveOccurred())
+
+			// Allocate the IP with the another container ID
+			r1, raw, err := testutils.CmdAddWithArgs(args1, func() error {
+				return cmdAdd(args1)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			if testutils.SpecVersionHasIPVersion(ver) {
+				Expect(strings.Index(string(raw), "\"version\":")).Should(BeNumerically(">", 0))
+			}
+
+			result1, err := types100.GetResult(r1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result1.IPs).Should(HaveLen(1))
+			Expect(result1.IPs[0].Address.String()).Should(Equal("10.1.2.3/24"))
+
+			// Allocate the IP with the same container ID again
+			_, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(HaveOccurred())
+
+			ipFilePath := filepath.Join(tmpDir, "mynet0", "10.1.2.2")
+
+			// Release the IPs
+			err = testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = os.Stat(ipFilePath)
+			Expect(err).To(HaveOccurred())
+
+			err = testutils.CmdDelWithArgs(args1, func() error {
+				return cmdDel(args1)
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It(fmt.Sprintf("[%s] verify DEL works on backwards compatible allocate", ver), func() {
+			err := os.WriteFile(filepath.Join(tmpDir, "resolv.conf"), []byte("nameserver 192.0.2.3"), 0o644)
+			Expect(err).NotTo(HaveOccurred())
+
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo",
+					"ipam": {
+						"type": "host-local",
+						"dataDir": "%s",
+						"resolvConf": "%s/resolv.conf",
+						"ranges": [
+							[{ "subnet": "10.1.2.0/24" }]
+						]
+					}
+			}`, ver, tmpDir, tmpDir)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+			}
+
+			// Allocate the IP
+			r, raw, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			if testutils.SpecVersionHasIPVersion(ver) {
+				Expect(strings.Index(string(raw), "\"version\":")).Should(BeNumerically(">", 0))
+			}
+
+			_, err = types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			ipFilePath := filepath.Join(tmpDir, "mynet", "10.1.2.2")
+			contents, err := os.ReadFile(ipFilePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal(args.ContainerID + LineBreak + ifname))
+			err = os.WriteFile(ipFilePath, []byte(strings.TrimSpace(args.ContainerID)), 0o644)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = os.Stat(ipFilePath)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It(fmt.Sprintf("[%s] doesn't error when passed an unknown ID on DEL", ver), func() {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.2.0/24",
+					"dataDir": "%s"
+				}
+			}`, ver, tmpDir)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+			}
+
+			// Release the IP
+			err := testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It(fmt.Sprintf("[%s] ignores whitespace in disk files", ver), func() {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.2.0/24",
+					"dataDir": "%s"
+				}
+			}`, ver, tmpDir)
+
+			args := &skel.CmdArgs{
+				ContainerID: "   dummy\n ",
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+			}
+
+			// Allocate the IP
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			ipFilePath := filepath.Join(tmpDir, "mynet", result.IPs[0].Address.IP.String())
+			contents, err := os.ReadFile(ipFilePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal("dummy" + LineBreak + ifname))
+
+			// Release the IP
+			err = testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = os.Stat(ipFilePath)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It(fmt.Sprintf("[%s] does not output an error message upon initial subnet creation", ver), func() {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.2.0/24",
+					"dataDir": "%s"
+				}
+			}`, ver, tmpDir)
+
+			args := &skel.CmdArgs{
+				ContainerID: "testing",
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+			}
+
+			// Allocate the IP
+			_, out, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(strings.Index(string(out), "Error retrieving last reserved ip")).To(Equal(-1))
+		})
+
+		It(fmt.Sprintf("[%s] allocates a custom IP when requested by config args", ver), func() {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"dataDir": "%s",
+					"ranges": [
+						[{ "subnet": "10.1.2.0/24" }]
+					]
+				},
+				"args": {
+					"cni": {
+						"ips": ["10.1.2.88"]
+					}
+				}
+			}`, ver, tmpDir)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+			}
+
+			// Allocate the IP
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(1))
+			Expect(result.IPs[0].Address.IP).To(Equal(net.ParseIP("10.1.2.88")))
+		})
+
+		It(fmt.Sprintf("[%s] allocates custom IPs from multiple ranges", ver), func() {
+			err := os.WriteFile(filepath.Join(tmpDir, "resolv.conf"), []byte("nameserver 192.0.2.3"), 0o644)
+			Expect(err).NotTo(HaveOccurred())
+
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"dataDir": "%s",
+					"ranges": [
+						[{ "subnet": "10.1.2.0/24" }],
+						[{ "subnet": "10.1.3.0/24" }]
+					]
+				},
+				"args": {
+					"cni": {
+						"ips": ["10.1.2.88", "10.1.3.77"]
+					}
+				}
+			}`, ver, tmpDir)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+			}
+
+			// Allocate the IP
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			if !testutils.SpecVersionHasMultipleIPs(ver) {
+				errStr := fmt.Sprintf("CNI version %s does not support more than 1 address per family", ver)
+				Expect(err).To(MatchError(errStr))
+			} else {
+				Expect(err).NotTo(HaveOccurred())
+				result, err := types100.GetResult(r)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.IPs).To(HaveLen(2))
+				Expect(result.IPs[0].Address.IP).To(Equal(net.ParseIP("10.1.2.88")))
+				Expect(result.IPs[1].Address.IP).To(Equal(net.ParseIP("10.1.3.77")))
+			}
+		})
+
+		It(fmt.Sprintf("[%s] allocates custom IPs from multiple protocols", ver), func() {
+			err := os.WriteFile(filepath.Join(tmpDir, "resolv.conf"), []byte("nameserver 192.0.2.3"), 0o644)
+			Expect(err).NotTo(HaveOccurred())
+
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"dataDir": "%s",
+					"ranges": [
+						[{"subnet":"172.16.1.0/24"}, { "subnet": "10.1.2.0/24" }],
+						[{ "subnet": "2001:db8:1::/48" }]
+					]
+				},
+				"args": {
+					"cni": {
+						"ips": ["10.1.2.88", "2001:db8:1::999"]
+					}
+				}
+			}`, ver, tmpDir)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+			}
+
+			// Allocate the IP
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(2))
+			Expect(result.IPs[0].Address.IP).To(Equal(net.ParseIP("10.1.2.88")))
+			Expect(result.IPs[1].Address.IP).To(Equal(net.ParseIP("2001:db8:1::999")))
+		})
+
+		It(fmt.Sprintf("[%s] fails if a requested custom IP is not used", ver), func() {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"dataDir": "%s",
+					"ranges": [
+						[{ "subnet": "10.1.2.0/24" }],
+						[{ "subnet": "10.1.3.0/24" }]
+					]
+				},
+				"args": {
+					"cni": {
+						"ips": ["10.1.2.88", "10.1.2.77"]
+					}
+				}
+			}`, ver, tmpDir)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+			}
+
+			// Allocate the IP
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			if !testutils.SpecVersionHasMultipleIPs(ver) {
+				errStr := fmt.Sprintf("CNI version %s does not support more than 1 address per family", ver)
+				Expect(err).To(MatchError(errStr))
+			} else {
+				Expect(err).To(HaveOccurred())
+				// Need to match prefix, because ordering is not guaranteed
+				Expect(err.Error()).To(HavePrefix("failed to allocate all requested IPs: 10.1.2."))
+			}
+		})
+	}
+
+	It("allocates the IPs of the ips capability, allocating nothing for a request out of the ranges", func() {
+		conf := func(ips string) []byte {
+			return []byte(fmt.Sprintf(`{
+				"cniVersion": "1.1.0",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"runtimeConfig": {"ips": %s},
+				"ipam": {
+					"type": "host-local",
+					"dataDir": "%s",
+					"ranges": [
+						[{"subnet": "10.1.2.0/24"}],
+						[{"subnet": "2001:db8:1::/64"}]
+					]
+				}
+			}`, ips, tmpDir))
+		}
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   conf(`["10.1.2.88/24", "2001:db8:1::999/64"]`),
+		}
+
+		r, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := types100.GetResult(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPs).To(HaveLen(2))
+		Expect(result.IPs[0].Address.String()).To(Equal("10.1.2.88/24"))
+		Expect(result.IPs[1].Address.String()).To(Equal("2001:db8:1::999/64"))
+
+		other := &skel.CmdArgs{
+			ContainerID: "other",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   conf(`["10.1.2.89", "10.9.9.9"]`),
+		}
+		_, _, err = testutils.CmdAddWithArgs(other, func() error {
+			return cmdAdd(other)
+		})
+		Expect(err).To(MatchError("failed to allocate all requested IPs: 10.9.9.9 is in no range of the network"))
+		Expect(filepath.Join(tmpDir, "mynet", "10.1.2.89")).NotTo(BeAnExistingFile())
+
+		// an address in use is a conflict
+		other.StdinData = conf(`["10.1.2.88"]`)
+		_, _, err = testutils.CmdAddWithArgs(other, func() error {
+			return cmdAdd(other)
+		})
+		Expect(err).To(MatchError(ContainSubstring("requested IP address 10.1.2.88 is not available")))
+	})
+
+	It("gives up on a locked store at the timeout on CHECK and STATUS", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.1.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"timeout": "100ms",
+				"ranges": [[{"subnet": "10.1.2.0/24"}]]
+			}
+		}`, tmpDir)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   []byte(conf),
+		}
+		_, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// another process holds the lock
+		store, err := disk.New("mynet", tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer store.Close()
+		Expect(store.Lock()).To(Succeed())
+		defer store.Unlock()
+
+		err = testutils.CmdCheckWithArgs(args, func() error {
+			return cmdCheck(args)
+		})
+		Expect(err).To(MatchError(ContainSubstring("gave up locking the store")))
+
+		_, err = captureStdout(func() error {
+			return cmdStatus(args)
+		})
+		Expect(err).To(MatchError(ContainSubstring("gave up locking the store")))
+	})
+
+	It("reports utilization and store health on STATUS", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.1.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"ranges": [
+					[{"subnet": "10.1.2.0/24", "rangeStart": "10.1.2.10", "rangeEnd": "10.1.2.19"}],
+					[{"subnet": "2001:db8:1::0/64"}]
+				]
+			}
+		}`, tmpDir)
+
+		for _, id := range []string{"dummy1", "dummy2"} {
+			args := &skel.CmdArgs{
+				ContainerID: id,
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+			}
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		args := &skel.CmdArgs{StdinData: []byte(conf)}
+		out, err := captureStdout(func() error {
+			return cmdStatus(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		status := &Status{}
+		Expect(json.Unmarshal(out, status)).To(Succeed())
+		Expect(status.Network).To(Equal("mynet"))
+		Expect(status.Store.Healthy).To(BeTrue())
+		Expect(status.Store.DataDir).To(Equal(filepath.Join(tmpDir, "mynet")))
+		Expect(status.Ranges).To(HaveLen(2))
+		Expect(status.Ranges[0]).To(Equal(RangeStatus{
+			RangeSet:    0,
+			Subnet:      "10.1.2.0/24",
+			RangeStart:  "10.1.2.10",
+			RangeEnd:    "10.1.2.19",
+			Size:        10,
+			Allocated:   2,
+			Utilization: 0.2,
+		}))
+		Expect(status.Ranges[1].Allocated).To(Equal(uint64(2)))
+		Expect(status.Ranges[1].Size).To(Equal(uint64(1<<64 - 1)))
+	})
+
+	DescribeTable("handles a repeated ADD according to onDuplicate",
+		func(policy, expected string) {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"dataDir": "%s",
+					"onDuplicate": "%s",
+					"ranges": [[{"subnet": "10.1.2.0/24"}]]
+				}
+			}`, tmpDir, policy)
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+			}
+
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			if expected == "" {
+				Expect(err).To(MatchError("failed to allocate for range 0: 10.1.2.2 has been allocated to dummy, duplicate allocation is not allowed"))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(1))
+			Expect(result.IPs[0].Address.String()).To(Equal(expected))
+			Expect(result.IPs[0].Gateway.String()).To(Equal("10.1.2.1"))
+
+			// only the address of the second ADD is kept
+			_, err = os.Stat(filepath.Join(tmpDir, "mynet", "10.1.2.2"))
+			Expect(err == nil).To(Equal(expected == "10.1.2.2/24"))
+		},
+		Entry("error", "error", ""),
+		Entry("reuse", "reuse", "10.1.2.2/24"),
+		Entry("replace", "replace", "10.1.2.3/24"),
+	)
+
+	It("keeps allocations in a journal with storeFormat journal", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.1.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"storeFormat": "journal",
+				"ranges": [[{"subnet": "10.1.2.0/24"}]]
+			}
+		}`, tmpDir)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   []byte(conf),
+		}
+
+		r, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := types100.GetResult(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPs[0].Address.String()).To(Equal("10.1.2.2/24"))
+		Expect(filepath.Join(tmpDir, "mynet", "10.1.2.2")).NotTo(BeAnExistingFile())
+		Expect(filepath.Join(tmpDir, "mynet", "allocations.journal")).To(BeAnExistingFile())
+
+		Expect(testutils.CmdCheckWithArgs(args, func() error {
+			return cmdCheck(args)
+		})).To(Succeed())
+
+		out, err := captureStdout(func() error {
+			return cmdStatus(&skel.CmdArgs{StdinData: []byte(conf)})
+		})
+		Expect(err).NotTo(HaveOccurred())
+		status := &Status{}
+		Expect(json.Unmarshal(out, status)).To(Succeed())
+		Expect(status.Store.Format).To(Equal("journal"))
+		Expect(status.Ranges[0].Allocated).To(Equal(uint64(1)))
+
+		Expect(testutils.CmdDelWithArgs(args, func() error {
+			return cmdDel(args)
+		})).To(Succeed())
+		Expect(testutils.CmdCheckWithArgs(args, func() error {
+			return cmdCheck(args)
+		})).NotTo(Succeed())
+	})
+
+	It("checks the allocation against prevResult", func() {
+		confFmt := `{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"ranges": [
+					[{"subnet": "10.1.2.0/24"}],
+					[{"subnet": "2001:db8:1::/64"}]
+				]
+			}%s
+		}`
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   []byte(fmt.Sprintf(confFmt, tmpDir, "")),
+		}
+		_, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		check := func(ips string) error {
+			args.StdinData = []byte(fmt.Sprintf(confFmt, tmpDir, `,
+			"prevResult": {"cniVersion": "1.0.0", "ips": [`+ips+`]}`))
+			return testutils.CmdCheckWithArgs(args, func() error {
+				return cmdCheck(args)
+			})
+		}
+
+		Expect(check(`{"address": "10.1.2.2/24", "gateway": "10.1.2.1"},
+			{"address": "2001:db8:1::2/64", "gateway": "2001:db8:1::1"},
+			{"address": "192.168.0.2/24"}`)).To(Succeed())
+		Expect(check(`{"address": "10.1.2.2/16", "gateway": "10.1.2.254"},
+			{"address": "2001:db8:1::2/64", "gateway": "2001:db8:1::1"}`)).To(MatchError(
+			"host-local: allocation of container dummy doesn't match prevResult: " +
+				"prevResult has 10.1.2.2/16, allocated is 10.1.2.2/24; " +
+				"gateway of 10.1.2.2 is 10.1.2.254 in prevResult, allocated is 10.1.2.1"))
+		Expect(check(`{"address": "10.1.2.3/24", "gateway": "10.1.2.1"}`)).To(MatchError(
+			"host-local: allocation of container dummy doesn't match prevResult: " +
+				"prevResult has 10.1.2.3/24, allocated is 10.1.2.2/24; " +
+				"allocated 2001:db8:1::2/64 is missing from prevResult"))
+	})
+
+	It("allocates perPodIPs addresses to the interface and releases them together", func() {
+		confFmt := `{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"perPodIPs": 3,
+				"onDuplicate": "reuse",
+				"ranges": [[{"subnet": "10.1.2.0/24"}]]
+			}%s
+		}`
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   []byte(fmt.Sprintf(confFmt, tmpDir, "")),
+		}
+		addresses := func() []string {
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			var addrs []string
+			for _, ipc := range result.IPs {
+				addrs = append(addrs, ipc.Address.String())
+			}
+			return addrs
+		}
+		expected := []string{"10.1.2.2/24", "10.1.2.3/24", "10.1.2.4/24"}
+		Expect(addresses()).To(Equal(expected))
+		// a retried ADD gets all of them back
+		Expect(addresses()).To(Equal(expected))
+
+		args.StdinData = []byte(fmt.Sprintf(confFmt, tmpDir, `,
+			"prevResult": {"cniVersion": "1.0.0", "ips": [
+				{"address": "10.1.2.2/24", "gateway": "10.1.2.1"},
+				{"address": "10.1.2.3/24", "gateway": "10.1.2.1"},
+				{"address": "10.1.2.4/24", "gateway": "10.1.2.1"}
+			]}`))
+		Expect(testutils.CmdCheckWithArgs(args, func() error {
+			return cmdCheck(args)
+		})).To(Succeed())
+
+		Expect(testutils.CmdDelWithArgs(args, func() error {
+			return cmdDel(args)
+		})).To(Succeed())
+		for _, ip := range []string{"10.1.2.2", "10.1.2.3", "10.1.2.4"} {
+			Expect(filepath.Join(tmpDir, "mynet", ip)).NotTo(BeAnExistingFile())
+		}
+	})
+
+	It("records the range set, range and sticky lease of the addresses for later plugins", func() {
+		annotationsDir := filepath.Join(tmpDir, "annotations")
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"annotate": true,
+				"annotationsDir": "%s",
+				"perPodIPs": 2,
+				"ranges": [
+					[{"subnet": "10.1.2.0/24", "name": "blue"}],
+					[{"subnet": "2001:db8:1::/64"}]
+				]
+			}
+		}`, tmpDir, annotationsDir)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       nspath,
+			IfName:      ifname,
+			Args:        "K8S_POD_NAMESPACE=default;K8S_POD_NAME=web",
+			StdinData:   []byte(conf),
+		}
+
+		_, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		a, err := annotations.Read(annotationsDir, "mynet", "dummy", ifname)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a).NotTo(BeNil())
+		// only the first address of a range set is kept for the pod
+		Expect(a.Addresses).To(Equal([]annotations.Address{
+			{IP: "10.1.2.2", RangeIndex: 0, Pool: "blue", LeaseID: "default/web"},
+			{IP: "10.1.2.3", RangeIndex: 0, Pool: "blue"},
+			{IP: "2001:db8:1::2", RangeIndex: 1, LeaseID: "default/web"},
+			{IP: "2001:db8:1::3", RangeIndex: 1},
+		}))
+
+		Expect(testutils.CmdDelWithArgs(args, func() error {
+			return cmdDel(args)
+		})).To(Succeed())
+		a, err = annotations.Read(annotationsDir, "mynet", "dummy", ifname)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a).To(BeNil())
+	})
+
+	It("names the addresses in the DNS result and the annotations", func() {
+		annotationsDir := filepath.Join(tmpDir, "annotations")
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"annotate": true,
+				"annotationsDir": "%s",
+				"hostname": "ip-${IP}.pods.site.example",
+				"ranges": [[{"subnet": "10.1.2.0/24", "name": "blue"}]]
+			},
+			"dns": {"domain": "cluster.local"}
+		}`, tmpDir, annotationsDir)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   []byte(conf),
+		}
+
+		r, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := types100.GetResult(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.DNS.Domain).To(Equal("pods.site.example"))
+
+		a, err := annotations.Read(annotationsDir, "mynet", "dummy", ifname)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a.Lookup(net.ParseIP("10.1.2.2")).Hostname).To(Equal("ip-10-1-2-2.pods.site.example"))
+	})
+
+	It("ignores repeated DELs of an attachment added again while its tombstone lasts", func() {
+		confFmt := `{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"tombstones": {"period": "1h"},
+				"ranges": [[{"subnet": "10.1.2.0/24"}]]
+			}%s
+		}`
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   []byte(fmt.Sprintf(confFmt, tmpDir, "")),
+		}
+		add := func() {
+			args.StdinData = []byte(fmt.Sprintf(confFmt, tmpDir, ""))
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+		del := func(prevIP string) {
+			prevResult := ""
+			if prevIP != "" {
+				prevResult = `,
+				"prevResult": {"cniVersion": "1.0.0", "ips": [{"address": "` + prevIP + `/24"}]}`
+			}
+			args.StdinData = []byte(fmt.Sprintf(confFmt, tmpDir, prevResult))
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+		}
+		lease := filepath.Join(tmpDir, "mynet", "10.1.2.3")
+
+		add()
+		del("10.1.2.2")
+		del("10.1.2.2")
+		add()
+		Expect(lease).To(BeAnExistingFile())
+
+		// late DELs of the deleted attachment leave the new address alone
+		del("10.1.2.2")
+		del("")
+		Expect(lease).To(BeAnExistingFile())
+
+		del("10.1.2.3")
+		Expect(lease).NotTo(BeAnExistingFile())
+	})
+
+	It("records the expiry of leases and reclaims them once expired", func() {
+		annotationsDir := filepath.Join(tmpDir, "annotations")
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"annotate": true,
+				"annotationsDir": "%s",
+				"onDuplicate": "reuse",
+				"leaseTTL": {"ttl": "1h", "file": "%s/expiry/${POD_NAMESPACE}/${POD_NAME}"},
+				"ranges": [[{"subnet": "10.1.2.0/24"}]]
+			}
+		}`, tmpDir, annotationsDir, tmpDir)
+		argsOf := func(id, pod string) *skel.CmdArgs {
+			return &skel.CmdArgs{
+				ContainerID: id,
+				Netns:       nspath,
+				IfName:      ifname,
+				Args:        "K8S_POD_NAMESPACE=default;K8S_POD_NAME=" + pod,
+				StdinData:   []byte(conf),
+			}
+		}
+		add := func(args *skel.CmdArgs) {
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+		expiryFile := func(pod string) string {
+			return filepath.Join(tmpDir, "expiry", "default", pod)
+		}
+
+		web := argsOf("c1", "web")
+		add(web)
+		a, err := annotations.Read(annotationsDir, "mynet", "c1", ifname)
+		Expect(err).NotTo(HaveOccurred())
+		expires, err := time.Parse(time.RFC3339, a.Lookup(net.ParseIP("10.1.2.2")).Expires)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(expires).To(BeTemporally("~", time.Now().Add(time.Hour), 2*time.Second))
+		data, err := os.ReadFile(expiryFile("web"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal(expires.Format(time.RFC3339) + "\n"))
+
+		// an ADD of the attachment again renews its lease
+		add(web)
+		store, err := disk.New("mynet", tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer store.Close()
+		expiries, err := store.ExpiriesOf("c1", ifname)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(expiries).To(HaveLen(1))
+
+		// let the lease expire, the next ADD reclaims it
+		Expect(store.SetExpiries([]disk.Expiry{{
+			IP: "10.1.2.2", ID: "c1", IfName: ifname, Until: time.Now().Add(-time.Second), File: expiryFile("web"),
+		}})).To(Succeed())
+		db := argsOf("c2", "db")
+		add(db)
+		Expect(filepath.Join(tmpDir, "mynet", "10.1.2.2")).NotTo(BeAnExistingFile())
+		Expect(filepath.Join(tmpDir, "mynet", "10.1.2.3")).To(BeAnExistingFile())
+		Expect(expiryFile("web")).NotTo(BeAnExistingFile())
+		Expect(annotations.Path(annotationsDir, "mynet", "c1", ifname)).NotTo(BeAnExistingFile())
+		expiries, err = store.ExpiriesOf("c1", ifname)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(expiries).To(BeEmpty())
+
+		Expect(testutils.CmdDelWithArgs(db, func() error {
+			return cmdDel(db)
+		})).To(Succeed())
+		Expect(expiryFile("db")).NotTo(BeAnExistingFile())
+		Expect(filepath.Join(tmpDir, "mynet", "expiries.json")).NotTo(BeAnExistingFile())
+	})
+
+	It("quarantines released addresses from other attachments", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"quarantine": {"period": "1h"},
+				"ranges": [[{"subnet": "10.1.2.0/24", "rangeStart": "10.1.2.2", "rangeEnd": "10.1.2.2"}]]
+			}
+		}`, tmpDir)
+		argsOf := func(id string) *skel.CmdArgs {
+			return &skel.CmdArgs{
+				ContainerID: id,
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+			}
+		}
+		add := func(args *skel.CmdArgs) error {
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			return err
+		}
+		del := func(args *skel.CmdArgs) {
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+		}
+
+		c1, c2 := argsOf("c1"), argsOf("c2")
+		Expect(add(c1)).To(Succeed())
+		del(c1)
+
+		// the only address is quarantined from another container
+		Expect(add(c2)).To(MatchError(ContainSubstring("no IP addresses available")))
+		out := &strings.Builder{}
+		Expect(runQuarantine([]string{"-network", "mynet", "-datadir", tmpDir}, out)).To(Succeed())
+		Expect(out.String()).To(MatchRegexp(`^10\.1\.2\.2\tuntil \S+ \(\S+\)\treleased by c1/` + ifname + "\n$"))
+
+		// but the container which released it gets it back
+		Expect(add(c1)).To(Succeed())
+		del(c1)
+
+		// once the quarantine is over it is free for everyone
+		store, err := disk.New("mynet", tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer store.Close()
+		Expect(store.Quarantine([]disk.Quarantined{{IP: "10.1.2.2", ID: "c1", IfName: ifname, Until: time.Now().Add(-time.Second)}})).To(Succeed())
+		out.Reset()
+		Expect(runQuarantine([]string{"-network", "mynet", "-datadir", tmpDir, "-json"}, out)).To(Succeed())
+		Expect(out.String()).To(Equal("[]\n"))
+		Expect(add(c2)).To(Succeed())
+		Expect(filepath.Join(tmpDir, "mynet", "10.1.2.2")).To(BeAnExistingFile())
+
+		// a quarantine list which can't be parsed fails allocations instead
+		// of being taken for an empty one
+		del(c2)
+		Expect(os.WriteFile(filepath.Join(tmpDir, "mynet", "quarantine.json"), []byte("{"), 0o600)).To(Succeed())
+		Expect(add(c1)).To(MatchError(ContainSubstring("failed to parse")))
+	})
+
+	It("releases addresses by IP and by pod without the container ID", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"ranges": [[{"subnet": "10.1.2.0/24"}]]
+			}
+		}`, tmpDir)
+		for _, id := range []string{"dummy1", "dummy2"} {
+			args := &skel.CmdArgs{
+				ContainerID: id,
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+				Args:        "K8S_POD_NAMESPACE=default;K8S_POD_NAME=" + id,
+			}
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+		netDir := filepath.Join(tmpDir, "mynet")
+		Expect(filepath.Join(netDir, "10.1.2.2")).To(BeAnExistingFile())
+		Expect(filepath.Join(netDir, "10.1.2.3")).To(BeAnExistingFile())
+		Expect(filepath.Join(netDir, "10.1.2.2_default_dummy1")).To(BeAnExistingFile())
+
+		out := &strings.Builder{}
+		Expect(runRelease([]string{"-network", "mynet", "-datadir", tmpDir, "-pod", "default/dummy1"}, out)).To(Succeed())
+		Expect(out.String()).To(Equal("released 10.1.2.2\n"))
+		Expect(filepath.Join(netDir, "10.1.2.2")).NotTo(BeAnExistingFile())
+		Expect(filepath.Join(netDir, "10.1.2.2_default_dummy1")).NotTo(BeAnExistingFile())
+
+		out.Reset()
+		Expect(runRelease([]string{"-network", "mynet", "-datadir", tmpDir, "-ip", "10.1.2.3"}, out)).To(Succeed())
+		Expect(out.String()).To(Equal("released 10.1.2.3\n"))
+		Expect(filepath.Join(netDir, "10.1.2.3")).NotTo(BeAnExistingFile())
+		Expect(filepath.Join(netDir, "10.1.2.3_default_dummy2")).NotTo(BeAnExistingFile())
+
+		err := runRelease([]string{"-network", "mynet", "-datadir", tmpDir, "-ip", "10.1.2.3"}, out)
+		Expect(err).To(MatchError("10.1.2.3 is not allocated in network mynet"))
+		err = runRelease([]string{"-network", "mynet", "-datadir", tmpDir, "-pod", "default/dummy1"}, out)
+		Expect(err).To(MatchError("no IPs are reserved for pod default/dummy1 in network mynet"))
+		err = runRelease([]string{"-network", "mynet", "-ip", "10.1.2.3", "-pod", "default/dummy1"}, out)
+		Expect(err).To(MatchError("exactly one of -ip and -pod is required"))
+	})
+
+	It("finds and repairs inconsistencies of the store with doctor", func() {
+		confFile := filepath.Join(tmpDir, "10-mynet.conflist")
+		Expect(os.WriteFile(confFile, []byte(fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"plugins": [{
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"dataDir": "%s",
+					"ranges": [[{"subnet": "10.1.2.0/24"}]]
+				}
+			}]
+		}`, tmpDir)), 0o644)).To(Succeed())
+		netDir := filepath.Join(tmpDir, "mynet")
+		Expect(os.MkdirAll(netDir, 0o755)).To(Succeed())
+		for name, content := range map[string]string{
+			"10.1.2.2":            "healthy" + disk.LineBreak + "eth0",
+			"10.1.2.5":            "dup" + disk.LineBreak + "eth0",
+			"::ffff:10.1.2.5":     "dup" + disk.LineBreak + "eth0",
+			"10.1.2.6":            "first" + disk.LineBreak + "eth0",
+			"::ffff:10.1.2.6":     "second" + disk.LineBreak + "eth0",
+			"10.5.0.1":            "moved" + disk.LineBreak + "eth0",
+			"last_reserved_ip.0":  "10.1.2.6",
+			"last_reserved_ip.1":  "10.1.3.6",
+			"last_reserved_ip.x0": "10.9.9.9",
+		} {
+			Expect(os.WriteFile(filepath.Join(netDir, name), []byte(content), 0o644)).To(Succeed())
+		}
+
+		out := &strings.Builder{}
+		err := runDoctor([]string{"-config", confFile}, out)
+		Expect(err).To(MatchError("5 problems of network mynet are left"))
+		Expect(out.String()).To(Equal(`CrossLinked 10.1.2.5: leased in the files 10.1.2.5, ::ffff:10.1.2.5
+CrossLinked 10.1.2.6: leased in the files 10.1.2.6, ::ffff:10.1.2.6 to several containers, only one of them can use it
+OrphanLastReserved range set 1: the network has no such range set
+OrphanLastReserved range set x0: the network has no such range set
+OutOfRange 10.5.0.1: leased outside of the ranges of the network, release it once its container is gone
+`))
+
+		out.Reset()
+		err = runDoctor([]string{"-config", confFile, "-fix", "-json"}, out)
+		Expect(err).To(MatchError("2 problems of network mynet are left"))
+		report := DoctorReport{}
+		Expect(json.Unmarshal([]byte(out.String()), &report)).To(Succeed())
+		Expect(report.Network).To(Equal("mynet"))
+		fixed := map[string]bool{}
+		for _, p := range report.Problems {
+			fixed[p.Kind+" "+p.IP+p.RangeID] = p.Fixed
+		}
+		Expect(fixed).To(Equal(map[string]bool{
+			"CrossLinked 10.1.2.5":  true,
+			"CrossLinked 10.1.2.6":  false,
+			"OrphanLastReserved 1":  true,
+			"OrphanLastReserved x0": true,
+			"OutOfRange 10.5.0.1":   false,
+		}))
+		Expect(report.Problems[1].Holders).To(Equal([]string{"first/eth0", "second/eth0"}))
+
+		Expect(filepath.Join(netDir, "10.1.2.5")).To(BeAnExistingFile())
+		Expect(filepath.Join(netDir, "::ffff:10.1.2.5")).NotTo(BeAnExistingFile())
+		Expect(filepath.Join(netDir, "::ffff:10.1.2.6")).To(BeAnExistingFile())
+		Expect(filepath.Join(netDir, "last_reserved_ip.0")).To(BeAnExistingFile())
+		Expect(filepath.Join(netDir, "last_reserved_ip.1")).NotTo(BeAnExistingFile())
+
+		// once the operator resolved the rest, the network is healthy
+		Expect(os.Remove(filepath.Join(netDir, "::ffff:10.1.2.6"))).To(Succeed())
+		Expect(os.Remove(filepath.Join(netDir, "10.5.0.1"))).To(Succeed())
+		out.Reset()
+		Expect(runDoctor([]string{"-config", confFile, "-json"}, out)).To(Succeed())
+		Expect(out.String()).To(Equal(`{"network":"mynet","problems":[]}` + "\n"))
+	})
+
+	It("publishes the state of networks as node annotations with report", func() {
+		confFile := filepath.Join(tmpDir, "10-mynet.conflist")
+		Expect(os.WriteFile(confFile, []byte(fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"plugins": [{
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"dataDir": "%s",
+					"ranges": [[{"subnet": "10.1.2.0/24"}]]
+				}
+			}]
+		}`, tmpDir)), 0o644)).To(Succeed())
+		conf, err := loadReportConf(confFile)
+		Expect(err).NotTo(HaveOccurred())
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   conf,
+			Args:        "K8S_POD_NAMESPACE=default;K8S_POD_NAME=web",
+		}
+		_, _, err = testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		var method, path, contentType, auth string
+		var body []byte
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			method, path = r.Method, r.URL.Path
+			contentType, auth = r.Header.Get("Content-Type"), r.Header.Get("Authorization")
+			body, _ = io.ReadAll(r.Body)
+			w.Write([]byte(`{}`))
+		}))
+		defer ts.Close()
+		tokenFile := filepath.Join(tmpDir, "token")
+		Expect(os.WriteFile(tokenFile, []byte("secret\n"), 0o600)).To(Succeed())
+
+		out := &strings.Builder{}
+		Expect(runReport([]string{"-config", confFile, "-node", "node1", "-server", ts.URL, "-token", tokenFile, "-ca", ""}, out)).To(Succeed())
+		Expect(method).To(Equal(http.MethodPatch))
+		Expect(path).To(Equal("/api/v1/nodes/node1"))
+		Expect(contentType).To(Equal("application/merge-patch+json"))
+		Expect(auth).To(Equal("Bearer secret"))
+
+		patch := struct {
+			Metadata struct {
+				Annotations map[string]string `json:"annotations"`
+			} `json:"metadata"`
+		}{}
+		Expect(json.Unmarshal(body, &patch)).To(Succeed())
+		Expect(patch.Metadata.Annotations).To(HaveKey("host-local.cni.dev/mynet"))
+		report := &NodeReport{}
+		Expect(json.Unmarshal([]byte(patch.Metadata.Annotations["host-local.cni.dev/mynet"]), report)).To(Succeed())
+		Expect(report.Ranges).To(HaveLen(1))
+		Expect(report.Ranges[0].Subnet).To(Equal("10.1.2.0/24"))
+		Expect(report.Ranges[0].Allocated).To(Equal(uint64(1)))
+		Expect(report.Pods).To(Equal(map[string][]string{"default/web": {"10.1.2.2"}}))
+
+		// the API server's errors are passed on
+		ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "nodes is forbidden", http.StatusForbidden)
+		})
+		err = runReport([]string{"-config", confFile, "-node", "node1", "-server", ts.URL, "-token", tokenFile, "-ca", ""}, out)
+		Expect(err).To(MatchError("failed to patch node node1: 403 Forbidden: nodes is forbidden"))
+
+		Expect(runReport([]string{"-config", confFile, "-dry-run"}, out)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring(`"host-local.cni.dev/mynet"`))
+	})
+
+	It("returns the DNS of the ranges addresses are allocated from", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"ranges": [
+					[
+						{"subnet": "10.1.2.0/24", "dns": {"nameservers": ["10.1.2.53"], "search": ["lan.example"]}},
+						{"subnet": "10.1.3.0/24", "dns": {"nameservers": ["10.1.3.53"]}}
+					],
+					[
+						{"subnet": "2001:db8:1::/64", "dns": {"nameservers": ["2001:db8:1::53"], "domain": "v6.example", "search": ["lan.example"]}}
+					]
+				]
+			}
+		}`, tmpDir)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   []byte(conf),
+		}
+		r, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := types100.GetResult(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPs).To(HaveLen(2))
+		Expect(result.DNS).To(Equal(types.DNS{
+			Nameservers: []string{"10.1.2.53", "2001:db8:1::53"},
+			Domain:      "v6.example",
+			Search:      []string{"lan.example"},
+		}))
+	})
+
+	It("snapshots the store on ADD and restores it with restore", func() {
+		snapDir := filepath.Join(tmpDir, "snapshots")
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"snapshots": {"count": 3, "interval": "1h", "dir": "%s"},
+				"ranges": [[{"subnet": "10.1.2.0/24"}]]
+			}
+		}`, tmpDir, snapDir)
+		for _, id := range []string{"dummy1", "dummy2"} {
+			args := &skel.CmdArgs{
+				ContainerID: id,
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+			}
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		// only the first ADD was due to take one
+		out := &strings.Builder{}
+		snapArgs := []string{"-network", "mynet", "-datadir", tmpDir, "-snapshotdir", snapDir}
+		Expect(runSnapshot(append(snapArgs, "-list"), out)).To(Succeed())
+		Expect(strings.Fields(out.String())).To(HaveLen(1))
+
+		out.Reset()
+		Expect(runSnapshot(snapArgs, out)).To(Succeed())
+		Expect(out.String()).To(HavePrefix("took snapshot "))
+
+		netDir := filepath.Join(tmpDir, "mynet")
+		Expect(os.Remove(filepath.Join(netDir, "10.1.2.2"))).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(netDir, "10.1.2.3"), []byte{0xff}, 0o600)).To(Succeed())
+
+		out.Reset()
+		Expect(runRestore(append(snapArgs, "-snapshot", "latest"), out)).To(Succeed())
+		Expect(out.String()).To(HavePrefix("restored snapshot "))
+		Expect(os.ReadFile(filepath.Join(netDir, "10.1.2.2"))).To(Equal([]byte("dummy1" + disk.LineBreak + ifname)))
+		Expect(os.ReadFile(filepath.Join(netDir, "10.1.2.3"))).To(Equal([]byte("dummy2" + disk.LineBreak + ifname)))
+
+		err := runRestore([]string{"-network", "mynet", "-datadir", tmpDir, "-snapshot", "latest"}, out)
+		Expect(err).To(MatchError("network mynet has no snapshots"))
+		err = runRestore(snapArgs, out)
+		Expect(err).To(MatchError("-snapshot is required"))
+	})
+
+	It("refuses ADDs but not DELs while the network is frozen", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"ranges": [[{"subnet": "10.1.2.0/24"}]]
+			}
+		}`, tmpDir)
+		newArgs := func(id string) *skel.CmdArgs {
+			return &skel.CmdArgs{ContainerID: id, Netns: nspath, IfName: ifname, StdinData: []byte(conf)}
+		}
+		add := func(id string) error {
+			args := newArgs(id)
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			return err
+		}
+		Expect(add("first")).To(Succeed())
+
+		out := &strings.Builder{}
+		freezeArgs := []string{"-network", "mynet", "-datadir", tmpDir}
+		Expect(runFreeze(append(freezeArgs, "-reason", "store migration"), out, true)).To(Succeed())
+		Expect(out.String()).To(Equal("froze network mynet\n"))
+
+		err := add("second")
+		var e *types.Error
+		Expect(errors.As(err, &e)).To(BeTrue())
+		Expect(e.Code).To(Equal(types.ErrTryAgainLater))
+		Expect(e.Msg).To(MatchRegexp(`^network mynet is frozen since .+: store migration, no addresses are allocated until it is thawed$`))
+		Expect(filepath.Join(tmpDir, "mynet", "10.1.2.3")).NotTo(BeAnExistingFile())
+
+		err = cmdStatus(newArgs(""))
+		Expect(errors.As(err, &e)).To(BeTrue())
+		Expect(e.Code).To(Equal(errPluginNotAvailable))
+		Expect(e.Msg).To(Equal("network frozen"))
+
+		args := newArgs("first")
+		Expect(testutils.CmdDelWithArgs(args, func() error {
+			return cmdDel(args)
+		})).To(Succeed())
+		Expect(filepath.Join(tmpDir, "mynet", "10.1.2.2")).NotTo(BeAnExistingFile())
+
+		out.Reset()
+		Expect(runFreeze(freezeArgs, out, false)).To(Succeed())
+		Expect(out.String()).To(Equal("thawed network mynet\n"))
+		Expect(add("second")).To(Succeed())
+	})
+
+	It("throttles the ADDs of a requester beyond its rate limit", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"ranges": [[{"subnet": "10.1.2.0/24"}]],
+				"rateLimit": {"burst": 2, "interval": "1h"}
+			}
+		}`, tmpDir)
+		add := func(id, namespace string) error {
+			args := &skel.CmdArgs{
+				ContainerID: id,
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+				Args:        "K8S_POD_NAMESPACE=" + namespace + ";K8S_POD_NAME=" + id,
+			}
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			return err
+		}
+		Expect(add("first", "loop")).To(Succeed())
+		Expect(add("second", "loop")).To(Succeed())
+
+		err := add("third", "loop")
+		var e *types.Error
+		Expect(errors.As(err, &e)).To(BeTrue())
+		Expect(e.Code).To(Equal(types.ErrTryAgainLater))
+		Expect(e.Msg).To(MatchRegexp(`^too many operations by namespace loop, retry in 5[89]m[0-9.]+s$`))
+		Expect(e.Details).To(ContainSubstring(`"kind":"Throttled"`))
+		Expect(filepath.Join(tmpDir, "mynet", "10.1.2.4")).NotTo(BeAnExistingFile())
+
+		// other namespaces have their own bucket
+		Expect(add("fourth", "quiet")).To(Succeed())
+		Expect(filepath.Join(tmpDir, "mynet", "10.1.2.4")).To(BeAnExistingFile())
+	})
+
+	It("mirrors allocations to a secondary store and migrates to it", func() {
+		secondaryDir := filepath.Join(tmpDir, "secondary")
+		confWith := func(ipam string) string {
+			return fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"dataDir": "%s",
+					%s
+					"ranges": [[{"subnet": "10.1.2.0/24"}]]
+				}
+			}`, tmpDir, ipam)
+		}
+		conf := confWith("")
+		newArgs := func(id string) *skel.CmdArgs {
+			return &skel.CmdArgs{ContainerID: id, Netns: nspath, IfName: ifname, StdinData: []byte(conf)}
+		}
+		add := func(id string) {
+			args := newArgs(id)
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+		add("first")
+
+		conf = confWith(fmt.Sprintf(`"secondaryStore": {"dataDir": "%s"},`, secondaryDir))
+		confFile := filepath.Join(tmpDir, "mynet.conf")
+		Expect(os.WriteFile(confFile, []byte(conf), 0o600)).To(Succeed())
+		add("second")
+		Expect(filepath.Join(tmpDir, "mynet", "10.1.2.3")).To(BeAnExistingFile())
+		// allocations made before are copied along
+		Expect(filepath.Join(secondaryDir, "mynet", "10.1.2.2")).To(BeAnExistingFile())
+		Expect(filepath.Join(secondaryDir, "mynet", "10.1.2.3")).To(BeAnExistingFile())
+
+		// a lost write
+		Expect(os.Remove(filepath.Join(secondaryDir, "mynet", "10.1.2.3"))).To(Succeed())
+		out := &strings.Builder{}
+		err := runMigrate([]string{"-config", confFile}, out)
+		Expect(err).To(MatchError("network mynet: 1 leases differ between the stores, see -sync"))
+		Expect(out.String()).To(Equal(filepath.Join(secondaryDir, "mynet") + ": 10.1.2.3: missing, held by second/" + ifname + "\n"))
+		out.Reset()
+		Expect(runMigrate([]string{"-config", confFile, "-cutover"}, out)).NotTo(Succeed())
+		Expect(filepath.Join(tmpDir, "mynet", "cutover.json")).NotTo(BeAnExistingFile())
+
+		out.Reset()
+		Expect(runMigrate([]string{"-config", confFile, "-sync"}, out)).To(Succeed())
+		Expect(out.String()).To(Equal("synced network mynet to " + filepath.Join(secondaryDir, "mynet") + "\n"))
+		out.Reset()
+		Expect(runMigrate([]string{"-config", confFile}, out)).To(Succeed())
+		Expect(out.String()).To(Equal("the stores of network mynet agree\n"))
+
+		out.Reset()
+		Expect(runMigrate([]string{"-config", confFile, "-cutover"}, out)).To(Succeed())
+		Expect(out.String()).To(Equal("network mynet is written to " + filepath.Join(secondaryDir, "mynet") + " first\n"))
+
+		// the secondary store is written first now, and mirrored back
+		add("third")
+		Expect(filepath.Join(secondaryDir, "mynet", "10.1.2.4")).To(BeAnExistingFile())
+		Expect(filepath.Join(tmpDir, "mynet", "10.1.2.4")).To(BeAnExistingFile())
+		args := newArgs("first")
+		Expect(testutils.CmdDelWithArgs(args, func() error {
+			return cmdDel(args)
+		})).To(Succeed())
+		Expect(filepath.Join(secondaryDir, "mynet", "10.1.2.2")).NotTo(BeAnExistingFile())
+		Expect(filepath.Join(tmpDir, "mynet", "10.1.2.2")).NotTo(BeAnExistingFile())
+
+		out.Reset()
+		Expect(runMigrate([]string{"-config", confFile, "-rollback"}, out)).To(Succeed())
+		Expect(out.String()).To(Equal("network mynet is written to " + filepath.Join(tmpDir, "mynet") + " first\n"))
+		Expect(filepath.Join(tmpDir, "mynet", "cutover.json")).NotTo(BeAnExistingFile())
+	})
+
+	It("reports tampered lease files on STATUS and verify", func() {
+		keyFile := filepath.Join(tmpDir, "node.key")
+		Expect(os.WriteFile(keyFile, []byte(strings.Repeat("k", disk.MinKeySize)+"\n"), 0o600)).To(Succeed())
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.1.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"integrity": {"keyFile": "%s"},
+				"ranges": [[{"subnet": "10.1.2.0/24"}]]
+			}
+		}`, tmpDir, keyFile)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   []byte(conf),
+		}
+		_, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		statusArgs := &skel.CmdArgs{StdinData: []byte(conf)}
+		out, err := captureStdout(func() error {
+			return cmdStatus(statusArgs)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		status := &Status{}
+		Expect(json.Unmarshal(out, status)).To(Succeed())
+		Expect(status.Integrity).To(Equal(&IntegrityStatus{Failures: []disk.VerifyFailure{}}))
+
+		verifyArgs := []string{"-network", "mynet", "-datadir", tmpDir, "-key", keyFile}
+		Expect(runVerify(verifyArgs, &strings.Builder{})).To(Succeed())
+
+		leaseFile := filepath.Join(tmpDir, "mynet", "10.1.2.2")
+		Expect(os.WriteFile(leaseFile, []byte("intruder\r\neth0"), 0o600)).To(Succeed())
+
+		_, err = captureStdout(func() error {
+			return cmdStatus(statusArgs)
+		})
+		var e *types.Error
+		Expect(errors.As(err, &e)).To(BeTrue())
+		Expect(e.Code).To(Equal(uint(50)))
+		Expect(e.Msg).To(Equal("store integrity check failed"))
+		Expect(e.Details).To(MatchJSON(`[{"file": "10.1.2.2", "reason": "not signed"}]`))
+
+		cliOut := &strings.Builder{}
+		err = runVerify(verifyArgs, cliOut)
+		Expect(err).To(MatchError("1 lease files of network mynet failed verification"))
+		Expect(cliOut.String()).To(Equal("10.1.2.2: not signed\n"))
+
+		// the tampered lease can't be released by whoever it names
+		intruder := &skel.CmdArgs{
+			ContainerID: "intruder",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   []byte(conf),
+		}
+		Expect(testutils.CmdDelWithArgs(intruder, func() error {
+			return cmdDel(intruder)
+		})).To(Succeed())
+		Expect(leaseFile).To(BeAnExistingFile())
+	})
+
+	DescribeTable("releases the leases of attachments the runtime no longer lists on GC", func(storeFormat string) {
+		conf := func(valid string) []byte {
+			return []byte(fmt.Sprintf(`{
+				"cniVersion": "1.1.0",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"dataDir": "%s",
+					"storeFormat": "%s",
+					"ranges": [[{"subnet": "10.1.2.0/24"}]]
+				},
+				"cni.dev/valid-attachments": %s
+			}`, tmpDir, storeFormat, valid))
+		}
+		for _, a := range []struct{ id, ifname string }{{"c1", "eth0"}, {"c2", "eth0"}, {"c2", "net1"}} {
+			args := &skel.CmdArgs{
+				ContainerID: a.id,
+				Netns:       nspath,
+				IfName:      a.ifname,
+				StdinData:   conf("[]"),
+			}
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		gcArgs := &skel.CmdArgs{StdinData: conf(`[
+			{"containerID": "c1", "ifname": "eth0"},
+			{"containerID": "c2", "ifname": "net1"}
+		]`)}
+		Expect(cmdGC(gcArgs)).To(Succeed())
+
+		store, err := disk.New("mynet", tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer store.Close()
+		Expect(store.GetByID("c1", "eth0")).To(HaveLen(1))
+		Expect(store.GetByID("c2", "net1")).To(HaveLen(1))
+		Expect(store.GetByID("c2", "eth0")).To(BeEmpty())
+
+		// GC is idempotent
+		Expect(cmdGC(gcArgs)).To(Succeed())
+		Expect(store.GetByID("c1", "eth0")).To(HaveLen(1))
+	},
+		Entry("files", "files"),
+		Entry("journal", "journal"),
+	)
+
+	It("releases leases which predate per-interface tracking on GC", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.1.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"ranges": [[{"subnet": "10.1.2.0/24"}]]
+			},
+			"cni.dev/valid-attachments": [{"containerID": "c1", "ifname": "eth0"}]
+		}`, tmpDir)
+		Expect(os.MkdirAll(filepath.Join(tmpDir, "mynet"), 0o755)).To(Succeed())
+		for ip, id := range map[string]string{"10.1.2.5": "c1", "10.1.2.6": "c3"} {
+			Expect(os.WriteFile(filepath.Join(tmpDir, "mynet", ip), []byte(id), 0o600)).To(Succeed())
+		}
+
+		Expect(cmdGC(&skel.CmdArgs{StdinData: []byte(conf)})).To(Succeed())
+		Expect(filepath.Join(tmpDir, "mynet", "10.1.2.5")).To(BeAnExistingFile())
+		Expect(filepath.Join(tmpDir, "mynet", "10.1.2.6")).NotTo(BeAnExistingFile())
+	})
+
+	DescribeTable("spreads the interfaces of a container over the ranges with spreadInterfaces", func(storeFormat string) {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"storeFormat": "%s",
+				"spreadInterfaces": true,
+				"ranges": [[{"subnet": "10.1.2.0/24"}, {"subnet": "10.1.3.0/24"}]]
+			}
+		}`, tmpDir, storeFormat)
+		add := func(id, ifname string) string {
+			args := &skel.CmdArgs{
+				ContainerID: id,
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+			}
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(1))
+			return result.IPs[0].Address.String()
+		}
+
+		Expect(add("c1", "eth0")).To(Equal("10.1.2.2/24"))
+		Expect(add("c1", "net1")).To(Equal("10.1.3.2/24"))
+		Expect(add("c1", "net2")).To(Equal("10.1.2.3/24"))
+		// another container starts over in the first range
+		Expect(add("c2", "eth0")).To(Equal("10.1.2.4/24"))
+		Expect(add("c2", "net1")).To(Equal("10.1.3.3/24"))
+	},
+		Entry("files", "files"),
+		Entry("journal", "journal"),
+	)
+
+	DescribeTable("hands a pod's address over to its new container", func(storeFormat string) {
+		conf := func(gracePeriod string) []byte {
+			return []byte(fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"dataDir": "%s",
+					"storeFormat": "%s",
+					"handover": {"gracePeriod": "%s"},
+					"ranges": [[{"subnet": "10.1.2.0/24"}]]
+				}
+			}`, tmpDir, storeFormat, gracePeriod))
+		}
+		cmdArgs := func(id, gracePeriod string) *skel.CmdArgs {
+			return &skel.CmdArgs{
+				ContainerID: id,
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   conf(gracePeriod),
+				Args:        "K8S_POD_NAMESPACE=default;K8S_POD_NAME=web-0",
+			}
+		}
+		add := func(args *skel.CmdArgs) string {
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			return result.IPs[0].Address.String()
+		}
+		check := func(args *skel.CmdArgs) error {
+			return testutils.CmdCheckWithArgs(args, func() error {
+				return cmdCheck(args)
+			})
+		}
+
+		oldArgs, newArgs := cmdArgs("old", "1m"), cmdArgs("new", "1m")
+		Expect(add(oldArgs)).To(Equal("10.1.2.2/24"))
+		Expect(add(newArgs)).To(Equal("10.1.2.2/24"))
+		Expect(check(oldArgs)).To(Succeed())
+		Expect(check(newArgs)).To(Succeed())
+
+		// the old DEL ends the lease of the old container only
+		Expect(testutils.CmdDelWithArgs(oldArgs, func() error {
+			return cmdDel(oldArgs)
+		})).To(Succeed())
+		Expect(check(oldArgs)).NotTo(Succeed())
+		Expect(check(newArgs)).To(Succeed())
+
+		// without a DEL the lease ends with the grace period
+		oldArgs, newArgs = cmdArgs("new", "50ms"), cmdArgs("newer", "50ms")
+		Expect(add(newArgs)).To(Equal("10.1.2.2/24"))
+		Expect(check(oldArgs)).To(Succeed())
+		time.Sleep(100 * time.Millisecond)
+		Expect(check(oldArgs)).NotTo(Succeed())
+		Expect(check(newArgs)).To(Succeed())
+
+		_, _, err := allocator.LoadIPAMConfig(conf("-1s"), "")
+		Expect(err).To(MatchError(`invalid handover gracePeriod "-1s", must be a positive duration`))
+	},
+		Entry("files", "files"),
+		Entry("journal", "journal"),
+	)
+
+	It("reports an exhausted range with its own error code", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"ranges": [[{"subnet": "10.1.2.0/30"}]]
+			}
+		}`, tmpDir)
+		add := func(id string) error {
+			args := &skel.CmdArgs{
+				ContainerID: id,
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+			}
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			return err
+		}
+
+		Expect(add("first")).To(Succeed())
+		err := add("second")
+		var e *types.Error
+		Expect(errors.As(err, &e)).To(BeTrue())
+		Expect(e.Code).To(Equal(uint(100)))
+		Expect(e.Msg).To(Equal("no IP addresses available in range set: 10.1.2.1-10.1.2.2"))
+		Expect(e.Details).To(MatchJSON(`{"kind": "PoolExhausted", "retryable": false, "rangeSet": "10.1.2.1-10.1.2.2"}`))
+	})
+
+	It("allocates from the ranges of the attachment's VLAN", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "macvlan",
+			"master": "eth1",
+			"vlanId": 20,
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"ranges": [
+					[
+						{"subnet": "10.0.10.0/24", "vlan": 10},
+						{"subnet": "10.0.20.0/24", "vlan": 20}
+					],
+					[{"subnet": "2001:db8:10::/64", "vlan": 10}]
+				]
+			}
+		}`, tmpDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   []byte(conf),
+			Args:        "VLAN=20;PARENT=eth1;IgnoreUnknown=1",
+		}
+		r, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := types100.GetResult(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPs).To(HaveLen(1))
+		Expect(result.IPs[0].Address.String()).To(Equal("10.0.20.2/24"))
+
+		args.ContainerID = "dummy2"
+		args.Args = "VLAN=30"
+		_, _, err = testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).To(MatchError(`no range of the network is open to vlan 30 of parent ""`))
+	})
+
+	It("allocates from a generated ULA range", func() {
+		machineID := filepath.Join(tmpDir, "machine-id")
+		Expect(os.WriteFile(machineID, []byte("0123456789abcdef0123456789abcdef\n"), 0o644)).To(Succeed())
+		defer func(orig string) { allocator.MachineIDFile = orig }(allocator.MachineIDFile)
+		allocator.MachineIDFile = machineID
+
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"ranges": [
+					[{"subnet": "10.1.2.0/24"}],
+					[{"generate": "ula"}]
+				]
+			}
+		}`, tmpDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   []byte(conf),
+		}
+		r, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := types100.GetResult(r)
+		Expect(err).NotTo(HaveOccurred())
+
+		subnet := allocator.ULASubnet("0123456789abcdef0123456789abcdef", "mynet", "1-0")
+		Expect(result.IPs).To(HaveLen(2))
+		Expect(subnet.Contains(result.IPs[1].Address.IP)).To(BeTrue())
+		Expect(result.IPs[1].Address.Mask).To(Equal(net.CIDRMask(64, 128)))
+
+		saved, err := os.ReadFile(filepath.Join(tmpDir, "mynet", "generated_subnet.1-0"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(saved)).To(Equal(subnet.String()))
+
+		By("keeping the persisted subnet when the machine-id changes")
+		Expect(os.WriteFile(machineID, []byte("fedcba9876543210fedcba9876543210\n"), 0o644)).To(Succeed())
+		args.ContainerID = "dummy2"
+		r, _, err = testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		result, err = types100.GetResult(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(subnet.Contains(result.IPs[1].Address.IP)).To(BeTrue())
+	})
+})
+
+func captureStdout(f func() error) ([]byte, error) {
+	oldStdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	os.Stdout = w
+	err = f()
+	w.Close()
+	os.Stdout = oldStdout
+
+	out, readErr := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return out, readErr
+}
+
+func mustCIDR(s string) net.IPNet {
+	ip, n, err := net.ParseCIDR(s)
+	n.IP = ip
+	if err != nil {
+		Fail(err.Error())
+	}
+
+	return *n
+}
@@ -0,0 +1,635 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostlocal
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/annotations"
+	"github.com/containernetworking/plugins/pkg/crash"
+	cnierrors "github.com/containernetworking/plugins/pkg/errors"
+	"github.com/containernetworking/plugins/pkg/include"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+)
+
+// Main runs the host-local plugin.
+func Main() {
+	if len(os.Args) > 1 && os.Args[1] == "release" {
+		if err := runRelease(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "snapshot" {
+		if err := runSnapshot(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		if err := runRestore(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		if err := runVerify(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "freeze" || os.Args[1] == "thaw") {
+		if err := runFreeze(os.Args[2:], os.Stdout, os.Args[1] == "freeze"); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		if err := runDoctor(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "quarantine" {
+		if err := runQuarantine(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		if err := runReport(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{
+		Add:    cmdAdd,
+		Check:  cmdCheck,
+		Del:    cmdDel,
+		GC:     cmdGC,
+		Status: cmdStatus,
+	}), version.All, bv.BuildString("host-local"))
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	ipamConf, _, err := allocator.LoadIPAMConfig(args.StdinData, args.Args)
+	if err != nil {
+		return err
+	}
+
+	// Look to see if there is at least one IP address allocated to the container
+	// in the data dir, irrespective of what that address actually is
+	store, err := openStore(ipamConf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	ctx, cancel := ipam.InvocationContext(ipamConf.ExecTimeout)
+	defer cancel()
+	if err := store.LockContext(ctx); err != nil {
+		return cnierrors.StoreUnavailable(err)
+	}
+	defer store.Unlock()
+
+	containerIPFound := store.FindByID(args.ContainerID, args.IfName)
+	// a container whose addresses were handed over keeps its lease for
+	// the grace period
+	if !containerIPFound && ipamConf.Handover != nil {
+		handedOver, err := store.HandedOver(args.ContainerID, args.IfName)
+		if handedOver || err != nil {
+			return err
+		}
+	}
+	if !containerIPFound {
+		return fmt.Errorf("host-local: Failed to find address added by container %v", args.ContainerID)
+	}
+
+	// With a prevResult, the addresses handed to the container must still
+	// be the ones allocated to it, with the same prefix and gateway
+	prev, err := parsePrevResult(args.StdinData)
+	if err != nil || prev == nil {
+		return err
+	}
+	if err := allocator.ResolveGeneratedRanges(ipamConf, store); err != nil {
+		return err
+	}
+	return checkPrevResult(ipamConf, store, args.ContainerID, args.IfName, prev)
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	ipamConf, confVersion, err := allocator.LoadIPAMConfig(args.StdinData, args.Args)
+	if err != nil {
+		return err
+	}
+
+	if len(ipamConf.PodNamespace)+len(ipamConf.PodName) > 230 {
+		return fmt.Errorf("ARGS: length of pod ns and name exceed the length limit")
+	}
+
+	result := &current.Result{CNIVersion: current.ImplementedSpecVersion}
+
+	var resolv *types.DNS
+	if ipamConf.ResolvConf != "" {
+		resolv, err = parseResolvConf(ipamConf.ResolvConf)
+		if err != nil {
+			return err
+		}
+	}
+	result.DNS = mergeDNS(ipamConf.DNSPolicy, ipamConf.ProvidedDNS, resolv)
+
+	store, err := openStore(ipamConf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	ctx, cancel := ipam.InvocationContext(ipamConf.ExecTimeout)
+	defer cancel()
+
+	if err := allocator.ResolveGeneratedRanges(ipamConf, store); err != nil {
+		return err
+	}
+
+	// Hold the lock for the whole ADD, so the addresses of all range sets
+	// are allocated, or rolled back, without other invocations interleaving
+	if err := store.LockContext(ctx); err != nil {
+		return cnierrors.StoreUnavailable(err)
+	}
+	defer store.Unlock()
+
+	// A frozen network allocates nothing, not even what an earlier ADD of
+	// the attachment held, which a replacing ADD would release first
+	if f, frozen := store.Frozen(); frozen {
+		return cnierrors.StoreUnavailable(frozenError(ipamConf.Name, f))
+	}
+
+	if rl := ipamConf.RateLimit; rl != nil {
+		requester := rl.Requester(args.ContainerID, ipamConf.PodNamespace)
+		wait, err := store.Throttle(requester, rl.Burst, rl.Leak)
+		if err != nil {
+			return fmt.Errorf("failed to record the ADD of %s: %v", requester, err)
+		}
+		if wait > 0 {
+			return cnierrors.Throttled(requester, wait.Round(time.Millisecond))
+		}
+	}
+
+	if ipamConf.LeaseTTL != nil {
+		if err := reclaimExpired(ipamConf, store); err != nil {
+			return err
+		}
+	}
+
+	// Drop what an earlier ADD of this attachment left behind
+	if ipamConf.OnDuplicate == allocator.DuplicateReplace {
+		if err := store.ReleaseByID(args.ContainerID, args.IfName); err != nil {
+			return fmt.Errorf("failed to release previous allocation: %v", err)
+		}
+	}
+	reuse := ipamConf.OnDuplicate == allocator.DuplicateReuse
+
+	// Keep the IPs we allocated, so we can release them if an error occurs
+	// after we start allocating. Reused IPs are left alone.
+	allocated := []net.IP{}
+	rollback := func() {
+		for _, ip := range allocated {
+			_, _ = store.ReleaseByIP(ip)
+		}
+	}
+
+	// The requested IPs by the range set they are allocated from; a
+	// request which can't be fulfilled fails before anything is allocated
+	requestedIPs, err := ipamConf.RequestedIPsBySet()
+	if err != nil {
+		return err
+	}
+	if ipamConf.LegacyIPArgs {
+		fmt.Fprintln(os.Stderr, "host-local: requesting IPs by CNI_ARGS IP or args.cni.ips is deprecated, use the ips capability")
+	}
+
+	// Only the ranges of the attachment's VLAN and parent interface are
+	// allocated from, range sets without any are skipped
+	attachmentRanges, err := ipamConf.AttachmentRanges(requestedIPs)
+	if err != nil {
+		return err
+	}
+
+	owner := allocator.Owner{PodNamespace: ipamConf.PodNamespace, PodName: ipamConf.PodName}
+	if ipamConf.MAC != "" {
+		if owner.MAC, err = net.ParseMAC(ipamConf.MAC); err != nil {
+			return fmt.Errorf("invalid MAC address %q: %v", ipamConf.MAC, err)
+		}
+	}
+
+	var stableKey []byte
+	if st := ipamConf.StableIPv6; st != nil {
+		stableKey = []byte(ipamConf.Name)
+		if st.SecretFile != "" {
+			if stableKey, err = disk.LoadKey(st.SecretFile); err != nil {
+				return err
+			}
+		}
+	}
+
+	// With handover, the pod's old container keeps its lease on the
+	// addresses taken over, recorded once the ADD succeeded
+	handovers := []disk.Handover{}
+
+	// The DNS of the ranges addresses are allocated from, e.g. of both
+	// networks of a dual-homed pod
+	rangeDNS := []types.DNS{}
+	addRangeDNS := func(rangeset *allocator.RangeSet, ip net.IP) {
+		if r, err := rangeset.RangeFor(ip); err == nil && r.DNS != nil {
+			rangeDNS = append(rangeDNS, *r.DNS)
+		}
+	}
+
+	// The metadata of the addresses, recorded for later plugins of the
+	// chain with annotate
+	annotated := []annotations.Address{}
+	annotate := func(idx int, rangeset *allocator.RangeSet, ipConfs ...*current.IPConfig) {
+		for _, ipc := range ipConfs {
+			a := annotations.Address{IP: ipc.Address.IP.String(), RangeIndex: idx}
+			if r, err := rangeset.RangeFor(ipc.Address.IP); err == nil {
+				a.Pool = r.Name
+			}
+			annotated = append(annotated, a)
+		}
+	}
+
+	for idx, rangeset := range attachmentRanges {
+		if len(rangeset) == 0 {
+			continue
+		}
+		// reservations are reloaded on every ADD, so changes apply
+		// without restarting anything
+		if err := rangeset.LoadReservations(); err != nil {
+			return err
+		}
+		allocator := allocator.NewIPAllocator(&rangeset, store, idx)
+		allocator.SetOwner(owner)
+		allocator.SetSpread(ipamConf.SpreadInterfaces)
+		if stableKey != nil {
+			allocator.SetStable(stableKey)
+		}
+
+		requestedIP := requestedIPs[idx]
+
+		if reuse {
+			if ipConfs := allocator.AllocatedAll(args.ContainerID, args.IfName); len(ipConfs) > 0 &&
+				(requestedIP == nil || containsIP(ipConfs, requestedIP)) {
+				result.IPs = append(result.IPs, ipConfs...)
+				addRangeDNS(&rangeset, ipConfs[0].Address.IP)
+				annotate(idx, &rangeset, ipConfs...)
+				continue
+			}
+		}
+
+		var prev *disk.Handover
+		if ipamConf.Handover != nil {
+			prev = previousHolder(store, &rangeset, args.ContainerID, ipamConf.PodNamespace, ipamConf.PodName)
+		}
+
+		ipConf, err := allocator.GetByPodNsAndName(args.ContainerID, args.IfName, requestedIP, ipamConf.PodNamespace, ipamConf.PodName)
+		if err != nil {
+			rollback()
+			return fmt.Errorf("failed to allocate for range %d: %w", idx, err)
+		}
+		if prev != nil && prev.IP == ipConf.Address.IP.String() {
+			prev.Until = time.Now().Add(ipamConf.Handover.Grace)
+			handovers = append(handovers, *prev)
+		}
+
+		allocated = append(allocated, ipConf.Address.IP)
+
+		result.IPs = append(result.IPs, ipConf)
+		addRangeDNS(&rangeset, ipConf.Address.IP)
+		annotate(idx, &rangeset, ipConf)
+
+		// the further addresses of the interface, released along with
+		// the first one
+		for n := 1; n < ipamConf.PerPodIPs; n++ {
+			extra, err := allocator.GetExtra(args.ContainerID, args.IfName)
+			if err != nil {
+				rollback()
+				return fmt.Errorf("failed to allocate address %d of %d for range %d: %w", n+1, ipamConf.PerPodIPs, idx, err)
+			}
+			allocated = append(allocated, extra.Address.IP)
+			result.IPs = append(result.IPs, extra)
+			annotate(idx, &rangeset, extra)
+		}
+	}
+
+	for _, h := range handovers {
+		if err := store.AddHandover(h); err != nil {
+			rollback()
+			return fmt.Errorf("failed to hand over %s: %v", h.IP, err)
+		}
+	}
+
+	// The names of the addresses. One that can't be named is left
+	// without, the addresses are of use anyway.
+	hostDomain := ""
+	for i := range annotated {
+		name, err := ipamConf.HostnameOf(args.IfName, net.ParseIP(annotated[i].IP))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to name %s: %v\n", annotated[i].IP, err)
+		}
+		annotated[i].Hostname = name
+		if _, domain, ok := strings.Cut(name, "."); ok && hostDomain == "" {
+			hostDomain = domain
+		}
+	}
+
+	if ipamConf.LeaseTTL != nil {
+		if err := recordExpiry(ipamConf, store, args.ContainerID, args.IfName, annotated); err != nil {
+			rollback()
+			return err
+		}
+	}
+
+	if ipamConf.Annotate {
+		if err := annotateLeases(store, ipamConf, annotated); err != nil {
+			rollback()
+			return err
+		}
+		err := annotations.Write(ipamConf.AnnotationsDir, ipamConf.Name, args.ContainerID, args.IfName,
+			&annotations.Annotations{Addresses: annotated})
+		if err != nil {
+			rollback()
+			return err
+		}
+	}
+
+	// Snapshots are taken opportunistically, failing to take one doesn't
+	// fail the ADD
+	if sn := ipamConf.Snapshots; sn != nil {
+		if _, err := store.SnapshotIfDue(sn.Every, sn.Count); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to snapshot the store: %v\n", err)
+		}
+	}
+
+	mirror(ipamConf, store)
+
+	if len(rangeDNS) > 0 {
+		result.DNS = appendDNS(append(rangeDNS, result.DNS))
+	}
+	// the pod's resolver completes its names with the domain they are in
+	if hostDomain != "" {
+		result.DNS.Domain = hostDomain
+	}
+	result.Routes = ipamConf.Routes
+
+	return types.PrintResult(result, confVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	ipamConf, _, err := allocator.LoadIPAMConfig(args.StdinData, args.Args)
+	if err != nil {
+		return err
+	}
+
+	store, err := openStore(ipamConf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	ctx, cancel := ipam.InvocationContext(ipamConf.ExecTimeout)
+	defer cancel()
+
+	// Hold the lock for the whole DEL, so it doesn't interleave with an ADD
+	// of the same attachment
+	if err := store.LockContext(ctx); err != nil {
+		return cnierrors.StoreUnavailable(err)
+	}
+	defer store.Unlock()
+
+	if ipamConf.Tombstones != nil {
+		stale, err := staleDel(ipamConf, store, args)
+		if err != nil || stale {
+			return err
+		}
+	}
+	released := store.GetByID(args.ContainerID, args.IfName)
+
+	// Release everything, even if an error occurs
+	var errors []string
+	if err := store.ReleaseByID(args.ContainerID, args.IfName); err != nil {
+		errors = append(errors, err.Error())
+	}
+
+	// End the lease of addresses handed over to a newer container of the pod
+	if err := store.ReleaseHandover(args.ContainerID, args.IfName); err != nil {
+		errors = append(errors, err.Error())
+	}
+
+	if t := ipamConf.Tombstones; t != nil && len(released) > 0 && errors == nil {
+		tombstone := disk.Tombstone{ID: args.ContainerID, IfName: args.IfName, Until: time.Now().Add(t.Expire)}
+		for _, ip := range released {
+			tombstone.IPs = append(tombstone.IPs, ip.String())
+		}
+		if err := store.AddTombstone(tombstone); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+
+	if ipamConf.Quarantine != nil && errors == nil {
+		if err := quarantine(ipamConf, store, args.ContainerID, args.IfName, released); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+
+	if ipamConf.Annotate {
+		if err := annotations.Remove(ipamConf.AnnotationsDir, ipamConf.Name, args.ContainerID, args.IfName); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+
+	if ipamConf.LeaseTTL != nil {
+		if err := forgetExpiry(store, args.ContainerID, args.IfName); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+
+	mirror(ipamConf, store)
+
+	if errors != nil {
+		return fmt.Errorf(strings.Join(errors, ";"))
+	}
+	return nil
+}
+
+// annotateLeases sets the lease ID of the addresses the store keeps for the
+// pod across its containers. The store must be locked.
+func annotateLeases(store *disk.Store, ipamConf *allocator.IPAMConfig, annotated []annotations.Address) error {
+	if ipamConf.PodName == "" {
+		return nil
+	}
+	pods, err := store.PodIPs()
+	if err != nil {
+		return err
+	}
+	pod := ipamConf.PodNamespace + "/" + ipamConf.PodName
+	for i := range annotated {
+		for _, ip := range pods[pod] {
+			if ip.String() == annotated[i].IP {
+				annotated[i].LeaseID = pod
+			}
+		}
+	}
+	return nil
+}
+
+func containsIP(ipConfs []*current.IPConfig, ip net.IP) bool {
+	for _, ipc := range ipConfs {
+		if ipc.Address.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// previousHolder returns the attachment holding the pod's address in the
+// range set, if it belongs to another container. The store must be locked.
+func previousHolder(store *disk.Store, rangeset *allocator.RangeSet, containerID, podNs, podName string) *disk.Handover {
+	if podName == "" {
+		return nil
+	}
+	known, ip := store.HasReservedIP(podNs, podName)
+	if !known || !rangeset.Contains(ip) {
+		return nil
+	}
+	id, ifname, held := store.HolderOf(ip)
+	if !held || id == strings.TrimSpace(containerID) {
+		return nil
+	}
+	return &disk.Handover{IP: ip.String(), ID: id, IfName: ifname}
+}
+
+// openStore opens the store of the network in the configured format. A
+// network which already has a journal keeps using it, see disk.New. Once
+// the network is cut over to its secondary store, that one is opened.
+func openStore(ipamConf *allocator.IPAMConfig) (*disk.Store, error) {
+	if sec := ipamConf.SecondaryStore; sec != nil && disk.CutOver(ipamConf.Name, ipamConf.DataDir) {
+		return openStoreIn(ipamConf, sec.DataDir, sec.StoreFormat)
+	}
+	return openStoreIn(ipamConf, ipamConf.DataDir, ipamConf.StoreFormat)
+}
+
+// openSecondaryStore opens the store changes are mirrored to, the
+// secondary store or, once the network is cut over to it, the primary one.
+// It returns nil if the network has no secondary store.
+func openSecondaryStore(ipamConf *allocator.IPAMConfig) (*disk.Store, error) {
+	sec := ipamConf.SecondaryStore
+	if sec == nil {
+		return nil, nil
+	}
+	if disk.CutOver(ipamConf.Name, ipamConf.DataDir) {
+		return openStoreIn(ipamConf, ipamConf.DataDir, ipamConf.StoreFormat)
+	}
+	return openStoreIn(ipamConf, sec.DataDir, sec.StoreFormat)
+}
+
+// mirrorLockTimeout bounds the wait for the lock of the secondary store
+const mirrorLockTimeout = 2 * time.Second
+
+// mirror writes the allocations of the store to the secondary store of the
+// network, if it has one. Failures are only logged, a store being migrated
+// to must not fail the operations; "host-local migrate" reports and repairs
+// the differences. The store must be locked.
+func mirror(ipamConf *allocator.IPAMConfig, store *disk.Store) {
+	secondary, err := openSecondaryStore(ipamConf)
+	if err == nil && secondary != nil {
+		defer secondary.Close()
+		if err = secondary.LockWithin(mirrorLockTimeout); err == nil {
+			err = store.SyncTo(secondary, rangeIDs(ipamConf))
+			secondary.Unlock()
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write the secondary store of network %s: %v\n", ipamConf.Name, err)
+	}
+}
+
+// rangeIDs returns the IDs the range sets track their last reserved IP by.
+func rangeIDs(ipamConf *allocator.IPAMConfig) []string {
+	ids := make([]string, len(ipamConf.Ranges))
+	for idx := range ipamConf.Ranges {
+		ids[idx] = strconv.Itoa(idx)
+	}
+	return ids
+}
+
+func openStoreIn(ipamConf *allocator.IPAMConfig, dataDir, format string) (*disk.Store, error) {
+	var store *disk.Store
+	var err error
+	if format == disk.FormatJournal {
+		store, err = disk.NewJournal(ipamConf.Name, dataDir)
+	} else {
+		store, err = disk.New(ipamConf.Name, dataDir)
+	}
+	if err != nil {
+		return nil, cnierrors.StoreUnavailable(err)
+	}
+	if sn := ipamConf.Snapshots; sn != nil && sn.Dir != "" {
+		store.SetSnapshotDir(filepath.Join(sn.Dir, ipamConf.Name))
+	}
+	if err := store.SetLabel(ipamConf.SELinuxContext); err != nil {
+		store.Close()
+		return nil, err
+	}
+	if in := ipamConf.Integrity; in != nil {
+		key, err := disk.LoadKey(in.KeyFile)
+		if err == nil {
+			err = store.SetKey(key, in.Encrypt)
+		}
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+	return store, nil
+}
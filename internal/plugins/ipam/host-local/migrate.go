@@ -0,0 +1,134 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostlocal
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+)
+
+// runMigrate implements "host-local migrate", which moves a network to its
+// secondary store while the plugin writes both. Without an action, it
+// verifies that the stores agree:
+//
+//	host-local migrate -config /etc/cni/net.d/10-mynet.conflist
+//	host-local migrate -config /etc/cni/net.d/10-mynet.conflist -sync
+//	host-local migrate -config /etc/cni/net.d/10-mynet.conflist -cutover
+//
+// -sync copies the allocations made before the secondary store was
+// configured, and repairs writes to it which failed. -cutover makes the
+// plugin write the secondary store first, once the stores agree; the
+// network configuration can then be changed to it at leisure. -rollback
+// undoes -cutover.
+func runMigrate(args []string, out io.Writer) error {
+	var file string
+	var sync, cutover, rollback bool
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.StringVar(&file, "config", "", "network configuration file")
+	flags.BoolVar(&sync, "sync", false, "make the secondary store agree with the store written first")
+	flags.BoolVar(&cutover, "cutover", false, "write the secondary store first from now on")
+	flags.BoolVar(&rollback, "rollback", false, "write the primary store first again")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if file == "" {
+		return fmt.Errorf("-config is required")
+	}
+	actions := 0
+	for _, set := range []bool{sync, cutover, rollback} {
+		if set {
+			actions++
+		}
+	}
+	if actions > 1 {
+		return fmt.Errorf("only one of -sync, -cutover and -rollback may be given")
+	}
+
+	data, err := loadReportConf(file)
+	if err != nil {
+		return err
+	}
+	ipamConf, _, err := allocator.LoadIPAMConfig(data, "")
+	if err != nil {
+		return err
+	}
+	sec := ipamConf.SecondaryStore
+	if sec == nil {
+		return fmt.Errorf("network %s has no secondaryStore", ipamConf.Name)
+	}
+
+	primary, err := openStoreIn(ipamConf, ipamConf.DataDir, ipamConf.StoreFormat)
+	if err != nil {
+		return err
+	}
+	defer primary.Close()
+	secondary, err := openStoreIn(ipamConf, sec.DataDir, sec.StoreFormat)
+	if err != nil {
+		return err
+	}
+	defer secondary.Close()
+	if err := primary.Lock(); err != nil {
+		return err
+	}
+	defer primary.Unlock()
+	if err := secondary.LockWithin(mirrorLockTimeout); err != nil {
+		return err
+	}
+	defer secondary.Unlock()
+
+	// changes are mirrored from the store written first to the other one
+	cutOver := disk.CutOver(ipamConf.Name, ipamConf.DataDir)
+	from, to, toDir := primary, secondary, secondary.DataDir()
+	if cutOver {
+		from, to, toDir = secondary, primary, primary.DataDir()
+	}
+
+	if sync {
+		if err := from.SyncTo(to, rangeIDs(ipamConf)); err != nil {
+			return fmt.Errorf("failed to sync network %s to %s: %v", ipamConf.Name, toDir, err)
+		}
+		fmt.Fprintf(out, "synced network %s to %s\n", ipamConf.Name, toDir)
+		return nil
+	}
+
+	diffs, err := from.Diff(to)
+	if err != nil {
+		return fmt.Errorf("failed to compare the stores of network %s: %v", ipamConf.Name, err)
+	}
+	for _, d := range diffs {
+		fmt.Fprintf(out, "%s: %s\n", toDir, d)
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("network %s: %d leases differ between the stores, see -sync", ipamConf.Name, len(diffs))
+	}
+
+	switch {
+	case cutover && cutOver, rollback && !cutOver:
+		return fmt.Errorf("network %s is already written to %s first", ipamConf.Name, from.DataDir())
+	case cutover || rollback:
+		if err := primary.SetCutOver(cutover); err != nil {
+			return fmt.Errorf("failed to switch network %s to %s: %v", ipamConf.Name, toDir, err)
+		}
+		fmt.Fprintf(out, "network %s is written to %s first\n", ipamConf.Name, toDir)
+	default:
+		fmt.Fprintf(out, "the stores of network %s agree\n", ipamConf.Name)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostlocal
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+)
+
+// quarantine holds the addresses released by the attachment back from
+// other attachments for the quarantine period. The store must be locked.
+func quarantine(ipamConf *allocator.IPAMConfig, store *disk.Store, containerID, ifName string, released []net.IP) error {
+	if len(released) == 0 {
+		return nil
+	}
+	until := time.Now().Add(ipamConf.Quarantine.Expire).UTC()
+	quarantined := make([]disk.Quarantined, 0, len(released))
+	for _, ip := range released {
+		quarantined = append(quarantined, disk.Quarantined{IP: ip.String(), ID: containerID, IfName: ifName, Until: until})
+	}
+	if err := store.Quarantine(quarantined); err != nil {
+		return fmt.Errorf("failed to quarantine the released addresses: %v", err)
+	}
+	return nil
+}
+
+// runQuarantine implements "host-local quarantine", which lists the
+// addresses of a network released too recently to be allocated to another
+// attachment, see allocator.Quarantine:
+//
+//	host-local quarantine -network mynet -json
+func runQuarantine(args []string, out io.Writer) error {
+	var sf snapshotFlags
+	var asJSON bool
+	flags := flag.NewFlagSet("quarantine", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.StringVar(&sf.network, "network", "", "name of the network")
+	flags.StringVar(&sf.dataDir, "datadir", "", "optional data directory of the network")
+	flags.BoolVar(&asJSON, "json", false, "print the quarantined addresses as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	store, err := sf.openLocked()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	quarantined, err := store.Quarantined()
+	store.Unlock()
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(quarantined, func(i, j int) bool {
+		return quarantined[i].Until.Before(quarantined[j].Until)
+	})
+	if asJSON {
+		return json.NewEncoder(out).Encode(quarantined)
+	}
+	now := time.Now()
+	for _, q := range quarantined {
+		fmt.Fprintf(out, "%s\tuntil %s (%s)\treleased by %s/%s\n", q.IP, q.Until.Format(time.RFC3339),
+			q.Until.Sub(now).Round(time.Second), q.ID, q.IfName)
+	}
+	return nil
+}
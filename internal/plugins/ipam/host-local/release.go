@@ -0,0 +1,93 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostlocal
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+)
+
+// runRelease implements "host-local release", which frees addresses of
+// containers whose ID is no longer known, e.g. after the runtime lost its
+// state:
+//
+//	host-local release -network mynet -ip 10.1.2.3
+//	host-local release -network mynet -pod kube-system/coredns-abcde
+func runRelease(args []string, out io.Writer) error {
+	var network, dataDir, ipStr, pod string
+	flags := flag.NewFlagSet("release", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.StringVar(&network, "network", "", "name of the network")
+	flags.StringVar(&dataDir, "datadir", "", "optional data directory of the network")
+	flags.StringVar(&ipStr, "ip", "", "IP address to release")
+	flags.StringVar(&pod, "pod", "", "namespace/name of the pod whose IPs to release")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if network == "" {
+		return fmt.Errorf("-network is required")
+	}
+	if (ipStr == "") == (pod == "") {
+		return fmt.Errorf("exactly one of -ip and -pod is required")
+	}
+
+	store, err := disk.New(network, dataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err := store.Lock(); err != nil {
+		return err
+	}
+	defer store.Unlock()
+
+	if ipStr != "" {
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			return fmt.Errorf("invalid IP address %q", ipStr)
+		}
+		found, err := store.ReleaseByIP(ip)
+		if err != nil {
+			return fmt.Errorf("failed to release %s: %v", ip, err)
+		}
+		if !found {
+			return fmt.Errorf("%s is not allocated in network %s", ip, network)
+		}
+		fmt.Fprintf(out, "released %s\n", ip)
+		return nil
+	}
+
+	podNs, podName, ok := strings.Cut(pod, "/")
+	if !ok || podNs == "" || podName == "" {
+		return fmt.Errorf("invalid pod %q, expected namespace/name", pod)
+	}
+	ips, err := store.ReleaseByPod(podNs, podName)
+	for _, ip := range ips {
+		fmt.Fprintf(out, "released %s\n", ip)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to release the IPs of pod %s: %v", pod, err)
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("no IPs are reserved for pod %s in network %s", pod, network)
+	}
+	return nil
+}
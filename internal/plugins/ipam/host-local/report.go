@@ -0,0 +1,307 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostlocal
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+)
+
+const (
+	// reportAnnotationPrefix is followed by the network name in the node
+	// annotation a network is reported in
+	reportAnnotationPrefix = "host-local.cni.dev/"
+
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// NodeReport is the state of a network on a node, published as the node
+// annotation of the network by "host-local report".
+type NodeReport struct {
+	Time   time.Time     `json:"time"`
+	Ranges []RangeStatus `json:"ranges"`
+	// Pods are the addresses kept for pods across restarts, by
+	// "namespace/name"
+	Pods map[string][]string `json:"pods,omitempty"`
+}
+
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// runReport implements "host-local report", which publishes the range
+// utilization and the pod addresses of networks as annotations of the
+// node, so the IPAM state can be seen from the API server:
+//
+//	host-local report -node $NODE_NAME -config /etc/cni/net.d/10-mynet.conflist
+//	host-local report -config /etc/cni/net.d/10-mynet.conflist -interval 1m
+//
+// Run in a pod, it uses its service account, which must be allowed to
+// patch nodes. With -interval it reports until it is terminated.
+func runReport(args []string, out io.Writer) error {
+	var configs stringList
+	var node, server, tokenFile, caFile string
+	var interval time.Duration
+	var dryRun bool
+	flags := flag.NewFlagSet("report", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.Var(&configs, "config", "network configuration file, may be repeated")
+	flags.StringVar(&node, "node", os.Getenv("NODE_NAME"), "name of the node, defaults to $NODE_NAME")
+	flags.DurationVar(&interval, "interval", 0, "report every interval until terminated, instead of once")
+	flags.StringVar(&server, "server", "", "URL of the API server, defaults to the in-cluster one")
+	flags.StringVar(&tokenFile, "token", serviceAccountDir+"/token", "file with the bearer token")
+	flags.StringVar(&caFile, "ca", serviceAccountDir+"/ca.crt", "file with the CA of the API server")
+	flags.BoolVar(&dryRun, "dry-run", false, "print the annotations instead of publishing them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if len(configs) == 0 {
+		return fmt.Errorf("-config is required")
+	}
+	if node == "" && !dryRun {
+		return fmt.Errorf("-node is required")
+	}
+
+	publish := func(annotations map[string]string) error {
+		return json.NewEncoder(out).Encode(annotations)
+	}
+	if !dryRun {
+		kc, err := newKubeClient(server, tokenFile, caFile)
+		if err != nil {
+			return err
+		}
+		publish = func(annotations map[string]string) error {
+			return kc.patchNodeAnnotations(node, annotations)
+		}
+	}
+
+	report := func() error {
+		annotations, err := reportAnnotations(configs)
+		if err != nil {
+			return err
+		}
+		return publish(annotations)
+	}
+	if interval <= 0 {
+		return report()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := report(); err != nil {
+			log.Printf("failed to report on node %s: %v", node, err)
+		}
+		select {
+		case <-sig:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// reportAnnotations returns the node annotations of the networks in the
+// configuration files.
+func reportAnnotations(configs []string) (map[string]string, error) {
+	annotations := map[string]string{}
+	for _, file := range configs {
+		network, report, err := networkReport(file)
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(report)
+		if err != nil {
+			return nil, err
+		}
+		annotations[reportAnnotationPrefix+network] = string(data)
+	}
+	return annotations, nil
+}
+
+func networkReport(file string) (string, *NodeReport, error) {
+	data, err := loadReportConf(file)
+	if err != nil {
+		return "", nil, err
+	}
+	ipamConf, _, err := allocator.LoadIPAMConfig(data, "")
+	if err != nil {
+		return "", nil, err
+	}
+
+	store, err := openStore(ipamConf)
+	if err != nil {
+		return "", nil, err
+	}
+	defer store.Close()
+	if err := store.Lock(); err != nil {
+		return "", nil, err
+	}
+	defer store.Unlock()
+
+	if err := allocator.ResolveGeneratedRanges(ipamConf, store); err != nil {
+		return "", nil, err
+	}
+	// the same metrics as STATUS
+	status, err := storeStatus(ipamConf, store)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get status of network %s: %v", ipamConf.Name, err)
+	}
+	pods, err := store.PodIPs()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to list pod addresses of network %s: %v", ipamConf.Name, err)
+	}
+
+	report := &NodeReport{Time: time.Now().UTC(), Ranges: status.Ranges}
+	for pod, ips := range pods {
+		if report.Pods == nil {
+			report.Pods = map[string][]string{}
+		}
+		for _, ip := range ips {
+			report.Pods[pod] = append(report.Pods[pod], ip.String())
+		}
+		sort.Strings(report.Pods[pod])
+	}
+	return ipamConf.Name, report, nil
+}
+
+// loadReportConf returns the configuration of the host-local plugin in a
+// network configuration file, which is either a list or a single plugin.
+func loadReportConf(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+	list := struct {
+		Name       string                   `json:"name"`
+		CNIVersion string                   `json:"cniVersion"`
+		Plugins    []map[string]interface{} `json:"plugins"`
+	}{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse config %q: %v", file, err)
+	}
+	if list.Plugins == nil {
+		return data, nil
+	}
+	for _, p := range list.Plugins {
+		if ipam, ok := p["ipam"].(map[string]interface{}); ok && ipam["type"] == "host-local" {
+			p["name"] = list.Name
+			p["cniVersion"] = list.CNIVersion
+			return json.Marshal(p)
+		}
+	}
+	return nil, fmt.Errorf("no plugin with host-local IPAM in config %q", file)
+}
+
+// kubeClient patches nodes through the API server. It reads the token for
+// every request, service account tokens are rotated.
+type kubeClient struct {
+	server    string
+	tokenFile string
+	client    *http.Client
+}
+
+func newKubeClient(server, tokenFile, caFile string) (*kubeClient, error) {
+	if server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("-server is required outside of a cluster")
+		}
+		server = "https://" + net.JoinHostPort(host, port)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read CA: %v", err)
+		}
+		if err == nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("no certificates in CA file %s", caFile)
+			}
+		}
+	}
+
+	return &kubeClient{
+		server:    strings.TrimSuffix(server, "/"),
+		tokenFile: tokenFile,
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+		},
+	}, nil
+}
+
+// patchNodeAnnotations sets the annotations of the node, leaving its other
+// annotations alone.
+func (kc *kubeClient) patchNodeAnnotations(node string, annotations map[string]string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPatch, kc.server+"/api/v1/nodes/"+url.PathEscape(node), bytes.NewReader(patch))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set("Accept", "application/json")
+	if kc.tokenFile != "" {
+		token, err := os.ReadFile(kc.tokenFile)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read token: %v", err)
+		}
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+		}
+	}
+
+	resp, err := kc.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to patch node %s: %v", node, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("failed to patch node %s: %s: %s", node, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostlocal
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+)
+
+// snapshotFlags are the flags shared by "host-local snapshot" and
+// "host-local restore".
+type snapshotFlags struct {
+	network, dataDir, snapshotDir string
+}
+
+func (f *snapshotFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.network, "network", "", "name of the network")
+	flags.StringVar(&f.dataDir, "datadir", "", "optional data directory of the network")
+	flags.StringVar(&f.snapshotDir, "snapshotdir", "", "optional snapshots dir of the network configuration")
+}
+
+// openLocked opens and locks the store of the network.
+func (f *snapshotFlags) openLocked() (*disk.Store, error) {
+	if f.network == "" {
+		return nil, fmt.Errorf("-network is required")
+	}
+	store, err := disk.New(f.network, f.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if f.snapshotDir != "" {
+		store.SetSnapshotDir(filepath.Join(f.snapshotDir, f.network))
+	}
+	if err := store.Lock(); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// runSnapshot implements "host-local snapshot", which takes a snapshot of
+// the store of a network, or lists them:
+//
+//	host-local snapshot -network mynet
+//	host-local snapshot -network mynet -list
+func runSnapshot(args []string, out io.Writer) error {
+	var sf snapshotFlags
+	var list bool
+	flags := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	flags.SetOutput(out)
+	sf.register(flags)
+	flags.BoolVar(&list, "list", false, "list the snapshots, the newest first")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	store, err := sf.openLocked()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	defer store.Unlock()
+
+	if list {
+		names, err := store.Snapshots()
+		if err != nil {
+			return fmt.Errorf("failed to list snapshots of network %s: %v", sf.network, err)
+		}
+		for _, name := range names {
+			fmt.Fprintln(out, name)
+		}
+		return nil
+	}
+
+	name, err := store.Snapshot()
+	if err != nil {
+		return fmt.Errorf("failed to snapshot network %s: %v", sf.network, err)
+	}
+	fmt.Fprintf(out, "took snapshot %s\n", name)
+	return nil
+}
+
+// runRestore implements "host-local restore", which replaces the store of
+// a network with one of its snapshots, e.g. after filesystem corruption:
+//
+//	host-local restore -network mynet -snapshot latest
+//	host-local restore -network mynet -snapshot 20240102T030405.000000000Z.tar.gz
+func runRestore(args []string, out io.Writer) error {
+	var sf snapshotFlags
+	var snapshot string
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags.SetOutput(out)
+	sf.register(flags)
+	flags.StringVar(&snapshot, "snapshot", "", `snapshot to restore, or "latest"`)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if snapshot == "" {
+		return fmt.Errorf("-snapshot is required")
+	}
+
+	store, err := sf.openLocked()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	defer store.Unlock()
+
+	if snapshot == "latest" {
+		names, err := store.Snapshots()
+		if err != nil {
+			return fmt.Errorf("failed to list snapshots of network %s: %v", sf.network, err)
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("network %s has no snapshots", sf.network)
+		}
+		snapshot = names[0]
+	}
+
+	if err := store.RestoreSnapshot(snapshot); err != nil {
+		return fmt.Errorf("failed to restore network %s: %v", sf.network, err)
+	}
+	fmt.Fprintf(out, "restored snapshot %s\n", snapshot)
+	return nil
+}
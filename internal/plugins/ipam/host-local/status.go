@@ -0,0 +1,182 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostlocal
+
+import (
+	"encoding/json"
+	"math"
+	"math/big"
+	"net"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+)
+
+// errPluginNotAvailable is the spec's well known error code for a plugin
+// which cannot service ADD requests.
+const errPluginNotAvailable uint = 50
+
+// Status is written to stdout on STATUS. Runtimes only look at the exit
+// code; node agents can parse the output to surface IPAM health.
+type Status struct {
+	Network string        `json:"network"`
+	Store   StoreStatus   `json:"store"`
+	Ranges  []RangeStatus `json:"ranges"`
+	// Integrity is only set if the lease files are signed or encrypted
+	Integrity *IntegrityStatus `json:"integrity,omitempty"`
+}
+
+// IntegrityStatus lists the lease files which failed verification against
+// the node key.
+type IntegrityStatus struct {
+	Encrypted bool                 `json:"encrypted"`
+	Failures  []disk.VerifyFailure `json:"failures"`
+}
+
+type StoreStatus struct {
+	Backend string `json:"backend"`
+	Format  string `json:"format"`
+	DataDir string `json:"dataDir"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+type RangeStatus struct {
+	RangeSet    int     `json:"rangeSet"`
+	Subnet      string  `json:"subnet"`
+	RangeStart  string  `json:"rangeStart"`
+	RangeEnd    string  `json:"rangeEnd"`
+	Size        uint64  `json:"size"`
+	Allocated   uint64  `json:"allocated"`
+	Utilization float64 `json:"utilization"`
+}
+
+func cmdStatus(args *skel.CmdArgs) error {
+	ipamConf, _, err := allocator.LoadIPAMConfig(args.StdinData, args.Args)
+	if err != nil {
+		return err
+	}
+
+	store, err := openStore(ipamConf)
+	if err != nil {
+		return types.NewError(errPluginNotAvailable, "store unavailable", err.Error())
+	}
+	defer store.Close()
+
+	ctx, cancel := ipam.InvocationContext(ipamConf.ExecTimeout)
+	defer cancel()
+	if err := store.LockContext(ctx); err != nil {
+		return types.NewError(errPluginNotAvailable, "failed to lock store", err.Error())
+	}
+	defer store.Unlock()
+
+	if f, frozen := store.Frozen(); frozen {
+		return types.NewError(errPluginNotAvailable, "network frozen", frozenError(ipamConf.Name, f).Error())
+	}
+
+	// a store the security policy of the node keeps the plugin from
+	// writing to, or labels for others, can't serve ADDs
+	if conflicts := store.Preflight(); len(conflicts) > 0 {
+		details, _ := json.Marshal(conflicts)
+		return types.NewError(errPluginNotAvailable, "store conflicts with security policy", string(details))
+	}
+
+	if err := allocator.ResolveGeneratedRanges(ipamConf, store); err != nil {
+		return types.NewError(errPluginNotAvailable, "failed to resolve generated ranges", err.Error())
+	}
+
+	status, err := storeStatus(ipamConf, store)
+	if err != nil {
+		return types.NewError(errPluginNotAvailable, "store unhealthy", err.Error())
+	}
+	if status.Integrity != nil && len(status.Integrity.Failures) > 0 {
+		details, _ := json.Marshal(status.Integrity.Failures)
+		return types.NewError(errPluginNotAvailable, "store integrity check failed", string(details))
+	}
+
+	return json.NewEncoder(os.Stdout).Encode(status)
+}
+
+// storeStatus collects the status of the network. It must be called with
+// the store locked and returns an error if the store is not usable.
+func storeStatus(ipamConf *allocator.IPAMConfig, store *disk.Store) (*Status, error) {
+	status := &Status{
+		Network: ipamConf.Name,
+		Store: StoreStatus{
+			Backend: "disk",
+			Format:  store.Format(),
+			DataDir: store.DataDir(),
+		},
+		Ranges: []RangeStatus{},
+	}
+
+	if err := store.CheckHealth(); err != nil {
+		return nil, err
+	}
+	ips, err := store.Allocations()
+	if err != nil {
+		return nil, err
+	}
+	status.Store.Healthy = true
+
+	if ipamConf.Integrity != nil {
+		failures, err := store.Verify(false)
+		if err != nil {
+			return nil, err
+		}
+		status.Integrity = &IntegrityStatus{
+			Encrypted: ipamConf.Integrity.Encrypt,
+			Failures:  failures,
+		}
+	}
+
+	for idx, rangeset := range ipamConf.Ranges {
+		for _, r := range rangeset {
+			rs := RangeStatus{
+				RangeSet:   idx,
+				Subnet:     (*net.IPNet)(&r.Subnet).String(),
+				RangeStart: r.RangeStart.String(),
+				RangeEnd:   r.RangeEnd.String(),
+				Size:       rangeSize(r.RangeStart, r.RangeEnd),
+			}
+			for _, ip := range ips {
+				if r.Contains(ip) {
+					rs.Allocated++
+				}
+			}
+			if rs.Size > 0 {
+				rs.Utilization = float64(rs.Allocated) / float64(rs.Size)
+			}
+			status.Ranges = append(status.Ranges, rs)
+		}
+	}
+
+	return status, nil
+}
+
+// rangeSize returns the number of addresses from start to end, inclusive,
+// capped at the largest uint64 for huge IPv6 ranges.
+func rangeSize(start, end net.IP) uint64 {
+	size := new(big.Int).Sub(new(big.Int).SetBytes(end.To16()), new(big.Int).SetBytes(start.To16()))
+	size.Add(size, big.NewInt(1))
+	if !size.IsUint64() {
+		return math.MaxUint64
+	}
+	return size.Uint64()
+}
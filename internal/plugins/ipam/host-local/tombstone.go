@@ -0,0 +1,70 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostlocal
+
+import (
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+)
+
+// staleDel returns true if the DEL repeats, or arrives late for, a DEL of
+// the attachment recorded in a tombstone, while the attachment was added
+// again since. Its new addresses are only released if the prevResult of
+// the DEL names exactly them, so a DEL without prevResult leaves them to a
+// later DEL or GC. The store must be locked.
+func staleDel(ipamConf *allocator.IPAMConfig, store *disk.Store, args *skel.CmdArgs) (bool, error) {
+	if _, ok, err := store.TombstoneOf(args.ContainerID, args.IfName); !ok || err != nil {
+		return false, err
+	}
+	allocated := store.GetByID(args.ContainerID, args.IfName)
+	if len(allocated) == 0 {
+		return false, nil
+	}
+
+	prev, err := parsePrevResult(args.StdinData)
+	if err != nil {
+		return false, err
+	}
+	if prev == nil {
+		return true, nil
+	}
+	named := map[string]bool{}
+	for _, ipc := range prev.IPs {
+		if inRanges(ipamConf, ipc.Address.IP) {
+			named[ipc.Address.IP.String()] = true
+		}
+	}
+	if len(named) != len(allocated) {
+		return true, nil
+	}
+	for _, ip := range allocated {
+		if !named[ip.String()] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func inRanges(ipamConf *allocator.IPAMConfig, ip net.IP) bool {
+	for _, rangeset := range ipamConf.Ranges {
+		if rangeset.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
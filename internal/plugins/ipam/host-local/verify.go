@@ -0,0 +1,81 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostlocal
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+)
+
+// runVerify implements "host-local verify", which checks the lease files of
+// a network against the node key:
+//
+//	host-local verify -network mynet -key /etc/cni/node.key
+//
+// With -sign, lease files written before the key was configured are signed
+// (or encrypted with -encrypt) instead of being reported.
+func runVerify(args []string, out io.Writer) error {
+	var network, dataDir, keyFile string
+	var encrypt, sign bool
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.StringVar(&network, "network", "", "name of the network")
+	flags.StringVar(&dataDir, "datadir", "", "optional data directory of the network")
+	flags.StringVar(&keyFile, "key", "", "file with the node key")
+	flags.BoolVar(&encrypt, "encrypt", false, "lease files are encrypted")
+	flags.BoolVar(&sign, "sign", false, "sign lease files which have no signature yet")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if network == "" {
+		return fmt.Errorf("-network is required")
+	}
+	if keyFile == "" {
+		return fmt.Errorf("-key is required")
+	}
+	key, err := disk.LoadKey(keyFile)
+	if err != nil {
+		return err
+	}
+
+	store, err := disk.New(network, dataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err := store.SetKey(key, encrypt); err != nil {
+		return err
+	}
+	if err := store.Lock(); err != nil {
+		return err
+	}
+	defer store.Unlock()
+
+	failures, err := store.Verify(sign)
+	if err != nil {
+		return fmt.Errorf("failed to verify network %s: %v", network, err)
+	}
+	for _, f := range failures {
+		fmt.Fprintf(out, "%s: %s\n", f.File, f.Reason)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d lease files of network %s failed verification", len(failures), network)
+	}
+	return nil
+}
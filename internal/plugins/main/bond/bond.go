@@ -0,0 +1,555 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bond
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/include"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+)
+
+type Link struct {
+	Name string `json:"name"`
+}
+
+type NetConf struct {
+	types.NetConf
+	Mode             string   `json:"mode"`
+	Links            []Link   `json:"links"`
+	LinksInContainer bool     `json:"linksInContainer"`
+	MTU              int      `json:"mtu"`
+	Miimon           int      `json:"miimon"`
+	UpDelay          int      `json:"updelay"`
+	DownDelay        int      `json:"downdelay"`
+	ArpInterval      int      `json:"arpInterval"`
+	ArpIPTargets     []string `json:"arpIpTargets"`
+	ArpValidate      string   `json:"arpValidate"`
+	FailOverMac      string   `json:"failOverMac"`
+	LacpRate         string   `json:"lacpRate"`
+	XmitHashPolicy   string   `json:"xmitHashPolicy"`
+}
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func loadConf(bytes []byte) (*NetConf, error) {
+	n := &NetConf{
+		Mode: "active-backup",
+	}
+	if err := config.Validate(bytes, n); err != nil {
+		return nil, fmt.Errorf("invalid network configuration: %v", err)
+	}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	mode := netlink.StringToBondMode(n.Mode)
+	if mode != netlink.BOND_MODE_ACTIVE_BACKUP && mode != netlink.BOND_MODE_802_3AD {
+		return nil, fmt.Errorf("unsupported bond mode %q, must be \"active-backup\" or \"802.3ad\"", n.Mode)
+	}
+	if len(n.Links) < 2 {
+		return nil, fmt.Errorf("a bond needs at least two links, got %d", len(n.Links))
+	}
+	seen := map[string]bool{}
+	for _, l := range n.Links {
+		if l.Name == "" {
+			return nil, errors.New("link name is required")
+		}
+		if seen[l.Name] {
+			return nil, fmt.Errorf("link %q is listed more than once", l.Name)
+		}
+		seen[l.Name] = true
+	}
+	if n.MTU < 0 {
+		return nil, fmt.Errorf("invalid MTU %d", n.MTU)
+	}
+	if n.Miimon < 0 || n.UpDelay < 0 || n.DownDelay < 0 || n.ArpInterval < 0 {
+		return nil, errors.New("miimon, updelay, downdelay and arpInterval must not be negative")
+	}
+	if n.Miimon > 0 && n.ArpInterval > 0 {
+		return nil, errors.New("miimon and arpInterval are mutually exclusive")
+	}
+	if n.ArpInterval > 0 {
+		if mode == netlink.BOND_MODE_802_3AD {
+			return nil, errors.New("arp monitoring is not supported in 802.3ad mode")
+		}
+		if len(n.ArpIPTargets) == 0 {
+			return nil, errors.New("arpInterval requires at least one entry in arpIpTargets")
+		}
+	}
+	for _, t := range n.ArpIPTargets {
+		if parsed := net.ParseIP(t); parsed == nil || parsed.To4() == nil {
+			return nil, fmt.Errorf("invalid arpIpTargets entry %q, must be an IPv4 address", t)
+		}
+	}
+	if n.ArpValidate != "" {
+		if _, ok := netlink.StringToBondArpValidateMap[n.ArpValidate]; !ok {
+			return nil, fmt.Errorf("invalid arpValidate %q", n.ArpValidate)
+		}
+	}
+	if n.FailOverMac != "" {
+		if _, ok := netlink.StringToBondFailOverMacMap[n.FailOverMac]; !ok {
+			return nil, fmt.Errorf("invalid failOverMac %q", n.FailOverMac)
+		}
+	}
+	if n.LacpRate != "" {
+		if mode != netlink.BOND_MODE_802_3AD {
+			return nil, errors.New("lacpRate is only supported in 802.3ad mode")
+		}
+		if netlink.StringToBondLacpRate(n.LacpRate) == netlink.BOND_LACP_RATE_UNKNOWN {
+			return nil, fmt.Errorf("invalid lacpRate %q", n.LacpRate)
+		}
+	}
+	if n.XmitHashPolicy != "" {
+		if mode != netlink.BOND_MODE_802_3AD {
+			return nil, errors.New("xmitHashPolicy is only supported in 802.3ad mode")
+		}
+		if netlink.StringToBondXmitHashPolicy(n.XmitHashPolicy) == netlink.BOND_XMIT_HASH_POLICY_UNKNOWN {
+			return nil, fmt.Errorf("invalid xmitHashPolicy %q", n.XmitHashPolicy)
+		}
+	}
+
+	return n, nil
+}
+
+// newBond builds the bond link described by conf. It is only called on a
+// conf which passed loadConf.
+func newBond(conf *NetConf, ifName string) *netlink.Bond {
+	bond := netlink.NewLinkBond(netlink.LinkAttrs{
+		Name: ifName,
+		MTU:  conf.MTU,
+	})
+	bond.Mode = netlink.StringToBondMode(conf.Mode)
+	bond.Miimon = conf.Miimon
+	if conf.UpDelay > 0 {
+		bond.UpDelay = conf.UpDelay
+	}
+	if conf.DownDelay > 0 {
+		bond.DownDelay = conf.DownDelay
+	}
+	if conf.ArpInterval > 0 {
+		bond.ArpInterval = conf.ArpInterval
+		for _, t := range conf.ArpIPTargets {
+			bond.ArpIpTargets = append(bond.ArpIpTargets, net.ParseIP(t).To4())
+		}
+	}
+	if conf.ArpValidate != "" {
+		bond.ArpValidate = netlink.StringToBondArpValidateMap[conf.ArpValidate]
+	}
+	if conf.FailOverMac != "" {
+		bond.FailOverMac = netlink.StringToBondFailOverMacMap[conf.FailOverMac]
+	}
+	if conf.LacpRate != "" {
+		bond.LacpRate = netlink.StringToBondLacpRate(conf.LacpRate)
+	}
+	if conf.XmitHashPolicy != "" {
+		bond.XmitHashPolicy = netlink.StringToBondXmitHashPolicy(conf.XmitHashPolicy)
+	}
+	return bond
+}
+
+// moveLinksIn moves the host links named in conf into the container.
+func moveLinksIn(conf *NetConf, netns ns.NetNS) error {
+	for i, l := range conf.Links {
+		link, err := netlink.LinkByName(l.Name)
+		if err != nil {
+			return fmt.Errorf("failed to find link %q: %v", l.Name, err)
+		}
+		if err := netlink.LinkSetDown(link); err != nil {
+			return fmt.Errorf("failed to set %q down: %v", l.Name, err)
+		}
+		if err := netlink.LinkSetNsFd(link, int(netns.Fd())); err != nil {
+			// put back the links we already moved
+			_ = moveLinksOut(&NetConf{Links: conf.Links[:i]}, netns)
+			return fmt.Errorf("failed to move %q to container netns: %v", l.Name, err)
+		}
+	}
+	return nil
+}
+
+// moveLinksOut moves the links named in conf from the container back to the
+// current (host) namespace. Links which are gone are skipped.
+func moveLinksOut(conf *NetConf, netns ns.NetNS) error {
+	hostNS, err := ns.GetCurrentNS()
+	if err != nil {
+		return fmt.Errorf("failed to get host netns: %v", err)
+	}
+	defer hostNS.Close()
+
+	return netns.Do(func(_ ns.NetNS) error {
+		for _, l := range conf.Links {
+			link, err := netlink.LinkByName(l.Name)
+			if err != nil {
+				if _, ok := err.(netlink.LinkNotFoundError); ok {
+					continue
+				}
+				return fmt.Errorf("failed to find link %q: %v", l.Name, err)
+			}
+			if err := netlink.LinkSetDown(link); err != nil {
+				return fmt.Errorf("failed to set %q down: %v", l.Name, err)
+			}
+			if err := netlink.LinkSetNsFd(link, int(hostNS.Fd())); err != nil {
+				return fmt.Errorf("failed to move %q to host netns: %v", l.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// createBond creates the bond in the container and enslaves the links. It
+// must be called inside the container netns.
+func createBond(conf *NetConf, ifName string) (*netlink.Bond, []netlink.Link, error) {
+	slaves := make([]netlink.Link, 0, len(conf.Links))
+	for _, l := range conf.Links {
+		link, err := netlink.LinkByName(l.Name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to find link %q in container: %v", l.Name, err)
+		}
+		if link.Attrs().MasterIndex != 0 {
+			return nil, nil, fmt.Errorf("link %q is already enslaved", l.Name)
+		}
+		slaves = append(slaves, link)
+	}
+
+	bond := newBond(conf, ifName)
+	if err := netlink.LinkAdd(bond); err != nil {
+		return nil, nil, fmt.Errorf("failed to create bond %q: %v", ifName, err)
+	}
+
+	err := func() error {
+		for _, slave := range slaves {
+			// the kernel only enslaves links which are down
+			if err := netlink.LinkSetDown(slave); err != nil {
+				return fmt.Errorf("failed to set %q down: %v", slave.Attrs().Name, err)
+			}
+			if err := netlink.LinkSetMasterByIndex(slave, bond.Attrs().Index); err != nil {
+				return fmt.Errorf("failed to enslave %q to %q: %v", slave.Attrs().Name, ifName, err)
+			}
+			if err := netlink.LinkSetUp(slave); err != nil {
+				return fmt.Errorf("failed to set %q up: %v", slave.Attrs().Name, err)
+			}
+		}
+		if err := netlink.LinkSetUp(bond); err != nil {
+			return fmt.Errorf("failed to set %q up: %v", ifName, err)
+		}
+		return nil
+	}()
+	if err != nil {
+		releaseBond(conf, ifName)
+		return nil, nil, err
+	}
+
+	// Re-fetch the links to get all properties/attributes
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to refetch bond %q: %v", ifName, err)
+	}
+	b, ok := link.(*netlink.Bond)
+	if !ok {
+		return nil, nil, fmt.Errorf("link %q is not a bond", ifName)
+	}
+	for i, slave := range slaves {
+		if slaves[i], err = netlink.LinkByIndex(slave.Attrs().Index); err != nil {
+			return nil, nil, fmt.Errorf("failed to refetch link %q: %v", slave.Attrs().Name, err)
+		}
+	}
+
+	return b, slaves, nil
+}
+
+// releaseBond frees the bond's slaves and deletes the bond. It must be called
+// inside the container netns and tolerates a bond which is already gone.
+func releaseBond(conf *NetConf, ifName string) error {
+	for _, l := range conf.Links {
+		link, err := netlink.LinkByName(l.Name)
+		if err != nil {
+			continue
+		}
+		if link.Attrs().MasterIndex != 0 {
+			if err := netlink.LinkSetNoMaster(link); err != nil {
+				return fmt.Errorf("failed to release %q: %v", l.Name, err)
+			}
+		}
+	}
+	if err := ip.DelLinkByName(ifName); err != nil && err != ip.ErrLinkNotFound {
+		return fmt.Errorf("failed to delete bond %q: %v", ifName, err)
+	}
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	n, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return ns.OpenError(args.Netns, err)
+	}
+	defer netns.Close()
+
+	if !n.LinksInContainer {
+		if err = moveLinksIn(n, netns); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				_ = moveLinksOut(n, netns)
+			}
+		}()
+	}
+
+	result := &current.Result{
+		CNIVersion: current.ImplementedSpecVersion,
+	}
+	err = netns.Do(func(_ ns.NetNS) error {
+		bond, slaves, err := createBond(n, args.IfName)
+		if err != nil {
+			return err
+		}
+		result.Interfaces = append(result.Interfaces, &current.Interface{
+			Name:    bond.Attrs().Name,
+			Mac:     bond.Attrs().HardwareAddr.String(),
+			Sandbox: netns.Path(),
+		})
+		for _, slave := range slaves {
+			result.Interfaces = append(result.Interfaces, &current.Interface{
+				Name:    slave.Attrs().Name,
+				Mac:     slave.Attrs().HardwareAddr.String(),
+				Sandbox: netns.Path(),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Delete the bond if err to leave the links as we found them
+	defer func() {
+		if err != nil {
+			_ = netns.Do(func(_ ns.NetNS) error {
+				return releaseBond(n, args.IfName)
+			})
+		}
+	}()
+
+	if n.IPAM.Type != "" {
+		// run the IPAM plugin and get back the config to apply
+		var r types.Result
+		r, err = ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+
+		// Invoke ipam del if err to avoid ip leak
+		defer func() {
+			if err != nil {
+				ipam.ExecDel(n.IPAM.Type, args.StdinData)
+			}
+		}()
+
+		// Convert whatever the IPAM result was into the current Result type
+		var ipamResult *current.Result
+		ipamResult, err = current.NewResultFromResult(r)
+		if err != nil {
+			return err
+		}
+
+		if len(ipamResult.IPs) == 0 {
+			err = errors.New("IPAM plugin returned missing IP config")
+			return err
+		}
+
+		result.IPs = ipamResult.IPs
+		result.Routes = ipamResult.Routes
+
+		for _, ipc := range result.IPs {
+			// All addresses apply to the bond
+			ipc.Interface = current.Int(0)
+		}
+
+		err = netns.Do(func(_ ns.NetNS) error {
+			return ipam.ConfigureIface(args.IfName, result)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	result.DNS = ipam.ResultDNS(result.DNS, n.DNS)
+
+	return types.PrintResult(result, n.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if n.IPAM.Type != "" {
+		if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
+			return err
+		}
+	}
+
+	if args.Netns == "" {
+		return nil
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		// if NetNs is passed down by the Cloud Orchestration Engine, or if it called multiple times
+		// so don't return an error if the device is already removed.
+		// https://github.com/kubernetes/kubernetes/issues/43014#issuecomment-287164444
+		if _, ok := err.(ns.NSPathNotExistErr); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	err = netns.Do(func(_ ns.NetNS) error {
+		return releaseBond(n, args.IfName)
+	})
+	if err != nil {
+		return err
+	}
+
+	if !n.LinksInContainer {
+		return moveLinksOut(n, netns)
+	}
+	return nil
+}
+
+// Main runs the bond plugin.
+func Main() {
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}), version.All, bv.BuildString("bond"))
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	n, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return ns.OpenError(args.Netns, err)
+	}
+	defer netns.Close()
+
+	if n.IPAM.Type != "" {
+		// run the IPAM plugin and get back the config to apply
+		err = ipam.ExecCheck(n.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Parse previous result.
+	if n.NetConf.RawPrevResult == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+
+	if err := version.ParsePrevResult(&n.NetConf); err != nil {
+		return err
+	}
+
+	result, err := current.NewResultFromResult(n.PrevResult)
+	if err != nil {
+		return err
+	}
+
+	var contBond current.Interface
+	for _, intf := range result.Interfaces {
+		if args.IfName == intf.Name && args.Netns == intf.Sandbox {
+			contBond = *intf
+		}
+	}
+
+	// The namespace must be the same as what was configured
+	if args.Netns != contBond.Sandbox {
+		return fmt.Errorf("sandbox in prevResult %s doesn't match configured netns: %s",
+			contBond.Sandbox, args.Netns)
+	}
+
+	// Check prevResults for ips, routes and dns against values found in the container
+	return netns.Do(func(_ ns.NetNS) error {
+		err := validateBond(n, contBond)
+		if err != nil {
+			return err
+		}
+
+		err = ip.ValidateExpectedInterfaceIPs(args.IfName, result.IPs)
+		if err != nil {
+			return err
+		}
+
+		return ip.ValidateExpectedRoute(result.Routes)
+	})
+}
+
+func validateBond(conf *NetConf, intf current.Interface) error {
+	link, err := netlink.LinkByName(intf.Name)
+	if err != nil {
+		return fmt.Errorf("container Interface name in prevResult: %s not found", intf.Name)
+	}
+	bond, ok := link.(*netlink.Bond)
+	if !ok {
+		return fmt.Errorf("error: Container interface %s not of type bond", intf.Name)
+	}
+
+	if expected := netlink.StringToBondMode(conf.Mode); bond.Mode != expected {
+		return fmt.Errorf("bond %s mode %s does not match expected value: %s", intf.Name, bond.Mode, expected)
+	}
+	if intf.Mac != "" && intf.Mac != bond.Attrs().HardwareAddr.String() {
+		return fmt.Errorf("interface %s Mac %s doesn't match container Mac: %s", intf.Name, intf.Mac, bond.Attrs().HardwareAddr)
+	}
+
+	for _, l := range conf.Links {
+		slave, err := netlink.LinkByName(l.Name)
+		if err != nil {
+			return fmt.Errorf("bond %s link %s not found", intf.Name, l.Name)
+		}
+		if slave.Attrs().MasterIndex != bond.Attrs().Index {
+			return fmt.Errorf("link %s is not enslaved to bond %s", l.Name, intf.Name)
+		}
+	}
+
+	return nil
+}
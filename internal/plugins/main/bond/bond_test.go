@@ -0,0 +1,234 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bond
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+)
+
+var _ = Describe("bond config", func() {
+	DescribeTable("rejects invalid configurations",
+		func(conf, msg string) {
+			_, err := loadConf([]byte(conf))
+			Expect(err).To(MatchError(ContainSubstring(msg)))
+		},
+		Entry("unsupported mode",
+			`{"mode": "balance-rr", "links": [{"name": "a"}, {"name": "b"}]}`, `unsupported bond mode "balance-rr"`),
+		Entry("single link",
+			`{"links": [{"name": "a"}]}`, "a bond needs at least two links, got 1"),
+		Entry("duplicate link",
+			`{"links": [{"name": "a"}, {"name": "a"}]}`, `link "a" is listed more than once`),
+		Entry("both monitors",
+			`{"links": [{"name": "a"}, {"name": "b"}], "miimon": 100, "arpInterval": 100, "arpIpTargets": ["192.0.2.1"]}`, "mutually exclusive"),
+		Entry("arp monitor without targets",
+			`{"links": [{"name": "a"}, {"name": "b"}], "arpInterval": 100}`, "requires at least one entry in arpIpTargets"),
+		Entry("arp monitor with 802.3ad",
+			`{"mode": "802.3ad", "links": [{"name": "a"}, {"name": "b"}], "arpInterval": 100, "arpIpTargets": ["192.0.2.1"]}`, "not supported in 802.3ad mode"),
+		Entry("IPv6 arp target",
+			`{"links": [{"name": "a"}, {"name": "b"}], "arpInterval": 100, "arpIpTargets": ["2001:db8::1"]}`, "must be an IPv4 address"),
+		Entry("lacpRate outside 802.3ad",
+			`{"links": [{"name": "a"}, {"name": "b"}], "lacpRate": "fast"}`, "lacpRate is only supported in 802.3ad mode"),
+		Entry("unknown xmitHashPolicy",
+			`{"mode": "802.3ad", "links": [{"name": "a"}, {"name": "b"}], "xmitHashPolicy": "layer5"}`, `invalid xmitHashPolicy "layer5"`),
+	)
+
+	It("builds the bond from the configuration", func() {
+		conf, err := loadConf([]byte(`{
+			"mode": "802.3ad",
+			"links": [{"name": "a"}, {"name": "b"}],
+			"mtu": 9000,
+			"miimon": 100,
+			"lacpRate": "fast",
+			"xmitHashPolicy": "layer3+4"
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		bond := newBond(conf, "bond0")
+		Expect(bond.Name).To(Equal("bond0"))
+		Expect(bond.MTU).To(Equal(9000))
+		Expect(bond.Mode).To(Equal(netlink.BOND_MODE_802_3AD))
+		Expect(bond.Miimon).To(Equal(100))
+		Expect(bond.LacpRate).To(Equal(netlink.BOND_LACP_RATE_FAST))
+		Expect(bond.XmitHashPolicy).To(Equal(netlink.BOND_XMIT_HASH_POLICY_LAYER3_4))
+		Expect(bond.ArpInterval).To(Equal(-1))
+	})
+})
+
+var _ = Describe("bond Operations", func() {
+	var originalNS, targetNS ns.NetNS
+	var dataDir string
+
+	BeforeEach(func() {
+		// Create a new NetNS so we don't modify the host
+		var err error
+		originalNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		targetNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		dataDir, err = os.MkdirTemp("", "bond_test")
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			// Add the links to aggregate
+			for _, name := range []string{"eth1", "eth2"} {
+				err = netlink.LinkAdd(&netlink.Veth{
+					LinkAttrs: netlink.LinkAttrs{
+						Name: name,
+					},
+					PeerName: name + "p",
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(originalNS)).To(Succeed())
+		Expect(targetNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(targetNS)).To(Succeed())
+	})
+
+	It("bonds host links in the container with ADD/CHECK/DEL", func() {
+		const IFNAME = "bond0"
+
+		conf := fmt.Sprintf(`{
+		    "cniVersion": "1.0.0",
+		    "name": "mynet",
+		    "type": "bond",
+		    "mode": "active-backup",
+		    "miimon": 100,
+		    "links": [{"name": "eth1"}, {"name": "eth2"}],
+		    "ipam": {
+			"type": "host-local",
+			"subnet": "10.1.2.0/24",
+			"dataDir": "%s"
+		    }
+		}`, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		var result types.Result
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			var err error
+			result, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// the links are gone from the host
+			_, err = netlink.LinkByName("eth1")
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		r, err := types100.GetResult(result)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.Interfaces).To(HaveLen(3))
+		Expect(r.Interfaces[0].Name).To(Equal(IFNAME))
+		Expect(r.IPs).To(HaveLen(1))
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			bond, ok := link.(*netlink.Bond)
+			Expect(ok).To(BeTrue())
+			Expect(bond.Mode).To(Equal(netlink.BOND_MODE_ACTIVE_BACKUP))
+			Expect(bond.Miimon).To(Equal(100))
+
+			for _, name := range []string{"eth1", "eth2"} {
+				slave, err := netlink.LinkByName(name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(slave.Attrs().MasterIndex).To(Equal(bond.Index))
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		checkConf := []byte(fmt.Sprintf(`{
+		    "cniVersion": "1.0.0",
+		    "name": "mynet",
+		    "type": "bond",
+		    "mode": "active-backup",
+		    "links": [{"name": "eth1"}, {"name": "eth2"}],
+		    "prevResult": {
+			"cniVersion": "1.0.0",
+			"interfaces": [{"name": "%s", "sandbox": "%s"}]
+		    }
+		}`, IFNAME, targetNS.Path()))
+		checkArgs := *args
+		checkArgs.StdinData = checkConf
+		err = originalNS.Do(func(ns.NetNS) error {
+			return testutils.CmdCheckWithArgs(&checkArgs, func() error {
+				return cmdCheck(&checkArgs)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// the links are back on the host
+			for _, name := range []string{"eth1", "eth2"} {
+				link, err := netlink.LinkByName(name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().MasterIndex).To(BeZero())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := netlink.LinkByName(IFNAME)
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
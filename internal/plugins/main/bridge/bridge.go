@@ -12,12 +12,13 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package bridge
 
 import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net"
 	"os"
 	"runtime"
@@ -31,6 +32,10 @@ import (
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/cniargs"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/include"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/link"
@@ -52,6 +57,9 @@ type NetConf struct {
 	IsDefaultGW         bool         `json:"isDefaultGateway"`
 	ForceAddress        bool         `json:"forceAddress"`
 	IPMasq              bool         `json:"ipMasq"`
+	IPMasqPortRange     string       `json:"ipMasqPortRange,omitempty"`
+	IPMasqRandomFully   bool         `json:"ipMasqRandomFully,omitempty"`
+	IPMasqMark          uint32       `json:"ipMasqMark,omitempty"`
 	MTU                 int          `json:"mtu"`
 	HairpinMode         bool         `json:"hairpinMode"`
 	PromiscMode         bool         `json:"promiscMode"`
@@ -60,16 +68,53 @@ type NetConf struct {
 	PreserveDefaultVlan bool         `json:"preserveDefaultVlan"`
 	MacSpoofChk         bool         `json:"macspoofchk,omitempty"`
 	EnableDad           bool         `json:"enabledad,omitempty"`
+	InterfaceOwnership  string       `json:"interfaceOwnership,omitempty"`
+	Uplink              string       `json:"uplink,omitempty"`
+	UplinkMoveAddrs     bool         `json:"uplinkMoveAddresses,omitempty"`
+	DataDir             string       `json:"dataDir,omitempty"`
+	HostIfaceTemplate   string       `json:"hostInterfaceTemplate,omitempty"`
+	VRF                 string       `json:"vrf,omitempty"`
+	VRFTable            uint32       `json:"vrfTable,omitempty"`
+	DHCPServer          *DHCPServer  `json:"dhcpServer,omitempty"`
+	// RemoveBridgeOnEmpty deletes a bridge the plugin created on the DEL of
+	// its last attachment, detaching the uplink first, see removeEmptyBridge
+	RemoveBridgeOnEmpty bool `json:"removeBridgeOnEmpty,omitempty"`
+	// ProxyARP and ProxyNDP make ProxyInterfaces, typically the host's
+	// uplinks, answer for the container's addresses so it is reachable
+	// through the gateway from their LAN without NAT
+	ProxyARP        bool     `json:"proxyARP,omitempty"`
+	ProxyNDP        bool     `json:"proxyNDP,omitempty"`
+	ProxyInterfaces []string `json:"proxyInterfaces,omitempty"`
+	// StormControl limits the broadcast and multicast traffic of each
+	// container, the runtime may adjust it per container
+	StormControl *StormControl `json:"stormControl,omitempty"`
+	// XDP attaches a pinned XDP program to the host veth of each
+	// container
+	XDP *XDP `json:"xdp,omitempty"`
+	// EtherTypes restricts the ethertypes containers can send
+	EtherTypes *EtherTypes `json:"etherTypes,omitempty"`
+	// LinkLocalGateway makes the IPv6 gateway the link-local fe80::1,
+	// advertised to the containers with RAs, instead of a global address
+	// of every range on the bridge
+	LinkLocalGateway bool `json:"linkLocalGateway,omitempty"`
+	// PodSysctls are set in the pod before its veth joins the bridge
+	PodSysctls *sysctl.Bundle `json:"podSysctls,omitempty"`
+	// StaticNAT maps the container's IPv4 address 1:1 to a public one
+	// on a host interface
+	StaticNAT *ip.StaticNAT `json:"staticNAT,omitempty"`
+	// MulticastGroups are joined statically on the host veth of each
+	// container, so snooping bridges forward them before the container
+	// sends its IGMP or MLD report
+	MulticastGroups []string `json:"multicastGroups,omitempty"`
 
-	Args struct {
-		Cni BridgeArgs `json:"cni,omitempty"`
-	} `json:"args,omitempty"`
 	RuntimeConfig struct {
-		Mac string `json:"mac,omitempty"`
+		StormControl    *StormControl `json:"stormControl,omitempty"`
+		MulticastGroups []string      `json:"multicastGroups,omitempty"`
 	} `json:"runtimeConfig,omitempty"`
 
-	mac   string
-	vlans []int
+	mac    string
+	vlans  []int
+	groups []net.IP
 }
 
 type VlanTrunk struct {
@@ -78,20 +123,12 @@ type VlanTrunk struct {
 	ID    *int `json:"id,omitempty"`
 }
 
-type BridgeArgs struct {
-	Mac string `json:"mac,omitempty"`
-}
-
-// MacEnvArgs represents CNI_ARGS
-type MacEnvArgs struct {
-	types.CommonArgs
-	MAC types.UnmarshallableString `json:"mac,omitempty"`
-}
-
 type gwInfo struct {
 	gws               []net.IPNet
 	family            int
 	defaultRouteFound bool
+	// linkLocalSubnets are the subnets routed via the link-local gateway
+	linkLocalSubnets []net.IPNet
 }
 
 func init() {
@@ -106,6 +143,10 @@ func loadNetConf(bytes []byte, envArgs string) (*NetConf, string, error) {
 		BrName: defaultBrName,
 		// Set default value equal to true to maintain existing behavior.
 		PreserveDefaultVlan: true,
+		DataDir:             defaultDataDir,
+	}
+	if err := config.Validate(bytes, n); err != nil {
+		return nil, "", fmt.Errorf("invalid network configuration: %v", err)
 	}
 	if err := json.Unmarshal(bytes, n); err != nil {
 		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
@@ -125,28 +166,145 @@ func loadNetConf(bytes []byte, envArgs string) (*NetConf, string, error) {
 		return nil, "", errors.New("cannot set vlan and vlanTrunk at the same time")
 	}
 
-	if envArgs != "" {
-		e := MacEnvArgs{}
-		if err := types.LoadArgs(envArgs, &e); err != nil {
+	if err := link.ValidateOwnership(n.InterfaceOwnership); err != nil {
+		return nil, "", err
+	}
+
+	if err := link.ValidateHostIfaceNameTemplate(n.HostIfaceTemplate); err != nil {
+		return nil, "", err
+	}
+
+	if n.VRFTable != 0 && n.VRF == "" {
+		return nil, "", errors.New("vrfTable requires a vrf")
+	}
+
+	if n.UplinkMoveAddrs && n.Uplink == "" {
+		return nil, "", errors.New("uplinkMoveAddresses requires an uplink")
+	}
+
+	if n.DHCPServer != nil {
+		if err := n.DHCPServer.validate(n); err != nil {
 			return nil, "", err
 		}
+	}
 
-		if e.MAC != "" {
-			n.mac = string(e.MAC)
+	if err := n.proxyNeighbors().Validate(); err != nil {
+		return nil, "", err
+	}
+	if err := n.masqOptions().Validate(); err != nil {
+		return nil, "", err
+	}
+	if n.masqOptions().Enabled() && !n.IPMasq {
+		return nil, "", errors.New("ipMasqPortRange, ipMasqRandomFully and ipMasqMark require ipMasq")
+	}
+	if (n.ProxyARP || n.ProxyNDP) && !n.IsGW && !n.IsDefaultGW {
+		return nil, "", errors.New("proxyARP and proxyNDP require isGateway")
+	}
+	if n.LinkLocalGateway && !n.IsGW && !n.IsDefaultGW {
+		return nil, "", errors.New("linkLocalGateway requires isGateway")
+	}
+	if n.StaticNAT != nil {
+		if n.IPAM.Type == "" {
+			return nil, "", errors.New("staticNAT requires ipam")
+		}
+		if err := n.StaticNAT.Validate(); err != nil {
+			return nil, "", err
 		}
 	}
 
-	if mac := n.Args.Cni.Mac; mac != "" {
-		n.mac = mac
+	n.StormControl = n.StormControl.merge(n.RuntimeConfig.StormControl)
+	if err := n.StormControl.validate(); err != nil {
+		return nil, "", err
 	}
 
-	if mac := n.RuntimeConfig.Mac; mac != "" {
-		n.mac = mac
+	n.groups, err = parseMulticastGroups(n.MulticastGroups, n.RuntimeConfig.MulticastGroups)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := n.XDP.validate(); err != nil {
+		return nil, "", err
+	}
+
+	if err := n.PodSysctls.Validate(); err != nil {
+		return nil, "", err
+	}
+
+	if err := n.EtherTypes.validate(); err != nil {
+		return nil, "", err
+	}
+
+	a, err := cniargs.Parse(envArgs, bytes)
+	if err != nil {
+		return nil, "", err
 	}
+	n.mac = a.MAC()
 
 	return n, n.CNIVersion, nil
 }
 
+func (n *NetConf) proxyNeighbors() *ip.ProxyNeighbors {
+	return &ip.ProxyNeighbors{ARP: n.ProxyARP, NDP: n.ProxyNDP, Interfaces: n.ProxyInterfaces}
+}
+
+func (n *NetConf) masqOptions() *ip.MasqOptions {
+	return &ip.MasqOptions{PortRange: n.IPMasqPortRange, RandomFully: n.IPMasqRandomFully, Mark: n.IPMasqMark}
+}
+
+// staticNATChains returns the DNAT and SNAT chains of the container.
+func (n *NetConf) staticNATChains(containerID string) (string, string) {
+	return utils.MustFormatChainNameWithPrefix(n.Name, containerID, "SD-"),
+		utils.MustFormatChainNameWithPrefix(n.Name, containerID, "SS-")
+}
+
+// teardownStaticNAT undoes the staticNAT mapping of the container, which
+// needs no container address.
+func teardownStaticNAT(n *NetConf, containerID string) error {
+	if n.StaticNAT == nil {
+		return nil
+	}
+	dnatChain, snatChain := n.staticNATChains(containerID)
+	return n.StaticNAT.Teardown(dnatChain, snatChain, utils.FormatComment(n.Name, containerID))
+}
+
+// firstIPv4 returns the first IPv4 address of ips, the one mapped by
+// staticNAT.
+func firstIPv4(ips []*current.IPConfig) *net.IPNet {
+	for _, ipc := range ips {
+		if ipc.Address.IP.To4() != nil {
+			return &ipc.Address
+		}
+	}
+	return nil
+}
+
+// teardownProxies removes the proxy entries of the addresses removed along
+// with the container interface or, if the container is gone, of the ones
+// in prevResult.
+func teardownProxies(n *NetConf, ipnets []*net.IPNet) error {
+	proxy := n.proxyNeighbors()
+	if !proxy.Enabled() {
+		return nil
+	}
+	var addrs []net.IP
+	for _, ipn := range ipnets {
+		addrs = append(addrs, ipn.IP)
+	}
+	if len(addrs) == 0 && n.RawPrevResult != nil {
+		if err := version.ParsePrevResult(&n.NetConf); err != nil {
+			return err
+		}
+		result, err := current.NewResultFromResult(n.PrevResult)
+		if err != nil {
+			return err
+		}
+		for _, ipc := range result.IPs {
+			addrs = append(addrs, ipc.Address.IP)
+		}
+	}
+	return proxy.Teardown(addrs)
+}
+
 // This method is copied from https://github.com/k8snetworkplumbingwg/ovs-cni/blob/v0.27.2/pkg/plugin/plugin.go
 func collectVlanTrunk(vlanTrunk []*VlanTrunk) ([]int, error) {
 	if vlanTrunk == nil {
@@ -232,6 +390,18 @@ func calcGateways(result *current.Result, n *NetConf) (*gwInfo, *gwInfo, error)
 		// All IPs currently refer to the container interface
 		ipc.Interface = current.Int(2)
 
+		// The link-local gateway replaces the one of IPAM, also in its
+		// routes
+		linkLocal := n.LinkLocalGateway && gws.family == netlink.FAMILY_V6
+		if linkLocal {
+			for _, route := range result.Routes {
+				if route.GW != nil && ipc.Gateway != nil && route.GW.Equal(ipc.Gateway) {
+					route.GW = linkLocalGateway.IP
+				}
+			}
+			ipc.Gateway = linkLocalGateway.IP
+		}
+
 		// If not provided, calculate the gateway address corresponding
 		// to the selected IP address
 		if ipc.Gateway == nil && n.IsGW {
@@ -257,7 +427,12 @@ func calcGateways(result *current.Result, n *NetConf) (*gwInfo, *gwInfo, error)
 		}
 
 		// Append this gateway address to the list of gateways
-		if n.IsGW {
+		if linkLocal {
+			gws.linkLocalSubnets = append(gws.linkLocalSubnets, net.IPNet{
+				IP:   ipc.Address.IP.Mask(ipc.Address.Mask),
+				Mask: ipc.Address.Mask,
+			})
+		} else if n.IsGW {
 			gw := net.IPNet{
 				IP:   ipc.Gateway,
 				Mask: ipc.Address.Mask,
@@ -367,6 +542,14 @@ func ensureBridge(brName string, mtu int, promiscMode, vlanFiltering bool) (*net
 		return nil, err
 	}
 
+	// an existing bridge may have been created without vlan filtering
+	if vlanFiltering && (br.VlanFiltering == nil || !*br.VlanFiltering) {
+		if err := netlink.BridgeSetVlanFiltering(br, true); err != nil {
+			return nil, fmt.Errorf("could not enable vlan filtering on %q: %v", brName, err)
+		}
+		br.VlanFiltering = &vlanFiltering
+	}
+
 	// we want to own the routes for this interface
 	_, _ = sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/accept_ra", brName), "0")
 
@@ -391,7 +574,7 @@ func ensureVlanInterface(br *netlink.Bridge, vlanID int, preserveDefaultVlan boo
 			return nil, fmt.Errorf("faild to find host namespace: %v", err)
 		}
 
-		_, brGatewayIface, err := setupVeth(hostNS, br, name, br.MTU, false, vlanID, nil, preserveDefaultVlan, "")
+		_, brGatewayIface, err := setupVeth(hostNS, br, name, "", br.MTU, false, vlanID, nil, preserveDefaultVlan, "", nil)
 		if err != nil {
 			return nil, fmt.Errorf("faild to create vlan gateway %q: %v", name, err)
 		}
@@ -410,13 +593,13 @@ func ensureVlanInterface(br *netlink.Bridge, vlanID int, preserveDefaultVlan boo
 	return brGatewayVeth, nil
 }
 
-func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int, hairpinMode bool, vlanID int, vlans []int, preserveDefaultVlan bool, mac string) (*current.Interface, *current.Interface, error) {
+func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName, hostIfName string, mtu int, hairpinMode bool, vlanID int, vlans []int, preserveDefaultVlan bool, mac string, sysctls *sysctl.Bundle) (*current.Interface, *current.Interface, error) {
 	contIface := &current.Interface{}
 	hostIface := &current.Interface{}
 
 	err := netns.Do(func(hostNS ns.NetNS) error {
 		// create the veth pair in the container and move host end into host netns
-		hostVeth, containerVeth, err := ip.SetupVeth(ifName, mtu, mac, hostNS)
+		hostVeth, containerVeth, err := ip.SetupVethWithName(ifName, hostIfName, mtu, mac, hostNS)
 		if err != nil {
 			return err
 		}
@@ -424,7 +607,9 @@ func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int, hairp
 		contIface.Mac = containerVeth.HardwareAddr.String()
 		contIface.Sandbox = netns.Path()
 		hostIface.Name = hostVeth.Name
-		return nil
+		// the host end isn't on the bridge yet, so e.g. no router
+		// advertisement is accepted against the bundle
+		return sysctls.Apply(ifName)
 	})
 	if err != nil {
 		return nil, nil, err
@@ -497,27 +682,34 @@ func calcGatewayIP(ipn *net.IPNet) net.IP {
 }
 
 func setupBridge(n *NetConf) (*netlink.Bridge, *current.Interface, error) {
-	vlanFiltering := false
-	if n.Vlan != 0 || n.VlanTrunk != nil {
-		vlanFiltering = true
+	vlanFiltering := needsVlanFiltering(n)
+	// mark the bridge before creating it, so the host network manager
+	// never gets a chance to pick it up
+	if err := link.MarkUnmanaged(n.InterfaceOwnership, n.BrName); err != nil {
+		return nil, nil, err
 	}
+
 	// create bridge if necessary
 	br, err := ensureBridge(n.BrName, n.MTU, n.PromiscMode, vlanFiltering)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create bridge %q: %v", n.BrName, err)
 	}
 
+	if err := link.VerifyUnmanaged(n.InterfaceOwnership, br.Attrs().Name, br.Attrs().Index); err != nil {
+		return nil, nil, err
+	}
+
 	return br, &current.Interface{
 		Name: br.Attrs().Name,
 		Mac:  br.Attrs().HardwareAddr.String(),
 	}, nil
 }
 
-func enableIPForward(family int) error {
+func enableIPForward(tx *sysctl.Tx, family int) error {
 	if family == netlink.FAMILY_V4 {
-		return ip.EnableIP4Forward()
+		return tx.Set("net.ipv4.ip_forward", "1")
 	}
-	return ip.EnableIP6Forward()
+	return tx.Set("net.ipv6.conf.all.forwarding", "1")
 }
 
 func cmdAdd(args *skel.CmdArgs) error {
@@ -530,6 +722,11 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	isLayer3 := n.IPAM.Type != ""
 
+	// raLink is set to the interface with the link-local gateway, which
+	// advertises it once the container is attached
+	var raLink netlink.Link
+	var raSubnets []net.IPNet
+
 	if n.IsDefaultGW {
 		n.IsGW = true
 	}
@@ -538,18 +735,37 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return fmt.Errorf("cannot set hairpin mode and promiscuous mode at the same time")
 	}
 
-	br, brInterface, err := setupBridge(n)
+	// other networks sharing the bridge may rely on its settings, so they
+	// are reference counted
+	if err := acquireBridgeSettings(n, uniqueID(args.ContainerID, args.IfName)); err != nil {
+		return err
+	}
+
+	br, brInterface, err := setupOwnedBridge(n, uniqueID(args.ContainerID, args.IfName))
 	if err != nil {
 		return err
 	}
 
+	if err := attachVRF(n, br); err != nil {
+		return err
+	}
+
+	if err := attachUplink(n, br); err != nil {
+		return err
+	}
+
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+		return ns.OpenError(args.Netns, err)
 	}
 	defer netns.Close()
 
-	hostInterface, containerInterface, err := setupVeth(netns, br, args.IfName, n.MTU, n.HairpinMode, n.Vlan, n.vlans, n.PreserveDefaultVlan, n.mac)
+	hostIfName, err := link.HostIfaceName(n.HostIfaceTemplate, link.NewHostIfaceNameData(args.ContainerID, args.IfName, args.Args))
+	if err != nil {
+		return err
+	}
+
+	hostInterface, containerInterface, err := setupVeth(netns, br, args.IfName, hostIfName, n.MTU, n.HairpinMode, n.Vlan, n.vlans, n.PreserveDefaultVlan, n.mac, n.PodSysctls)
 	if err != nil {
 		return err
 	}
@@ -578,9 +794,24 @@ func cmdAdd(args *skel.CmdArgs) error {
 		}()
 	}
 
+	if n.EtherTypes != nil {
+		f := n.EtherTypes.filter(hostInterface.Name, uniqueID(args.ContainerID, args.IfName))
+		if err := f.Setup(); err != nil {
+			return err
+		}
+		defer func() {
+			if !success {
+				if err := f.Teardown(); err != nil {
+					fmt.Fprintf(os.Stderr, "%v", err)
+				}
+			}
+		}()
+	}
+
 	if isLayer3 {
-		// run the IPAM plugin and get back the config to apply
-		r, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+		// run the IPAM plugin and get back the config to apply, passing
+		// the access VLAN and the uplink, which ranges may be pinned to
+		r, err := ipam.ExecAddOn(n.IPAM.Type, args.StdinData, n.Vlan, n.Uplink)
 		if err != nil {
 			return err
 		}
@@ -629,53 +860,109 @@ func cmdAdd(args *skel.CmdArgs) error {
 		}
 
 		if n.IsGW {
+			// Turn forwarding off again if the ADD fails, unless it was on before
+			forwarding := sysctl.NewTx()
+			defer func() {
+				if !success {
+					_ = forwarding.Rollback()
+				}
+			}()
+
 			var vlanInterface *current.Interface
+			// gatewayLink returns the interface the gateway addresses go
+			// on, the bridge or its vlan interface
+			gatewayLink := func() (netlink.Link, error) {
+				if n.Vlan == 0 {
+					return br, nil
+				}
+				vlanIface, err := ensureVlanInterface(br, n.Vlan, n.PreserveDefaultVlan)
+				if err != nil {
+					return nil, fmt.Errorf("failed to create vlan interface: %v", err)
+				}
+
+				if vlanInterface == nil {
+					vlanInterface = &current.Interface{
+						Name: vlanIface.Attrs().Name,
+						Mac:  vlanIface.Attrs().HardwareAddr.String(),
+					}
+					result.Interfaces = append(result.Interfaces, vlanInterface)
+				}
+				return vlanIface, nil
+			}
+
 			// Set the IP address(es) on the bridge and enable forwarding
 			for _, gws := range []*gwInfo{gwsV4, gwsV6} {
 				for _, gw := range gws.gws {
-					if n.Vlan != 0 {
-						vlanIface, err := ensureVlanInterface(br, n.Vlan, n.PreserveDefaultVlan)
-						if err != nil {
-							return fmt.Errorf("failed to create vlan interface: %v", err)
-						}
-
-						if vlanInterface == nil {
-							vlanInterface = &current.Interface{
-								Name: vlanIface.Attrs().Name,
-								Mac:  vlanIface.Attrs().HardwareAddr.String(),
-							}
-							result.Interfaces = append(result.Interfaces, vlanInterface)
-						}
-
-						err = ensureAddr(vlanIface, gws.family, &gw, n.ForceAddress)
-						if err != nil {
+					gwLink, err := gatewayLink()
+					if err != nil {
+						return err
+					}
+					if err = ensureAddr(gwLink, gws.family, &gw, n.ForceAddress); err != nil {
+						if n.Vlan != 0 {
 							return fmt.Errorf("failed to set vlan interface for bridge with addr: %v", err)
 						}
-					} else {
-						err = ensureAddr(br, gws.family, &gw, n.ForceAddress)
-						if err != nil {
-							return fmt.Errorf("failed to set bridge addr: %v", err)
-						}
+						return fmt.Errorf("failed to set bridge addr: %v", err)
 					}
 				}
 
-				if gws.gws != nil {
-					if err = enableIPForward(gws.family); err != nil {
+				if gws.linkLocalSubnets != nil {
+					if raLink, err = gatewayLink(); err != nil {
+						return err
+					}
+					if err = ensureLinkLocalGateway(raLink, gws.linkLocalSubnets); err != nil {
+						return err
+					}
+					raSubnets = gws.linkLocalSubnets
+				}
+
+				if gws.gws != nil || gws.linkLocalSubnets != nil {
+					if err = enableIPForward(forwarding, gws.family); err != nil {
 						return fmt.Errorf("failed to enable forwarding: %v", err)
 					}
 				}
 			}
+
+			if proxy := n.proxyNeighbors(); proxy.Enabled() {
+				var addrs []net.IP
+				for _, ipc := range result.IPs {
+					addrs = append(addrs, ipc.Address.IP)
+				}
+				if err = proxy.Setup(forwarding, addrs); err != nil {
+					return err
+				}
+				defer func() {
+					if !success {
+						_ = proxy.Teardown(addrs)
+					}
+				}()
+			}
 		}
 
 		if n.IPMasq {
 			chain := utils.FormatChainName(n.Name, args.ContainerID)
 			comment := utils.FormatComment(n.Name, args.ContainerID)
 			for _, ipc := range result.IPs {
-				if err = ip.SetupIPMasq(&ipc.Address, chain, comment); err != nil {
+				if err = ip.SetupIPMasqWithOptions(&ipc.Address, chain, comment, n.masqOptions()); err != nil {
 					return err
 				}
 			}
 		}
+
+		if n.StaticNAT != nil {
+			addr := firstIPv4(result.IPs)
+			if addr == nil {
+				return fmt.Errorf("staticNAT requires an IPv4 address, IPAM returned none")
+			}
+			defer func() {
+				if !success {
+					_ = teardownStaticNAT(n, args.ContainerID)
+				}
+			}()
+			dnatChain, snatChain := n.staticNATChains(args.ContainerID)
+			if err = n.StaticNAT.Setup(addr, dnatChain, snatChain, utils.FormatComment(n.Name, args.ContainerID)); err != nil {
+				return err
+			}
+		}
 	} else {
 		if err := netns.Do(func(_ ns.NetNS) error {
 			link, err := netlink.LinkByName(args.IfName)
@@ -715,6 +1002,28 @@ func cmdAdd(args *skel.CmdArgs) error {
 	// In certain circumstances, the host-side of the veth may change addrs
 	hostInterface.Mac = hostVeth.Attrs().HardwareAddr.String()
 
+	if err := link.VerifyUnmanaged(n.InterfaceOwnership, hostVeth.Attrs().Name, hostVeth.Attrs().Index); err != nil {
+		return err
+	}
+
+	if err := setupStormControl(n.StormControl, hostVeth); err != nil {
+		return err
+	}
+
+	if err := setupXDP(n.XDP, hostVeth); err != nil {
+		return err
+	}
+
+	if err := setupMulticastGroups(n.groups, br, hostVeth, n.Vlan); err != nil {
+		return err
+	}
+
+	if raLink != nil {
+		if err := sendRouterAdvertisement(raLink, raSubnets, n.MTU, !n.IsDefaultGW); err != nil {
+			return err
+		}
+	}
+
 	// Refetch the bridge since its MAC address may change when the first
 	// veth is added or after its IP address is set
 	br, err = bridgeByName(n.BrName)
@@ -728,24 +1037,15 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return debugPostIPAMError
 	}
 
-	// Use incoming DNS settings if provided, otherwise use the
-	// settings that were already configured by the IPAM plugin
-	if dnsConfSet(n.DNS) {
-		result.DNS = n.DNS
-	}
+	// The IPAM plugin may have combined the DNS settings with the ones of
+	// the network configuration already, see the host-local dnsPolicy
+	result.DNS = ipam.ResultDNS(result.DNS, n.DNS)
 
 	success = true
 
 	return types.PrintResult(result, cniVersion)
 }
 
-func dnsConfSet(dnsConf types.DNS) bool {
-	return dnsConf.Nameservers != nil ||
-		dnsConf.Search != nil ||
-		dnsConf.Options != nil ||
-		dnsConf.Domain != ""
-}
-
 func cmdDel(args *skel.CmdArgs) error {
 	n, _, err := loadNetConf(args.StdinData, args.Args)
 	if err != nil {
@@ -754,6 +1054,22 @@ func cmdDel(args *skel.CmdArgs) error {
 
 	isLayer3 := n.IPAM.Type != ""
 
+	releaseBridge := func() error {
+		if err := releaseBridgeSettings(n, uniqueID(args.ContainerID, args.IfName)); err != nil {
+			return err
+		}
+		if err := detachUplink(n); err != nil {
+			return err
+		}
+		if err := detachVRF(n); err != nil {
+			return err
+		}
+		if err := removeEmptyBridge(n, uniqueID(args.ContainerID, args.IfName)); err != nil {
+			return err
+		}
+		return unmarkIdleBridge(n)
+	}
+
 	ipamDel := func() error {
 		if isLayer3 {
 			if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
@@ -764,13 +1080,25 @@ func cmdDel(args *skel.CmdArgs) error {
 	}
 
 	if args.Netns == "" {
-		return ipamDel()
+		if err := ipamDel(); err != nil {
+			return err
+		}
+		if err := teardownProxies(n, nil); err != nil {
+			return err
+		}
+		if err := teardownStaticNAT(n, args.ContainerID); err != nil {
+			return err
+		}
+		return releaseBridge()
 	}
 
+	teardownXDP(n.XDP, args.Netns, args.IfName)
+
 	// There is a netns so try to clean up. Delete can be called multiple times
 	// so don't return an error if the device is already removed.
 	// If the device isn't there then don't try to clean up IP masq either.
 	var ipnets []*net.IPNet
+	netnsGone := false
 	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
 		var err error
 		ipnets, err = ip.DelLinkByNameAddr(args.IfName)
@@ -784,11 +1112,12 @@ func cmdDel(args *skel.CmdArgs) error {
 		//  if NetNs is passed down by the Cloud Orchestration Engine, or if it called multiple times
 		// so don't return an error if the device is already removed.
 		// https://github.com/kubernetes/kubernetes/issues/43014#issuecomment-287164444
-		_, ok := err.(ns.NSPathNotExistErr)
-		if ok {
-			return ipamDel()
+		if _, ok := err.(ns.NSPathNotExistErr); !ok {
+			return err
 		}
-		return err
+		// The veth went away with the netns, but the host side of the
+		// attachment is still to be cleaned up.
+		netnsGone = true
 	}
 
 	// call ipam.ExecDel after clean up device in netns
@@ -796,6 +1125,10 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	}
 
+	if err := teardownProxies(n, ipnets); err != nil {
+		return err
+	}
+
 	if n.MacSpoofChk {
 		sc := link.NewSpoofChecker("", "", uniqueID(args.ContainerID, args.IfName))
 		if err := sc.Teardown(); err != nil {
@@ -803,9 +1136,21 @@ func cmdDel(args *skel.CmdArgs) error {
 		}
 	}
 
+	if n.EtherTypes != nil {
+		if err := n.EtherTypes.filter("", uniqueID(args.ContainerID, args.IfName)).Teardown(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v", err)
+		}
+	}
+
 	if isLayer3 && n.IPMasq {
 		chain := utils.FormatChainName(n.Name, args.ContainerID)
 		comment := utils.FormatComment(n.Name, args.ContainerID)
+		if netnsGone {
+			// the addresses went away with the netns
+			if err := ip.TeardownIPMasqChain(chain); err != nil {
+				return err
+			}
+		}
 		for _, ipn := range ipnets {
 			if err := ip.TeardownIPMasq(ipn, chain, comment); err != nil {
 				return err
@@ -813,11 +1158,22 @@ func cmdDel(args *skel.CmdArgs) error {
 		}
 	}
 
-	return err
+	if err := teardownStaticNAT(n, args.ContainerID); err != nil {
+		return err
+	}
+
+	return releaseBridge()
 }
 
-func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("bridge"))
+// Main runs the bridge plugin.
+func Main() {
+	if len(os.Args) > 1 && os.Args[1] == "dhcp-server" {
+		if err := runDHCPServer(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}), version.All, bv.BuildString("bridge"))
 }
 
 type cniBridgeIf struct {
@@ -961,7 +1317,7 @@ func cmdCheck(args *skel.CmdArgs) error {
 	}
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+		return ns.OpenError(args.Netns, err)
 	}
 	defer netns.Close()
 
@@ -1061,7 +1417,7 @@ func cmdCheck(args *skel.CmdArgs) error {
 	}
 
 	// Check prevResults for ips, routes and dns against values found in the container
-	return netns.Do(func(_ ns.NetNS) error {
+	if err := netns.Do(func(_ ns.NetNS) error {
 		err = ip.ValidateExpectedInterfaceIPs(args.IfName, result.IPs)
 		if err != nil {
 			return err
@@ -1072,7 +1428,33 @@ func cmdCheck(args *skel.CmdArgs) error {
 			return err
 		}
 		return nil
-	})
+	}); err != nil {
+		return err
+	}
+
+	if len(n.groups) > 0 {
+		br, err := bridgeByName(n.BrName)
+		if err != nil {
+			return err
+		}
+		hostVeth, err := netlink.LinkByName(vethCNI.Name)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", vethCNI.Name, err)
+		}
+		if err := checkMulticastGroups(n.groups, br, hostVeth, n.Vlan); err != nil {
+			return err
+		}
+	}
+
+	if n.StaticNAT != nil {
+		addr := firstIPv4(result.IPs)
+		if addr == nil {
+			return fmt.Errorf("staticNAT requires an IPv4 address, prevResult has none")
+		}
+		dnatChain, snatChain := n.staticNATChains(args.ContainerID)
+		return n.StaticNAT.Check(addr, dnatChain, snatChain, utils.FormatComment(n.Name, args.ContainerID))
+	}
+	return nil
 }
 
 func uniqueID(containerID, cniIface string) string {
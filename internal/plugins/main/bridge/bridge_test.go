@@ -12,13 +12,14 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package bridge
 
 import (
 	"encoding/json"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/coreos/go-iptables/iptables"
@@ -27,6 +28,7 @@ import (
 	. "github.com/onsi/gomega"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
@@ -35,6 +37,7 @@ import (
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
 )
 
@@ -2463,6 +2466,804 @@ var _ = Describe("bridge Operations", func() {
 		})
 	}
 
+	It("attaches the uplink on ADD and detaches it on the last DEL", func() {
+		const uplinkName = "uplink0"
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"uplink": "%s",
+			"uplinkMoveAddresses": true,
+			"dataDir": "%s",
+			"ipam": {}
+		}`, BRNAME, uplinkName, dataDir)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy-uplink",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+		uplinkAddr, err := netlink.ParseAddr("192.0.2.5/24")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: uplinkName},
+				PeerName:  uplinkName + "p",
+			})).To(Succeed())
+			uplink, err := netlink.LinkByName(uplinkName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(uplink)).To(Succeed())
+			Expect(netlink.AddrAdd(uplink, uplinkAddr)).To(Succeed())
+
+			_, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			br, err := netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			uplink, err = netlink.LinkByName(uplinkName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(uplink.Attrs().MasterIndex).To(Equal(br.Attrs().Index))
+			Expect(br.Attrs().HardwareAddr).To(Equal(uplink.Attrs().HardwareAddr))
+
+			addrs, err := netlink.AddrList(br, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(ContainElement(HaveField("IPNet.String()", "192.0.2.5/24")))
+			addrs, err = netlink.AddrList(uplink, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(BeEmpty())
+
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+
+			uplink, err = netlink.LinkByName(uplinkName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(uplink.Attrs().MasterIndex).To(BeZero())
+			addrs, err = netlink.AddrList(uplink, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(ContainElement(HaveField("IPNet.String()", "192.0.2.5/24")))
+			Expect(filepath.Join(dataDir, BRNAME+".uplink.json")).NotTo(BeAnExistingFile())
+			return nil
+		})).To(Succeed())
+	})
+
+	It("leaves an uplink it didn't attach on the last DEL", func() {
+		const uplinkName = "uplink0"
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"uplink": "%s",
+			"dataDir": "%s",
+			"ipam": {}
+		}`, BRNAME, uplinkName, dataDir)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy-uplink",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		Expect(originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Bridge{
+				LinkAttrs: netlink.LinkAttrs{Name: BRNAME},
+			})).To(Succeed())
+			br, err := netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: uplinkName, MasterIndex: br.Attrs().Index},
+				PeerName:  uplinkName + "p",
+			})).To(Succeed())
+
+			_, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(dataDir, BRNAME+".uplink.json")).NotTo(BeAnExistingFile())
+
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+			uplink, err := netlink.LinkByName(uplinkName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(uplink.Attrs().MasterIndex).To(Equal(br.Attrs().Index))
+			return nil
+		})).To(Succeed())
+	})
+
+	It("removes a bridge it created on the last DEL with removeBridgeOnEmpty", func() {
+		const uplinkName = "uplink0"
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"uplink": "%s",
+			"removeBridgeOnEmpty": true,
+			"dataDir": "%s",
+			"ipam": {}
+		}`, BRNAME, uplinkName, dataDir)
+		args := func(id, ifName string) *skel.CmdArgs {
+			return &skel.CmdArgs{
+				ContainerID: id,
+				Netns:       targetNS.Path(),
+				IfName:      ifName,
+				StdinData:   []byte(conf),
+			}
+		}
+		first, second := args("dummy-first", IFNAME), args("dummy-second", "eth1")
+
+		Expect(originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: uplinkName},
+				PeerName:  uplinkName + "p",
+			})).To(Succeed())
+
+			for _, a := range []*skel.CmdArgs{first, second} {
+				_, _, err := testutils.CmdAddWithArgs(a, func() error {
+					return cmdAdd(a)
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			br, err := netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(dataDir, BRNAME+".owner.json")).To(BeAnExistingFile())
+
+			// the other attachment keeps the bridge
+			Expect(testutils.CmdDelWithArgs(first, func() error {
+				return cmdDel(first)
+			})).To(Succeed())
+			Expect(netlink.LinkByName(BRNAME)).To(HaveField("Attrs().Index", br.Attrs().Index))
+
+			Expect(testutils.CmdDelWithArgs(second, func() error {
+				return cmdDel(second)
+			})).To(Succeed())
+			_, err = netlink.LinkByName(BRNAME)
+			Expect(err).To(BeAssignableToTypeOf(netlink.LinkNotFoundError{}))
+			uplink, err := netlink.LinkByName(uplinkName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(uplink.Attrs().MasterIndex).To(BeZero())
+			Expect(filepath.Join(dataDir, BRNAME+".owner.json")).NotTo(BeAnExistingFile())
+
+			// deleting again is fine
+			Expect(testutils.CmdDelWithArgs(second, func() error {
+				return cmdDel(second)
+			})).To(Succeed())
+			return nil
+		})).To(Succeed())
+	})
+
+	It("removes the unmanaged markers of the bridge on the last DEL", func() {
+		markers := []string{
+			"/run/udev/rules.d/90-cni-" + BRNAME + ".rules",
+			"/run/systemd/network/90-cni-" + BRNAME + ".network",
+		}
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"interfaceOwnership": "mark",
+			"dataDir": "%s",
+			"ipam": {}
+		}`, BRNAME, dataDir)
+		args := func(id, ifName string) *skel.CmdArgs {
+			return &skel.CmdArgs{
+				ContainerID: id,
+				Netns:       targetNS.Path(),
+				IfName:      ifName,
+				StdinData:   []byte(conf),
+			}
+		}
+		first, second := args("dummy-first", IFNAME), args("dummy-second", "eth1")
+
+		Expect(originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			for _, a := range []*skel.CmdArgs{first, second} {
+				_, _, err := testutils.CmdAddWithArgs(a, func() error {
+					return cmdAdd(a)
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			for _, marker := range markers {
+				Expect(marker).To(BeAnExistingFile())
+			}
+
+			// the other attachment keeps the markers
+			Expect(testutils.CmdDelWithArgs(first, func() error {
+				return cmdDel(first)
+			})).To(Succeed())
+			for _, marker := range markers {
+				Expect(marker).To(BeAnExistingFile())
+			}
+
+			Expect(testutils.CmdDelWithArgs(second, func() error {
+				return cmdDel(second)
+			})).To(Succeed())
+			for _, marker := range markers {
+				Expect(marker).NotTo(BeAnExistingFile())
+			}
+			return nil
+		})).To(Succeed())
+	})
+
+	It("keeps a bridge it didn't create with removeBridgeOnEmpty", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"removeBridgeOnEmpty": true,
+			"dataDir": "%s",
+			"ipam": {}
+		}`, BRNAME, dataDir)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy-existing",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		Expect(originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Bridge{
+				LinkAttrs: netlink.LinkAttrs{Name: BRNAME},
+			})).To(Succeed())
+
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+
+			_, err = netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(dataDir, BRNAME+".owner.json")).NotTo(BeAnExistingFile())
+			return nil
+		})).To(Succeed())
+	})
+
+	It("places the bridge into a VRF on ADD and removes the VRF on the last DEL", func() {
+		const vrfName = "vrf-blue"
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"isGateway": true,
+			"vrf": "%s",
+			"vrfTable": 1077,
+			"dataDir": "%s",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.77.0.0/24",
+				"dataDir": "%s"
+			}
+		}`, BRNAME, vrfName, dataDir, dataDir)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy-vrf",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+		_, subnet, _ := net.ParseCIDR("10.77.0.0/24")
+
+		Expect(originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			vrf, err := netlink.LinkByName(vrfName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(vrf).To(BeAssignableToTypeOf(&netlink.Vrf{}))
+			br, err := netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(br.Attrs().MasterIndex).To(Equal(vrf.Attrs().Index))
+
+			// the gateway's connected route lives in the VRF table only
+			routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: 1077}, netlink.RT_FILTER_TABLE)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(ContainElement(HaveField("Dst.String()", subnet.String())))
+			routes, err = netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: subnet}, netlink.RT_FILTER_DST)
+			Expect(err).NotTo(HaveOccurred())
+			for _, r := range routes {
+				Expect(r.Table).To(Equal(1077))
+			}
+
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+
+			_, err = netlink.LinkByName(vrfName)
+			Expect(err).To(HaveOccurred())
+			br, err = netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(br.Attrs().MasterIndex).To(BeZero())
+			Expect(filepath.Join(dataDir, BRNAME+".vrf.json")).NotTo(BeAnExistingFile())
+			return nil
+		})).To(Succeed())
+	})
+
+	It("reverts promiscuous mode only after its last user is deleted", func() {
+		newArgs := func(id, ifName string) *skel.CmdArgs {
+			return &skel.CmdArgs{
+				ContainerID: id,
+				Netns:       targetNS.Path(),
+				IfName:      ifName,
+				StdinData: []byte(fmt.Sprintf(`{
+					"cniVersion": "1.0.0",
+					"name": "net-%s",
+					"type": "bridge",
+					"bridge": "%s",
+					"dataDir": "%s",
+					"promiscMode": true,
+					"ipam": {}
+				}`, id, BRNAME, dataDir)),
+			}
+		}
+		argsA := newArgs("a", "eth1")
+		argsB := newArgs("b", "eth2")
+
+		promisc := func() bool {
+			br, err := bridgeByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			return br.Attrs().Promisc != 0
+		}
+
+		Expect(originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			for _, args := range []*skel.CmdArgs{argsA, argsB} {
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(promisc()).To(BeTrue())
+
+			Expect(testutils.CmdDelWithArgs(argsA, func() error {
+				return cmdDel(argsA)
+			})).To(Succeed())
+			Expect(promisc()).To(BeTrue())
+
+			Expect(testutils.CmdDelWithArgs(argsB, func() error {
+				return cmdDel(argsB)
+			})).To(Succeed())
+			Expect(promisc()).To(BeFalse())
+			Expect(filepath.Join(dataDir, BRNAME+".settings.json")).NotTo(BeAnExistingFile())
+			return nil
+		})).To(Succeed())
+	})
+
+	It("names the host veth from the hostInterfaceTemplate", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			Args:        "K8S_POD_NAMESPACE=default;K8S_POD_NAME=nginx-7c5ddbdf54-8lgzr",
+			StdinData: []byte(fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "bridge",
+				"bridge": "%s",
+				"hostInterfaceTemplate": "v-{{.PodName | trunc 5}}-{{.Hash | trunc 4}}",
+				"ipam": {}
+			}`, BRNAME)),
+		}
+
+		Expect(originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			hostName := result.Interfaces[1].Name
+			Expect(hostName).To(HavePrefix("v-nginx-"))
+			Expect(hostName).To(HaveLen(12))
+			_, err = netlink.LinkByName(hostName)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+			_, err = netlink.LinkByName(hostName)
+			Expect(err).To(HaveOccurred())
+			return nil
+		})).To(Succeed())
+	})
+
+	It("answers ARP for the container's addresses on the proxy interfaces", func() {
+		const uplinkName = "uplink0"
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"isGateway": true,
+			"proxyARP": true,
+			"proxyInterfaces": ["%s"],
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24",
+				"dataDir": "%s"
+			}
+		}`, BRNAME, uplinkName, dataDir)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy-proxy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		Expect(originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: uplinkName},
+				PeerName:  uplinkName + "p",
+			})).To(Succeed())
+			uplink, err := netlink.LinkByName(uplinkName)
+			Expect(err).NotTo(HaveOccurred())
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			proxies, err := netlink.NeighProxyList(uplink.Attrs().Index, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(proxies).To(HaveLen(1))
+			Expect(proxies[0].IP.Equal(result.IPs[0].Address.IP)).To(BeTrue())
+			value, err := sysctl.Sysctl("net/ipv4/conf/" + uplinkName + "/proxy_arp")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal("1"))
+
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+
+			proxies, err = netlink.NeighProxyList(uplink.Attrs().Index, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(proxies).To(BeEmpty())
+			return nil
+		})).To(Succeed())
+	})
+
+	It("rejects proxy ARP without a gateway", func() {
+		_, _, err := loadNetConf([]byte(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"proxyARP": true,
+			"proxyInterfaces": ["uplink0"]
+		}`), "")
+		Expect(err).To(MatchError("proxyARP and proxyNDP require isGateway"))
+	})
+
+	It("routes IPv6 via a link-local gateway and advertises it", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"isGateway": true,
+			"linkLocalGateway": true,
+			"ipam": {
+				"type": "host-local",
+				"ranges": [[{"subnet": "2001:db8:1::/64", "gateway": "fe80::1"}]],
+				"dataDir": "%s"
+			}
+		}`, BRNAME, dataDir)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy-ll",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+		_, subnet, err := net.ParseCIDR("2001:db8:1::/64")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(1))
+			Expect(result.IPs[0].Gateway.String()).To(Equal("fe80::1"))
+			// the first address of the range is the container's
+			Expect(result.IPs[0].Address.IP.String()).To(Equal("2001:db8:1::1"))
+
+			br, err := netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			addrs, err := netlink.AddrList(br, netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+			var brAddrs []string
+			for _, a := range addrs {
+				Expect(subnet.Contains(a.IP)).To(BeFalse())
+				brAddrs = append(brAddrs, a.IPNet.String())
+			}
+			Expect(brAddrs).To(ContainElement("fe80::1/64"))
+			routes, err := netlink.RouteListFiltered(netlink.FAMILY_V6, &netlink.Route{Dst: subnet}, netlink.RT_FILTER_DST)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(HaveLen(1))
+			Expect(routes[0].LinkIndex).To(Equal(br.Attrs().Index))
+			return nil
+		})).To(Succeed())
+
+		Expect(targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+
+			// the RA adds the default route and marks the gateway as a
+			// router
+			Eventually(func() []string {
+				routes, err := netlink.RouteList(link, netlink.FAMILY_V6)
+				Expect(err).NotTo(HaveOccurred())
+				var gws []string
+				for _, r := range routes {
+					if r.Dst == nil && r.Gw != nil && r.Protocol == unix.RTPROT_RA {
+						gws = append(gws, r.Gw.String())
+					}
+				}
+				return gws
+			}).Should(ConsistOf("fe80::1"))
+			neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(neighs).To(ContainElement(SatisfyAll(
+				HaveField("IP", Equal(linkLocalGateway.IP)),
+				HaveField("Flags", Equal(netlink.NTF_ROUTER)),
+			)))
+			return nil
+		})).To(Succeed())
+
+		Expect(originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})).To(Succeed())
+	})
+
+	It("rejects a link-local gateway without a gateway", func() {
+		_, _, err := loadNetConf([]byte(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"linkLocalGateway": true
+		}`), "")
+		Expect(err).To(MatchError("linkLocalGateway requires isGateway"))
+	})
+
+	It("rejects static NAT without ipam or to an IPv6 address", func() {
+		_, _, err := loadNetConf([]byte(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"staticNAT": {"publicIP": "192.0.2.10", "interface": "uplink0"}
+		}`), "")
+		Expect(err).To(MatchError("staticNAT requires ipam"))
+
+		_, _, err = loadNetConf([]byte(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"staticNAT": {"publicIP": "2001:db8::10", "interface": "uplink0"},
+			"ipam": {"type": "host-local", "subnet": "10.1.2.0/24"}
+		}`), "")
+		Expect(err).To(MatchError(`invalid staticNAT publicIP "2001:db8::10", must be an IPv4 address`))
+	})
+
+	It("merges multicast groups from the runtime and rejects unicast and link-local groups", func() {
+		n, _, err := loadNetConf([]byte(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"multicastGroups": ["239.1.2.3", "ff3e::8000:1"],
+			"runtimeConfig": {"multicastGroups": ["239.1.2.3", "232.0.0.7"]}
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.groups).To(Equal([]net.IP{
+			net.ParseIP("239.1.2.3"), net.ParseIP("ff3e::8000:1"), net.ParseIP("232.0.0.7"),
+		}))
+
+		for group, msg := range map[string]string{
+			"10.1.2.3":  `invalid multicast group "10.1.2.3", must be an IPv4 or IPv6 multicast address`,
+			"224.0.0.1": `invalid multicast group "224.0.0.1", link-local groups are always flooded`,
+			"ff02::1":   `invalid multicast group "ff02::1", link-local groups are always flooded`,
+		} {
+			_, _, err := loadNetConf([]byte(fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "testConfig",
+				"type": "bridge",
+				"multicastGroups": [%q]
+			}`, group)), "")
+			Expect(err).To(MatchError(msg))
+		}
+	})
+
+	It("rejects masquerade options without ipMasq or with an invalid port range", func() {
+		_, _, err := loadNetConf([]byte(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"ipMasqRandomFully": true
+		}`), "")
+		Expect(err).To(MatchError("ipMasqPortRange, ipMasqRandomFully and ipMasqMark require ipMasq"))
+
+		_, _, err = loadNetConf([]byte(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"ipMasq": true,
+			"ipMasqPortRange": "60999-32768"
+		}`), "")
+		Expect(err).To(MatchError(`invalid masquerade port range "60999-32768"`))
+	})
+
+	It("rejects ethertype filters with both or no lists and unknown ethertypes", func() {
+		for conf, msg := range map[string]string{
+			`{"allow": ["ipv4"], "deny": ["lldp"]}`: "etherTypes: specify either allow or deny",
+			`{}`:                                    "etherTypes: specify allow or deny",
+			`{"deny": ["appletalk"]}`:               `invalid ethertype "appletalk"`,
+		} {
+			_, _, err := loadNetConf([]byte(`{
+				"cniVersion": "1.0.0",
+				"name": "testConfig",
+				"type": "bridge",
+				"etherTypes": `+conf+`
+			}`), "")
+			Expect(err).To(MatchError(msg))
+		}
+	})
+
+	It("polices the broadcast and multicast traffic of the container", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"stormControl": {
+				"broadcastRate": 800000,
+				"broadcastBurst": 80000,
+				"multicastRate": 8000000,
+				"multicastBurst": 80000
+			},
+			"runtimeConfig": {
+				"stormControl": {"broadcastRate": 1600000, "broadcastBurst": 160000}
+			}
+		}`, BRNAME)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy-storm",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		Expect(originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			hostVeth, err := netlink.LinkByName(result.Interfaces[1].Name)
+			Expect(err).NotTo(HaveOccurred())
+			filters, err := netlink.FilterList(hostVeth, netlink.MakeHandle(0xffff, 0))
+			Expect(err).NotTo(HaveOccurred())
+			rates := []uint32{}
+			for _, filter := range filters {
+				u32, ok := filter.(*netlink.U32)
+				Expect(ok).To(BeTrue())
+				for _, action := range u32.Actions {
+					if police, ok := action.(*netlink.PoliceAction); ok {
+						Expect(police.ExceedAction).To(Equal(netlink.TC_POLICE_SHOT))
+						rates = append(rates, police.Rate)
+					}
+				}
+			}
+			// the runtime's broadcast limit replaces the configured one
+			Expect(rates).To(ConsistOf(uint32(200000), uint32(1000000)))
+
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+			return nil
+		})).To(Succeed())
+	})
+
+	It("rejects a storm control rate without a burst", func() {
+		_, _, err := loadNetConf([]byte(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"stormControl": {"broadcastRate": 800000}
+		}`), "")
+		Expect(err).To(MatchError("stormControl: broadcast rate and burst must be set together"))
+	})
+
+	It("carries on without an xdp program that can't be attached, unless it is required", func() {
+		confFmt := `{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"xdp": {"program": "/sys/fs/bpf/cni-test-missing", "mode": "native", "required": %t}
+		}`
+		args := &skel.CmdArgs{
+			ContainerID: "dummy-xdp",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(fmt.Sprintf(confFmt, BRNAME, false)),
+		}
+
+		Expect(originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			hostVeth, err := netlink.LinkByName(result.Interfaces[1].Name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hostVeth.Attrs().Xdp == nil || !hostVeth.Attrs().Xdp.Attached).To(BeTrue())
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+
+			args.StdinData = []byte(fmt.Sprintf(confFmt, BRNAME, true))
+			_, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(MatchError(ContainSubstring(`failed to open xdp program "/sys/fs/bpf/cni-test-missing"`)))
+			return nil
+		})).To(Succeed())
+	})
+
+	It("rejects an invalid xdp mode", func() {
+		_, _, err := loadNetConf([]byte(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"xdp": {"program": "/sys/fs/bpf/hairpin", "mode": "offload"}
+		}`), "")
+		Expect(err).To(MatchError(`invalid xdp mode "offload", must be "generic" or "native"`))
+	})
+
 	It("check vlan id when loading net conf", func() {
 		type vlanTC struct {
 			testCase
@@ -0,0 +1,397 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/d2g/dhcp4"
+	"golang.org/x/sys/unix"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+)
+
+const (
+	defaultDHCPLeaseTime = time.Hour
+	// dhcpOfferHold is how long an offered address stays reserved for a
+	// client that doesn't follow up with a request
+	dhcpOfferHold = time.Minute
+	// dhcpLeasePrefix and dhcpIfName identify the leases in the host-local
+	// store, next to the allocations of containers
+	dhcpLeasePrefix = "dhcp-"
+	dhcpIfName      = "dhcp"
+)
+
+// DHCPServer enables the DHCP responder run by "bridge dhcp-server" for
+// devices on the bridge that aren't attached through CNI, such as VMs.
+type DHCPServer struct {
+	LeaseTime string `json:"leaseTime,omitempty"`
+
+	leaseTime time.Duration
+}
+
+func (d *DHCPServer) validate(n *NetConf) error {
+	d.leaseTime = defaultDHCPLeaseTime
+	if d.LeaseTime != "" {
+		t, err := time.ParseDuration(d.LeaseTime)
+		if err != nil || t <= 0 {
+			return fmt.Errorf("invalid dhcpServer leaseTime %q, must be a positive duration", d.LeaseTime)
+		}
+		d.leaseTime = t
+	}
+	if n.IPAM.Type != "host-local" {
+		return errors.New("dhcpServer requires host-local IPAM")
+	}
+	if !n.IsGW {
+		return errors.New("dhcpServer requires isGateway, it answers from the gateway address")
+	}
+	return nil
+}
+
+// dhcpServer answers DHCPv4 for the IPv4 range set of the bridge, leasing
+// addresses from the host-local store of the network, so they never clash
+// with the addresses of containers.
+type dhcpServer struct {
+	sync.Mutex
+	n        *NetConf
+	store    *disk.Store
+	rangeset *allocator.RangeSet
+	serverIP net.IP
+	// leases maps the store IDs of the leases to their expiry
+	leases map[string]time.Time
+	now    func() time.Time
+}
+
+// runDHCPServer serves DHCP on the bridge of the network configuration in
+// file until it is terminated.
+func runDHCPServer(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: bridge dhcp-server <config file>")
+	}
+	data, err := loadDHCPServerConf(args[0])
+	if err != nil {
+		return err
+	}
+	s, err := newDHCPServer(data)
+	if err != nil {
+		return err
+	}
+	defer s.store.Close()
+
+	conn, err := listenDHCP(s.n.BrName)
+	if err != nil {
+		return err
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		conn.Close()
+	}()
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		for range ticker.C {
+			s.expire()
+		}
+	}()
+
+	log.Printf("serving DHCP on %s for %s", s.n.BrName, s.rangeset)
+	return s.serve(conn)
+}
+
+// loadDHCPServerConf returns the bridge configuration of a network
+// configuration file, which is either a list or a single plugin.
+func loadDHCPServerConf(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+	list := struct {
+		Name       string                   `json:"name"`
+		CNIVersion string                   `json:"cniVersion"`
+		Plugins    []map[string]interface{} `json:"plugins"`
+	}{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse config %q: %v", file, err)
+	}
+	if list.Plugins == nil {
+		return data, nil
+	}
+	for _, p := range list.Plugins {
+		if p["type"] == "bridge" {
+			p["name"] = list.Name
+			p["cniVersion"] = list.CNIVersion
+			return json.Marshal(p)
+		}
+	}
+	return nil, fmt.Errorf("no bridge plugin in config %q", file)
+}
+
+func newDHCPServer(data []byte) (*dhcpServer, error) {
+	n, _, err := loadNetConf(data, "")
+	if err != nil {
+		return nil, err
+	}
+	if n.DHCPServer == nil {
+		return nil, fmt.Errorf("dhcpServer is not enabled for bridge %q", n.BrName)
+	}
+	ipamConf, _, err := allocator.LoadIPAMConfig(data, "")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &dhcpServer{n: n, leases: map[string]time.Time{}, now: time.Now}
+	for i := range ipamConf.Ranges {
+		rs := &ipamConf.Ranges[i]
+		if !rs.Generated() && (*rs)[0].Subnet.IP.To4() != nil {
+			s.rangeset = rs
+			s.serverIP = (*rs)[0].Gateway.To4()
+			break
+		}
+	}
+	if s.rangeset == nil {
+		return nil, errors.New("dhcpServer requires an IPv4 range")
+	}
+
+	if ipamConf.StoreFormat == disk.FormatJournal {
+		s.store, err = disk.NewJournal(ipamConf.Name, ipamConf.DataDir)
+	} else {
+		s.store, err = disk.New(ipamConf.Name, ipamConf.DataDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.adoptLeases(); err != nil {
+		s.store.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// adoptLeases picks up the leases of an earlier run, giving them a full
+// lease time, as their expiry isn't persisted.
+func (s *dhcpServer) adoptLeases() error {
+	if err := s.store.Lock(); err != nil {
+		return err
+	}
+	defer s.store.Unlock()
+
+	ips, err := s.store.Allocations()
+	if err != nil {
+		return fmt.Errorf("failed to list allocations: %v", err)
+	}
+	for _, ip := range ips {
+		if !s.rangeset.Contains(ip) {
+			continue
+		}
+		if id, _, ok := s.store.HolderOf(ip); ok && strings.HasPrefix(id, dhcpLeasePrefix) {
+			s.leases[id] = s.now().Add(s.n.DHCPServer.leaseTime)
+		}
+	}
+	return nil
+}
+
+func listenDHCP(ifName string) (net.PacketConn, error) {
+	lc := net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var err error
+			cerr := c.Control(func(fd uintptr) {
+				if err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+					return
+				}
+				if err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_BROADCAST, 1); err != nil {
+					return
+				}
+				err = unix.BindToDevice(int(fd), ifName)
+			})
+			if cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp4", ":67")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for DHCP on %q: %v", ifName, err)
+	}
+	return conn, nil
+}
+
+func (s *dhcpServer) serve(conn net.PacketConn) error {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		req := dhcp4.Packet(append([]byte{}, buf[:n]...))
+		reply := s.handle(req)
+		if reply == nil {
+			continue
+		}
+
+		// Unicast to bound clients, broadcast to the others, which have no
+		// address yet
+		dst := &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+		if ciaddr := req.CIAddr(); !ciaddr.Equal(net.IPv4zero) && reply.ParseOptions()[dhcp4.OptionDHCPMessageType][0] != byte(dhcp4.NAK) {
+			dst.IP = ciaddr
+		}
+		if _, err := conn.WriteTo(reply, dst); err != nil {
+			log.Printf("failed to send DHCP reply to %s: %v", req.CHAddr(), err)
+		}
+	}
+}
+
+// handle returns the reply to a DHCP request, or nil if there is none.
+func (s *dhcpServer) handle(req dhcp4.Packet) dhcp4.Packet {
+	if len(req) < 241 || req.OpCode() != dhcp4.BootRequest || req.HLen() != 6 {
+		return nil
+	}
+	// Only devices on the bridge are served, not relayed requests
+	if !req.GIAddr().Equal(net.IPv4zero) {
+		return nil
+	}
+	opts := req.ParseOptions()
+	msgType := opts[dhcp4.OptionDHCPMessageType]
+	if len(msgType) != 1 {
+		return nil
+	}
+	if sid := opts[dhcp4.OptionServerIdentifier]; sid != nil && !net.IP(sid).Equal(s.serverIP) {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	id := dhcpLeasePrefix + req.CHAddr().String()
+	switch dhcp4.MessageType(msgType[0]) {
+	case dhcp4.Discover:
+		ip, err := s.allocate(id, net.IP(opts[dhcp4.OptionRequestedIPAddress]))
+		if err != nil {
+			log.Printf("failed to offer an address to %s: %v", req.CHAddr(), err)
+			return nil
+		}
+		if expiry := s.now().Add(dhcpOfferHold); s.leases[id].Before(expiry) {
+			s.leases[id] = expiry
+		}
+		return s.reply(req, dhcp4.Offer, ip)
+
+	case dhcp4.Request:
+		requested := net.IP(opts[dhcp4.OptionRequestedIPAddress])
+		if requested == nil {
+			requested = req.CIAddr()
+		}
+		ip, err := s.allocate(id, requested)
+		if err != nil || !ip.Equal(requested) {
+			return dhcp4.ReplyPacket(req, dhcp4.NAK, s.serverIP, nil, 0, nil)
+		}
+		s.leases[id] = s.now().Add(s.n.DHCPServer.leaseTime)
+		return s.reply(req, dhcp4.ACK, ip)
+
+	case dhcp4.Release, dhcp4.Decline:
+		if err := s.release(id); err != nil {
+			log.Printf("failed to release the lease of %s: %v", req.CHAddr(), err)
+		}
+	}
+	return nil
+}
+
+func (s *dhcpServer) reply(req dhcp4.Packet, msgType dhcp4.MessageType, ip net.IP) dhcp4.Packet {
+	r := (*s.rangeset)[0]
+	opts := []dhcp4.Option{
+		{Code: dhcp4.OptionSubnetMask, Value: []byte(r.Subnet.Mask)},
+		{Code: dhcp4.OptionRouter, Value: []byte(s.serverIP)},
+		{Code: dhcp4.OptionRenewalTimeValue, Value: dhcp4.OptionsLeaseTime(s.n.DHCPServer.leaseTime / 2)},
+		{Code: dhcp4.OptionRebindingTimeValue, Value: dhcp4.OptionsLeaseTime(s.n.DHCPServer.leaseTime * 7 / 8)},
+	}
+	nameservers := []net.IP{}
+	for _, ns := range s.n.DNS.Nameservers {
+		if ip := net.ParseIP(ns).To4(); ip != nil {
+			nameservers = append(nameservers, ip)
+		}
+	}
+	if len(nameservers) > 0 {
+		opts = append(opts, dhcp4.Option{Code: dhcp4.OptionDomainNameServer, Value: dhcp4.JoinIPs(nameservers)})
+	}
+	if s.n.DNS.Domain != "" {
+		opts = append(opts, dhcp4.Option{Code: dhcp4.OptionDomainName, Value: []byte(s.n.DNS.Domain)})
+	}
+	return dhcp4.ReplyPacket(req, msgType, s.serverIP, ip, s.n.DHCPServer.leaseTime, opts)
+}
+
+// allocate returns the address leased to the client, allocating one from
+// the range set if it has none, preferably the requested one.
+func (s *dhcpServer) allocate(id string, requested net.IP) (net.IP, error) {
+	if err := s.store.Lock(); err != nil {
+		return nil, err
+	}
+	defer s.store.Unlock()
+
+	a := allocator.NewIPAllocator(s.rangeset, s.store, 0)
+	if ipConf := a.Allocated(id, dhcpIfName); ipConf != nil {
+		return ipConf.Address.IP.To4(), nil
+	}
+	if requested != nil && s.rangeset.Contains(requested) {
+		if ipConf, err := a.Get(id, dhcpIfName, requested); err == nil {
+			return ipConf.Address.IP.To4(), nil
+		}
+	}
+	ipConf, err := a.Get(id, dhcpIfName, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ipConf.Address.IP.To4(), nil
+}
+
+func (s *dhcpServer) release(id string) error {
+	delete(s.leases, id)
+	if err := s.store.Lock(); err != nil {
+		return err
+	}
+	defer s.store.Unlock()
+	return s.store.ReleaseByID(id, dhcpIfName)
+}
+
+// expire releases the leases which weren't renewed in time.
+func (s *dhcpServer) expire() {
+	s.Lock()
+	defer s.Unlock()
+
+	now := s.now()
+	for id, expiry := range s.leases {
+		if expiry.After(now) {
+			continue
+		}
+		if err := s.release(id); err != nil {
+			log.Printf("failed to release expired lease %s: %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bridge
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/d2g/dhcp4"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+)
+
+var _ = Describe("bridge DHCP server", func() {
+	var (
+		dataDir string
+		s       *dhcpServer
+		mac     net.HardwareAddr
+	)
+
+	conf := func(dataDir, extra string) []byte {
+		return []byte(fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "edge",
+			"type": "bridge",
+			"strictConfig": true,
+			"bridge": "br-edge",
+			"isGateway": true,
+			"dns": {"nameservers": ["10.1.2.1", "fd00::1"], "domain": "edge.local"},
+			"dhcpServer": {"leaseTime": "10m"%s},
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"ranges": [[{"subnet": "fd00::/64"}], [{"subnet": "10.1.2.0/24"}]]
+			}
+		}`, extra, dataDir))
+	}
+
+	BeforeEach(func() {
+		var err error
+		dataDir = GinkgoT().TempDir()
+		s, err = newDHCPServer(conf(dataDir, ""))
+		Expect(err).NotTo(HaveOccurred())
+		mac, _ = net.ParseMAC("02:00:00:00:00:01")
+	})
+
+	AfterEach(func() {
+		Expect(s.store.Close()).To(Succeed())
+	})
+
+	request := func(mt dhcp4.MessageType, options ...dhcp4.Option) dhcp4.Packet {
+		return dhcp4.RequestPacket(mt, mac, nil, []byte{1, 2, 3, 4}, true, options)
+	}
+	messageType := func(p dhcp4.Packet) dhcp4.MessageType {
+		return dhcp4.MessageType(p.ParseOptions()[dhcp4.OptionDHCPMessageType][0])
+	}
+	holder := func(ip string) string {
+		data, err := os.ReadFile(filepath.Join(dataDir, "edge", ip))
+		if os.IsNotExist(err) {
+			return ""
+		}
+		Expect(err).NotTo(HaveOccurred())
+		return string(data)
+	}
+
+	It("leases addresses of the range set from the host-local store", func() {
+		offer := s.handle(request(dhcp4.Discover))
+		Expect(offer).NotTo(BeNil())
+		Expect(messageType(offer)).To(Equal(dhcp4.Offer))
+		Expect(offer.YIAddr().String()).To(Equal("10.1.2.2"))
+		opts := offer.ParseOptions()
+		Expect(net.IP(opts[dhcp4.OptionServerIdentifier]).String()).To(Equal("10.1.2.1"))
+		Expect(net.IP(opts[dhcp4.OptionRouter]).String()).To(Equal("10.1.2.1"))
+		Expect(net.IP(opts[dhcp4.OptionSubnetMask]).String()).To(Equal("255.255.255.0"))
+		Expect(net.IP(opts[dhcp4.OptionDomainNameServer]).String()).To(Equal("10.1.2.1"))
+		Expect(string(opts[dhcp4.OptionDomainName])).To(Equal("edge.local"))
+		Expect(opts[dhcp4.OptionIPAddressLeaseTime]).To(Equal(dhcp4.OptionsLeaseTime(10 * time.Minute)))
+		Expect(holder("10.1.2.2")).To(Equal("dhcp-02:00:00:00:00:01\r\ndhcp"))
+
+		ack := s.handle(request(dhcp4.Request,
+			dhcp4.Option{Code: dhcp4.OptionRequestedIPAddress, Value: offer.YIAddr().To4()},
+			dhcp4.Option{Code: dhcp4.OptionServerIdentifier, Value: net.ParseIP("10.1.2.1").To4()},
+		))
+		Expect(messageType(ack)).To(Equal(dhcp4.ACK))
+		Expect(ack.YIAddr().String()).To(Equal("10.1.2.2"))
+
+		// containers get other addresses of the range set
+		Expect(s.store.Lock()).To(Succeed())
+		ipConf, err := allocator.NewIPAllocator(s.rangeset, s.store, 0).Get("container", "eth0", nil)
+		Expect(s.store.Unlock()).To(Succeed())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipConf.Address.IP.String()).To(Equal("10.1.2.3"))
+
+		// the lease survives a restart
+		Expect(s.store.Close()).To(Succeed())
+		s, err = newDHCPServer(conf(dataDir, ""))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.leases).To(HaveKey("dhcp-02:00:00:00:00:01"))
+
+		Expect(s.handle(request(dhcp4.Release))).To(BeNil())
+		Expect(holder("10.1.2.2")).To(BeEmpty())
+	})
+
+	It("refuses addresses which aren't the client's", func() {
+		nak := s.handle(request(dhcp4.Request,
+			dhcp4.Option{Code: dhcp4.OptionRequestedIPAddress, Value: net.ParseIP("10.9.9.9").To4()},
+		))
+		Expect(messageType(nak)).To(Equal(dhcp4.NAK))
+
+		// requests for other servers are left alone
+		Expect(s.handle(request(dhcp4.Request,
+			dhcp4.Option{Code: dhcp4.OptionServerIdentifier, Value: net.ParseIP("10.1.2.254").To4()},
+		))).To(BeNil())
+	})
+
+	It("releases leases which weren't renewed", func() {
+		offer := s.handle(request(dhcp4.Discover))
+		Expect(holder(offer.YIAddr().String())).NotTo(BeEmpty())
+
+		// an offer is held briefly only
+		s.now = func() time.Time { return time.Now().Add(2 * dhcpOfferHold) }
+		s.expire()
+		Expect(holder(offer.YIAddr().String())).To(BeEmpty())
+
+		s.now = time.Now
+		s.handle(request(dhcp4.Request,
+			dhcp4.Option{Code: dhcp4.OptionRequestedIPAddress, Value: net.ParseIP("10.1.2.5").To4()},
+		))
+		Expect(holder("10.1.2.5")).NotTo(BeEmpty())
+		s.now = func() time.Time { return time.Now().Add(2 * dhcpOfferHold) }
+		s.expire()
+		Expect(holder("10.1.2.5")).NotTo(BeEmpty())
+		s.now = func() time.Time { return time.Now().Add(11 * time.Minute) }
+		s.expire()
+		Expect(holder("10.1.2.5")).To(BeEmpty())
+	})
+
+	It("validates the configuration", func() {
+		_, _, err := loadNetConf(conf(dataDir, `, "bogus": 1`), "")
+		Expect(err).To(MatchError(ContainSubstring("dhcpServer.bogus")))
+
+		_, _, err = loadNetConf([]byte(`{"name": "edge", "type": "bridge", "isGateway": true, "dhcpServer": {}, "ipam": {"type": "dhcp"}}`), "")
+		Expect(err).To(MatchError("dhcpServer requires host-local IPAM"))
+
+		_, _, err = loadNetConf([]byte(`{"name": "edge", "type": "bridge", "dhcpServer": {"leaseTime": "0s"}, "ipam": {"type": "host-local"}}`), "")
+		Expect(err).To(MatchError(`invalid dhcpServer leaseTime "0s", must be a positive duration`))
+
+		_, err = newDHCPServer([]byte(`{"name": "edge", "type": "bridge", "isGateway": true, "ipam": {"type": "host-local", "subnet": "10.1.2.0/24"}}`))
+		Expect(err).To(MatchError(`dhcpServer is not enabled for bridge "cni0"`))
+	})
+})
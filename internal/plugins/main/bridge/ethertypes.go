@@ -0,0 +1,62 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bridge
+
+import (
+	"errors"
+
+	"github.com/containernetworking/plugins/pkg/link"
+)
+
+// EtherTypes restricts the ethertypes of the frames a container can send
+// into the bridge, e.g. to allow only IPv4, IPv6 and ARP, or to drop LLDP
+// and STP, which upset the site's switches. Ethertypes are given by name,
+// such as "ipv4", "lldp" or "stp", or as numbers, such as "0x88b5". Only
+// one of Allow and Deny may be set.
+type EtherTypes struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+
+	etherTypes []uint16
+}
+
+func (e *EtherTypes) validate() error {
+	if e == nil {
+		return nil
+	}
+	names := e.Allow
+	switch {
+	case len(e.Allow) > 0 && len(e.Deny) > 0:
+		return errors.New("etherTypes: specify either allow or deny")
+	case len(e.Allow) == 0 && len(e.Deny) == 0:
+		return errors.New("etherTypes: specify allow or deny")
+	case len(e.Deny) > 0:
+		names = e.Deny
+	}
+	e.etherTypes = nil
+	for _, name := range names {
+		t, err := link.ParseEtherType(name)
+		if err != nil {
+			return err
+		}
+		e.etherTypes = append(e.etherTypes, t)
+	}
+	return nil
+}
+
+// filter returns the filter of the host veth of a container.
+func (e *EtherTypes) filter(hostIfName, refID string) *link.EtherTypeFilter {
+	return link.NewEtherTypeFilter(hostIfName, len(e.Allow) > 0, e.etherTypes, refID)
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bridge
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// raRouterLifetime is the longest router lifetime an RA may carry,
+	// RAs are only sent on ADD
+	raRouterLifetime = 9000
+	// raHopLimit is the hop limit of neighbor discovery, receivers drop
+	// RAs with any other
+	raHopLimit = 255
+
+	ndOptSourceLinkAddr = 1
+	ndOptPrefixInfo     = 3
+	ndOptMTU            = 5
+	ndPrefixOnLink      = 0x80
+)
+
+// linkLocalGateway is the IPv6 gateway of networks with linkLocalGateway
+// set, the same on every node and bridge. The ranges are routed through
+// the bridge instead of being on-link by an address of each.
+var linkLocalGateway = &net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)}
+
+// ensureLinkLocalGateway adds the link-local gateway to the bridge, or its
+// vlan interface, and routes the container subnets through it.
+func ensureLinkLocalGateway(gwLink netlink.Link, subnets []net.IPNet) error {
+	// DAD would keep the address tentative, and unusable as the source
+	// of RAs, for a second. It is ours on every bridge anyway.
+	addr := &netlink.Addr{IPNet: linkLocalGateway, Flags: unix.IFA_F_NODAD}
+	if err := netlink.AddrAdd(gwLink, addr); err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("could not add link-local gateway to %q: %v", gwLink.Attrs().Name, err)
+	}
+
+	for i := range subnets {
+		route := &netlink.Route{LinkIndex: gwLink.Attrs().Index, Dst: &subnets[i]}
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("could not route %v via %q: %v", &subnets[i], gwLink.Attrs().Name, err)
+		}
+	}
+
+	// Set the bridge's MAC to itself, as ensureAddr does, so the router
+	// address the containers learn from the RA doesn't change
+	if err := netlink.LinkSetHardwareAddr(gwLink, gwLink.Attrs().HardwareAddr); err != nil {
+		return fmt.Errorf("could not set bridge's mac: %v", err)
+	}
+	return nil
+}
+
+// sendRouterAdvertisement advertises the link-local gateway as the router
+// of the subnets, on-link but without autoconfiguration, as the addresses
+// come from IPAM. It is advertised as a default router unless the
+// containers get their default route from the result, which the kernel
+// wouldn't add the route of the RA next to.
+func sendRouterAdvertisement(gwLink netlink.Link, subnets []net.IPNet, mtu int, defaultRouter bool) error {
+	name, index := gwLink.Attrs().Name, gwLink.Attrs().Index
+
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.IPPROTO_ICMPV6)
+	if err != nil {
+		return fmt.Errorf("failed to open ICMPv6 socket: %v", err)
+	}
+	defer unix.Close(fd)
+
+	if err := unix.BindToDevice(fd, name); err != nil {
+		return fmt.Errorf("failed to bind ICMPv6 socket to %q: %v", name, err)
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_HOPS, raHopLimit); err != nil {
+		return err
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_IF, index); err != nil {
+		return err
+	}
+	src := &unix.SockaddrInet6{ZoneId: uint32(index)}
+	copy(src.Addr[:], linkLocalGateway.IP.To16())
+	if err := unix.Bind(fd, src); err != nil {
+		return fmt.Errorf("failed to bind ICMPv6 socket to %v: %v", linkLocalGateway.IP, err)
+	}
+
+	dst := &unix.SockaddrInet6{ZoneId: uint32(index)}
+	copy(dst.Addr[:], net.IPv6linklocalallnodes)
+	// the kernel fills in the checksum of ICMPv6 sockets
+	if err := unix.Sendto(fd, routerAdvertisement(gwLink.Attrs().HardwareAddr, subnets, mtu, defaultRouter), 0, dst); err != nil {
+		return fmt.Errorf("failed to send router advertisement on %q: %v", name, err)
+	}
+	return nil
+}
+
+// routerAdvertisement returns the ICMPv6 message of an RA, see RFC 4861.
+func routerAdvertisement(mac net.HardwareAddr, subnets []net.IPNet, mtu int, defaultRouter bool) []byte {
+	msg := []byte{
+		134, 0, 0, 0, // type, code, checksum
+		64, 0, // cur hop limit, flags
+		0, 0, // router lifetime
+		0, 0, 0, 0, // reachable time
+		0, 0, 0, 0, // retrans timer
+	}
+	if defaultRouter {
+		binary.BigEndian.PutUint16(msg[6:], raRouterLifetime)
+	}
+
+	if len(mac) == 6 {
+		msg = append(msg, ndOptSourceLinkAddr, 1)
+		msg = append(msg, mac...)
+	}
+	if mtu > 0 {
+		opt := make([]byte, 8)
+		opt[0], opt[1] = ndOptMTU, 1
+		binary.BigEndian.PutUint32(opt[4:], uint32(mtu))
+		msg = append(msg, opt...)
+	}
+	for _, subnet := range subnets {
+		ones, _ := subnet.Mask.Size()
+		opt := make([]byte, 32)
+		opt[0], opt[1] = ndOptPrefixInfo, 4
+		opt[2], opt[3] = byte(ones), ndPrefixOnLink
+		binary.BigEndian.PutUint32(opt[4:], 0xffffffff) // valid lifetime
+		binary.BigEndian.PutUint32(opt[8:], 0xffffffff) // preferred lifetime
+		copy(opt[16:], subnet.IP.Mask(subnet.Mask).To16())
+		msg = append(msg, opt...)
+	}
+	return msg
+}
@@ -0,0 +1,215 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bridge
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Attributes and states of the bridge multicast database, from
+// linux/if_bridge.h
+const (
+	mdbaMDB          = 1
+	mdbaMDBEntry     = 1
+	mdbaMDBEntryInfo = 1
+	mdbaSetEntry     = 1
+
+	mdbPermanent = 1
+)
+
+// mdbEntryLen is the size of struct br_mdb_entry.
+const mdbEntryLen = 28
+
+// parseMulticastGroups parses the multicast groups of the configuration
+// and of the "multicastGroups" capability argument, dropping duplicates.
+func parseMulticastGroups(groups ...[]string) ([]net.IP, error) {
+	var parsed []net.IP
+	seen := map[string]bool{}
+	for _, g := range groups {
+		for _, s := range g {
+			ip := net.ParseIP(s)
+			if ip == nil || !ip.IsMulticast() {
+				return nil, fmt.Errorf("invalid multicast group %q, must be an IPv4 or IPv6 multicast address", s)
+			}
+			if ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+				return nil, fmt.Errorf("invalid multicast group %q, link-local groups are always flooded", s)
+			}
+			if !seen[ip.String()] {
+				seen[ip.String()] = true
+				parsed = append(parsed, ip)
+			}
+		}
+	}
+	return parsed, nil
+}
+
+// brPortMsg is struct br_port_msg, the header of MDB messages.
+type brPortMsg struct {
+	ifindex uint32
+}
+
+func (m *brPortMsg) Len() int { return 8 }
+
+func (m *brPortMsg) Serialize() []byte {
+	b := make([]byte, m.Len())
+	b[0] = unix.AF_BRIDGE
+	nl.NativeEndian().PutUint32(b[4:], m.ifindex)
+	return b
+}
+
+// mdbEntry is struct br_mdb_entry, a group on a bridge port.
+type mdbEntry struct {
+	ifindex uint32
+	state   uint8
+	vid     uint16
+	group   net.IP
+}
+
+func (e *mdbEntry) serialize() []byte {
+	b := make([]byte, mdbEntryLen)
+	nl.NativeEndian().PutUint32(b[0:], e.ifindex)
+	b[4] = e.state
+	nl.NativeEndian().PutUint16(b[6:], e.vid)
+	if ip4 := e.group.To4(); ip4 != nil {
+		copy(b[8:], ip4)
+		binary.BigEndian.PutUint16(b[24:], unix.ETH_P_IP)
+	} else {
+		copy(b[8:], e.group.To16())
+		binary.BigEndian.PutUint16(b[24:], unix.ETH_P_IPV6)
+	}
+	return b
+}
+
+func parseMDBEntry(b []byte) (*mdbEntry, bool) {
+	if len(b) < mdbEntryLen {
+		return nil, false
+	}
+	e := &mdbEntry{
+		ifindex: nl.NativeEndian().Uint32(b[0:]),
+		state:   b[4],
+		vid:     nl.NativeEndian().Uint16(b[6:]),
+	}
+	switch binary.BigEndian.Uint16(b[24:]) {
+	case unix.ETH_P_IP:
+		e.group = net.IP(append([]byte{}, b[8:12]...))
+	case unix.ETH_P_IPV6:
+		e.group = net.IP(append([]byte{}, b[8:24]...))
+	default:
+		return nil, false
+	}
+	return e, true
+}
+
+// snooping reports whether the bridge snoops IGMP and MLD. Bridges which
+// don't snoop flood multicast to all ports, so they need no static groups.
+func snooping(br *netlink.Bridge) bool {
+	return br.MulticastSnooping == nil || *br.MulticastSnooping
+}
+
+// setupMulticastGroups adds permanent entries for the groups on the host
+// veth to the multicast database of the bridge, so the bridge forwards
+// their traffic to the container before it sees the container join them.
+// The kernel drops the entries along with the port.
+func setupMulticastGroups(groups []net.IP, br *netlink.Bridge, hostVeth netlink.Link, vid int) error {
+	if len(groups) == 0 || !snooping(br) {
+		return nil
+	}
+	for _, group := range groups {
+		req := nl.NewNetlinkRequest(unix.RTM_NEWMDB, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK)
+		req.AddData(&brPortMsg{ifindex: uint32(br.Attrs().Index)})
+		entry := &mdbEntry{ifindex: uint32(hostVeth.Attrs().Index), state: mdbPermanent, vid: uint16(vid), group: group}
+		req.AddData(nl.NewRtAttr(mdbaSetEntry, entry.serialize()))
+		if _, err := req.Execute(unix.NETLINK_ROUTE, 0); err != nil && !errors.Is(err, syscall.EEXIST) {
+			return fmt.Errorf("failed to add multicast group %s for %q to bridge %q: %v", group, hostVeth.Attrs().Name, br.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// multicastGroupsOf returns the groups in the multicast database of the
+// bridge for the port.
+func multicastGroupsOf(br netlink.Link, port netlink.Link) ([]*mdbEntry, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETMDB, unix.NLM_F_DUMP)
+	req.AddData(&brPortMsg{})
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_GETMDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump the multicast database: %v", err)
+	}
+
+	var entries []*mdbEntry
+	for _, msg := range msgs {
+		if len(msg) < 8 || nl.NativeEndian().Uint32(msg[4:]) != uint32(br.Attrs().Index) {
+			continue
+		}
+		for _, mdb := range nestedAttrs(msg[8:], mdbaMDB) {
+			for _, entry := range nestedAttrs(mdb, mdbaMDBEntry) {
+				for _, info := range nestedAttrs(entry, mdbaMDBEntryInfo) {
+					if e, ok := parseMDBEntry(info); ok && e.ifindex == uint32(port.Attrs().Index) {
+						entries = append(entries, e)
+					}
+				}
+			}
+		}
+	}
+	return entries, nil
+}
+
+// nestedAttrs returns the values of the attributes of type typ in b.
+func nestedAttrs(b []byte, typ uint16) [][]byte {
+	attrs, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return nil
+	}
+	var values [][]byte
+	for _, a := range attrs {
+		if a.Attr.Type&nl.NLA_TYPE_MASK == typ {
+			values = append(values, a.Value)
+		}
+	}
+	return values
+}
+
+// checkMulticastGroups verifies that the bridge has the permanent groups
+// of the port.
+func checkMulticastGroups(groups []net.IP, br *netlink.Bridge, hostVeth netlink.Link, vid int) error {
+	if len(groups) == 0 || !snooping(br) {
+		return nil
+	}
+	entries, err := multicastGroupsOf(br, hostVeth)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		found := false
+		for _, e := range entries {
+			if e.group.Equal(group) && e.state == mdbPermanent && int(e.vid) == vid {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("multicast group %s of %q missing on bridge %q", group, hostVeth.Attrs().Name, br.Attrs().Name)
+		}
+	}
+	return nil
+}
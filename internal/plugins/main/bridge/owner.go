@@ -0,0 +1,192 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/vishvananda/netlink"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/link"
+)
+
+// bridgeOwnerState records a bridge created by the plugin for a network with
+// removeBridgeOnEmpty, and the attachments using it, so the last DEL can
+// remove the bridge and a bridge created by anyone else is never removed.
+type bridgeOwnerState struct {
+	// Index is the index of the bridge the plugin created, 0 if it found
+	// the bridge already there
+	Index int `json:"index,omitempty"`
+
+	// Users are keyed by uniqueID
+	Users map[string]string `json:"users"`
+}
+
+func bridgeOwnerStatePath(n *NetConf) string {
+	return filepath.Join(n.DataDir, n.BrName+".owner.json")
+}
+
+// setupOwnedBridge is setupBridge, registering the attachment as a user of
+// the bridge and recording whether the plugin created it. Both happen under
+// the bridge lock, so a concurrent DEL never removes the bridge between its
+// creation and the attachment of the container.
+func setupOwnedBridge(n *NetConf, id string) (*netlink.Bridge, *current.Interface, error) {
+	if !n.RemoveBridgeOnEmpty {
+		return setupBridge(n)
+	}
+
+	unlock, err := lockBridge(n)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	state, err := readBridgeOwnerState(n)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = netlink.LinkByName(n.BrName)
+	_, missing := err.(netlink.LinkNotFoundError)
+
+	br, brInterface, err := setupBridge(n)
+	if err != nil {
+		return nil, nil, err
+	}
+	if missing {
+		state.Index = br.Attrs().Index
+	}
+	state.Users[id] = n.Name
+	if err := writeBridgeOwnerState(n, state); err != nil {
+		return nil, nil, err
+	}
+	return br, brInterface, nil
+}
+
+// unmarkIdleBridge removes the network manager markers of the bridge on the
+// last DEL, once the bridge is gone or has no ports left. The next ADD marks
+// it again before attaching to it.
+func unmarkIdleBridge(n *NetConf) error {
+	if n.InterfaceOwnership != link.OwnershipMark && n.InterfaceOwnership != link.OwnershipEnforce {
+		return nil
+	}
+
+	unlock, err := lockBridge(n)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if br, err := bridgeByName(n.BrName); err == nil {
+		ports, err := countBridgePorts(br, nil)
+		if err != nil {
+			return err
+		}
+		if ports > 0 {
+			return nil
+		}
+	}
+	return link.UnmarkUnmanaged(n.InterfaceOwnership, n.BrName)
+}
+
+// removeEmptyBridge removes the attachment from the users of the bridge, and
+// deletes the bridge once its last user is gone, if the plugin created it and
+// nothing else is attached to it. The uplink and VRF must already be
+// detached; the vlan gateway interfaces of the bridge go with it.
+func removeEmptyBridge(n *NetConf, id string) error {
+	if !n.RemoveBridgeOnEmpty {
+		return nil
+	}
+
+	unlock, err := lockBridge(n)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := readBridgeOwnerState(n)
+	if err != nil {
+		return err
+	}
+	delete(state.Users, id)
+	if len(state.Users) > 0 {
+		return writeBridgeOwnerState(n, state)
+	}
+
+	br, err := bridgeByName(n.BrName)
+	if err != nil || state.Index == 0 || br.Attrs().Index != state.Index {
+		// gone, or not ours to remove
+		return removeBridgeOwnerState(n)
+	}
+	ports, err := countBridgePorts(br, nil)
+	if err != nil {
+		return err
+	}
+	if ports > 0 {
+		// attached by other networks, or by hand
+		return removeBridgeOwnerState(n)
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("failed to list links: %v", err)
+	}
+	for _, l := range links {
+		if l.Attrs().MasterIndex == br.Attrs().Index && isVlanGatewayPort(br, l) {
+			if err := netlink.LinkDel(l); err != nil {
+				return fmt.Errorf("failed to delete vlan gateway of bridge %q: %v", n.BrName, err)
+			}
+		}
+	}
+	if err := netlink.LinkDel(br); err != nil {
+		return fmt.Errorf("failed to delete bridge %q: %v", n.BrName, err)
+	}
+	return removeBridgeOwnerState(n)
+}
+
+func readBridgeOwnerState(n *NetConf) (*bridgeOwnerState, error) {
+	state := &bridgeOwnerState{}
+	data, err := os.ReadFile(bridgeOwnerStatePath(n))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, state); err != nil {
+			return nil, fmt.Errorf("failed to parse owner state of bridge %q: %v", n.BrName, err)
+		}
+	}
+	if state.Users == nil {
+		state.Users = map[string]string{}
+	}
+	return state, nil
+}
+
+func writeBridgeOwnerState(n *NetConf, state *bridgeOwnerState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(bridgeOwnerStatePath(n), data, 0o600)
+}
+
+func removeBridgeOwnerState(n *NetConf) error {
+	if err := os.Remove(bridgeOwnerStatePath(n)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
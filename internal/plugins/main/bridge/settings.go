@@ -0,0 +1,182 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/vishvananda/netlink"
+)
+
+// bridgeSettings tracks the attachments of a shared bridge which need
+// promiscuous mode or vlan filtering, so a DEL only reverts a setting once
+// its last user is gone and never breaks another network on the bridge.
+type bridgeSettings struct {
+	// OrigPromisc and OrigVlanFiltering are the state of the bridge before
+	// the first user needing the setting was added, unset while no user
+	// needs it
+	OrigPromisc       *bool `json:"origPromisc,omitempty"`
+	OrigVlanFiltering *bool `json:"origVlanFiltering,omitempty"`
+
+	// Users are keyed by uniqueID
+	Users map[string]bridgeSettingsUser `json:"users"`
+}
+
+type bridgeSettingsUser struct {
+	Network       string `json:"network"`
+	Promisc       bool   `json:"promisc,omitempty"`
+	VlanFiltering bool   `json:"vlanFiltering,omitempty"`
+}
+
+func bridgeSettingsPath(n *NetConf) string {
+	return filepath.Join(n.DataDir, n.BrName+".settings.json")
+}
+
+func needsVlanFiltering(n *NetConf) bool {
+	return n.Vlan != 0 || n.VlanTrunk != nil
+}
+
+// needs reports whether any user needs the setting selected by f.
+func (s *bridgeSettings) needs(f func(bridgeSettingsUser) bool) bool {
+	for _, u := range s.Users {
+		if f(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// acquireBridgeSettings registers the attachment as a user of the settings
+// it needs, recording the bridge's state before they are first applied. It
+// must be called before the bridge is set up.
+func acquireBridgeSettings(n *NetConf, id string) error {
+	user := bridgeSettingsUser{
+		Network:       n.Name,
+		Promisc:       n.PromiscMode,
+		VlanFiltering: needsVlanFiltering(n),
+	}
+	if !user.Promisc && !user.VlanFiltering {
+		return nil
+	}
+
+	unlock, err := lockBridge(n)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s, err := readBridgeSettings(n)
+	if err != nil {
+		return err
+	}
+
+	// a bridge which doesn't exist yet has neither setting
+	promisc, vlanFiltering := false, false
+	if br, err := bridgeByName(n.BrName); err == nil {
+		promisc = br.Attrs().Promisc != 0
+		vlanFiltering = br.VlanFiltering != nil && *br.VlanFiltering
+	}
+	if user.Promisc && !s.needs(func(u bridgeSettingsUser) bool { return u.Promisc }) {
+		s.OrigPromisc = &promisc
+	}
+	if user.VlanFiltering && !s.needs(func(u bridgeSettingsUser) bool { return u.VlanFiltering }) {
+		s.OrigVlanFiltering = &vlanFiltering
+	}
+	s.Users[id] = user
+
+	return writeBridgeSettings(n, s)
+}
+
+// releaseBridgeSettings removes the attachment's claims and reverts every
+// setting no remaining user needs to what the bridge had before.
+func releaseBridgeSettings(n *NetConf, id string) error {
+	unlock, err := lockBridge(n)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s, err := readBridgeSettings(n)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.Users[id]; !ok {
+		return nil
+	}
+	delete(s.Users, id)
+
+	br, err := bridgeByName(n.BrName)
+	if err != nil {
+		// the bridge is gone and its settings with it
+		return removeBridgeSettings(n)
+	}
+
+	if s.OrigPromisc != nil && !s.needs(func(u bridgeSettingsUser) bool { return u.Promisc }) {
+		if !*s.OrigPromisc {
+			if err := netlink.SetPromiscOff(br); err != nil {
+				return fmt.Errorf("could not reset promiscuous mode on %q: %v", n.BrName, err)
+			}
+		}
+		s.OrigPromisc = nil
+	}
+	if s.OrigVlanFiltering != nil && !s.needs(func(u bridgeSettingsUser) bool { return u.VlanFiltering }) {
+		if !*s.OrigVlanFiltering {
+			if err := netlink.BridgeSetVlanFiltering(br, false); err != nil {
+				return fmt.Errorf("could not reset vlan filtering on %q: %v", n.BrName, err)
+			}
+		}
+		s.OrigVlanFiltering = nil
+	}
+
+	if len(s.Users) == 0 {
+		return removeBridgeSettings(n)
+	}
+	return writeBridgeSettings(n, s)
+}
+
+func readBridgeSettings(n *NetConf) (*bridgeSettings, error) {
+	s := &bridgeSettings{}
+	data, err := os.ReadFile(bridgeSettingsPath(n))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, s); err != nil {
+			return nil, fmt.Errorf("failed to parse settings of bridge %q: %v", n.BrName, err)
+		}
+	}
+	if s.Users == nil {
+		s.Users = map[string]bridgeSettingsUser{}
+	}
+	return s, nil
+}
+
+func writeBridgeSettings(n *NetConf, s *bridgeSettings) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(bridgeSettingsPath(n), data, 0o600)
+}
+
+func removeBridgeSettings(n *NetConf) error {
+	if err := os.Remove(bridgeSettingsPath(n)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
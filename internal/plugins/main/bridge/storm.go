@@ -0,0 +1,152 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// stormFilterPrio is the priority of the storm control filters on the
+// ingress qdisc of the host veth. The bandwidth plugin redirects the
+// container's traffic from the same qdisc at priority 1, so the filters
+// share it and, being added first, run first.
+const stormFilterPrio = 1
+
+// StormControl limits the broadcast and multicast traffic a container can
+// send into the bridge, which floods it to every port, including the
+// uplink to the site's switches. Rates are in bits per second and bursts
+// in bits, as in the bandwidth plugin.
+//
+// Unknown unicast isn't limited: tc sees the frames before the bridge
+// looks them up in its forwarding database, so they can't be told apart.
+type StormControl struct {
+	BroadcastRate  uint64 `json:"broadcastRate,omitempty"`
+	BroadcastBurst uint64 `json:"broadcastBurst,omitempty"`
+	// Multicast includes broadcast, a broadcast frame counts against both
+	MulticastRate  uint64 `json:"multicastRate,omitempty"`
+	MulticastBurst uint64 `json:"multicastBurst,omitempty"`
+}
+
+// merge returns sc with the limits set in override, e.g. from the
+// "stormControl" capability argument, replacing its own.
+func (sc *StormControl) merge(override *StormControl) *StormControl {
+	merged := &StormControl{}
+	if sc != nil {
+		*merged = *sc
+	}
+	if override == nil {
+		return merged
+	}
+	if override.BroadcastRate != 0 || override.BroadcastBurst != 0 {
+		merged.BroadcastRate, merged.BroadcastBurst = override.BroadcastRate, override.BroadcastBurst
+	}
+	if override.MulticastRate != 0 || override.MulticastBurst != 0 {
+		merged.MulticastRate, merged.MulticastBurst = override.MulticastRate, override.MulticastBurst
+	}
+	return merged
+}
+
+func (sc *StormControl) isZero() bool {
+	return sc == nil || (sc.BroadcastRate == 0 && sc.MulticastRate == 0)
+}
+
+func (sc *StormControl) validate() error {
+	if sc == nil {
+		return nil
+	}
+	for _, l := range []struct {
+		name        string
+		rate, burst uint64
+	}{
+		{"broadcast", sc.BroadcastRate, sc.BroadcastBurst},
+		{"multicast", sc.MulticastRate, sc.MulticastBurst},
+	} {
+		if (l.rate == 0) != (l.burst == 0) {
+			return fmt.Errorf("stormControl: %s rate and burst must be set together", l.name)
+		}
+		// the kernel takes them in bytes
+		if l.rate/8 > math.MaxUint32 || l.burst/8 > math.MaxUint32 {
+			return fmt.Errorf("stormControl: %s rate or burst too large", l.name)
+		}
+	}
+	return nil
+}
+
+// setupStormControl polices the broadcast and multicast frames the
+// container sends, i.e. the ones entering the host veth, dropping the ones
+// exceeding the limits.
+func setupStormControl(sc *StormControl, hostVeth netlink.Link) error {
+	if sc.isZero() {
+		return nil
+	}
+
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: hostVeth.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	if err := netlink.QdiscAdd(ingress); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return fmt.Errorf("failed to add ingress qdisc to %q: %v", hostVeth.Attrs().Name, err)
+	}
+
+	// at ingress, offsets are relative to the network header, the
+	// destination MAC starts 14 bytes before it
+	if sc.BroadcastRate != 0 {
+		keys := []netlink.TcU32Key{
+			{Mask: 0xffffffff, Val: 0xffffffff, Off: -14},
+			{Mask: 0xffff0000, Val: 0xffff0000, Off: -10},
+		}
+		if err := netlink.FilterAdd(stormFilter(hostVeth, keys, sc.BroadcastRate, sc.BroadcastBurst)); err != nil {
+			return fmt.Errorf("failed to add broadcast storm control filter to %q: %v", hostVeth.Attrs().Name, err)
+		}
+	}
+	if sc.MulticastRate != 0 {
+		keys := []netlink.TcU32Key{
+			{Mask: 0x01000000, Val: 0x01000000, Off: -14},
+		}
+		if err := netlink.FilterAdd(stormFilter(hostVeth, keys, sc.MulticastRate, sc.MulticastBurst)); err != nil {
+			return fmt.Errorf("failed to add multicast storm control filter to %q: %v", hostVeth.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// stormFilter drops the frames matching keys beyond the rate. Frames within
+// it continue to the next filter, e.g. the one of the bandwidth plugin.
+func stormFilter(hostVeth netlink.Link, keys []netlink.TcU32Key, rateInBits, burstInBits uint64) *netlink.U32 {
+	police := netlink.NewPoliceAction()
+	police.Rate = uint32(rateInBits / 8)
+	police.Burst = uint32(burstInBits / 8)
+	police.ExceedAction = netlink.TC_POLICE_SHOT
+	police.NotExceedAction = netlink.TC_POLICE_UNSPEC
+
+	return &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: hostVeth.Attrs().Index,
+			Parent:    netlink.MakeHandle(0xffff, 0),
+			Priority:  stormFilterPrio,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		Sel:     &netlink.TcU32Sel{Flags: netlink.TC_U32_TERMINAL, Keys: keys},
+		Actions: []netlink.Action{police},
+	}
+}
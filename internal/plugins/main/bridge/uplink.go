@@ -0,0 +1,243 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alexflint/go-filemutex"
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+)
+
+const defaultDataDir = "/run/cni/bridge"
+
+// uplinkState records what was moved from the uplink onto the bridge when
+// the uplink was attached, so it can be put back when it is detached.
+type uplinkState struct {
+	Uplink string `json:"uplink"`
+	ip.LinkConfig
+}
+
+func uplinkStatePath(n *NetConf) string {
+	return filepath.Join(n.DataDir, n.BrName+".uplink.json")
+}
+
+// lockBridge serializes changes to the shared bridge state across concurrent
+// plugin invocations. The returned function releases the lock.
+func lockBridge(n *NetConf) (func(), error) {
+	if err := os.MkdirAll(n.DataDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create data dir %q: %v", n.DataDir, err)
+	}
+	m, err := filemutex.New(filepath.Join(n.DataDir, n.BrName+".lock"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock for bridge %q: %v", n.BrName, err)
+	}
+	if err := m.Lock(); err != nil {
+		m.Close()
+		return nil, fmt.Errorf("failed to lock bridge %q: %v", n.BrName, err)
+	}
+	return func() {
+		m.Unlock()
+		m.Close()
+	}, nil
+}
+
+// attachUplink enslaves the configured uplink to the bridge, if it isn't
+// already. When uplinkMoveAddresses is set, the uplink's addresses and routes
+// are moved to the bridge so the host keeps its connectivity.
+func attachUplink(n *NetConf, br *netlink.Bridge) error {
+	if n.Uplink == "" {
+		return nil
+	}
+
+	unlock, err := lockBridge(n)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	uplink, err := netlink.LinkByName(n.Uplink)
+	if err != nil {
+		return fmt.Errorf("failed to lookup uplink %q: %v", n.Uplink, err)
+	}
+	if uplink.Attrs().MasterIndex == br.Attrs().Index {
+		return nil
+	}
+	if uplink.Attrs().MasterIndex != 0 {
+		return fmt.Errorf("uplink %q is already attached to another master", n.Uplink)
+	}
+	if _, isBridge := uplink.(*netlink.Bridge); isBridge {
+		return fmt.Errorf("uplink %q is a bridge", n.Uplink)
+	}
+
+	state := &uplinkState{Uplink: n.Uplink}
+	if n.UplinkMoveAddrs {
+		conf, err := ip.GetLinkConfig(uplink)
+		if err != nil {
+			return err
+		}
+		state.LinkConfig = *conf
+	}
+
+	// Write the state first, so a failure half way can still be undone by DEL
+	if err := writeUplinkState(n, state); err != nil {
+		return err
+	}
+
+	if err := netlink.LinkSetMaster(uplink, br); err != nil {
+		return fmt.Errorf("failed to attach uplink %q to bridge %q: %v", n.Uplink, n.BrName, err)
+	}
+	if err := netlink.LinkSetUp(uplink); err != nil {
+		return fmt.Errorf("failed to set uplink %q up: %v", n.Uplink, err)
+	}
+
+	if n.UplinkMoveAddrs {
+		// Keep the uplink's MAC on the bridge, so DHCP leases and port
+		// security on the upstream switch still match
+		if err := netlink.LinkSetHardwareAddr(br, uplink.Attrs().HardwareAddr); err != nil {
+			return fmt.Errorf("failed to set bridge %q mac: %v", n.BrName, err)
+		}
+		if err := ip.MoveLinkConfig(&state.LinkConfig, uplink, br); err != nil {
+			return fmt.Errorf("failed to move addresses from uplink %q to bridge %q: %v", n.Uplink, n.BrName, err)
+		}
+	}
+
+	return nil
+}
+
+// detachUplink releases the uplink from the bridge once no other ports are
+// left on it, restoring any addresses and routes that were moved. An uplink
+// which attachUplink found on the bridge already is left there.
+func detachUplink(n *NetConf) error {
+	if n.Uplink == "" {
+		return nil
+	}
+
+	unlock, err := lockBridge(n)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	br, err := bridgeByName(n.BrName)
+	if err != nil {
+		// nothing to detach from
+		return nil
+	}
+	uplink, err := netlink.LinkByName(n.Uplink)
+	if err != nil || uplink.Attrs().MasterIndex != br.Attrs().Index {
+		return removeUplinkState(n)
+	}
+
+	// only the attach recorded in the state file is undone
+	state, err := readUplinkState(n)
+	if err != nil {
+		return err
+	}
+	if state == nil || state.Uplink != n.Uplink {
+		return nil
+	}
+
+	ports, err := countBridgePorts(br, uplink)
+	if err != nil {
+		return err
+	}
+	if ports > 0 {
+		return nil
+	}
+
+	if err := netlink.LinkSetNoMaster(uplink); err != nil {
+		return fmt.Errorf("failed to detach uplink %q from bridge %q: %v", n.Uplink, n.BrName, err)
+	}
+	if err := ip.MoveLinkConfig(&state.LinkConfig, br, uplink); err != nil {
+		return fmt.Errorf("failed to restore addresses of uplink %q: %v", n.Uplink, err)
+	}
+
+	return removeUplinkState(n)
+}
+
+// countBridgePorts returns the number of ports on the bridge, not counting
+// the uplink itself, if any, and the host side of vlan gateway interfaces.
+func countBridgePorts(br *netlink.Bridge, uplink netlink.Link) (int, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list links: %v", err)
+	}
+
+	count := 0
+	for _, l := range links {
+		if l.Attrs().MasterIndex != br.Attrs().Index || (uplink != nil && l.Attrs().Index == uplink.Attrs().Index) {
+			continue
+		}
+		if isVlanGatewayPort(br, l) {
+			continue
+		}
+		count++
+	}
+	return count, nil
+}
+
+// isVlanGatewayPort reports whether the port is the bridge end of a
+// gateway veth created by ensureVlanInterface.
+func isVlanGatewayPort(br *netlink.Bridge, l netlink.Link) bool {
+	if _, isVeth := l.(*netlink.Veth); !isVeth {
+		return false
+	}
+	peerIndex, err := netlink.VethPeerIndex(l.(*netlink.Veth))
+	if err != nil {
+		return false
+	}
+	peer, err := netlink.LinkByIndex(peerIndex)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(peer.Attrs().Name, br.Attrs().Name+".")
+}
+
+func writeUplinkState(n *NetConf, s *uplinkState) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(uplinkStatePath(n), data, 0o600)
+}
+
+func readUplinkState(n *NetConf) (*uplinkState, error) {
+	data, err := os.ReadFile(uplinkStatePath(n))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &uplinkState{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse uplink state for bridge %q: %v", n.BrName, err)
+	}
+	return s, nil
+}
+
+func removeUplinkState(n *NetConf) error {
+	if err := os.Remove(uplinkStatePath(n)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// vrfUnreachableMetric is the metric of the unreachable default routes added
+// to the VRF table. It is high, so they only terminate lookups that nothing
+// else in the table matched instead of falling through to the main table.
+const vrfUnreachableMetric = math.MaxInt32
+
+// vrfState records whether the VRF was created by the plugin, so the last
+// DEL only deletes VRFs it owns.
+type vrfState struct {
+	VRF     string `json:"vrf"`
+	Table   uint32 `json:"table"`
+	Created bool   `json:"created,omitempty"`
+}
+
+func vrfStatePath(n *NetConf) string {
+	return filepath.Join(n.DataDir, n.BrName+".vrf.json")
+}
+
+// attachVRF places the bridge into the configured VRF, creating the VRF if
+// it doesn't exist. The connected routes of the bridge's gateway addresses
+// then go to the VRF table, so networks with overlapping subnets can share
+// a node. It must be called before gateway addresses are added to a new
+// bridge, as enslaving it drops its IPv6 addresses.
+func attachVRF(n *NetConf, br *netlink.Bridge) error {
+	if n.VRF == "" {
+		return nil
+	}
+
+	unlock, err := lockBridge(n)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	vrf, err := vrfByName(n.VRF)
+	if err != nil {
+		return err
+	}
+	if vrf != nil && br.Attrs().MasterIndex == vrf.Attrs().Index {
+		return nil
+	}
+	if br.Attrs().MasterIndex != 0 {
+		return fmt.Errorf("bridge %q is already attached to another master", n.BrName)
+	}
+
+	state := &vrfState{VRF: n.VRF}
+	if vrf == nil {
+		if vrf, err = createVRF(n.VRF, n.VRFTable); err != nil {
+			return err
+		}
+		state.Created = true
+	} else if n.VRFTable != 0 && vrf.Table != n.VRFTable {
+		return fmt.Errorf("VRF %q uses table %d, not %d", n.VRF, vrf.Table, n.VRFTable)
+	}
+	state.Table = vrf.Table
+
+	// Write the state first, so a failure half way can still be undone by DEL
+	if err := writeVRFState(n, state); err != nil {
+		return err
+	}
+
+	if err := netlink.LinkSetMaster(br, vrf); err != nil {
+		return fmt.Errorf("failed to attach bridge %q to VRF %q: %v", n.BrName, n.VRF, err)
+	}
+	for _, route := range vrfUnreachableRoutes(vrf.Table) {
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to add unreachable default route to VRF %q: %v", n.VRF, err)
+		}
+	}
+	return nil
+}
+
+// detachVRF takes the bridge out of its VRF once no ports are left on it.
+// The bridge's addresses are removed first, as their routes would otherwise
+// move to the main table and clash with the networks of other VRFs; the next
+// ADD adds them again. A VRF created by the plugin is deleted once it has no
+// members left.
+func detachVRF(n *NetConf) error {
+	if n.VRF == "" {
+		return nil
+	}
+
+	unlock, err := lockBridge(n)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := readVRFState(n)
+	if err != nil {
+		return err
+	}
+	vrf, err := vrfByName(n.VRF)
+	if err != nil {
+		return err
+	}
+	if vrf == nil {
+		return removeVRFState(n)
+	}
+
+	if br, err := bridgeByName(n.BrName); err == nil && br.Attrs().MasterIndex == vrf.Attrs().Index {
+		var uplink netlink.Link
+		if n.Uplink != "" {
+			uplink, _ = netlink.LinkByName(n.Uplink)
+		}
+		ports, err := countBridgePorts(br, uplink)
+		if err != nil {
+			return err
+		}
+		if ports > 0 {
+			return nil
+		}
+
+		addrs, err := netlink.AddrList(br, netlink.FAMILY_ALL)
+		if err != nil {
+			return fmt.Errorf("failed to list addresses of bridge %q: %v", n.BrName, err)
+		}
+		for _, addr := range addrs {
+			if addr.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if err := netlink.AddrDel(br, &addr); err != nil {
+				return fmt.Errorf("failed to remove address %s from bridge %q: %v", addr.IPNet, n.BrName, err)
+			}
+		}
+		if err := netlink.LinkSetNoMaster(br); err != nil {
+			return fmt.Errorf("failed to detach bridge %q from VRF %q: %v", n.BrName, n.VRF, err)
+		}
+	}
+
+	if state == nil || !state.Created {
+		return removeVRFState(n)
+	}
+	members, err := vrfMembers(vrf)
+	if err != nil {
+		return err
+	}
+	if members > 0 {
+		return removeVRFState(n)
+	}
+	for _, route := range vrfUnreachableRoutes(vrf.Table) {
+		if err := netlink.RouteDel(route); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("failed to remove unreachable default route of VRF %q: %v", n.VRF, err)
+		}
+	}
+	if err := netlink.LinkDel(vrf); err != nil {
+		return fmt.Errorf("failed to delete VRF %q: %v", n.VRF, err)
+	}
+	return removeVRFState(n)
+}
+
+// vrfByName returns the VRF, or nil if there is no link of that name.
+func vrfByName(name string) (*netlink.Vrf, error) {
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to lookup VRF %q: %v", name, err)
+	}
+	vrf, ok := l.(*netlink.Vrf)
+	if !ok {
+		return nil, fmt.Errorf("%s already exists but is not a VRF", name)
+	}
+	return vrf, nil
+}
+
+// createVRF creates and sets up a VRF. A table of 0 picks the lowest one not
+// used by another VRF.
+func createVRF(name string, table uint32) (*netlink.Vrf, error) {
+	if table == 0 {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list links: %v", err)
+		}
+		taken := map[uint32]bool{}
+		for _, l := range links {
+			if vrf, ok := l.(*netlink.Vrf); ok {
+				taken[vrf.Table] = true
+			}
+		}
+		table = 1
+		for taken[table] {
+			if table == math.MaxUint32 {
+				return nil, fmt.Errorf("failed to find a free routing table for VRF %q", name)
+			}
+			table++
+		}
+	}
+
+	vrf := &netlink.Vrf{
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+		Table:     table,
+	}
+	if err := netlink.LinkAdd(vrf); err != nil {
+		return nil, fmt.Errorf("failed to create VRF %q: %v", name, err)
+	}
+	if err := netlink.LinkSetUp(vrf); err != nil {
+		return nil, fmt.Errorf("failed to set VRF %q up: %v", name, err)
+	}
+	return vrf, nil
+}
+
+func vrfMembers(vrf *netlink.Vrf) (int, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list links: %v", err)
+	}
+	count := 0
+	for _, l := range links {
+		if l.Attrs().MasterIndex == vrf.Attrs().Index {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func vrfUnreachableRoutes(table uint32) []*netlink.Route {
+	routes := []*netlink.Route{}
+	for _, dst := range []string{"0.0.0.0/0", "::/0"} {
+		_, ipn, _ := net.ParseCIDR(dst)
+		routes = append(routes, &netlink.Route{
+			Dst:      ipn,
+			Table:    int(table),
+			Type:     unix.RTN_UNREACHABLE,
+			Priority: vrfUnreachableMetric,
+		})
+	}
+	return routes
+}
+
+func readVRFState(n *NetConf) (*vrfState, error) {
+	data, err := os.ReadFile(vrfStatePath(n))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VRF state: %v", err)
+	}
+	state := &vrfState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse VRF state: %v", err)
+	}
+	return state, nil
+}
+
+func writeVRFState(n *NetConf, state *vrfState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(vrfStatePath(n), data, 0o644); err != nil {
+		return fmt.Errorf("failed to write VRF state: %v", err)
+	}
+	return nil
+}
+
+func removeVRFState(n *NetConf) error {
+	if err := os.Remove(vrfStatePath(n)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove VRF state: %v", err)
+	}
+	return nil
+}
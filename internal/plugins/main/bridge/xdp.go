@@ -0,0 +1,156 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bridge
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"unsafe"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+const (
+	xdpModeGeneric = "generic"
+	xdpModeNative  = "native"
+)
+
+// XDP attaches an XDP program to the host side veth of each container,
+// e.g. to forward the hairpin traffic of edge caches on a fast path. The
+// program is loaded and pinned in the BPF filesystem by whoever provides
+// it; the plugin only attaches it.
+type XDP struct {
+	// Program is the path of the pinned program, e.g. /sys/fs/bpf/hairpin
+	Program string `json:"program"`
+	// Mode is "generic", the default, or "native", which falls back to
+	// generic if the driver doesn't support it
+	Mode string `json:"mode,omitempty"`
+	// Required fails ADD if the program can't be attached, instead of
+	// leaving the port on the regular path
+	Required bool `json:"required,omitempty"`
+}
+
+func (x *XDP) validate() error {
+	if x == nil {
+		return nil
+	}
+	if !filepath.IsAbs(x.Program) {
+		return fmt.Errorf("xdp program must be an absolute path, got %q", x.Program)
+	}
+	switch x.Mode {
+	case "", xdpModeGeneric, xdpModeNative:
+	default:
+		return fmt.Errorf("invalid xdp mode %q, must be %q or %q", x.Mode, xdpModeGeneric, xdpModeNative)
+	}
+	return nil
+}
+
+// bpfObjGetAttr is the BPF_OBJ_GET part of union bpf_attr.
+type bpfObjGetAttr struct {
+	pathname  uint64
+	bpfFd     uint32
+	fileFlags uint32
+}
+
+// openPinned returns a file descriptor of the BPF object pinned at path.
+func openPinned(path string) (int, error) {
+	p, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return -1, err
+	}
+	attr := bpfObjGetAttr{pathname: uint64(uintptr(unsafe.Pointer(p)))}
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_OBJ_GET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	runtime.KeepAlive(p)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// setupXDP attaches the program to the host veth. Unless it is required,
+// a failure is logged and the port carries on without it.
+func setupXDP(x *XDP, hostVeth netlink.Link) error {
+	if x == nil {
+		return nil
+	}
+	err := attachXDP(x, hostVeth)
+	if err != nil && !x.Required {
+		fmt.Fprintf(os.Stderr, "bridge: not attaching xdp program %q to %q: %v\n", x.Program, hostVeth.Attrs().Name, err)
+		return nil
+	}
+	return err
+}
+
+func attachXDP(x *XDP, hostVeth netlink.Link) error {
+	fd, err := openPinned(x.Program)
+	if err != nil {
+		return fmt.Errorf("failed to open xdp program %q: %v", x.Program, err)
+	}
+	defer unix.Close(fd)
+
+	if x.Mode == xdpModeNative {
+		err := netlink.LinkSetXdpFdWithFlags(hostVeth, fd, nl.XDP_FLAGS_DRV_MODE)
+		if err == nil {
+			return nil
+		}
+		fmt.Fprintf(os.Stderr, "bridge: falling back to generic xdp on %q: %v\n", hostVeth.Attrs().Name, err)
+	}
+	if err := netlink.LinkSetXdpFdWithFlags(hostVeth, fd, nl.XDP_FLAGS_SKB_MODE); err != nil {
+		return fmt.Errorf("failed to attach xdp program %q to %q: %v", x.Program, hostVeth.Attrs().Name, err)
+	}
+	return nil
+}
+
+// teardownXDP detaches the program from the host veth of the container's
+// interface, before the veth pair is deleted. It is best effort: the
+// program goes with the veth anyway.
+func teardownXDP(x *XDP, netnsPath, ifName string) {
+	if x == nil {
+		return
+	}
+	peerIndex := 0
+	_ = ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		l, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return err
+		}
+		veth, ok := l.(*netlink.Veth)
+		if !ok {
+			return nil
+		}
+		peerIndex, err = netlink.VethPeerIndex(veth)
+		return err
+	})
+	if peerIndex == 0 {
+		return
+	}
+	hostVeth, err := netlink.LinkByIndex(peerIndex)
+	if err != nil || hostVeth.Attrs().Xdp == nil || !hostVeth.Attrs().Xdp.Attached {
+		return
+	}
+	flags := nl.XDP_FLAGS_SKB_MODE
+	if hostVeth.Attrs().Xdp.AttachMode == nl.XDP_ATTACHED_DRV {
+		flags = nl.XDP_FLAGS_DRV_MODE
+	}
+	if err := netlink.LinkSetXdpFdWithFlags(hostVeth, -1, flags); err != nil {
+		fmt.Fprintf(os.Stderr, "bridge: failed to detach xdp program from %q: %v\n", hostVeth.Attrs().Name, err)
+	}
+}
@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package dummy
 
 import (
 	"encoding/json"
@@ -26,6 +26,9 @@ import (
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/include"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
@@ -34,6 +37,9 @@ import (
 
 func parseNetConf(bytes []byte) (*types.NetConf, error) {
 	conf := &types.NetConf{}
+	if err := config.Validate(bytes, conf); err != nil {
+		return nil, fmt.Errorf("invalid network configuration: %v", err)
+	}
 	if err := json.Unmarshal(bytes, conf); err != nil {
 		return nil, fmt.Errorf("failed to parse network config: %v", err)
 	}
@@ -86,7 +92,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", netns, err)
+		return ns.OpenError(args.Netns, err)
 	}
 	defer netns.Close()
 
@@ -180,8 +186,9 @@ func cmdDel(args *skel.CmdArgs) error {
 	return nil
 }
 
-func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("dummy"))
+// Main runs the dummy plugin.
+func Main() {
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}), version.All, bv.BuildString("dummy"))
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
@@ -196,7 +203,7 @@ func cmdCheck(args *skel.CmdArgs) error {
 
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+		return ns.OpenError(args.Netns, err)
 	}
 	defer netns.Close()
 
@@ -0,0 +1,333 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostdevice
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+var (
+	sysClassNet  = "/sys/class/net"
+	udevDataPath = "/run/udev/data"
+)
+
+// DeviceSelector selects one of several devices moved into the container
+// by a single invocation, and the name it gets there.
+type DeviceSelector struct {
+	Device     string `json:"device,omitempty"`
+	HWAddr     string `json:"hwaddr,omitempty"`
+	KernelPath string `json:"kernelpath,omitempty"`
+	PCIAddr    string `json:"pciBusID,omitempty"`
+	// Udev selects the only device whose udev properties, e.g. ID_PATH,
+	// match all the given shell patterns
+	Udev map[string]string `json:"udev,omitempty"`
+	// IfName is the name of the device in the container. It defaults to
+	// the runtime's interface name for the first device and is required
+	// for all others.
+	IfName string `json:"ifName,omitempty"`
+	// Queues configures the queues of the device
+	Queues *Queues `json:"queues,omitempty"`
+}
+
+// hostDevice is a device found on the host, and the name it gets in the
+// container.
+type hostDevice struct {
+	link   netlink.Link
+	ifName string
+	queues *Queues
+}
+
+func (s *DeviceSelector) validate() error {
+	set := 0
+	for _, v := range []string{s.Device, s.HWAddr, s.KernelPath, s.PCIAddr} {
+		if v != "" {
+			set++
+		}
+	}
+	if len(s.Udev) > 0 {
+		set++
+	}
+	if set != 1 {
+		return fmt.Errorf(`specify exactly one of "device", "hwaddr", "kernelpath", "pciBusID" or "udev" per device`)
+	}
+	for key, pattern := range s.Udev {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid udev pattern %q for %s: %v", pattern, key, err)
+		}
+	}
+	if err := s.Queues.validate(); err != nil {
+		return err
+	}
+	if s.PCIAddr != "" {
+		dpdk, err := hasDpdkDriver(s.PCIAddr)
+		if err != nil {
+			return fmt.Errorf("error with host device: %v", err)
+		}
+		if dpdk {
+			return fmt.Errorf("device %s is bound to a DPDK driver, which \"devices\" doesn't support", s.PCIAddr)
+		}
+	}
+	return nil
+}
+
+// validateDevices checks the selectors of "devices" and names them in the
+// container.
+func validateDevices(n *NetConf) error {
+	if n.Device != "" || n.HWAddr != "" || n.KernelPath != "" || n.PCIAddr != "" {
+		return fmt.Errorf(`specify either "devices" or a single device`)
+	}
+	if n.RuntimeConfig.DeviceID != "" {
+		return fmt.Errorf(`runtimeConfig deviceID can't be combined with "devices"`)
+	}
+	names := map[string]bool{}
+	for i := range n.Devices {
+		sel := &n.Devices[i]
+		if err := sel.validate(); err != nil {
+			return err
+		}
+		if sel.IfName == "" && i > 0 {
+			return fmt.Errorf("device %d is missing an ifName", i)
+		}
+		if sel.IfName != "" {
+			if names[sel.IfName] {
+				return fmt.Errorf("duplicate device ifName %q", sel.IfName)
+			}
+			names[sel.IfName] = true
+		}
+	}
+	return nil
+}
+
+// containerNames returns the names of the devices in the container, the
+// first one falling back to the runtime's interface name.
+func containerNames(n *NetConf, ifName string) []string {
+	if len(n.Devices) == 0 {
+		return []string{ifName}
+	}
+	names := make([]string, 0, len(n.Devices))
+	for _, sel := range n.Devices {
+		if sel.IfName == "" {
+			names = append(names, ifName)
+		} else {
+			names = append(names, sel.IfName)
+		}
+	}
+	return names
+}
+
+// findDevices resolves all configured devices before any of them is moved,
+// so a missing one fails the ADD without touching the others.
+func findDevices(n *NetConf, ifName string) ([]hostDevice, error) {
+	names := containerNames(n, ifName)
+	if len(n.Devices) == 0 {
+		hostDev, err := getLink(n.Device, n.HWAddr, n.KernelPath, n.PCIAddr)
+		if err != nil {
+			return nil, err
+		}
+		return []hostDevice{{link: hostDev, ifName: names[0], queues: n.Queues}}, nil
+	}
+
+	devs := make([]hostDevice, 0, len(n.Devices))
+	seen := map[int]int{}
+	for i, sel := range n.Devices {
+		var hostDev netlink.Link
+		var err error
+		if len(sel.Udev) > 0 {
+			hostDev, err = getLinkByUdev(sel.Udev)
+		} else {
+			hostDev, err = getLink(sel.Device, sel.HWAddr, sel.KernelPath, sel.PCIAddr)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("device %d: %v", i, err)
+		}
+		if j, ok := seen[hostDev.Attrs().Index]; ok {
+			return nil, fmt.Errorf("devices %d and %d both select %q", j, i, hostDev.Attrs().Name)
+		}
+		seen[hostDev.Attrs().Index] = i
+		devs = append(devs, hostDevice{link: hostDev, ifName: names[i], queues: sel.Queues})
+	}
+	return devs, nil
+}
+
+// getLinkByUdev returns the only link whose udev properties match.
+func getLinkByUdev(match map[string]string) (netlink.Link, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list node links: %v", err)
+	}
+	var found []netlink.Link
+	for _, l := range links {
+		props := udevProperties(l.Attrs().Name, l.Attrs().Index)
+		if udevMatches(props, match) {
+			found = append(found, l)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("no device matches udev properties %v", match)
+	case 1:
+		return found[0], nil
+	default:
+		return nil, fmt.Errorf("%d devices match udev properties %v, the match must select one", len(found), match)
+	}
+}
+
+func udevMatches(props, match map[string]string) bool {
+	for key, pattern := range match {
+		value, ok := props[key]
+		if !ok {
+			return false
+		}
+		if ok, _ := filepath.Match(pattern, value); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// udevProperties collects the properties of a network device from the
+// kernel's uevent files and, where udev runs, from its database.
+func udevProperties(name string, index int) map[string]string {
+	props := map[string]string{}
+	readProperties(filepath.Join(sysClassNet, name, "device", "uevent"), "", props)
+	readProperties(filepath.Join(sysClassNet, name, "uevent"), "", props)
+	readProperties(filepath.Join(udevDataPath, fmt.Sprintf("n%d", index)), "E:", props)
+	return props
+}
+
+// readProperties adds the KEY=VALUE lines of a file, with the prefix
+// stripped, to props. Missing files are skipped.
+func readProperties(path, prefix string, props map[string]string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, prefix), "=")
+		if ok {
+			props[key] = value
+		}
+	}
+}
+
+// moveDevicesIn moves all devices into the container and configures their
+// queues, moving the ones already moved back out if one fails. The queue
+// settings are left as they are on DEL.
+func moveDevicesIn(devs []hostDevice, containerNs ns.NetNS) ([]netlink.Link, error) {
+	contDevs := make([]netlink.Link, 0, len(devs))
+	rollback := func() {
+		for _, moved := range contDevs {
+			_, _ = moveLinkOut(containerNs, moved.Attrs().Name)
+		}
+	}
+	for _, dev := range devs {
+		name := dev.link.Attrs().Name
+		devicePath, err := dev.queues.prepare(name)
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		contDev, err := moveLinkIn(dev.link, containerNs, dev.ifName)
+		if err != nil {
+			rollback()
+			return nil, fmt.Errorf("failed to move link %v", err)
+		}
+		contDevs = append(contDevs, contDev)
+		if err := dev.queues.pinIRQs(name, devicePath); err != nil {
+			rollback()
+			return nil, err
+		}
+	}
+	return contDevs, nil
+}
+
+// moveDevicesOut returns every device to the host, carrying on past the
+// ones failing, and returns the host names of the devices it moved.
+// Devices already gone from the container are skipped, so DEL can be
+// retried.
+func moveDevicesOut(containerNs ns.NetNS, names []string) ([]string, error) {
+	var hostNames []string
+	var errs []error
+	for _, name := range names {
+		if len(names) > 1 && !linkExistsIn(containerNs, name) {
+			continue
+		}
+		hostName, err := moveLinkOut(containerNs, name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		hostNames = append(hostNames, hostName)
+	}
+	return hostNames, errors.Join(errs...)
+}
+
+// renameReturnedDevices gives the devices the kernel returned to the host
+// when their netns went away their original names back, which moveLinkIn
+// kept in their alias, and returns those names. A device is left alone when
+// another one has taken its original name in the meantime.
+func renameReturnedDevices(names []string) ([]string, error) {
+	var hostNames []string
+	var errs []error
+	for _, name := range names {
+		dev, err := netlink.LinkByName(name)
+		if err != nil {
+			continue
+		}
+		alias := dev.Attrs().Alias
+		if alias == "" || alias == name {
+			continue
+		}
+		hostNames = append(hostNames, alias)
+		if _, err := netlink.LinkByName(alias); err == nil {
+			continue
+		}
+		// Devices can be renamed only when down
+		if err := netlink.LinkSetDown(dev); err != nil {
+			errs = append(errs, fmt.Errorf("failed to set %q down: %v", name, err))
+			continue
+		}
+		if err := netlink.LinkSetName(dev, alias); err != nil {
+			errs = append(errs, fmt.Errorf("failed to restore %q to original name %q: %v", name, alias, err))
+		}
+	}
+	return hostNames, errors.Join(errs...)
+}
+
+func linkExistsIn(containerNs ns.NetNS, name string) bool {
+	exists := false
+	_ = containerNs.Do(func(_ ns.NetNS) error {
+		_, err := netlink.LinkByName(name)
+		exists = err == nil
+		return nil
+	})
+	return exists
+}
@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package hostdevice
 
 import (
 	"bytes"
@@ -31,8 +31,12 @@ import (
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/include"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/link"
 	"github.com/containernetworking/plugins/pkg/ns"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 )
@@ -45,11 +49,17 @@ var userspaceDrivers = []string{"vfio-pci", "uio_pci_generic", "igb_uio"}
 // NetConf for host-device config, look the README to learn how to use those parameters
 type NetConf struct {
 	types.NetConf
-	Device        string `json:"device"` // Device-Name, something like eth0 or can0 etc.
-	HWAddr        string `json:"hwaddr"` // MAC Address of target network interface
-	DPDKMode      bool
-	KernelPath    string `json:"kernelpath"` // Kernelpath of the device
-	PCIAddr       string `json:"pciBusID"`   // PCI Address of target network device
+	Device     string `json:"device"` // Device-Name, something like eth0 or can0 etc.
+	HWAddr     string `json:"hwaddr"` // MAC Address of target network interface
+	DPDKMode   bool
+	KernelPath string `json:"kernelpath"`                   // Kernelpath of the device
+	PCIAddr    string `json:"pciBusID"`                     // PCI Address of target network device
+	Ownership  string `json:"interfaceOwnership,omitempty"` // Protection from host network managers
+	// Devices moves several devices into the container at once, instead
+	// of the single one selected above
+	Devices []DeviceSelector `json:"devices,omitempty"`
+	// Queues configures the queues of the single device
+	Queues        *Queues `json:"queues,omitempty"`
 	RuntimeConfig struct {
 		DeviceID string `json:"deviceID,omitempty"`
 	} `json:"runtimeConfig,omitempty"`
@@ -65,24 +75,44 @@ func init() {
 func loadConf(bytes []byte) (*NetConf, error) {
 	n := &NetConf{}
 	var err error
+	if err := config.Validate(bytes, n); err != nil {
+		return nil, fmt.Errorf("invalid network configuration: %v", err)
+	}
 	if err = json.Unmarshal(bytes, n); err != nil {
 		return nil, fmt.Errorf("failed to load netconf: %v", err)
 	}
 
-	if n.RuntimeConfig.DeviceID != "" {
+	if err := n.Queues.validate(); err != nil {
+		return nil, err
+	}
+	if len(n.Devices) > 0 {
+		if n.Queues != nil {
+			return nil, fmt.Errorf(`specify "queues" per device with "devices"`)
+		}
+		if err := validateDevices(n); err != nil {
+			return nil, err
+		}
+	} else if n.RuntimeConfig.DeviceID != "" {
 		// Override PCI device with the standardized DeviceID provided in Runtime Config.
 		n.PCIAddr = n.RuntimeConfig.DeviceID
 	}
 
-	if n.Device == "" && n.HWAddr == "" && n.KernelPath == "" && n.PCIAddr == "" {
+	if len(n.Devices) == 0 && n.Device == "" && n.HWAddr == "" && n.KernelPath == "" && n.PCIAddr == "" {
 		return nil, fmt.Errorf(`specify either "device", "hwaddr", "kernelpath" or "pciBusID"`)
 	}
 
+	if err := link.ValidateOwnership(n.Ownership); err != nil {
+		return nil, err
+	}
+
 	if len(n.PCIAddr) > 0 {
 		n.DPDKMode, err = hasDpdkDriver(n.PCIAddr)
 		if err != nil {
 			return nil, fmt.Errorf("error with host device: %v", err)
 		}
+		if n.DPDKMode && n.Queues != nil {
+			return nil, fmt.Errorf("queues of device %s can't be configured, it is bound to a DPDK driver", n.PCIAddr)
+		}
 	}
 
 	return n, nil
@@ -95,35 +125,49 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	containerNs, err := ns.GetNS(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+		return ns.OpenError(args.Netns, err)
 	}
 	defer containerNs.Close()
 
 	result := &current.Result{}
-	var contDev netlink.Link
+	var contDevs []netlink.Link
 	if !cfg.DPDKMode {
-		hostDev, err := getLink(cfg.Device, cfg.HWAddr, cfg.KernelPath, cfg.PCIAddr)
+		hostDevs, err := findDevices(cfg, args.IfName)
 		if err != nil {
 			return fmt.Errorf("failed to find host device: %v", err)
 		}
 
-		contDev, err = moveLinkIn(hostDev, containerNs, args.IfName)
+		// A network manager still holding the device will try to bring it
+		// back. The markers go on DEL, when the device is returned.
+		for _, hostDev := range hostDevs {
+			if err := link.MarkUnmanaged(cfg.Ownership, hostDev.link.Attrs().Name); err != nil {
+				return err
+			}
+			if err := link.VerifyUnmanaged(cfg.Ownership, hostDev.link.Attrs().Name, hostDev.link.Attrs().Index); err != nil {
+				return err
+			}
+		}
+
+		contDevs, err = moveDevicesIn(hostDevs, containerNs)
 		if err != nil {
-			return fmt.Errorf("failed to move link %v", err)
+			return err
 		}
 
-		result.Interfaces = []*current.Interface{{
-			Name:    contDev.Attrs().Name,
-			Mac:     contDev.Attrs().HardwareAddr.String(),
-			Sandbox: containerNs.Path(),
-		}}
+		for _, contDev := range contDevs {
+			result.Interfaces = append(result.Interfaces, &current.Interface{
+				Name:    contDev.Attrs().Name,
+				Mac:     contDev.Attrs().HardwareAddr.String(),
+				Sandbox: containerNs.Path(),
+			})
+		}
 	}
 
 	if cfg.IPAM.Type == "" {
 		if cfg.DPDKMode {
 			return types.PrintResult(result, cfg.CNIVersion)
 		}
-		return printLink(contDev, cfg.CNIVersion, containerNs)
+		result.CNIVersion = current.ImplementedSpecVersion
+		return types.PrintResult(result, cfg.CNIVersion)
 	}
 
 	// run the IPAM plugin and get back the config to apply
@@ -150,7 +194,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 
 	for _, ipc := range newResult.IPs {
-		// All addresses apply to the container interface (move from host)
+		// All addresses apply to the first container interface (move from host)
 		ipc.Interface = current.Int(0)
 	}
 
@@ -158,14 +202,14 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	if !cfg.DPDKMode {
 		err = containerNs.Do(func(_ ns.NetNS) error {
-			return ipam.ConfigureIface(args.IfName, newResult)
+			return ipam.ConfigureIface(contDevs[0].Attrs().Name, newResult)
 		})
 		if err != nil {
 			return err
 		}
 	}
 
-	newResult.DNS = cfg.DNS
+	newResult.DNS = ipam.ResultDNS(newResult.DNS, cfg.DNS)
 
 	return types.PrintResult(newResult, cfg.CNIVersion)
 }
@@ -180,9 +224,10 @@ func cmdDel(args *skel.CmdArgs) error {
 	}
 	containerNs, err := ns.GetNS(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+		if _, ok := err.(ns.NSPathNotExistErr); !ok {
+			return ns.OpenError(args.Netns, err)
+		}
 	}
-	defer containerNs.Close()
 
 	if cfg.IPAM.Type != "" {
 		if err := ipam.ExecDel(cfg.IPAM.Type, args.StdinData); err != nil {
@@ -190,13 +235,30 @@ func cmdDel(args *skel.CmdArgs) error {
 		}
 	}
 
-	if !cfg.DPDKMode {
-		if err := moveLinkOut(containerNs, args.IfName); err != nil {
-			return err
+	if cfg.DPDKMode {
+		if containerNs != nil {
+			containerNs.Close()
 		}
+		return nil
 	}
 
-	return nil
+	var hostNames []string
+	if containerNs == nil {
+		// The kernel has returned the devices to the host along with the
+		// netns, under their names in the container.
+		hostNames, err = renameReturnedDevices(containerNames(cfg, args.IfName))
+	} else {
+		defer containerNs.Close()
+		hostNames, err = moveDevicesOut(containerNs, containerNames(cfg, args.IfName))
+	}
+
+	// The devices are the host's again, so are its network managers
+	for _, name := range hostNames {
+		if uerr := link.UnmarkUnmanaged(cfg.Ownership, name); uerr != nil {
+			err = errors.Join(err, uerr)
+		}
+	}
+	return err
 }
 
 func moveLinkIn(hostDev netlink.Link, containerNs ns.NetNS, ifName string) (netlink.Link, error) {
@@ -240,14 +302,17 @@ func moveLinkIn(hostDev netlink.Link, containerNs ns.NetNS, ifName string) (netl
 	return contDev, nil
 }
 
-func moveLinkOut(containerNs ns.NetNS, ifName string) error {
+// moveLinkOut returns the device to the host under its original name, and
+// returns that name.
+func moveLinkOut(containerNs ns.NetNS, ifName string) (string, error) {
 	defaultNs, err := ns.GetCurrentNS()
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer defaultNs.Close()
 
-	return containerNs.Do(func(_ ns.NetNS) error {
+	var hostName string
+	err = containerNs.Do(func(_ ns.NetNS) error {
 		dev, err := netlink.LinkByName(ifName)
 		if err != nil {
 			return fmt.Errorf("failed to find %q: %v", ifName, err)
@@ -277,8 +342,10 @@ func moveLinkOut(containerNs ns.NetNS, ifName string) error {
 		if err = netlink.LinkSetNsFd(dev, int(defaultNs.Fd())); err != nil {
 			return fmt.Errorf("failed to move %q to host netns: %v", dev.Attrs().Alias, err)
 		}
+		hostName = dev.Attrs().Alias
 		return nil
 	})
+	return hostName, err
 }
 
 func hasDpdkDriver(pciaddr string) (bool, error) {
@@ -300,20 +367,6 @@ func hasDpdkDriver(pciaddr string) (bool, error) {
 	return false, nil
 }
 
-func printLink(dev netlink.Link, cniVersion string, containerNs ns.NetNS) error {
-	result := current.Result{
-		CNIVersion: current.ImplementedSpecVersion,
-		Interfaces: []*current.Interface{
-			{
-				Name:    dev.Attrs().Name,
-				Mac:     dev.Attrs().HardwareAddr.String(),
-				Sandbox: containerNs.Path(),
-			},
-		},
-	}
-	return types.PrintResult(&result, cniVersion)
-}
-
 func getLink(devname, hwaddr, kernelpath, pciaddr string) (netlink.Link, error) {
 	links, err := netlink.LinkList()
 	if err != nil {
@@ -376,8 +429,9 @@ func getLink(devname, hwaddr, kernelpath, pciaddr string) (netlink.Link, error)
 	return nil, fmt.Errorf("failed to find physical interface")
 }
 
-func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("host-device"))
+// Main runs the host-device plugin.
+func Main() {
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}), version.All, bv.BuildString("host-device"))
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
@@ -387,7 +441,7 @@ func cmdCheck(args *skel.CmdArgs) error {
 	}
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+		return ns.OpenError(args.Netns, err)
 	}
 	defer netns.Close()
 
@@ -417,33 +471,40 @@ func cmdCheck(args *skel.CmdArgs) error {
 		return nil
 	}
 
-	var contMap current.Interface
-	// Find interfaces for name we know, that of host-device inside container
-	for _, intf := range result.Interfaces {
-		if args.IfName == intf.Name {
-			if args.Netns == intf.Sandbox {
-				contMap = *intf
-				continue
+	names := containerNames(cfg, args.IfName)
+	contMaps := make([]current.Interface, 0, len(names))
+	// Find interfaces for names we know, those of host-device inside container
+	for _, name := range names {
+		var contMap current.Interface
+		for _, intf := range result.Interfaces {
+			if name == intf.Name {
+				if args.Netns == intf.Sandbox {
+					contMap = *intf
+					continue
+				}
 			}
 		}
-	}
 
-	// The namespace must be the same as what was configured
-	if args.Netns != contMap.Sandbox {
-		return fmt.Errorf("Sandbox in prevResult %s doesn't match configured netns: %s",
-			contMap.Sandbox, args.Netns)
+		// The namespace must be the same as what was configured
+		if args.Netns != contMap.Sandbox {
+			return fmt.Errorf("Sandbox in prevResult %s doesn't match configured netns: %s",
+				contMap.Sandbox, args.Netns)
+		}
+		contMaps = append(contMaps, contMap)
 	}
 
 	//
 	// Check prevResults for ips, routes and dns against values found in the container
 	if err := netns.Do(func(_ ns.NetNS) error {
-		// Check interface against values found in the container
-		err := validateCniContainerInterface(contMap)
-		if err != nil {
-			return err
+		// Check interfaces against values found in the container
+		for _, contMap := range contMaps {
+			if err := validateCniContainerInterface(contMap); err != nil {
+				return err
+			}
 		}
 
-		err = ip.ValidateExpectedInterfaceIPs(args.IfName, result.IPs)
+		// IPAM only configures the first interface
+		err := ip.ValidateExpectedInterfaceIPs(names[0], result.IPs)
 		if err != nil {
 			return err
 		}
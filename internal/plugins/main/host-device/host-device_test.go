@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package hostdevice
 
 import (
 	"encoding/json"
@@ -32,6 +32,7 @@ import (
 	types040 "github.com/containernetworking/cni/pkg/types/040"
 	types100 "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
+	cnierrors "github.com/containernetworking/plugins/pkg/errors"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/testutils"
 )
@@ -1152,6 +1153,389 @@ var _ = Describe("base functionality", func() {
 	}
 })
 
+var _ = Describe("when the netns is gone", func() {
+	var originalNS ns.NetNS
+
+	BeforeEach(func() {
+		var err error
+		originalNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(originalNS)).To(Succeed())
+	})
+
+	It("gives the devices the kernel returned their names back on DEL and reports it on CHECK", func() {
+		conf := `{
+			"cniVersion": "1.0.0",
+			"name": "cni-plugin-host-device-test",
+			"type": "host-device",
+			"device": "hostdev0"
+		}`
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       "/var/run/netns/gone",
+			IfName:      "net1",
+			StdinData:   []byte(conf),
+		}
+		_ = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			// the device is back under its name in the container
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "net1"},
+				PeerName:  "net1-peer",
+			})).To(Succeed())
+			link, err := netlink.LinkByName("net1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetAlias(link, "hostdev0")).To(Succeed())
+
+			Expect(testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) })).To(Succeed())
+			_, err = netlink.LinkByName("hostdev0")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = netlink.LinkByName("net1")
+			Expect(err).To(HaveOccurred())
+
+			err = testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })
+			Expect(cnierrors.KindOf(err)).To(Equal(cnierrors.KindNetNSGone))
+			return nil
+		})
+	})
+})
+
+var _ = Describe("multiple devices", func() {
+	var originalNS, targetNS ns.NetNS
+	var udevDir string
+
+	BeforeEach(func() {
+		var err error
+		originalNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		targetNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		udevDir, err = os.MkdirTemp("", "host-device-udev")
+		Expect(err).NotTo(HaveOccurred())
+		udevDataPath = udevDir
+
+		// two veth pairs stand in for physical devices
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			for _, name := range []string{"uplink0", "uplink1"} {
+				Expect(netlink.LinkAdd(&netlink.Veth{
+					LinkAttrs: netlink.LinkAttrs{Name: name},
+					PeerName:  name + "-peer",
+				})).To(Succeed())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(udevDir)).To(Succeed())
+		udevDataPath = "/run/udev/data"
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(originalNS)).To(Succeed())
+		Expect(targetNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(targetNS)).To(Succeed())
+	})
+
+	writeUdevData := func(name, content string) {
+		_ = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName(name)
+			Expect(err).NotTo(HaveOccurred())
+			path := path.Join(udevDir, fmt.Sprintf("n%d", link.Attrs().Index))
+			Expect(os.WriteFile(path, []byte(content), 0o644)).To(Succeed())
+			return nil
+		})
+	}
+
+	linkExists := func(netns ns.NetNS, name string) bool {
+		exists := false
+		_ = netns.Do(func(ns.NetNS) error {
+			_, err := netlink.LinkByName(name)
+			exists = err == nil
+			return nil
+		})
+		return exists
+	}
+
+	It("moves all devices in with their names, checks and restores them", func() {
+		writeUdevData("uplink1", "I:123\nE:ID_PATH=pci-0000:03:00.1\nE:ID_NET_DRIVER=ixgbe\n")
+		conf := `{
+			"cniVersion": "1.0.0",
+			"name": "cni-plugin-host-device-test",
+			"type": "host-device",
+			"devices": [
+				{"device": "uplink0"},
+				{"udev": {"ID_PATH": "pci-0000:03:00.*"}, "ifName": "data1"}
+			]
+		}`
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      "net1",
+			StdinData:   []byte(conf),
+		}
+		var resI types.Result
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			var err error
+			resI, _, err = testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) })
+			return err
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		result, err := types100.GetResult(resI)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Interfaces).To(HaveLen(2))
+		Expect(result.Interfaces[0].Name).To(Equal("net1"))
+		Expect(result.Interfaces[1].Name).To(Equal("data1"))
+		for _, intf := range result.Interfaces {
+			Expect(intf.Sandbox).To(Equal(targetNS.Path()))
+			Expect(linkExists(targetNS, intf.Name)).To(BeTrue())
+		}
+		Expect(linkExists(originalNS, "uplink0")).To(BeFalse())
+		Expect(linkExists(originalNS, "uplink1")).To(BeFalse())
+
+		// CHECK verifies every device
+		prevResult, err := json.Marshal(result)
+		Expect(err).NotTo(HaveOccurred())
+		args.StdinData = []byte(strings.TrimSuffix(strings.TrimSpace(conf), "}") +
+			`, "prevResult": ` + string(prevResult) + `}`)
+		err = originalNS.Do(func(ns.NetNS) error {
+			return testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// a device gone from the container fails the CHECK
+		_ = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName("data1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetDown(link)).To(Succeed())
+			Expect(netlink.LinkSetName(link, "data1-gone")).To(Succeed())
+			return nil
+		})
+		err = originalNS.Do(func(ns.NetNS) error {
+			return testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })
+		})
+		Expect(err).To(MatchError(ContainSubstring("data1")))
+
+		// DEL restores the devices still there, and is retried until all are
+		err = originalNS.Do(func(ns.NetNS) error {
+			return testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) })
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(linkExists(originalNS, "uplink0")).To(BeTrue())
+		Expect(linkExists(targetNS, "data1-gone")).To(BeTrue())
+	})
+
+	It("marks the devices unmanaged while they are in the container", func() {
+		markers := []string{
+			"/run/udev/rules.d/90-cni-uplink0.rules",
+			"/run/systemd/network/90-cni-uplink0.network",
+		}
+		conf := `{
+			"cniVersion": "1.0.0",
+			"name": "cni-plugin-host-device-test",
+			"type": "host-device",
+			"device": "uplink0",
+			"interfaceOwnership": "mark"
+		}`
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      "net1",
+			StdinData:   []byte(conf),
+		}
+		err := originalNS.Do(func(ns.NetNS) error {
+			_, _, err := testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) })
+			return err
+		})
+		Expect(err).NotTo(HaveOccurred())
+		for _, marker := range markers {
+			Expect(marker).To(BeAnExistingFile())
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			return testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) })
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(linkExists(originalNS, "uplink0")).To(BeTrue())
+		for _, marker := range markers {
+			Expect(marker).NotTo(BeAnExistingFile())
+		}
+	})
+
+	It("moves the devices already moved back when one fails", func() {
+		// the name of the second device is taken in the container
+		_ = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "data1"},
+				PeerName:  "data1-peer",
+			})).To(Succeed())
+			return nil
+		})
+		conf := `{
+			"cniVersion": "1.0.0",
+			"name": "cni-plugin-host-device-test",
+			"type": "host-device",
+			"devices": [
+				{"device": "uplink0"},
+				{"device": "uplink1", "ifName": "data1"}
+			]
+		}`
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      "net1",
+			StdinData:   []byte(conf),
+		}
+		err := originalNS.Do(func(ns.NetNS) error {
+			_, _, err := testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) })
+			return err
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(linkExists(originalNS, "uplink0")).To(BeTrue())
+		Expect(linkExists(targetNS, "net1")).To(BeFalse())
+	})
+
+	It("fails when a udev match is ambiguous", func() {
+		writeUdevData("uplink0", "E:ID_NET_DRIVER=ixgbe\n")
+		writeUdevData("uplink1", "E:ID_NET_DRIVER=ixgbe\n")
+		conf := `{
+			"cniVersion": "1.0.0",
+			"name": "cni-plugin-host-device-test",
+			"type": "host-device",
+			"devices": [{"udev": {"ID_NET_DRIVER": "ixgbe"}}]
+		}`
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      "net1",
+			StdinData:   []byte(conf),
+		}
+		err := originalNS.Do(func(ns.NetNS) error {
+			_, _, err := testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) })
+			return err
+		})
+		Expect(err).To(MatchError(ContainSubstring("2 devices match udev properties")))
+		Expect(linkExists(originalNS, "uplink0")).To(BeTrue())
+	})
+
+	DescribeTable("rejects invalid device lists",
+		func(devices, extra, expected string) {
+			conf := `{
+				"cniVersion": "1.0.0",
+				"name": "cni-plugin-host-device-test",
+				"type": "host-device",
+				` + extra + `
+				"devices": ` + devices + `
+			}`
+			_, err := loadConf([]byte(conf))
+			Expect(err).To(MatchError(ContainSubstring(expected)))
+		},
+		Entry("mixed with a single device", `[{"device": "eth1"}]`, `"device": "eth0",`, `specify either "devices" or a single device`),
+		Entry("no selector", `[{"ifName": "net1"}]`, ``, `specify exactly one of`),
+		Entry("two selectors", `[{"device": "eth1", "hwaddr": "00:11:22:33:44:55"}]`, ``, `specify exactly one of`),
+		Entry("missing ifName", `[{"device": "eth1"}, {"device": "eth2"}]`, ``, `device 1 is missing an ifName`),
+		Entry("duplicate ifName", `[{"device": "eth1", "ifName": "a"}, {"device": "eth2", "ifName": "a"}]`, ``, `duplicate device ifName "a"`),
+		Entry("bad udev pattern", `[{"udev": {"ID_PATH": "["}}]`, ``, `invalid udev pattern`),
+		Entry("bad queue cpus", `[{"device": "eth1", "queues": {"cpus": "3-1"}}]`, ``, `invalid queues cpus "3-1"`),
+		Entry("queues of all devices", `[{"device": "eth1"}]`, `"queues": {"cpus": "1"},`, `specify "queues" per device`),
+	)
+
+	Context("with queues", func() {
+		var fakeRoot string
+
+		BeforeEach(func() {
+			var err error
+			fakeRoot, err = os.MkdirTemp("", "host-device-queues")
+			Expect(err).NotTo(HaveOccurred())
+			sysClassNet = path.Join(fakeRoot, "sys/class/net")
+			procIRQ = path.Join(fakeRoot, "proc/irq")
+
+			// uplink0 is a bus device with three MSI IRQs, uplink1 has none
+			for i, name := range []string{"uplink0", "uplink1"} {
+				device := path.Join(fakeRoot, "sys/devices", fmt.Sprintf("0000:03:00.%d", i))
+				Expect(os.MkdirAll(device, 0o755)).To(Succeed())
+				Expect(os.MkdirAll(path.Join(sysClassNet, name), 0o755)).To(Succeed())
+				Expect(os.Symlink(device, path.Join(sysClassNet, name, "device"))).To(Succeed())
+			}
+			for _, irq := range []string{"41", "40", "112"} {
+				Expect(os.MkdirAll(path.Join(fakeRoot, "sys/devices/0000:03:00.0/msi_irqs", irq), 0o755)).To(Succeed())
+				Expect(os.MkdirAll(path.Join(procIRQ, irq), 0o755)).To(Succeed())
+			}
+		})
+
+		AfterEach(func() {
+			sysClassNet = "/sys/class/net"
+			procIRQ = "/proc/irq"
+			Expect(os.RemoveAll(fakeRoot)).To(Succeed())
+		})
+
+		addDevices := func(devices string) error {
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      "net1",
+				StdinData: []byte(`{
+					"cniVersion": "1.0.0",
+					"name": "cni-plugin-host-device-test",
+					"type": "host-device",
+					"devices": ` + devices + `
+				}`),
+			}
+			return originalNS.Do(func(ns.NetNS) error {
+				_, _, err := testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) })
+				return err
+			})
+		}
+
+		It("pins the IRQs of a device to its CPUs round robin", func() {
+			Expect(addDevices(`[{"device": "uplink0", "queues": {"cpus": "2-3"}}, {"device": "uplink1", "ifName": "data1"}]`)).To(Succeed())
+			for irq, cpu := range map[string]string{"40": "2", "41": "3", "112": "2"} {
+				data, err := os.ReadFile(path.Join(procIRQ, irq, "smp_affinity_list"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).To(Equal(cpu), "IRQ %s", irq)
+			}
+			Expect(linkExists(targetNS, "net1")).To(BeTrue())
+			Expect(linkExists(targetNS, "data1")).To(BeTrue())
+		})
+
+		It("moves the devices back when a device has no IRQs to pin", func() {
+			err := addDevices(`[{"device": "uplink0"}, {"device": "uplink1", "ifName": "data1", "queues": {"cpus": "1"}}]`)
+			Expect(err).To(MatchError(ContainSubstring(`"uplink1" has no MSI IRQs to pin`)))
+			Expect(linkExists(originalNS, "uplink0")).To(BeTrue())
+			Expect(linkExists(originalNS, "uplink1")).To(BeTrue())
+			Expect(linkExists(targetNS, "net1")).To(BeFalse())
+		})
+	})
+})
+
+var _ = DescribeTable("parseCPUSet",
+	func(cpuset string, expected []int, expectedErr string) {
+		cpus, err := parseCPUSet(cpuset)
+		if expectedErr != "" {
+			Expect(err).To(MatchError(ContainSubstring(expectedErr)))
+			return
+		}
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cpus).To(Equal(expected))
+	},
+	Entry("single CPU", "3", []int{3}, ""),
+	Entry("ranges and CPUs", "2-4, 8,0-1", []int{2, 3, 4, 8, 0, 1}, ""),
+	Entry("overlapping ranges", "1-3,2-4", []int{1, 2, 3, 4}, ""),
+	Entry("empty", "", nil, `invalid CPU ""`),
+	Entry("reversed range", "4-2", nil, `invalid CPU range "4-2"`),
+	Entry("not a CPU", "a", nil, `invalid CPU "a"`),
+)
+
 type fakeFilesystem struct {
 	rootDir  string
 	dirs     []string
@@ -0,0 +1,181 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostdevice
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/safchain/ethtool"
+)
+
+var procIRQ = "/proc/irq"
+
+// Queues configures the queues of a device moved into the container, so
+// latency-critical pods get predictable packet processing without a
+// privileged tuning container. The settings stay when the device is
+// returned to the host.
+type Queues struct {
+	// Combined, RX and TX set the channel counts of the device, as
+	// "ethtool -L" does
+	Combined uint32 `json:"combined,omitempty"`
+	RX       uint32 `json:"rx,omitempty"`
+	TX       uint32 `json:"tx,omitempty"`
+	// CPUs is a cpuset, e.g. "2-5,8". The IRQs of the device are pinned
+	// to its CPUs round robin, irqbalance must leave them alone.
+	CPUs string `json:"cpus,omitempty"`
+
+	cpus []int
+}
+
+func (q *Queues) validate() error {
+	if q == nil || q.CPUs == "" {
+		return nil
+	}
+	cpus, err := parseCPUSet(q.CPUs)
+	if err != nil {
+		return fmt.Errorf("invalid queues cpus %q: %v", q.CPUs, err)
+	}
+	q.cpus = cpus
+	return nil
+}
+
+// parseCPUSet returns the CPUs of a cpuset in the kernel's list format.
+func parseCPUSet(s string) ([]int, error) {
+	seen := map[int]bool{}
+	var cpus []int
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		lo, err := strconv.Atoi(first)
+		if err != nil || lo < 0 {
+			return nil, fmt.Errorf("invalid CPU %q", first)
+		}
+		hi := lo
+		if isRange {
+			if hi, err = strconv.Atoi(last); err != nil || hi < lo {
+				return nil, fmt.Errorf("invalid CPU range %q", part)
+			}
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			if !seen[cpu] {
+				seen[cpu] = true
+				cpus = append(cpus, cpu)
+			}
+		}
+	}
+	return cpus, nil
+}
+
+// setChannels sets the channel counts of the device. It must be called on
+// the host, where the ethtool ioctls find the device by name, and before
+// the IRQs are pinned, as new channels get new IRQs.
+func (q *Queues) setChannels(name string) error {
+	if q == nil || (q.Combined == 0 && q.RX == 0 && q.TX == 0) {
+		return nil
+	}
+	e, err := ethtool.NewEthtool()
+	if err != nil {
+		return fmt.Errorf("failed to initialize ethtool: %v", err)
+	}
+	defer e.Close()
+
+	channels, err := e.GetChannels(name)
+	if err != nil {
+		return fmt.Errorf("failed to get channels of %q: %v", name, err)
+	}
+	for _, c := range []struct {
+		kind      string
+		want, max uint32
+		count     *uint32
+	}{
+		{"combined", q.Combined, channels.MaxCombined, &channels.CombinedCount},
+		{"rx", q.RX, channels.MaxRx, &channels.RxCount},
+		{"tx", q.TX, channels.MaxTx, &channels.TxCount},
+	} {
+		if c.want == 0 {
+			continue
+		}
+		if c.want > c.max {
+			return fmt.Errorf("%q supports at most %d %s channels", name, c.max, c.kind)
+		}
+		*c.count = c.want
+	}
+	if _, err := e.SetChannels(name, channels); err != nil {
+		return fmt.Errorf("failed to set channels of %q: %v", name, err)
+	}
+	return nil
+}
+
+// prepare applies the channel counts and returns the path of the bus
+// device, the IRQs of which are pinned once the link is up in the container.
+// It must be called while the link is still on the host.
+func (q *Queues) prepare(name string) (string, error) {
+	if q == nil {
+		return "", nil
+	}
+	if err := q.setChannels(name); err != nil {
+		return "", err
+	}
+	if len(q.cpus) == 0 {
+		return "", nil
+	}
+	devicePath, err := filepath.EvalSymlinks(filepath.Join(sysClassNet, name, "device"))
+	if err != nil {
+		return "", fmt.Errorf("%q is not a bus device, its IRQs can't be pinned: %v", name, err)
+	}
+	return devicePath, nil
+}
+
+// pinIRQs pins the MSI IRQs of the bus device to the CPUs of the queues,
+// round robin. Drivers may allocate them only when the link comes up.
+func (q *Queues) pinIRQs(name, devicePath string) error {
+	if q == nil || len(q.cpus) == 0 {
+		return nil
+	}
+	irqs, err := deviceIRQs(devicePath)
+	if err != nil {
+		return fmt.Errorf("failed to list IRQs of %q: %v", name, err)
+	}
+	if len(irqs) == 0 {
+		return fmt.Errorf("%q has no MSI IRQs to pin", name)
+	}
+	for i, irq := range irqs {
+		cpu := strconv.Itoa(q.cpus[i%len(q.cpus)])
+		path := filepath.Join(procIRQ, strconv.Itoa(irq), "smp_affinity_list")
+		if err := os.WriteFile(path, []byte(cpu), 0o644); err != nil {
+			return fmt.Errorf("failed to pin IRQ %d of %q to CPU %s: %v", irq, name, cpu, err)
+		}
+	}
+	return nil
+}
+
+func deviceIRQs(devicePath string) ([]int, error) {
+	entries, err := os.ReadDir(filepath.Join(devicePath, "msi_irqs"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	irqs := make([]int, 0, len(entries))
+	for _, e := range entries {
+		if irq, err := strconv.Atoi(e.Name()); err == nil {
+			irqs = append(irqs, irq)
+		}
+	}
+	sort.Ints(irqs)
+	return irqs, nil
+}
@@ -12,13 +12,16 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package ipvlan
 
 import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"os"
 	"runtime"
+	"time"
 
 	"github.com/vishvananda/netlink"
 
@@ -26,19 +29,46 @@ import (
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/dhcpinform"
+	"github.com/containernetworking/plugins/pkg/include"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/link"
 	"github.com/containernetworking/plugins/pkg/ns"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 )
 
+// routerDiscoveryTimeout bounds the wait for the default route with
+// ipv6RouterDiscovery
+const routerDiscoveryTimeout = 10 * time.Second
+
 type NetConf struct {
 	types.NetConf
 	Master     string `json:"master"`
 	Mode       string `json:"mode"`
 	MTU        int    `json:"mtu"`
 	LinkContNs bool   `json:"linkInContainer,omitempty"`
+	// DHCPInform announces the container's addresses to the DHCP helpers
+	// of the parent network
+	DHCPInform *dhcpinform.Config `json:"dhcpInform,omitempty"`
+	// MasterWait is how long to wait for the master to appear and come up,
+	// for NICs that are enumerated late on boot
+	MasterWait string `json:"masterWait,omitempty"`
+	// PodSysctls are set in the pod before the ipvlan comes up
+	PodSysctls *sysctl.Bundle `json:"podSysctls,omitempty"`
+	// ProxyARP and ProxyNDP make the master answer for the pod's addresses
+	// in l3 and l3s mode, so devices on its LAN reach the pod without a
+	// route to it
+	ProxyARP bool `json:"proxyARP,omitempty"`
+	ProxyNDP bool `json:"proxyNDP,omitempty"`
+	// IPv6RouterDiscovery solicits routers at ADD, and waits for the
+	// default route learned from their advertisements
+	IPv6RouterDiscovery bool `json:"ipv6RouterDiscovery,omitempty"`
+
+	masterWait time.Duration
 }
 
 func init() {
@@ -50,16 +80,47 @@ func init() {
 
 func loadConf(args *skel.CmdArgs, cmdCheck bool) (*NetConf, string, error) {
 	n := &NetConf{}
+	if err := config.Validate(args.StdinData, n); err != nil {
+		return nil, "", fmt.Errorf("invalid network configuration: %v", err)
+	}
 	if err := json.Unmarshal(args.StdinData, n); err != nil {
 		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
 	}
+	if n.DHCPInform != nil {
+		if err := n.DHCPInform.Validate(); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := n.PodSysctls.Validate(); err != nil {
+		return nil, "", err
+	}
+	if n.IPv6RouterDiscovery {
+		// routers' multicast doesn't reach l3 ipvlans
+		if n.Mode == "l3" || n.Mode == "l3s" {
+			return nil, "", errors.New("ipv6RouterDiscovery requires l2 mode")
+		}
+		if n.PodSysctls.IgnoresRouterAdvertisements() {
+			return nil, "", errors.New("ipv6RouterDiscovery can't be combined with podSysctls ignoring router advertisements")
+		}
+	}
+	if n.ProxyARP || n.ProxyNDP {
+		if n.Mode != "l3" && n.Mode != "l3s" {
+			return nil, "", errors.New("proxyARP and proxyNDP require l3 or l3s mode")
+		}
+		if n.LinkContNs {
+			return nil, "", errors.New("proxyARP and proxyNDP can't be combined with linkInContainer")
+		}
+	}
+	var err error
+	if n.masterWait, err = link.ParseWait("masterWait", n.MasterWait); err != nil {
+		return nil, "", err
+	}
 
 	if cmdCheck {
 		return n, n.CNIVersion, nil
 	}
 
 	var result *current.Result
-	var err error
 	// Parse previous result
 	if n.NetConf.RawPrevResult != nil {
 		if err = version.ParsePrevResult(&n.NetConf); err != nil {
@@ -90,6 +151,30 @@ func loadConf(args *skel.CmdArgs, cmdCheck bool) (*NetConf, string, error) {
 	return n, n.CNIVersion, nil
 }
 
+func (n *NetConf) proxyNeighbors() *ip.ProxyNeighbors {
+	return &ip.ProxyNeighbors{ARP: n.ProxyARP, NDP: n.ProxyNDP, Interfaces: []string{n.Master}}
+}
+
+// delAddrs returns the addresses to stop proxying on DEL: the ones of the
+// deleted ipvlan, or those of the previous result when it is gone already.
+func delAddrs(n *NetConf, ipnets []*net.IPNet) []net.IP {
+	var addrs []net.IP
+	for _, ipn := range ipnets {
+		addrs = append(addrs, ipn.IP)
+	}
+	if len(addrs) > 0 || n.PrevResult == nil {
+		return addrs
+	}
+	result, err := current.NewResultFromResult(n.PrevResult)
+	if err != nil {
+		return nil
+	}
+	for _, ipc := range result.IPs {
+		addrs = append(addrs, ipc.Address.IP)
+	}
+	return addrs
+}
+
 func modeFromString(s string) (netlink.IPVlanMode, error) {
 	switch s {
 	case "", "l2":
@@ -127,11 +212,11 @@ func createIpvlan(conf *NetConf, ifName string, netns ns.NetNS) (*current.Interf
 	var m netlink.Link
 	if conf.LinkContNs {
 		err = netns.Do(func(_ ns.NetNS) error {
-			m, err = netlink.LinkByName(conf.Master)
+			m, err = link.WaitForLink(conf.Master, conf.masterWait)
 			return err
 		})
 	} else {
-		m, err = netlink.LinkByName(conf.Master)
+		m, err = link.WaitForLink(conf.Master, conf.masterWait)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to lookup master %q: %v", conf.Master, err)
@@ -238,7 +323,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+		return ns.OpenError(args.Netns, err)
 	}
 	defer netns.Close()
 
@@ -247,6 +332,15 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
+	// Before the link comes up, so e.g. no router advertisement is
+	// accepted against the bundle
+	err = netns.Do(func(_ ns.NetNS) error {
+		return n.PodSysctls.Apply(args.IfName)
+	})
+	if err != nil {
+		return err
+	}
+
 	var result *current.Result
 	// Configure iface from PrevResult if we have IPs and an IPAM
 	// block has not been configured
@@ -295,13 +389,44 @@ func cmdAdd(args *skel.CmdArgs) error {
 		_, _ = sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/arp_notify", args.IfName), "1")
 		_, _ = sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/ndisc_notify", args.IfName), "1")
 
-		return ipam.ConfigureIface(args.IfName, result)
+		if err := ipam.ConfigureIface(args.IfName, result); err != nil {
+			return err
+		}
+		// upstream learns the address sooner, but works without
+		if n.DHCPInform != nil {
+			if err := n.DHCPInform.Send(args.IfName, result.IPs); err != nil {
+				fmt.Fprintf(os.Stderr, "ipvlan: %v\n", err)
+			}
+		}
+		return nil
 	})
 	if err != nil {
 		return err
 	}
 
-	result.DNS = n.DNS
+	if n.IPv6RouterDiscovery {
+		err = netns.Do(func(_ ns.NetNS) error {
+			_, err := ip.SolicitRouter(args.IfName, routerDiscoveryTimeout)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if proxy := n.proxyNeighbors(); proxy.Enabled() {
+		var addrs []net.IP
+		for _, ipc := range result.IPs {
+			addrs = append(addrs, ipc.Address.IP)
+		}
+		tx := sysctl.NewTx()
+		if err = proxy.Setup(tx, addrs); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	result.DNS = ipam.ResultDNS(result.DNS, n.DNS)
 
 	return types.PrintResult(result, cniVersion)
 }
@@ -321,19 +446,24 @@ func cmdDel(args *skel.CmdArgs) error {
 	}
 
 	if args.Netns == "" {
-		return nil
+		return n.proxyNeighbors().Teardown(delAddrs(n, nil))
 	}
 
 	// There is a netns so try to clean up. Delete can be called multiple times
 	// so don't return an error if the device is already removed.
+	var ipnets []*net.IPNet
 	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
-		if err := ip.DelLinkByName(args.IfName); err != nil {
-			if err != ip.ErrLinkNotFound {
-				return err
-			}
+		ipnets, err = ip.DelLinkByNameAddr(args.IfName)
+		if err != nil && err != ip.ErrLinkNotFound {
+			return err
 		}
 		return nil
 	})
+	if proxy := n.proxyNeighbors(); proxy.Enabled() {
+		if err := proxy.Teardown(delAddrs(n, ipnets)); err != nil {
+			return err
+		}
+	}
 
 	if err != nil {
 		//  if NetNs is passed down by the Cloud Orchestration Engine, or if it called multiple times
@@ -349,8 +479,9 @@ func cmdDel(args *skel.CmdArgs) error {
 	return err
 }
 
-func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("ipvlan"))
+// Main runs the ipvlan plugin.
+func Main() {
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}), version.All, bv.BuildString("ipvlan"))
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
@@ -360,7 +491,7 @@ func cmdCheck(args *skel.CmdArgs) error {
 	}
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+		return ns.OpenError(args.Netns, err)
 	}
 	defer netns.Close()
 
@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package ipvlan
 
 import (
 	"encoding/json"
@@ -33,6 +33,7 @@ import (
 	types100 "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
 )
 
@@ -495,4 +496,88 @@ var _ = Describe("ipvlan Operations", func() {
 			})
 		}
 	}
+
+	It("proxies the pod's addresses on the master in l3 mode", func() {
+		conf := fmt.Sprintf(`{
+		    "cniVersion": "1.0.0",
+		    "name": "mynet",
+		    "type": "ipvlan",
+		    "master": "%s",
+		    "mode": "l3",
+		    "proxyARP": true,
+		    "ipam": {
+			"type": "host-local",
+			"subnet": "10.1.2.0/24",
+			"dataDir": "%s"
+		    }
+		}`, MASTER_NAME, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      "ipvl0",
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(1))
+
+			master, err := netlink.LinkByName(MASTER_NAME)
+			Expect(err).NotTo(HaveOccurred())
+			proxies, err := netlink.NeighProxyList(master.Attrs().Index, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(proxies).To(HaveLen(1))
+			Expect(proxies[0].IP.Equal(result.IPs[0].Address.IP)).To(BeTrue())
+			Expect(sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/proxy_arp", MASTER_NAME))).To(Equal("1"))
+
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+
+			proxies, err = netlink.NeighProxyList(master.Attrs().Index, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(proxies).To(BeEmpty())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects proxyARP in l2 mode", func() {
+		conf := fmt.Sprintf(`{
+		    "cniVersion": "1.0.0",
+		    "name": "mynet",
+		    "type": "ipvlan",
+		    "master": "%s",
+		    "proxyARP": true
+		}`, MASTER_NAME)
+
+		_, _, err := loadConf(&skel.CmdArgs{StdinData: []byte(conf)}, false)
+		Expect(err).To(MatchError("proxyARP and proxyNDP require l3 or l3s mode"))
+	})
+
+	It("rejects ipv6RouterDiscovery where routers' advertisements aren't taken", func() {
+		conf := func(extra string) string {
+			return fmt.Sprintf(`{
+			    "cniVersion": "1.0.0",
+			    "name": "mynet",
+			    "type": "ipvlan",
+			    "master": "%s",
+			    "ipv6RouterDiscovery": true,
+			    %s
+			}`, MASTER_NAME, extra)
+		}
+
+		_, _, err := loadConf(&skel.CmdArgs{StdinData: []byte(conf(`"mode": "l3"`))}, false)
+		Expect(err).To(MatchError("ipv6RouterDiscovery requires l2 mode"))
+		_, _, err = loadConf(&skel.CmdArgs{StdinData: []byte(conf(`"podSysctls": {"name": "no-ra"}`))}, false)
+		Expect(err).To(MatchError("ipv6RouterDiscovery can't be combined with podSysctls ignoring router advertisements"))
+	})
 })
@@ -0,0 +1,127 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package macvlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// defaultMacStoreDir survives reboots, unlike the data dir, as the
+	// MACs are kept for the upstream network
+	defaultMacStoreDir = "/var/lib/cni/macvlan"
+	// macRetention is how long the MAC of a pod is kept after its last
+	// DEL, for it to come back
+	macRetention = 30 * 24 * time.Hour
+)
+
+// macEntry is the MAC of a pod's macvlan.
+type macEntry struct {
+	MAC string `json:"mac"`
+	// Released is when the pod was last deleted, unset while it runs
+	Released *time.Time `json:"released,omitempty"`
+}
+
+// macStore is the MACs of the pods of a network, by "namespace/name". It is
+// shared by all invocations of the plugin on the node.
+type macStore map[string]*macEntry
+
+func macStorePath(n *NetConf) string {
+	return filepath.Join(n.MacStoreDir, n.Name+".macs.json")
+}
+
+// withMacStore runs fn with the locked store of the network and writes the
+// store back if fn changed it.
+func withMacStore(n *NetConf, fn func(store macStore) bool) error {
+	unlock, err := lockFile(n.MacStoreDir, n.Name+".macs")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	store := macStore{}
+	data, err := os.ReadFile(macStorePath(n))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read MAC store: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &store); err != nil {
+			return fmt.Errorf("failed to parse MAC store: %v", err)
+		}
+	}
+	if !fn(store) {
+		return nil
+	}
+
+	store.prune(time.Now())
+	if data, err = json.Marshal(store); err != nil {
+		return err
+	}
+	// written through a temporary file, a torn store would lose all MACs
+	tmp := macStorePath(n) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write MAC store: %v", err)
+	}
+	if err := os.Rename(tmp, macStorePath(n)); err != nil {
+		return fmt.Errorf("failed to write MAC store: %v", err)
+	}
+	return nil
+}
+
+// prune forgets the pods released longer than macRetention ago.
+func (s macStore) prune(now time.Time) {
+	for pod, e := range s {
+		if e.Released != nil && now.Sub(*e.Released) > macRetention {
+			delete(s, pod)
+		}
+	}
+}
+
+// storedMac returns the MAC the pod had before, or "" if there is none.
+func storedMac(n *NetConf) (string, error) {
+	mac := ""
+	err := withMacStore(n, func(store macStore) bool {
+		if e, ok := store[n.pod]; ok {
+			mac = e.MAC
+		}
+		return false
+	})
+	return mac, err
+}
+
+// storeMac records the MAC of the pod's macvlan.
+func storeMac(n *NetConf, mac string) error {
+	return withMacStore(n, func(store macStore) bool {
+		store[n.pod] = &macEntry{MAC: mac}
+		return true
+	})
+}
+
+// releaseMac starts the retention of the pod's MAC.
+func releaseMac(n *NetConf) error {
+	return withMacStore(n, func(store macStore) bool {
+		e, ok := store[n.pod]
+		if !ok || e.Released != nil {
+			return false
+		}
+		now := time.Now().UTC()
+		e.Released = &now
+		return true
+	})
+}
@@ -12,14 +12,16 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package macvlan
 
 import (
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
+	"os"
 	"runtime"
+	"time"
 
 	"github.com/vishvananda/netlink"
 
@@ -27,13 +29,23 @@ import (
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/cniargs"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/dhcpinform"
+	"github.com/containernetworking/plugins/pkg/include"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/link"
 	"github.com/containernetworking/plugins/pkg/ns"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 )
 
+// routerDiscoveryTimeout bounds the wait for the default route with
+// ipv6RouterDiscovery
+const routerDiscoveryTimeout = 10 * time.Second
+
 type NetConf struct {
 	types.NetConf
 	Master     string `json:"master"`
@@ -41,16 +53,33 @@ type NetConf struct {
 	MTU        int    `json:"mtu"`
 	Mac        string `json:"mac,omitempty"`
 	LinkContNs bool   `json:"linkInContainer,omitempty"`
-
-	RuntimeConfig struct {
-		Mac string `json:"mac,omitempty"`
-	} `json:"runtimeConfig,omitempty"`
-}
-
-// MacEnvArgs represents CNI_ARG
-type MacEnvArgs struct {
-	types.CommonArgs
-	MAC types.UnmarshallableString `json:"mac,omitempty"`
+	VlanID     int    `json:"vlanId,omitempty"`
+	DataDir    string `json:"dataDir,omitempty"`
+
+	InterfaceOwnership string `json:"interfaceOwnership,omitempty"`
+	// DHCPInform announces the container's addresses to the DHCP helpers
+	// of the parent network
+	DHCPInform *dhcpinform.Config `json:"dhcpInform,omitempty"`
+	// TakeoverAddrs moves the addresses and routes of the master onto the
+	// passthru macvlan, and back on DEL
+	TakeoverAddrs bool `json:"takeoverAddresses,omitempty"`
+	// MasterWait is how long to wait for the master to appear and come up,
+	// for NICs that are enumerated late on boot
+	MasterWait string `json:"masterWait,omitempty"`
+	// PersistMac gives the macvlan of a pod the MAC it had before, so
+	// port security and DHCP reservations keyed by MAC survive restarts
+	PersistMac bool `json:"persistMac,omitempty"`
+	// MacStoreDir is where the MACs of pods are kept
+	MacStoreDir string `json:"macStoreDir,omitempty"`
+	// PodSysctls are set in the pod before the macvlan comes up
+	PodSysctls *sysctl.Bundle `json:"podSysctls,omitempty"`
+	// IPv6RouterDiscovery solicits routers at ADD, and waits for the
+	// default route learned from their advertisements
+	IPv6RouterDiscovery bool `json:"ipv6RouterDiscovery,omitempty"`
+
+	masterWait time.Duration
+	// pod is "namespace/name" of the pod the MAC is kept for
+	pod string
 }
 
 func init() {
@@ -103,10 +132,41 @@ func getNamespacedDefaultRouteInterfaceName(namespace string, inContainer bool)
 }
 
 func loadConf(args *skel.CmdArgs, envArgs string) (*NetConf, string, error) {
-	n := &NetConf{}
+	n := &NetConf{
+		DataDir:     defaultDataDir,
+		MacStoreDir: defaultMacStoreDir,
+	}
+	if err := config.Validate(args.StdinData, n); err != nil {
+		return nil, "", fmt.Errorf("invalid network configuration: %v", err)
+	}
 	if err := json.Unmarshal(args.StdinData, n); err != nil {
 		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
 	}
+	if err := link.ValidateOwnership(n.InterfaceOwnership); err != nil {
+		return nil, "", err
+	}
+	if n.VlanID < 0 || n.VlanID > 4094 {
+		return nil, "", fmt.Errorf("invalid vlanId %d, must be [1, 4094]", n.VlanID)
+	}
+	if n.VlanID != 0 && n.LinkContNs {
+		return nil, "", fmt.Errorf("vlanId can't be combined with linkInContainer")
+	}
+	if err := validateTakeover(n); err != nil {
+		return nil, "", err
+	}
+	if n.PersistMac && n.Mode == "passthru" {
+		return nil, "", fmt.Errorf("persistMac can't be combined with passthru mode, which uses the master's MAC")
+	}
+	if err := n.PodSysctls.Validate(); err != nil {
+		return nil, "", err
+	}
+	if n.IPv6RouterDiscovery && n.PodSysctls.IgnoresRouterAdvertisements() {
+		return nil, "", fmt.Errorf("ipv6RouterDiscovery can't be combined with podSysctls ignoring router advertisements")
+	}
+	var err error
+	if n.masterWait, err = link.ParseWait("masterWait", n.MasterWait); err != nil {
+		return nil, "", err
+	}
 	if n.Master == "" {
 		defaultRouteInterface, err := getNamespacedDefaultRouteInterfaceName(args.Netns, n.LinkContNs)
 		if err != nil {
@@ -116,7 +176,7 @@ func loadConf(args *skel.CmdArgs, envArgs string) (*NetConf, string, error) {
 	}
 
 	// check existing and MTU of master interface
-	masterMTU, err := getMTUByName(n.Master, args.Netns, n.LinkContNs)
+	masterMTU, err := getMTUByName(n.Master, args.Netns, n.LinkContNs, n.masterWait)
 	if err != nil {
 		return nil, "", err
 	}
@@ -124,27 +184,28 @@ func loadConf(args *skel.CmdArgs, envArgs string) (*NetConf, string, error) {
 		return nil, "", fmt.Errorf("invalid MTU %d, must be [0, master MTU(%d)]", n.MTU, masterMTU)
 	}
 
-	if envArgs != "" {
-		e := MacEnvArgs{}
-		err := types.LoadArgs(envArgs, &e)
-		if err != nil {
-			return nil, "", err
-		}
-
-		if e.MAC != "" {
-			n.Mac = string(e.MAC)
-		}
+	a, err := cniargs.Parse(envArgs, args.StdinData)
+	if err != nil {
+		return nil, "", err
+	}
+	if mac := a.MAC(); mac != "" {
+		n.Mac = mac
+	}
+	if a.PodNamespace != "" && a.PodName != "" {
+		n.pod = a.PodNamespace + "/" + a.PodName
 	}
 
-	if n.RuntimeConfig.Mac != "" {
-		n.Mac = n.RuntimeConfig.Mac
+	if n.DHCPInform != nil {
+		if err := n.DHCPInform.Validate(); err != nil {
+			return nil, "", err
+		}
 	}
 
 	return n, n.CNIVersion, nil
 }
 
-func getMTUByName(ifName string, namespace string, inContainer bool) (int, error) {
-	var link netlink.Link
+func getMTUByName(ifName string, namespace string, inContainer bool, wait time.Duration) (int, error) {
+	var m netlink.Link
 	var err error
 	if inContainer {
 		var netns ns.NetNS
@@ -155,16 +216,16 @@ func getMTUByName(ifName string, namespace string, inContainer bool) (int, error
 		defer netns.Close()
 
 		err = netns.Do(func(_ ns.NetNS) error {
-			link, err = netlink.LinkByName(ifName)
+			m, err = link.WaitForLink(ifName, wait)
 			return err
 		})
 	} else {
-		link, err = netlink.LinkByName(ifName)
+		m, err = link.WaitForLink(ifName, wait)
 	}
 	if err != nil {
 		return 0, err
 	}
-	return link.Attrs().MTU, nil
+	return m.Attrs().MTU, nil
 }
 
 func modeFromString(s string) (netlink.MacvlanMode, error) {
@@ -218,6 +279,15 @@ func createMacvlan(conf *NetConf, ifName string, netns ns.NetNS) (*current.Inter
 		return nil, fmt.Errorf("failed to lookup master %q: %v", conf.Master, err)
 	}
 
+	// The macvlan itself is created straight into the container, so only the
+	// master can be reconfigured by a host network manager. Never mark the
+	// master unmanaged, it usually carries the host's own connectivity.
+	if !conf.LinkContNs {
+		if err := link.VerifyUnmanaged(conf.InterfaceOwnership, m.Attrs().Name, m.Attrs().Index); err != nil {
+			return nil, err
+		}
+	}
+
 	// due to kernel bug we have to create with tmpName or it might
 	// collide with the name on the host and error out
 	tmpName, err := ip.RandomVethName()
@@ -293,10 +363,51 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", netns, err)
+		return ns.OpenError(args.Netns, err)
 	}
 	defer netns.Close()
 
+	// the physical port, which IPAM may pin ranges to
+	port := n.Master
+
+	// Use a VLAN sub-interface of the master as the macvlan's parent, so the
+	// network maps to a VLAN trunked on the uplink
+	if n.VlanID != 0 {
+		var vlanIf string
+		vlanIf, err = acquireVlan(n, args.ContainerID, args.IfName)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				releaseVlan(n, args.ContainerID, args.IfName)
+			}
+		}()
+		n.Master = vlanIf
+	}
+
+	// A MAC requested for this attachment wins over the one the pod had
+	persistMac := n.PersistMac && n.pod != ""
+	if persistMac && n.Mac == "" {
+		if n.Mac, err = storedMac(n); err != nil {
+			return err
+		}
+	}
+
+	// Record the master's configuration before the macvlan takes it over
+	var takeover *takeoverState
+	if n.TakeoverAddrs {
+		takeover, err = takeOverMaster(n, args.ContainerID, args.IfName)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				_ = giveBack(n, args.ContainerID, args.IfName)
+			}
+		}()
+	}
+
 	macvlanInterface, err := createMacvlan(n, args.IfName, netns)
 	if err != nil {
 		return err
@@ -311,6 +422,15 @@ func cmdAdd(args *skel.CmdArgs) error {
 		}
 	}()
 
+	// Before the link comes up, so e.g. no router advertisement is
+	// accepted against the bundle
+	err = netns.Do(func(_ ns.NetNS) error {
+		return n.PodSysctls.Apply(args.IfName)
+	})
+	if err != nil {
+		return err
+	}
+
 	// Assume L2 interface only
 	result := &current.Result{
 		CNIVersion: current.ImplementedSpecVersion,
@@ -319,7 +439,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	if isLayer3 {
 		// run the IPAM plugin and get back the config to apply
-		r, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+		r, err := ipam.ExecAddOn(n.IPAM.Type, args.StdinData, n.VlanID, port)
 		if err != nil {
 			return err
 		}
@@ -353,7 +473,16 @@ func cmdAdd(args *skel.CmdArgs) error {
 			_, _ = sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/arp_notify", args.IfName), "1")
 			_, _ = sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/ndisc_notify", args.IfName), "1")
 
-			return ipam.ConfigureIface(args.IfName, result)
+			if err := ipam.ConfigureIface(args.IfName, result); err != nil {
+				return err
+			}
+			// upstream learns the address sooner, but works without
+			if n.DHCPInform != nil {
+				if err := n.DHCPInform.Send(args.IfName, result.IPs); err != nil {
+					fmt.Fprintf(os.Stderr, "macvlan: %v\n", err)
+				}
+			}
+			return nil
 		})
 		if err != nil {
 			return err
@@ -377,18 +506,55 @@ func cmdAdd(args *skel.CmdArgs) error {
 		}
 	}
 
-	result.DNS = n.DNS
+	if n.IPv6RouterDiscovery {
+		err = netns.Do(func(_ ns.NetNS) error {
+			_, err := ip.SolicitRouter(args.IfName, routerDiscoveryTimeout)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if takeover != nil {
+		if err = takeover.moveToContainer(netns, result); err != nil {
+			return fmt.Errorf("failed to take over the addresses of master %q: %v", n.Master, err)
+		}
+	}
+
+	if persistMac {
+		if err = storeMac(n, macvlanInterface.Mac); err != nil {
+			return err
+		}
+	}
+
+	result.DNS = ipam.ResultDNS(result.DNS, n.DNS)
 
 	return types.PrintResult(result, cniVersion)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
-	var n NetConf
+	n := NetConf{
+		DataDir:     defaultDataDir,
+		MacStoreDir: defaultMacStoreDir,
+	}
 	err := json.Unmarshal(args.StdinData, &n)
 	if err != nil {
 		return fmt.Errorf("failed to load netConf: %v", err)
 	}
 
+	// The MAC is kept for a while, for the pod to get it back when it
+	// is recreated
+	if n.PersistMac {
+		env, _ := cniargs.ParseEnv(args.Args)
+		if env[cniargs.KeyPodNamespace] != "" && env[cniargs.KeyPodName] != "" {
+			n.pod = env[cniargs.KeyPodNamespace] + "/" + env[cniargs.KeyPodName]
+			if err := releaseMac(&n); err != nil {
+				return err
+			}
+		}
+	}
+
 	isLayer3 := n.IPAM.Type != ""
 	if isLayer3 {
 		err = ipam.ExecDel(n.IPAM.Type, args.StdinData)
@@ -398,7 +564,7 @@ func cmdDel(args *skel.CmdArgs) error {
 	}
 
 	if args.Netns == "" {
-		return nil
+		return releaseMaster(&n, args)
 	}
 
 	// There is a netns so try to clean up. Delete can be called multiple times
@@ -418,16 +584,44 @@ func cmdDel(args *skel.CmdArgs) error {
 		// https://github.com/kubernetes/kubernetes/issues/43014#issuecomment-287164444
 		_, ok := err.(ns.NSPathNotExistErr)
 		if ok {
-			return nil
+			return releaseMaster(&n, args)
 		}
 		return err
 	}
 
-	return err
+	return releaseMaster(&n, args)
+}
+
+// releaseMaster gives back what the attachment took from the master, once
+// its macvlan is gone.
+func releaseMaster(n *NetConf, args *skel.CmdArgs) error {
+	if n.TakeoverAddrs {
+		if err := giveBack(n, args.ContainerID, args.IfName); err != nil {
+			return err
+		}
+	}
+	return delVlan(n, args)
+}
+
+// delVlan releases the attachment's use of the VLAN sub-interface, once its
+// macvlan is gone.
+func delVlan(n *NetConf, args *skel.CmdArgs) error {
+	if n.VlanID == 0 {
+		return nil
+	}
+	if n.Master == "" {
+		master, err := getDefaultRouteInterfaceName()
+		if err != nil {
+			return err
+		}
+		n.Master = master
+	}
+	return releaseVlan(n, args.ContainerID, args.IfName)
 }
 
-func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("macvlan"))
+// Main runs the macvlan plugin.
+func Main() {
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}), version.All, bv.BuildString("macvlan"))
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
@@ -439,7 +633,7 @@ func cmdCheck(args *skel.CmdArgs) error {
 
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+		return ns.OpenError(args.Netns, err)
 	}
 	defer netns.Close()
 
@@ -482,6 +676,9 @@ func cmdCheck(args *skel.CmdArgs) error {
 			contMap.Sandbox, args.Netns)
 	}
 
+	if n.VlanID != 0 {
+		n.Master = vlanIfName(n.Master, n.VlanID)
+	}
 	if n.LinkContNs {
 		err = netns.Do(func(_ ns.NetNS) error {
 			_, err = netlink.LinkByName(n.Master)
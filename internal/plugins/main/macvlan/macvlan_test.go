@@ -12,15 +12,17 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package macvlan
 
 import (
 	"encoding/json"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -882,4 +884,309 @@ var _ = Describe("macvlan Operations", func() {
 			})
 		}
 	}
+
+	It("creates a VLAN sub-interface of the master and deletes it with the last DEL", func() {
+		conf := fmt.Sprintf(`{
+		    "cniVersion": "1.0.0",
+		    "name": "mynet",
+		    "type": "macvlan",
+		    "master": "%s",
+		    "vlanId": 42,
+		    "dataDir": "%s"
+		}`, MASTER_NAME, dataDir)
+		vlanName := MASTER_NAME + ".42"
+
+		argsA := &skel.CmdArgs{
+			ContainerID: "a",
+			Netns:       targetNS.Path(),
+			IfName:      "macvl0",
+			StdinData:   []byte(conf),
+		}
+		argsB := &skel.CmdArgs{
+			ContainerID: "b",
+			Netns:       targetNS.Path(),
+			IfName:      "macvl1",
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			for _, args := range []*skel.CmdArgs{argsA, argsB} {
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			master, err := netlink.LinkByName(MASTER_NAME)
+			Expect(err).NotTo(HaveOccurred())
+			l, err := netlink.LinkByName(vlanName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(l).To(BeAssignableToTypeOf(&netlink.Vlan{}))
+			Expect(l.(*netlink.Vlan).VlanId).To(Equal(42))
+			Expect(l.Attrs().ParentIndex).To(Equal(master.Attrs().Index))
+
+			Expect(testutils.CmdDelWithArgs(argsA, func() error {
+				return cmdDel(argsA)
+			})).To(Succeed())
+			_, err = netlink.LinkByName(vlanName)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(testutils.CmdDelWithArgs(argsB, func() error {
+				return cmdDel(argsB)
+			})).To(Succeed())
+			_, err = netlink.LinkByName(vlanName)
+			Expect(err).To(HaveOccurred())
+			Expect(filepath.Join(dataDir, vlanName+".json")).NotTo(BeAnExistingFile())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := netlink.LinkByName("macvl0")
+			Expect(err).To(HaveOccurred())
+			_, err = netlink.LinkByName("macvl1")
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("takes over the master's addresses in passthru mode and gives them back on DEL", func() {
+		conf := fmt.Sprintf(`{
+		    "cniVersion": "1.0.0",
+		    "name": "mynet",
+		    "type": "macvlan",
+		    "master": "%s",
+		    "mode": "passthru",
+		    "takeoverAddresses": true,
+		    "dataDir": "%s"
+		}`, MASTER_NAME, dataDir)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      "macvl0",
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			master, err := netlink.LinkByName(MASTER_NAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(master)).To(Succeed())
+			addr, err := netlink.ParseAddr("192.0.2.10/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(master, addr)).To(Succeed())
+			Expect(netlink.RouteAdd(&netlink.Route{
+				LinkIndex: master.Attrs().Index,
+				Gw:        net.ParseIP("192.0.2.1"),
+			})).To(Succeed())
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(1))
+			Expect(result.IPs[0].Address.String()).To(Equal("192.0.2.10/24"))
+			Expect(result.Routes).To(HaveLen(1))
+			Expect(result.Routes[0].GW.String()).To(Equal("192.0.2.1"))
+
+			addrs, err := netlink.AddrList(master, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(BeEmpty())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName("macvl0")
+			Expect(err).NotTo(HaveOccurred())
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(HaveLen(1))
+			Expect(addrs[0].IPNet.String()).To(Equal("192.0.2.10/24"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+
+			master, err := netlink.LinkByName(MASTER_NAME)
+			Expect(err).NotTo(HaveOccurred())
+			addrs, err := netlink.AddrList(master, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(HaveLen(1))
+			Expect(addrs[0].IPNet.String()).To(Equal("192.0.2.10/24"))
+			routes, err := netlink.RouteList(master, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(ContainElement(HaveField("Gw", Equal(net.ParseIP("192.0.2.1").To4()))))
+			Expect(filepath.Join(dataDir, MASTER_NAME+".takeover.json")).NotTo(BeAnExistingFile())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects takeoverAddresses outside of passthru mode", func() {
+		conf := fmt.Sprintf(`{
+		    "cniVersion": "1.0.0",
+		    "name": "mynet",
+		    "type": "macvlan",
+		    "master": "%s",
+		    "mode": "bridge",
+		    "takeoverAddresses": true
+		}`, MASTER_NAME)
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			_, _, err := loadConf(&skel.CmdArgs{StdinData: []byte(conf)}, "")
+			return err
+		})
+		Expect(err).To(MatchError("takeoverAddresses requires mode passthru"))
+	})
+
+	It("gives a recreated pod the MAC it had before", func() {
+		conf := fmt.Sprintf(`{
+		    "cniVersion": "1.0.0",
+		    "name": "mynet",
+		    "type": "macvlan",
+		    "master": "%s",
+		    "persistMac": true,
+		    "macStoreDir": "%s"
+		}`, MASTER_NAME, dataDir)
+		podArgs := "K8S_POD_NAMESPACE=default;K8S_POD_NAME=web-0"
+
+		macs := []string{}
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			for _, containerID := range []string{"first", "second"} {
+				args := &skel.CmdArgs{
+					ContainerID: containerID,
+					Netns:       targetNS.Path(),
+					IfName:      "macvl0",
+					Args:        podArgs,
+					StdinData:   []byte(conf),
+				}
+				r, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				result, err := types100.GetResult(r)
+				Expect(err).NotTo(HaveOccurred())
+				macs = append(macs, result.Interfaces[0].Mac)
+
+				Expect(testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})).To(Succeed())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(macs[1]).To(Equal(macs[0]))
+	})
+
+	It("rejects persistMac in passthru mode", func() {
+		conf := fmt.Sprintf(`{
+		    "cniVersion": "1.0.0",
+		    "name": "mynet",
+		    "type": "macvlan",
+		    "master": "%s",
+		    "mode": "passthru",
+		    "persistMac": true
+		}`, MASTER_NAME)
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			_, _, err := loadConf(&skel.CmdArgs{StdinData: []byte(conf)}, "")
+			return err
+		})
+		Expect(err).To(MatchError(ContainSubstring("persistMac can't be combined with passthru mode")))
+	})
+
+	It("rejects an unknown podSysctls bundle", func() {
+		conf := fmt.Sprintf(`{
+		    "cniVersion": "1.0.0",
+		    "name": "mynet",
+		    "type": "macvlan",
+		    "master": "%s",
+		    "podSysctls": {"name": "lax"}
+		}`, MASTER_NAME)
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			_, _, err := loadConf(&skel.CmdArgs{StdinData: []byte(conf)}, "")
+			return err
+		})
+		Expect(err).To(MatchError(ContainSubstring(`unknown sysctl bundle "lax"`)))
+	})
+
+	It("rejects ipv6RouterDiscovery with podSysctls ignoring router advertisements", func() {
+		conf := fmt.Sprintf(`{
+		    "cniVersion": "1.0.0",
+		    "name": "mynet",
+		    "type": "macvlan",
+		    "master": "%s",
+		    "ipv6RouterDiscovery": true,
+		    "podSysctls": {"sysctls": {"net.ipv6.conf.IFNAME.accept_ra": "0"}}
+		}`, MASTER_NAME)
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			_, _, err := loadConf(&skel.CmdArgs{StdinData: []byte(conf)}, "")
+			return err
+		})
+		Expect(err).To(MatchError("ipv6RouterDiscovery can't be combined with podSysctls ignoring router advertisements"))
+	})
+})
+
+var _ = Describe("MAC store", func() {
+	var n *NetConf
+
+	BeforeEach(func() {
+		dir, err := os.MkdirTemp("", "macvlan_macs")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+		n = &NetConf{NetConf: types.NetConf{Name: "mynet"}, MacStoreDir: dir, pod: "default/web-0"}
+	})
+
+	It("keeps the MAC of a pod across DEL", func() {
+		mac, err := storedMac(n)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mac).To(BeEmpty())
+
+		Expect(storeMac(n, "02:00:00:00:00:01")).To(Succeed())
+		Expect(releaseMac(n)).To(Succeed())
+		mac, err = storedMac(n)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mac).To(Equal("02:00:00:00:00:01"))
+
+		other := *n
+		other.pod = "default/web-1"
+		mac, err = storedMac(&other)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mac).To(BeEmpty())
+	})
+
+	It("forgets pods released longer than the retention ago", func() {
+		now := time.Now()
+		old, recent := now.Add(-macRetention-time.Hour), now.Add(-time.Hour)
+		store := macStore{
+			"default/gone":    {MAC: "02:00:00:00:00:01", Released: &old},
+			"default/back":    {MAC: "02:00:00:00:00:02", Released: &recent},
+			"default/running": {MAC: "02:00:00:00:00:03"},
+		}
+		store.prune(now)
+		Expect(store).To(HaveLen(2))
+		Expect(store).To(HaveKey("default/back"))
+		Expect(store).To(HaveKey("default/running"))
+	})
 })
@@ -0,0 +1,184 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package macvlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// takeoverState records the IP configuration a passthru macvlan took over
+// from its master, so DEL can give it back.
+type takeoverState struct {
+	Master      string `json:"master"`
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifName"`
+	ip.LinkConfig
+}
+
+func takeoverStatePath(n *NetConf) string {
+	return filepath.Join(n.DataDir, n.Master+".takeover.json")
+}
+
+func readTakeoverState(n *NetConf) (*takeoverState, error) {
+	data, err := os.ReadFile(takeoverStatePath(n))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &takeoverState{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse takeover state of master %q: %v", n.Master, err)
+	}
+	return s, nil
+}
+
+// takeOverMaster records the IP configuration of the master for the
+// attachment. The state is written before anything is moved, so a failure
+// half way can still be undone by DEL.
+func takeOverMaster(n *NetConf, containerID, ifName string) (*takeoverState, error) {
+	if s, err := readTakeoverState(n); err != nil {
+		return nil, err
+	} else if s != nil && (s.ContainerID != containerID || s.IfName != ifName) {
+		return nil, fmt.Errorf("master %q is taken over by container %s already", n.Master, s.ContainerID)
+	}
+
+	master, err := netlink.LinkByName(n.Master)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup master %q: %v", n.Master, err)
+	}
+	conf, err := ip.GetLinkConfig(master)
+	if err != nil {
+		return nil, err
+	}
+	s := &takeoverState{Master: n.Master, ContainerID: containerID, IfName: ifName, LinkConfig: *conf}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(n.DataDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create data dir %q: %v", n.DataDir, err)
+	}
+	if err := os.WriteFile(takeoverStatePath(n), data, 0o600); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// moveToContainer moves the master's IP configuration onto the macvlan and
+// adds it to the result.
+func (s *takeoverState) moveToContainer(netns ns.NetNS, result *current.Result) error {
+	master, err := netlink.LinkByName(s.Master)
+	if err != nil {
+		return fmt.Errorf("failed to lookup master %q: %v", s.Master, err)
+	}
+	if err := s.Remove(master); err != nil {
+		return err
+	}
+	err = netns.Do(func(_ ns.NetNS) error {
+		macvlan, err := netlink.LinkByName(s.IfName)
+		if err != nil {
+			return fmt.Errorf("failed to find interface name %q: %v", s.IfName, err)
+		}
+		if err := netlink.LinkSetUp(macvlan); err != nil {
+			return fmt.Errorf("failed to set %q UP: %v", s.IfName, err)
+		}
+		return s.Apply(macvlan)
+	})
+	if err != nil {
+		return err
+	}
+
+	addrs, routes, err := s.Parse()
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		result.IPs = append(result.IPs, &current.IPConfig{Address: *a.IPNet, Interface: current.Int(0)})
+	}
+	for _, r := range routes {
+		// the routes of other tables can't be validated by CHECK
+		if r.Table != 0 && r.Table != unix.RT_TABLE_MAIN {
+			continue
+		}
+		dst := r.Dst
+		if dst == nil {
+			dst = &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+			if r.Gw != nil && r.Gw.To4() == nil {
+				dst = &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+			}
+		}
+		result.Routes = append(result.Routes, &types.Route{Dst: *dst, GW: r.Gw})
+	}
+	return nil
+}
+
+// giveBack restores the master's IP configuration taken over by the
+// attachment, once its macvlan is gone, and removes the state.
+func giveBack(n *NetConf, containerID, ifName string) error {
+	s, err := readTakeoverState(n)
+	if err != nil || s == nil {
+		return err
+	}
+	if s.ContainerID != containerID || s.IfName != ifName {
+		return nil
+	}
+
+	master, err := netlink.LinkByName(s.Master)
+	if err != nil {
+		return fmt.Errorf("failed to lookup master %q: %v", s.Master, err)
+	}
+	if err := netlink.LinkSetUp(master); err != nil {
+		return fmt.Errorf("failed to set master %q up: %v", s.Master, err)
+	}
+	if err := s.Apply(master); err != nil {
+		return fmt.Errorf("failed to restore the addresses of master %q: %v", s.Master, err)
+	}
+	if err := os.Remove(takeoverStatePath(n)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// validateTakeover checks the takeoverAddresses setting of the network.
+func validateTakeover(n *NetConf) error {
+	if !n.TakeoverAddrs {
+		return nil
+	}
+	switch {
+	case n.Mode != "passthru":
+		return fmt.Errorf("takeoverAddresses requires mode passthru")
+	case n.Master == "":
+		// DEL can't find the master by the default route it took away
+		return fmt.Errorf("takeoverAddresses requires a master")
+	case n.LinkContNs, n.VlanID != 0:
+		return fmt.Errorf("takeoverAddresses can't be combined with linkInContainer or vlanId")
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package macvlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/alexflint/go-filemutex"
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+)
+
+const defaultDataDir = "/run/cni/macvlan"
+
+// vlanState tracks the attachments using a VLAN sub-interface, and whether
+// the plugin created it, so it is only deleted by the last DEL and only if
+// it wasn't pre-created on the host.
+type vlanState struct {
+	Created bool     `json:"created,omitempty"`
+	Users   []string `json:"users"`
+}
+
+// vlanIfName returns the name of the VLAN sub-interface of master, cutting
+// the master's name short if needed to fit the kernel's limit.
+func vlanIfName(master string, vlanID int) string {
+	suffix := "." + strconv.Itoa(vlanID)
+	if room := 15 - len(suffix); len(master) > room {
+		master = master[:room]
+	}
+	return master + suffix
+}
+
+func lockVlan(n *NetConf, name string) (func(), error) {
+	return lockFile(n.DataDir, name)
+}
+
+// lockFile locks name in dir against other invocations of the plugin.
+func lockFile(dir, name string) (func(), error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create data dir %q: %v", dir, err)
+	}
+	m, err := filemutex.New(filepath.Join(dir, name+".lock"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock for %q: %v", name, err)
+	}
+	if err := m.Lock(); err != nil {
+		m.Close()
+		return nil, fmt.Errorf("failed to lock %q: %v", name, err)
+	}
+	return func() {
+		m.Unlock()
+		m.Close()
+	}, nil
+}
+
+// acquireVlan returns the VLAN sub-interface of the master to use as the
+// macvlan's parent, creating it if it doesn't exist, and records the
+// attachment as one of its users.
+func acquireVlan(n *NetConf, containerID, ifName string) (string, error) {
+	name := vlanIfName(n.Master, n.VlanID)
+	unlock, err := lockVlan(n, name)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	state, err := readVlanState(n, name)
+	if err != nil {
+		return "", err
+	}
+	if state == nil {
+		state = &vlanState{}
+	}
+
+	master, err := netlink.LinkByName(n.Master)
+	if err != nil {
+		return "", fmt.Errorf("failed to lookup master %q: %v", n.Master, err)
+	}
+
+	l, err := netlink.LinkByName(name)
+	switch {
+	case err == nil:
+		vlan, ok := l.(*netlink.Vlan)
+		if !ok || vlan.ParentIndex != master.Attrs().Index || vlan.VlanId != n.VlanID {
+			return "", fmt.Errorf("%s already exists but is not VLAN %d of %q", name, n.VlanID, n.Master)
+		}
+	case isLinkNotFound(err):
+		vlan := &netlink.Vlan{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:        name,
+				ParentIndex: master.Attrs().Index,
+			},
+			VlanId: n.VlanID,
+		}
+		if err := netlink.LinkAdd(vlan); err != nil {
+			return "", fmt.Errorf("failed to create VLAN %d on %q: %v", n.VlanID, n.Master, err)
+		}
+		state.Created = true
+		l = vlan
+	default:
+		return "", fmt.Errorf("failed to lookup %q: %v", name, err)
+	}
+
+	if err := netlink.LinkSetUp(l); err != nil {
+		return "", fmt.Errorf("failed to set %q up: %v", name, err)
+	}
+
+	user := containerID + "/" + ifName
+	for _, u := range state.Users {
+		if u == user {
+			return name, writeVlanState(n, name, state)
+		}
+	}
+	state.Users = append(state.Users, user)
+	return name, writeVlanState(n, name, state)
+}
+
+// releaseVlan drops the attachment from the users of the VLAN sub-interface,
+// and deletes the sub-interface when the plugin created it and no users are
+// left.
+func releaseVlan(n *NetConf, containerID, ifName string) error {
+	name := vlanIfName(n.Master, n.VlanID)
+	unlock, err := lockVlan(n, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := readVlanState(n, name)
+	if err != nil || state == nil {
+		return err
+	}
+
+	user := containerID + "/" + ifName
+	users := state.Users[:0]
+	for _, u := range state.Users {
+		if u != user {
+			users = append(users, u)
+		}
+	}
+	state.Users = users
+	if len(state.Users) > 0 {
+		return writeVlanState(n, name, state)
+	}
+
+	if state.Created {
+		if err := ip.DelLinkByName(name); err != nil && err != ip.ErrLinkNotFound {
+			return fmt.Errorf("failed to delete %q: %v", name, err)
+		}
+	}
+	if err := os.Remove(vlanStatePath(n, name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove VLAN state: %v", err)
+	}
+	return nil
+}
+
+func isLinkNotFound(err error) bool {
+	_, ok := err.(netlink.LinkNotFoundError)
+	return ok
+}
+
+func vlanStatePath(n *NetConf, name string) string {
+	return filepath.Join(n.DataDir, name+".json")
+}
+
+func readVlanState(n *NetConf, name string) (*vlanState, error) {
+	data, err := os.ReadFile(vlanStatePath(n, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VLAN state: %v", err)
+	}
+	state := &vlanState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse VLAN state: %v", err)
+	}
+	return state, nil
+}
+
+func writeVlanState(n *NetConf, name string, state *vlanState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(vlanStatePath(n, name), data, 0o644); err != nil {
+		return fmt.Errorf("failed to write VLAN state: %v", err)
+	}
+	return nil
+}
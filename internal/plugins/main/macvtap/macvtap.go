@@ -0,0 +1,542 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package macvtap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/cniargs"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/include"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+)
+
+const defaultDeviceInfoDir = "/run/cni/macvtap"
+
+// sysfsDir is where the sysfs of the host's network namespace is mounted
+var sysfsDir = "/sys"
+
+type NetConf struct {
+	types.NetConf
+	Master        string `json:"master"`
+	Mode          string `json:"mode"`
+	MTU           int    `json:"mtu"`
+	Mac           string `json:"mac,omitempty"`
+	DeviceInfoDir string `json:"deviceInfoDir,omitempty"`
+}
+
+// DeviceInfo describes the tap device handed to the container, so VM based
+// runtimes can find the character device backing the interface.
+type DeviceInfo struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac"`
+	MTU     int    `json:"mtu"`
+	Mode    string `json:"mode"`
+	IfIndex int    `json:"ifIndex"`
+	// Dev is the major:minor of the tap character device
+	Dev     string `json:"dev"`
+	TapPath string `json:"tapPath"`
+	Sandbox string `json:"sandbox"`
+}
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func loadConf(args *skel.CmdArgs) (*NetConf, string, error) {
+	n := &NetConf{
+		DeviceInfoDir: defaultDeviceInfoDir,
+	}
+	if err := config.Validate(args.StdinData, n); err != nil {
+		return nil, "", fmt.Errorf("invalid network configuration: %v", err)
+	}
+	if err := json.Unmarshal(args.StdinData, n); err != nil {
+		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
+	}
+	if n.Master == "" {
+		return nil, "", errors.New(`"master" field is required. It specifies the host interface name to create the macvtap on`)
+	}
+	if _, err := modeFromString(n.Mode); err != nil {
+		return nil, "", err
+	}
+
+	master, err := netlink.LinkByName(n.Master)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to lookup master %q: %v", n.Master, err)
+	}
+	if n.MTU < 0 || n.MTU > master.Attrs().MTU {
+		return nil, "", fmt.Errorf("invalid MTU %d, must be [0, master MTU(%d)]", n.MTU, master.Attrs().MTU)
+	}
+
+	a, err := cniargs.Parse(args.Args, args.StdinData)
+	if err != nil {
+		return nil, "", err
+	}
+	if mac := a.MAC(); mac != "" {
+		n.Mac = mac
+	}
+
+	return n, n.CNIVersion, nil
+}
+
+func modeFromString(s string) (netlink.MacvlanMode, error) {
+	switch s {
+	case "", "bridge":
+		return netlink.MACVLAN_MODE_BRIDGE, nil
+	case "private":
+		return netlink.MACVLAN_MODE_PRIVATE, nil
+	case "vepa":
+		return netlink.MACVLAN_MODE_VEPA, nil
+	case "passthru":
+		return netlink.MACVLAN_MODE_PASSTHRU, nil
+	default:
+		return 0, fmt.Errorf("unknown macvtap mode: %q", s)
+	}
+}
+
+func modeToString(mode netlink.MacvlanMode) (string, error) {
+	switch mode {
+	case netlink.MACVLAN_MODE_BRIDGE:
+		return "bridge", nil
+	case netlink.MACVLAN_MODE_PRIVATE:
+		return "private", nil
+	case netlink.MACVLAN_MODE_VEPA:
+		return "vepa", nil
+	case netlink.MACVLAN_MODE_PASSTHRU:
+		return "passthru", nil
+	default:
+		return "", fmt.Errorf("unknown macvtap mode: %q", mode)
+	}
+}
+
+func deviceInfoPath(dir, containerID, ifName string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.json", containerID, ifName))
+}
+
+func createMacvtap(conf *NetConf, ifName string, netns ns.NetNS) (*current.Interface, *DeviceInfo, error) {
+	mode, err := modeFromString(conf.Mode)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m, err := netlink.LinkByName(conf.Master)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to lookup master %q: %v", conf.Master, err)
+	}
+
+	// due to kernel bug we have to create with tmpName or it might
+	// collide with the name on the host and error out
+	tmpName, err := ip.RandomVethName()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	linkAttrs := netlink.LinkAttrs{
+		MTU:         conf.MTU,
+		Name:        tmpName,
+		ParentIndex: m.Attrs().Index,
+	}
+
+	if conf.Mac != "" {
+		addr, err := net.ParseMAC(conf.Mac)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid args %v for MAC addr: %v", conf.Mac, err)
+		}
+		linkAttrs.HardwareAddr = addr
+	}
+
+	mv := &netlink.Macvtap{
+		Macvlan: netlink.Macvlan{
+			LinkAttrs: linkAttrs,
+			Mode:      mode,
+		},
+	}
+
+	if err := netlink.LinkAdd(mv); err != nil {
+		return nil, nil, fmt.Errorf("failed to create macvtap: %v", err)
+	}
+
+	// the tap device is only listed in the sysfs of the host, so look it
+	// up before the macvtap moves into the container
+	info := &DeviceInfo{}
+	info.Dev, info.TapPath, err = tapDevice(tmpName)
+	if err == nil {
+		err = netlink.LinkSetNsFd(mv, int(netns.Fd()))
+		if err != nil {
+			err = fmt.Errorf("failed to move macvtap to the container: %v", err)
+		}
+	}
+	if err != nil {
+		_ = netlink.LinkDel(mv)
+		return nil, nil, err
+	}
+
+	macvtap := &current.Interface{}
+	err = netns.Do(func(_ ns.NetNS) error {
+		err := ip.RenameLink(tmpName, ifName)
+		if err != nil {
+			_ = netlink.LinkDel(mv)
+			return fmt.Errorf("failed to rename macvtap to %q: %v", ifName, err)
+		}
+
+		// Re-fetch macvtap to get all properties/attributes
+		contMacvtap, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to refetch macvtap %q: %v", ifName, err)
+		}
+		macvtap.Name = ifName
+		macvtap.Mac = contMacvtap.Attrs().HardwareAddr.String()
+		macvtap.Sandbox = netns.Path()
+
+		info.Name = ifName
+		info.Mac = macvtap.Mac
+		info.MTU = contMacvtap.Attrs().MTU
+		info.IfIndex = contMacvtap.Attrs().Index
+		info.Sandbox = netns.Path()
+
+		macvtap.Mtu = info.MTU
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	info.Mode, _ = modeToString(mode)
+
+	return macvtap, info, nil
+}
+
+// tapDevice returns the major:minor and the device node of the tap device
+// backing the macvtap link linkName in the host's network namespace.
+func tapDevice(linkName string) (string, string, error) {
+	devs, err := filepath.Glob(filepath.Join(sysfsDir, "class", "net", linkName, "macvtap", "tap*", "dev"))
+	if err != nil {
+		return "", "", err
+	}
+	if len(devs) != 1 {
+		return "", "", fmt.Errorf("failed to find the tap device of macvtap %q", linkName)
+	}
+	dev, err := os.ReadFile(devs[0])
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read the tap device of macvtap %q: %v", linkName, err)
+	}
+
+	// udev names the device node after the DEVNAME of the device
+	uevent, err := os.ReadFile(filepath.Join(sysfsDir, "dev", "char", strings.TrimSpace(string(dev)), "uevent"))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read the tap device of macvtap %q: %v", linkName, err)
+	}
+	for _, line := range strings.Split(string(uevent), "\n") {
+		if name, ok := strings.CutPrefix(line, "DEVNAME="); ok {
+			return strings.TrimSpace(string(dev)), filepath.Join("/dev", name), nil
+		}
+	}
+	return "", "", fmt.Errorf("failed to find the device node of macvtap %q", linkName)
+}
+
+func writeDeviceInfo(dir, containerID string, info *DeviceInfo) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create device info dir %q: %v", dir, err)
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(deviceInfoPath(dir, containerID, info.Name), data, 0o644)
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	n, cniVersion, err := loadConf(args)
+	if err != nil {
+		return err
+	}
+
+	isLayer3 := n.IPAM.Type != ""
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return ns.OpenError(args.Netns, err)
+	}
+	defer netns.Close()
+
+	macvtapInterface, info, err := createMacvtap(n, args.IfName, netns)
+	if err != nil {
+		return err
+	}
+
+	// Delete link if err to avoid link leak in this ns
+	defer func() {
+		if err != nil {
+			netns.Do(func(_ ns.NetNS) error {
+				return ip.DelLinkByName(args.IfName)
+			})
+			os.Remove(deviceInfoPath(n.DeviceInfoDir, args.ContainerID, args.IfName))
+		}
+	}()
+
+	if err = writeDeviceInfo(n.DeviceInfoDir, args.ContainerID, info); err != nil {
+		return err
+	}
+
+	// Assume L2 interface only
+	result := &current.Result{
+		CNIVersion: current.ImplementedSpecVersion,
+		Interfaces: []*current.Interface{macvtapInterface},
+	}
+
+	if isLayer3 {
+		// run the IPAM plugin and get back the config to apply
+		var r types.Result
+		r, err = ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+
+		// Invoke ipam del if err to avoid ip leak
+		defer func() {
+			if err != nil {
+				ipam.ExecDel(n.IPAM.Type, args.StdinData)
+			}
+		}()
+
+		// Convert whatever the IPAM result was into the current Result type
+		var ipamResult *current.Result
+		ipamResult, err = current.NewResultFromResult(r)
+		if err != nil {
+			return err
+		}
+
+		if len(ipamResult.IPs) == 0 {
+			err = errors.New("IPAM plugin returned missing IP config")
+			return err
+		}
+
+		result.IPs = ipamResult.IPs
+		result.Routes = ipamResult.Routes
+
+		for _, ipc := range result.IPs {
+			// All addresses apply to the container macvtap interface
+			ipc.Interface = current.Int(0)
+		}
+
+		err = netns.Do(func(_ ns.NetNS) error {
+			return ipam.ConfigureIface(args.IfName, result)
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		// For L2 just change interface status to up
+		err = netns.Do(func(_ ns.NetNS) error {
+			link, err := netlink.LinkByName(args.IfName)
+			if err != nil {
+				return fmt.Errorf("failed to find interface name %q: %v", args.IfName, err)
+			}
+			if err := netlink.LinkSetUp(link); err != nil {
+				return fmt.Errorf("failed to set %q UP: %v", args.IfName, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	result.DNS = ipam.ResultDNS(result.DNS, n.DNS)
+
+	return types.PrintResult(result, cniVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n := &NetConf{DeviceInfoDir: defaultDeviceInfoDir}
+	if err := json.Unmarshal(args.StdinData, n); err != nil {
+		return fmt.Errorf("failed to load netConf: %v", err)
+	}
+
+	if n.IPAM.Type != "" {
+		if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(deviceInfoPath(n.DeviceInfoDir, args.ContainerID, args.IfName)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove device info: %v", err)
+	}
+
+	if args.Netns == "" {
+		return nil
+	}
+
+	// There is a netns so try to clean up. Delete can be called multiple times
+	// so don't return an error if the device is already removed.
+	err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		if err := ip.DelLinkByName(args.IfName); err != nil {
+			if err != ip.ErrLinkNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		//  if NetNs is passed down by the Cloud Orchestration Engine, or if it called multiple times
+		// so don't return an error if the device is already removed.
+		// https://github.com/kubernetes/kubernetes/issues/43014#issuecomment-287164444
+		_, ok := err.(ns.NSPathNotExistErr)
+		if ok {
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Main runs the macvtap plugin.
+func Main() {
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}), version.All, bv.BuildString("macvtap"))
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	n, _, err := loadConf(args)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return ns.OpenError(args.Netns, err)
+	}
+	defer netns.Close()
+
+	if n.IPAM.Type != "" {
+		// run the IPAM plugin and get back the config to apply
+		err = ipam.ExecCheck(n.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Parse previous result.
+	if n.NetConf.RawPrevResult == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+
+	if err := version.ParsePrevResult(&n.NetConf); err != nil {
+		return err
+	}
+
+	result, err := current.NewResultFromResult(n.PrevResult)
+	if err != nil {
+		return err
+	}
+
+	var contMap current.Interface
+	// Find interfaces for names whe know, macvtap device name inside container
+	for _, intf := range result.Interfaces {
+		if args.IfName == intf.Name {
+			if args.Netns == intf.Sandbox {
+				contMap = *intf
+				continue
+			}
+		}
+	}
+
+	// The namespace must be the same as what was configured
+	if args.Netns != contMap.Sandbox {
+		return fmt.Errorf("sandbox in prevResult %s doesn't match configured netns: %s",
+			contMap.Sandbox, args.Netns)
+	}
+
+	if _, err := os.Stat(deviceInfoPath(n.DeviceInfoDir, args.ContainerID, args.IfName)); err != nil {
+		return fmt.Errorf("device info for %q not found: %v", args.IfName, err)
+	}
+
+	// Check prevResults for ips, routes and dns against values found in the container
+	return netns.Do(func(_ ns.NetNS) error {
+		// Check interface against values found in the container
+		err := validateCniContainerInterface(contMap, n.Mode)
+		if err != nil {
+			return err
+		}
+
+		err = ip.ValidateExpectedInterfaceIPs(args.IfName, result.IPs)
+		if err != nil {
+			return err
+		}
+
+		return ip.ValidateExpectedRoute(result.Routes)
+	})
+}
+
+func validateCniContainerInterface(intf current.Interface, modeExpected string) error {
+	if intf.Name == "" {
+		return fmt.Errorf("container interface name missing in prevResult: %v", intf.Name)
+	}
+	link, err := netlink.LinkByName(intf.Name)
+	if err != nil {
+		return fmt.Errorf("container Interface name in prevResult: %s not found", intf.Name)
+	}
+	if intf.Sandbox == "" {
+		return fmt.Errorf("error: Container interface %s should not be in host namespace", link.Attrs().Name)
+	}
+
+	macvtap, isMacvtap := link.(*netlink.Macvtap)
+	if !isMacvtap {
+		return fmt.Errorf("error: Container interface %s not of type macvtap", link.Attrs().Name)
+	}
+
+	mode, err := modeFromString(modeExpected)
+	if err != nil {
+		return err
+	}
+	if macvtap.Mode != mode {
+		currString, err := modeToString(macvtap.Mode)
+		if err != nil {
+			return err
+		}
+		confString, err := modeToString(mode)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("container macvtap mode %s does not match expected value: %s", currString, confString)
+	}
+
+	if intf.Mac != "" {
+		if intf.Mac != link.Attrs().HardwareAddr.String() {
+			return fmt.Errorf("interface %s Mac %s doesn't match container Mac: %s", intf.Name, intf.Mac, link.Attrs().HardwareAddr)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,299 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package macvtap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+)
+
+const MASTER_NAME = "eth0"
+
+var _ = Describe("macvtap Operations", func() {
+	var originalNS, targetNS ns.NetNS
+	var dataDir, infoDir, sysfs string
+
+	BeforeEach(func() {
+		// Create a new NetNS so we don't modify the host
+		var err error
+		originalNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		targetNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		dataDir, err = os.MkdirTemp("", "macvtap_test")
+		Expect(err).NotTo(HaveOccurred())
+		infoDir, err = os.MkdirTemp("", "macvtap_info")
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			// Add master
+			err = netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: MASTER_NAME,
+				},
+				PeerName: MASTER_NAME + "p",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = netlink.LinkByName(MASTER_NAME)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// the plugin looks up the tap devices in the sysfs of the host,
+		// which is originalNS here
+		sysfs, err = os.MkdirTemp("", "macvtap_sysfs")
+		Expect(err).NotTo(HaveOccurred())
+		err = originalNS.Do(func(ns.NetNS) error {
+			return unix.Mount("sysfs", sysfs, "sysfs", 0, "")
+		})
+		Expect(err).NotTo(HaveOccurred())
+		sysfsDir = sysfs
+	})
+
+	AfterEach(func() {
+		sysfsDir = "/sys"
+		Expect(unix.Unmount(sysfs, unix.MNT_DETACH)).To(Succeed())
+		Expect(os.Remove(sysfs)).To(Succeed())
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+		Expect(os.RemoveAll(infoDir)).To(Succeed())
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(originalNS)).To(Succeed())
+		Expect(targetNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(targetNS)).To(Succeed())
+	})
+
+	for _, ver := range testutils.AllSpecVersions {
+		// Redefine ver inside for scope so real value is picked up by each dynamically defined It()
+		// See Gingkgo's "Patterns for dynamically generating tests" documentation.
+		ver := ver
+
+		It(fmt.Sprintf("[%s] configures and deconfigures a macvtap link with ADD/DEL", ver), func() {
+			const IFNAME = "mvtap0"
+
+			conf := fmt.Sprintf(`{
+			    "cniVersion": "%s",
+			    "name": "mynet",
+			    "type": "macvtap",
+			    "master": "%s",
+			    "deviceInfoDir": "%s",
+			    "ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24",
+				"dataDir": "%s"
+			    }
+			}`, ver, MASTER_NAME, infoDir, dataDir)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   []byte(conf),
+			}
+
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// Make sure macvtap link exists in the target namespace
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link).To(BeAssignableToTypeOf(&netlink.Macvtap{}))
+				Expect(link.Attrs().Flags & net.FlagUp).To(Equal(net.FlagUp))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deviceInfoPath(infoDir, "dummy", IFNAME)).To(BeAnExistingFile())
+
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				err := testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// Make sure macvtap link has been deleted
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				_, err := netlink.LinkByName(IFNAME)
+				Expect(err).To(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deviceInfoPath(infoDir, "dummy", IFNAME)).NotTo(BeAnExistingFile())
+
+			// DEL can be called multiple times
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				return testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	}
+
+	It("returns the device info and honours mac, mode and mtu", func() {
+		const IFNAME = "mvtap0"
+		const MAC = "c2:11:22:33:44:55"
+
+		conf := fmt.Sprintf(`{
+		    "cniVersion": "1.0.0",
+		    "name": "mynet",
+		    "type": "macvtap",
+		    "master": "%s",
+		    "mode": "vepa",
+		    "mtu": 1400,
+		    "mac": "%s",
+		    "deviceInfoDir": "%s"
+		}`, MASTER_NAME, MAC, infoDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		var out []byte
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			var err error
+			_, out, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// the result sticks to the spec, the device info is in its file
+		Expect(string(out)).NotTo(ContainSubstring("deviceInfo"))
+		result := &types100.Result{}
+		Expect(json.Unmarshal(out, result)).To(Succeed())
+		Expect(result.Interfaces).To(HaveLen(1))
+		Expect(result.Interfaces[0].Mac).To(Equal(MAC))
+		Expect(result.IPs).To(BeEmpty())
+
+		data, err := os.ReadFile(deviceInfoPath(infoDir, "dummy", IFNAME))
+		Expect(err).NotTo(HaveOccurred())
+		info := &DeviceInfo{}
+		Expect(json.Unmarshal(data, info)).To(Succeed())
+		Expect(info.Name).To(Equal(IFNAME))
+		Expect(info.Mac).To(Equal(MAC))
+		Expect(info.MTU).To(Equal(1400))
+		Expect(info.Mode).To(Equal("vepa"))
+		Expect(info.Dev).To(MatchRegexp(`^\d+:\d+$`))
+		Expect(info.TapPath).To(MatchRegexp(`^/dev/tap\d+$`))
+		Expect(info.Sandbox).To(Equal(targetNS.Path()))
+
+		Expect(result.Interfaces[0].Mtu).To(Equal(1400))
+		Expect(result.Interfaces[0].SocketPath).To(BeEmpty())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().HardwareAddr.String()).To(Equal(MAC))
+			Expect(link.Attrs().MTU).To(Equal(1400))
+			Expect(link.Attrs().Index).To(Equal(info.IfIndex))
+			Expect(link.(*netlink.Macvtap).Mode).To(Equal(netlink.MACVLAN_MODE_VEPA))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// CHECK against the previous result
+		checkConf := fmt.Sprintf(`{
+		    "cniVersion": "1.0.0",
+		    "name": "mynet",
+		    "type": "macvtap",
+		    "master": "%s",
+		    "mode": "vepa",
+		    "deviceInfoDir": "%s",
+		    "prevResult": {
+			"cniVersion": "1.0.0",
+			"interfaces": [{"name": "%s", "mac": "%s", "sandbox": "%s"}]
+		    }
+		}`, MASTER_NAME, infoDir, IFNAME, MAC, targetNS.Path())
+		args.StdinData = []byte(checkConf)
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			return testutils.CmdCheckWithArgs(args, func() error {
+				return cmdCheck(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects unknown modes and oversized MTUs", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			for conf, msg := range map[string]string{
+				fmt.Sprintf(`{"cniVersion": "1.0.0", "name": "mynet", "type": "macvtap", "master": "%s", "mode": "source"}`, MASTER_NAME): `unknown macvtap mode: "source"`,
+				fmt.Sprintf(`{"cniVersion": "1.0.0", "name": "mynet", "type": "macvtap", "master": "%s", "mtu": 65536}`, MASTER_NAME):     "invalid MTU 65536",
+				`{"cniVersion": "1.0.0", "name": "mynet", "type": "macvtap"}`:                                                             `"master" field is required`,
+			} {
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNS.Path(),
+					IfName:      "mvtap0",
+					StdinData:   []byte(conf),
+				}
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).To(MatchError(ContainSubstring(msg)))
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
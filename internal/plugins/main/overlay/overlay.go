@@ -0,0 +1,471 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package overlay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/include"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+)
+
+const maxVNI = 1<<24 - 1
+
+type NetConf struct {
+	types.NetConf
+	Encapsulation string `json:"encapsulation"`
+	VNI           int    `json:"vni"`
+	Vtep          string `json:"vtep"`
+	BrName        string `json:"bridge"`
+	Device        string `json:"device"`
+	Local         string `json:"local"`
+	Remote        string `json:"remote"`
+	Port          int    `json:"port"`
+	MTU           int    `json:"mtu"`
+	Peers         []Peer `json:"peers"`
+	PeersFile     string `json:"peersFile"`
+
+	local  net.IP
+	remote net.IP
+}
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func loadNetConf(bytes []byte) (*NetConf, error) {
+	n := &NetConf{
+		Encapsulation: encapVxlan,
+	}
+	if err := config.Validate(bytes, n); err != nil {
+		return nil, fmt.Errorf("invalid network configuration: %v", err)
+	}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	if n.Encapsulation != encapVxlan && n.Encapsulation != encapGeneve {
+		return nil, fmt.Errorf("invalid encapsulation %q, must be %q or %q", n.Encapsulation, encapVxlan, encapGeneve)
+	}
+	if n.VNI < 1 || n.VNI > maxVNI {
+		return nil, fmt.Errorf("invalid VNI %d, must be [1, %d]", n.VNI, maxVNI)
+	}
+	if n.Port < 0 || n.Port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", n.Port)
+	}
+	if n.MTU < 0 {
+		return nil, fmt.Errorf("invalid MTU %d", n.MTU)
+	}
+
+	if n.Local != "" {
+		if n.local = net.ParseIP(n.Local); n.local == nil {
+			return nil, fmt.Errorf("invalid local address %q", n.Local)
+		}
+	}
+	if n.Remote != "" {
+		if n.remote = net.ParseIP(n.Remote); n.remote == nil {
+			return nil, fmt.Errorf("invalid remote address %q", n.Remote)
+		}
+	}
+	hasPeers := len(n.Peers) > 0 || n.PeersFile != ""
+	if n.remote != nil && hasPeers {
+		return nil, errors.New("remote cannot be combined with peers or peersFile")
+	}
+
+	switch n.Encapsulation {
+	case encapVxlan:
+		if n.remote != nil && n.remote.IsMulticast() && n.Device == "" {
+			return nil, errors.New("a multicast remote requires a device")
+		}
+		if n.Port == 0 {
+			n.Port = defaultVxlanPort
+		}
+		if n.Vtep == "" {
+			n.Vtep = fmt.Sprintf("vx%d", n.VNI)
+		}
+	case encapGeneve:
+		if n.remote == nil || n.remote.IsMulticast() {
+			return nil, errors.New("geneve requires a unicast remote")
+		}
+		if n.local != nil {
+			return nil, errors.New("local is not supported with geneve")
+		}
+		if hasPeers {
+			return nil, errors.New("peers are only supported with vxlan")
+		}
+		if n.Port == 0 {
+			n.Port = defaultGenevePort
+		}
+		if n.Vtep == "" {
+			n.Vtep = fmt.Sprintf("gnv%d", n.VNI)
+		}
+	}
+	if n.BrName == "" {
+		n.BrName = fmt.Sprintf("ovl%d", n.VNI)
+	}
+
+	return n, nil
+}
+
+func ensureBridge(brName string, mtu int) (*netlink.Bridge, error) {
+	br := &netlink.Bridge{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: brName,
+			MTU:  mtu,
+			// Let kernel use default txqueuelen; leaving it unset
+			// means 0, and a zero-length TX queue messes up FIFO
+			// traffic shapers which use TX queue length as the
+			// default packet limit
+			TxQLen: -1,
+		},
+	}
+
+	err := netlink.LinkAdd(br)
+	if err != nil && err != syscall.EEXIST {
+		return nil, fmt.Errorf("could not add %q: %v", brName, err)
+	}
+
+	// Re-fetch link to read all attributes and if it already existed,
+	// ensure it's really a bridge with similar configuration
+	l, err := netlink.LinkByName(brName)
+	if err != nil {
+		return nil, fmt.Errorf("could not lookup %q: %v", brName, err)
+	}
+	br, ok := l.(*netlink.Bridge)
+	if !ok {
+		return nil, fmt.Errorf("%q already exists but is not a bridge", brName)
+	}
+
+	if err := netlink.LinkSetUp(br); err != nil {
+		return nil, err
+	}
+
+	return br, nil
+}
+
+// setupOverlay makes sure the VTEP exists, is attached to the overlay bridge
+// and forwards to the configured peers.
+func setupOverlay(n *NetConf) (netlink.Link, *netlink.Bridge, error) {
+	vtep, err := ensureVtep(n)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	br, err := ensureBridge(n.BrName, vtep.Attrs().MTU)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if vtep.Attrs().MasterIndex != br.Index {
+		if err := netlink.LinkSetMaster(vtep, br); err != nil {
+			return nil, nil, fmt.Errorf("failed to attach %q to bridge %q: %v", n.Vtep, n.BrName, err)
+		}
+	}
+
+	if n.Encapsulation == encapVxlan && n.remote == nil {
+		peers, err := loadPeers(n)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := syncFDB(vtep, peers); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return vtep, br, nil
+}
+
+func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int) (*current.Interface, *current.Interface, error) {
+	contIface := &current.Interface{}
+	hostIface := &current.Interface{}
+
+	err := netns.Do(func(hostNS ns.NetNS) error {
+		// create the veth pair in the container and move host end into host netns
+		hostVeth, containerVeth, err := ip.SetupVeth(ifName, mtu, "", hostNS)
+		if err != nil {
+			return err
+		}
+		contIface.Name = containerVeth.Name
+		contIface.Mac = containerVeth.HardwareAddr.String()
+		contIface.Sandbox = netns.Path()
+		hostIface.Name = hostVeth.Name
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// need to lookup hostVeth again as its index has changed during ns move
+	hostVeth, err := netlink.LinkByName(hostIface.Name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to lookup %q: %v", hostIface.Name, err)
+	}
+	hostIface.Mac = hostVeth.Attrs().HardwareAddr.String()
+
+	// connect host veth end to the bridge
+	if err := netlink.LinkSetMaster(hostVeth, br); err != nil {
+		return nil, nil, fmt.Errorf("failed to connect %q to bridge %v: %v", hostVeth.Attrs().Name, br.Attrs().Name, err)
+	}
+
+	return hostIface, contIface, nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	n, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	vtep, br, err := setupOverlay(n)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return ns.OpenError(args.Netns, err)
+	}
+	defer netns.Close()
+
+	hostInterface, containerInterface, err := setupVeth(netns, br, args.IfName, vtep.Attrs().MTU)
+	if err != nil {
+		return err
+	}
+
+	// Delete the veth if err to avoid link leak in this ns
+	defer func() {
+		if err != nil {
+			netns.Do(func(_ ns.NetNS) error {
+				return ip.DelLinkByName(args.IfName)
+			})
+		}
+	}()
+
+	result := &current.Result{
+		CNIVersion: current.ImplementedSpecVersion,
+		Interfaces: []*current.Interface{
+			{
+				Name: br.Attrs().Name,
+				Mac:  br.Attrs().HardwareAddr.String(),
+			},
+			hostInterface,
+			containerInterface,
+		},
+	}
+
+	if n.IPAM.Type != "" {
+		// run the IPAM plugin and get back the config to apply
+		var r types.Result
+		r, err = ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+
+		// Invoke ipam del if err to avoid ip leak
+		defer func() {
+			if err != nil {
+				ipam.ExecDel(n.IPAM.Type, args.StdinData)
+			}
+		}()
+
+		// Convert whatever the IPAM result was into the current Result type
+		var ipamResult *current.Result
+		ipamResult, err = current.NewResultFromResult(r)
+		if err != nil {
+			return err
+		}
+
+		if len(ipamResult.IPs) == 0 {
+			err = errors.New("IPAM plugin returned missing IP config")
+			return err
+		}
+
+		result.IPs = ipamResult.IPs
+		result.Routes = ipamResult.Routes
+
+		for _, ipc := range result.IPs {
+			// All addresses apply to the container veth interface
+			ipc.Interface = current.Int(2)
+		}
+
+		err = netns.Do(func(_ ns.NetNS) error {
+			return ipam.ConfigureIface(args.IfName, result)
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		// For L2 just change interface status to up
+		err = netns.Do(func(_ ns.NetNS) error {
+			link, err := netlink.LinkByName(args.IfName)
+			if err != nil {
+				return fmt.Errorf("failed to find interface name %q: %v", args.IfName, err)
+			}
+			return netlink.LinkSetUp(link)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	result.DNS = ipam.ResultDNS(result.DNS, n.DNS)
+
+	return types.PrintResult(result, n.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if n.IPAM.Type != "" {
+		if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
+			return err
+		}
+	}
+
+	if args.Netns == "" {
+		return nil
+	}
+
+	// There is a netns so try to clean up. Delete can be called multiple times
+	// so don't return an error if the device is already removed.
+	// The VTEP and the bridge are shared by all pods of the network and stay.
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		err := ip.DelLinkByName(args.IfName)
+		if err != nil && err == ip.ErrLinkNotFound {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		//  if NetNs is passed down by the Cloud Orchestration Engine, or if it called multiple times
+		// so don't return an error if the device is already removed.
+		// https://github.com/kubernetes/kubernetes/issues/43014#issuecomment-287164444
+		_, ok := err.(ns.NSPathNotExistErr)
+		if ok {
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Main runs the overlay plugin.
+func Main() {
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}), version.All, bv.BuildString("overlay"))
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	n, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return ns.OpenError(args.Netns, err)
+	}
+	defer netns.Close()
+
+	if n.IPAM.Type != "" {
+		// run the IPAM plugin and get back the config to apply
+		err = ipam.ExecCheck(n.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Parse previous result.
+	if n.NetConf.RawPrevResult == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+
+	if err := version.ParsePrevResult(&n.NetConf); err != nil {
+		return err
+	}
+
+	result, err := current.NewResultFromResult(n.PrevResult)
+	if err != nil {
+		return err
+	}
+
+	vtep, err := netlink.LinkByName(n.Vtep)
+	if err != nil {
+		return fmt.Errorf("%s device %q not found", n.Encapsulation, n.Vtep)
+	}
+	if err := checkVtep(n, vtep); err != nil {
+		return err
+	}
+	br, err := netlink.LinkByName(n.BrName)
+	if err != nil {
+		return fmt.Errorf("bridge %q not found", n.BrName)
+	}
+	if vtep.Attrs().MasterIndex != br.Attrs().Index {
+		return fmt.Errorf("%q is not attached to bridge %q", n.Vtep, n.BrName)
+	}
+
+	var contIntf *current.Interface
+	for _, intf := range result.Interfaces {
+		if intf.Name == args.IfName && intf.Sandbox == args.Netns {
+			contIntf = intf
+		}
+	}
+	if contIntf == nil {
+		return fmt.Errorf("interface %q in netns %q not found in prevResult", args.IfName, args.Netns)
+	}
+
+	// Check prevResults for ips, routes and dns against values found in the container
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return fmt.Errorf("container interface %q not found", args.IfName)
+		}
+		if _, isVeth := link.(*netlink.Veth); !isVeth {
+			return fmt.Errorf("container interface %q is not a veth", args.IfName)
+		}
+		if contIntf.Mac != "" && contIntf.Mac != link.Attrs().HardwareAddr.String() {
+			return fmt.Errorf("interface %s Mac %s doesn't match container Mac: %s", args.IfName, contIntf.Mac, link.Attrs().HardwareAddr)
+		}
+
+		err = ip.ValidateExpectedInterfaceIPs(args.IfName, result.IPs)
+		if err != nil {
+			return err
+		}
+
+		return ip.ValidateExpectedRoute(result.Routes)
+	})
+}
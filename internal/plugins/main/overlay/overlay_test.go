@@ -0,0 +1,271 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package overlay
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+)
+
+// fdbEntries returns the permanent forwarding entries of the VTEP as
+// "mac dst" strings.
+func fdbEntries(vtep string) []string {
+	link, err := netlink.LinkByName(vtep)
+	Expect(err).NotTo(HaveOccurred())
+	neighs, err := netlink.NeighList(link.Attrs().Index, syscall.AF_BRIDGE)
+	Expect(err).NotTo(HaveOccurred())
+
+	var entries []string
+	for _, n := range neighs {
+		if n.IP != nil && n.State&netlink.NUD_PERMANENT != 0 {
+			entries = append(entries, fmt.Sprintf("%s %s", n.HardwareAddr, n.IP))
+		}
+	}
+	return entries
+}
+
+var _ = Describe("overlay config", func() {
+	DescribeTable("rejects invalid configurations",
+		func(conf, msg string) {
+			_, err := loadNetConf([]byte(conf))
+			Expect(err).To(MatchError(ContainSubstring(msg)))
+		},
+		Entry("unknown encapsulation", `{"encapsulation": "gre", "vni": 1}`, `invalid encapsulation "gre"`),
+		Entry("missing VNI", `{}`, "invalid VNI 0"),
+		Entry("oversized VNI", `{"vni": 16777216}`, "invalid VNI 16777216"),
+		Entry("remote and peers", `{"vni": 1, "remote": "192.0.2.2", "peers": [{"ip": "192.0.2.3"}]}`, "remote cannot be combined with peers"),
+		Entry("multicast without device", `{"vni": 1, "remote": "239.1.1.1"}`, "a multicast remote requires a device"),
+		Entry("geneve without remote", `{"encapsulation": "geneve", "vni": 1}`, "geneve requires a unicast remote"),
+	)
+
+	It("fills in defaults", func() {
+		n, err := loadNetConf([]byte(`{"vni": 42}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.Encapsulation).To(Equal("vxlan"))
+		Expect(n.Vtep).To(Equal("vx42"))
+		Expect(n.BrName).To(Equal("ovl42"))
+		Expect(n.Port).To(Equal(4789))
+
+		n, err = loadNetConf([]byte(`{"encapsulation": "geneve", "vni": 42, "remote": "192.0.2.2"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.Vtep).To(Equal("gnv42"))
+		Expect(n.Port).To(Equal(6081))
+	})
+})
+
+var _ = Describe("overlay Operations", func() {
+	var originalNS, targetNS ns.NetNS
+	var dataDir string
+
+	BeforeEach(func() {
+		// Create a new NetNS so we don't modify the host
+		var err error
+		originalNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		targetNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		dataDir, err = os.MkdirTemp("", "overlay_test")
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			// Add the underlay
+			err = netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: "eth0",
+					MTU:  1500,
+				},
+				PeerName: "eth0p",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			link, err := netlink.LinkByName("eth0")
+			Expect(err).NotTo(HaveOccurred())
+			addr, err := netlink.ParseAddr("192.0.2.1/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(link, addr)).To(Succeed())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(originalNS)).To(Succeed())
+		Expect(targetNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(targetNS)).To(Succeed())
+	})
+
+	It("attaches a pod to a vxlan overlay with ADD/CHECK/DEL", func() {
+		const IFNAME = "eth1"
+		peersFile := filepath.Join(dataDir, "peers.json")
+		Expect(os.WriteFile(peersFile, []byte(`[{"ip": "192.0.2.3"}]`), 0o644)).To(Succeed())
+
+		conf := fmt.Sprintf(`{
+		    "cniVersion": "1.0.0",
+		    "name": "mynet",
+		    "type": "overlay",
+		    "vni": 42,
+		    "device": "eth0",
+		    "local": "192.0.2.1",
+		    "peers": [{"ip": "192.0.2.2", "macs": ["0a:58:0a:01:02:03"]}],
+		    "peersFile": "%s",
+		    "ipam": {
+			"type": "host-local",
+			"subnet": "10.1.2.0/24",
+			"dataDir": "%s"
+		    }
+		}`, peersFile, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		var result types.Result
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			var err error
+			result, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			vtep, err := netlink.LinkByName("vx42")
+			Expect(err).NotTo(HaveOccurred())
+			vxlan, ok := vtep.(*netlink.Vxlan)
+			Expect(ok).To(BeTrue())
+			Expect(vxlan.VxlanId).To(Equal(42))
+			Expect(vxlan.MTU).To(Equal(1450))
+
+			br, err := netlink.LinkByName("ovl42")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(vtep.Attrs().MasterIndex).To(Equal(br.Attrs().Index))
+
+			Expect(fdbEntries("vx42")).To(ConsistOf(
+				"00:00:00:00:00:00 192.0.2.2",
+				"0a:58:0a:01:02:03 192.0.2.2",
+				"00:00:00:00:00:00 192.0.2.3",
+			))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		r, err := types100.GetResult(result)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.Interfaces).To(HaveLen(3))
+		Expect(r.Interfaces[0].Name).To(Equal("ovl42"))
+		Expect(r.IPs).To(HaveLen(1))
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().MTU).To(Equal(1450))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		checkArgs := *args
+		checkArgs.StdinData = []byte(fmt.Sprintf(`{
+		    "cniVersion": "1.0.0",
+		    "name": "mynet",
+		    "type": "overlay",
+		    "vni": 42,
+		    "prevResult": {
+			"cniVersion": "1.0.0",
+			"interfaces": [{"name": "%s", "mac": "%s", "sandbox": "%s"}]
+		    }
+		}`, IFNAME, r.Interfaces[2].Mac, targetNS.Path()))
+		err = originalNS.Do(func(ns.NetNS) error {
+			return testutils.CmdCheckWithArgs(&checkArgs, func() error {
+				return cmdCheck(&checkArgs)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// the overlay itself stays for other pods
+			_, err = netlink.LinkByName("vx42")
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := netlink.LinkByName(IFNAME)
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("follows changes of the peers file", func() {
+		peersFile := filepath.Join(dataDir, "peers.json")
+		Expect(os.WriteFile(peersFile, []byte(`[{"ip": "192.0.2.2"}, {"ip": "192.0.2.3"}]`), 0o644)).To(Succeed())
+
+		n, err := loadNetConf([]byte(fmt.Sprintf(`{"vni": 7, "peersFile": "%s"}`, peersFile)))
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := setupOverlay(n)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fdbEntries("vx7")).To(ConsistOf(
+				"00:00:00:00:00:00 192.0.2.2",
+				"00:00:00:00:00:00 192.0.2.3",
+			))
+
+			Expect(os.WriteFile(peersFile, []byte(`[{"ip": "192.0.2.3"}, {"ip": "192.0.2.4"}]`), 0o644)).To(Succeed())
+			_, _, err = setupOverlay(n)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fdbEntries("vx7")).To(ConsistOf(
+				"00:00:00:00:00:00 192.0.2.3",
+				"00:00:00:00:00:00 192.0.2.4",
+			))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,250 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package overlay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	encapVxlan  = "vxlan"
+	encapGeneve = "geneve"
+
+	defaultVxlanPort  = 4789
+	defaultGenevePort = 6081
+
+	// outer IPv4 + UDP + VXLAN/Geneve header + inner ethernet header
+	encapOverheadV4 = 50
+	encapOverheadV6 = 70
+)
+
+var zeroMAC = net.HardwareAddr{0, 0, 0, 0, 0, 0}
+
+// Peer is a remote VTEP of the overlay. MACs optionally lists the addresses
+// known to live behind it, which saves flooding for them.
+type Peer struct {
+	IP   string   `json:"ip"`
+	MACs []string `json:"macs,omitempty"`
+}
+
+// loadPeers returns the peers from the config followed by the ones in the
+// peers file, if any. A missing peers file means no extra peers.
+func loadPeers(n *NetConf) ([]Peer, error) {
+	peers := append([]Peer{}, n.Peers...)
+	if n.PeersFile != "" {
+		data, err := os.ReadFile(n.PeersFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read peers file %q: %v", n.PeersFile, err)
+		}
+		if err == nil {
+			var filePeers []Peer
+			if err := json.Unmarshal(data, &filePeers); err != nil {
+				return nil, fmt.Errorf("failed to parse peers file %q: %v", n.PeersFile, err)
+			}
+			peers = append(peers, filePeers...)
+		}
+	}
+
+	for _, p := range peers {
+		if net.ParseIP(p.IP) == nil {
+			return nil, fmt.Errorf("invalid peer IP %q", p.IP)
+		}
+		for _, m := range p.MACs {
+			if _, err := net.ParseMAC(m); err != nil {
+				return nil, fmt.Errorf("invalid MAC %q for peer %s: %v", m, p.IP, err)
+			}
+		}
+	}
+	return peers, nil
+}
+
+// vtepMTU returns the MTU for the overlay, leaving room for the
+// encapsulation on the underlay device.
+func vtepMTU(n *NetConf, underlay netlink.Link) int {
+	if n.MTU != 0 {
+		return n.MTU
+	}
+	mtu := 1500
+	if underlay != nil {
+		mtu = underlay.Attrs().MTU
+	}
+	overhead := encapOverheadV4
+	if n.remote != nil && n.remote.To4() == nil || n.local != nil && n.local.To4() == nil {
+		overhead = encapOverheadV6
+	}
+	return mtu - overhead
+}
+
+// ensureVtep creates the VXLAN or Geneve device for the network, or checks
+// an existing one carries the configured VNI.
+func ensureVtep(n *NetConf) (netlink.Link, error) {
+	var underlay netlink.Link
+	if n.Device != "" {
+		var err error
+		if underlay, err = netlink.LinkByName(n.Device); err != nil {
+			return nil, fmt.Errorf("failed to lookup device %q: %v", n.Device, err)
+		}
+	}
+
+	if l, err := netlink.LinkByName(n.Vtep); err == nil {
+		if err := checkVtep(n, l); err != nil {
+			return nil, err
+		}
+		return l, netlink.LinkSetUp(l)
+	}
+
+	attrs := netlink.LinkAttrs{
+		Name: n.Vtep,
+		MTU:  vtepMTU(n, underlay),
+	}
+
+	var vtep netlink.Link
+	switch n.Encapsulation {
+	case encapVxlan:
+		vxlan := &netlink.Vxlan{
+			LinkAttrs: attrs,
+			VxlanId:   n.VNI,
+			SrcAddr:   n.local,
+			Group:     n.remote,
+			Port:      n.Port,
+			Learning:  true,
+		}
+		if underlay != nil {
+			vxlan.VtepDevIndex = underlay.Attrs().Index
+		}
+		vtep = vxlan
+	case encapGeneve:
+		geneve := &netlink.Geneve{
+			LinkAttrs: attrs,
+			ID:        uint32(n.VNI),
+			Remote:    n.remote,
+			Dport:     uint16(n.Port),
+		}
+		if underlay != nil {
+			geneve.Link = uint32(underlay.Attrs().Index)
+		}
+		vtep = geneve
+	}
+
+	if err := netlink.LinkAdd(vtep); err != nil && err != syscall.EEXIST {
+		return nil, fmt.Errorf("failed to create %s device %q: %v", n.Encapsulation, n.Vtep, err)
+	}
+
+	// Re-fetch link to read all attributes and if it already existed,
+	// ensure it's really the VTEP we want
+	l, err := netlink.LinkByName(n.Vtep)
+	if err != nil {
+		return nil, fmt.Errorf("could not lookup %q: %v", n.Vtep, err)
+	}
+	if err := checkVtep(n, l); err != nil {
+		return nil, err
+	}
+	if err := netlink.LinkSetUp(l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func checkVtep(n *NetConf, l netlink.Link) error {
+	switch v := l.(type) {
+	case *netlink.Vxlan:
+		if n.Encapsulation != encapVxlan {
+			return fmt.Errorf("%q already exists but is a vxlan device", n.Vtep)
+		}
+		if v.VxlanId != n.VNI {
+			return fmt.Errorf("vxlan device %q has VNI %d, expected %d", n.Vtep, v.VxlanId, n.VNI)
+		}
+	case *netlink.Geneve:
+		if n.Encapsulation != encapGeneve {
+			return fmt.Errorf("%q already exists but is a geneve device", n.Vtep)
+		}
+		if int(v.ID) != n.VNI {
+			return fmt.Errorf("geneve device %q has VNI %d, expected %d", n.Vtep, v.ID, n.VNI)
+		}
+	default:
+		return fmt.Errorf("%q already exists but is not a %s device", n.Vtep, n.Encapsulation)
+	}
+	return nil
+}
+
+// syncFDB makes the permanent forwarding entries of the VXLAN device match
+// peers: an all-zeros entry per peer so broadcast and unknown unicast is
+// replicated to every VTEP, and one entry per known MAC. Entries for peers
+// which went away are removed; learned entries are left alone.
+func syncFDB(vtep netlink.Link, peers []Peer) error {
+	type fdbKey struct{ mac, ip string }
+
+	want := map[fdbKey]bool{}
+	for _, p := range peers {
+		peerIP := net.ParseIP(p.IP)
+		want[fdbKey{zeroMAC.String(), peerIP.String()}] = true
+		for _, m := range p.MACs {
+			mac, _ := net.ParseMAC(m)
+			want[fdbKey{mac.String(), peerIP.String()}] = true
+		}
+	}
+
+	existing, err := netlink.NeighList(vtep.Attrs().Index, syscall.AF_BRIDGE)
+	if err != nil {
+		return fmt.Errorf("failed to list fdb entries of %q: %v", vtep.Attrs().Name, err)
+	}
+	have := map[fdbKey]bool{}
+	for i := range existing {
+		e := existing[i]
+		if e.IP == nil || e.State&netlink.NUD_PERMANENT == 0 {
+			continue
+		}
+		key := fdbKey{e.HardwareAddr.String(), e.IP.String()}
+		if want[key] {
+			have[key] = true
+			continue
+		}
+		if err := netlink.NeighDel(&e); err != nil {
+			return fmt.Errorf("failed to remove fdb entry %s dst %s: %v", key.mac, key.ip, err)
+		}
+	}
+
+	for key := range want {
+		if have[key] {
+			continue
+		}
+		mac, _ := net.ParseMAC(key.mac)
+		entry := &netlink.Neigh{
+			LinkIndex:    vtep.Attrs().Index,
+			Family:       syscall.AF_BRIDGE,
+			State:        netlink.NUD_PERMANENT,
+			Flags:        netlink.NTF_SELF,
+			IP:           net.ParseIP(key.ip),
+			HardwareAddr: mac,
+		}
+		// the all-zeros entry exists once per peer, so it has to be appended
+		add := netlink.NeighSet
+		if bytes.Equal(mac, zeroMAC) {
+			add = netlink.NeighAppend
+		}
+		if err := add(entry); err != nil {
+			return fmt.Errorf("failed to add fdb entry %s dst %s: %v", key.mac, key.ip, err)
+		}
+	}
+
+	return nil
+}
@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package ptp
 
 import (
 	"encoding/json"
@@ -28,11 +28,16 @@ import (
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/include"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/link"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/utils"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 )
 
 func init() {
@@ -44,11 +49,74 @@ func init() {
 
 type NetConf struct {
 	types.NetConf
-	IPMasq bool `json:"ipMasq"`
-	MTU    int  `json:"mtu"`
+	IPMasq            bool   `json:"ipMasq"`
+	IPMasqPortRange   string `json:"ipMasqPortRange,omitempty"`
+	IPMasqRandomFully bool   `json:"ipMasqRandomFully,omitempty"`
+	IPMasqMark        uint32 `json:"ipMasqMark,omitempty"`
+	MTU               int    `json:"mtu"`
+	HostIfaceTemplate string `json:"hostInterfaceTemplate,omitempty"`
+
+	// ProxyARP and ProxyNDP make ProxyInterfaces, typically the host's
+	// uplinks, answer for the container's addresses so it is reachable
+	// from their LAN without NAT
+	ProxyARP        bool     `json:"proxyARP,omitempty"`
+	ProxyNDP        bool     `json:"proxyNDP,omitempty"`
+	ProxyInterfaces []string `json:"proxyInterfaces,omitempty"`
+
+	// StaticNAT maps the container's IPv4 address 1:1 to a public one
+	// on a host interface
+	StaticNAT *ip.StaticNAT `json:"staticNAT,omitempty"`
 }
 
-func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, pr *current.Result) (*current.Interface, *current.Interface, error) {
+func (n *NetConf) proxyNeighbors() *ip.ProxyNeighbors {
+	return &ip.ProxyNeighbors{ARP: n.ProxyARP, NDP: n.ProxyNDP, Interfaces: n.ProxyInterfaces}
+}
+
+func (n *NetConf) masqOptions() *ip.MasqOptions {
+	return &ip.MasqOptions{PortRange: n.IPMasqPortRange, RandomFully: n.IPMasqRandomFully, Mark: n.IPMasqMark}
+}
+
+// staticNATChains returns the DNAT and SNAT chains of the container.
+func (n *NetConf) staticNATChains(containerID string) (string, string) {
+	return utils.MustFormatChainNameWithPrefix(n.Name, containerID, "SD-"),
+		utils.MustFormatChainNameWithPrefix(n.Name, containerID, "SS-")
+}
+
+// firstIPv4 returns the first IPv4 address of ips, the one mapped by
+// staticNAT.
+func firstIPv4(ips []*current.IPConfig) *net.IPNet {
+	for _, ipc := range ips {
+		if ipc.Address.IP.To4() != nil {
+			return &ipc.Address
+		}
+	}
+	return nil
+}
+
+// delAddrs returns the addresses removed along with the container
+// interface or, if the container is gone, the ones of prevResult.
+func delAddrs(conf *NetConf, ipnets []*net.IPNet) []net.IP {
+	var addrs []net.IP
+	for _, ipn := range ipnets {
+		addrs = append(addrs, ipn.IP)
+	}
+	if len(addrs) > 0 || conf.RawPrevResult == nil {
+		return addrs
+	}
+	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+		return nil
+	}
+	result, err := current.NewResultFromResult(conf.PrevResult)
+	if err != nil {
+		return nil
+	}
+	for _, ipc := range result.IPs {
+		addrs = append(addrs, ipc.Address.IP)
+	}
+	return addrs
+}
+
+func setupContainerVeth(netns ns.NetNS, ifName, hostIfName string, mtu int, pr *current.Result) (*current.Interface, *current.Interface, error) {
 	// The IPAM result will be something like IP=192.168.3.5/24, GW=192.168.3.1.
 	// What we want is really a point-to-point link but veth does not support IFF_POINTTOPOINT.
 	// Next best thing would be to let it ARP but set interface to 192.168.3.5/32 and
@@ -64,7 +132,7 @@ func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, pr *current.Resu
 	containerInterface := &current.Interface{}
 
 	err := netns.Do(func(hostNS ns.NetNS) error {
-		hostVeth, contVeth0, err := ip.SetupVeth(ifName, mtu, "", hostNS)
+		hostVeth, contVeth0, err := ip.SetupVethWithName(ifName, hostIfName, mtu, "", hostNS)
 		if err != nil {
 			return err
 		}
@@ -182,9 +250,29 @@ func setupHostVeth(vethName string, result *current.Result) error {
 
 func cmdAdd(args *skel.CmdArgs) error {
 	conf := NetConf{}
+	if err := config.Validate(args.StdinData, &conf); err != nil {
+		return fmt.Errorf("invalid network configuration: %v", err)
+	}
 	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
 		return fmt.Errorf("failed to load netconf: %v", err)
 	}
+	if err := link.ValidateHostIfaceNameTemplate(conf.HostIfaceTemplate); err != nil {
+		return err
+	}
+	if err := conf.proxyNeighbors().Validate(); err != nil {
+		return err
+	}
+	if err := conf.masqOptions().Validate(); err != nil {
+		return err
+	}
+	if conf.masqOptions().Enabled() && !conf.IPMasq {
+		return fmt.Errorf("ipMasqPortRange, ipMasqRandomFully and ipMasqMark require ipMasq")
+	}
+	if conf.StaticNAT != nil {
+		if err := conf.StaticNAT.Validate(); err != nil {
+			return err
+		}
+	}
 
 	// run the IPAM plugin and get back the config to apply
 	r, err := ipam.ExecAdd(conf.IPAM.Type, args.StdinData)
@@ -209,17 +297,30 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return errors.New("IPAM plugin returned missing IP config")
 	}
 
-	if err := ip.EnableForward(result.IPs); err != nil {
+	// Turn forwarding and neighbor proxying off again if the ADD fails,
+	// unless they were on before
+	forwarding := sysctl.NewTx()
+	if err = ip.EnableForwardTx(forwarding, result.IPs); err != nil {
 		return fmt.Errorf("Could not enable IP forwarding: %v", err)
 	}
+	defer func() {
+		if err != nil {
+			_ = forwarding.Rollback()
+		}
+	}()
 
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+		return ns.OpenError(args.Netns, err)
 	}
 	defer netns.Close()
 
-	hostInterface, _, err := setupContainerVeth(netns, args.IfName, conf.MTU, result)
+	hostIfName, err := link.HostIfaceName(conf.HostIfaceTemplate, link.NewHostIfaceNameData(args.ContainerID, args.IfName, args.Args))
+	if err != nil {
+		return err
+	}
+
+	hostInterface, _, err := setupContainerVeth(netns, args.IfName, hostIfName, conf.MTU, result)
 	if err != nil {
 		return err
 	}
@@ -228,31 +329,49 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
+	if proxy := conf.proxyNeighbors(); proxy.Enabled() {
+		var addrs []net.IP
+		for _, ipc := range result.IPs {
+			addrs = append(addrs, ipc.Address.IP)
+		}
+		if err = proxy.Setup(forwarding, addrs); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				_ = proxy.Teardown(addrs)
+			}
+		}()
+	}
+
 	if conf.IPMasq {
 		chain := utils.FormatChainName(conf.Name, args.ContainerID)
 		comment := utils.FormatComment(conf.Name, args.ContainerID)
 		for _, ipc := range result.IPs {
-			if err = ip.SetupIPMasq(&ipc.Address, chain, comment); err != nil {
+			if err = ip.SetupIPMasqWithOptions(&ipc.Address, chain, comment, conf.masqOptions()); err != nil {
 				return err
 			}
 		}
 	}
 
-	// Only override the DNS settings in the previous result if any DNS fields
-	// were provided to the ptp plugin. This allows, for example, IPAM plugins
-	// to specify the DNS settings instead of the ptp plugin.
-	if dnsConfSet(conf.DNS) {
-		result.DNS = conf.DNS
+	if conf.StaticNAT != nil {
+		addr := firstIPv4(result.IPs)
+		if addr == nil {
+			return fmt.Errorf("staticNAT requires an IPv4 address, IPAM returned none")
+		}
+		dnatChain, snatChain := conf.staticNATChains(args.ContainerID)
+		comment := utils.FormatComment(conf.Name, args.ContainerID)
+		if err = conf.StaticNAT.Setup(addr, dnatChain, snatChain, comment); err != nil {
+			_ = conf.StaticNAT.Teardown(dnatChain, snatChain, comment)
+			return err
+		}
 	}
 
-	return types.PrintResult(result, conf.CNIVersion)
-}
+	// The IPAM plugin may have combined the DNS settings with the ones of
+	// the network configuration already, see the host-local dnsPolicy
+	result.DNS = ipam.ResultDNS(result.DNS, conf.DNS)
 
-func dnsConfSet(dnsConf types.DNS) bool {
-	return dnsConf.Nameservers != nil ||
-		dnsConf.Search != nil ||
-		dnsConf.Options != nil ||
-		dnsConf.Domain != ""
+	return types.PrintResult(result, conf.CNIVersion)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
@@ -265,8 +384,16 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	}
 
+	// The mapping needs no container address to be undone
+	if conf.StaticNAT != nil {
+		dnatChain, snatChain := conf.staticNATChains(args.ContainerID)
+		if err := conf.StaticNAT.Teardown(dnatChain, snatChain, utils.FormatComment(conf.Name, args.ContainerID)); err != nil {
+			return err
+		}
+	}
+
 	if args.Netns == "" {
-		return nil
+		return conf.proxyNeighbors().Teardown(delAddrs(&conf, nil))
 	}
 
 	// There is a netns so try to clean up. Delete can be called multiple times
@@ -286,10 +413,23 @@ func cmdDel(args *skel.CmdArgs) error {
 		// so don't return an error if the device is already removed.
 		// https://github.com/kubernetes/kubernetes/issues/43014#issuecomment-287164444
 		_, ok := err.(ns.NSPathNotExistErr)
-		if ok {
-			return nil
+		if !ok {
+			return err
+		}
+		// The veth went away with the netns, and its addresses with it, but
+		// their masquerading is still to be undone.
+		if conf.IPMasq {
+			if err := ip.TeardownIPMasqChain(utils.FormatChainName(conf.Name, args.ContainerID)); err != nil {
+				return err
+			}
+		}
+		return conf.proxyNeighbors().Teardown(delAddrs(&conf, nil))
+	}
+
+	if proxy := conf.proxyNeighbors(); proxy.Enabled() {
+		if err := proxy.Teardown(delAddrs(&conf, ipnets)); err != nil {
+			return err
 		}
-		return err
 	}
 
 	if len(ipnets) != 0 && conf.IPMasq {
@@ -303,19 +443,23 @@ func cmdDel(args *skel.CmdArgs) error {
 	return err
 }
 
-func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("ptp"))
+// Main runs the ptp plugin.
+func Main() {
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}), version.All, bv.BuildString("ptp"))
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
 	conf := NetConf{}
+	if err := config.Validate(args.StdinData, &conf); err != nil {
+		return fmt.Errorf("invalid network configuration: %v", err)
+	}
 	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
 		return fmt.Errorf("failed to load netconf: %v", err)
 	}
 
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+		return ns.OpenError(args.Netns, err)
 	}
 	defer netns.Close()
 
@@ -376,6 +520,17 @@ func cmdCheck(args *skel.CmdArgs) error {
 		return err
 	}
 
+	if conf.StaticNAT != nil {
+		addr := firstIPv4(result.IPs)
+		if addr == nil {
+			return fmt.Errorf("staticNAT requires an IPv4 address, prevResult has none")
+		}
+		dnatChain, snatChain := conf.staticNATChains(args.ContainerID)
+		if err := conf.StaticNAT.Check(addr, dnatChain, snatChain, utils.FormatComment(conf.Name, args.ContainerID)); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
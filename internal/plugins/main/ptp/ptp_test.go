@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package ptp
 
 import (
 	"encoding/json"
@@ -31,6 +31,7 @@ import (
 	types100 "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
 )
 
@@ -336,6 +337,208 @@ var _ = Describe("ptp Operations", func() {
 		Expect(err).NotTo(HaveOccurred())
 	}
 
+	It("answers ARP and NDP for the container's addresses on the proxy interfaces", func() {
+		const IFNAME = "ptp0"
+
+		conf := fmt.Sprintf(`{
+		    "cniVersion": "1.0.0",
+		    "name": "mynet",
+		    "type": "ptp",
+		    "proxyARP": true,
+		    "proxyNDP": true,
+		    "proxyInterfaces": ["uplink0"],
+		    "ipam": {
+			"type": "host-local",
+			"dataDir": "%s",
+			"ranges": [
+				[{ "subnet": "10.1.2.0/24" }],
+				[{ "subnet": "2001:db8:1::/64" }]
+			]
+		    }
+		}`, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "uplink0"},
+				PeerName:  "uplink0-peer",
+			})).To(Succeed())
+			uplink, err := netlink.LinkByName("uplink0")
+			Expect(err).NotTo(HaveOccurred())
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(2))
+
+			for i, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+				proxies, err := netlink.NeighProxyList(uplink.Attrs().Index, family)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(proxies).To(HaveLen(1))
+				Expect(proxies[0].IP.Equal(result.IPs[i].Address.IP)).To(BeTrue())
+			}
+			value, err := sysctl.Sysctl("net/ipv4/conf/uplink0/proxy_arp")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal("1"))
+
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+
+			for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+				proxies, err := netlink.NeighProxyList(uplink.Attrs().Index, family)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(proxies).To(BeEmpty())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects proxying without proxy interfaces", func() {
+		conf := fmt.Sprintf(`{
+		    "cniVersion": "1.0.0",
+		    "name": "mynet",
+		    "type": "ptp",
+		    "proxyARP": true,
+		    "ipam": {
+			"type": "host-local",
+			"dataDir": "%s",
+			"subnet": "10.1.2.0/24"
+		    }
+		}`, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      "ptp0",
+			StdinData:   []byte(conf),
+		}
+		err := originalNS.Do(func(ns.NetNS) error {
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			return err
+		})
+		Expect(err).To(MatchError("proxyARP and proxyNDP require proxyInterfaces"))
+	})
+
+	It("maps the container 1:1 to the public address on the static NAT interface", func() {
+		conf := fmt.Sprintf(`{
+		    "cniVersion": "1.0.0",
+		    "name": "mynet",
+		    "type": "ptp",
+		    "ipMasq": true,
+		    "staticNAT": {
+			"publicIP": "192.0.2.10",
+			"interface": "uplink0"
+		    },
+		    "ipam": {
+			"type": "host-local",
+			"dataDir": "%s",
+			"subnet": "10.1.2.0/24"
+		    }
+		}`, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      "ptp0",
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "uplink0"},
+				PeerName:  "uplink0-peer",
+			})).To(Succeed())
+			uplink, err := netlink.LinkByName("uplink0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(uplink)).To(Succeed())
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			addrs, err := netlink.AddrList(uplink, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(HaveLen(1))
+			Expect(addrs[0].IPNet.String()).To(Equal("192.0.2.10/32"))
+
+			// CHECK verifies the address and the rules
+			var checkConf map[string]interface{}
+			Expect(json.Unmarshal([]byte(conf), &checkConf)).To(Succeed())
+			checkConf["prevResult"] = result
+			checkArgs := *args
+			checkArgs.StdinData, err = json.Marshal(checkConf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(testutils.CmdCheckWithArgs(&checkArgs, func() error {
+				return cmdCheck(&checkArgs)
+			})).To(Succeed())
+
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+
+			addrs, err = netlink.AddrList(uplink, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(BeEmpty())
+			err = testutils.CmdCheckWithArgs(&checkArgs, func() error {
+				return cmdCheck(&checkArgs)
+			})
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects static NAT to an IPv6 address", func() {
+		conf := fmt.Sprintf(`{
+		    "cniVersion": "1.0.0",
+		    "name": "mynet",
+		    "type": "ptp",
+		    "staticNAT": {
+			"publicIP": "2001:db8::10",
+			"interface": "uplink0"
+		    },
+		    "ipam": {
+			"type": "host-local",
+			"dataDir": "%s",
+			"subnet": "10.1.2.0/24"
+		    }
+		}`, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      "ptp0",
+			StdinData:   []byte(conf),
+		}
+		err := originalNS.Do(func(ns.NetNS) error {
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			return err
+		})
+		Expect(err).To(MatchError(`invalid staticNAT publicIP "2001:db8::10", must be an IPv4 address`))
+	})
+
 	for _, ver := range testutils.AllSpecVersions {
 		// Redefine ver inside for scope so real value is picked up by each dynamically defined It()
 		// See Gingkgo's "Patterns for dynamically generating tests" documentation.
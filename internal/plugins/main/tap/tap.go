@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package tap
 
 import (
 	"encoding/json"
@@ -32,6 +32,10 @@ import (
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/cniargs"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/include"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
@@ -41,23 +45,13 @@ import (
 
 type NetConf struct {
 	types.NetConf
-	MultiQueue     bool      `json:"multiQueue"`
-	MTU            int       `json:"mtu"`
-	Mac            string    `json:"mac,omitempty"`
-	Owner          *uint32   `json:"owner,omitempty"`
-	Group          *uint32   `json:"group,omitempty"`
-	SelinuxContext string    `json:"selinuxContext,omitempty"`
-	Bridge         string    `json:"bridge,omitempty"`
-	Args           *struct{} `json:"args,omitempty"`
-	RuntimeConfig  struct {
-		Mac string `json:"mac,omitempty"`
-	} `json:"runtimeConfig,omitempty"`
-}
-
-// MacEnvArgs represents CNI_ARG
-type MacEnvArgs struct {
-	types.CommonArgs
-	MAC types.UnmarshallableString `json:"mac,omitempty"`
+	MultiQueue     bool    `json:"multiQueue"`
+	MTU            int     `json:"mtu"`
+	Mac            string  `json:"mac,omitempty"`
+	Owner          *uint32 `json:"owner,omitempty"`
+	Group          *uint32 `json:"group,omitempty"`
+	SelinuxContext string  `json:"selinuxContext,omitempty"`
+	Bridge         string  `json:"bridge,omitempty"`
 }
 
 func init() {
@@ -69,23 +63,18 @@ func init() {
 
 func loadConf(args *skel.CmdArgs) (*NetConf, string, error) {
 	n := &NetConf{}
+	if err := config.Validate(args.StdinData, n); err != nil {
+		return nil, "", fmt.Errorf("invalid network configuration: %v", err)
+	}
 	if err := json.Unmarshal(args.StdinData, n); err != nil {
 		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
 	}
-	if args.Args != "" {
-		e := MacEnvArgs{}
-		err := types.LoadArgs(args.Args, &e)
-		if err != nil {
-			return nil, "", err
-		}
-
-		if e.MAC != "" {
-			n.Mac = string(e.MAC)
-		}
+	a, err := cniargs.Parse(args.Args, args.StdinData)
+	if err != nil {
+		return nil, "", err
 	}
-
-	if n.RuntimeConfig.Mac != "" {
-		n.Mac = n.RuntimeConfig.Mac
+	if mac := a.MAC(); mac != "" {
+		n.Mac = mac
 	}
 
 	return n, n.CNIVersion, nil
@@ -256,7 +245,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", netns, err)
+		return ns.OpenError(args.Netns, err)
 	}
 	defer netns.Close()
 
@@ -386,8 +375,9 @@ func cmdDel(args *skel.CmdArgs) error {
 	return err
 }
 
-func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("tap"))
+// Main runs the tap plugin.
+func Main() {
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}), version.All, bv.BuildString("tap"))
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
@@ -399,7 +389,7 @@ func cmdCheck(args *skel.CmdArgs) error {
 
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+		return ns.OpenError(args.Netns, err)
 	}
 	defer netns.Close()
 
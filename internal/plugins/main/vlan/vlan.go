@@ -12,13 +12,14 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package vlan
 
 import (
 	"encoding/json"
 	"errors"
 	"fmt"
 	"runtime"
+	"time"
 
 	"github.com/vishvananda/netlink"
 
@@ -26,8 +27,12 @@ import (
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/include"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/link"
 	"github.com/containernetworking/plugins/pkg/ns"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 )
@@ -38,6 +43,9 @@ type NetConf struct {
 	VlanID     int    `json:"vlanId"`
 	MTU        int    `json:"mtu,omitempty"`
 	LinkContNs bool   `json:"linkInContainer,omitempty"`
+	MasterWait string `json:"masterWait,omitempty"`
+
+	masterWait time.Duration
 }
 
 func init() {
@@ -49,6 +57,9 @@ func init() {
 
 func loadConf(args *skel.CmdArgs) (*NetConf, string, error) {
 	n := &NetConf{}
+	if err := config.Validate(args.StdinData, n); err != nil {
+		return nil, "", fmt.Errorf("invalid network configuration: %v", err)
+	}
 	if err := json.Unmarshal(args.StdinData, n); err != nil {
 		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
 	}
@@ -58,9 +69,13 @@ func loadConf(args *skel.CmdArgs) (*NetConf, string, error) {
 	if n.VlanID < 0 || n.VlanID > 4094 {
 		return nil, "", fmt.Errorf("invalid VLAN ID %d (must be between 0 and 4095 inclusive)", n.VlanID)
 	}
+	var err error
+	if n.masterWait, err = link.ParseWait("masterWait", n.MasterWait); err != nil {
+		return nil, "", err
+	}
 
 	// check existing and MTU of master interface
-	masterMTU, err := getMTUByName(n.Master, args.Netns, n.LinkContNs)
+	masterMTU, err := getMTUByName(n.Master, args.Netns, n.LinkContNs, n.masterWait)
 	if err != nil {
 		return nil, "", err
 	}
@@ -70,8 +85,8 @@ func loadConf(args *skel.CmdArgs) (*NetConf, string, error) {
 	return n, n.CNIVersion, nil
 }
 
-func getMTUByName(ifName string, namespace string, inContainer bool) (int, error) {
-	var link netlink.Link
+func getMTUByName(ifName string, namespace string, inContainer bool, wait time.Duration) (int, error) {
+	var m netlink.Link
 	var err error
 	if inContainer {
 		var netns ns.NetNS
@@ -82,16 +97,16 @@ func getMTUByName(ifName string, namespace string, inContainer bool) (int, error
 		defer netns.Close()
 
 		err = netns.Do(func(_ ns.NetNS) error {
-			link, err = netlink.LinkByName(ifName)
+			m, err = link.WaitForLink(ifName, wait)
 			return err
 		})
 	} else {
-		link, err = netlink.LinkByName(ifName)
+		m, err = link.WaitForLink(ifName, wait)
 	}
 	if err != nil {
 		return 0, err
 	}
-	return link.Attrs().MTU, nil
+	return m.Attrs().MTU, nil
 }
 
 func createVlan(conf *NetConf, ifName string, netns ns.NetNS) (*current.Interface, error) {
@@ -172,7 +187,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+		return ns.OpenError(args.Netns, err)
 	}
 	defer netns.Close()
 
@@ -184,7 +199,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 	// run the IPAM plugin and get back the config to apply
 	r, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
 	if err != nil {
-		return fmt.Errorf("failed to execute IPAM delegate: %v", err)
+		return fmt.Errorf("failed to execute IPAM delegate: %w", err)
 	}
 
 	// Invoke ipam del if err to avoid ip leak
@@ -217,7 +232,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
-	result.DNS = n.DNS
+	result.DNS = ipam.ResultDNS(result.DNS, n.DNS)
 
 	return types.PrintResult(result, cniVersion)
 }
@@ -259,19 +274,23 @@ func cmdDel(args *skel.CmdArgs) error {
 	return err
 }
 
-func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("vlan"))
+// Main runs the vlan plugin.
+func Main() {
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}), version.All, bv.BuildString("vlan"))
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
 	conf := NetConf{}
+	if err := config.Validate(args.StdinData, &conf); err != nil {
+		return fmt.Errorf("invalid network configuration: %v", err)
+	}
 	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
 		return fmt.Errorf("failed to load netconf: %v", err)
 	}
 
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+		return ns.OpenError(args.Netns, err)
 	}
 	defer netns.Close()
 
@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package vlan
 
 import (
 	"encoding/json"
@@ -533,4 +533,29 @@ var _ = Describe("vlan Operations", func() {
 			})
 		}
 	}
+
+	It("times out waiting for a master that doesn't appear within masterWait", func() {
+		conf := `{
+		    "cniVersion": "1.0.0",
+		    "name": "mynet",
+		    "type": "vlan",
+		    "master": "wwan0",
+		    "vlanId": 1234,
+		    "masterWait": "200ms"
+		}`
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      "eth0",
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			return err
+		})
+		Expect(err).To(MatchError(ContainSubstring(`timed out after 200ms waiting for link "wwan0" to appear`)))
+	})
 })
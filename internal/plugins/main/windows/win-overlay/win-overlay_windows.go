@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package winoverlay
 
 import (
 	"encoding/json"
@@ -29,8 +29,12 @@ import (
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
 
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
 	"github.com/containernetworking/plugins/pkg/errors"
+	"github.com/containernetworking/plugins/pkg/gc"
 	"github.com/containernetworking/plugins/pkg/hns"
+	"github.com/containernetworking/plugins/pkg/include"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 )
@@ -51,6 +55,9 @@ func init() {
 
 func loadNetConf(bytes []byte) (*NetConf, string, error) {
 	n := &NetConf{}
+	if err := config.Validate(bytes, n); err != nil {
+		return nil, "", fmt.Errorf("invalid network configuration: %v", err)
+	}
 	if err := json.Unmarshal(bytes, n); err != nil {
 		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
 	}
@@ -281,11 +288,86 @@ func cmdDel(args *skel.CmdArgs) error {
 	return hns.RemoveHnsEndpoint(epName, args.Netns, args.ContainerID)
 }
 
-func cmdCheck(_ *skel.CmdArgs) error {
-	// TODO: implement
-	return nil
+// cmdCheck verifies that the endpoint of the container matches prevResult
+// and carries the policies an ADD would have given it.
+func cmdCheck(args *skel.CmdArgs) error {
+	n, _, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if n.IPAM.Type != "" {
+		if err := ipam.ExecCheck(n.IPAM.Type, args.StdinData); err != nil {
+			return err
+		}
+	}
+
+	if n.RawPrevResult == nil {
+		return fmt.Errorf("Required prevResult missing")
+	}
+	if err := version.ParsePrevResult(&n.NetConf.NetConf); err != nil {
+		return err
+	}
+	result, err := current.NewResultFromResult(n.PrevResult)
+	if err != nil {
+		return err
+	}
+
+	hnsNetwork, err := hcsshim.GetHNSNetworkByName(n.Name)
+	if err != nil {
+		return errors.Annotatef(err, "error while GETHNSNewtorkByName(%s)", n.Name)
+	}
+	n.ApplyDefaultPAPolicy(hnsNetwork.ManagementIP)
+	if n.IPMasq {
+		n.ApplyOutboundNatPolicy(hnsNetwork.Subnets[0].AddressPrefix)
+	}
+	if n.LoopbackDSR && len(result.IPs) > 0 {
+		ip := result.IPs[0].Address.IP.To4()
+		n.ApplyLoopbackDSRPolicy(&ip)
+	}
+
+	epName := hns.ConstructEndpointName(args.ContainerID, args.Netns, n.Name)
+	if n.ApiVersion == 2 {
+		hcnNetwork, err := hcn.GetNetworkByName(n.Name)
+		if err != nil {
+			return errors.Annotatef(err, "error while hcn.GetNetworkByName(%s)", n.Name)
+		}
+		return hns.CheckHcnEndpoint(epName, hcnNetwork.Id, args.Netns, result, &n.NetConf)
+	}
+	return hns.CheckHnsEndpoint(epName, hnsNetwork.Id, result, &n.NetConf)
+}
+
+// cmdGC removes the endpoints of the network whose containers the runtime
+// no longer lists, and has the IPAM plugin release their addresses.
+func cmdGC(args *skel.CmdArgs) error {
+	n, _, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	valid, err := gc.ValidAttachments(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	gcErr := gc.Collect(valid, func() ([]types.GCAttachment, error) {
+		return hns.EndpointAttachments(n.ApiVersion, n.Name)
+	}, func(a types.GCAttachment) error {
+		return hns.RemoveEndpoint(n.ApiVersion, a.ContainerID, n.Name)
+	})
+	if n.IPAM.Type != "" {
+		if err := ipam.ExecGC(n.IPAM.Type, args.StdinData); err != nil && gcErr == nil {
+			gcErr = err
+		}
+	}
+	return gcErr
 }
 
-func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("win-overlay"))
+// Main runs the win-overlay plugin.
+func Main() {
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{
+		Add:   cmdAdd,
+		Check: cmdCheck,
+		Del:   cmdDel,
+		GC:    cmdGC,
+	}), version.All, bv.BuildString("win-overlay"))
 }
@@ -0,0 +1,123 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// wgCommand is the wg(8) binary used to configure the device.
+var wgCommand = "wg"
+
+// Peer is a WireGuard peer of the pod.
+type Peer struct {
+	PublicKey           string   `json:"publicKey"`
+	PresharedKey        string   `json:"presharedKey,omitempty" config:"exclusive=presharedKey"`
+	PresharedKeyFile    string   `json:"presharedKeyFile,omitempty" config:"exclusive=presharedKey"`
+	Endpoint            string   `json:"endpoint,omitempty"`
+	AllowedIPs          []string `json:"allowedIPs"`
+	PersistentKeepalive int      `json:"persistentKeepalive,omitempty"`
+}
+
+// Secrets is the format of the secrets file. It holds the private key and
+// optionally peers, so keys don't have to be part of the network config.
+type Secrets struct {
+	PrivateKey string `json:"privateKey"`
+	Peers      []Peer `json:"peers,omitempty"`
+}
+
+func validateKey(what, key string) error {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != 32 {
+		return fmt.Errorf("invalid %s: must be a base64 encoded 32 byte key", what)
+	}
+	return nil
+}
+
+// wgSetArgs returns the arguments for "wg set" configuring the device from
+// conf. Keys are passed to wg through files, which are written to keyDir
+// when they are given inline.
+func wgSetArgs(ifName string, conf *NetConf, keyDir string) ([]string, error) {
+	args := []string{"set", ifName}
+	if conf.ListenPort != 0 {
+		args = append(args, "listen-port", strconv.Itoa(conf.ListenPort))
+	}
+	if conf.FirewallMark != 0 {
+		args = append(args, "fwmark", strconv.Itoa(conf.FirewallMark))
+	}
+
+	keyFile, err := keyPath(conf.PrivateKey, conf.PrivateKeyFile, keyDir, "private")
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, "private-key", keyFile)
+
+	for i, p := range conf.Peers {
+		args = append(args, "peer", p.PublicKey)
+		if p.PresharedKey != "" || p.PresharedKeyFile != "" {
+			pskFile, err := keyPath(p.PresharedKey, p.PresharedKeyFile, keyDir, fmt.Sprintf("psk%d", i))
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, "preshared-key", pskFile)
+		}
+		if p.Endpoint != "" {
+			args = append(args, "endpoint", p.Endpoint)
+		}
+		if p.PersistentKeepalive != 0 {
+			args = append(args, "persistent-keepalive", strconv.Itoa(p.PersistentKeepalive))
+		}
+		args = append(args, "allowed-ips", strings.Join(p.AllowedIPs, ","))
+	}
+
+	return args, nil
+}
+
+func keyPath(key, file, keyDir, name string) (string, error) {
+	if file != "" {
+		return file, nil
+	}
+	path := filepath.Join(keyDir, name)
+	if err := os.WriteFile(path, []byte(key+"\n"), 0o600); err != nil {
+		return "", fmt.Errorf("failed to write %s key: %v", name, err)
+	}
+	return path, nil
+}
+
+// configureDevice sets keys, listen port and peers of the WireGuard device.
+func configureDevice(ifName string, conf *NetConf) error {
+	keyDir, err := os.MkdirTemp("", "cni-wireguard")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(keyDir)
+
+	args, err := wgSetArgs(ifName, conf, keyDir)
+	if err != nil {
+		return err
+	}
+
+	out, err := exec.Command(wgCommand, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to configure wireguard device %q: %v: %s", ifName, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
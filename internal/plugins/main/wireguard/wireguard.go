@@ -0,0 +1,492 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/include"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+)
+
+const (
+	defaultMTU = 1420
+
+	// socketHost creates the device on the host, so the encrypted traffic
+	// leaves through the host's interfaces.
+	socketHost = "host"
+	// socketContainer creates the device in the container, so the encrypted
+	// traffic leaves through the container's other interfaces.
+	socketContainer = "container"
+)
+
+type NetConf struct {
+	types.NetConf
+	PrivateKey      string   `json:"privateKey,omitempty" config:"exclusive=privateKey"`
+	PrivateKeyFile  string   `json:"privateKeyFile,omitempty" config:"exclusive=privateKey"`
+	SecretsFile     string   `json:"secretsFile,omitempty"`
+	ListenPort      int      `json:"listenPort,omitempty"`
+	FirewallMark    int      `json:"fwmark,omitempty"`
+	MTU             int      `json:"mtu,omitempty"`
+	SocketNamespace string   `json:"socketNamespace,omitempty"`
+	Peers           []Peer   `json:"peers,omitempty"`
+	Routes          []string `json:"routes,omitempty"`
+
+	routes []*net.IPNet
+}
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func parseConfig(stdin []byte) (*NetConf, error) {
+	conf := &NetConf{
+		MTU:             defaultMTU,
+		SocketNamespace: socketHost,
+	}
+	if err := config.Validate(stdin, conf); err != nil {
+		return nil, fmt.Errorf("invalid network configuration: %v", err)
+	}
+	if err := json.Unmarshal(stdin, conf); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+	}
+
+	if conf.RawPrevResult != nil {
+		if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+			return nil, fmt.Errorf("could not parse prevResult: %v", err)
+		}
+	}
+
+	return conf, nil
+}
+
+// loadSecrets merges the secrets file into conf and validates the keys and
+// peers.
+func loadSecrets(conf *NetConf) error {
+	if conf.SecretsFile != "" {
+		data, err := os.ReadFile(conf.SecretsFile)
+		if err != nil {
+			return fmt.Errorf("failed to read secrets file: %v", err)
+		}
+		secrets := &Secrets{}
+		if err := json.Unmarshal(data, secrets); err != nil {
+			return fmt.Errorf("failed to parse secrets file %q: %v", conf.SecretsFile, err)
+		}
+		if conf.PrivateKey == "" && conf.PrivateKeyFile == "" {
+			conf.PrivateKey = secrets.PrivateKey
+		}
+		conf.Peers = append(conf.Peers, secrets.Peers...)
+	}
+	if conf.PrivateKeyFile != "" {
+		data, err := os.ReadFile(conf.PrivateKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read private key: %v", err)
+		}
+		conf.PrivateKey = string(trimKey(data))
+	}
+
+	return validateConf(conf)
+}
+
+func trimKey(data []byte) []byte {
+	for len(data) > 0 && (data[len(data)-1] == '\n' || data[len(data)-1] == '\r' || data[len(data)-1] == ' ') {
+		data = data[:len(data)-1]
+	}
+	return data
+}
+
+func validateConf(conf *NetConf) error {
+	if conf.PrivateKey == "" {
+		return errors.New("a private key is required, set privateKey, privateKeyFile or secretsFile")
+	}
+	if err := validateKey("private key", conf.PrivateKey); err != nil {
+		return err
+	}
+	if conf.SocketNamespace != socketHost && conf.SocketNamespace != socketContainer {
+		return fmt.Errorf("invalid socketNamespace %q, must be %q or %q", conf.SocketNamespace, socketHost, socketContainer)
+	}
+	if conf.ListenPort < 0 || conf.ListenPort > 65535 {
+		return fmt.Errorf("invalid listenPort %d", conf.ListenPort)
+	}
+	if conf.MTU < 0 {
+		return fmt.Errorf("invalid MTU %d", conf.MTU)
+	}
+	if len(conf.Peers) == 0 {
+		return errors.New("at least one peer is required")
+	}
+
+	var allowed []string
+	for _, p := range conf.Peers {
+		if err := validateKey(fmt.Sprintf("public key of peer %q", p.PublicKey), p.PublicKey); err != nil {
+			return err
+		}
+		if p.PresharedKey != "" {
+			if err := validateKey(fmt.Sprintf("preshared key of peer %q", p.PublicKey), p.PresharedKey); err != nil {
+				return err
+			}
+		}
+		if p.Endpoint != "" {
+			if _, _, err := net.SplitHostPort(p.Endpoint); err != nil {
+				return fmt.Errorf("invalid endpoint %q of peer %q: %v", p.Endpoint, p.PublicKey, err)
+			}
+		}
+		if p.PersistentKeepalive < 0 || p.PersistentKeepalive > 65535 {
+			return fmt.Errorf("invalid persistentKeepalive %d of peer %q", p.PersistentKeepalive, p.PublicKey)
+		}
+		for _, a := range p.AllowedIPs {
+			if _, _, err := net.ParseCIDR(a); err != nil {
+				return fmt.Errorf("invalid allowedIPs entry %q of peer %q: %v", a, p.PublicKey, err)
+			}
+		}
+		allowed = append(allowed, p.AllowedIPs...)
+	}
+
+	// Without explicit routes everything the peers accept goes through the
+	// tunnel
+	routes := conf.Routes
+	if routes == nil {
+		routes = allowed
+	}
+	conf.routes = nil
+	for _, r := range routes {
+		_, dst, err := net.ParseCIDR(r)
+		if err != nil {
+			return fmt.Errorf("invalid route %q: %v", r, err)
+		}
+		conf.routes = append(conf.routes, dst)
+	}
+
+	return nil
+}
+
+// createWireguard creates and configures the WireGuard device and leaves it
+// named ifName in the container.
+func createWireguard(conf *NetConf, ifName string, netns ns.NetNS) (*current.Interface, error) {
+	if conf.SocketNamespace == socketContainer {
+		err := netns.Do(func(_ ns.NetNS) error {
+			return addWireguard(conf, ifName)
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// the device keeps its UDP socket in the namespace it was created in,
+		// so create it here and move it into the container afterwards
+		tmpName, err := ip.RandomVethName()
+		if err != nil {
+			return nil, err
+		}
+		if err := addWireguard(conf, tmpName); err != nil {
+			return nil, err
+		}
+		link, err := netlink.LinkByName(tmpName)
+		if err != nil {
+			_ = ip.DelLinkByName(tmpName)
+			return nil, fmt.Errorf("failed to refetch wireguard device %q: %v", tmpName, err)
+		}
+		if err := netlink.LinkSetNsFd(link, int(netns.Fd())); err != nil {
+			_ = netlink.LinkDel(link)
+			return nil, fmt.Errorf("failed to move wireguard device to container netns: %v", err)
+		}
+		err = netns.Do(func(_ ns.NetNS) error {
+			if err := ip.RenameLink(tmpName, ifName); err != nil {
+				_ = ip.DelLinkByName(tmpName)
+				return fmt.Errorf("failed to rename wireguard device to %q: %v", ifName, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &current.Interface{
+		Name:    ifName,
+		Sandbox: netns.Path(),
+	}, nil
+}
+
+func addWireguard(conf *NetConf, name string) error {
+	wg := &netlink.Wireguard{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: name,
+			MTU:  conf.MTU,
+		},
+	}
+	if err := netlink.LinkAdd(wg); err != nil {
+		return fmt.Errorf("failed to create wireguard device %q: %v", name, err)
+	}
+	if err := configureDevice(name, conf); err != nil {
+		_ = ip.DelLinkByName(name)
+		return err
+	}
+	return nil
+}
+
+// addRoutes routes the configured prefixes through the device. It must be
+// called inside the container netns.
+func addRoutes(ifName string, routes []*net.IPNet) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %q: %v", ifName, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to set %q UP: %v", ifName, err)
+	}
+	for _, dst := range routes {
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Scope:     netlink.SCOPE_LINK,
+			Dst:       dst,
+		}
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to route %s through %q: %v", dst, ifName, err)
+		}
+	}
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if err := loadSecrets(conf); err != nil {
+		return err
+	}
+
+	// When chained, extend the previous result; otherwise start afresh
+	result := &current.Result{CNIVersion: current.ImplementedSpecVersion}
+	if conf.PrevResult != nil {
+		if result, err = current.NewResultFromResult(conf.PrevResult); err != nil {
+			return fmt.Errorf("could not convert result to current version: %v", err)
+		}
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return ns.OpenError(args.Netns, err)
+	}
+	defer netns.Close()
+
+	wgInterface, err := createWireguard(conf, args.IfName, netns)
+	if err != nil {
+		return err
+	}
+
+	// Delete link if err to avoid link leak in this ns
+	defer func() {
+		if err != nil {
+			netns.Do(func(_ ns.NetNS) error {
+				return ip.DelLinkByName(args.IfName)
+			})
+		}
+	}()
+
+	result.Interfaces = append(result.Interfaces, wgInterface)
+	ifIndex := len(result.Interfaces) - 1
+
+	if conf.IPAM.Type != "" {
+		// run the IPAM plugin and get back the config to apply
+		var r types.Result
+		r, err = ipam.ExecAdd(conf.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+
+		// Invoke ipam del if err to avoid ip leak
+		defer func() {
+			if err != nil {
+				ipam.ExecDel(conf.IPAM.Type, args.StdinData)
+			}
+		}()
+
+		// Convert whatever the IPAM result was into the current Result type
+		var ipamResult *current.Result
+		ipamResult, err = current.NewResultFromResult(r)
+		if err != nil {
+			return err
+		}
+
+		if len(ipamResult.IPs) == 0 {
+			err = errors.New("IPAM plugin returned missing IP config")
+			return err
+		}
+
+		for _, ipc := range ipamResult.IPs {
+			// All addresses apply to the wireguard device
+			ipc.Interface = current.Int(ifIndex)
+		}
+
+		err = netns.Do(func(_ ns.NetNS) error {
+			return ipam.ConfigureIface(args.IfName, ipamResult)
+		})
+		if err != nil {
+			return err
+		}
+
+		result.IPs = append(result.IPs, ipamResult.IPs...)
+		result.Routes = append(result.Routes, ipamResult.Routes...)
+	}
+
+	err = netns.Do(func(_ ns.NetNS) error {
+		return addRoutes(args.IfName, conf.routes)
+	})
+	if err != nil {
+		return err
+	}
+	for _, dst := range conf.routes {
+		result.Routes = append(result.Routes, &types.Route{Dst: *dst})
+	}
+
+	if conf.PrevResult == nil {
+		result.DNS = conf.DNS
+	}
+
+	return types.PrintResult(result, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.IPAM.Type != "" {
+		if err := ipam.ExecDel(conf.IPAM.Type, args.StdinData); err != nil {
+			return err
+		}
+	}
+
+	if args.Netns == "" {
+		return nil
+	}
+
+	// There is a netns so try to clean up. Delete can be called multiple times
+	// so don't return an error if the device is already removed.
+	// The routes through the device go away with it.
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		if err := ip.DelLinkByName(args.IfName); err != nil && err != ip.ErrLinkNotFound {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		//  if NetNs is passed down by the Cloud Orchestration Engine, or if it called multiple times
+		// so don't return an error if the device is already removed.
+		// https://github.com/kubernetes/kubernetes/issues/43014#issuecomment-287164444
+		_, ok := err.(ns.NSPathNotExistErr)
+		if ok {
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Main runs the wireguard plugin.
+func Main() {
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}), version.All, bv.BuildString("wireguard"))
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if err := loadSecrets(conf); err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return ns.OpenError(args.Netns, err)
+	}
+	defer netns.Close()
+
+	if conf.IPAM.Type != "" {
+		// run the IPAM plugin and get back the config to apply
+		err = ipam.ExecCheck(conf.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+	result, err := current.NewResultFromResult(conf.PrevResult)
+	if err != nil {
+		return err
+	}
+
+	var ips []*current.IPConfig
+	for _, ipc := range result.IPs {
+		if ipc.Interface == nil || *ipc.Interface >= len(result.Interfaces) {
+			continue
+		}
+		if intf := result.Interfaces[*ipc.Interface]; intf.Name == args.IfName && intf.Sandbox == args.Netns {
+			ips = append(ips, ipc)
+		}
+	}
+
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return fmt.Errorf("wireguard device %q not found: %v", args.IfName, err)
+		}
+		if link.Type() != "wireguard" {
+			return fmt.Errorf("interface %q is of type %s, not wireguard", args.IfName, link.Type())
+		}
+
+		if err := ip.ValidateExpectedInterfaceIPs(args.IfName, ips); err != nil {
+			return err
+		}
+
+		for _, dst := range conf.routes {
+			routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{
+				Dst:       dst,
+				LinkIndex: link.Attrs().Index,
+			}, netlink.RT_FILTER_DST|netlink.RT_FILTER_OIF)
+			if err != nil {
+				return err
+			}
+			if len(routes) == 0 {
+				return fmt.Errorf("route to %s through %q not found", dst, args.IfName)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wireguard
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	privateKey = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+	peerKey    = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+	psk        = "FpCyhws9cxwWoV4xELtfJvjJN+zQVRPISllRWgeopVE="
+)
+
+var _ = Describe("wireguard config", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "wireguard_test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	load := func(conf string) (*NetConf, error) {
+		n, err := parseConfig([]byte(conf))
+		if err != nil {
+			return nil, err
+		}
+		return n, loadSecrets(n)
+	}
+
+	It("merges the secrets file and routes the allowed IPs", func() {
+		secrets := filepath.Join(dir, "secrets.json")
+		Expect(os.WriteFile(secrets, []byte(fmt.Sprintf(`{
+			"privateKey": "%s",
+			"peers": [{"publicKey": "%s", "presharedKey": "%s", "endpoint": "203.0.113.1:51820", "allowedIPs": ["10.10.0.0/16"]}]
+		}`, privateKey, peerKey, psk)), 0o600)).To(Succeed())
+
+		n, err := load(fmt.Sprintf(`{"cniVersion": "1.0.0", "name": "wg", "type": "wireguard", "secretsFile": "%s"}`, secrets))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.PrivateKey).To(Equal(privateKey))
+		Expect(n.Peers).To(HaveLen(1))
+		Expect(n.MTU).To(Equal(1420))
+		Expect(n.SocketNamespace).To(Equal("host"))
+		Expect(n.routes).To(HaveLen(1))
+		Expect(n.routes[0].String()).To(Equal("10.10.0.0/16"))
+	})
+
+	It("reads the private key from a file and honours explicit routes", func() {
+		keyFile := filepath.Join(dir, "key")
+		Expect(os.WriteFile(keyFile, []byte(privateKey+"\n"), 0o600)).To(Succeed())
+
+		n, err := load(fmt.Sprintf(`{
+			"cniVersion": "1.0.0", "name": "wg", "type": "wireguard",
+			"privateKeyFile": "%s",
+			"routes": ["10.10.1.0/24"],
+			"peers": [{"publicKey": "%s", "allowedIPs": ["10.10.0.0/16", "10.20.0.0/16"]}]
+		}`, keyFile, peerKey))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.PrivateKey).To(Equal(privateKey))
+		Expect(n.routes).To(HaveLen(1))
+		Expect(n.routes[0].String()).To(Equal("10.10.1.0/24"))
+	})
+
+	DescribeTable("rejects invalid configurations",
+		func(conf, msg string) {
+			_, err := load(conf)
+			Expect(err).To(MatchError(ContainSubstring(msg)))
+		},
+		Entry("missing key", `{"peers": [{"publicKey": "`+peerKey+`"}]}`, "a private key is required"),
+		Entry("bad key", `{"privateKey": "Zm9v", "peers": [{"publicKey": "`+peerKey+`"}]}`, "invalid private key"),
+		Entry("no peers", `{"privateKey": "`+privateKey+`"}`, "at least one peer is required"),
+		Entry("bad peer key", `{"privateKey": "`+privateKey+`", "peers": [{"publicKey": "foo"}]}`, `invalid public key of peer "foo"`),
+		Entry("bad endpoint", `{"privateKey": "`+privateKey+`", "peers": [{"publicKey": "`+peerKey+`", "endpoint": "203.0.113.1"}]}`, `invalid endpoint "203.0.113.1"`),
+		Entry("bad allowed IP", `{"privateKey": "`+privateKey+`", "peers": [{"publicKey": "`+peerKey+`", "allowedIPs": ["10.0.0.1"]}]}`, `invalid allowedIPs entry "10.0.0.1"`),
+		Entry("bad socket namespace", `{"privateKey": "`+privateKey+`", "socketNamespace": "pod", "peers": [{"publicKey": "`+peerKey+`"}]}`, `invalid socketNamespace "pod"`),
+	)
+
+	It("builds the wg arguments", func() {
+		n, err := load(fmt.Sprintf(`{
+			"privateKey": "%s",
+			"listenPort": 51820,
+			"peers": [
+				{"publicKey": "%s", "presharedKey": "%s", "endpoint": "203.0.113.1:51820", "persistentKeepalive": 25, "allowedIPs": ["10.10.0.0/16", "fd00::/64"]}
+			]
+		}`, privateKey, peerKey, psk))
+		Expect(err).NotTo(HaveOccurred())
+
+		args, err := wgSetArgs("wg0", n, dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(args).To(Equal([]string{
+			"set", "wg0",
+			"listen-port", "51820",
+			"private-key", filepath.Join(dir, "private"),
+			"peer", peerKey,
+			"preshared-key", filepath.Join(dir, "psk0"),
+			"endpoint", "203.0.113.1:51820",
+			"persistent-keepalive", "25",
+			"allowed-ips", "10.10.0.0/16,fd00::/64",
+		}))
+
+		data, err := os.ReadFile(filepath.Join(dir, "private"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal(privateKey + "\n"))
+		fi, err := os.Stat(filepath.Join(dir, "psk0"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fi.Mode().Perm()).To(Equal(os.FileMode(0o600)))
+	})
+})
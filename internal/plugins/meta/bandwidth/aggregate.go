@@ -0,0 +1,436 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bandwidth
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/alexflint/go-filemutex"
+	"github.com/vishvananda/netlink"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+const (
+	defaultDataDir = "/run/cni/bandwidth"
+
+	// podMinRate is the rate in bits guaranteed to every pod of an
+	// aggregate, anything above it is borrowed from the network's class
+	podMinRate = 8000
+
+	// ipv6FilterPrio is added to the priority of a pod's IPv6 filters, as
+	// the kernel wants all filters of a priority to match one protocol
+	ipv6FilterPrio = 0x8000
+)
+
+// Aggregate caps the traffic all pods of the network send out of Uplink at
+// Rate bits per second. Every network gets an HTB class beneath a root
+// shared by all networks on the uplink, and every pod a class beneath its
+// network's, ceiled at the pod's egressRate, if any. Pods are matched by
+// source address, so the uplink must see their addresses before any SNAT.
+type Aggregate struct {
+	Uplink string `json:"uplink"`
+	Rate   uint64 `json:"rate"`
+}
+
+// aggregateState records the classes on an uplink. The HTB root exists as
+// long as any network has a class, and a network's class as long as any of
+// its pods has one.
+type aggregateState struct {
+	Networks map[string]*networkClass `json:"networks"`
+}
+
+type networkClass struct {
+	Minor uint16 `json:"minor"`
+	// Pods maps containerID/ifName to the minor of the pod's class, which
+	// is also the priority of its IPv4 filters
+	Pods map[string]uint16 `json:"pods"`
+}
+
+// defaultRootQdiscs are the root qdiscs the kernel installs by itself,
+// which the HTB root may replace.
+var defaultRootQdiscs = map[string]bool{
+	"noqueue":    true,
+	"noop":       true,
+	"pfifo_fast": true,
+	"fq_codel":   true,
+	"mq":         true,
+}
+
+func aggregateKey(containerID, ifName string) string {
+	return containerID + "/" + ifName
+}
+
+func aggregateStatePath(conf *PluginConf) string {
+	return filepath.Join(conf.DataDir, conf.Aggregate.Uplink+".aggregate.json")
+}
+
+func lockAggregate(conf *PluginConf) (func(), error) {
+	if err := os.MkdirAll(conf.DataDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create data dir %q: %v", conf.DataDir, err)
+	}
+	m, err := filemutex.New(filepath.Join(conf.DataDir, conf.Aggregate.Uplink+".lock"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock for uplink %q: %v", conf.Aggregate.Uplink, err)
+	}
+	if err := m.Lock(); err != nil {
+		m.Close()
+		return nil, fmt.Errorf("failed to lock uplink %q: %v", conf.Aggregate.Uplink, err)
+	}
+	return func() {
+		m.Unlock()
+		m.Close()
+	}, nil
+}
+
+func readAggregateState(conf *PluginConf) (*aggregateState, error) {
+	state := &aggregateState{Networks: map[string]*networkClass{}}
+	data, err := os.ReadFile(aggregateStatePath(conf))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, fmt.Errorf("failed to read aggregate state: %v", err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse aggregate state: %v", err)
+	}
+	if state.Networks == nil {
+		state.Networks = map[string]*networkClass{}
+	}
+	return state, nil
+}
+
+func writeAggregateState(conf *PluginConf, state *aggregateState) error {
+	path := aggregateStatePath(conf)
+	if len(state.Networks) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove aggregate state: %v", err)
+		}
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write aggregate state: %v", err)
+	}
+	return nil
+}
+
+// freeMinor returns the lowest class minor not used on the uplink yet.
+func (s *aggregateState) freeMinor() (uint16, error) {
+	used := map[uint16]bool{}
+	for _, n := range s.Networks {
+		used[n.Minor] = true
+		for _, minor := range n.Pods {
+			used[minor] = true
+		}
+	}
+	for minor := uint16(1); minor < ipv6FilterPrio; minor++ {
+		if !used[minor] {
+			return minor, nil
+		}
+	}
+	return 0, fmt.Errorf("no free class left")
+}
+
+// acquireAggregate attaches a class for the pod beneath the network's class
+// on the uplink, creating the network class and the HTB root if this is
+// their first user. ceilInBits caps the pod, 0 leaves it at the aggregate.
+func acquireAggregate(conf *PluginConf, containerID, ifName string, ceilInBits uint64, ips []*current.IPConfig) error {
+	agg := conf.Aggregate
+	unlock, err := lockAggregate(conf)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	uplink, err := netlink.LinkByName(agg.Uplink)
+	if err != nil {
+		return fmt.Errorf("failed to lookup uplink %q: %v", agg.Uplink, err)
+	}
+
+	state, err := readAggregateState(conf)
+	if err != nil {
+		return err
+	}
+	if len(state.Networks) == 0 {
+		if err := createAggregateRoot(uplink); err != nil {
+			return err
+		}
+	}
+
+	network, ok := state.Networks[conf.Name]
+	if !ok {
+		minor, err := state.freeMinor()
+		if err != nil {
+			return err
+		}
+		network = &networkClass{Minor: minor, Pods: map[string]uint16{}}
+		state.Networks[conf.Name] = network
+	}
+	key := aggregateKey(containerID, ifName)
+	podMinor, ok := network.Pods[key]
+	if !ok {
+		if podMinor, err = state.freeMinor(); err != nil {
+			return err
+		}
+		network.Pods[key] = podMinor
+	}
+
+	// Write the state first, so a failure half way can still be undone by DEL
+	if err := writeAggregateState(conf, state); err != nil {
+		return err
+	}
+
+	// replace the network's class every time, so rate changes apply
+	err = netlink.ClassReplace(netlink.NewHtbClass(netlink.ClassAttrs{
+		LinkIndex: uplink.Attrs().Index,
+		Parent:    netlink.MakeHandle(1, 0),
+		Handle:    netlink.MakeHandle(1, network.Minor),
+	}, netlink.HtbClassAttrs{Rate: agg.Rate, Ceil: agg.Rate}))
+	if err != nil {
+		return fmt.Errorf("failed to create class of network %q: %v", conf.Name, err)
+	}
+
+	if ceilInBits == 0 || ceilInBits > agg.Rate {
+		ceilInBits = agg.Rate
+	}
+	rate := uint64(podMinRate)
+	if rate > ceilInBits {
+		rate = ceilInBits
+	}
+	err = netlink.ClassReplace(netlink.NewHtbClass(netlink.ClassAttrs{
+		LinkIndex: uplink.Attrs().Index,
+		Parent:    netlink.MakeHandle(1, network.Minor),
+		Handle:    netlink.MakeHandle(1, podMinor),
+	}, netlink.HtbClassAttrs{Rate: rate, Ceil: ceilInBits}))
+	if err != nil {
+		return fmt.Errorf("failed to create class of container %q: %v", containerID, err)
+	}
+
+	deletePodFilters(uplink, podMinor)
+	for _, ipc := range ips {
+		if err := netlink.FilterAdd(podFilter(uplink, podMinor, ipc.Address.IP)); err != nil {
+			return fmt.Errorf("failed to add filter for %s: %v", ipc.Address.IP, err)
+		}
+	}
+	return nil
+}
+
+// releaseAggregate removes the pod's class, and the network's class and the
+// HTB root once their last user is gone.
+func releaseAggregate(conf *PluginConf, containerID, ifName string) error {
+	unlock, err := lockAggregate(conf)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := readAggregateState(conf)
+	if err != nil {
+		return err
+	}
+	network, ok := state.Networks[conf.Name]
+	if !ok {
+		return nil
+	}
+	key := aggregateKey(containerID, ifName)
+	podMinor, ok := network.Pods[key]
+	if !ok {
+		return nil
+	}
+
+	// Without the uplink there are no classes left to remove
+	uplink, err := netlink.LinkByName(conf.Aggregate.Uplink)
+	if err == nil {
+		deletePodFilters(uplink, podMinor)
+		if err := deleteClass(uplink, podMinor); err != nil {
+			return fmt.Errorf("failed to delete class of container %q: %v", containerID, err)
+		}
+	}
+	delete(network.Pods, key)
+
+	if len(network.Pods) == 0 {
+		if uplink != nil {
+			if err := deleteClass(uplink, network.Minor); err != nil {
+				return fmt.Errorf("failed to delete class of network %q: %v", conf.Name, err)
+			}
+		}
+		delete(state.Networks, conf.Name)
+	}
+	if len(state.Networks) == 0 && uplink != nil {
+		if err := deleteAggregateRoot(uplink); err != nil {
+			return err
+		}
+	}
+
+	return writeAggregateState(conf, state)
+}
+
+// checkAggregate describes how the pod's class on the uplink differs from
+// the one acquireAggregate would attach.
+func checkAggregate(conf *PluginConf, containerID, ifName string, ceilInBits uint64) []string {
+	agg := conf.Aggregate
+	uplink, err := netlink.LinkByName(agg.Uplink)
+	if err != nil {
+		return []string{fmt.Sprintf("uplink %q not found", agg.Uplink)}
+	}
+
+	unlock, err := lockAggregate(conf)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	state, err := readAggregateState(conf)
+	unlock()
+	if err != nil {
+		return []string{err.Error()}
+	}
+	network, ok := state.Networks[conf.Name]
+	if !ok {
+		return []string{fmt.Sprintf("%s: no class for network %q", agg.Uplink, conf.Name)}
+	}
+	podMinor, ok := network.Pods[aggregateKey(containerID, ifName)]
+	if !ok {
+		return []string{fmt.Sprintf("%s: no class for container %q", agg.Uplink, containerID)}
+	}
+
+	classes, err := netlink.ClassList(uplink, netlink.MakeHandle(1, network.Minor))
+	if err != nil {
+		return []string{fmt.Sprintf("%s: failed to list classes: %v", agg.Uplink, err)}
+	}
+	if ceilInBits == 0 || ceilInBits > agg.Rate {
+		ceilInBits = agg.Rate
+	}
+	for _, class := range classes {
+		htb, ok := class.(*netlink.HtbClass)
+		if !ok || htb.Handle != netlink.MakeHandle(1, podMinor) {
+			continue
+		}
+		if htb.Ceil != ceilInBits/8 {
+			return []string{fmt.Sprintf("%s: class 1:%x ceil %d, expected %d", agg.Uplink, podMinor, htb.Ceil, ceilInBits/8)}
+		}
+		return nil
+	}
+	return []string{fmt.Sprintf("%s: class 1:%x of container %q not found", agg.Uplink, podMinor, containerID)}
+}
+
+func createAggregateRoot(uplink netlink.Link) error {
+	name := uplink.Attrs().Name
+	qdiscs, err := SafeQdiscList(uplink)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs of uplink %q: %v", name, err)
+	}
+	for _, qdisc := range qdiscs {
+		if qdisc.Attrs().Parent != netlink.HANDLE_ROOT {
+			continue
+		}
+		// left behind by a DEL which failed half way
+		if _, ok := qdisc.(*netlink.Htb); ok && qdisc.Attrs().Handle == netlink.MakeHandle(1, 0) {
+			return nil
+		}
+		if !defaultRootQdiscs[qdisc.Type()] {
+			return fmt.Errorf("uplink %q already has a %s root qdisc", name, qdisc.Type())
+		}
+	}
+
+	root := netlink.NewHtb(netlink.QdiscAttrs{
+		LinkIndex: uplink.Attrs().Index,
+		Handle:    netlink.MakeHandle(1, 0),
+		Parent:    netlink.HANDLE_ROOT,
+	})
+	if err := netlink.QdiscReplace(root); err != nil {
+		return fmt.Errorf("failed to create htb qdisc on uplink %q: %v", name, err)
+	}
+	return nil
+}
+
+func deleteAggregateRoot(uplink netlink.Link) error {
+	root := netlink.NewHtb(netlink.QdiscAttrs{
+		LinkIndex: uplink.Attrs().Index,
+		Handle:    netlink.MakeHandle(1, 0),
+		Parent:    netlink.HANDLE_ROOT,
+	})
+	if err := netlink.QdiscDel(root); err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete htb qdisc on uplink %q: %v", uplink.Attrs().Name, err)
+	}
+	return nil
+}
+
+func deleteClass(uplink netlink.Link, minor uint16) error {
+	class := netlink.NewHtbClass(netlink.ClassAttrs{
+		LinkIndex: uplink.Attrs().Index,
+		Handle:    netlink.MakeHandle(1, minor),
+	}, netlink.HtbClassAttrs{})
+	if err := netlink.ClassDel(class); err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// podFilter matches the packets with source ip and puts them in the class
+// minor. Its priority is derived from the minor too, so all filters of a
+// pod can be deleted at once.
+func podFilter(uplink netlink.Link, minor uint16, ip net.IP) *netlink.U32 {
+	prio, protocol, offset, addr := minor+ipv6FilterPrio, uint16(syscall.ETH_P_IPV6), int32(8), ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		prio, protocol, offset, addr = minor, syscall.ETH_P_IP, 12, ip4
+	}
+	sel := &netlink.TcU32Sel{Flags: netlink.TC_U32_TERMINAL}
+	for i := 0; i < len(addr); i += 4 {
+		sel.Keys = append(sel.Keys, netlink.TcU32Key{
+			Mask: 0xffffffff,
+			Val:  binary.BigEndian.Uint32(addr[i : i+4]),
+			Off:  offset + int32(i),
+		})
+	}
+	return &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: uplink.Attrs().Index,
+			Parent:    netlink.MakeHandle(1, 0),
+			Priority:  prio,
+			Protocol:  protocol,
+		},
+		ClassId: netlink.MakeHandle(1, minor),
+		Sel:     sel,
+	}
+}
+
+func deletePodFilters(uplink netlink.Link, minor uint16) {
+	for prio, protocol := range map[uint16]uint16{
+		minor:                  syscall.ETH_P_IP,
+		minor + ipv6FilterPrio: syscall.ETH_P_IPV6,
+	} {
+		_ = netlink.FilterDel(&netlink.U32{FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: uplink.Attrs().Index,
+			Parent:    netlink.MakeHandle(1, 0),
+			Priority:  prio,
+			Protocol:  protocol,
+		}})
+	}
+}
+
+func isNotFound(err error) bool {
+	return errors.Is(err, syscall.ENOENT)
+}
@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package bandwidth
 
 import (
 	"context"
@@ -20,6 +20,8 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"syscall"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -617,6 +619,93 @@ var _ = Describe("bandwidth test", func() {
 			})
 		})
 
+		Describe("cmdCHECK", func() {
+			It(fmt.Sprintf("[%s] detects qdiscs which drifted from the config", ver), func() {
+				if !testutils.SpecVersionHasCHECK(ver) {
+					Skip("CHECK is not supported by " + ver)
+				}
+				conf := fmt.Sprintf(`{
+					"cniVersion": "%s",
+					"name": "cni-plugin-bandwidth-test",
+					"type": "bandwidth",
+					"ingressRate": 8,
+					"ingressBurst": 8,
+					"egressRate": 16,
+					"egressBurst": 8,
+					"prevResult": {
+						"interfaces": [
+							{
+								"name": "%s",
+								"sandbox": ""
+							},
+							{
+								"name": "%s",
+								"sandbox": "%s"
+							}
+						],
+						"ips": [
+							{
+								"version": "4",
+								"address": "%s/24",
+								"gateway": "10.0.0.1",
+								"interface": 1
+							}
+						],
+						"routes": []
+					}
+				}`, ver, hostIfname, containerIfname, containerNs.Path(), containerIP.String())
+
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       containerNs.Path(),
+					IfName:      containerIfname,
+					StdinData:   []byte(conf),
+				}
+
+				Expect(hostNs.Do(func(netNS ns.NetNS) error {
+					defer GinkgoRecover()
+					_, out, err := testutils.CmdAdd(containerNs.Path(), args.ContainerID, "", []byte(conf), func() error { return cmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred(), string(out))
+
+					err = testutils.CmdCheck(containerNs.Path(), args.ContainerID, "", func() error { return cmdCheck(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					By("changing the rate of the ingress tbf")
+					hostVethLink, err := netlink.LinkByName(hostIfname)
+					Expect(err).NotTo(HaveOccurred())
+					rate, limit, buffer := tbfParams(80, 8)
+					Expect(netlink.QdiscReplace(&netlink.Tbf{
+						QdiscAttrs: netlink.QdiscAttrs{
+							LinkIndex: hostVethLink.Attrs().Index,
+							Handle:    netlink.MakeHandle(1, 0),
+							Parent:    netlink.HANDLE_ROOT,
+						},
+						Rate:   rate,
+						Limit:  limit,
+						Buffer: buffer,
+					})).To(Succeed())
+
+					By("removing the egress tbf from the ifb device")
+					ifbLink, err := netlink.LinkByName(ifbDeviceName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(netlink.QdiscDel(&netlink.Tbf{
+						QdiscAttrs: netlink.QdiscAttrs{
+							LinkIndex: ifbLink.Attrs().Index,
+							Handle:    netlink.MakeHandle(1, 0),
+							Parent:    netlink.HANDLE_ROOT,
+						},
+					})).To(Succeed())
+
+					err = testutils.CmdCheck(containerNs.Path(), args.ContainerID, "", func() error { return cmdCheck(args) })
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring(fmt.Sprintf("%s: rate 10, expected 1", hostIfname)))
+					Expect(err.Error()).To(ContainSubstring(fmt.Sprintf("%s: tbf qdisc not found", ifbDeviceName)))
+
+					return nil
+				})).To(Succeed())
+			})
+		})
+
 		Describe("Getting the host interface which plugin should work on from veth peer of container interface", func() {
 			It(fmt.Sprintf("[%s] should work with multiple host veth interfaces", ver), func() {
 				// create veth peer in host ns
@@ -1043,6 +1132,482 @@ var _ = Describe("bandwidth test", func() {
 		})
 	}
 
+	Describe("aggregate rate limiting", func() {
+		It("shares an HTB root on the uplink between the pods of a network", func() {
+			dataDir, err := os.MkdirTemp("", "bandwidth-aggregate")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dataDir)
+
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "guest",
+				"type": "bandwidth",
+				"egressRate": 16000,
+				"egressBurst": 8000,
+				"aggregate": {"uplink": "uplink0", "rate": 80000},
+				"dataDir": "%s",
+				"prevResult": {
+					"interfaces": [
+						{"name": "%s", "sandbox": ""},
+						{"name": "%s", "sandbox": "%s"}
+					],
+					"ips": [
+						{"version": "4", "address": "%s/24", "interface": 1},
+						{"version": "6", "address": "fd00::2/64", "interface": 1}
+					]
+				}
+			}`, dataDir, hostIfname, containerIfname, containerNs.Path(), containerIP.String())
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       containerNs.Path(),
+				IfName:      containerIfname,
+				StdinData:   []byte(conf),
+			}
+
+			Expect(hostNs.Do(func(netNS ns.NetNS) error {
+				defer GinkgoRecover()
+				Expect(netlink.LinkAdd(&netlink.Veth{
+					LinkAttrs: netlink.LinkAttrs{Name: "uplink0"},
+					PeerName:  "uplink0-peer",
+				})).To(Succeed())
+				uplink, err := netlink.LinkByName("uplink0")
+				Expect(err).NotTo(HaveOccurred())
+
+				r, out, err := testutils.CmdAdd(containerNs.Path(), args.ContainerID, "", []byte(conf), func() error { return cmdAdd(args) })
+				Expect(err).NotTo(HaveOccurred(), string(out))
+				result, err := types100.GetResult(r)
+				Expect(err).NotTo(HaveOccurred())
+				// the egress limit is the ceiling of the pod's class, no ifb
+				Expect(result.Interfaces).To(HaveLen(2))
+
+				qdiscs, err := SafeQdiscList(uplink)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(qdiscs).To(HaveLen(1))
+				Expect(qdiscs[0]).To(BeAssignableToTypeOf(&netlink.Htb{}))
+
+				classes, err := netlink.ClassList(uplink, netlink.MakeHandle(1, 0))
+				Expect(err).NotTo(HaveOccurred())
+				ceils := map[uint32]uint64{}
+				for _, class := range classes {
+					ceils[class.Attrs().Handle] = class.(*netlink.HtbClass).Ceil
+				}
+				Expect(ceils).To(Equal(map[uint32]uint64{
+					netlink.MakeHandle(1, 1): 10000,
+					netlink.MakeHandle(1, 2): 2000,
+				}))
+
+				filters, err := netlink.FilterList(uplink, netlink.MakeHandle(1, 0))
+				Expect(err).NotTo(HaveOccurred())
+				classIDs := []uint32{}
+				for _, filter := range filters {
+					if u32, ok := filter.(*netlink.U32); ok && u32.ClassId != 0 {
+						classIDs = append(classIDs, u32.ClassId)
+					}
+				}
+				Expect(classIDs).To(Equal([]uint32{netlink.MakeHandle(1, 2), netlink.MakeHandle(1, 2)}))
+
+				err = testutils.CmdCheck(containerNs.Path(), args.ContainerID, "", func() error { return cmdCheck(args) })
+				Expect(err).NotTo(HaveOccurred())
+
+				By("adding a second pod to the network")
+				second := *args
+				second.ContainerID = "second"
+				_, out, err = testutils.CmdAdd(containerNs.Path(), second.ContainerID, "", []byte(conf), func() error { return cmdAdd(&second) })
+				Expect(err).NotTo(HaveOccurred(), string(out))
+				classes, err = netlink.ClassList(uplink, netlink.MakeHandle(1, 0))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(classes).To(HaveLen(3))
+
+				By("keeping the root until the last pod is gone")
+				Expect(testutils.CmdDel(containerNs.Path(), args.ContainerID, "", func() error { return cmdDel(args) })).To(Succeed())
+				classes, err = netlink.ClassList(uplink, netlink.MakeHandle(1, 0))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(classes).To(HaveLen(2))
+				err = testutils.CmdCheck(containerNs.Path(), args.ContainerID, "", func() error { return cmdCheck(args) })
+				Expect(err).To(MatchError(`bandwidth limits don't match the configuration: uplink0: no class for container "dummy"`))
+
+				Expect(testutils.CmdDel(containerNs.Path(), second.ContainerID, "", func() error { return cmdDel(&second) })).To(Succeed())
+				qdiscs, err = SafeQdiscList(uplink)
+				Expect(err).NotTo(HaveOccurred())
+				for _, qdisc := range qdiscs {
+					Expect(qdisc).NotTo(BeAssignableToTypeOf(&netlink.Htb{}))
+				}
+				Expect(filepath.Join(dataDir, "uplink0.aggregate.json")).NotTo(BeAnExistingFile())
+				return nil
+			})).To(Succeed())
+		})
+
+		It("requires an uplink and a rate", func() {
+			_, err := parseConfig([]byte(`{"cniVersion": "1.0.0", "name": "guest", "type": "bandwidth", "aggregate": {"rate": 8000}}`))
+			Expect(err).To(MatchError("aggregate requires an uplink"))
+			_, err = parseConfig([]byte(`{"cniVersion": "1.0.0", "name": "guest", "type": "bandwidth", "aggregate": {"uplink": "eth0"}}`))
+			Expect(err).To(MatchError("aggregate requires a rate"))
+		})
+	})
+
+	Describe("shaping exemptions", func() {
+		conf := func(exemptions string) string {
+			return fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "cni-plugin-bandwidth-test",
+				"type": "bandwidth",
+				"ingressRate": 8000,
+				"ingressBurst": 8000,
+				"egressRate": 16000,
+				"egressBurst": 8000,
+				"shapingExemptions": %s,
+				"prevResult": {
+					"interfaces": [
+						{"name": "%s", "sandbox": ""},
+						{"name": "%s", "sandbox": "%s"}
+					],
+					"ips": [{"address": "%s/24", "gateway": "10.0.0.1", "interface": 1}],
+					"routes": []
+				}
+			}`, exemptions, hostIfname, containerIfname, containerNs.Path(), containerIP.String())
+		}
+
+		It("puts marked and DSCP traffic beside the tbf in both directions", func() {
+			stdin := conf(`[{"mark": 256, "mask": 3840}, {"dscp": 48}]`)
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       containerNs.Path(),
+				IfName:      containerIfname,
+				StdinData:   []byte(stdin),
+			}
+
+			Expect(hostNs.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				_, out, err := testutils.CmdAdd(containerNs.Path(), args.ContainerID, "", []byte(stdin), func() error { return cmdAdd(args) })
+				Expect(err).NotTo(HaveOccurred(), string(out))
+
+				for _, name := range []string{hostIfname, ifbDeviceName} {
+					link, err := netlink.LinkByName(name)
+					Expect(err).NotTo(HaveOccurred())
+
+					qdiscs, err := SafeQdiscList(link)
+					Expect(err).NotTo(HaveOccurred())
+					var prio *netlink.Prio
+					var tbf *netlink.Tbf
+					for _, q := range qdiscs {
+						switch q := q.(type) {
+						case *netlink.Prio:
+							prio = q
+						case *netlink.Tbf:
+							tbf = q
+						}
+					}
+					Expect(prio).NotTo(BeNil(), name)
+					Expect(prio.Parent).To(Equal(uint32(netlink.HANDLE_ROOT)))
+					Expect(tbf).NotTo(BeNil(), name)
+					Expect(tbf.Parent).To(Equal(netlink.MakeHandle(1, 2)))
+
+					filters, err := netlink.FilterList(link, netlink.MakeHandle(1, 0))
+					Expect(err).NotTo(HaveOccurred())
+					kinds := map[uint16]string{}
+					for _, f := range filters {
+						kinds[f.Attrs().Priority] = f.Type()
+						switch f := f.(type) {
+						case *netlink.FwFilter:
+							Expect(f.ClassId).To(Equal(netlink.MakeHandle(1, 1)))
+							Expect(f.Mask).To(Equal(uint32(0xf00)))
+						case *netlink.U32:
+							Expect(f.ClassId).To(Equal(netlink.MakeHandle(1, 1)))
+						}
+					}
+					Expect(kinds).To(Equal(map[uint16]string{1: "matchall", 2: "fw", 3: "u32", 4: "u32"}), name)
+				}
+
+				Expect(testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })).To(Succeed())
+
+				// the filters are part of the configuration CHECK verifies
+				ifb, err := netlink.LinkByName(ifbDeviceName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.FilterDel(&netlink.FwFilter{FilterAttrs: netlink.FilterAttrs{
+					LinkIndex: ifb.Attrs().Index,
+					Parent:    netlink.MakeHandle(1, 0),
+					Priority:  2,
+					Protocol:  syscall.ETH_P_ALL,
+				}})).To(Succeed())
+				err = testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })
+				Expect(err).To(MatchError(ContainSubstring("fw filter of shaping exemptions with priority 2 not found")))
+				return nil
+			})).To(Succeed())
+		})
+
+		It("rejects invalid exemptions", func() {
+			for exemptions, expected := range map[string]string{
+				`[{}]`:                         "shaping exemption 0: specify either mark or dscp",
+				`[{"mark": 1, "dscp": 1}]`:     "shaping exemption 0: specify either mark or dscp",
+				`[{"dscp": 64}]`:               "shaping exemption 0: invalid dscp 64",
+				`[{"dscp": 1, "mask": 255}]`:   "shaping exemption 0: mask requires mark",
+				`[{"mark": 256, "mask": 255}]`: "shaping exemption 0: mark 0x100 has bits outside of mask 0xff",
+			} {
+				_, err := parseConfig([]byte(conf(exemptions)))
+				Expect(err).To(MatchError(expected), exemptions)
+			}
+			_, err := parseConfig([]byte(`{"cniVersion": "1.0.0", "name": "guest", "type": "bandwidth", "aggregate": {"uplink": "eth0", "rate": 8000}, "shapingExemptions": [{"dscp": 48}]}`))
+			Expect(err).To(MatchError("shapingExemptions can't be combined with aggregate"))
+		})
+	})
+
+	Describe("shaped interfaces", func() {
+		const (
+			wanHostIfname      = "host-wan"
+			wanContainerIfname = "wan0"
+		)
+
+		conf := func(selectors string) string {
+			return fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "cni-plugin-bandwidth-test",
+				"type": "bandwidth",
+				"ingressRate": 8000,
+				"ingressBurst": 8000,
+				"egressRate": 16000,
+				"egressBurst": 8000,
+				"shapedInterfaces": %s,
+				"prevResult": {
+					"interfaces": [
+						{"name": "%s", "sandbox": ""},
+						{"name": "%s", "sandbox": "%s"},
+						{"name": "%s", "sandbox": ""},
+						{"name": "%s", "sandbox": "%s"}
+					],
+					"ips": [{"address": "%s/24", "gateway": "10.0.0.1", "interface": 1}],
+					"routes": []
+				}
+			}`, selectors, hostIfname, containerIfname, containerNs.Path(),
+				wanHostIfname, wanContainerIfname, containerNs.Path(), containerIP.String())
+		}
+
+		BeforeEach(func() {
+			createVeth(hostNs, wanHostIfname, containerNs, wanContainerIfname, net.IP{169, 254, 1, 1}, net.IP{10, 254, 1, 1}, hostIfaceMTU)
+		})
+
+		It("limits only the selected interfaces", func() {
+			wanIfbDeviceName := ifbDeviceFor("cni-plugin-bandwidth-test", "dummy", wanContainerIfname, containerIfname)
+			Expect(wanIfbDeviceName).NotTo(Equal(ifbDeviceName))
+
+			for _, selectors := range []string{`["wan*"]`, `["3"]`} {
+				stdin := conf(selectors)
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       containerNs.Path(),
+					IfName:      containerIfname,
+					StdinData:   []byte(stdin),
+				}
+
+				Expect(hostNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					r, out, err := testutils.CmdAdd(containerNs.Path(), args.ContainerID, "", []byte(stdin), func() error { return cmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred(), string(out))
+					result, err := types100.GetResult(r)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(result.Interfaces[len(result.Interfaces)-1].Name).To(Equal(wanIfbDeviceName))
+
+					hasTBF := func(name string) bool {
+						link, err := netlink.LinkByName(name)
+						Expect(err).NotTo(HaveOccurred())
+						qdiscs, err := SafeQdiscList(link)
+						Expect(err).NotTo(HaveOccurred())
+						for _, q := range qdiscs {
+							if _, ok := q.(*netlink.Tbf); ok {
+								return true
+							}
+						}
+						return false
+					}
+					Expect(hasTBF(wanHostIfname)).To(BeTrue(), selectors)
+					Expect(hasTBF(wanIfbDeviceName)).To(BeTrue(), selectors)
+					Expect(hasTBF(hostIfname)).To(BeFalse(), selectors)
+					_, err = netlink.LinkByName(ifbDeviceName)
+					Expect(err).To(HaveOccurred())
+
+					Expect(testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })).To(Succeed())
+
+					Expect(testutils.CmdDel(containerNs.Path(), args.ContainerID, "", func() error { return cmdDel(args) })).To(Succeed())
+					_, err = netlink.LinkByName(wanIfbDeviceName)
+					Expect(err).To(HaveOccurred())
+
+					// the ingress tbf goes with the qdiscs of the next round
+					link, err := netlink.LinkByName(wanHostIfname)
+					Expect(err).NotTo(HaveOccurred())
+					qdiscs, err := SafeQdiscList(link)
+					Expect(err).NotTo(HaveOccurred())
+					for _, q := range qdiscs {
+						Expect(netlink.QdiscDel(q)).To(Succeed())
+					}
+					return nil
+				})).To(Succeed())
+			}
+		})
+
+		It("fails when the selectors match no container interface", func() {
+			stdin := conf(`["lan*", "0"]`)
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       containerNs.Path(),
+				IfName:      containerIfname,
+				StdinData:   []byte(stdin),
+			}
+			Expect(hostNs.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				_, _, err := testutils.CmdAdd(containerNs.Path(), args.ContainerID, "", []byte(stdin), func() error { return cmdAdd(args) })
+				Expect(err).To(MatchError("shapedInterfaces [lan* 0] select no container interface"))
+				return nil
+			})).To(Succeed())
+		})
+
+		It("rejects invalid selectors", func() {
+			for selectors, expected := range map[string]string{
+				`[""]`:     "shapedInterfaces: empty selector",
+				`["-1"]`:   "shapedInterfaces: invalid index -1",
+				`["wan["]`: `shapedInterfaces: invalid pattern "wan[": syntax error in pattern`,
+			} {
+				_, err := parseConfig([]byte(conf(selectors)))
+				Expect(err).To(MatchError(expected), selectors)
+			}
+			_, err := parseConfig([]byte(`{"cniVersion": "1.0.0", "name": "guest", "type": "bandwidth", "aggregate": {"uplink": "eth0", "rate": 8000}, "shapedInterfaces": ["wan*"]}`))
+			Expect(err).To(MatchError("shapedInterfaces can't be combined with aggregate"))
+		})
+	})
+
+	Describe("cmdGC", func() {
+		It("removes the ifb devices of containers the runtime no longer lists", func() {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.1.0",
+				"name": "cni-plugin-bandwidth-test",
+				"type": "bandwidth",
+				"egressRate": 16,
+				"egressBurst": 8,
+				"prevResult": {
+					"interfaces": [
+						{"name": "%s", "sandbox": ""},
+						{"name": "%s", "sandbox": "%s"}
+					],
+					"ips": [
+						{"version": "4", "address": "%s/24", "interface": 1}
+					]
+				}
+			}`, hostIfname, containerIfname, containerNs.Path(), containerIP.String())
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       containerNs.Path(),
+				IfName:      containerIfname,
+				StdinData:   []byte(conf),
+			}
+			gcConf := `{
+				"cniVersion": "1.1.0",
+				"name": "cni-plugin-bandwidth-test",
+				"type": "bandwidth",
+				"cni.dev/valid-attachments": [{"containerID": "dummy", "ifname": "eth0"}]
+			}`
+
+			Expect(hostNs.Do(func(netNS ns.NetNS) error {
+				defer GinkgoRecover()
+				_, out, err := testutils.CmdAdd(containerNs.Path(), args.ContainerID, "", []byte(conf), func() error { return cmdAdd(args) })
+				Expect(err).NotTo(HaveOccurred(), string(out))
+
+				// left behind by a container of this network, one of
+				// another network and one created before the tagging
+				stale := getIfbDeviceName("cni-plugin-bandwidth-test", "gone")
+				others := []string{getIfbDeviceName("other", "gone"), getIfbDeviceName("untagged", "gone")}
+				for name, alias := range map[string]string{
+					stale:     ifbAlias("cni-plugin-bandwidth-test", "gone"),
+					others[0]: ifbAlias("other", "gone"),
+					others[1]: "",
+				} {
+					Expect(CreateIfb(name, 1500)).To(Succeed())
+					if alias != "" {
+						link, err := netlink.LinkByName(name)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(netlink.LinkSetAlias(link, alias)).To(Succeed())
+					}
+				}
+
+				Expect(cmdGC(&skel.CmdArgs{StdinData: []byte(gcConf)})).To(Succeed())
+
+				_, err = netlink.LinkByName(ifbDeviceName)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = netlink.LinkByName(stale)
+				Expect(err).To(HaveOccurred())
+				for _, name := range others {
+					_, err = netlink.LinkByName(name)
+					Expect(err).NotTo(HaveOccurred())
+				}
+				return nil
+			})).To(Succeed())
+		})
+
+		It("removes the aggregate classes of attachments the runtime no longer lists", func() {
+			dataDir, err := os.MkdirTemp("", "bandwidth-aggregate")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dataDir)
+
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.1.0",
+				"name": "guest",
+				"type": "bandwidth",
+				"aggregate": {"uplink": "uplink0", "rate": 80000},
+				"dataDir": "%s",
+				"prevResult": {
+					"interfaces": [
+						{"name": "%s", "sandbox": ""},
+						{"name": "%s", "sandbox": "%s"}
+					],
+					"ips": [
+						{"version": "4", "address": "%s/24", "interface": 1}
+					]
+				}
+			}`, dataDir, hostIfname, containerIfname, containerNs.Path(), containerIP.String())
+			gcConf := fmt.Sprintf(`{
+				"cniVersion": "1.1.0",
+				"name": "guest",
+				"type": "bandwidth",
+				"aggregate": {"uplink": "uplink0", "rate": 80000},
+				"dataDir": "%s",
+				"cni.dev/valid-attachments": [{"containerID": "second", "ifname": "%s"}]
+			}`, dataDir, containerIfname)
+
+			Expect(hostNs.Do(func(netNS ns.NetNS) error {
+				defer GinkgoRecover()
+				Expect(netlink.LinkAdd(&netlink.Veth{
+					LinkAttrs: netlink.LinkAttrs{Name: "uplink0"},
+					PeerName:  "uplink0-peer",
+				})).To(Succeed())
+				uplink, err := netlink.LinkByName("uplink0")
+				Expect(err).NotTo(HaveOccurred())
+
+				for _, id := range []string{"dummy", "second"} {
+					args := &skel.CmdArgs{
+						ContainerID: id,
+						Netns:       containerNs.Path(),
+						IfName:      containerIfname,
+						StdinData:   []byte(conf),
+					}
+					_, out, err := testutils.CmdAdd(containerNs.Path(), id, "", []byte(conf), func() error { return cmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred(), string(out))
+				}
+				classes, err := netlink.ClassList(uplink, netlink.MakeHandle(1, 0))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(classes).To(HaveLen(3))
+
+				Expect(cmdGC(&skel.CmdArgs{StdinData: []byte(gcConf)})).To(Succeed())
+				classes, err = netlink.ClassList(uplink, netlink.MakeHandle(1, 0))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(classes).To(HaveLen(2))
+
+				conf, err := parseConfig([]byte(gcConf))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(listAttachments(conf)).To(Equal([]types.GCAttachment{{ContainerID: "second", IfName: containerIfname}}))
+				return nil
+			})).To(Succeed())
+		})
+	})
+
 	Describe("Validating input", func() {
 		It("Should allow only 4GB burst rate", func() {
 			err := validateRateAndBurst(5000, 4*1024*1024*1024*8-16) // 2 bytes less than the max should pass
@@ -0,0 +1,168 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bandwidth
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// With exemptions the tbf hangs under a prio qdisc with two bands: the
+// filters put exempt traffic into the first, the priomap everything else
+// into the second, the tbf's.
+var (
+	exemptClass = netlink.MakeHandle(1, 1)
+	shapedClass = netlink.MakeHandle(1, 2)
+	shapedTBF   = netlink.MakeHandle(2, 0)
+)
+
+// Exemption exempts traffic from shaping, e.g. node-local monitoring and
+// health checks, by the conntrack mark of its flow or its DSCP.
+type Exemption struct {
+	// Mark exempts the flows whose conntrack mark, under Mask, is Mark
+	Mark *uint32 `json:"mark,omitempty"`
+	Mask *uint32 `json:"mask,omitempty"`
+	// DSCP exempts the packets with this DSCP
+	DSCP *uint8 `json:"dscp,omitempty"`
+}
+
+func validateExemptions(exemptions []Exemption) error {
+	for i, e := range exemptions {
+		switch {
+		case (e.Mark == nil) == (e.DSCP == nil):
+			return fmt.Errorf("shaping exemption %d: specify either mark or dscp", i)
+		case e.Mask != nil && e.Mark == nil:
+			return fmt.Errorf("shaping exemption %d: mask requires mark", i)
+		case e.Mark != nil && *e.Mark&^e.mask() != 0:
+			return fmt.Errorf("shaping exemption %d: mark %#x has bits outside of mask %#x", i, *e.Mark, e.mask())
+		case e.DSCP != nil && *e.DSCP > 63:
+			return fmt.Errorf("shaping exemption %d: invalid dscp %d", i, *e.DSCP)
+		}
+	}
+	return nil
+}
+
+func (e *Exemption) mask() uint32 {
+	if e.Mask == nil {
+		return 0xffffffff
+	}
+	return *e.Mask
+}
+
+// createExemptRoot adds the prio qdisc the tbf of link hangs under.
+func createExemptRoot(linkIndex int) error {
+	prio := &netlink.Prio{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Bands: 2,
+	}
+	for i := range prio.PriorityMap {
+		prio.PriorityMap[i] = 1
+	}
+	if err := netlink.QdiscAdd(prio); err != nil {
+		return fmt.Errorf("create prio qdisc: %s", err)
+	}
+	return nil
+}
+
+// exemptionFilters returns the filters classifying exempt traffic of link,
+// in the order of their priorities. The conntrack mark of a flow is copied
+// to its packets first, as the fw filter matches the packet mark.
+func exemptionFilters(linkIndex int, exemptions []Exemption) []netlink.Filter {
+	attrs := func(prio, protocol uint16) netlink.FilterAttrs {
+		return netlink.FilterAttrs{
+			LinkIndex: linkIndex,
+			Parent:    netlink.MakeHandle(1, 0),
+			Priority:  prio,
+			Protocol:  protocol,
+		}
+	}
+
+	var filters []netlink.Filter
+	prio := uint16(1)
+	for _, e := range exemptions {
+		if e.Mark != nil {
+			filters = append(filters, &netlink.MatchAll{
+				FilterAttrs: attrs(prio, syscall.ETH_P_ALL),
+				Actions: []netlink.Action{
+					netlink.NewConnmarkAction(),
+					// on to the next filter
+					&netlink.GenericAction{ActionAttrs: netlink.ActionAttrs{Action: netlink.TC_ACT_UNSPEC}},
+				},
+			})
+			prio++
+			break
+		}
+	}
+	for _, e := range exemptions {
+		if e.Mark != nil {
+			fw := &netlink.FwFilter{
+				FilterAttrs: attrs(prio, syscall.ETH_P_ALL),
+				ClassId:     exemptClass,
+				Mask:        e.mask(),
+			}
+			fw.Handle = *e.Mark
+			filters = append(filters, fw)
+			prio++
+			continue
+		}
+		// the DSCP is the upper six bits of the IPv4 TOS and of the IPv6
+		// traffic class
+		dscp := uint32(*e.DSCP)
+		for _, key := range []struct {
+			protocol  uint16
+			mask, val uint32
+		}{
+			{syscall.ETH_P_IP, 0x00fc0000, dscp << 18},
+			{syscall.ETH_P_IPV6, 0x0fc00000, dscp << 22},
+		} {
+			filters = append(filters, &netlink.U32{
+				FilterAttrs: attrs(prio, key.protocol),
+				ClassId:     exemptClass,
+				Sel: &netlink.TcU32Sel{
+					Flags: netlink.TC_U32_TERMINAL,
+					Keys:  []netlink.TcU32Key{{Mask: key.mask, Val: key.val}},
+				},
+			})
+			prio++
+		}
+	}
+	return filters
+}
+
+// checkExemptions verifies the filters classifying exempt traffic of link.
+func checkExemptions(link netlink.Link, exemptions []Exemption) []string {
+	name := link.Attrs().Name
+	filters, err := netlink.FilterList(link, netlink.MakeHandle(1, 0))
+	if err != nil {
+		return []string{fmt.Sprintf("%s: failed to list filters: %v", name, err)}
+	}
+	prios := map[uint16]string{}
+	for _, f := range filters {
+		prios[f.Attrs().Priority] = f.Type()
+	}
+	var drift []string
+	for _, want := range exemptionFilters(link.Attrs().Index, exemptions) {
+		if prios[want.Attrs().Priority] != want.Type() {
+			drift = append(drift, fmt.Sprintf("%s: %s filter of shaping exemptions with priority %d not found", name, want.Type(), want.Attrs().Priority))
+		}
+	}
+	return drift
+}
@@ -0,0 +1,108 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bandwidth
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/gc"
+)
+
+// ifbAliasPrefix starts the alias naming the network and container an ifb
+// device belongs to, which its hashed name doesn't tell.
+const ifbAliasPrefix = "cni-bandwidth:"
+
+func ifbAlias(networkName, containerID string) string {
+	return ifbAliasPrefix + networkName + "/" + containerID
+}
+
+// ifbOwner returns the network and container an ifb device was created
+// for. Devices created before they were tagged have no owner.
+func ifbOwner(link netlink.Link) (string, string, bool) {
+	if link.Type() != "ifb" {
+		return "", "", false
+	}
+	owner, ok := strings.CutPrefix(link.Attrs().Alias, ifbAliasPrefix)
+	if !ok {
+		return "", "", false
+	}
+	return strings.Cut(owner, "/")
+}
+
+// listAttachments returns the containers of the network with an ifb
+// device, for all of their interfaces, and the attachments with a class
+// beneath the aggregate.
+func listAttachments(conf *PluginConf) ([]types.GCAttachment, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+	var attachments []types.GCAttachment
+	for _, link := range links {
+		if network, containerID, ok := ifbOwner(link); ok && network == conf.Name {
+			attachments = append(attachments, types.GCAttachment{ContainerID: containerID})
+		}
+	}
+
+	if conf.Aggregate == nil {
+		return attachments, nil
+	}
+	unlock, err := lockAggregate(conf)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	state, err := readAggregateState(conf)
+	if err != nil {
+		return nil, err
+	}
+	if network, ok := state.Networks[conf.Name]; ok {
+		for key := range network.Pods {
+			containerID, ifName, _ := strings.Cut(key, "/")
+			attachments = append(attachments, types.GCAttachment{ContainerID: containerID, IfName: ifName})
+		}
+	}
+	return attachments, nil
+}
+
+func releaseAttachment(conf *PluginConf, a types.GCAttachment) error {
+	if a.IfName == "" {
+		return teardownIfbs(conf.Name, a.ContainerID)
+	}
+	return releaseAggregate(conf, a.ContainerID, a.IfName)
+}
+
+// cmdGC removes the ifb devices and aggregate classes of the attachments
+// the runtime no longer lists.
+func cmdGC(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+	valid, err := gc.ValidAttachments(args.StdinData)
+	if err != nil {
+		return err
+	}
+	return gc.Collect(valid, func() ([]types.GCAttachment, error) {
+		return listAttachments(conf)
+	}, func(a types.GCAttachment) error {
+		return releaseAttachment(conf, a)
+	})
+}
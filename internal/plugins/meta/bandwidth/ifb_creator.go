@@ -0,0 +1,275 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bandwidth
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+)
+
+const latencyInMillis = 25
+
+func CreateIfb(ifbDeviceName string, mtu int) error {
+	err := netlink.LinkAdd(&netlink.Ifb{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:  ifbDeviceName,
+			Flags: net.FlagUp,
+			MTU:   mtu,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("adding link: %s", err)
+	}
+
+	return nil
+}
+
+func TeardownIfb(deviceName string) error {
+	_, err := ip.DelLinkByNameAddr(deviceName)
+	if err != nil && err == ip.ErrLinkNotFound {
+		return nil
+	}
+	return err
+}
+
+func CreateIngressQdisc(rateInBits, burstInBits uint64, hostDeviceName string, exemptions []Exemption) error {
+	hostDevice, err := netlink.LinkByName(hostDeviceName)
+	if err != nil {
+		return fmt.Errorf("get host device: %s", err)
+	}
+	return createTBF(rateInBits, burstInBits, hostDevice.Attrs().Index, exemptions)
+}
+
+func CreateEgressQdisc(rateInBits, burstInBits uint64, hostDeviceName string, ifbDeviceName string, exemptions []Exemption) error {
+	ifbDevice, err := netlink.LinkByName(ifbDeviceName)
+	if err != nil {
+		return fmt.Errorf("get ifb device: %s", err)
+	}
+	hostDevice, err := netlink.LinkByName(hostDeviceName)
+	if err != nil {
+		return fmt.Errorf("get host device: %s", err)
+	}
+
+	// add qdisc ingress on host device
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: hostDevice.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0), // ffff:
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+
+	// the bridge plugin may have added it already for its storm control
+	err = netlink.QdiscAdd(ingress)
+	if err != nil && !errors.Is(err, syscall.EEXIST) {
+		return fmt.Errorf("create ingress qdisc: %s", err)
+	}
+
+	// add filter on host device to mirror traffic to ifb device
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: hostDevice.Attrs().Index,
+			Parent:    ingress.QdiscAttrs.Handle,
+			Priority:  1,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		ClassId:    netlink.MakeHandle(1, 1),
+		RedirIndex: ifbDevice.Attrs().Index,
+		Actions: []netlink.Action{
+			&netlink.MirredAction{
+				ActionAttrs:  netlink.ActionAttrs{},
+				MirredAction: netlink.TCA_EGRESS_REDIR,
+				Ifindex:      ifbDevice.Attrs().Index,
+			},
+		},
+	}
+	err = netlink.FilterAdd(filter)
+	if err != nil {
+		return fmt.Errorf("add filter: %s", err)
+	}
+
+	// throttle traffic on ifb device
+	err = createTBF(rateInBits, burstInBits, ifbDevice.Attrs().Index, exemptions)
+	if err != nil {
+		return fmt.Errorf("create ifb qdisc: %s", err)
+	}
+	return nil
+}
+
+func createTBF(rateInBits, burstInBits uint64, linkIndex int, exemptions []Exemption) error {
+	// Equivalent to
+	// tc qdisc add dev link root tbf
+	//		rate netConf.BandwidthLimits.Rate
+	//		burst netConf.BandwidthLimits.Burst
+	if rateInBits <= 0 {
+		return fmt.Errorf("invalid rate: %d", rateInBits)
+	}
+	if burstInBits <= 0 {
+		return fmt.Errorf("invalid burst: %d", burstInBits)
+	}
+	rateInBytes, limitInBytes, bufferInBytes := tbfParams(rateInBits, burstInBits)
+
+	qdisc := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Limit:  limitInBytes,
+		Rate:   rateInBytes,
+		Buffer: bufferInBytes,
+	}
+	if len(exemptions) > 0 {
+		if err := createExemptRoot(linkIndex); err != nil {
+			return err
+		}
+		qdisc.Handle, qdisc.Parent = shapedTBF, shapedClass
+	}
+	err := netlink.QdiscAdd(qdisc)
+	if err != nil {
+		return fmt.Errorf("create qdisc: %s", err)
+	}
+	for _, filter := range exemptionFilters(linkIndex, exemptions) {
+		if err := netlink.FilterAdd(filter); err != nil {
+			return fmt.Errorf("add %s filter of shaping exemptions: %s", filter.Type(), err)
+		}
+	}
+	return nil
+}
+
+// checkTBF compares the root qdisc of link with the tbf createTBF would
+// install for rate and burst, and describes every difference found.
+func checkTBF(link netlink.Link, rateInBits, burstInBits uint64, exemptions []Exemption) []string {
+	name := link.Attrs().Name
+	qdiscs, err := SafeQdiscList(link)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: failed to list qdiscs: %v", name, err)}
+	}
+
+	var root netlink.Qdisc
+	for _, qdisc := range qdiscs {
+		if qdisc.Attrs().Parent == netlink.HANDLE_ROOT {
+			root = qdisc
+			break
+		}
+	}
+	// once the tbf is deleted the kernel falls back to a default root qdisc
+	if root == nil || root.Type() == "noqueue" {
+		return []string{fmt.Sprintf("%s: tbf qdisc not found", name)}
+	}
+	var drift []string
+	if len(exemptions) > 0 {
+		if _, ok := root.(*netlink.Prio); !ok {
+			return []string{fmt.Sprintf("%s: root qdisc is %s, expected prio", name, root.Type())}
+		}
+		drift = append(drift, checkExemptions(link, exemptions)...)
+		root = nil
+		for _, qdisc := range qdiscs {
+			if qdisc.Attrs().Parent == shapedClass {
+				root = qdisc
+			}
+		}
+		if root == nil {
+			return append(drift, fmt.Sprintf("%s: tbf qdisc not found", name))
+		}
+	}
+	tbf, ok := root.(*netlink.Tbf)
+	if !ok {
+		return append(drift, fmt.Sprintf("%s: root qdisc is %s, expected tbf", name, root.Type()))
+	}
+
+	rate, limitInBytes, bufferInBytes := tbfParams(rateInBits, burstInBits)
+	if tbf.Rate != rate {
+		drift = append(drift, fmt.Sprintf("%s: rate %d, expected %d", name, tbf.Rate, rate))
+	}
+	if tbf.Limit != limitInBytes {
+		drift = append(drift, fmt.Sprintf("%s: limit %d, expected %d", name, tbf.Limit, limitInBytes))
+	}
+	if tbf.Buffer != bufferInBytes {
+		drift = append(drift, fmt.Sprintf("%s: buffer %d, expected %d", name, tbf.Buffer, bufferInBytes))
+	}
+	return drift
+}
+
+// checkRedirect verifies the ingress qdisc and mirred filter installed by
+// CreateEgressQdisc still redirect traffic of hostLink to ifb.
+func checkRedirect(hostLink, ifb netlink.Link) []string {
+	name := hostLink.Attrs().Name
+	qdiscs, err := SafeQdiscList(hostLink)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: failed to list qdiscs: %v", name, err)}
+	}
+	found := false
+	for _, qdisc := range qdiscs {
+		if _, ok := qdisc.(*netlink.Ingress); ok {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return []string{fmt.Sprintf("%s: ingress qdisc not found", name)}
+	}
+
+	filters, err := netlink.FilterList(hostLink, netlink.MakeHandle(0xffff, 0))
+	if err != nil {
+		return []string{fmt.Sprintf("%s: failed to list filters: %v", name, err)}
+	}
+	for _, filter := range filters {
+		u32, ok := filter.(*netlink.U32)
+		if !ok {
+			continue
+		}
+		for _, action := range u32.Actions {
+			mirred, ok := action.(*netlink.MirredAction)
+			if ok && mirred.MirredAction == netlink.TCA_EGRESS_REDIR && mirred.Ifindex == ifb.Attrs().Index {
+				return nil
+			}
+		}
+	}
+	return []string{fmt.Sprintf("%s: no filter redirecting to %s", name, ifb.Attrs().Name)}
+}
+
+// tbfParams converts the configured rate and burst to the rate, limit and
+// buffer of the tbf qdisc, as installed by createTBF.
+func tbfParams(rateInBits, burstInBits uint64) (rate uint64, limitInBytes, bufferInBytes uint32) {
+	rate = rateInBits / 8
+	burstInBytes := burstInBits / 8
+	bufferInBytes = buffer(rate, uint32(burstInBytes))
+	latency := latencyInUsec(latencyInMillis)
+	limitInBytes = limit(rate, latency, uint32(burstInBytes))
+	return rate, limitInBytes, bufferInBytes
+}
+
+func time2Tick(time uint32) uint32 {
+	return uint32(float64(time) * netlink.TickInUsec())
+}
+
+func buffer(rate uint64, burst uint32) uint32 {
+	return time2Tick(uint32(float64(burst) * float64(netlink.TIME_UNITS_PER_SEC) / float64(rate)))
+}
+
+func limit(rate uint64, latency float64, buffer uint32) uint32 {
+	return uint32(float64(rate)*latency/float64(netlink.TIME_UNITS_PER_SEC)) + buffer
+}
+
+func latencyInUsec(latencyInMillis float64) float64 {
+	return float64(netlink.TIME_UNITS_PER_SEC) * (latencyInMillis / 1000.0)
+}
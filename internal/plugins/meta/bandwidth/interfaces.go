@@ -0,0 +1,110 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bandwidth
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+
+	"github.com/vishvananda/netlink"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+// validateShapedInterfaces checks the selectors of shapedInterfaces: each
+// is a name pattern, or an index into the interfaces of the previous
+// result when it is a number.
+func validateShapedInterfaces(selectors []string) error {
+	for _, s := range selectors {
+		if s == "" {
+			return fmt.Errorf("shapedInterfaces: empty selector")
+		}
+		if i, err := strconv.Atoi(s); err == nil {
+			if i < 0 {
+				return fmt.Errorf("shapedInterfaces: invalid index %d", i)
+			}
+			continue
+		}
+		if _, err := path.Match(s, ""); err != nil {
+			return fmt.Errorf("shapedInterfaces: invalid pattern %q: %v", s, err)
+		}
+	}
+	return nil
+}
+
+// shapedInterfaces returns the container interfaces of the result the
+// limits apply to, in the order of the result. Without selectors it's the
+// interface the runtime attached alone.
+func shapedInterfaces(conf *PluginConf, result *current.Result, ifName string) ([]string, error) {
+	if len(conf.ShapedInterfaces) == 0 {
+		return []string{ifName}, nil
+	}
+	var names []string
+	for i, iface := range result.Interfaces {
+		if iface.Sandbox == "" {
+			continue
+		}
+		if selected(conf.ShapedInterfaces, i, iface.Name) {
+			names = append(names, iface.Name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("shapedInterfaces %v select no container interface", conf.ShapedInterfaces)
+	}
+	return names, nil
+}
+
+func selected(selectors []string, index int, name string) bool {
+	for _, s := range selectors {
+		if i, err := strconv.Atoi(s); err == nil {
+			if i == index {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(s, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ifbDeviceFor returns the ifb device the egress of the container
+// interface ifName is shaped on. The interface the runtime attached keeps
+// the device name it always had.
+func ifbDeviceFor(networkName, containerID, ifName, attachedIfName string) string {
+	if ifName == attachedIfName {
+		return getIfbDeviceName(networkName, containerID)
+	}
+	return getIfbDeviceName(networkName, containerID+"/"+ifName)
+}
+
+// teardownIfbs deletes the ifb devices of a container, found by their
+// owner, and the one named for it which may predate owners.
+func teardownIfbs(networkName, containerID string) error {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("failed to list links: %v", err)
+	}
+	for _, link := range links {
+		if network, id, ok := ifbOwner(link); ok && network == networkName && id == containerID {
+			if err := TeardownIfb(link.Attrs().Name); err != nil {
+				return err
+			}
+		}
+	}
+	return TeardownIfb(getIfbDeviceName(networkName, containerID))
+}
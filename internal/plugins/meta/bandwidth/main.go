@@ -0,0 +1,406 @@
+// Copyright 2018 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bandwidth
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/cniargs"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/include"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+)
+
+const (
+	maxIfbDeviceLength = 15
+	ifbDevicePrefix    = "bwp"
+)
+
+// BandwidthEntry corresponds to a single entry in the bandwidth argument,
+// see CONVENTIONS.md
+type BandwidthEntry = cniargs.BandwidthEntry
+
+type PluginConf struct {
+	types.NetConf
+
+	RuntimeConfig struct {
+		Bandwidth *BandwidthEntry `json:"bandwidth,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+
+	*BandwidthEntry
+
+	Aggregate *Aggregate `json:"aggregate,omitempty"`
+	DataDir   string     `json:"dataDir,omitempty"`
+	// Exemptions are the traffic the pod's limits don't apply to
+	Exemptions []Exemption `json:"shapingExemptions,omitempty"`
+	// ShapedInterfaces select the container interfaces of the previous
+	// result the limits apply to, by name pattern or index, instead of the
+	// one the runtime attached
+	ShapedInterfaces []string `json:"shapedInterfaces,omitempty"`
+}
+
+// parseConfig parses the supplied configuration (and prevResult) from stdin.
+func parseConfig(stdin []byte) (*PluginConf, error) {
+	conf := PluginConf{DataDir: defaultDataDir}
+
+	if err := config.Validate(stdin, &conf); err != nil {
+		return nil, fmt.Errorf("invalid network configuration: %v", err)
+	}
+	if err := json.Unmarshal(stdin, &conf); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+	}
+
+	bandwidth := getBandwidth(&conf)
+	if bandwidth != nil {
+		err := validateRateAndBurst(bandwidth.IngressRate, bandwidth.IngressBurst)
+		if err != nil {
+			return nil, err
+		}
+		err = validateRateAndBurst(bandwidth.EgressRate, bandwidth.EgressBurst)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if agg := conf.Aggregate; agg != nil {
+		if agg.Uplink == "" {
+			return nil, fmt.Errorf("aggregate requires an uplink")
+		}
+		if agg.Rate == 0 {
+			return nil, fmt.Errorf("aggregate requires a rate")
+		}
+		if len(conf.Exemptions) > 0 {
+			return nil, fmt.Errorf("shapingExemptions can't be combined with aggregate")
+		}
+		if len(conf.ShapedInterfaces) > 0 {
+			return nil, fmt.Errorf("shapedInterfaces can't be combined with aggregate")
+		}
+	}
+	if err := validateExemptions(conf.Exemptions); err != nil {
+		return nil, err
+	}
+	if err := validateShapedInterfaces(conf.ShapedInterfaces); err != nil {
+		return nil, err
+	}
+
+	if conf.RawPrevResult != nil {
+		var err error
+		if err = version.ParsePrevResult(&conf.NetConf); err != nil {
+			return nil, fmt.Errorf("could not parse prevResult: %v", err)
+		}
+
+		_, err = current.NewResultFromResult(conf.PrevResult)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert result to current version: %v", err)
+		}
+	}
+
+	return &conf, nil
+}
+
+func getBandwidth(conf *PluginConf) *BandwidthEntry {
+	if conf.BandwidthEntry == nil && conf.RuntimeConfig.Bandwidth != nil {
+		return conf.RuntimeConfig.Bandwidth
+	}
+	return conf.BandwidthEntry
+}
+
+func validateRateAndBurst(rate, burst uint64) error {
+	switch {
+	case burst == 0 && rate != 0:
+		return fmt.Errorf("if rate is set, burst must also be set")
+	case rate == 0 && burst != 0:
+		return fmt.Errorf("if burst is set, rate must also be set")
+	case burst/8 >= math.MaxUint32:
+		return fmt.Errorf("burst cannot be more than 4GB")
+	}
+
+	return nil
+}
+
+func getIfbDeviceName(networkName string, containerID string) string {
+	return utils.MustFormatHashWithPrefix(maxIfbDeviceLength, ifbDevicePrefix, networkName+containerID)
+}
+
+func getMTU(deviceName string) (int, error) {
+	link, err := netlink.LinkByName(deviceName)
+	if err != nil {
+		return -1, err
+	}
+
+	return link.Attrs().MTU, nil
+}
+
+// get the veth peer of container interface in host namespace
+func getHostInterface(interfaces []*current.Interface, containerIfName string, netns ns.NetNS) (*current.Interface, error) {
+	if len(interfaces) == 0 {
+		return nil, fmt.Errorf("no interfaces provided")
+	}
+
+	// get veth peer index of container interface
+	var peerIndex int
+	var err error
+	_ = netns.Do(func(_ ns.NetNS) error {
+		_, peerIndex, err = ip.GetVethPeerIfindex(containerIfName)
+		return nil
+	})
+	if peerIndex <= 0 {
+		return nil, fmt.Errorf("container interface %s has no veth peer: %v", containerIfName, err)
+	}
+
+	// find host interface by index
+	link, err := netlink.LinkByIndex(peerIndex)
+	if err != nil {
+		return nil, fmt.Errorf("veth peer with index %d is not in host ns", peerIndex)
+	}
+	for _, iface := range interfaces {
+		if iface.Sandbox == "" && iface.Name == link.Attrs().Name {
+			return iface, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no veth peer of container interface found in host ns")
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	bandwidth := getBandwidth(conf)
+	if (bandwidth == nil || bandwidth.IsZero()) && conf.Aggregate == nil {
+		return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+	}
+	if bandwidth == nil {
+		bandwidth = &BandwidthEntry{}
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	result, err := current.NewResultFromResult(conf.PrevResult)
+	if err != nil {
+		return fmt.Errorf("could not convert result to current version: %v", err)
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return ns.OpenError(args.Netns, err)
+	}
+	defer netns.Close()
+
+	ifNames, err := shapedInterfaces(conf, result, args.IfName)
+	if err != nil {
+		return err
+	}
+	for _, ifName := range ifNames {
+		if err := shapeInterface(conf, bandwidth, result, args, ifName, netns); err != nil {
+			return err
+		}
+	}
+
+	return types.PrintResult(result, conf.CNIVersion)
+}
+
+// shapeInterface limits the container interface ifName on its host veth
+// peer, adding the ifb device for its egress to the result.
+func shapeInterface(conf *PluginConf, bandwidth *BandwidthEntry, result *current.Result, args *skel.CmdArgs, ifName string, netns ns.NetNS) error {
+	hostInterface, err := getHostInterface(result.Interfaces, ifName, netns)
+	if err != nil {
+		return err
+	}
+
+	if bandwidth.IngressRate > 0 && bandwidth.IngressBurst > 0 {
+		err = CreateIngressQdisc(bandwidth.IngressRate, bandwidth.IngressBurst, hostInterface.Name, conf.Exemptions)
+		if err != nil {
+			return err
+		}
+	}
+
+	// with an aggregate the pod's egress limit is the ceiling of its class
+	if conf.Aggregate != nil {
+		if err := acquireAggregate(conf, args.ContainerID, ifName, bandwidth.EgressRate, result.IPs); err != nil {
+			return err
+		}
+	} else if bandwidth.EgressRate > 0 && bandwidth.EgressBurst > 0 {
+		mtu, err := getMTU(hostInterface.Name)
+		if err != nil {
+			return err
+		}
+
+		ifbDeviceName := ifbDeviceFor(conf.Name, args.ContainerID, ifName, args.IfName)
+
+		err = CreateIfb(ifbDeviceName, mtu)
+		if err != nil {
+			return err
+		}
+
+		ifbDevice, err := netlink.LinkByName(ifbDeviceName)
+		if err != nil {
+			return err
+		}
+		// GC finds the device by its owner
+		if err := netlink.LinkSetAlias(ifbDevice, ifbAlias(conf.Name, args.ContainerID)); err != nil {
+			return fmt.Errorf("failed to set alias of %q: %v", ifbDeviceName, err)
+		}
+
+		result.Interfaces = append(result.Interfaces, &current.Interface{
+			Name: ifbDeviceName,
+			Mac:  ifbDevice.Attrs().HardwareAddr.String(),
+		})
+		err = CreateEgressQdisc(bandwidth.EgressRate, bandwidth.EgressBurst, hostInterface.Name, ifbDeviceName, conf.Exemptions)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.Aggregate != nil {
+		if err := releaseAggregate(conf, args.ContainerID, args.IfName); err != nil {
+			return err
+		}
+	}
+
+	return teardownIfbs(conf.Name, args.ContainerID)
+}
+
+// Main runs the bandwidth plugin.
+func Main() {
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{
+		Add:   cmdAdd,
+		Check: cmdCheck,
+		Del:   cmdDel,
+		GC:    cmdGC,
+	}), version.VersionsStartingFrom("0.3.0"), bv.BuildString("bandwidth"))
+}
+
+func SafeQdiscList(link netlink.Link) ([]netlink.Qdisc, error) {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return nil, err
+	}
+	result := []netlink.Qdisc{}
+	for _, qdisc := range qdiscs {
+		// filter out pfifo_fast qdiscs because
+		// older kernels don't return them
+		_, pfifo := qdisc.(*netlink.PfifoFast)
+		if !pfifo {
+			result = append(result, qdisc)
+		}
+	}
+	return result, nil
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	bwConf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if bwConf.PrevResult == nil {
+		return fmt.Errorf("must be called as a chained plugin")
+	}
+
+	result, err := current.NewResultFromResult(bwConf.PrevResult)
+	if err != nil {
+		return fmt.Errorf("could not convert result to current version: %v", err)
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return ns.OpenError(args.Netns, err)
+	}
+	defer netns.Close()
+
+	bandwidth := getBandwidth(bwConf)
+	if bandwidth == nil {
+		bandwidth = &BandwidthEntry{}
+	}
+
+	ifNames, err := shapedInterfaces(bwConf, result, args.IfName)
+	if err != nil {
+		return err
+	}
+	var drift []string
+	for _, ifName := range ifNames {
+		ifDrift, err := checkInterface(bwConf, bandwidth, result, args, ifName, netns)
+		if err != nil {
+			return err
+		}
+		drift = append(drift, ifDrift...)
+	}
+
+	if len(drift) > 0 {
+		return fmt.Errorf("bandwidth limits don't match the configuration: %s", strings.Join(drift, "; "))
+	}
+
+	return nil
+}
+
+// checkInterface returns how the limits of the container interface ifName
+// drifted from the configuration.
+func checkInterface(bwConf *PluginConf, bandwidth *BandwidthEntry, result *current.Result, args *skel.CmdArgs, ifName string, netns ns.NetNS) ([]string, error) {
+	hostInterface, err := getHostInterface(result.Interfaces, ifName, netns)
+	if err != nil {
+		return nil, err
+	}
+	link, err := netlink.LinkByName(hostInterface.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var drift []string
+	if bandwidth.IngressRate > 0 && bandwidth.IngressBurst > 0 {
+		drift = append(drift, checkTBF(link, bandwidth.IngressRate, bandwidth.IngressBurst, bwConf.Exemptions)...)
+	}
+
+	if bwConf.Aggregate != nil {
+		drift = append(drift, checkAggregate(bwConf, args.ContainerID, ifName, bandwidth.EgressRate)...)
+	} else if bandwidth.EgressRate > 0 && bandwidth.EgressBurst > 0 {
+		ifbDeviceName := ifbDeviceFor(bwConf.Name, args.ContainerID, ifName, args.IfName)
+		ifbDevice, err := netlink.LinkByName(ifbDeviceName)
+		if err != nil {
+			drift = append(drift, fmt.Sprintf("ifb device %q not found", ifbDeviceName))
+		} else {
+			drift = append(drift, checkRedirect(link, ifbDevice)...)
+			drift = append(drift, checkTBF(ifbDevice, bandwidth.EgressRate, bandwidth.EgressBurst, bwConf.Exemptions)...)
+		}
+	}
+
+	return drift, nil
+}
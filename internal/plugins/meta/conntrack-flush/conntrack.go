@@ -0,0 +1,98 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conntrackflush
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/containernetworking/plugins/pkg/cniargs"
+	"github.com/containernetworking/plugins/pkg/utils"
+)
+
+// podFlowFilter matches the flows of the given protocols that have one of
+// the pod's addresses on either side, before or after NAT. This covers
+// connections to and from the pod, as well as those reaching it through a
+// DNAT'ed host port or leaving it masqueraded.
+type podFlowFilter struct {
+	ips    []net.IP
+	protos []uint8
+}
+
+func (f *podFlowFilter) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	matchesProto := false
+	for _, p := range f.protos {
+		if flow.Forward.Protocol == p {
+			matchesProto = true
+			break
+		}
+	}
+	if !matchesProto {
+		return false
+	}
+
+	for _, ip := range f.ips {
+		for _, flowIP := range []net.IP{flow.Forward.SrcIP, flow.Forward.DstIP, flow.Reverse.SrcIP, flow.Reverse.DstIP} {
+			if ip.Equal(flowIP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var _ netlink.CustomConntrackFilter = (*podFlowFilter)(nil)
+
+// flushPodEntries deletes the conntrack entries of the pod's addresses.
+func flushPodEntries(ips []net.IP, protos []uint8) error {
+	for _, family := range []netlink.InetFamily{unix.AF_INET, unix.AF_INET6} {
+		filter := &podFlowFilter{protos: protos}
+		for _, ip := range ips {
+			if (ip.To4() != nil) == (family == unix.AF_INET) {
+				filter.ips = append(filter.ips, ip)
+			}
+		}
+		if len(filter.ips) == 0 {
+			continue
+		}
+		if _, err := netlink.ConntrackDeleteFilter(netlink.ConntrackTable, family, filter); err != nil {
+			return fmt.Errorf("error deleting connection tracking state for %v: %v", filter.ips, err)
+		}
+	}
+	return nil
+}
+
+// flushHostPortEntries deletes the conntrack entries of the pod's host
+// ports, which were created before the port was mapped and so don't reach
+// the pod.
+func flushHostPortEntries(portMaps []cniargs.PortMapping, protos []uint8) error {
+	for _, pm := range portMaps {
+		proto, ok := protocolNumbers[strings.ToLower(pm.Protocol)]
+		if !ok || !slices.Contains(protos, proto) {
+			continue
+		}
+		for _, family := range []netlink.InetFamily{unix.AF_INET, unix.AF_INET6} {
+			if err := utils.DeleteConntrackEntriesForDstPort(uint16(pm.HostPort), proto, family); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conntrackflush
+
+import (
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/utils"
+)
+
+var _ = Describe("conntrack-flush", func() {
+	It("parses the protocols and the pod's addresses", func() {
+		conf, result, err := parseConf([]byte(`{
+			"cniVersion": "1.0.0",
+			"name": "test",
+			"type": "conntrack-flush",
+			"protocols": ["UDP", "tcp"],
+			"prevResult": {
+				"cniVersion": "1.0.0",
+				"interfaces": [
+					{"name": "veth0"},
+					{"name": "eth0", "sandbox": "/var/run/netns/test"}
+				],
+				"ips": [
+					{"address": "10.0.0.1/24", "interface": 0},
+					{"address": "10.0.0.2/24", "interface": 1},
+					{"address": "fd00::2/64", "interface": 1}
+				]
+			}
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.protocols).To(Equal([]uint8{utils.PROTOCOL_UDP, utils.PROTOCOL_TCP}))
+		ips := []string{}
+		for _, ip := range podIPs(result) {
+			ips = append(ips, ip.String())
+		}
+		Expect(ips).To(Equal([]string{"10.0.0.2", "fd00::2"}))
+
+		conf, result, err = parseConf([]byte(`{"cniVersion": "1.0.0", "name": "test", "type": "conntrack-flush"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(BeNil())
+		Expect(conf.protocols).To(Equal([]uint8{utils.PROTOCOL_UDP}))
+
+		_, _, err = parseConf([]byte(`{"cniVersion": "1.0.0", "name": "test", "type": "conntrack-flush", "protocols": ["icmp"]}`))
+		Expect(err).To(MatchError(`invalid protocol "icmp", must be one of tcp, udp or sctp`))
+	})
+
+	It("matches the flows of the pod's addresses before and after NAT", func() {
+		filter := &podFlowFilter{
+			ips:    []net.IP{net.ParseIP("10.0.0.2")},
+			protos: []uint8{utils.PROTOCOL_UDP},
+		}
+		flow := func(proto uint8, fwdSrc, fwdDst, revSrc, revDst string) *netlink.ConntrackFlow {
+			f := &netlink.ConntrackFlow{}
+			f.Forward.Protocol = proto
+			f.Forward.SrcIP, f.Forward.DstIP = net.ParseIP(fwdSrc), net.ParseIP(fwdDst)
+			f.Reverse.SrcIP, f.Reverse.DstIP = net.ParseIP(revSrc), net.ParseIP(revDst)
+			return f
+		}
+
+		// to the pod, from the pod, to a host port DNAT'ed to the pod, masqueraded from the pod
+		Expect(filter.MatchConntrackFlow(flow(utils.PROTOCOL_UDP, "10.0.0.3", "10.0.0.2", "10.0.0.2", "10.0.0.3"))).To(BeTrue())
+		Expect(filter.MatchConntrackFlow(flow(utils.PROTOCOL_UDP, "10.0.0.2", "1.1.1.1", "1.1.1.1", "10.0.0.2"))).To(BeTrue())
+		Expect(filter.MatchConntrackFlow(flow(utils.PROTOCOL_UDP, "192.0.2.1", "192.0.2.10", "10.0.0.2", "192.0.2.1"))).To(BeTrue())
+		Expect(filter.MatchConntrackFlow(flow(utils.PROTOCOL_UDP, "10.0.0.2", "1.1.1.1", "1.1.1.1", "192.0.2.10"))).To(BeTrue())
+
+		Expect(filter.MatchConntrackFlow(flow(utils.PROTOCOL_TCP, "10.0.0.3", "10.0.0.2", "10.0.0.2", "10.0.0.3"))).To(BeFalse())
+		Expect(filter.MatchConntrackFlow(flow(utils.PROTOCOL_UDP, "10.0.0.3", "10.0.0.4", "10.0.0.4", "10.0.0.3"))).To(BeFalse())
+	})
+})
@@ -0,0 +1,166 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a chained plugin that flushes the host's conntrack entries of a
+// pod's addresses when the pod is deleted, so a pod that is later given the
+// same address doesn't inherit stale NAT sessions. Optionally it also
+// flushes them on ADD, along with the entries of the pod's host ports.
+package conntrackflush
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/cniargs"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/include"
+	"github.com/containernetworking/plugins/pkg/utils"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+)
+
+// FlushConf is the conntrack-flush configuration.
+type FlushConf struct {
+	types.NetConf
+
+	// Protocols are the protocols whose entries are flushed, "udp" only
+	// by default, as TCP sessions to a gone pod are reset by their peers.
+	Protocols []string `json:"protocols,omitempty"`
+	// FlushOnAdd flushes the entries of the pod's addresses and host ports
+	// on ADD too, for entries created before the address was recycled.
+	FlushOnAdd bool `json:"flushOnAdd,omitempty"`
+
+	RuntimeConfig struct {
+		PortMaps []cniargs.PortMapping `json:"portMappings,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+
+	protocols []uint8
+}
+
+var protocolNumbers = map[string]uint8{
+	"tcp":  utils.PROTOCOL_TCP,
+	"udp":  utils.PROTOCOL_UDP,
+	"sctp": utils.PROTOCOL_SCTP,
+}
+
+// Main runs the conntrack-flush plugin.
+func Main() {
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}), version.All, bv.BuildString("conntrack-flush"))
+}
+
+func parseConf(data []byte) (*FlushConf, *current.Result, error) {
+	conf := FlushConf{}
+	if err := config.Validate(data, &conf); err != nil {
+		return nil, nil, fmt.Errorf("invalid network configuration: %v", err)
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	if len(conf.Protocols) == 0 {
+		conf.Protocols = []string{"udp"}
+	}
+	for _, p := range conf.Protocols {
+		proto, ok := protocolNumbers[strings.ToLower(p)]
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid protocol %q, must be one of tcp, udp or sctp", p)
+		}
+		conf.protocols = append(conf.protocols, proto)
+	}
+
+	if conf.RawPrevResult == nil {
+		return &conf, nil, nil
+	}
+	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+		return nil, nil, fmt.Errorf("could not parse prevResult: %v", err)
+	}
+	result, err := current.NewResultFromResult(conf.PrevResult)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not convert result to current version: %v", err)
+	}
+	return &conf, result, nil
+}
+
+// podIPs returns the addresses of the container's interfaces in the result.
+func podIPs(result *current.Result) []net.IP {
+	ips := []net.IP{}
+	for _, ipc := range result.IPs {
+		if ipc.Interface != nil {
+			idx := *ipc.Interface
+			if idx >= 0 && idx < len(result.Interfaces) && result.Interfaces[idx].Sandbox == "" {
+				continue
+			}
+		}
+		ips = append(ips, ipc.Address.IP)
+	}
+	return ips
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, result, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	// Entries are flushed after the pod's address was configured, so new
+	// traffic creates fresh ones. Failures are informative only.
+	if conf.FlushOnAdd {
+		if err := flushPodEntries(podIPs(result), conf.protocols); err != nil {
+			log.Printf("failed to flush conntrack entries of %s: %v", args.ContainerID, err)
+		}
+		if err := flushHostPortEntries(conf.RuntimeConfig.PortMaps, conf.protocols); err != nil {
+			log.Printf("failed to flush conntrack entries of the host ports of %s: %v", args.ContainerID, err)
+		}
+	}
+
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, result, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	// Without a prevResult the pod's addresses are unknown
+	if result == nil {
+		return nil
+	}
+
+	// DEL must not fail on a best effort cleanup
+	if err := flushPodEntries(podIPs(result), conf.protocols); err != nil {
+		log.Printf("failed to flush conntrack entries of %s: %v", args.ContainerID, err)
+	}
+	return nil
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	_, result, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/cniargs"
+	"github.com/containernetworking/plugins/pkg/utils"
+)
+
+const (
+	// DefaultPolicyAllow ("allow"): inbound connections are only subject to
+	// the ingressPolicy. This is the default.
+	DefaultPolicyAllow = "allow"
+	// DefaultPolicyDeny ("deny"): new inbound connections to the container
+	// are dropped, unless an allow rule matches.
+	DefaultPolicyDeny = "deny"
+
+	// defaultDenyChain holds the jumps to the per container chains. It is
+	// inserted at the top of FORWARD, regardless of the backend.
+	defaultDenyChain = "CNI-DEFAULT-DENY"
+)
+
+var portRegexp = regexp.MustCompile(`^[0-9]+(:[0-9]+)?$`)
+
+// AllowRule allows new inbound connections to containers of the network
+// under the "deny" default policy. Unset fields match anything.
+type AllowRule struct {
+	// From is the source CIDR
+	From string `json:"from,omitempty"`
+	// Protocol is "tcp", "udp", "sctp" or "icmp"
+	Protocol string `json:"protocol,omitempty"`
+	// Port is the destination port or port range, e.g. "8000:8100". It
+	// requires a protocol with ports
+	Port string `json:"port,omitempty"`
+}
+
+func (r *AllowRule) validate() error {
+	if r.From != "" {
+		if _, _, err := net.ParseCIDR(r.From); err != nil {
+			return fmt.Errorf("invalid allow rule source %q: %v", r.From, err)
+		}
+	}
+	switch r.Protocol {
+	case "", "icmp":
+		if r.Port != "" {
+			return fmt.Errorf("allow rule port %q requires protocol tcp, udp or sctp", r.Port)
+		}
+	case "tcp", "udp", "sctp":
+		if r.Port != "" && !portRegexp.MatchString(r.Port) {
+			return fmt.Errorf("invalid allow rule port %q, must be like \"80\" or \"8000:8100\"", r.Port)
+		}
+	default:
+		return fmt.Errorf("invalid allow rule protocol %q", r.Protocol)
+	}
+	return nil
+}
+
+// rule returns the iptables rule of r for proto, or nil if r only matches
+// the other IP family.
+func (r *AllowRule) rule(proto iptables.Protocol) []string {
+	rule := []string{}
+	if r.From != "" {
+		_, from, _ := net.ParseCIDR(r.From)
+		if protoForIP(*from) != proto {
+			return nil
+		}
+		rule = append(rule, "-s", from.String())
+	}
+	switch {
+	case r.Protocol == "icmp" && proto == iptables.ProtocolIPv6:
+		rule = append(rule, "-p", "ipv6-icmp")
+	case r.Protocol != "":
+		rule = append(rule, "-p", r.Protocol)
+	}
+	if r.Port != "" {
+		rule = append(rule, "--dport", r.Port)
+	}
+	return append(rule, "-j", "ACCEPT")
+}
+
+func validateDefaultPolicy(conf *FirewallNetConf) error {
+	switch conf.DefaultPolicy {
+	case "", DefaultPolicyAllow:
+		if len(conf.Allow) > 0 || len(conf.Exceptions) > 0 {
+			return fmt.Errorf("allow and exceptions require defaultPolicy %q", DefaultPolicyDeny)
+		}
+		return nil
+	case DefaultPolicyDeny:
+	default:
+		return fmt.Errorf("unknown default policy: %q", conf.DefaultPolicy)
+	}
+	for i := range conf.Allow {
+		if err := conf.Allow[i].validate(); err != nil {
+			return err
+		}
+	}
+	for _, e := range conf.Exceptions {
+		if _, err := path.Match(e, ""); err != nil || strings.Count(e, "/") != 1 {
+			return fmt.Errorf("invalid exception %q, must be a namespace/name pattern", e)
+		}
+	}
+	return nil
+}
+
+// denies returns true if the deny policy applies to the pod named in the
+// CNI_ARGS, i.e. it isn't excepted.
+func denies(conf *FirewallNetConf, envArgs string) (bool, error) {
+	if conf.DefaultPolicy != DefaultPolicyDeny {
+		return false, nil
+	}
+	if len(conf.Exceptions) == 0 {
+		return true, nil
+	}
+	env, err := cniargs.ParseEnv(envArgs)
+	if err != nil {
+		return false, err
+	}
+	ns, name := env[cniargs.KeyPodNamespace], env[cniargs.KeyPodName]
+	if ns == "" || name == "" {
+		// without pod names, nothing can be excepted
+		return true, nil
+	}
+	for _, e := range conf.Exceptions {
+		if ok, _ := path.Match(e, ns+"/"+name); ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func denyChainName(conf *FirewallNetConf, containerID string) string {
+	return utils.MustFormatChainNameWithPrefix(conf.Name, containerID, "DENY-")
+}
+
+// denyJumpRules returns the rules sending new connections to the
+// container's addresses of protocol proto to its deny chain.
+func denyJumpRules(conf *FirewallNetConf, containerID string, result *types100.Result, proto iptables.Protocol) [][]string {
+	var rules [][]string
+	for _, ip := range result.IPs {
+		if protoForIP(ip.Address) != proto {
+			continue
+		}
+		rules = append(rules, []string{
+			"-d", ipString(ip.Address),
+			"-m", "conntrack", "!", "--ctstate", "RELATED,ESTABLISHED",
+			"-m", "comment", "--comment", utils.FormatComment(conf.Name, containerID),
+			"-j", denyChainName(conf, containerID),
+		})
+	}
+	return rules
+}
+
+// denyChainRules returns the allow rules of the container's deny chain,
+// followed by the drop.
+func denyChainRules(conf *FirewallNetConf, proto iptables.Protocol) [][]string {
+	var rules [][]string
+	for i := range conf.Allow {
+		if rule := conf.Allow[i].rule(proto); rule != nil {
+			rules = append(rules, rule)
+		}
+	}
+	return append(rules, []string{"-j", "DROP"})
+}
+
+// setupDefaultDeny drops new inbound connections to the container that no
+// allow rule matches:
+// ```
+// iptables -N CNI-DEFAULT-DENY
+// iptables -I FORWARD -j CNI-DEFAULT-DENY
+// iptables -N CNI-DENY-${hash}
+// iptables -A CNI-DENY-${hash} ${allow rule} -j ACCEPT
+// iptables -A CNI-DENY-${hash} -j DROP
+// iptables -A CNI-DEFAULT-DENY -d ${ip} -m conntrack ! --ctstate RELATED,ESTABLISHED -j CNI-DENY-${hash}
+// ```
+func setupDefaultDeny(conf *FirewallNetConf, containerID, envArgs string, result *types100.Result) error {
+	deny, err := denies(conf, envArgs)
+	if err != nil || !deny {
+		return err
+	}
+	chain := denyChainName(conf, containerID)
+	for _, proto := range findProtos(conf) {
+		jumps := denyJumpRules(conf, containerID, result, proto)
+		if len(jumps) == 0 {
+			continue
+		}
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return err
+		}
+		if err := utils.EnsureChain(ipt, filterTableName, defaultDenyChain); err != nil {
+			return err
+		}
+		if err := utils.InsertUnique(ipt, filterTableName, forwardChainName, true, []string{"-j", defaultDenyChain}); err != nil {
+			return err
+		}
+		if err := utils.EnsureChain(ipt, filterTableName, chain); err != nil {
+			return err
+		}
+		if err := utils.ClearChain(ipt, filterTableName, chain); err != nil {
+			return err
+		}
+		for _, rule := range denyChainRules(conf, proto) {
+			if err := ipt.Append(filterTableName, chain, rule...); err != nil {
+				return fmt.Errorf("failed to add default deny rule: %v", err)
+			}
+		}
+		for _, rule := range jumps {
+			if err := utils.InsertUnique(ipt, filterTableName, defaultDenyChain, false, rule); err != nil {
+				return fmt.Errorf("failed to add default deny rule: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// teardownDefaultDeny deletes the container's deny chain and the jumps to
+// it. Without a prevResult there is nothing to derive the jumps from, like
+// for the other rules, and for excepted pods there is nothing to delete.
+func teardownDefaultDeny(conf *FirewallNetConf, containerID string, result *types100.Result) error {
+	if conf.DefaultPolicy != DefaultPolicyDeny {
+		return nil
+	}
+	chain := denyChainName(conf, containerID)
+	for _, proto := range findProtos(conf) {
+		jumps := denyJumpRules(conf, containerID, result, proto)
+		if len(jumps) == 0 {
+			continue
+		}
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return err
+		}
+		exists, err := ipt.ChainExists(filterTableName, chain)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		for _, rule := range jumps {
+			if err := utils.DeleteRule(ipt, filterTableName, defaultDenyChain, rule...); err != nil {
+				return fmt.Errorf("failed to delete default deny rule: %v", err)
+			}
+		}
+		if err := utils.DeleteChain(ipt, filterTableName, chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkDefaultDeny(conf *FirewallNetConf, containerID, envArgs string, result *types100.Result) error {
+	deny, err := denies(conf, envArgs)
+	if err != nil || !deny {
+		return err
+	}
+	chain := denyChainName(conf, containerID)
+	for _, proto := range findProtos(conf) {
+		jumps := denyJumpRules(conf, containerID, result, proto)
+		if len(jumps) == 0 {
+			continue
+		}
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return err
+		}
+		for _, rule := range denyChainRules(conf, proto) {
+			exists, err := ipt.Exists(filterTableName, chain, rule...)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("expected %v rule %v not found", chain, rule)
+			}
+		}
+		for _, rule := range jumps {
+			exists, err := ipt.Exists(filterTableName, defaultDenyChain, rule...)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("expected %v rule %v not found", defaultDenyChain, rule)
+			}
+		}
+	}
+	return nil
+}
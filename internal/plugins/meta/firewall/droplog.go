@@ -0,0 +1,188 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firewall
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/coreos/go-iptables/iptables"
+
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/utils"
+)
+
+const (
+	defaultDropLogRate   = "10/second"
+	defaultDropLogBurst  = 5
+	defaultDropLogPrefix = "CNI-DROP "
+
+	// maxNflogPrefix is the longest prefix the NFLOG target takes
+	maxNflogPrefix = 64
+)
+
+var dropLogRateRegexp = regexp.MustCompile(`^[1-9][0-9]*/(second|minute|hour|day)$`)
+
+// DropLog sends the packets dropped on their way to the container to an
+// NFLOG group, where e.g. ulogd can collect them. Every container gets its
+// own rules, each rate limited on its own.
+type DropLog struct {
+	// Group is the NFLOG group to send the packets to
+	Group uint16 `json:"group"`
+	// Rate limits the logged packets, in the syntax of the iptables limit
+	// match, e.g. "10/second", which is the default
+	Rate string `json:"rate,omitempty"`
+	// Burst is the number of packets logged before the rate applies,
+	// defaults to 5
+	Burst int `json:"burst,omitempty"`
+	// Prefix is prepended to the log messages, defaults to "CNI-DROP "
+	Prefix string `json:"prefix,omitempty"`
+}
+
+func (d *DropLog) validate(conf *FirewallNetConf) error {
+	if conf.IngressPolicy != IngressPolicySameBridge {
+		return fmt.Errorf("dropLog requires ingressPolicy %q, the only policy dropping packets", IngressPolicySameBridge)
+	}
+	if d.Rate == "" {
+		d.Rate = defaultDropLogRate
+	}
+	if !dropLogRateRegexp.MatchString(d.Rate) {
+		return fmt.Errorf("invalid dropLog rate %q, must be like \"10/second\"", d.Rate)
+	}
+	if d.Burst == 0 {
+		d.Burst = defaultDropLogBurst
+	}
+	if d.Burst < 0 {
+		return fmt.Errorf("invalid dropLog burst %d", d.Burst)
+	}
+	if d.Prefix == "" {
+		d.Prefix = defaultDropLogPrefix
+	}
+	if len(d.Prefix) > maxNflogPrefix {
+		return fmt.Errorf("dropLog prefix %q is longer than %d characters", d.Prefix, maxNflogPrefix)
+	}
+	return nil
+}
+
+// dropLogRules returns the rules logging the packets to the container's
+// addresses of protocol proto, which CNI-ISOLATION-STAGE-2 is about to drop.
+func dropLogRules(conf *FirewallNetConf, containerID string, result *types100.Result, proto iptables.Protocol) ([][]string, error) {
+	var ips []string
+	for _, ip := range result.IPs {
+		if protoForIP(ip.Address) == proto {
+			ips = append(ips, ipString(ip.Address))
+		}
+	}
+	if len(ips) == 0 {
+		return nil, nil
+	}
+	bridgeName, err := sameBridgeName(conf, result)
+	if err != nil {
+		return nil, err
+	}
+
+	d := conf.DropLog
+	rules := make([][]string, 0, len(ips))
+	for _, ip := range ips {
+		rules = append(rules, []string{
+			"-o", bridgeName, "-d", ip,
+			"-m", "comment", "--comment", utils.FormatComment(conf.Name, containerID),
+			"-m", "limit", "--limit", d.Rate, "--limit-burst", strconv.Itoa(d.Burst),
+			"-j", "NFLOG", "--nflog-group", strconv.Itoa(int(d.Group)), "--nflog-prefix", d.Prefix,
+		})
+	}
+	return rules, nil
+}
+
+// setupDropLog inserts the container's log rules in front of the drop rule
+// of its bridge.
+func setupDropLog(conf *FirewallNetConf, containerID string, result *types100.Result) error {
+	if conf.DropLog == nil {
+		return nil
+	}
+	for _, proto := range findProtos(conf) {
+		rules, err := dropLogRules(conf, containerID, result, proto)
+		if err != nil {
+			return err
+		}
+		if len(rules) == 0 {
+			continue
+		}
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			if err := utils.InsertUnique(ipt, filterTableName, stage2Chain, true, rule); err != nil {
+				return fmt.Errorf("failed to add drop log rule: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// teardownDropLog deletes the container's log rules. Without a prevResult
+// there is nothing to derive them from, like for the other rules.
+func teardownDropLog(conf *FirewallNetConf, containerID string, result *types100.Result) error {
+	if conf.DropLog == nil {
+		return nil
+	}
+	for _, proto := range findProtos(conf) {
+		rules, err := dropLogRules(conf, containerID, result, proto)
+		if err != nil || len(rules) == 0 {
+			continue
+		}
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			if err := utils.DeleteRule(ipt, filterTableName, stage2Chain, rule...); err != nil {
+				return fmt.Errorf("failed to delete drop log rule: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+func checkDropLog(conf *FirewallNetConf, containerID string, result *types100.Result) error {
+	if conf.DropLog == nil {
+		return nil
+	}
+	for _, proto := range findProtos(conf) {
+		rules, err := dropLogRules(conf, containerID, result, proto)
+		if err != nil {
+			return err
+		}
+		if len(rules) == 0 {
+			continue
+		}
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			exists, err := ipt.Exists(filterTableName, stage2Chain, rule...)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("expected %v rule %v not found", stage2Chain, rule)
+			}
+		}
+	}
+	return nil
+}
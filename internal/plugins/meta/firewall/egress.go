@@ -0,0 +1,303 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firewall
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/coreos/go-iptables/iptables"
+
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/utils"
+)
+
+const (
+	// EgressAllow and EgressDeny are the actions of egress rules, and the
+	// defaults of the egress policy.
+	EgressAllow = "allow"
+	EgressDeny  = "deny"
+
+	// egressChain holds the jumps to the per container egress chains. It
+	// is inserted at the top of FORWARD, regardless of the backend.
+	egressChain = "CNI-EGRESS"
+)
+
+// EgressPolicy restricts the new connections the container opens. The
+// rules are matched in order, the first match decides; connections no rule
+// matches get the default. Replies to inbound connections aren't affected.
+type EgressPolicy struct {
+	// Default is "allow", the default, or "deny"
+	Default string `json:"default,omitempty"`
+	// Rules allow or deny connections to destinations
+	Rules []EgressRule `json:"rules,omitempty"`
+}
+
+// EgressRule matches new outbound connections of the container. Unset
+// fields match anything.
+type EgressRule struct {
+	// Action is "allow" or "deny"
+	Action string `json:"action"`
+	// To are the destination CIDRs
+	To []string `json:"to,omitempty"`
+	// Protocol is "tcp", "udp", "sctp" or "icmp"
+	Protocol string `json:"protocol,omitempty"`
+	// Port is the destination port or port range, e.g. "8000:8100". It
+	// requires a protocol with ports
+	Port string `json:"port,omitempty"`
+}
+
+func (r *EgressRule) validate() error {
+	switch r.Action {
+	case EgressAllow, EgressDeny:
+	default:
+		return fmt.Errorf("invalid egress rule action %q, must be %q or %q", r.Action, EgressAllow, EgressDeny)
+	}
+	for _, to := range r.To {
+		if _, _, err := net.ParseCIDR(to); err != nil {
+			return fmt.Errorf("invalid egress rule destination %q: %v", to, err)
+		}
+	}
+	switch r.Protocol {
+	case "", "icmp":
+		if r.Port != "" {
+			return fmt.Errorf("egress rule port %q requires protocol tcp, udp or sctp", r.Port)
+		}
+	case "tcp", "udp", "sctp":
+		if r.Port != "" && !portRegexp.MatchString(r.Port) {
+			return fmt.Errorf("invalid egress rule port %q, must be like \"80\" or \"8000:8100\"", r.Port)
+		}
+	default:
+		return fmt.Errorf("invalid egress rule protocol %q", r.Protocol)
+	}
+	return nil
+}
+
+// rules returns the iptables rules of r for proto, one per destination of
+// that IP family, none if all its destinations are of the other one.
+func (r *EgressRule) rules(proto iptables.Protocol) [][]string {
+	match := []string{}
+	switch {
+	case r.Protocol == "icmp" && proto == iptables.ProtocolIPv6:
+		match = append(match, "-p", "ipv6-icmp")
+	case r.Protocol != "":
+		match = append(match, "-p", r.Protocol)
+	}
+	if r.Port != "" {
+		match = append(match, "--dport", r.Port)
+	}
+	// allowed connections go on through FORWARD, to the isolation of the
+	// ingress policy and the rules of other plugins
+	target := []string{"-j", "RETURN"}
+	if r.Action == EgressDeny {
+		target = []string{"-j", "DROP"}
+	}
+
+	if len(r.To) == 0 {
+		return [][]string{append(match, target...)}
+	}
+	var rules [][]string
+	for _, to := range r.To {
+		_, dst, _ := net.ParseCIDR(to)
+		if protoForIP(*dst) != proto {
+			continue
+		}
+		rule := append([]string{"-d", dst.String()}, match...)
+		rules = append(rules, append(rule, target...))
+	}
+	return rules
+}
+
+// egressPolicy returns the egress policy of the container, the one of the
+// runtime config replacing the configured one as a whole.
+func egressPolicy(conf *FirewallNetConf) *EgressPolicy {
+	if conf.RuntimeConfig.Egress != nil {
+		return conf.RuntimeConfig.Egress
+	}
+	return conf.Egress
+}
+
+func validateEgress(conf *FirewallNetConf) error {
+	policy := egressPolicy(conf)
+	if policy == nil {
+		return nil
+	}
+	switch policy.Default {
+	case "", EgressAllow, EgressDeny:
+	default:
+		return fmt.Errorf("invalid egress default %q, must be %q or %q", policy.Default, EgressAllow, EgressDeny)
+	}
+	for i := range policy.Rules {
+		if err := policy.Rules[i].validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func egressChainName(conf *FirewallNetConf, containerID string) string {
+	return utils.MustFormatChainNameWithPrefix(conf.Name, containerID, "EGR-")
+}
+
+// egressJumpRules returns the rules sending new connections from the
+// container's addresses of protocol proto to its egress chain.
+func egressJumpRules(conf *FirewallNetConf, containerID string, result *types100.Result, proto iptables.Protocol) [][]string {
+	var rules [][]string
+	for _, ip := range result.IPs {
+		if protoForIP(ip.Address) != proto {
+			continue
+		}
+		rules = append(rules, []string{
+			"-s", ipString(ip.Address),
+			"-m", "conntrack", "!", "--ctstate", "RELATED,ESTABLISHED",
+			"-m", "comment", "--comment", utils.FormatComment(conf.Name, containerID),
+			"-j", egressChainName(conf, containerID),
+		})
+	}
+	return rules
+}
+
+// egressChainRules returns the rules of the container's egress chain, with
+// the drop of a "deny" default last.
+func egressChainRules(policy *EgressPolicy, proto iptables.Protocol) [][]string {
+	var rules [][]string
+	for i := range policy.Rules {
+		rules = append(rules, policy.Rules[i].rules(proto)...)
+	}
+	if policy.Default == EgressDeny {
+		rules = append(rules, []string{"-j", "DROP"})
+	}
+	return rules
+}
+
+// setupEgress restricts the new connections the container opens by its
+// egress policy:
+// ```
+// iptables -N CNI-EGRESS
+// iptables -I FORWARD -j CNI-EGRESS
+// iptables -N CNI-EGR-${hash}
+// iptables -A CNI-EGR-${hash} -d ${cidr} ${match} -j RETURN|DROP
+// iptables -A CNI-EGR-${hash} -j DROP # with default "deny"
+// iptables -A CNI-EGRESS -s ${ip} -m conntrack ! --ctstate RELATED,ESTABLISHED -j CNI-EGR-${hash}
+// ```
+func setupEgress(conf *FirewallNetConf, containerID string, result *types100.Result) error {
+	policy := egressPolicy(conf)
+	if policy == nil {
+		return nil
+	}
+	chain := egressChainName(conf, containerID)
+	for _, proto := range findProtos(conf) {
+		jumps := egressJumpRules(conf, containerID, result, proto)
+		if len(jumps) == 0 {
+			continue
+		}
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return err
+		}
+		if err := utils.EnsureChain(ipt, filterTableName, egressChain); err != nil {
+			return err
+		}
+		if err := utils.InsertUnique(ipt, filterTableName, forwardChainName, true, []string{"-j", egressChain}); err != nil {
+			return err
+		}
+		if err := utils.EnsureChain(ipt, filterTableName, chain); err != nil {
+			return err
+		}
+		if err := utils.ClearChain(ipt, filterTableName, chain); err != nil {
+			return err
+		}
+		for _, rule := range egressChainRules(policy, proto) {
+			if err := ipt.Append(filterTableName, chain, rule...); err != nil {
+				return fmt.Errorf("failed to add egress rule: %v", err)
+			}
+		}
+		for _, rule := range jumps {
+			if err := utils.InsertUnique(ipt, filterTableName, egressChain, false, rule); err != nil {
+				return fmt.Errorf("failed to add egress rule: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// teardownEgress deletes the container's egress chain and the jumps to it,
+// whatever the policy, as the runtime config of the DEL may not have one.
+func teardownEgress(conf *FirewallNetConf, containerID string, result *types100.Result) error {
+	chain := egressChainName(conf, containerID)
+	for _, proto := range findProtos(conf) {
+		jumps := egressJumpRules(conf, containerID, result, proto)
+		if len(jumps) == 0 {
+			continue
+		}
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return err
+		}
+		exists, err := ipt.ChainExists(filterTableName, chain)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		for _, rule := range jumps {
+			if err := utils.DeleteRule(ipt, filterTableName, egressChain, rule...); err != nil {
+				return fmt.Errorf("failed to delete egress rule: %v", err)
+			}
+		}
+		if err := utils.DeleteChain(ipt, filterTableName, chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkEgress(conf *FirewallNetConf, containerID string, result *types100.Result) error {
+	policy := egressPolicy(conf)
+	if policy == nil {
+		return nil
+	}
+	chain := egressChainName(conf, containerID)
+	for _, proto := range findProtos(conf) {
+		jumps := egressJumpRules(conf, containerID, result, proto)
+		if len(jumps) == 0 {
+			continue
+		}
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return err
+		}
+		for _, rule := range egressChainRules(policy, proto) {
+			exists, err := ipt.Exists(filterTableName, chain, rule...)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("expected %v rule %v not found", chain, rule)
+			}
+		}
+		for _, rule := range jumps {
+			exists, err := ipt.Exists(filterTableName, egressChain, rule...)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("expected %v rule %v not found", egressChain, rule)
+			}
+		}
+	}
+	return nil
+}
@@ -15,7 +15,7 @@
 // This is a "meta-plugin". It reads in its own netconf, it does not create
 // any network interface but just changes the network sysctl.
 
-package main
+package firewall
 
 import (
 	"encoding/json"
@@ -26,6 +26,9 @@ import (
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/include"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 )
 
@@ -49,6 +52,28 @@ type FirewallNetConf struct {
 	// IngressPolicy is an optional ingress policy.
 	// Defaults to "open".
 	IngressPolicy IngressPolicy `json:"ingressPolicy,omitempty"`
+
+	// DropLog optionally logs the packets dropped by the ingress policy
+	// to an NFLOG group.
+	DropLog *DropLog `json:"dropLog,omitempty"`
+
+	// DefaultPolicy is "allow" (the default) or "deny", which drops new
+	// inbound connections to the container unless one of Allow matches.
+	DefaultPolicy string `json:"defaultPolicy,omitempty"`
+	// Allow lists the inbound connections the "deny" policy lets through.
+	Allow []AllowRule `json:"allow,omitempty"`
+	// Exceptions are "namespace/name" patterns, e.g. "kube-system/*", of
+	// the pods the "deny" policy doesn't apply to. The pod is taken from
+	// K8S_POD_NAMESPACE and K8S_POD_NAME in CNI_ARGS.
+	Exceptions []string `json:"exceptions,omitempty"`
+
+	// Egress optionally restricts the connections the container opens.
+	Egress *EgressPolicy `json:"egress,omitempty"`
+
+	RuntimeConfig struct {
+		// Egress replaces the configured egress policy for the container
+		Egress *EgressPolicy `json:"egress,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
 }
 
 // IngressPolicy is an ingress policy string.
@@ -81,6 +106,9 @@ func ipString(ip net.IPNet) string {
 
 func parseConf(data []byte) (*FirewallNetConf, *current.Result, error) {
 	conf := FirewallNetConf{}
+	if err := config.Validate(data, &conf); err != nil {
+		return nil, nil, fmt.Errorf("invalid network configuration: %v", err)
+	}
 	if err := json.Unmarshal(data, &conf); err != nil {
 		return nil, nil, fmt.Errorf("failed to load netconf: %v", err)
 	}
@@ -90,6 +118,20 @@ func parseConf(data []byte) (*FirewallNetConf, *current.Result, error) {
 		conf.FirewalldZone = "trusted"
 	}
 
+	if conf.DropLog != nil {
+		if err := conf.DropLog.validate(&conf); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := validateDefaultPolicy(&conf); err != nil {
+		return nil, nil, err
+	}
+
+	if err := validateEgress(&conf); err != nil {
+		return nil, nil, err
+	}
+
 	// Parse previous result.
 	if conf.RawPrevResult == nil {
 		// return early if there was no previous result, which is allowed for DEL calls
@@ -151,6 +193,18 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
+	if err := setupDropLog(conf, args.ContainerID, result); err != nil {
+		return err
+	}
+
+	if err := setupDefaultDeny(conf, args.ContainerID, args.Args, result); err != nil {
+		return err
+	}
+
+	if err := setupEgress(conf, args.ContainerID, result); err != nil {
+		return err
+	}
+
 	if result == nil {
 		result = &current.Result{
 			CNIVersion: current.ImplementedSpecVersion,
@@ -175,11 +229,24 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	}
 
+	if err := teardownDropLog(conf, args.ContainerID, result); err != nil {
+		return err
+	}
+
+	if err := teardownDefaultDeny(conf, args.ContainerID, result); err != nil {
+		return err
+	}
+
+	if err := teardownEgress(conf, args.ContainerID, result); err != nil {
+		return err
+	}
+
 	return teardownIngressPolicy(conf)
 }
 
-func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.VersionsStartingFrom("0.4.0"), bv.BuildString("firewall"))
+// Main runs the firewall plugin.
+func Main() {
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}), version.VersionsStartingFrom("0.4.0"), bv.BuildString("firewall"))
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
@@ -198,5 +265,17 @@ func cmdCheck(args *skel.CmdArgs) error {
 		return err
 	}
 
-	return backend.Check(conf, result)
+	if err := backend.Check(conf, result); err != nil {
+		return err
+	}
+
+	if err := checkDropLog(conf, args.ContainerID, result); err != nil {
+		return err
+	}
+
+	if err := checkDefaultDeny(conf, args.ContainerID, args.Args, result); err != nil {
+		return err
+	}
+
+	return checkEgress(conf, args.ContainerID, result)
 }
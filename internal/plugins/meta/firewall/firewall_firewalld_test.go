@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package firewall
 
 import (
 	"bufio"
@@ -111,7 +111,7 @@ func makeFirewalldConf(ver string, ns ns.NetNS) []byte {
 	  "name": "firewalld-test",
 	  "type": "firewall",
 	  "backend": "firewalld",
-	  "zone": "trusted",
+	  "firewalldZone": "trusted",
 	  "prevResult": {
 	    "cniVersion": "%s",
 	    "interfaces": [
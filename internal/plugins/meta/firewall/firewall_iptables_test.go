@@ -0,0 +1,787 @@
+// Copyright 2017 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firewall
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	types040 "github.com/containernetworking/cni/pkg/types/040"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+)
+
+func findChains(chains []string) (bool, bool) {
+	var foundAdmin, foundPriv bool
+	for _, ch := range chains {
+		if ch == "CNI-ADMIN" {
+			foundAdmin = true
+		} else if ch == "CNI-FORWARD" {
+			foundPriv = true
+		}
+	}
+	return foundAdmin, foundPriv
+}
+
+func findForwardJumpRules(rules []string) (bool, bool) {
+	var foundAdmin, foundPriv bool
+	for _, rule := range rules {
+		if strings.Contains(rule, "-j CNI-ADMIN") {
+			foundAdmin = true
+		} else if strings.Contains(rule, "-j CNI-FORWARD") {
+			foundPriv = true
+		}
+	}
+	return foundAdmin, foundPriv
+}
+
+func findForwardAllowRules(rules []string, ip string) (bool, bool) {
+	var foundOne, foundTwo bool
+	for _, rule := range rules {
+		if !strings.HasSuffix(rule, "-j ACCEPT") {
+			continue
+		}
+		if strings.Contains(rule, fmt.Sprintf(" -s %s ", ip)) {
+			foundOne = true
+		} else if strings.Contains(rule, fmt.Sprintf(" -d %s ", ip)) && strings.Contains(rule, "RELATED,ESTABLISHED") {
+			foundTwo = true
+		}
+	}
+	return foundOne, foundTwo
+}
+
+func getPrevResult(bytes []byte) *current.Result {
+	type TmpConf struct {
+		types.NetConf
+		RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+		PrevResult    *current.Result        `json:"-"`
+	}
+
+	conf := &TmpConf{}
+	err := json.Unmarshal(bytes, conf)
+	Expect(err).NotTo(HaveOccurred())
+	if conf.RawPrevResult == nil {
+		return nil
+	}
+
+	resultBytes, err := json.Marshal(conf.RawPrevResult)
+	Expect(err).NotTo(HaveOccurred())
+	res, err := version.NewResult(conf.CNIVersion, resultBytes)
+	Expect(err).NotTo(HaveOccurred())
+	prevResult, err := current.NewResultFromResult(res)
+	Expect(err).NotTo(HaveOccurred())
+
+	return prevResult
+}
+
+func validateFullRuleset(bytes []byte) {
+	prevResult := getPrevResult(bytes)
+
+	for _, ip := range prevResult.IPs {
+		ipt, err := iptables.NewWithProtocol(protoForIP(ip.Address))
+		Expect(err).NotTo(HaveOccurred())
+
+		// Ensure chains
+		chains, err := ipt.ListChains("filter")
+		Expect(err).NotTo(HaveOccurred())
+		foundAdmin, foundPriv := findChains(chains)
+		Expect(foundAdmin).To(BeTrue())
+		Expect(foundPriv).To(BeTrue())
+
+		// Look for the FORWARD chain jump rules to our custom chains
+		rules, err := ipt.List("filter", "FORWARD")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(rules)).Should(BeNumerically(">", 1))
+		_, foundPriv = findForwardJumpRules(rules)
+		Expect(foundPriv).To(BeTrue())
+
+		// Look for the allow rules in our custom FORWARD chain
+		rules, err = ipt.List("filter", "CNI-FORWARD")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(rules)).Should(BeNumerically(">", 1))
+		foundAdmin, _ = findForwardJumpRules(rules)
+		Expect(foundAdmin).To(BeTrue())
+
+		// Look for the IP allow rules
+		foundOne, foundTwo := findForwardAllowRules(rules, ipString(ip.Address))
+		Expect(foundOne).To(BeTrue())
+		Expect(foundTwo).To(BeTrue())
+	}
+}
+
+func validateCleanedUp(bytes []byte) {
+	prevResult := getPrevResult(bytes)
+
+	for _, ip := range prevResult.IPs {
+		ipt, err := iptables.NewWithProtocol(protoForIP(ip.Address))
+		Expect(err).NotTo(HaveOccurred())
+
+		// Our private and admin chains don't get cleaned up
+		chains, err := ipt.ListChains("filter")
+		Expect(err).NotTo(HaveOccurred())
+		foundAdmin, foundPriv := findChains(chains)
+		Expect(foundAdmin).To(BeTrue())
+		Expect(foundPriv).To(BeTrue())
+
+		// Look for the FORWARD chain jump rules to our custom chains
+		rules, err := ipt.List("filter", "FORWARD")
+		Expect(err).NotTo(HaveOccurred())
+		_, foundPriv = findForwardJumpRules(rules)
+		Expect(foundPriv).To(BeTrue())
+
+		// Look for the allow rules in our custom FORWARD chain
+		rules, err = ipt.List("filter", "CNI-FORWARD")
+		Expect(err).NotTo(HaveOccurred())
+		foundAdmin, _ = findForwardJumpRules(rules)
+		Expect(foundAdmin).To(BeTrue())
+
+		// Expect no IP address rules for this IP
+		foundOne, foundTwo := findForwardAllowRules(rules, ipString(ip.Address))
+		Expect(foundOne).To(BeFalse())
+		Expect(foundTwo).To(BeFalse())
+	}
+}
+
+func makeIptablesConf(ver string) []byte {
+	return []byte(fmt.Sprintf(`{
+		"name": "test",
+		"type": "firewall",
+		"backend": "iptables",
+		"ifName": "dummy0",
+		"cniVersion": "%s",
+		"prevResult": {
+			"cniVersion": "%s",
+			"interfaces": [
+				{"name": "dummy0"}
+			],
+			"ips": [
+				{
+					"version": "4",
+					"address": "10.0.0.2/24",
+					"interface": 0
+				},
+				{
+					"version": "6",
+					"address": "2001:db8:1:2::1/64",
+					"interface": 0
+				}
+			]
+		}
+	}`, ver, ver))
+}
+
+var _ = Describe("firewall plugin iptables backend", func() {
+	var originalNS, targetNS ns.NetNS
+	const IFNAME string = "dummy0"
+
+	BeforeEach(func() {
+		// Create a new NetNS so we don't modify the host
+		var err error
+		originalNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err = netlink.LinkAdd(&netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: IFNAME,
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		targetNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(targetNS.Close()).To(Succeed())
+	})
+
+	// firewall plugin requires a prevResult and thus only supports 0.3.0
+	// and later CNI versions
+	for _, ver := range []string{"0.3.0", "0.3.1", "0.4.0", "1.0.0"} {
+		// Redefine ver inside for scope so real value is picked up by each dynamically defined It()
+		// See Gingkgo's "Patterns for dynamically generating tests" documentation.
+		ver := ver
+
+		It(fmt.Sprintf("[%s] passes prevResult through unchanged", ver), func() {
+			fullConf := makeIptablesConf(ver)
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   fullConf,
+			}
+
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				r, _, err := testutils.CmdAdd(targetNS.Path(), args.ContainerID, IFNAME, fullConf, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				result, err := current.GetResult(r)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(result.Interfaces).To(HaveLen(1))
+				Expect(result.Interfaces[0].Name).To(Equal(IFNAME))
+				Expect(result.IPs).To(HaveLen(2))
+				Expect(result.IPs[0].Address.String()).To(Equal("10.0.0.2/24"))
+				Expect(result.IPs[1].Address.String()).To(Equal("2001:db8:1:2::1/64"))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It(fmt.Sprintf("[%s] installs the right iptables rules on the host", ver), func() {
+			fullConf := makeIptablesConf(ver)
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   fullConf,
+			}
+
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				_, _, err := testutils.CmdAdd(targetNS.Path(), args.ContainerID, IFNAME, fullConf, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				validateFullRuleset(fullConf)
+
+				// ensure creation is idempotent
+				_, _, err = testutils.CmdAdd(targetNS.Path(), args.ContainerID, IFNAME, fullConf, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It(fmt.Sprintf("[%s] correctly handles a custom IptablesAdminChainName", ver), func() {
+			conf := []byte(fmt.Sprintf(`{
+				"name": "test",
+				"type": "firewall",
+				"backend": "iptables",
+				"ifName": "dummy0",
+				"cniVersion": "%s",
+				"iptablesAdminChainName": "CNI-foobar",
+				"prevResult": {
+					"cniVersion": "%s",
+					"interfaces": [
+						{"name": "dummy0"}
+					],
+					"ips": [
+						{
+							"version": "4",
+							"address": "10.0.0.2/24",
+							"interface": 0
+						},
+						{
+							"version": "6",
+							"address": "2001:db8:1:2::1/64",
+							"interface": 0
+						}
+					]
+				}
+			}`, ver, ver))
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   conf,
+			}
+
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				_, _, err := testutils.CmdAdd(targetNS.Path(), args.ContainerID, IFNAME, conf, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				var ipt *iptables.IPTables
+				for _, proto := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+					ipt, err = iptables.NewWithProtocol(proto)
+					Expect(err).NotTo(HaveOccurred())
+
+					// Ensure custom admin chain name
+					chains, err := ipt.ListChains("filter")
+					Expect(err).NotTo(HaveOccurred())
+					var foundAdmin bool
+					for _, ch := range chains {
+						if ch == "CNI-foobar" {
+							foundAdmin = true
+						}
+					}
+					Expect(foundAdmin).To(BeTrue())
+				}
+
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It(fmt.Sprintf("[%s] installs iptables rules, checks rules, then cleans up on delete", ver), func() {
+			fullConf := makeIptablesConf(ver)
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   fullConf,
+			}
+
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				r, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = types040.GetResult(r)
+				Expect(err).NotTo(HaveOccurred())
+
+				if testutils.SpecVersionHasCHECK(ver) {
+					err = testutils.CmdCheckWithArgs(args, func() error {
+						return cmdCheck(args)
+					})
+					Expect(err).NotTo(HaveOccurred())
+					validateFullRuleset(fullConf)
+				}
+
+				err = testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				validateCleanedUp(fullConf)
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	}
+
+	It("logs dropped packets per container to an NFLOG group", func() {
+		conf := []byte(`{
+			"name": "test",
+			"type": "firewall",
+			"backend": "iptables",
+			"ingressPolicy": "same-bridge",
+			"dropLog": {"group": 7, "rate": "5/minute"},
+			"cniVersion": "1.0.0",
+			"prevResult": {
+				"cniVersion": "1.0.0",
+				"interfaces": [
+					{"name": "dummy0"}
+				],
+				"ips": [
+					{
+						"address": "10.0.0.2/24",
+						"interface": 0
+					}
+				]
+			}
+		}`)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   conf,
+		}
+		logRules := func(ipt *iptables.IPTables) []string {
+			rules, err := ipt.List("filter", "CNI-ISOLATION-STAGE-2")
+			Expect(err).NotTo(HaveOccurred())
+			var found []string
+			for _, rule := range rules {
+				if strings.Contains(rule, "-j NFLOG") {
+					found = append(found, rule)
+				}
+			}
+			return found
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+			Expect(err).NotTo(HaveOccurred())
+			rules, err := ipt.List("filter", "CNI-ISOLATION-STAGE-2")
+			Expect(err).NotTo(HaveOccurred())
+			// the log rule comes before the drop
+			Expect(rules[1]).To(ContainSubstring("-d 10.0.0.2/32 -o dummy0"))
+			Expect(rules[1]).To(ContainSubstring("--limit 5/min --limit-burst 5"))
+			Expect(rules[1]).To(ContainSubstring(`-j NFLOG --nflog-prefix "CNI-DROP " --nflog-group 7`))
+			Expect(logRules(ipt)).To(HaveLen(1))
+
+			Expect(testutils.CmdCheckWithArgs(args, func() error {
+				return cmdCheck(args)
+			})).To(Succeed())
+
+			Expect(ipt.Delete("filter", "CNI-ISOLATION-STAGE-2", dropLogRulesFor(conf, "dummy")...)).To(Succeed())
+			err = testutils.CmdCheckWithArgs(args, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).To(MatchError(ContainSubstring("expected CNI-ISOLATION-STAGE-2 rule")))
+
+			Expect(testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})).Error().NotTo(HaveOccurred())
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+			Expect(logRules(ipt)).To(BeEmpty())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("denies new inbound connections except for the allowed ones", func() {
+		conf := []byte(`{
+			"name": "test",
+			"type": "firewall",
+			"backend": "iptables",
+			"defaultPolicy": "deny",
+			"allow": [
+				{"protocol": "tcp", "port": "80"},
+				{"from": "10.0.0.0/24", "protocol": "icmp"}
+			],
+			"exceptions": ["kube-system/*"],
+			"cniVersion": "1.0.0",
+			"prevResult": {
+				"cniVersion": "1.0.0",
+				"interfaces": [
+					{"name": "dummy0"}
+				],
+				"ips": [
+					{
+						"address": "10.0.0.2/24",
+						"interface": 0
+					}
+				]
+			}
+		}`)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   conf,
+			Args:        "K8S_POD_NAMESPACE=default;K8S_POD_NAME=web",
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+			Expect(err).NotTo(HaveOccurred())
+			rules, err := ipt.List("filter", "FORWARD")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules[1]).To(Equal("-A FORWARD -j CNI-DEFAULT-DENY"))
+
+			rules, err = ipt.List("filter", "CNI-DEFAULT-DENY")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules).To(HaveLen(2))
+			Expect(rules[1]).To(ContainSubstring("-d 10.0.0.2/32 -m conntrack ! --ctstate RELATED,ESTABLISHED"))
+			chain := rules[1][strings.LastIndex(rules[1], " ")+1:]
+			Expect(chain).To(HavePrefix("CNI-DENY-"))
+
+			rules, err = ipt.List("filter", chain)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules[1:]).To(Equal([]string{
+				"-A " + chain + " -p tcp -m tcp --dport 80 -j ACCEPT",
+				"-A " + chain + " -s 10.0.0.0/24 -p icmp -j ACCEPT",
+				"-A " + chain + " -j DROP",
+			}))
+
+			Expect(testutils.CmdCheckWithArgs(args, func() error {
+				return cmdCheck(args)
+			})).To(Succeed())
+
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+			rules, err = ipt.List("filter", "CNI-DEFAULT-DENY")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules).To(HaveLen(1))
+			exists, err := ipt.ChainExists("filter", chain)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+
+			// excepted pods are left open
+			args.Args = "K8S_POD_NAMESPACE=kube-system;K8S_POD_NAME=coredns"
+			_, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			exists, err = ipt.ChainExists("filter", chain)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("restricts new outbound connections by the egress policy of the runtime config", func() {
+		conf := []byte(`{
+			"name": "test",
+			"type": "firewall",
+			"backend": "iptables",
+			"egress": {"default": "allow"},
+			"runtimeConfig": {
+				"egress": {
+					"default": "deny",
+					"rules": [
+						{"action": "deny", "to": ["10.0.0.1/32"]},
+						{"action": "allow", "to": ["10.0.0.0/24", "2001:db8::/64"], "protocol": "tcp", "port": "443"},
+						{"action": "allow", "protocol": "udp", "port": "53"}
+					]
+				}
+			},
+			"cniVersion": "1.0.0",
+			"prevResult": {
+				"cniVersion": "1.0.0",
+				"interfaces": [
+					{"name": "dummy0"}
+				],
+				"ips": [
+					{
+						"address": "10.0.0.2/24",
+						"interface": 0
+					}
+				]
+			}
+		}`)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   conf,
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+			Expect(err).NotTo(HaveOccurred())
+			rules, err := ipt.List("filter", "FORWARD")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules).To(ContainElement("-A FORWARD -j CNI-EGRESS"))
+
+			rules, err = ipt.List("filter", "CNI-EGRESS")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules).To(HaveLen(2))
+			Expect(rules[1]).To(ContainSubstring("-s 10.0.0.2/32 -m conntrack ! --ctstate RELATED,ESTABLISHED"))
+			chain := rules[1][strings.LastIndex(rules[1], " ")+1:]
+			Expect(chain).To(HavePrefix("CNI-EGR-"))
+
+			rules, err = ipt.List("filter", chain)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules[1:]).To(Equal([]string{
+				"-A " + chain + " -d 10.0.0.1/32 -j DROP",
+				"-A " + chain + " -d 10.0.0.0/24 -p tcp -m tcp --dport 443 -j RETURN",
+				"-A " + chain + " -p udp -m udp --dport 53 -j RETURN",
+				"-A " + chain + " -j DROP",
+			}))
+
+			Expect(testutils.CmdCheckWithArgs(args, func() error {
+				return cmdCheck(args)
+			})).To(Succeed())
+
+			// DEL removes the chain without any policy
+			var delConf map[string]interface{}
+			Expect(json.Unmarshal(conf, &delConf)).To(Succeed())
+			delete(delConf, "egress")
+			delete(delConf, "runtimeConfig")
+			del := *args
+			del.StdinData, err = json.Marshal(delConf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(testutils.CmdDelWithArgs(&del, func() error {
+				return cmdDel(&del)
+			})).To(Succeed())
+			rules, err = ipt.List("filter", "CNI-EGRESS")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules).To(HaveLen(1))
+			exists, err := ipt.ChainExists("filter", chain)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+// dropLogRulesFor returns the IPv4 drop log rule the config installs for
+// the container.
+func dropLogRulesFor(data []byte, containerID string) []string {
+	conf, result, err := parseConf(data)
+	Expect(err).NotTo(HaveOccurred())
+	rules, err := dropLogRules(conf, containerID, result, iptables.ProtocolIPv4)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(rules).To(HaveLen(1))
+	return rules[0]
+}
+
+var _ = Describe("firewall dropLog config", func() {
+	parse := func(ingressPolicy, dropLog string) error {
+		_, _, err := parseConf([]byte(fmt.Sprintf(`{
+			"name": "test",
+			"type": "firewall",
+			"cniVersion": "1.0.0",
+			"ingressPolicy": "%s",
+			"dropLog": %s
+		}`, ingressPolicy, dropLog)))
+		return err
+	}
+
+	It("applies defaults", func() {
+		conf, _, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "firewall",
+			"cniVersion": "1.0.0",
+			"ingressPolicy": "same-bridge",
+			"dropLog": {"group": 3}
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*conf.DropLog).To(Equal(DropLog{Group: 3, Rate: "10/second", Burst: 5, Prefix: "CNI-DROP "}))
+	})
+
+	It("rejects invalid settings", func() {
+		Expect(parse("open", `{"group": 3}`)).To(MatchError(`dropLog requires ingressPolicy "same-bridge", the only policy dropping packets`))
+		Expect(parse("same-bridge", `{"rate": "fast"}`)).To(MatchError(`invalid dropLog rate "fast", must be like "10/second"`))
+		Expect(parse("same-bridge", `{"burst": -1}`)).To(MatchError("invalid dropLog burst -1"))
+		Expect(parse("same-bridge", fmt.Sprintf(`{"prefix": "%s"}`, strings.Repeat("x", 65)))).To(MatchError(ContainSubstring("is longer than 64 characters")))
+	})
+})
+
+var _ = Describe("firewall defaultPolicy config", func() {
+	parse := func(extra string) error {
+		_, _, err := parseConf([]byte(fmt.Sprintf(`{
+			"name": "test",
+			"type": "firewall",
+			"cniVersion": "1.0.0",
+			%s
+		}`, extra)))
+		return err
+	}
+
+	It("rejects invalid settings", func() {
+		Expect(parse(`"defaultPolicy": "reject"`)).To(MatchError(`unknown default policy: "reject"`))
+		Expect(parse(`"allow": [{"protocol": "tcp"}]`)).To(MatchError(`allow and exceptions require defaultPolicy "deny"`))
+		Expect(parse(`"defaultPolicy": "deny", "allow": [{"from": "10.0.0.0"}]`)).To(MatchError(ContainSubstring(`invalid allow rule source "10.0.0.0"`)))
+		Expect(parse(`"defaultPolicy": "deny", "allow": [{"protocol": "gre"}]`)).To(MatchError(`invalid allow rule protocol "gre"`))
+		Expect(parse(`"defaultPolicy": "deny", "allow": [{"port": "80"}]`)).To(MatchError(`allow rule port "80" requires protocol tcp, udp or sctp`))
+		Expect(parse(`"defaultPolicy": "deny", "allow": [{"protocol": "tcp", "port": "http"}]`)).To(MatchError(`invalid allow rule port "http", must be like "80" or "8000:8100"`))
+		Expect(parse(`"defaultPolicy": "deny", "exceptions": ["coredns"]`)).To(MatchError(`invalid exception "coredns", must be a namespace/name pattern`))
+	})
+
+	It("excepts pods by namespace/name pattern", func() {
+		conf, _, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "firewall",
+			"cniVersion": "1.0.0",
+			"defaultPolicy": "deny",
+			"exceptions": ["kube-system/*", "monitoring/prometheus-*"]
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		for args, deny := range map[string]bool{
+			"K8S_POD_NAMESPACE=kube-system;K8S_POD_NAME=coredns":     false,
+			"K8S_POD_NAMESPACE=monitoring;K8S_POD_NAME=prometheus-0": false,
+			"K8S_POD_NAMESPACE=monitoring;K8S_POD_NAME=grafana":      true,
+			"K8S_POD_NAMESPACE=default;K8S_POD_NAME=kube-system":     true,
+			"": true,
+		} {
+			d, err := denies(conf, args)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(d).To(Equal(deny), args)
+		}
+	})
+})
+
+var _ = Describe("firewall egress config", func() {
+	parse := func(egress string) error {
+		_, _, err := parseConf([]byte(fmt.Sprintf(`{
+			"name": "test",
+			"type": "firewall",
+			"cniVersion": "1.0.0",
+			"egress": %s
+		}`, egress)))
+		return err
+	}
+
+	It("rejects invalid settings", func() {
+		Expect(parse(`{"default": "reject"}`)).To(MatchError(`invalid egress default "reject", must be "allow" or "deny"`))
+		Expect(parse(`{"rules": [{"to": ["10.0.0.0/8"]}]}`)).To(MatchError(`invalid egress rule action "", must be "allow" or "deny"`))
+		Expect(parse(`{"rules": [{"action": "deny", "to": ["10.0.0.0"]}]}`)).To(MatchError(ContainSubstring(`invalid egress rule destination "10.0.0.0"`)))
+		Expect(parse(`{"rules": [{"action": "deny", "protocol": "gre"}]}`)).To(MatchError(`invalid egress rule protocol "gre"`))
+		Expect(parse(`{"rules": [{"action": "allow", "port": "443"}]}`)).To(MatchError(`egress rule port "443" requires protocol tcp, udp or sctp`))
+	})
+
+	It("splits the rules by IP family", func() {
+		policy := &EgressPolicy{
+			Default: EgressDeny,
+			Rules: []EgressRule{
+				{Action: EgressAllow, To: []string{"192.0.2.0/24", "2001:db8::/32"}, Protocol: "icmp"},
+				{Action: EgressDeny, To: []string{"198.51.100.0/24"}},
+			},
+		}
+		Expect(egressChainRules(policy, iptables.ProtocolIPv4)).To(Equal([][]string{
+			{"-d", "192.0.2.0/24", "-p", "icmp", "-j", "RETURN"},
+			{"-d", "198.51.100.0/24", "-j", "DROP"},
+			{"-j", "DROP"},
+		}))
+		Expect(egressChainRules(policy, iptables.ProtocolIPv6)).To(Equal([][]string{
+			{"-d", "2001:db8::/32", "-p", "ipv6-icmp", "-j", "RETURN"},
+			{"-j", "DROP"},
+		}))
+	})
+})
@@ -14,7 +14,7 @@
 
 // This is a sample chained plugin that supports multiple CNI versions. It
 // parses prevResult according to the cniVersion
-package main
+package firewall
 
 import (
 	"fmt"
@@ -37,18 +37,27 @@ func setupIngressPolicy(conf *FirewallNetConf, prevResult *types100.Result) erro
 	}
 }
 
-func setupIngressPolicySameBridge(conf *FirewallNetConf, prevResult *types100.Result) error {
+// sameBridgeName returns the name of the bridge the container is attached
+// to, which the bridge plugin reports as its first interface.
+func sameBridgeName(conf *FirewallNetConf, prevResult *types100.Result) (string, error) {
 	if len(prevResult.Interfaces) == 0 {
-		return fmt.Errorf("interface needs to be set for ingress policy %q, make sure to chain \"firewall\" plugin with \"bridge\"",
+		return "", fmt.Errorf("interface needs to be set for ingress policy %q, make sure to chain \"firewall\" plugin with \"bridge\"",
 			conf.IngressPolicy)
 	}
 	intf := prevResult.Interfaces[0]
 	if intf == nil {
-		return fmt.Errorf("got nil interface")
+		return "", fmt.Errorf("got nil interface")
 	}
-	bridgeName := intf.Name
-	if bridgeName == "" {
-		return fmt.Errorf("got empty bridge name")
+	if intf.Name == "" {
+		return "", fmt.Errorf("got empty bridge name")
+	}
+	return intf.Name, nil
+}
+
+func setupIngressPolicySameBridge(conf *FirewallNetConf, prevResult *types100.Result) error {
+	bridgeName, err := sameBridgeName(conf, prevResult)
+	if err != nil {
+		return err
 	}
 	for _, iptProto := range findProtos(conf) {
 		ipt, err := iptables.NewWithProtocol(iptProto)
@@ -81,6 +90,10 @@ func teardownIngressPolicy(conf *FirewallNetConf) error {
 const (
 	filterTableName  = "filter"  // built-in
 	forwardChainName = "FORWARD" // built-in
+
+	// Future version may support custom chain names
+	stage1Chain = "CNI-ISOLATION-STAGE-1"
+	stage2Chain = "CNI-ISOLATION-STAGE-2"
 )
 
 // setupIsolationChains executes the following iptables commands for isolating networks:
@@ -95,11 +108,6 @@ const (
 // iptables -A CNI-ISOLATION-STAGE-2 -j RETURN
 // ```
 func setupIsolationChains(ipt *iptables.IPTables, bridgeName string) error {
-	const (
-		// Future version may support custom chain names
-		stage1Chain = "CNI-ISOLATION-STAGE-1"
-		stage2Chain = "CNI-ISOLATION-STAGE-2"
-	)
 	// Commands:
 	// ```
 	// iptables -N CNI-ISOLATION-STAGE-1
@@ -0,0 +1,176 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostroute
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+)
+
+var _ = Describe("hostroute", func() {
+	var hostNS, containerNS ns.NetNS
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		hostNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		containerNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		dataDir, err = os.MkdirTemp("", "hostroute")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "veth0"},
+				PeerName:  "eth0",
+			})).To(Succeed())
+			veth0, err := netlink.LinkByName("veth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(veth0)).To(Succeed())
+			eth0, err := netlink.LinkByName("eth0")
+			Expect(err).NotTo(HaveOccurred())
+			return netlink.LinkSetNsFd(eth0, int(containerNS.Fd()))
+		})).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+		for _, n := range []ns.NetNS{hostNS, containerNS} {
+			Expect(n.Close()).To(Succeed())
+			Expect(testutils.UnmountNS(n)).To(Succeed())
+		}
+	})
+
+	conf := func(settings string) []byte {
+		return []byte(fmt.Sprintf(`{
+			"cniVersion": "1.1.0",
+			"name": "test",
+			"type": "hostroute",
+			"dataDir": %q,
+			%s
+			"prevResult": {
+				"cniVersion": "1.1.0",
+				"interfaces": [
+					{"name": "veth0"},
+					{"name": "eth0", "sandbox": %q}
+				],
+				"ips": [
+					{"address": "10.0.0.2/24", "interface": 1},
+					{"address": "fd00::2/64", "interface": 1}
+				]
+			}
+		}`, dataDir, settings, containerNS.Path()))
+	}
+
+	hostRoutes := func(table int) []string {
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: table, Protocol: defaultProtocol},
+			netlink.RT_FILTER_TABLE|netlink.RT_FILTER_PROTOCOL)
+		Expect(err).NotTo(HaveOccurred())
+		dsts := []string{}
+		for _, r := range routes {
+			link, err := netlink.LinkByIndex(r.LinkIndex)
+			Expect(err).NotTo(HaveOccurred())
+			dsts = append(dsts, fmt.Sprintf("%s dev %s metric %d", r.Dst, link.Attrs().Name, r.Priority))
+		}
+		return dsts
+	}
+
+	It("rejects invalid settings", func() {
+		_, _, err := parseConf([]byte(`{"cniVersion": "1.0.0", "name": "test", "type": "hostroute", "table": 255}`))
+		Expect(err).To(MatchError("invalid table 255, the local table is the kernel's"))
+		_, _, err = parseConf([]byte(`{"cniVersion": "1.0.0", "name": "test", "type": "hostroute", "protocol": 2}`))
+		Expect(err).To(MatchError("invalid protocol 2, must be between 5 and 255"))
+		_, _, err = parseConf([]byte(`{"cniVersion": "1.0.0", "name": "test", "type": "hostroute", "metric": -1}`))
+		Expect(err).To(MatchError("invalid metric -1"))
+	})
+
+	It("adds, checks and deletes the routes of the pod's addresses via its veth", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       containerNS.Path(),
+			IfName:      "eth0",
+			StdinData:   conf(`"metric": 50,`),
+		}
+
+		Expect(hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) })
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hostRoutes(0)).To(ConsistOf("10.0.0.2/32 dev veth0 metric 50", "fd00::2/128 dev veth0 metric 50"))
+			Expect(testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })).To(Succeed())
+
+			Expect(testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) })).To(Succeed())
+			Expect(hostRoutes(0)).To(BeEmpty())
+			Expect(testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })).To(
+				MatchError(`route to 10.0.0.2/32 via "veth0" with metric 50 missing from table 254`))
+
+			// deleting twice is fine
+			Expect(testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) })).To(Succeed())
+			return nil
+		})).To(Succeed())
+	})
+
+	It("removes the routes of attachments no longer valid with GC", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       containerNS.Path(),
+			IfName:      "eth0",
+			StdinData:   conf(`"table": 100,`),
+		}
+
+		Expect(hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) })
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hostRoutes(100)).To(HaveLen(2))
+
+			gcArgs := &skel.CmdArgs{StdinData: []byte(fmt.Sprintf(`{
+				"cniVersion": "1.1.0",
+				"name": "test",
+				"type": "hostroute",
+				"table": 100,
+				"dataDir": %q,
+				"cni.dev/valid-attachments": [{"containerID": "dummy", "ifname": "eth0"}]
+			}`, dataDir))}
+			Expect(cmdGC(gcArgs)).To(Succeed())
+			Expect(hostRoutes(100)).To(HaveLen(2))
+
+			gcArgs.StdinData = []byte(fmt.Sprintf(`{
+				"cniVersion": "1.1.0",
+				"name": "test",
+				"type": "hostroute",
+				"table": 100,
+				"dataDir": %q,
+				"cni.dev/valid-attachments": []
+			}`, dataDir))
+			Expect(cmdGC(gcArgs)).To(Succeed())
+			Expect(hostRoutes(100)).To(BeEmpty())
+			return nil
+		})).To(Succeed())
+	})
+})
@@ -0,0 +1,393 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a chained plugin that routes a pod's addresses on the host: it
+// adds a host route for each of them through the host side interface the
+// pod is reached by, with a configurable metric, table and route protocol.
+// Unlike route-reflector's, the routes are routed by. They are recorded per
+// attachment, so DEL and GC remove exactly the routes ADD added.
+package hostroute
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/gc"
+	"github.com/containernetworking/plugins/pkg/include"
+	"github.com/containernetworking/plugins/pkg/ns"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+)
+
+const (
+	defaultDataDir  = "/run/cni/hostroute"
+	defaultProtocol = 201
+)
+
+// HostRouteConf is the hostroute configuration.
+type HostRouteConf struct {
+	types.NetConf
+
+	// Metric is the metric of the routes
+	Metric int `json:"metric,omitempty"`
+	// Table is the routing table of the routes, the main table by default
+	Table int `json:"table,omitempty"`
+	// Protocol is the route protocol the routes are tagged with, so they
+	// can be told from others, e.g. by routing daemons redistributing them
+	Protocol int `json:"protocol,omitempty"`
+	// HostInterface is the host side interface the routes go out of. By
+	// default it is the host end of the pod's veth, or the bridge it is
+	// attached to, or else the first host interface of the prevResult.
+	HostInterface string `json:"hostInterface,omitempty"`
+	DataDir       string `json:"dataDir,omitempty"`
+}
+
+// attachmentState records the routes added for an attachment, as they
+// were configured at the time.
+type attachmentState struct {
+	ContainerID string   `json:"containerID"`
+	IfName      string   `json:"ifName"`
+	Table       int      `json:"table"`
+	Metric      int      `json:"metric"`
+	Dsts        []string `json:"dsts"`
+}
+
+// Main runs the hostroute plugin.
+func Main() {
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{
+		Add:   cmdAdd,
+		Check: cmdCheck,
+		Del:   cmdDel,
+		GC:    cmdGC,
+	}), version.VersionsStartingFrom("0.3.1"), bv.BuildString("hostroute"))
+}
+
+func parseConf(data []byte) (*HostRouteConf, *current.Result, error) {
+	conf := HostRouteConf{Table: syscall.RT_TABLE_MAIN, Protocol: defaultProtocol, DataDir: defaultDataDir}
+	if err := config.Validate(data, &conf); err != nil {
+		return nil, nil, fmt.Errorf("invalid network configuration: %v", err)
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	if conf.Metric < 0 {
+		return nil, nil, fmt.Errorf("invalid metric %d", conf.Metric)
+	}
+	switch {
+	case conf.Table < 0:
+		return nil, nil, fmt.Errorf("invalid table %d", conf.Table)
+	case conf.Table == syscall.RT_TABLE_UNSPEC:
+		conf.Table = syscall.RT_TABLE_MAIN
+	case conf.Table == syscall.RT_TABLE_LOCAL:
+		return nil, nil, fmt.Errorf("invalid table %d, the local table is the kernel's", conf.Table)
+	}
+	// protocols up to RTPROT_STATIC are the kernel's own
+	if conf.Protocol <= syscall.RTPROT_STATIC || conf.Protocol > 255 {
+		return nil, nil, fmt.Errorf("invalid protocol %d, must be between %d and 255", conf.Protocol, syscall.RTPROT_STATIC+1)
+	}
+
+	if conf.RawPrevResult == nil {
+		return &conf, nil, nil
+	}
+	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+		return nil, nil, fmt.Errorf("could not parse prevResult: %v", err)
+	}
+	result, err := current.NewResultFromResult(conf.PrevResult)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not convert result to current version: %v", err)
+	}
+	return &conf, result, nil
+}
+
+// podDsts returns the host prefixes of the addresses of the pod's interface
+// ifName in the result.
+func podDsts(result *current.Result, ifName string) []*net.IPNet {
+	var dsts []*net.IPNet
+	for _, ipc := range result.IPs {
+		if ipc.Interface != nil {
+			idx := *ipc.Interface
+			if idx >= 0 && idx < len(result.Interfaces) {
+				intf := result.Interfaces[idx]
+				if intf.Sandbox == "" || intf.Name != ifName {
+					continue
+				}
+			}
+		}
+		bits := 128
+		if ipc.Address.IP.To4() != nil {
+			bits = 32
+		}
+		dsts = append(dsts, &net.IPNet{IP: ipc.Address.IP, Mask: net.CIDRMask(bits, bits)})
+	}
+	return dsts
+}
+
+// hostLink returns the host side interface the pod's interface ifName is
+// reached by.
+func hostLink(conf *HostRouteConf, result *current.Result, netnsPath, ifName string) (netlink.Link, error) {
+	if conf.HostInterface != "" {
+		link, err := netlink.LinkByName(conf.HostInterface)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up host interface %q: %v", conf.HostInterface, err)
+		}
+		return link, nil
+	}
+
+	peerIndex := 0
+	err := ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to look up %q: %v", ifName, err)
+		}
+		if veth, ok := link.(*netlink.Veth); ok {
+			peerIndex, err = netlink.VethPeerIndex(veth)
+			if err != nil {
+				return fmt.Errorf("failed to find the peer of %q: %v", ifName, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if peerIndex != 0 {
+		link, err := netlink.LinkByIndex(peerIndex)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up the host end of %q: %v", ifName, err)
+		}
+		// a bridge port isn't routed by, its bridge is
+		if master := link.Attrs().MasterIndex; master != 0 {
+			return netlink.LinkByIndex(master)
+		}
+		return link, nil
+	}
+
+	for _, intf := range result.Interfaces {
+		if intf.Sandbox == "" {
+			link, err := netlink.LinkByName(intf.Name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to look up host interface %q: %v", intf.Name, err)
+			}
+			return link, nil
+		}
+	}
+	return nil, fmt.Errorf("no host interface to route %q by, set hostInterface", ifName)
+}
+
+func hostRoute(table, metric, protocol, linkIndex int, dst *net.IPNet) *netlink.Route {
+	return &netlink.Route{
+		LinkIndex: linkIndex,
+		Dst:       dst,
+		Scope:     netlink.SCOPE_LINK,
+		Table:     table,
+		Priority:  metric,
+		Protocol:  netlink.RouteProtocol(protocol),
+	}
+}
+
+func statePath(conf *HostRouteConf, containerID, ifName string) string {
+	return filepath.Join(conf.DataDir, conf.Name, containerID, ifName+".json")
+}
+
+func readState(path string) (*attachmentState, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &attachmentState{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse state %q: %v", path, err)
+	}
+	return s, nil
+}
+
+func writeState(conf *HostRouteConf, s *attachmentState) error {
+	path := statePath(conf, s.ContainerID, s.IfName)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create state dir: %v", err)
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// removeRoutes deletes the routes recorded in the state of an attachment,
+// and the state. The routes are matched by destination, table and metric
+// only, the host interface may be gone already.
+func removeRoutes(conf *HostRouteConf, containerID, ifName string) error {
+	path := statePath(conf, containerID, ifName)
+	s, err := readState(path)
+	if err != nil || s == nil {
+		return err
+	}
+
+	var errs []error
+	for _, d := range s.Dsts {
+		_, dst, err := net.ParseCIDR(d)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid route destination %q in state: %v", d, err))
+			continue
+		}
+		route := &netlink.Route{Dst: dst, Table: s.Table, Priority: s.Metric, Scope: netlink.SCOPE_NOWHERE}
+		if err := netlink.RouteDel(route); err != nil && !errors.Is(err, syscall.ESRCH) && !errors.Is(err, syscall.ENOENT) {
+			errs = append(errs, fmt.Errorf("failed to delete route to %s: %v", dst, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// the container's directory goes with its last attachment
+	_ = os.Remove(filepath.Dir(path))
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, result, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	dsts := podDsts(result, args.IfName)
+	if len(dsts) == 0 {
+		return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+	}
+	link, err := hostLink(conf, result, args.Netns, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	// the state is written first, so DEL removes whatever was added
+	s := &attachmentState{ContainerID: args.ContainerID, IfName: args.IfName, Table: conf.Table, Metric: conf.Metric}
+	for _, dst := range dsts {
+		s.Dsts = append(s.Dsts, dst.String())
+	}
+	if err := writeState(conf, s); err != nil {
+		return err
+	}
+	for _, dst := range dsts {
+		route := hostRoute(conf.Table, conf.Metric, conf.Protocol, link.Attrs().Index, dst)
+		// replace, a former pod's route to the address may be left
+		if err := netlink.RouteReplace(route); err != nil {
+			_ = removeRoutes(conf, args.ContainerID, args.IfName)
+			return fmt.Errorf("failed to add route to %s via %q: %v", dst, link.Attrs().Name, err)
+		}
+	}
+
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, _, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	return removeRoutes(conf, args.ContainerID, args.IfName)
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, result, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+
+	dsts := podDsts(result, args.IfName)
+	if len(dsts) == 0 {
+		return nil
+	}
+	link, err := hostLink(conf, result, args.Netns, args.IfName)
+	if err != nil {
+		return err
+	}
+	for _, dst := range dsts {
+		want := hostRoute(conf.Table, conf.Metric, conf.Protocol, link.Attrs().Index, dst)
+		found, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, want,
+			netlink.RT_FILTER_DST|netlink.RT_FILTER_TABLE|netlink.RT_FILTER_OIF|netlink.RT_FILTER_PROTOCOL)
+		if err != nil {
+			return fmt.Errorf("failed to list routes of table %d: %v", conf.Table, err)
+		}
+		ok := false
+		for _, r := range found {
+			ok = ok || r.Priority == conf.Metric
+		}
+		if !ok {
+			return fmt.Errorf("route to %s via %q with metric %d missing from table %d", dst, link.Attrs().Name, conf.Metric, conf.Table)
+		}
+	}
+	return nil
+}
+
+// listAttachments returns the attachments of the network with recorded
+// routes.
+func listAttachments(conf *HostRouteConf) ([]types.GCAttachment, error) {
+	paths, err := filepath.Glob(filepath.Join(conf.DataDir, conf.Name, "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var attachments []types.GCAttachment
+	for _, path := range paths {
+		s, err := readState(path)
+		if err != nil {
+			return nil, err
+		}
+		if s != nil {
+			attachments = append(attachments, types.GCAttachment{ContainerID: s.ContainerID, IfName: s.IfName})
+		}
+	}
+	return attachments, nil
+}
+
+// cmdGC removes the routes of the attachments the runtime no longer lists.
+func cmdGC(args *skel.CmdArgs) error {
+	conf, _, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	valid, err := gc.ValidAttachments(args.StdinData)
+	if err != nil {
+		return err
+	}
+	return gc.Collect(valid, func() ([]types.GCAttachment, error) {
+		return listAttachments(conf)
+	}, func(a types.GCAttachment) error {
+		return removeRoutes(conf, a.ContainerID, a.IfName)
+	})
+}
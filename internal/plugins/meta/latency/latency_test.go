@@ -0,0 +1,194 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package latency
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+)
+
+var _ = Describe("latency", func() {
+	var hostNS, containerNS ns.NetNS
+
+	BeforeEach(func() {
+		var err error
+		hostNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		containerNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "veth0"},
+				PeerName:  "eth0",
+			})).To(Succeed())
+			eth0, err := netlink.LinkByName("eth0")
+			Expect(err).NotTo(HaveOccurred())
+			return netlink.LinkSetNsFd(eth0, int(containerNS.Fd()))
+		})).To(Succeed())
+	})
+
+	AfterEach(func() {
+		for _, n := range []ns.NetNS{hostNS, containerNS} {
+			Expect(n.Close()).To(Succeed())
+			Expect(testutils.UnmountNS(n)).To(Succeed())
+		}
+	})
+
+	conf := func(settings string) []byte {
+		return []byte(fmt.Sprintf(`{
+			"cniVersion": "1.1.0",
+			"name": "test",
+			"type": "latency",
+			%s
+			"prevResult": {
+				"cniVersion": "1.1.0",
+				"interfaces": [
+					{"name": "veth0"},
+					{"name": "eth0", "sandbox": %q}
+				],
+				"ips": [{"address": "10.0.0.2/24", "interface": 1}]
+			}
+		}`, settings, containerNS.Path()))
+	}
+
+	// qdiscs lists the qdiscs of the container's interfaces, but their
+	// default ones
+	qdiscs := func() []string {
+		found := []string{}
+		Expect(containerNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			links, err := netlink.LinkList()
+			Expect(err).NotTo(HaveOccurred())
+			for _, link := range links {
+				qs, err := netlink.QdiscList(link)
+				Expect(err).NotTo(HaveOccurred())
+				for _, q := range qs {
+					switch q.(type) {
+					case *netlink.Netem, *netlink.Ingress:
+						found = append(found, link.Attrs().Name+" "+q.Type())
+					}
+				}
+			}
+			return nil
+		})).To(Succeed())
+		return found
+	}
+
+	DescribeTable("rejects invalid conditions",
+		func(settings, msg string) {
+			conf, _, err := parseConf([]byte(`{"cniVersion": "1.0.0", "name": "test", "type": "latency", ` + settings + `}`))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = getNetem(conf)
+			Expect(err).To(MatchError(msg))
+		},
+		Entry("delay", `"delay": "soon"`, `invalid delay "soon": time: invalid duration "soon"`),
+		Entry("long delay", `"delay": "2m"`, `invalid delay "2m", must be between 0 and 1m0s`),
+		Entry("jitter without delay", `"jitter": "5ms"`, "jitter and reorder require a delay"),
+		Entry("jitter above delay", `"delay": "5ms", "jitter": "10ms"`, `invalid jitter 10ms, must not exceed the delay 5ms`),
+		Entry("loss", `"loss": 120`, "invalid loss 120, must be a percentage"),
+		Entry("direction", `"delay": "5ms", "direction": "up"`, `invalid direction "up", must be one of egress, ingress or both`),
+	)
+
+	It("delays the traffic the pod sends, checks and removes it", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       containerNS.Path(),
+			IfName:      "eth0",
+			StdinData:   conf(`"delay": "50ms", "jitter": "5ms", "loss": 1.5,`),
+		}
+
+		_, _, err := testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) })
+		Expect(err).NotTo(HaveOccurred())
+		Expect(qdiscs()).To(ConsistOf("eth0 netem"))
+		Expect(testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })).To(Succeed())
+
+		changed := *args
+		changed.StdinData = conf(`"delay": "80ms", "jitter": "5ms", "loss": 1.5,`)
+		err = testutils.CmdCheckWithArgs(&changed, func() error { return cmdCheck(&changed) })
+		Expect(err).To(MatchError(ContainSubstring("latency doesn't match the configuration: eth0: delay")))
+
+		Expect(testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) })).To(Succeed())
+		Expect(qdiscs()).To(BeEmpty())
+		// deleting twice is fine
+		Expect(testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) })).To(Succeed())
+	})
+
+	It("delays the traffic to the pod from the runtime config through an ifb device", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       containerNS.Path(),
+			IfName:      "eth0",
+			StdinData: conf(`"delay": "10ms",
+				"runtimeConfig": {"latency": {"delay": "100ms", "reorder": 10, "direction": "both"}},`),
+		}
+		ifbName := getIfbDeviceName("eth0")
+
+		_, _, err := testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) })
+		Expect(err).NotTo(HaveOccurred())
+		Expect(qdiscs()).To(ConsistOf("eth0 netem", "eth0 ingress", ifbName+" netem"))
+		Expect(testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })).To(Succeed())
+
+		// adding again replaces the conditions
+		_, _, err = testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) })
+		Expect(err).NotTo(HaveOccurred())
+		Expect(qdiscs()).To(ConsistOf("eth0 netem", "eth0 ingress", ifbName+" netem"))
+
+		// nothing is left on the host side for bandwidth to trip over
+		Expect(hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			veth0, err := netlink.LinkByName("veth0")
+			Expect(err).NotTo(HaveOccurred())
+			qs, err := netlink.QdiscList(veth0)
+			Expect(err).NotTo(HaveOccurred())
+			for _, q := range qs {
+				Expect(q.Type()).NotTo(BeElementOf("netem", "ingress"))
+			}
+			return nil
+		})).To(Succeed())
+
+		// DEL goes by what is there, not by the configuration
+		del := *args
+		del.StdinData = conf("")
+		Expect(testutils.CmdDelWithArgs(&del, func() error { return cmdDel(&del) })).To(Succeed())
+		Expect(qdiscs()).To(BeEmpty())
+		err = testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })
+		Expect(err).To(MatchError(ContainSubstring("eth0: netem qdisc not found")))
+	})
+
+	It("passes the prevResult through without conditions", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       containerNS.Path(),
+			IfName:      "eth0",
+			StdinData:   conf(""),
+		}
+		_, _, err := testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) })
+		Expect(err).NotTo(HaveOccurred())
+		Expect(qdiscs()).To(BeEmpty())
+		Expect(testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })).To(Succeed())
+	})
+})
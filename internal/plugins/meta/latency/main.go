@@ -0,0 +1,287 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a chained plugin that emulates WAN conditions for a pod: it adds
+// delay, jitter, loss and reordering to the traffic of the pod's interface
+// with the netem qdisc. Everything it sets up lives in the pod's namespace,
+// so it composes with the bandwidth plugin, which shapes on the host side,
+// and goes away with the namespace.
+package latency
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/include"
+	"github.com/containernetworking/plugins/pkg/ns"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+)
+
+const (
+	directionEgress  = "egress"
+	directionIngress = "ingress"
+	directionBoth    = "both"
+
+	// netem keeps the delay in a 32 bit count of ticks
+	maxDelay = time.Minute
+)
+
+// NetemEntry describes the emulated conditions, the configuration's or the
+// "latency" capability argument.
+type NetemEntry struct {
+	// Delay is added to every packet, e.g. "50ms"
+	Delay string `json:"delay,omitempty"`
+	// Jitter varies the delay of each packet randomly by up to this much
+	Jitter string `json:"jitter,omitempty"`
+	// DelayCorrelation is how much each packet's delay depends on the
+	// previous one's, in percent
+	DelayCorrelation float32 `json:"delayCorrelation,omitempty"`
+	// Loss is the share of packets dropped, in percent
+	Loss float32 `json:"loss,omitempty"`
+	// Reorder is the share of packets sent at once, ahead of the delayed
+	// ones, in percent
+	Reorder float32 `json:"reorder,omitempty"`
+	// Limit is the number of packets netem holds, 1000 by default
+	Limit uint32 `json:"limit,omitempty"`
+	// Direction is the traffic the conditions apply to, "egress", what
+	// the pod sends, "ingress", what it receives, or "both"
+	Direction string `json:"direction,omitempty"`
+}
+
+// LatencyConf is the latency configuration.
+type LatencyConf struct {
+	types.NetConf
+
+	*NetemEntry
+
+	RuntimeConfig struct {
+		Latency *NetemEntry `json:"latency,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+}
+
+// netemParams are the parsed conditions of an entry.
+type netemParams struct {
+	attrs   netlink.NetemQdiscAttrs
+	egress  bool
+	ingress bool
+}
+
+// Main runs the latency plugin.
+func Main() {
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}), version.VersionsStartingFrom("0.3.1"), bv.BuildString("latency"))
+}
+
+func parseConf(data []byte) (*LatencyConf, *current.Result, error) {
+	conf := LatencyConf{}
+	if err := config.Validate(data, &conf); err != nil {
+		return nil, nil, fmt.Errorf("invalid network configuration: %v", err)
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	if conf.RawPrevResult == nil {
+		return &conf, nil, nil
+	}
+	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+		return nil, nil, fmt.Errorf("could not parse prevResult: %v", err)
+	}
+	result, err := current.NewResultFromResult(conf.PrevResult)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not convert result to current version: %v", err)
+	}
+	return &conf, result, nil
+}
+
+// getNetem returns the conditions of the pod: those of the capability
+// argument, which are per pod, or else the configuration's. It returns nil
+// if no conditions are emulated.
+func getNetem(conf *LatencyConf) (*netemParams, error) {
+	entry := conf.NetemEntry
+	if conf.RuntimeConfig.Latency != nil {
+		entry = conf.RuntimeConfig.Latency
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	return parseNetem(entry)
+}
+
+func parseNetem(entry *NetemEntry) (*netemParams, error) {
+	delay, err := parseDelay("delay", entry.Delay)
+	if err != nil {
+		return nil, err
+	}
+	jitter, err := parseDelay("jitter", entry.Jitter)
+	if err != nil {
+		return nil, err
+	}
+	for name, pct := range map[string]float32{
+		"delayCorrelation": entry.DelayCorrelation,
+		"loss":             entry.Loss,
+		"reorder":          entry.Reorder,
+	} {
+		if pct < 0 || pct > 100 {
+			return nil, fmt.Errorf("invalid %s %v, must be a percentage", name, pct)
+		}
+	}
+	// netem jitters and reorders delayed packets only
+	if delay == 0 && (jitter > 0 || entry.Reorder > 0) {
+		return nil, fmt.Errorf("jitter and reorder require a delay")
+	}
+	if jitter > delay {
+		return nil, fmt.Errorf("invalid jitter %s, must not exceed the delay %s", entry.Jitter, entry.Delay)
+	}
+
+	p := &netemParams{
+		attrs: netlink.NetemQdiscAttrs{
+			Latency:     uint32(delay.Microseconds()),
+			Jitter:      uint32(jitter.Microseconds()),
+			DelayCorr:   entry.DelayCorrelation,
+			Loss:        entry.Loss,
+			ReorderProb: entry.Reorder,
+			Limit:       entry.Limit,
+		},
+	}
+	switch strings.ToLower(entry.Direction) {
+	case "", directionEgress:
+		p.egress = true
+	case directionIngress:
+		p.ingress = true
+	case directionBoth:
+		p.egress, p.ingress = true, true
+	default:
+		return nil, fmt.Errorf("invalid direction %q, must be one of egress, ingress or both", entry.Direction)
+	}
+	if delay == 0 && entry.Loss == 0 {
+		return nil, nil
+	}
+	return p, nil
+}
+
+func parseDelay(name, s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", name, s, err)
+	}
+	if d < 0 || d > maxDelay {
+		return 0, fmt.Errorf("invalid %s %q, must be between 0 and %s", name, s, maxDelay)
+	}
+	return d, nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, result, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+	p, err := getNetem(conf)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return ns.OpenError(args.Netns, err)
+	}
+	defer netns.Close()
+
+	err = netns.Do(func(_ ns.NetNS) error {
+		// whatever an earlier ADD set up is replaced
+		if err := teardownNetem(args.IfName); err != nil {
+			return err
+		}
+		return setupNetem(args.IfName, p)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to emulate latency on %q: %v", args.IfName, err)
+	}
+
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	if _, _, err := parseConf(args.StdinData); err != nil {
+		return err
+	}
+	if args.Netns == "" {
+		return nil
+	}
+
+	// the conditions are removed whatever the configuration is now, it
+	// may have changed since ADD
+	err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		return teardownNetem(args.IfName)
+	})
+	if err != nil {
+		// everything was in the namespace, it is gone with it
+		if _, ok := err.(ns.NSPathNotExistErr); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to remove latency from %q: %v", args.IfName, err)
+	}
+	return nil
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, result, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+	p, err := getNetem(conf)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return ns.OpenError(args.Netns, err)
+	}
+	defer netns.Close()
+
+	var drift []string
+	err = netns.Do(func(_ ns.NetNS) error {
+		drift, err = checkNetem(args.IfName, p)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(drift) > 0 {
+		return fmt.Errorf("latency doesn't match the configuration: %s", strings.Join(drift, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package latency
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/utils"
+)
+
+const (
+	maxIfbDeviceLength = 15
+	ifbDevicePrefix    = "lat"
+)
+
+// getIfbDeviceName returns the name of the ifb device the traffic to the
+// pod's interface is redirected to, in the pod's namespace.
+func getIfbDeviceName(ifName string) string {
+	return utils.MustFormatHashWithPrefix(maxIfbDeviceLength, ifbDevicePrefix, ifName)
+}
+
+func netemQdisc(linkIndex int, p *netemParams) *netlink.Netem {
+	return netlink.NewNetem(netlink.QdiscAttrs{
+		LinkIndex: linkIndex,
+		Handle:    netlink.MakeHandle(1, 0),
+		Parent:    netlink.HANDLE_ROOT,
+	}, p.attrs)
+}
+
+func ingressQdisc(linkIndex int) *netlink.Ingress {
+	return &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+}
+
+// setupNetem adds a netem root qdisc to the pod's interface for the traffic
+// it sends and, for the traffic it receives, one to an ifb device the
+// interface's ingress is redirected to. It runs in the pod's namespace.
+func setupNetem(ifName string, p *netemParams) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to look up %q: %v", ifName, err)
+	}
+
+	if p.egress {
+		if err := netlink.QdiscReplace(netemQdisc(link.Attrs().Index, p)); err != nil {
+			return fmt.Errorf("failed to add netem qdisc: %v", err)
+		}
+	}
+	if !p.ingress {
+		return nil
+	}
+
+	ifbName := getIfbDeviceName(ifName)
+	err = netlink.LinkAdd(&netlink.Ifb{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:  ifbName,
+			Flags: net.FlagUp,
+			MTU:   link.Attrs().MTU,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add ifb device %q: %v", ifbName, err)
+	}
+	ifb, err := netlink.LinkByName(ifbName)
+	if err != nil {
+		return err
+	}
+	if err := netlink.QdiscReplace(netemQdisc(ifb.Attrs().Index, p)); err != nil {
+		return fmt.Errorf("failed to add netem qdisc to %q: %v", ifbName, err)
+	}
+
+	ingress := ingressQdisc(link.Attrs().Index)
+	if err := netlink.QdiscAdd(ingress); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return fmt.Errorf("failed to add ingress qdisc: %v", err)
+	}
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    ingress.Handle,
+			Priority:  1,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		ClassId:    netlink.MakeHandle(1, 1),
+		RedirIndex: ifb.Attrs().Index,
+		Actions: []netlink.Action{
+			&netlink.MirredAction{
+				MirredAction: netlink.TCA_EGRESS_REDIR,
+				Ifindex:      ifb.Attrs().Index,
+			},
+		},
+	}
+	if err := netlink.FilterAdd(filter); err != nil {
+		return fmt.Errorf("failed to redirect %q to %q: %v", ifName, ifbName, err)
+	}
+	return nil
+}
+
+// teardownNetem removes what setupNetem added, if it is there. It runs in
+// the pod's namespace.
+func teardownNetem(ifName string) error {
+	ifbName := getIfbDeviceName(ifName)
+	ifb, err := netlink.LinkByName(ifbName)
+	if err == nil {
+		if err := netlink.LinkDel(ifb); err != nil {
+			return fmt.Errorf("failed to delete ifb device %q: %v", ifbName, err)
+		}
+	}
+
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to look up %q: %v", ifName, err)
+	}
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs of %q: %v", ifName, err)
+	}
+	for _, qdisc := range qdiscs {
+		_, isNetem := qdisc.(*netlink.Netem)
+		_, isIngress := qdisc.(*netlink.Ingress)
+		// the ingress qdisc only ever redirected to the ifb device
+		if (isNetem && qdisc.Attrs().Parent == netlink.HANDLE_ROOT) || (isIngress && ifb != nil) {
+			if err := netlink.QdiscDel(qdisc); err != nil && !errors.Is(err, syscall.ENOENT) {
+				return fmt.Errorf("failed to delete %s qdisc of %q: %v", qdisc.Type(), ifName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkNetem compares the qdiscs of the pod's interface with those
+// setupNetem adds for p, which is nil if no conditions are emulated, and
+// describes every difference found. It runs in the pod's namespace.
+func checkNetem(ifName string, p *netemParams) ([]string, error) {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up %q: %v", ifName, err)
+	}
+	ifbName := getIfbDeviceName(ifName)
+	ifb, ifbErr := netlink.LinkByName(ifbName)
+
+	var drift []string
+	if p != nil && p.egress {
+		drift = append(drift, compareNetem(link, p)...)
+	} else if rootNetem(link) != nil {
+		drift = append(drift, fmt.Sprintf("%s: unexpected netem qdisc", ifName))
+	}
+
+	switch {
+	case p != nil && p.ingress && ifbErr != nil:
+		drift = append(drift, fmt.Sprintf("ifb device %q not found", ifbName))
+	case p != nil && p.ingress:
+		if !redirects(link, ifb) {
+			drift = append(drift, fmt.Sprintf("%s: no filter redirecting to %s", ifName, ifbName))
+		}
+		drift = append(drift, compareNetem(ifb, p)...)
+	case ifbErr == nil:
+		drift = append(drift, fmt.Sprintf("unexpected ifb device %q", ifbName))
+	}
+	return drift, nil
+}
+
+func rootNetem(link netlink.Link) *netlink.Netem {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return nil
+	}
+	for _, qdisc := range qdiscs {
+		if netem, ok := qdisc.(*netlink.Netem); ok && netem.Parent == netlink.HANDLE_ROOT {
+			return netem
+		}
+	}
+	return nil
+}
+
+func compareNetem(link netlink.Link, p *netemParams) []string {
+	name := link.Attrs().Name
+	have := rootNetem(link)
+	if have == nil {
+		return []string{fmt.Sprintf("%s: netem qdisc not found", name)}
+	}
+	want := netemQdisc(link.Attrs().Index, p)
+
+	var drift []string
+	for _, f := range []struct {
+		name       string
+		have, want uint32
+	}{
+		{"delay", have.Latency, want.Latency},
+		{"jitter", have.Jitter, want.Jitter},
+		{"loss", have.Loss, want.Loss},
+		{"reorder", have.ReorderProb, want.ReorderProb},
+		{"limit", have.Limit, want.Limit},
+	} {
+		if f.have != f.want {
+			drift = append(drift, fmt.Sprintf("%s: %s %d, expected %d", name, f.name, f.have, f.want))
+		}
+	}
+	return drift
+}
+
+// redirects reports whether the ingress traffic of link is redirected to
+// ifb.
+func redirects(link, ifb netlink.Link) bool {
+	filters, err := netlink.FilterList(link, netlink.MakeHandle(0xffff, 0))
+	if err != nil {
+		return false
+	}
+	for _, filter := range filters {
+		u32, ok := filter.(*netlink.U32)
+		if !ok {
+			continue
+		}
+		for _, action := range u32.Actions {
+			mirred, ok := action.(*netlink.MirredAction)
+			if ok && mirred.MirredAction == netlink.TCA_EGRESS_REDIR && mirred.Ifindex == ifb.Attrs().Index {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,549 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a chained plugin for pods with several interfaces, a generalized
+// sbr: every interface of the prevResult gets a routing table and rules
+// routing traffic from its addresses by that table, so replies leave by
+// the interface the traffic arrived on. The default route of the pod is
+// put on the first of its uplinks, and "multihome monitor" moves it to the
+// next one while health checks of the uplink fail.
+package multihome
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/gc"
+	"github.com/containernetworking/plugins/pkg/include"
+	"github.com/containernetworking/plugins/pkg/ns"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+)
+
+const (
+	defaultDataDir      = "/run/cni/multihome"
+	defaultTableBase    = 1000
+	defaultRulePriority = 1000
+)
+
+// MultihomeConf is the multihome configuration.
+type MultihomeConf struct {
+	types.NetConf
+
+	// TableBase is the routing table of the first interface of the
+	// prevResult, the others get the tables following it
+	TableBase int `json:"tableBase,omitempty"`
+	// RulePriority is the priority of the source rules, which must come
+	// before the main table's
+	RulePriority int `json:"rulePriority,omitempty"`
+	// Uplinks are the interfaces the default route may go by, the first
+	// healthy one is used
+	Uplinks []Uplink `json:"uplinks,omitempty"`
+	DataDir string   `json:"dataDir,omitempty"`
+}
+
+// Uplink is an interface of the pod the default route may go by.
+type Uplink struct {
+	Interface string `json:"interface"`
+	// Check is the host:port the uplink is healthy while TCP connections
+	// to it, made from the uplink, succeed. Uplinks without are always
+	// healthy.
+	Check string `json:"check,omitempty"`
+}
+
+// attachmentState records what ADD set up, for DEL, GC and the monitor.
+type attachmentState struct {
+	ContainerID  string        `json:"containerID"`
+	IfName       string        `json:"ifName"`
+	Netns        string        `json:"netns"`
+	RulePriority int           `json:"rulePriority"`
+	Interfaces   []ifaceState  `json:"interfaces"`
+	Uplinks      []uplinkState `json:"uplinks,omitempty"`
+}
+
+// ifaceState is the routing table of an interface and the addresses
+// routed by it.
+type ifaceState struct {
+	Name    string   `json:"name"`
+	Table   int      `json:"table"`
+	Sources []string `json:"sources"`
+
+	// index is the index of the interface in the result
+	index int
+}
+
+// uplinkState is an uplink and its gateways, one per address family.
+type uplinkState struct {
+	Interface string   `json:"interface"`
+	Gateways  []string `json:"gateways"`
+	Check     string   `json:"check,omitempty"`
+}
+
+// Main runs the multihome plugin.
+func Main() {
+	if len(os.Args) > 1 && os.Args[1] == "monitor" {
+		if err := runMonitor(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{
+		Add:   cmdAdd,
+		Check: cmdCheck,
+		Del:   cmdDel,
+		GC:    cmdGC,
+	}), version.VersionsStartingFrom("0.3.1"), bv.BuildString("multihome"))
+}
+
+func parseConf(data []byte) (*MultihomeConf, *current.Result, error) {
+	conf := MultihomeConf{TableBase: defaultTableBase, RulePriority: defaultRulePriority, DataDir: defaultDataDir}
+	if err := config.Validate(data, &conf); err != nil {
+		return nil, nil, fmt.Errorf("invalid network configuration: %v", err)
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	// the tables up to 255 include the kernel's own
+	if conf.TableBase <= 255 {
+		return nil, nil, fmt.Errorf("invalid tableBase %d, must be above 255", conf.TableBase)
+	}
+	// the main table's rule has priority 32766
+	if conf.RulePriority <= 0 || conf.RulePriority >= 32766 {
+		return nil, nil, fmt.Errorf("invalid rulePriority %d, must be between 1 and 32765", conf.RulePriority)
+	}
+	seen := map[string]bool{}
+	for _, u := range conf.Uplinks {
+		if u.Interface == "" {
+			return nil, nil, fmt.Errorf("uplink without interface")
+		}
+		if seen[u.Interface] {
+			return nil, nil, fmt.Errorf("duplicate uplink %q", u.Interface)
+		}
+		seen[u.Interface] = true
+		if u.Check != "" {
+			if _, _, err := net.SplitHostPort(u.Check); err != nil {
+				return nil, nil, fmt.Errorf("invalid check %q of uplink %q: %v", u.Check, u.Interface, err)
+			}
+		}
+	}
+
+	if conf.RawPrevResult == nil {
+		return &conf, nil, nil
+	}
+	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+		return nil, nil, fmt.Errorf("could not parse prevResult: %v", err)
+	}
+	result, err := current.NewResultFromResult(conf.PrevResult)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not convert result to current version: %v", err)
+	}
+	return &conf, result, nil
+}
+
+// interfaceIPs returns the addresses of the interface with index idx in
+// the result.
+func interfaceIPs(result *current.Result, idx int) []*current.IPConfig {
+	var ipcs []*current.IPConfig
+	for _, ipc := range result.IPs {
+		if ipc.Interface != nil && *ipc.Interface == idx {
+			ipcs = append(ipcs, ipc)
+		}
+	}
+	return ipcs
+}
+
+func hostPrefix(ip net.IP) *net.IPNet {
+	bits := 128
+	if ip.To4() != nil {
+		bits = 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+func defaultDst(ip net.IP) *net.IPNet {
+	if ip.To4() != nil {
+		return &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+	}
+	return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+}
+
+// buildState works out the tables, sources and uplinks of the pod's
+// interfaces in the result.
+func buildState(conf *MultihomeConf, result *current.Result, args *skel.CmdArgs) (*attachmentState, error) {
+	s := &attachmentState{
+		ContainerID:  args.ContainerID,
+		IfName:       args.IfName,
+		Netns:        args.Netns,
+		RulePriority: conf.RulePriority,
+	}
+	gateways := map[string][]string{}
+	for idx, intf := range result.Interfaces {
+		if intf.Sandbox == "" {
+			continue
+		}
+		ipcs := interfaceIPs(result, idx)
+		if len(ipcs) == 0 {
+			continue
+		}
+		is := ifaceState{Name: intf.Name, Table: conf.TableBase + idx, index: idx}
+		for _, ipc := range ipcs {
+			is.Sources = append(is.Sources, hostPrefix(ipc.Address.IP).String())
+			if ipc.Gateway != nil {
+				gateways[intf.Name] = append(gateways[intf.Name], ipc.Gateway.String())
+			}
+		}
+		s.Interfaces = append(s.Interfaces, is)
+	}
+	if len(s.Interfaces) == 0 {
+		return nil, nil
+	}
+
+	for _, u := range conf.Uplinks {
+		if len(gateways[u.Interface]) == 0 {
+			return nil, fmt.Errorf("uplink %q is not an interface of the pod with a gateway", u.Interface)
+		}
+		s.Uplinks = append(s.Uplinks, uplinkState{Interface: u.Interface, Gateways: gateways[u.Interface], Check: u.Check})
+	}
+	return s, nil
+}
+
+func statePath(conf *MultihomeConf, containerID string) string {
+	return filepath.Join(conf.DataDir, conf.Name, containerID+".json")
+}
+
+func readState(path string) (*attachmentState, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &attachmentState{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse state %q: %v", path, err)
+	}
+	return s, nil
+}
+
+func writeState(conf *MultihomeConf, s *attachmentState) error {
+	path := statePath(conf, s.ContainerID)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create state dir: %v", err)
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// tableRoutes returns the routes of an interface's table: the subnets of
+// its addresses, the routes of the result through its gateways and a
+// default route through them.
+func tableRoutes(result *current.Result, idx int, link netlink.Link, table int) []*netlink.Route {
+	var routes []*netlink.Route
+	ipcs := interfaceIPs(result, idx)
+	for _, ipc := range ipcs {
+		subnet := &net.IPNet{IP: ipc.Address.IP.Mask(ipc.Address.Mask), Mask: ipc.Address.Mask}
+		routes = append(routes, &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       subnet,
+			Src:       ipc.Address.IP,
+			Scope:     netlink.SCOPE_LINK,
+			Table:     table,
+		})
+		if ipc.Gateway != nil {
+			routes = append(routes, &netlink.Route{
+				LinkIndex: link.Attrs().Index,
+				Dst:       defaultDst(ipc.Gateway),
+				Gw:        ipc.Gateway,
+				Table:     table,
+			})
+		}
+	}
+	for _, r := range result.Routes {
+		if r.GW == nil {
+			continue
+		}
+		// the default route of the table is through the gateways above
+		if ones, _ := r.Dst.Mask.Size(); ones == 0 {
+			continue
+		}
+		for _, ipc := range ipcs {
+			if ipc.Address.Contains(r.GW) {
+				dst := r.Dst
+				routes = append(routes, &netlink.Route{
+					LinkIndex: link.Attrs().Index,
+					Dst:       &dst,
+					Gw:        r.GW,
+					Table:     table,
+				})
+				break
+			}
+		}
+	}
+	return routes
+}
+
+// sourceRule routes traffic from src by table.
+func sourceRule(src *net.IPNet, table, priority int) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Src = src
+	rule.Table = table
+	rule.Priority = priority
+	rule.Family = netlink.FAMILY_V4
+	if src.IP.To4() == nil {
+		rule.Family = netlink.FAMILY_V6
+	}
+	return rule
+}
+
+// setDefaultRoutes puts the pod's default routes on the uplink.
+func setDefaultRoutes(u uplinkState) error {
+	link, err := netlink.LinkByName(u.Interface)
+	if err != nil {
+		return fmt.Errorf("failed to look up uplink %q: %v", u.Interface, err)
+	}
+	for _, g := range u.Gateways {
+		gw := net.ParseIP(g)
+		if gw == nil {
+			return fmt.Errorf("invalid gateway %q of uplink %q in state", g, u.Interface)
+		}
+		route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: defaultDst(gw), Gw: gw}
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to route by uplink %q: %v", u.Interface, err)
+		}
+	}
+	return nil
+}
+
+// setup adds the tables and rules of the interfaces and puts the default
+// routes on the first uplink.
+func setup(s *attachmentState, result *current.Result) error {
+	for _, is := range s.Interfaces {
+		link, err := netlink.LinkByName(is.Name)
+		if err != nil {
+			return fmt.Errorf("failed to look up %q: %v", is.Name, err)
+		}
+		for _, route := range tableRoutes(result, is.index, link, is.Table) {
+			if err := netlink.RouteReplace(route); err != nil {
+				return fmt.Errorf("failed to add route to %s to table %d: %v", route.Dst, is.Table, err)
+			}
+		}
+		for _, src := range is.Sources {
+			_, prefix, err := net.ParseCIDR(src)
+			if err != nil {
+				return err
+			}
+			if err := netlink.RuleAdd(sourceRule(prefix, is.Table, s.RulePriority)); err != nil && !errors.Is(err, syscall.EEXIST) {
+				return fmt.Errorf("failed to add rule from %s to table %d: %v", src, is.Table, err)
+			}
+			// Strict reverse path filtering drops what arrives on an
+			// interface the main table doesn't route the source by
+			if prefix.IP.To4() != nil {
+				if _, err := sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/rp_filter", is.Name), "2"); err != nil {
+					return fmt.Errorf("failed to loosen rp_filter of %q: %v", is.Name, err)
+				}
+			}
+		}
+	}
+	if len(s.Uplinks) > 0 {
+		return setDefaultRoutes(s.Uplinks[0])
+	}
+	return nil
+}
+
+// teardown removes the rules and flushes the tables recorded in the state,
+// in the pod's namespace.
+func teardown(s *attachmentState) error {
+	var errs []error
+	for _, is := range s.Interfaces {
+		for _, src := range is.Sources {
+			_, prefix, err := net.ParseCIDR(src)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid source %q in state: %v", src, err))
+				continue
+			}
+			if err := netlink.RuleDel(sourceRule(prefix, is.Table, s.RulePriority)); err != nil && !errors.Is(err, syscall.ENOENT) {
+				errs = append(errs, fmt.Errorf("failed to delete rule from %s: %v", src, err))
+			}
+		}
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: is.Table}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to list routes of table %d: %v", is.Table, err))
+			continue
+		}
+		for i := range routes {
+			if err := netlink.RouteDel(&routes[i]); err != nil && !errors.Is(err, syscall.ESRCH) {
+				errs = append(errs, fmt.Errorf("failed to delete route to %s from table %d: %v", routes[i].Dst, is.Table, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// removeState tears down what the state records, if the pod's namespace
+// is still there, and removes the state.
+func removeState(conf *MultihomeConf, containerID string) error {
+	path := statePath(conf, containerID)
+	s, err := readState(path)
+	if err != nil || s == nil {
+		return err
+	}
+	if s.Netns != "" {
+		err := ns.WithNetNSPath(s.Netns, func(_ ns.NetNS) error {
+			return teardown(s)
+		})
+		if _, ok := err.(ns.NSPathNotExistErr); !ok && err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, result, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	s, err := buildState(conf, result, args)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+	}
+
+	// the state is written first, so DEL removes whatever was added
+	if err := writeState(conf, s); err != nil {
+		return err
+	}
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		return setup(s, result)
+	})
+	if err != nil {
+		_ = removeState(conf, args.ContainerID)
+		return err
+	}
+
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, _, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	return removeState(conf, args.ContainerID)
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, result, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+	s, err := buildState(conf, result, args)
+	if err != nil || s == nil {
+		return err
+	}
+
+	return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		rules, err := netlink.RuleList(netlink.FAMILY_ALL)
+		if err != nil {
+			return fmt.Errorf("failed to list rules: %v", err)
+		}
+		for _, is := range s.Interfaces {
+			for _, src := range is.Sources {
+				found := false
+				for _, r := range rules {
+					found = found || r.Src != nil && r.Src.String() == src && r.Table == is.Table && r.Priority == s.RulePriority
+				}
+				if !found {
+					return fmt.Errorf("rule from %s to table %d missing", src, is.Table)
+				}
+			}
+			routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: is.Table}, netlink.RT_FILTER_TABLE)
+			if err != nil {
+				return fmt.Errorf("failed to list routes of table %d: %v", is.Table, err)
+			}
+			if len(routes) == 0 {
+				return fmt.Errorf("table %d of %q is empty", is.Table, is.Name)
+			}
+		}
+		return nil
+	})
+}
+
+// listAttachments returns the attachments of the network with recorded
+// state.
+func listAttachments(conf *MultihomeConf) ([]types.GCAttachment, error) {
+	paths, err := filepath.Glob(filepath.Join(conf.DataDir, conf.Name, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var attachments []types.GCAttachment
+	for _, path := range paths {
+		s, err := readState(path)
+		if err != nil {
+			return nil, err
+		}
+		if s != nil {
+			attachments = append(attachments, types.GCAttachment{ContainerID: s.ContainerID, IfName: s.IfName})
+		}
+	}
+	return attachments, nil
+}
+
+// cmdGC removes the state of the attachments the runtime no longer lists.
+func cmdGC(args *skel.CmdArgs) error {
+	conf, _, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	valid, err := gc.ValidAttachments(args.StdinData)
+	if err != nil {
+		return err
+	}
+	return gc.Collect(valid, func() ([]types.GCAttachment, error) {
+		return listAttachments(conf)
+	}, func(a types.GCAttachment) error {
+		return removeState(conf, a.ContainerID)
+	})
+}
@@ -0,0 +1,194 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package multihome
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// monitor moves the default routes of pods to their next healthy uplink
+// while the health checks of the one in use fail.
+type monitor struct {
+	dataDir  string
+	timeout  time.Duration
+	failures int
+	// probe checks an uplink, in the pod's namespace
+	probe func(u uplinkState, timeout time.Duration) error
+
+	mu sync.Mutex
+	// failed counts the consecutive failed checks of the uplinks
+	failed map[uplinkKey]int
+	// active is the uplink the default routes are on, by pod
+	active map[string]string
+}
+
+// uplinkKey is an uplink of the pod with the state at path.
+type uplinkKey struct {
+	path, uplink string
+}
+
+// runMonitor implements "multihome monitor", which checks the uplinks of
+// all pods on the node until it is terminated:
+//
+//	multihome monitor -interval 5s -failures 3
+func runMonitor(args []string) error {
+	var interval time.Duration
+	m := &monitor{probe: probeUplink, failed: map[uplinkKey]int{}, active: map[string]string{}}
+	flags := flag.NewFlagSet("monitor", flag.ContinueOnError)
+	flags.StringVar(&m.dataDir, "data-dir", defaultDataDir, "data dir of the plugin")
+	flags.DurationVar(&interval, "interval", 5*time.Second, "time between checks")
+	flags.DurationVar(&m.timeout, "timeout", 2*time.Second, "timeout of a check")
+	flags.IntVar(&m.failures, "failures", 3, "consecutive failed checks taking an uplink out")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if interval <= 0 || m.timeout <= 0 || m.failures <= 0 {
+		return fmt.Errorf("-interval, -timeout and -failures must be positive")
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		m.checkAll()
+		select {
+		case <-sig:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkAll checks the uplinks of every pod with some, in parallel.
+func (m *monitor) checkAll() {
+	paths, err := filepath.Glob(filepath.Join(m.dataDir, "*", "*.json"))
+	if err != nil {
+		log.Printf("failed to list pods: %v", err)
+		return
+	}
+	var wg sync.WaitGroup
+	seen := map[string]bool{}
+	for _, path := range paths {
+		s, err := readState(path)
+		if err != nil || s == nil || len(s.Uplinks) < 2 {
+			continue
+		}
+		seen[path] = true
+		wg.Add(1)
+		go func(path string, s *attachmentState) {
+			defer wg.Done()
+			if err := m.check(path, s); err != nil {
+				log.Printf("failed to check uplinks of %s: %v", s.ContainerID, err)
+			}
+		}(path, s)
+	}
+	wg.Wait()
+
+	// forget the pods gone
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.failed {
+		if !seen[key.path] {
+			delete(m.failed, key)
+		}
+	}
+	for path := range m.active {
+		if !seen[path] {
+			delete(m.active, path)
+		}
+	}
+}
+
+// check checks the uplinks of a pod and moves its default routes to the
+// first healthy one. While none is, they stay where they are.
+func (m *monitor) check(path string, s *attachmentState) error {
+	return ns.WithNetNSPath(s.Netns, func(_ ns.NetNS) error {
+		healthy := make([]bool, len(s.Uplinks))
+		for i, u := range s.Uplinks {
+			err := error(nil)
+			if u.Check != "" {
+				err = m.probe(u, m.timeout)
+			}
+			key := uplinkKey{path, u.Interface}
+			m.mu.Lock()
+			if err != nil {
+				m.failed[key]++
+			} else {
+				m.failed[key] = 0
+			}
+			healthy[i] = m.failed[key] < m.failures
+			m.mu.Unlock()
+		}
+
+		for i, u := range s.Uplinks {
+			if !healthy[i] {
+				continue
+			}
+			m.mu.Lock()
+			current := m.active[path]
+			m.mu.Unlock()
+			if current == u.Interface {
+				return nil
+			}
+			if err := setDefaultRoutes(u); err != nil {
+				return err
+			}
+			if current != "" {
+				log.Printf("moved default routes of %s from %s to %s", s.ContainerID, current, u.Interface)
+			}
+			m.mu.Lock()
+			m.active[path] = u.Interface
+			m.mu.Unlock()
+			return nil
+		}
+		return nil
+	})
+}
+
+// probeUplink opens a TCP connection to the check target of the uplink,
+// bound to the uplink's device so it can't take another way.
+func probeUplink(u uplinkState, timeout time.Duration) error {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = unix.BindToDevice(int(fd), u.Interface)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	conn, err := dialer.Dial("tcp", u.Check)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,230 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package multihome
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+)
+
+var _ = Describe("multihome", func() {
+	var containerNS ns.NetNS
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		containerNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		dataDir, err = os.MkdirTemp("", "multihome")
+		Expect(err).NotTo(HaveOccurred())
+
+		// two veth pairs stand in for the interfaces of the main plugins
+		Expect(containerNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			for i, name := range []string{"net1", "net2"} {
+				Expect(netlink.LinkAdd(&netlink.Veth{
+					LinkAttrs: netlink.LinkAttrs{Name: name},
+					PeerName:  name + "-peer",
+				})).To(Succeed())
+				for _, n := range []string{name, name + "-peer"} {
+					link, err := netlink.LinkByName(n)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(netlink.LinkSetUp(link)).To(Succeed())
+				}
+				link, err := netlink.LinkByName(name)
+				Expect(err).NotTo(HaveOccurred())
+				addr, err := netlink.ParseAddr(fmt.Sprintf("10.%d.0.2/24", i+1))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.AddrAdd(link, addr)).To(Succeed())
+			}
+			return nil
+		})).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+		Expect(containerNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(containerNS)).To(Succeed())
+	})
+
+	conf := func(settings string) []byte {
+		return []byte(fmt.Sprintf(`{
+			"cniVersion": "1.1.0",
+			"name": "test",
+			"type": "multihome",
+			"dataDir": %q,
+			%s
+			"prevResult": {
+				"cniVersion": "1.1.0",
+				"interfaces": [
+					{"name": "net1", "sandbox": %q},
+					{"name": "net2", "sandbox": %q}
+				],
+				"ips": [
+					{"address": "10.1.0.2/24", "gateway": "10.1.0.1", "interface": 0},
+					{"address": "10.2.0.2/24", "gateway": "10.2.0.1", "interface": 1}
+				],
+				"routes": [
+					{"dst": "192.168.0.0/16", "gw": "10.2.0.1"}
+				]
+			}
+		}`, dataDir, settings, containerNS.Path(), containerNS.Path()))
+	}
+
+	// tableRoutes and rules list what the plugin set up, in the container
+	tableRoutes := func(table int) []string {
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+		Expect(err).NotTo(HaveOccurred())
+		dsts := []string{}
+		for _, r := range routes {
+			dst := "default"
+			if r.Dst != nil {
+				dst = r.Dst.String()
+			}
+			dsts = append(dsts, fmt.Sprintf("%s via %s", dst, r.Gw))
+		}
+		return dsts
+	}
+	rules := func() []string {
+		rules, err := netlink.RuleList(netlink.FAMILY_V4)
+		Expect(err).NotTo(HaveOccurred())
+		found := []string{}
+		for _, r := range rules {
+			if r.Priority == defaultRulePriority {
+				found = append(found, fmt.Sprintf("from %s table %d", r.Src, r.Table))
+			}
+		}
+		return found
+	}
+	defaultGateway := func() string {
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: 254}, netlink.RT_FILTER_TABLE)
+		Expect(err).NotTo(HaveOccurred())
+		for _, r := range routes {
+			if r.Dst == nil || r.Dst.String() == "0.0.0.0/0" {
+				return r.Gw.String()
+			}
+		}
+		return ""
+	}
+
+	It("rejects invalid settings", func() {
+		_, _, err := parseConf([]byte(`{"cniVersion": "1.0.0", "name": "test", "type": "multihome", "tableBase": 100}`))
+		Expect(err).To(MatchError("invalid tableBase 100, must be above 255"))
+		_, _, err = parseConf([]byte(`{"cniVersion": "1.0.0", "name": "test", "type": "multihome", "rulePriority": 32766}`))
+		Expect(err).To(MatchError("invalid rulePriority 32766, must be between 1 and 32765"))
+		_, _, err = parseConf([]byte(`{"cniVersion": "1.0.0", "name": "test", "type": "multihome", "uplinks": [{"interface": "net1", "check": "10.0.0.1"}]}`))
+		Expect(err).To(MatchError(ContainSubstring(`invalid check "10.0.0.1" of uplink "net1"`)))
+		_, _, err = parseConf([]byte(`{"cniVersion": "1.0.0", "name": "test", "type": "multihome", "uplinks": [{"interface": "net1"}, {"interface": "net1"}]}`))
+		Expect(err).To(MatchError(`duplicate uplink "net1"`))
+	})
+
+	It("routes replies by the interface of their source, checks and deletes", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       containerNS.Path(),
+			IfName:      "net1",
+			StdinData:   conf(`"uplinks": [{"interface": "net2"}, {"interface": "net1"}],`),
+		}
+
+		_, _, err := testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) })
+		Expect(err).NotTo(HaveOccurred())
+		Expect(containerNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(rules()).To(ConsistOf("from 10.1.0.2/32 table 1000", "from 10.2.0.2/32 table 1001"))
+			Expect(tableRoutes(1000)).To(ConsistOf("10.1.0.0/24 via <nil>", "default via 10.1.0.1"))
+			Expect(tableRoutes(1001)).To(ConsistOf("10.2.0.0/24 via <nil>", "default via 10.2.0.1", "192.168.0.0/16 via 10.2.0.1"))
+			Expect(defaultGateway()).To(Equal("10.2.0.1"))
+			return nil
+		})).To(Succeed())
+		Expect(testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })).To(Succeed())
+
+		Expect(testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) })).To(Succeed())
+		Expect(containerNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(rules()).To(BeEmpty())
+			Expect(tableRoutes(1000)).To(BeEmpty())
+			Expect(tableRoutes(1001)).To(BeEmpty())
+			return nil
+		})).To(Succeed())
+		Expect(testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })).To(
+			MatchError("rule from 10.1.0.2/32 to table 1000 missing"))
+		Expect(filepath.Join(dataDir, "test", "dummy.json")).NotTo(BeAnExistingFile())
+
+		// deleting twice is fine
+		Expect(testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) })).To(Succeed())
+	})
+
+	It("moves the default route to the next uplink while checks fail", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       containerNS.Path(),
+			IfName:      "net1",
+			StdinData:   conf(`"uplinks": [{"interface": "net1", "check": "10.1.0.1:443"}, {"interface": "net2"}],`),
+		}
+		_, _, err := testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) })
+		Expect(err).NotTo(HaveOccurred())
+
+		down := false
+		m := &monitor{
+			dataDir:  dataDir,
+			timeout:  time.Second,
+			failures: 2,
+			probe: func(u uplinkState, _ time.Duration) error {
+				Expect(u.Interface).To(Equal("net1"))
+				if down {
+					return errors.New("connection refused")
+				}
+				return nil
+			},
+			failed: map[uplinkKey]int{},
+			active: map[string]string{},
+		}
+		gateway := func() string {
+			gw := ""
+			Expect(containerNS.Do(func(ns.NetNS) error {
+				gw = defaultGateway()
+				return nil
+			})).To(Succeed())
+			return gw
+		}
+
+		m.checkAll()
+		Expect(gateway()).To(Equal("10.1.0.1"))
+
+		down = true
+		m.checkAll()
+		Expect(gateway()).To(Equal("10.1.0.1"))
+		m.checkAll()
+		Expect(gateway()).To(Equal("10.2.0.1"))
+
+		down = false
+		m.checkAll()
+		Expect(gateway()).To(Equal("10.1.0.1"))
+	})
+})
@@ -0,0 +1,250 @@
+//go:build linux
+
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a chained plugin that probes the network from inside the pod
+// before ADD succeeds: it pings the gateways or other hosts, resolves names
+// and connects to TCP services, retrying each probe, and fails the ADD when
+// one of them keeps failing. A broken uplink is then caught when the pod is
+// created, rather than by its crash loops.
+package netnsready
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/include"
+	"github.com/containernetworking/plugins/pkg/ns"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+)
+
+const (
+	defaultTimeout  = time.Second
+	defaultInterval = time.Second
+	defaultRetries  = 2
+)
+
+// ReadyConf is the netns-ready configuration.
+type ReadyConf struct {
+	types.NetConf
+
+	// Probes are run in order, by default the gateway probe alone
+	Probes []Probe `json:"probes,omitempty"`
+	// Timeout is how long an attempt of a probe may take
+	Timeout string `json:"timeout,omitempty"`
+	// Retries is how often a failed probe is tried again
+	Retries int `json:"retries,omitempty"`
+	// Interval is the pause between the attempts of a probe
+	Interval string `json:"interval,omitempty"`
+
+	timeout  time.Duration
+	interval time.Duration
+}
+
+// Main runs the netns-ready plugin.
+func Main() {
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}), version.VersionsStartingFrom("0.3.1"), bv.BuildString("netns-ready"))
+}
+
+func parseConf(data []byte) (*ReadyConf, *current.Result, error) {
+	conf := ReadyConf{Retries: defaultRetries}
+	if err := config.Validate(data, &conf); err != nil {
+		return nil, nil, fmt.Errorf("invalid network configuration: %v", err)
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	var err error
+	if conf.timeout, err = parseDuration("timeout", conf.Timeout, defaultTimeout); err != nil {
+		return nil, nil, err
+	}
+	if conf.interval, err = parseDuration("interval", conf.Interval, defaultInterval); err != nil {
+		return nil, nil, err
+	}
+	if conf.Retries < 0 {
+		return nil, nil, fmt.Errorf("invalid retries %d", conf.Retries)
+	}
+	if len(conf.Probes) == 0 {
+		conf.Probes = []Probe{{Type: probeGateway}}
+	}
+	for i := range conf.Probes {
+		if err := conf.Probes[i].validate(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if conf.RawPrevResult == nil {
+		return &conf, nil, nil
+	}
+	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+		return nil, nil, fmt.Errorf("could not parse prevResult: %v", err)
+	}
+	result, err := current.NewResultFromResult(conf.PrevResult)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not convert result to current version: %v", err)
+	}
+	return &conf, result, nil
+}
+
+func parseDuration(name, s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q, must be a positive duration", name, s)
+	}
+	return d, nil
+}
+
+// gateways returns the gateways of the addresses of the pod's interfaces.
+func gateways(result *current.Result) []net.IP {
+	var gws []net.IP
+next:
+	for _, ipc := range result.IPs {
+		if ipc.Gateway == nil {
+			continue
+		}
+		if ipc.Interface != nil {
+			idx := *ipc.Interface
+			if idx >= 0 && idx < len(result.Interfaces) && result.Interfaces[idx].Sandbox == "" {
+				continue
+			}
+		}
+		for _, gw := range gws {
+			if gw.Equal(ipc.Gateway) {
+				continue next
+			}
+		}
+		gws = append(gws, ipc.Gateway)
+	}
+	return gws
+}
+
+// nameserver returns the server dns probes ask by default.
+func nameserver(conf *ReadyConf, result *current.Result) net.IP {
+	for _, dns := range []types.DNS{result.DNS, conf.DNS} {
+		for _, server := range dns.Nameservers {
+			if ip := net.ParseIP(server); ip != nil {
+				return ip
+			}
+		}
+	}
+	return nil
+}
+
+// runProbe runs a probe until it succeeds or runs out of retries.
+func runProbe(conf *ReadyConf, result *current.Result, p *Probe) error {
+	var checks []func() error
+	var target string
+	switch p.Type {
+	case probeGateway:
+		gws := gateways(result)
+		if len(gws) == 0 {
+			return fmt.Errorf("gateway probe failed: no gateway in the previous result")
+		}
+		for _, gw := range gws {
+			gw := gw
+			checks = append(checks, func() error { return ping(gw, conf.timeout) })
+		}
+		target = fmt.Sprintf("%v", gws)
+	case probePing:
+		addr := net.ParseIP(p.Address)
+		checks = append(checks, func() error { return ping(addr, conf.timeout) })
+		target = p.Address
+	case probeDNS:
+		server := net.ParseIP(p.Address)
+		if server == nil {
+			if server = nameserver(conf, result); server == nil {
+				return fmt.Errorf("dns probe of %s failed: no nameserver to ask", p.Name)
+			}
+		}
+		checks = append(checks, func() error { return resolve(server, p.Name, conf.timeout) })
+		target = fmt.Sprintf("%s at %s", p.Name, server)
+	case probeTCP:
+		checks = append(checks, func() error { return connect(p.Address, conf.timeout) })
+		target = p.Address
+	}
+
+	var err error
+	for attempt := 0; attempt <= conf.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(conf.interval)
+		}
+		err = nil
+		for _, check := range checks {
+			if err = check(); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s probe of %s failed after %d attempts: %v", p.Type, target, conf.Retries+1, err)
+}
+
+// probe runs the probes in the pod's namespace, stopping at the first that
+// fails.
+func probe(conf *ReadyConf, result *current.Result, netnsPath string) error {
+	return ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		for i := range conf.Probes {
+			if err := runProbe(conf, result, &conf.Probes[i]); err != nil {
+				return fmt.Errorf("network isn't ready: %v", err)
+			}
+		}
+		return nil
+	})
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, result, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	if err := probe(conf, result, args.Netns); err != nil {
+		return err
+	}
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+func cmdDel(_ *skel.CmdArgs) error {
+	// nothing was set up
+	return nil
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, result, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+	return probe(conf, result, args.Netns)
+}
@@ -0,0 +1,182 @@
+//go:build linux
+
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netnsready
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+)
+
+var _ = Describe("netns-ready", func() {
+	var hostNS, containerNS ns.NetNS
+
+	addAddr := func(name, addr string) {
+		defer GinkgoRecover()
+
+		link, err := netlink.LinkByName(name)
+		Expect(err).NotTo(HaveOccurred())
+		ipn, err := netlink.ParseIPNet(addr)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(netlink.AddrAdd(link, &netlink.Addr{IPNet: ipn})).To(Succeed())
+		Expect(netlink.LinkSetUp(link)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		hostNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		containerNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "veth0"},
+				PeerName:  "eth0",
+			})).To(Succeed())
+			addAddr("veth0", "10.0.0.1/24")
+			eth0, err := netlink.LinkByName("eth0")
+			Expect(err).NotTo(HaveOccurred())
+			return netlink.LinkSetNsFd(eth0, int(containerNS.Fd()))
+		})).To(Succeed())
+		Expect(containerNS.Do(func(ns.NetNS) error {
+			addAddr("eth0", "10.0.0.2/24")
+			return nil
+		})).To(Succeed())
+	})
+
+	AfterEach(func() {
+		for _, n := range []ns.NetNS{hostNS, containerNS} {
+			Expect(n.Close()).To(Succeed())
+			Expect(testutils.UnmountNS(n)).To(Succeed())
+		}
+	})
+
+	conf := func(settings string) []byte {
+		return []byte(fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "test",
+			"type": "netns-ready",
+			"timeout": "200ms",
+			"interval": "10ms",
+			%s
+			"prevResult": {
+				"cniVersion": "1.0.0",
+				"interfaces": [
+					{"name": "veth0"},
+					{"name": "eth0", "sandbox": %q}
+				],
+				"ips": [
+					{"address": "10.0.0.2/24", "gateway": "10.0.0.1", "interface": 1}
+				],
+				"dns": {"nameservers": ["10.0.0.1"]}
+			}
+		}`, settings, containerNS.Path()))
+	}
+
+	add := func(data []byte) error {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       containerNS.Path(),
+			IfName:      "eth0",
+			StdinData:   data,
+		}
+		_, _, err := testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) })
+		return err
+	}
+
+	It("pings the gateway by default", func() {
+		Expect(add(conf(""))).To(Succeed())
+		Expect(add(conf(`"probes": [{"type": "ping", "address": "10.0.0.3"}], "retries": 1,`))).To(MatchError(
+			ContainSubstring("network isn't ready: ping probe of 10.0.0.3 failed after 2 attempts")))
+	})
+
+	It("connects to TCP services", func() {
+		var listener net.Listener
+		Expect(hostNS.Do(func(ns.NetNS) error {
+			var err error
+			listener, err = net.Listen("tcp", "10.0.0.1:0")
+			return err
+		})).To(Succeed())
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+
+		Expect(add(conf(fmt.Sprintf(`"probes": [{"type": "tcp", "address": %q}],`, listener.Addr())))).To(Succeed())
+		Expect(add(conf(`"probes": [{"type": "tcp", "address": "10.0.0.1:1"}], "retries": 0,`))).To(MatchError(
+			ContainSubstring("tcp probe of 10.0.0.1:1 failed after 1 attempts")))
+	})
+
+	It("resolves names with the nameserver of the result", func() {
+		var server net.PacketConn
+		Expect(hostNS.Do(func(ns.NetNS) error {
+			var err error
+			server, err = net.ListenPacket("udp", "10.0.0.1:53")
+			return err
+		})).To(Succeed())
+		defer server.Close()
+		// answers NOERROR for ready.test., NXDOMAIN for any other name
+		go func() {
+			buf := make([]byte, 512)
+			for {
+				n, from, err := server.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				query, _ := dnsQuery(binary.BigEndian.Uint16(buf), "ready.test")
+				reply := append([]byte{}, buf[:n]...)
+				reply[2] |= 0x80
+				if string(reply[12:]) != string(query[12:]) {
+					reply[3] |= 3
+				}
+				_, _ = server.WriteTo(reply, from)
+			}
+		}()
+
+		Expect(add(conf(`"probes": [{"type": "dns", "name": "ready.test"}],`))).To(Succeed())
+		Expect(add(conf(`"probes": [{"type": "dns", "name": "gone.test"}], "retries": 0,`))).To(MatchError(
+			ContainSubstring("dns probe of gone.test at 10.0.0.1 failed after 1 attempts: gone.test doesn't exist")))
+	})
+
+	It("validates the configuration", func() {
+		_, _, err := parseConf(conf(`"probes": [{"type": "http"}],`))
+		Expect(err).To(MatchError(`unknown probe type "http", must be one of gateway, ping, dns or tcp`))
+		_, _, err = parseConf(conf(`"probes": [{"type": "tcp", "address": "kubernetes:443"}],`))
+		Expect(err).To(MatchError(`invalid tcp probe address "kubernetes:443", must be ip:port`))
+		_, _, err = parseConf(conf(`"probes": [{"type": "dns"}],`))
+		Expect(err).To(MatchError("dns probe requires a name"))
+		_, _, err = parseConf([]byte(`{"cniVersion": "1.0.0", "name": "test", "type": "netns-ready", "timeout": "0s"}`))
+		Expect(err).To(MatchError(`invalid timeout "0s", must be a positive duration`))
+	})
+})
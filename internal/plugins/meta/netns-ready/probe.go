@@ -0,0 +1,203 @@
+//go:build linux
+
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netnsready
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	probeGateway = "gateway"
+	probePing    = "ping"
+	probeDNS     = "dns"
+	probeTCP     = "tcp"
+)
+
+// Probe is a check of the pod's network, run from inside its namespace.
+type Probe struct {
+	// Type is "gateway", pinging the gateways of the previous result,
+	// "ping", "dns" or "tcp"
+	Type string `json:"type"`
+	// Address is the host to ping, the host:port to connect to, or the
+	// DNS server to ask, by default the first nameserver of the result
+	Address string `json:"address,omitempty"`
+	// Name is the name a dns probe resolves
+	Name string `json:"name,omitempty"`
+}
+
+func (p *Probe) validate() error {
+	switch p.Type {
+	case probeGateway:
+		return nil
+	case probePing:
+		if net.ParseIP(p.Address) == nil {
+			return fmt.Errorf("invalid ping probe address %q, must be an IP address", p.Address)
+		}
+	case probeDNS:
+		if p.Name == "" {
+			return fmt.Errorf("dns probe requires a name")
+		}
+		if p.Address != "" && net.ParseIP(p.Address) == nil {
+			return fmt.Errorf("invalid dns probe address %q, must be an IP address", p.Address)
+		}
+	case probeTCP:
+		// names would be resolved outside of the pod's namespace
+		host, _, err := net.SplitHostPort(p.Address)
+		if err != nil || net.ParseIP(host) == nil {
+			return fmt.Errorf("invalid tcp probe address %q, must be ip:port", p.Address)
+		}
+	default:
+		return fmt.Errorf("unknown probe type %q, must be one of gateway, ping, dns or tcp", p.Type)
+	}
+	return nil
+}
+
+// ping sends an ICMP echo request to addr and waits for the reply.
+func ping(addr net.IP, timeout time.Duration) error {
+	network, request, reply := "ip4:icmp", byte(8), byte(0)
+	if addr.To4() == nil {
+		network, request, reply = "ip6:ipv6-icmp", 128, 129
+	}
+	conn, err := net.ListenPacket(network, "")
+	if err != nil {
+		return fmt.Errorf("failed to open ICMP socket: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	id, seq := uint16(rand.Intn(1<<16)), uint16(1)
+	msg := make([]byte, 16)
+	msg[0] = request
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	copy(msg[8:], "cni-ping")
+	// the kernel fills in the checksum of ICMPv6 sockets
+	if request == 8 {
+		binary.BigEndian.PutUint16(msg[2:], checksum(msg))
+	}
+	if _, err := conn.WriteTo(msg, &net.IPAddr{IP: addr}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		// the socket sees all ICMP messages of the namespace
+		if n < 8 || buf[0] != reply || !from.(*net.IPAddr).IP.Equal(addr) {
+			continue
+		}
+		if binary.BigEndian.Uint16(buf[4:]) == id && binary.BigEndian.Uint16(buf[6:]) == seq {
+			return nil
+		}
+	}
+}
+
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// resolve asks server for the A records of name. The name has to exist,
+// records of another type only, e.g. on IPv6 only networks, do. The query
+// is made by hand instead of with net.Resolver, which may open its socket
+// on another thread, outside of the pod's namespace.
+func resolve(server net.IP, name string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(server.String(), "53"), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	id := uint16(rand.Intn(1 << 16))
+	query, err := dnsQuery(id, name)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(query); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 512)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		// a late answer to an earlier attempt
+		if n < 12 || binary.BigEndian.Uint16(buf) != id || buf[2]&0x80 == 0 {
+			continue
+		}
+		switch rcode := buf[3] & 0x0f; rcode {
+		case 0:
+			return nil
+		case 3:
+			return fmt.Errorf("%s doesn't exist", name)
+		default:
+			return fmt.Errorf("server answered with rcode %d", rcode)
+		}
+	}
+}
+
+// dnsQuery returns a recursive query for the A records of name.
+func dnsQuery(id uint16, name string) ([]byte, error) {
+	msg := make([]byte, 12, 12+len(name)+6)
+	binary.BigEndian.PutUint16(msg, id)
+	// recursion desired
+	msg[2] = 0x01
+	// one question
+	msg[5] = 1
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid name %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	// type A, class IN
+	return append(msg, 0, 0, 1, 0, 1), nil
+}
+
+// connect opens a TCP connection to address and closes it again.
+func connect(address string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
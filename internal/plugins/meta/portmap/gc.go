@@ -0,0 +1,121 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package portmap
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/mattn/go-shellwords"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/gc"
+)
+
+// dnatCommentRe matches the comment fillDnatRules tags the entry rules of
+// a container with. Comments trimmed to the iptables limit don't match:
+// their container can't be told and GC leaves them to DEL.
+var dnatCommentRe = regexp.MustCompile(`^dnat name: "(.*)" id: "(.*)"$`)
+
+// dnatRuleOwner returns the network and container of an entry rule of the
+// top-level DNAT chain, as listed by iptables -S.
+func dnatRuleOwner(rule string) (string, string, bool) {
+	parts, err := shellwords.Parse(rule)
+	if err != nil {
+		return "", "", false
+	}
+	for i := 0; i < len(parts)-1; i++ {
+		if parts[i] != "--comment" {
+			continue
+		}
+		if m := dnatCommentRe.FindStringSubmatch(parts[i+1]); m != nil {
+			return m[1], m[2], true
+		}
+	}
+	return "", "", false
+}
+
+// usableIptables returns the handles of the protocols iptables can be
+// used for, which may be none.
+func usableIptables() []*iptables.IPTables {
+	var ipts []*iptables.IPTables
+	for _, isV6 := range []bool{false, true} {
+		if ipt, _ := maybeGetIptables(isV6); ipt != nil {
+			ipts = append(ipts, ipt)
+		}
+	}
+	return ipts
+}
+
+// listAttachments returns the containers of the network with port
+// mappings, for all of their interfaces.
+func listAttachments(conf *PortMapConf, ipts []*iptables.IPTables) ([]types.GCAttachment, error) {
+	var attachments []types.GCAttachment
+	for _, ipt := range ipts {
+		exists, err := ipt.ChainExists("nat", TopLevelDNATChainName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check chain %s: %v", TopLevelDNATChainName, err)
+		}
+		if !exists {
+			continue
+		}
+		rules, err := ipt.List("nat", TopLevelDNATChainName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list chain %s: %v", TopLevelDNATChainName, err)
+		}
+		for _, rule := range rules {
+			if network, containerID, ok := dnatRuleOwner(rule); ok && network == conf.Name {
+				attachments = append(attachments, types.GCAttachment{ContainerID: containerID})
+			}
+		}
+	}
+	return attachments, nil
+}
+
+// releaseAttachment deletes the DNAT chain of a container and its entry
+// rules, and the SNAT chain older versions created.
+func releaseAttachment(conf *PortMapConf, ipts []*iptables.IPTables, a types.GCAttachment) error {
+	dnatChain := genDnatChain(conf.Name, a.ContainerID)
+	oldSnatChain := genOldSnatChain(conf.Name, a.ContainerID)
+	for _, ipt := range ipts {
+		if err := dnatChain.teardown(ipt); err != nil {
+			return fmt.Errorf("could not teardown dnat: %v", err)
+		}
+		oldSnatChain.teardown(ipt)
+	}
+	return nil
+}
+
+// cmdGC removes the port mappings of the containers the runtime no longer
+// lists, which would otherwise forward their host ports until reboot.
+func cmdGC(args *skel.CmdArgs) error {
+	conf, _, err := parseConfig(args.StdinData, "")
+	if err != nil {
+		return fmt.Errorf("failed to parse config: %v", err)
+	}
+	valid, err := gc.ValidAttachments(args.StdinData)
+	if err != nil {
+		return err
+	}
+	// Without iptables there can't be any rules to collect
+	ipts := usableIptables()
+	return gc.Collect(valid, func() ([]types.GCAttachment, error) {
+		return listAttachments(conf, ipts)
+	}, func(a types.GCAttachment) error {
+		return releaseAttachment(conf, ipts, a)
+	})
+}
@@ -0,0 +1,132 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package portmap
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+func hasHostInterface(entries []PortMapEntry) bool {
+	for _, e := range entries {
+		if e.HostInterface != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveHostInterfaces replaces every mapping bound to a host interface by
+// one mapping per current address of the interface. Link-local addresses are
+// skipped, as they can't be told apart between interfaces. An interface
+// without addresses, e.g. still waiting for a DHCP lease, maps nothing until
+// the mappings are resolved again.
+func resolveHostInterfaces(entries []PortMapEntry) ([]PortMapEntry, error) {
+	if !hasHostInterface(entries) {
+		return entries, nil
+	}
+
+	resolved := make([]PortMapEntry, 0, len(entries))
+	for _, e := range entries {
+		if e.HostInterface == "" {
+			resolved = append(resolved, e)
+			continue
+		}
+
+		l, err := netlink.LinkByName(e.HostInterface)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup host interface %q: %v", e.HostInterface, err)
+		}
+		addrs, err := netlink.AddrList(l, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list addresses of host interface %q: %v", e.HostInterface, err)
+		}
+
+		n := 0
+		for _, addr := range addrs {
+			if addr.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			m := e
+			m.HostIP = addr.IP.String()
+			m.HostInterface = ""
+			resolved = append(resolved, m)
+			n++
+		}
+		if n == 0 {
+			log.Printf("host interface %q has no addresses, not mapping host port %d", e.HostInterface, e.HostPort)
+		}
+	}
+	return resolved, nil
+}
+
+// refreshPorts rebuilds the container's DNAT chains if they no longer match
+// the resolved mappings, e.g. after a host interface changed its address.
+func refreshPorts(config *PortMapConf) error {
+	stale := false
+	for _, containerNet := range contNets(config) {
+		if !dnatChainCurrent(config, containerNet) {
+			stale = true
+		}
+	}
+	if !stale {
+		return nil
+	}
+
+	if err := unforwardPorts(config); err != nil {
+		return err
+	}
+	for _, containerNet := range contNets(config) {
+		if err := forwardPorts(config, containerNet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func contNets(config *PortMapConf) []net.IPNet {
+	nets := []net.IPNet{}
+	if config.ContIPv4.IP != nil {
+		nets = append(nets, config.ContIPv4)
+	}
+	if config.ContIPv6.IP != nil {
+		nets = append(nets, config.ContIPv6)
+	}
+	return nets
+}
+
+// dnatChainCurrent returns true if the DNAT chain for containerNet holds
+// exactly the rules of the current mappings. Rules for addresses the host
+// interface lost would otherwise go unnoticed.
+func dnatChainCurrent(config *PortMapConf, containerNet net.IPNet) bool {
+	ipt, err := maybeGetIptables(containerNet.IP.To4() == nil)
+	if err != nil {
+		return false
+	}
+	dnatChain := genDnatChain(config.Name, config.ContainerID)
+	fillDnatRules(&dnatChain, config, containerNet)
+	if err := dnatChain.check(ipt); err != nil {
+		return false
+	}
+	rules, err := ipt.List(dnatChain.table, dnatChain.name)
+	if err != nil {
+		return false
+	}
+	// the listing starts with the chain's -N line
+	return len(rules)-1 == len(dnatChain.rules)
+}
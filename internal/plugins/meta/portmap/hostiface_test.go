@@ -0,0 +1,97 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package portmap
+
+import (
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+)
+
+var _ = Describe("portmapping to host interfaces", func() {
+	var testNS ns.NetNS
+
+	BeforeEach(func() {
+		var err error
+		testNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = testNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			lo, err := netlink.LinkByName("lo")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(lo)).To(Succeed())
+			Expect(netlink.AddrAdd(lo, &netlink.Addr{IPNet: &net.IPNet{
+				IP:   net.ParseIP("192.0.2.10"),
+				Mask: net.CIDRMask(32, 32),
+			}})).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(testNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(testNS)).To(Succeed())
+	})
+
+	It("rejects mappings with both a hostIP and a hostInterface", func() {
+		_, _, err := parseConfig([]byte(`{
+			"name": "test",
+			"type": "portmap",
+			"cniVersion": "1.0.0",
+			"runtimeConfig": {
+				"portMappings": [
+					{"hostPort": 8080, "containerPort": 80, "protocol": "tcp", "hostIP": "192.0.2.10", "hostInterface": "lo"}
+				]
+			}
+		}`), "container")
+		Expect(err).To(MatchError("hostIP and hostInterface can't both be set for host port 8080"))
+	})
+
+	It("resolves a hostInterface to its current addresses", func() {
+		err := testNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			entries := []PortMapEntry{
+				{HostPort: 8080, ContainerPort: 80, Protocol: "tcp", HostInterface: "lo"},
+				{HostPort: 8443, ContainerPort: 443, Protocol: "tcp"},
+			}
+			resolved, err := resolveHostInterfaces(entries)
+			Expect(err).NotTo(HaveOccurred())
+
+			hostIPs := []string{}
+			for _, e := range resolved {
+				if e.HostPort == 8080 {
+					Expect(e.HostInterface).To(BeEmpty())
+					hostIPs = append(hostIPs, e.HostIP)
+				}
+			}
+			Expect(hostIPs).To(ConsistOf("127.0.0.1", "192.0.2.10", "::1"))
+			Expect(resolved).To(ContainElement(entries[1]))
+
+			_, err = resolveHostInterfaces([]PortMapEntry{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp", HostInterface: "missing0"}})
+			Expect(err).To(MatchError(ContainSubstring(`failed to lookup host interface "missing0"`)))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
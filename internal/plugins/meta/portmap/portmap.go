@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package portmap
 
 import (
 	"fmt"
@@ -245,6 +245,13 @@ func fillDnatRules(c *chain, config *PortMapConf, containerNet net.IPNet) {
 			}
 		}
 
+		// A mapping restricted to sources of the other family only isn't
+		// exposed at all
+		sources := sourceCIDRs(entry, isV6)
+		if len(entry.SourceCIDRs) > 0 && len(sources) == 0 {
+			continue
+		}
+
 		ruleBase := []string{
 			"-p", entry.Protocol,
 			"--dport", strconv.Itoa(entry.HostPort),
@@ -288,15 +295,37 @@ func fillDnatRules(c *chain, config *PortMapConf, containerNet net.IPNet) {
 			}
 		}
 
-		// The actual dnat rule
-		dnatRule := make([]string, len(ruleBase), len(ruleBase)+4)
-		copy(dnatRule, ruleBase)
-		dnatRule = append(dnatRule,
-			"-j", "DNAT",
-			"--to-destination", fmtIPPort(containerNet.IP, entry.ContainerPort),
-		)
-		c.rules = append(c.rules, dnatRule)
+		// The actual dnat rule, once per allowed source, if restricted
+		if len(sources) == 0 {
+			sources = []string{""}
+		}
+		for _, source := range sources {
+			dnatRule := make([]string, len(ruleBase), len(ruleBase)+6)
+			copy(dnatRule, ruleBase)
+			if source != "" {
+				dnatRule = append(dnatRule, "-s", source)
+			}
+			dnatRule = append(dnatRule,
+				"-j", "DNAT",
+				"--to-destination", fmtIPPort(containerNet.IP, entry.ContainerPort),
+			)
+			c.rules = append(c.rules, dnatRule)
+		}
+	}
+}
+
+// sourceCIDRs returns the source CIDRs of the entry of the given family,
+// in their canonical form.
+func sourceCIDRs(entry PortMapEntry, isV6 bool) []string {
+	var sources []string
+	for _, cidr := range entry.SourceCIDRs {
+		_, ipn, err := net.ParseCIDR(cidr)
+		if err != nil || (ipn.IP.To4() == nil) != isV6 {
+			continue
+		}
+		sources = append(sources, ipn.String())
 	}
+	return sources
 }
 
 // genSetMarkChain creates the SETMARK chain - the chain that sets the
@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package portmap
 
 import (
 	"fmt"
@@ -129,6 +129,21 @@ var _ = Describe("portmapping configuration", func() {
 				Expect(err).To(MatchError("Invalid host port number: 0"))
 			})
 
+			It(fmt.Sprintf("[%s] fails with an invalid source CIDR", ver), func() {
+				configBytes := []byte(fmt.Sprintf(`{
+					"name": "test",
+					"type": "portmap",
+					"cniVersion": "%s",
+					"runtimeConfig": {
+						"portMappings": [
+							{ "hostPort": 8080, "containerPort": 80, "protocol": "tcp", "sourceCIDRs": ["192.168.10.1"]}
+						]
+					}
+				}`, ver))
+				_, _, err := parseConfig(configBytes, "container")
+				Expect(err).To(MatchError(`invalid source CIDR "192.168.10.1" for host port 8080: invalid CIDR address: 192.168.10.1`))
+			})
+
 			It(fmt.Sprintf("[%s] does not fail on missing prevResult interface index", ver), func() {
 				configBytes := []byte(fmt.Sprintf(`{
 					"name": "test",
@@ -330,6 +345,43 @@ var _ = Describe("portmapping configuration", func() {
 					}))
 				})
 
+				It(fmt.Sprintf("[%s] restricts a mapping to its source CIDRs", ver), func() {
+					configBytes := []byte(fmt.Sprintf(`{
+						"name": "test",
+						"type": "portmap",
+						"cniVersion": "%s",
+						"snat": false,
+						"runtimeConfig": {
+							"portMappings": [
+								{ "hostPort": 8443, "containerPort": 443, "protocol": "tcp", "sourceCIDRs": ["192.168.10.0/24", "10.20.0.1/16", "fd00::/64"]},
+								{ "hostPort": 8080, "containerPort": 80, "protocol": "tcp", "sourceCIDRs": ["fd00::/64"]}
+							]
+						}
+					}`, ver))
+
+					conf, _, err := parseConfig(configBytes, "foo")
+					Expect(err).NotTo(HaveOccurred())
+					conf.ContainerID = containerID
+
+					ch := genDnatChain(conf.Name, containerID)
+					n, err := types.ParseCIDR("10.0.0.2/24")
+					Expect(err).NotTo(HaveOccurred())
+					fillDnatRules(&ch, conf, *n)
+					Expect(ch.rules).To(Equal([][]string{
+						{"-p", "tcp", "--dport", "8443", "-s", "192.168.10.0/24", "-j", "DNAT", "--to-destination", "10.0.0.2:443"},
+						{"-p", "tcp", "--dport", "8443", "-s", "10.20.0.0/16", "-j", "DNAT", "--to-destination", "10.0.0.2:443"},
+					}))
+
+					ch = genDnatChain(conf.Name, containerID)
+					n, err = types.ParseCIDR("2001:db8::2/64")
+					Expect(err).NotTo(HaveOccurred())
+					fillDnatRules(&ch, conf, *n)
+					Expect(ch.rules).To(Equal([][]string{
+						{"-p", "tcp", "--dport", "8443", "-s", "fd00::/64", "-j", "DNAT", "--to-destination", "[2001:db8::2]:443"},
+						{"-p", "tcp", "--dport", "8080", "-s", "fd00::/64", "-j", "DNAT", "--to-destination", "[2001:db8::2]:80"},
+					}))
+				})
+
 				It(fmt.Sprintf("[%s] generates a correct top-level chain", ver), func() {
 					ch := genToplevelDnatChain()
 
@@ -375,4 +427,23 @@ var _ = Describe("portmapping configuration", func() {
 			})
 		})
 	}
+
+	Describe("GC", func() {
+		It("tells the owner of an entry rule", func() {
+			network, id, ok := dnatRuleOwner(`-A CNI-HOSTPORT-DNAT -p tcp -m comment --comment "dnat name: \"test\" id: \"abc\"" -m multiport --dports 8080 -j CNI-DN-2e2f8d5b91929ef9fc152`)
+			Expect(ok).To(BeTrue())
+			Expect(network).To(Equal("test"))
+			Expect(id).To(Equal("abc"))
+		})
+
+		It("ignores rules of others and trimmed comments", func() {
+			_, _, ok := dnatRuleOwner(`-N CNI-HOSTPORT-DNAT`)
+			Expect(ok).To(BeFalse())
+			_, _, ok = dnatRuleOwner(`-A CNI-HOSTPORT-DNAT -p tcp -m comment --comment "kube hostport" -j KUBE-HP-X`)
+			Expect(ok).To(BeFalse())
+			comment := trimComment(fmt.Sprintf(`dnat name: "test" id: "%s"`, containerID+containerID))
+			_, _, ok = dnatRuleOwner(fmt.Sprintf(`-A CNI-HOSTPORT-DNAT -m comment --comment %q -j CNI-DN-x`, comment))
+			Expect(ok).To(BeFalse())
+		})
+	})
 })
@@ -0,0 +1,226 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a chained plugin that makes a pod's addresses reachable across
+// the site without an overlay: it keeps a host route for each of them in a
+// dedicated routing table, which the node's BGP daemon announces to its
+// upstream peers. The routes are added on ADD and withdrawn on DEL. A CNI
+// plugin only lives for one invocation, too short for a BGP session, whose
+// routes are withdrawn when it closes, so the session is left to the daemon.
+package routereflector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/include"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+)
+
+const (
+	defaultTable    = 200
+	defaultProtocol = 200
+)
+
+// ReflectorConf is the route-reflector configuration.
+type ReflectorConf struct {
+	types.NetConf
+
+	// Table is the routing table the pod routes are kept in, the one the
+	// BGP daemon exports. It must not be one the host routes by.
+	Table int `json:"table,omitempty"`
+	// Protocol is the route protocol the pod routes are tagged with, so
+	// the BGP daemon can tell them from others
+	Protocol int `json:"protocol,omitempty"`
+}
+
+// Main runs the route-reflector plugin.
+func Main() {
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}), version.VersionsStartingFrom("0.3.1"), bv.BuildString("route-reflector"))
+}
+
+func parseConf(data []byte) (*ReflectorConf, *current.Result, error) {
+	conf := ReflectorConf{Table: defaultTable, Protocol: defaultProtocol}
+	if err := config.Validate(data, &conf); err != nil {
+		return nil, nil, fmt.Errorf("invalid network configuration: %v", err)
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	switch conf.Table {
+	case syscall.RT_TABLE_UNSPEC, syscall.RT_TABLE_COMPAT, syscall.RT_TABLE_DEFAULT, syscall.RT_TABLE_MAIN, syscall.RT_TABLE_LOCAL:
+		return nil, nil, fmt.Errorf("invalid table %d, the host routes by it", conf.Table)
+	}
+	if conf.Table < 0 {
+		return nil, nil, fmt.Errorf("invalid table %d", conf.Table)
+	}
+	// protocols up to RTPROT_STATIC are the kernel's own
+	if conf.Protocol <= syscall.RTPROT_STATIC || conf.Protocol > 255 {
+		return nil, nil, fmt.Errorf("invalid protocol %d, must be between %d and 255", conf.Protocol, syscall.RTPROT_STATIC+1)
+	}
+
+	if conf.RawPrevResult == nil {
+		return &conf, nil, nil
+	}
+	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+		return nil, nil, fmt.Errorf("could not parse prevResult: %v", err)
+	}
+	result, err := current.NewResultFromResult(conf.PrevResult)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not convert result to current version: %v", err)
+	}
+	return &conf, result, nil
+}
+
+// podRoutes returns the host routes of the pod's addresses in the result.
+// They go out of the first host side interface, e.g. the bridge or the
+// host end of the veth, or are blackholes if there is none, e.g. with
+// macvlan: the table is only exported, never routed by.
+func podRoutes(conf *ReflectorConf, result *current.Result) ([]*netlink.Route, error) {
+	linkIndex := 0
+	for _, intf := range result.Interfaces {
+		if intf.Sandbox == "" {
+			link, err := netlink.LinkByName(intf.Name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to look up host interface %q: %v", intf.Name, err)
+			}
+			linkIndex = link.Attrs().Index
+			break
+		}
+	}
+
+	var routes []*netlink.Route
+	for _, ipc := range result.IPs {
+		if ipc.Interface != nil {
+			idx := *ipc.Interface
+			if idx >= 0 && idx < len(result.Interfaces) && result.Interfaces[idx].Sandbox == "" {
+				continue
+			}
+		}
+		bits := 128
+		if ipc.Address.IP.To4() != nil {
+			bits = 32
+		}
+		route := &netlink.Route{
+			Dst:      &net.IPNet{IP: ipc.Address.IP, Mask: net.CIDRMask(bits, bits)},
+			Table:    conf.Table,
+			Protocol: netlink.RouteProtocol(conf.Protocol),
+		}
+		if linkIndex != 0 {
+			route.LinkIndex = linkIndex
+			route.Scope = netlink.SCOPE_LINK
+		} else {
+			route.Type = syscall.RTN_BLACKHOLE
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, result, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	routes, err := podRoutes(conf, result)
+	if err != nil {
+		return err
+	}
+	for i, route := range routes {
+		// replace, an earlier pod's route may not have been withdrawn
+		if err := netlink.RouteReplace(route); err != nil {
+			for _, added := range routes[:i] {
+				_ = netlink.RouteDel(added)
+			}
+			return fmt.Errorf("failed to add route to %s: %v", route.Dst, err)
+		}
+	}
+
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, result, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	// Without a prevResult the pod's addresses are unknown
+	if result == nil {
+		return nil
+	}
+
+	var errs []error
+	for _, ipc := range result.IPs {
+		bits := 128
+		if ipc.Address.IP.To4() != nil {
+			bits = 32
+		}
+		// the host interface may be gone already, match the route by
+		// its destination only, whatever its scope
+		route := &netlink.Route{
+			Dst:   &net.IPNet{IP: ipc.Address.IP, Mask: net.CIDRMask(bits, bits)},
+			Table: conf.Table,
+			Scope: netlink.SCOPE_NOWHERE,
+		}
+		if err := netlink.RouteDel(route); err != nil && !errors.Is(err, syscall.ESRCH) && !errors.Is(err, syscall.ENOENT) {
+			errs = append(errs, fmt.Errorf("failed to withdraw route to %s: %v", route.Dst, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, result, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+
+	routes, err := podRoutes(conf, result)
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		found, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Dst: route.Dst, Table: conf.Table},
+			netlink.RT_FILTER_DST|netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return fmt.Errorf("failed to list routes of table %d: %v", conf.Table, err)
+		}
+		if len(found) == 0 {
+			return fmt.Errorf("route to %s missing from table %d", route.Dst, conf.Table)
+		}
+		if found[0].LinkIndex != route.LinkIndex || found[0].Protocol != route.Protocol {
+			return fmt.Errorf("route to %s in table %d doesn't match, it was changed", route.Dst, conf.Table)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routereflector
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+)
+
+var _ = Describe("route-reflector", func() {
+	var hostNS ns.NetNS
+
+	BeforeEach(func() {
+		var err error
+		hostNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(hostNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(hostNS)).To(Succeed())
+	})
+
+	It("rejects the tables the host routes by", func() {
+		_, _, err := parseConf([]byte(`{"cniVersion": "1.0.0", "name": "test", "type": "route-reflector", "table": 254}`))
+		Expect(err).To(MatchError("invalid table 254, the host routes by it"))
+		_, _, err = parseConf([]byte(`{"cniVersion": "1.0.0", "name": "test", "type": "route-reflector", "protocol": 4}`))
+		Expect(err).To(MatchError("invalid protocol 4, must be between 5 and 255"))
+	})
+
+	It("adds, checks and withdraws the routes of the pod's addresses", func() {
+		conf := []byte(`{
+			"cniVersion": "1.0.0",
+			"name": "test",
+			"type": "route-reflector",
+			"table": 100,
+			"prevResult": {
+				"cniVersion": "1.0.0",
+				"interfaces": [
+					{"name": "veth0"},
+					{"name": "eth0", "sandbox": "/var/run/netns/test"}
+				],
+				"ips": [
+					{"address": "10.0.0.2/24", "interface": 1},
+					{"address": "fd00::2/64", "interface": 1}
+				]
+			}
+		}`)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       "/var/run/netns/test",
+			IfName:      "eth0",
+			StdinData:   conf,
+		}
+
+		tableRoutes := func() []string {
+			routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: 100}, netlink.RT_FILTER_TABLE)
+			Expect(err).NotTo(HaveOccurred())
+			dsts := []string{}
+			for _, r := range routes {
+				dsts = append(dsts, fmt.Sprintf("%s %d", r.Dst, r.Protocol))
+			}
+			return dsts
+		}
+
+		err := hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "veth0"},
+				PeerName:  "veth1",
+			})).To(Succeed())
+			veth0, err := netlink.LinkByName("veth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(veth0)).To(Succeed())
+
+			_, _, err = testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) })
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tableRoutes()).To(ConsistOf("10.0.0.2/32 200", "fd00::2/128 200"))
+
+			Expect(testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })).To(Succeed())
+
+			Expect(testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) })).To(Succeed())
+			Expect(tableRoutes()).To(BeEmpty())
+			Expect(testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })).To(
+				MatchError("route to 10.0.0.2/32 missing from table 100"))
+
+			// withdrawing twice is fine
+			Expect(testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) })).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
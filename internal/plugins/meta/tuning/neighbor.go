@@ -0,0 +1,241 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tuning
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+)
+
+// NeighborConf tunes the neighbor tables for pods talking to many peers on
+// the LAN, e.g. IoT aggregators.
+//
+// The kernel keeps a single neighbor table per protocol for all network
+// namespaces, so the garbage collection thresholds are host wide. They are
+// only ever raised, never lowered, and are left in place on DEL. The other
+// settings apply to the container's interface, for IPv4 and IPv6.
+type NeighborConf struct {
+	GCThresh1           *int `json:"gcThresh1,omitempty"`
+	GCThresh2           *int `json:"gcThresh2,omitempty"`
+	GCThresh3           *int `json:"gcThresh3,omitempty"`
+	BaseReachableTimeMs *int `json:"baseReachableTimeMs,omitempty"`
+	GCStaleTime         *int `json:"gcStaleTime,omitempty"`
+	UnresQLen           *int `json:"unresQLen,omitempty"`
+}
+
+// RouteConf tunes the routes of the container's interface and the IPv6
+// route cache of the container's network namespace.
+type RouteConf struct {
+	// Metric replaces the metric of all routes through the interface
+	Metric       *int `json:"metric,omitempty"`
+	IPv6MaxSize  *int `json:"ipv6MaxSize,omitempty"`
+	IPv6GCThresh *int `json:"ipv6GCThresh,omitempty"`
+}
+
+func (n *NeighborConf) gcThresholds() map[string]*int {
+	return map[string]*int{
+		"gc_thresh1": n.GCThresh1,
+		"gc_thresh2": n.GCThresh2,
+		"gc_thresh3": n.GCThresh3,
+	}
+}
+
+func (n *NeighborConf) validate() error {
+	values := n.gcThresholds()
+	values["baseReachableTimeMs"] = n.BaseReachableTimeMs
+	values["gcStaleTime"] = n.GCStaleTime
+	values["unresQLen"] = n.UnresQLen
+	for name, v := range values {
+		if v != nil && *v <= 0 {
+			return fmt.Errorf("invalid neighbor %s %d, must be positive", name, *v)
+		}
+	}
+
+	// every threshold set must not be above the next one set
+	var prev *int
+	for _, v := range []*int{n.GCThresh1, n.GCThresh2, n.GCThresh3} {
+		if v == nil {
+			continue
+		}
+		if prev != nil && *prev > *v {
+			return fmt.Errorf("neighbor gcThresh1, gcThresh2 and gcThresh3 must be increasing")
+		}
+		prev = v
+	}
+	return nil
+}
+
+func (r *RouteConf) validate() error {
+	if r.Metric != nil && *r.Metric < 0 {
+		return fmt.Errorf("invalid route metric %d", *r.Metric)
+	}
+	if r.IPv6MaxSize != nil && *r.IPv6MaxSize <= 0 {
+		return fmt.Errorf("invalid route ipv6MaxSize %d, must be positive", *r.IPv6MaxSize)
+	}
+	if r.IPv6GCThresh != nil && *r.IPv6GCThresh <= 0 {
+		return fmt.Errorf("invalid route ipv6GCThresh %d, must be positive", *r.IPv6GCThresh)
+	}
+	return nil
+}
+
+// tableSysctls returns the sysctls of the container's network namespace
+// the neighbor and route settings translate to, so they are written,
+// checked and allowlisted like the ones configured directly.
+func tableSysctls(conf *TuningConf) map[string]string {
+	sysctls := map[string]string{}
+	set := func(key string, v *int) {
+		if v != nil {
+			sysctls[key] = strconv.Itoa(*v)
+		}
+	}
+	if n := conf.Neighbor; n != nil {
+		for _, proto := range []string{"ipv4", "ipv6"} {
+			set("net."+proto+".neigh.IFNAME.base_reachable_time_ms", n.BaseReachableTimeMs)
+			set("net."+proto+".neigh.IFNAME.gc_stale_time", n.GCStaleTime)
+			set("net."+proto+".neigh.IFNAME.unres_qlen", n.UnresQLen)
+		}
+	}
+	if r := conf.Route; r != nil {
+		set("net.ipv6.route.max_size", r.IPv6MaxSize)
+		set("net.ipv6.route.gc_thresh", r.IPv6GCThresh)
+	}
+	return sysctls
+}
+
+// mergeTableSysctls adds the sysctls of the neighbor and route settings to
+// the configured ones, refusing to override any of them.
+func mergeTableSysctls(conf *TuningConf) error {
+	for key, value := range tableSysctls(conf) {
+		if _, ok := conf.SysCtl[key]; ok {
+			return fmt.Errorf("sysctl %s is set both directly and by the neighbor or route settings", key)
+		}
+		if conf.SysCtl == nil {
+			conf.SysCtl = map[string]string{}
+		}
+		conf.SysCtl[key] = value
+	}
+	return nil
+}
+
+// raiseGCThresholds raises the host wide neighbor table thresholds to the
+// configured ones. It must be called in the host's network namespace, the
+// container's doesn't have them.
+func raiseGCThresholds(n *NeighborConf) error {
+	if n == nil {
+		return nil
+	}
+	for _, proto := range []string{"ipv4", "ipv6"} {
+		for name, v := range n.gcThresholds() {
+			if v == nil {
+				continue
+			}
+			key := fmt.Sprintf("net.%s.neigh.default.%s", proto, name)
+			cur, err := readIntSysctl(key)
+			if err != nil {
+				return err
+			}
+			if cur >= *v {
+				continue
+			}
+			if _, err := sysctl.Sysctl(key, strconv.Itoa(*v)); err != nil {
+				return fmt.Errorf("failed to set %s: %v", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+func checkGCThresholds(n *NeighborConf) error {
+	if n == nil {
+		return nil
+	}
+	for _, proto := range []string{"ipv4", "ipv6"} {
+		for name, v := range n.gcThresholds() {
+			if v == nil {
+				continue
+			}
+			key := fmt.Sprintf("net.%s.neigh.default.%s", proto, name)
+			cur, err := readIntSysctl(key)
+			if err != nil {
+				return err
+			}
+			if cur < *v {
+				return fmt.Errorf("Error: Tuning configured %s is at least %d, current value is %d", key, *v, cur)
+			}
+		}
+	}
+	return nil
+}
+
+func readIntSysctl(key string) (int, error) {
+	value, err := sysctl.Sysctl(key)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %v", key, err)
+	}
+	return strconv.Atoi(strings.TrimSpace(value))
+}
+
+// changeRouteMetric replaces the routes through ifName in the main table
+// whose metric differs from the configured one.
+func changeRouteMetric(ifName string, metric int) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to get %q: %v", ifName, err)
+	}
+	routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list routes of %q: %v", ifName, err)
+	}
+	for _, route := range routes {
+		if route.Priority == metric {
+			continue
+		}
+		old := route
+		route.Priority = metric
+		// flags such as linkdown are reported, but only onlink can be set
+		route.Flags &= int(netlink.FLAG_ONLINK)
+		// add first, so the destination stays reachable
+		if err := netlink.RouteAdd(&route); err != nil {
+			return fmt.Errorf("failed to add route to %v with metric %d: %v", route.Dst, metric, err)
+		}
+		if err := netlink.RouteDel(&old); err != nil {
+			return fmt.Errorf("failed to delete route to %v with metric %d: %v", old.Dst, old.Priority, err)
+		}
+	}
+	return nil
+}
+
+func checkRouteMetric(ifName string, metric int) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("Cannot find container link %v", ifName)
+	}
+	routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list routes of %q: %v", ifName, err)
+	}
+	for _, route := range routes {
+		if route.Priority != metric {
+			return fmt.Errorf("Error: Tuning configured route metric of %s is %d, route to %v has %d",
+				ifName, metric, route.Dst, route.Priority)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tuning
+
+import (
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+var sysClassNet = "/sys/class/net"
+
+// SteeringConf steers the packet processing of the host side of the
+// container's veth to CPUs, for softirq locality of pods with high packet
+// rates. The CPUs are cpusets, e.g. "2-5,8", and must be online. They are
+// set on all queues of the host side veths of prevResult, which go away
+// with the container, so DEL leaves them.
+type SteeringConf struct {
+	// RPSCPUs are the CPUs receive packet steering spreads the packets
+	// the veth receives from the container over
+	RPSCPUs string `json:"rpsCpus,omitempty"`
+	// XPSCPUs are the CPUs transmit packet steering lets send to the
+	// container, the affinity of the veth's transmit queues
+	XPSCPUs string `json:"xpsCpus,omitempty"`
+
+	rps, xps []int
+}
+
+func (s *SteeringConf) validate() error {
+	var err error
+	if s.RPSCPUs != "" {
+		if s.rps, err = parseCPUSet(s.RPSCPUs); err != nil {
+			return fmt.Errorf("invalid steering rpsCpus %q: %v", s.RPSCPUs, err)
+		}
+	}
+	if s.XPSCPUs != "" {
+		if s.xps, err = parseCPUSet(s.XPSCPUs); err != nil {
+			return fmt.Errorf("invalid steering xpsCpus %q: %v", s.XPSCPUs, err)
+		}
+	}
+	return nil
+}
+
+// masks maps the patterns of the queue files of a device to the CPUs of
+// the masks written to them.
+func (s *SteeringConf) masks() map[string][]int {
+	masks := map[string][]int{}
+	if len(s.rps) > 0 {
+		masks["rx-*/rps_cpus"] = s.rps
+	}
+	if len(s.xps) > 0 {
+		masks["tx-*/xps_cpus"] = s.xps
+	}
+	return masks
+}
+
+// validateSteeringCPUs fails for CPUs which aren't online, which the kernel
+// refuses beyond its possible CPUs and silently leaves out otherwise.
+func validateSteeringCPUs(s *SteeringConf) error {
+	if s == nil {
+		return nil
+	}
+	online, err := onlineCPUs()
+	if err != nil {
+		return err
+	}
+	for name, cpus := range map[string][]int{"rpsCpus": s.rps, "xpsCpus": s.xps} {
+		offline := []int{}
+		for _, cpu := range cpus {
+			if !online[cpu] {
+				offline = append(offline, cpu)
+			}
+		}
+		if len(offline) > 0 {
+			return fmt.Errorf("invalid steering %s: CPUs %v are not online", name, offline)
+		}
+	}
+	return nil
+}
+
+// onlineCPUs returns the CPUs the kernel has online. It is a variable so
+// tests don't depend on the host's CPUs.
+var onlineCPUs = func() (map[int]bool, error) {
+	data, err := os.ReadFile("/sys/devices/system/cpu/online")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the online CPUs: %v", err)
+	}
+	cpus, err := parseCPUSet(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the online CPUs: %v", err)
+	}
+	online := map[int]bool{}
+	for _, cpu := range cpus {
+		online[cpu] = true
+	}
+	return online, nil
+}
+
+// parseCPUSet returns the CPUs of a cpuset in the kernel's list format.
+func parseCPUSet(s string) ([]int, error) {
+	seen := map[int]bool{}
+	var cpus []int
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		lo, err := strconv.Atoi(first)
+		if err != nil || lo < 0 {
+			return nil, fmt.Errorf("invalid CPU %q", first)
+		}
+		hi := lo
+		if isRange {
+			if hi, err = strconv.Atoi(last); err != nil || hi < lo {
+				return nil, fmt.Errorf("invalid CPU range %q", part)
+			}
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			if !seen[cpu] {
+				seen[cpu] = true
+				cpus = append(cpus, cpu)
+			}
+		}
+	}
+	return cpus, nil
+}
+
+// cpuMask returns the mask of the CPUs.
+func cpuMask(cpus []int) *big.Int {
+	mask := new(big.Int)
+	for _, cpu := range cpus {
+		mask.SetBit(mask, cpu, 1)
+	}
+	return mask
+}
+
+// formatCPUMask writes the mask as the kernel does, in hexadecimal groups of
+// 32 bits separated by commas.
+func formatCPUMask(mask *big.Int) string {
+	groups := []string{}
+	word := new(big.Int)
+	for rest := new(big.Int).Set(mask); ; rest.Rsh(rest, 32) {
+		word.And(rest, big.NewInt(0xffffffff))
+		groups = append([]string{fmt.Sprintf("%08x", word.Uint64())}, groups...)
+		if rest.BitLen() <= 32 {
+			break
+		}
+	}
+	return strings.Join(groups, ",")
+}
+
+// parseCPUMask parses a CPU mask as the kernel writes it, in hexadecimal
+// groups of 32 bits separated by commas.
+func parseCPUMask(mask string) (*big.Int, error) {
+	cpus, ok := new(big.Int).SetString(strings.ReplaceAll(strings.TrimSpace(mask), ",", ""), 16)
+	if !ok || cpus.Sign() < 0 {
+		return nil, fmt.Errorf("not a hexadecimal CPU mask")
+	}
+	return cpus, nil
+}
+
+// hostVeths returns the host side veths of the result: its interfaces
+// outside of a sandbox, which are veths, leaving out e.g. the bridge.
+func hostVeths(result *current.Result) ([]string, error) {
+	veths := []string{}
+	for _, iface := range result.Interfaces {
+		if iface.Sandbox != "" {
+			continue
+		}
+		link, err := netlink.LinkByName(iface.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find host interface %q: %v", iface.Name, err)
+		}
+		if link.Type() == "veth" {
+			veths = append(veths, iface.Name)
+		}
+	}
+	if len(veths) == 0 {
+		return nil, fmt.Errorf("steering needs a host side veth, prevResult names none")
+	}
+	return veths, nil
+}
+
+// steeringFiles returns the queue files of the device of a queue pattern,
+// failing if it has none, as when the kernel is built without XPS.
+func steeringFiles(dev, pattern string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(sysClassNet, dev, "queues", pattern))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s has no %s queue files, the kernel doesn't support this steering", dev, filepath.Base(pattern))
+	}
+	return files, nil
+}
+
+// applySteering writes the masks to the queues of the host side veths. It
+// must be called in the host's network namespace.
+func applySteering(s *SteeringConf, result *current.Result) error {
+	veths, err := hostVeths(result)
+	if err != nil {
+		return err
+	}
+	for _, dev := range veths {
+		for pattern, cpus := range s.masks() {
+			files, err := steeringFiles(dev, pattern)
+			if err != nil {
+				return err
+			}
+			mask := formatCPUMask(cpuMask(cpus))
+			for _, file := range files {
+				if err := os.WriteFile(file, []byte(mask), 0o644); err != nil {
+					return fmt.Errorf("failed to set %s to %s: %v", file, mask, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkSteering compares the masks of the queues of the host side veths to
+// the configured ones.
+func checkSteering(s *SteeringConf, result *current.Result) error {
+	veths, err := hostVeths(result)
+	if err != nil {
+		return err
+	}
+	for _, dev := range veths {
+		for pattern, cpus := range s.masks() {
+			want := cpuMask(cpus)
+			files, err := steeringFiles(dev, pattern)
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				data, err := os.ReadFile(file)
+				if err != nil {
+					return err
+				}
+				cur, err := parseCPUMask(string(data))
+				if err != nil {
+					return fmt.Errorf("failed to parse %s: %v", file, err)
+				}
+				if cur.Cmp(want) != 0 {
+					return fmt.Errorf("Error: Tuning configured CPU mask of %s is %s, current value is %s",
+						file, formatCPUMask(want), strings.TrimSpace(string(data)))
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tuning
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+)
+
+var congestionControlRegexp = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// TCPConf tunes TCP in the container's network namespace, e.g. bbr for
+// pods behind high latency satellite links, without granting them the
+// privileges to change it themselves.
+type TCPConf struct {
+	// CongestionControl is the default congestion control algorithm of the
+	// network namespace, e.g. "bbr" or "cubic". Its kernel module must be
+	// loaded or available to be loaded.
+	CongestionControl string `json:"congestionControl,omitempty"`
+	// RMem and WMem are the min, default and max sizes of the receive and
+	// send buffers of TCP sockets
+	RMem *TCPMem `json:"rmem,omitempty"`
+	WMem *TCPMem `json:"wmem,omitempty"`
+	// MTUProbing is 0 to disable packetization layer path MTU discovery,
+	// 1 to enable it once a black hole is detected and 2 to always enable it
+	MTUProbing *int `json:"mtuProbing,omitempty"`
+}
+
+// TCPMem holds the sizes of the TCP socket buffers, in bytes.
+type TCPMem struct {
+	Min     int `json:"min"`
+	Default int `json:"default"`
+	Max     int `json:"max"`
+}
+
+func (m *TCPMem) String() string {
+	return fmt.Sprintf("%d %d %d", m.Min, m.Default, m.Max)
+}
+
+func (m *TCPMem) validate(name string) error {
+	if m.Min <= 0 || m.Default < m.Min || m.Max < m.Default {
+		return fmt.Errorf("invalid tcp %s %q, must be positive and increasing", name, m.String())
+	}
+	return nil
+}
+
+func (t *TCPConf) validate() error {
+	if t.CongestionControl != "" && !congestionControlRegexp.MatchString(t.CongestionControl) {
+		return fmt.Errorf("invalid tcp congestionControl %q", t.CongestionControl)
+	}
+	if t.RMem != nil {
+		if err := t.RMem.validate("rmem"); err != nil {
+			return err
+		}
+	}
+	if t.WMem != nil {
+		if err := t.WMem.validate("wmem"); err != nil {
+			return err
+		}
+	}
+	if t.MTUProbing != nil && (*t.MTUProbing < 0 || *t.MTUProbing > 2) {
+		return fmt.Errorf("invalid tcp mtuProbing %d, must be 0, 1 or 2", *t.MTUProbing)
+	}
+	return nil
+}
+
+// tcpSysctls returns the sysctls of the container's network namespace the
+// TCP settings translate to.
+func tcpSysctls(t *TCPConf) map[string]string {
+	sysctls := map[string]string{}
+	if t == nil {
+		return sysctls
+	}
+	if t.CongestionControl != "" {
+		sysctls["net.ipv4.tcp_congestion_control"] = t.CongestionControl
+	}
+	if t.RMem != nil {
+		sysctls["net.ipv4.tcp_rmem"] = t.RMem.String()
+	}
+	if t.WMem != nil {
+		sysctls["net.ipv4.tcp_wmem"] = t.WMem.String()
+	}
+	if t.MTUProbing != nil {
+		sysctls["net.ipv4.tcp_mtu_probing"] = fmt.Sprint(*t.MTUProbing)
+	}
+	return sysctls
+}
+
+// mergeTCPSysctls adds the sysctls of the TCP settings to the configured
+// ones, refusing to override any of them.
+func mergeTCPSysctls(conf *TuningConf) error {
+	for key, value := range tcpSysctls(conf.TCP) {
+		if _, ok := conf.SysCtl[key]; ok {
+			return fmt.Errorf("sysctl %s is set both directly and by the tcp settings", key)
+		}
+		if conf.SysCtl == nil {
+			conf.SysCtl = map[string]string{}
+		}
+		conf.SysCtl[key] = value
+	}
+	return nil
+}
+
+// congestionControlAvailable reports whether the kernel has the congestion
+// control algorithm name, or can load its module when the sysctl is
+// written. It is a variable so tests don't depend on the host's kernel.
+var congestionControlAvailable = func(name string) (bool, error) {
+	available, err := sysctl.Sysctl("net.ipv4.tcp_available_congestion_control")
+	if err != nil {
+		return false, fmt.Errorf("failed to read the available tcp congestion control algorithms: %v", err)
+	}
+	for _, a := range strings.Fields(available) {
+		if a == name {
+			return true, nil
+		}
+	}
+
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return false, err
+	}
+	dir := filepath.Join("/lib/modules", unix.ByteSliceToString(uts.Release[:]), "kernel/net/ipv4")
+	matches, err := filepath.Glob(filepath.Join(dir, "tcp_"+name+".ko*"))
+	if err != nil {
+		return false, err
+	}
+	return len(matches) > 0, nil
+}
+
+// validateCongestionControl fails early for an algorithm the kernel doesn't
+// have, rather than with the EPERM or ENOENT of the sysctl.
+func validateCongestionControl(t *TCPConf) error {
+	if t == nil || t.CongestionControl == "" {
+		return nil
+	}
+	ok, err := congestionControlAvailable(t.CongestionControl)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("tcp congestion control %q is not available, the tcp_%s kernel module is neither loaded nor installed",
+			t.CongestionControl, t.CongestionControl)
+	}
+	return nil
+}
@@ -15,7 +15,7 @@
 // This is a "meta-plugin". It reads in its own netconf, it does not create
 // any network interface but just changes the network sysctl.
 
-package main
+package tuning
 
 import (
 	"encoding/json"
@@ -35,8 +35,13 @@ import (
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/cniargs"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/include"
 	"github.com/containernetworking/plugins/pkg/ns"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 )
 
 const (
@@ -55,10 +60,11 @@ type TuningConf struct {
 	Mtu      int               `json:"mtu,omitempty"`
 	TxQLen   *int              `json:"txQLen,omitempty"`
 	Allmulti *bool             `json:"allmulti,omitempty"`
+	Neighbor *NeighborConf     `json:"neighbor,omitempty"`
+	Route    *RouteConf        `json:"route,omitempty"`
+	TCP      *TCPConf          `json:"tcp,omitempty"`
+	Steering *SteeringConf     `json:"steering,omitempty"`
 
-	RuntimeConfig struct {
-		Mac string `json:"mac,omitempty"`
-	} `json:"runtimeConfig,omitempty"`
 	Args *struct {
 		A *IPAMArgs `json:"cni"`
 	} `json:"args"`
@@ -71,6 +77,7 @@ type IPAMArgs struct {
 	Mtu      *int               `json:"mtu,omitempty"`
 	Allmulti *bool              `json:"allmulti,omitempty"`
 	TxQLen   *int               `json:"txQLen,omitempty"`
+	TCP      *TCPConf           `json:"tcp,omitempty"`
 }
 
 // configToRestore will contain interface attributes that should be restored on cmdDel
@@ -80,16 +87,15 @@ type configToRestore struct {
 	Mtu      int    `json:"mtu,omitempty"`
 	Allmulti *bool  `json:"allmulti,omitempty"`
 	TxQLen   *int   `json:"txQLen,omitempty"`
-}
-
-// MacEnvArgs represents CNI_ARG
-type MacEnvArgs struct {
-	types.CommonArgs
-	MAC types.UnmarshallableString `json:"mac,omitempty"`
+	// SysCtl holds the sysctls changed, with their prior values
+	SysCtl []sysctl.Prior `json:"sysctl,omitempty"`
 }
 
 func parseConf(data []byte, envArgs string) (*TuningConf, error) {
 	conf := TuningConf{Promisc: false}
+	if err := config.Validate(data, &conf); err != nil {
+		return nil, fmt.Errorf("invalid network configuration: %v", err)
+	}
 	if err := json.Unmarshal(data, &conf); err != nil {
 		return nil, fmt.Errorf("failed to load netconf: %v", err)
 	}
@@ -98,22 +104,13 @@ func parseConf(data []byte, envArgs string) (*TuningConf, error) {
 		conf.DataDir = defaultDataDir
 	}
 
-	// Parse custom Mac from both env args
-	if envArgs != "" {
-		e := MacEnvArgs{}
-		err := types.LoadArgs(envArgs, &e)
-		if err != nil {
-			return nil, err
-		}
-
-		if e.MAC != "" {
-			conf.Mac = string(e.MAC)
-		}
+	// Parse custom Mac from env args and RuntimeConfig
+	a, err := cniargs.Parse(envArgs, data)
+	if err != nil {
+		return nil, err
 	}
-
-	// Parse custom Mac from RuntimeConfig
-	if conf.RuntimeConfig.Mac != "" {
-		conf.Mac = conf.RuntimeConfig.Mac
+	if mac := a.MAC(); mac != "" {
+		conf.Mac = mac
 	}
 
 	// Get args
@@ -143,6 +140,37 @@ func parseConf(data []byte, envArgs string) (*TuningConf, error) {
 		if conf.Args.A.TxQLen != nil {
 			conf.TxQLen = conf.Args.A.TxQLen
 		}
+
+		if conf.Args.A.TCP != nil {
+			conf.TCP = conf.Args.A.TCP
+		}
+	}
+
+	if conf.Neighbor != nil {
+		if err := conf.Neighbor.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if conf.Route != nil {
+		if err := conf.Route.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if conf.TCP != nil {
+		if err := conf.TCP.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if conf.Steering != nil {
+		if err := conf.Steering.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mergeTableSysctls(&conf); err != nil {
+		return nil, err
+	}
+	if err := mergeTCPSysctls(&conf); err != nil {
+		return nil, err
 	}
 
 	return &conf, nil
@@ -219,29 +247,37 @@ func changeTxQLen(ifName string, txQLen int) error {
 	return netlink.LinkSetTxQLen(link, txQLen)
 }
 
-func createBackup(ifName, containerID, backupPath string, tuningConf *TuningConf) error {
-	config := configToRestore{}
-	link, err := netlink.LinkByName(ifName)
-	if err != nil {
-		return fmt.Errorf("failed to get %q: %v", ifName, err)
-	}
-	if tuningConf.Mac != "" {
-		config.Mac = link.Attrs().HardwareAddr.String()
-	}
-	if tuningConf.Promisc {
-		config.Promisc = new(bool)
-		*config.Promisc = (link.Attrs().Promisc != 0)
-	}
-	if tuningConf.Mtu != 0 {
-		config.Mtu = link.Attrs().MTU
-	}
-	if tuningConf.Allmulti != nil {
-		config.Allmulti = new(bool)
-		*config.Allmulti = (link.Attrs().RawFlags&unix.IFF_ALLMULTI != 0)
-	}
-	if tuningConf.TxQLen != nil {
-		qlen := link.Attrs().TxQLen
-		config.TxQLen = &qlen
+// changesLink tells whether the configuration changes attributes of the
+// interface, which have to be restored along with the sysctls.
+func changesLink(tuningConf *TuningConf) bool {
+	return tuningConf.Mac != "" || tuningConf.Mtu != 0 || tuningConf.Promisc || tuningConf.Allmulti != nil || tuningConf.TxQLen != nil
+}
+
+func createBackup(ifName, containerID, backupPath string, tuningConf *TuningConf, sysctls []sysctl.Prior) error {
+	config := configToRestore{SysCtl: sysctls}
+	if changesLink(tuningConf) {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to get %q: %v", ifName, err)
+		}
+		if tuningConf.Mac != "" {
+			config.Mac = link.Attrs().HardwareAddr.String()
+		}
+		if tuningConf.Promisc {
+			config.Promisc = new(bool)
+			*config.Promisc = (link.Attrs().Promisc != 0)
+		}
+		if tuningConf.Mtu != 0 {
+			config.Mtu = link.Attrs().MTU
+		}
+		if tuningConf.Allmulti != nil {
+			config.Allmulti = new(bool)
+			*config.Allmulti = (link.Attrs().RawFlags&unix.IFF_ALLMULTI != 0)
+		}
+		if tuningConf.TxQLen != nil {
+			qlen := link.Attrs().TxQLen
+			config.TxQLen = &qlen
+		}
 	}
 
 	if _, err := os.Stat(backupPath); os.IsNotExist(err) {
@@ -281,9 +317,15 @@ func restoreBackup(ifName, containerID, backupPath string) error {
 
 	var errStr []string
 
-	_, err = netlink.LinkByName(ifName)
-	if err != nil {
-		return nil
+	if len(config.SysCtl) > 0 {
+		if err = sysctl.Restore(config.SysCtl); err != nil {
+			errStr = append(errStr, err.Error())
+		}
+	}
+
+	if _, err = netlink.LinkByName(ifName); err != nil {
+		// The interface is gone, and its attributes with it
+		config = configToRestore{}
 	}
 
 	if config.Mtu != 0 {
@@ -342,6 +384,14 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
+	if err = validateCongestionControl(tuningConf.TCP); err != nil {
+		return err
+	}
+
+	if err = validateSteeringCPUs(tuningConf.Steering); err != nil {
+		return err
+	}
+
 	if err = validateArgs(args); err != nil {
 		return err
 	}
@@ -355,25 +405,50 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
+	// The neighbor tables are shared by all network namespaces, their
+	// thresholds are only found in the host's.
+	if err := raiseGCThresholds(tuningConf.Neighbor); err != nil {
+		return err
+	}
+
+	// The host side veths are in the host's network namespace
+	if tuningConf.Steering != nil {
+		result, err := current.NewResultFromResult(tuningConf.PrevResult)
+		if err != nil {
+			return err
+		}
+		if err := applySteering(tuningConf.Steering, result); err != nil {
+			return err
+		}
+	}
+
 	// The directory /proc/sys/net is per network namespace. Enter in the
 	// network namespace before writing on it.
 
 	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		sysctls := map[string]string{}
 		for key, value := range tuningConf.SysCtl {
 			fileName, err := getSysctlFilename(key, args.IfName)
 			if err != nil {
 				return err
 			}
+			sysctls[strings.TrimPrefix(fileName, "/proc/sys/")] = value
+		}
 
-			content := []byte(value)
-			err = os.WriteFile(fileName, content, 0o644)
+		// Put the sysctls back if any of the other settings fails, so a
+		// retried ADD starts over from the same state
+		tx := sysctl.NewTx()
+		if err = tx.Apply(sysctls); err != nil {
+			return err
+		}
+		defer func() {
 			if err != nil {
-				return err
+				_ = tx.Rollback()
 			}
-		}
+		}()
 
-		if tuningConf.Mac != "" || tuningConf.Mtu != 0 || tuningConf.Promisc || tuningConf.Allmulti != nil || tuningConf.TxQLen != nil {
-			if err = createBackup(args.IfName, args.ContainerID, tuningConf.DataDir, tuningConf); err != nil {
+		if len(tx.Priors()) > 0 || changesLink(tuningConf) {
+			if err = createBackup(args.IfName, args.ContainerID, tuningConf.DataDir, tuningConf, tx.Priors()); err != nil {
 				return err
 			}
 		}
@@ -409,6 +484,12 @@ func cmdAdd(args *skel.CmdArgs) error {
 				return err
 			}
 		}
+
+		if tuningConf.Route != nil && tuningConf.Route.Metric != nil {
+			if err = changeRouteMetric(args.IfName, *tuningConf.Route.Metric); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 	if err != nil {
@@ -426,14 +507,15 @@ func cmdDel(args *skel.CmdArgs) error {
 	}
 
 	ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
-		// MAC address, MTU, promiscuous and all-multicast mode settings will be restored
+		// Sysctls, MAC address, MTU, promiscuous and all-multicast mode settings will be restored
 		return restoreBackup(args.IfName, args.ContainerID, tuningConf.DataDir)
 	})
 	return nil
 }
 
-func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("tuning"))
+// Main runs the tuning plugin.
+func Main() {
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}), version.All, bv.BuildString("tuning"))
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
@@ -454,11 +536,21 @@ func cmdCheck(args *skel.CmdArgs) error {
 		return err
 	}
 
-	_, err = current.NewResultFromResult(tuningConf.PrevResult)
+	result, err := current.NewResultFromResult(tuningConf.PrevResult)
 	if err != nil {
 		return err
 	}
 
+	if err := checkGCThresholds(tuningConf.Neighbor); err != nil {
+		return err
+	}
+
+	if tuningConf.Steering != nil {
+		if err := checkSteering(tuningConf.Steering, result); err != nil {
+			return err
+		}
+	}
+
 	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
 		// Check each configured value vs what's currently in the container
 		for key, confValue := range tuningConf.SysCtl {
@@ -472,7 +564,9 @@ func cmdCheck(args *skel.CmdArgs) error {
 				return err
 			}
 			curValue := strings.TrimSuffix(string(contents), "\n")
-			if confValue != curValue {
+			// the kernel reports multi-valued sysctls such as tcp_rmem
+			// tab separated
+			if strings.Join(strings.Fields(confValue), " ") != strings.Join(strings.Fields(curValue), " ") {
 				return fmt.Errorf("Error: Tuning configured value of %s is %s, current value is %s", fileName, confValue, curValue)
 			}
 		}
@@ -522,6 +616,12 @@ func cmdCheck(args *skel.CmdArgs) error {
 					args.IfName, tuningConf.TxQLen, link.Attrs().TxQLen)
 			}
 		}
+
+		if tuningConf.Route != nil && tuningConf.Route.Metric != nil {
+			if err := checkRouteMetric(args.IfName, *tuningConf.Route.Metric); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 	if err != nil {
@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package tuning
 
 import (
 	"encoding/json"
@@ -20,6 +20,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -1353,4 +1354,372 @@ var _ = Describe("tuning plugin", func() {
 		})
 
 	}
+
+	It("tunes the neighbor tables and route metrics with ADD and CHECK", func() {
+		conf := []byte(`{
+			"name": "test",
+			"type": "tuning",
+			"cniVersion": "1.0.0",
+			"neighbor": {
+				"gcThresh1": 1,
+				"baseReachableTimeMs": 60000,
+				"gcStaleTime": 120
+			},
+			"route": {
+				"metric": 100,
+				"ipv6MaxSize": 8192
+			},
+			"prevResult": {
+				"interfaces": [
+					{"name": "dummy0", "sandbox":"netns"}
+				],
+				"ips": [
+					{
+						"address": "10.0.0.2/24",
+						"interface": 0
+					}
+				]
+			}
+		}`)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       originalNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   conf,
+		}
+		readSysctl := func(key string) string {
+			data, err := os.ReadFile(filepath.Join("/proc/sys", strings.ReplaceAll(key, ".", "/")))
+			Expect(err).NotTo(HaveOccurred())
+			return strings.TrimSpace(string(data))
+		}
+		// the host wide threshold is never lowered
+		gcThresh1 := readSysctl("net.ipv4.neigh.default.gc_thresh1")
+
+		var link netlink.Link
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			var err error
+			link, err = netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+			addr, err := netlink.ParseAddr("10.0.0.2/24")
+			Expect(err).NotTo(HaveOccurred())
+			return netlink.AddrAdd(link, addr)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// the thresholds are only found in the host's network namespace,
+		// where runtimes call plugins
+		_, _, err = testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testutils.CmdCheckWithArgs(args, func() error {
+			return cmdCheck(args)
+		})).To(Succeed())
+		Expect(readSysctl("net.ipv4.neigh.default.gc_thresh1")).To(Equal(gcThresh1))
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(readSysctl("net.ipv4.neigh.dummy0.base_reachable_time_ms")).To(Equal("60000"))
+			Expect(readSysctl("net.ipv6.neigh.dummy0.base_reachable_time_ms")).To(Equal("60000"))
+			Expect(readSysctl("net.ipv4.neigh.dummy0.gc_stale_time")).To(Equal("120"))
+			Expect(readSysctl("net.ipv6.route.max_size")).To(Equal("8192"))
+
+			routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(HaveLen(1))
+			Expect(routes[0].Dst.String()).To(Equal("10.0.0.0/24"))
+			Expect(routes[0].Priority).To(Equal(100))
+
+			return netlink.RouteAdd(&netlink.Route{
+				LinkIndex: link.Attrs().Index,
+				Dst:       &net.IPNet{IP: net.IPv4(10, 1, 0, 0), Mask: net.CIDRMask(16, 32)},
+				Gw:        net.IPv4(10, 0, 0, 1),
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+		err = testutils.CmdCheckWithArgs(args, func() error {
+			return cmdCheck(args)
+		})
+		Expect(err).To(MatchError("Error: Tuning configured route metric of dummy0 is 100, route to 10.1.0.0/16 has 0"))
+	})
+
+	It("puts the sysctls back when ADD fails and on DEL", func() {
+		dataDir, err := os.MkdirTemp("", "tuning-test")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dataDir)
+
+		conf := func(mtu int) []byte {
+			return []byte(fmt.Sprintf(`{
+				"name": "test",
+				"type": "tuning",
+				"cniVersion": "1.0.0",
+				"dataDir": %q,
+				"mtu": %d,
+				"sysctl": {
+					"net.ipv4.conf.IFNAME.arp_notify": "1",
+					"net.ipv4.conf.IFNAME.arp_accept": "1"
+				},
+				"prevResult": {
+					"interfaces": [
+						{"name": "dummy0", "sandbox":"netns"}
+					],
+					"ips": [
+						{
+							"address": "10.0.0.2/24",
+							"interface": 0
+						}
+					]
+				}
+			}`, dataDir, mtu))
+		}
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       originalNS.Path(),
+			IfName:      IFNAME,
+		}
+		readSysctls := func() []string {
+			var values []string
+			_ = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				for _, key := range []string{"arp_notify", "arp_accept"} {
+					data, err := os.ReadFile(filepath.Join("/proc/sys/net/ipv4/conf", IFNAME, key))
+					Expect(err).NotTo(HaveOccurred())
+					values = append(values, strings.TrimSpace(string(data)))
+				}
+				return nil
+			})
+			return values
+		}
+		Expect(readSysctls()).To(Equal([]string{"0", "0"}))
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			// an MTU the interface can't take fails after the sysctls
+			args.StdinData = conf(1 << 20)
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(readSysctls()).To(Equal([]string{"0", "0"}))
+
+			args.StdinData = conf(1400)
+			sysctlDuplicatesMap = map[sysctlKey]interface{}{}
+			_, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(readSysctls()).To(Equal([]string{"1", "1"}))
+
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+			Expect(readSysctls()).To(Equal([]string{"0", "0"}))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+var _ = Describe("tuning neighbor and route config", func() {
+	parse := func(settings string) (*TuningConf, error) {
+		return parseConf([]byte(fmt.Sprintf(`{
+			"name": "test",
+			"type": "tuning",
+			"cniVersion": "1.0.0",
+			%s
+		}`, settings)), "")
+	}
+
+	It("translates to sysctls of the container's interface", func() {
+		conf, err := parse(`"neighbor": {"unresQLen": 512}, "route": {"ipv6GCThresh": 2048}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.SysCtl).To(Equal(map[string]string{
+			"net.ipv4.neigh.IFNAME.unres_qlen": "512",
+			"net.ipv6.neigh.IFNAME.unres_qlen": "512",
+			"net.ipv6.route.gc_thresh":         "2048",
+		}))
+	})
+
+	It("rejects invalid settings", func() {
+		_, err := parse(`"neighbor": {"gcThresh1": 2048, "gcThresh3": 1024}`)
+		Expect(err).To(MatchError("neighbor gcThresh1, gcThresh2 and gcThresh3 must be increasing"))
+		_, err = parse(`"neighbor": {"gcStaleTime": 0}`)
+		Expect(err).To(MatchError("invalid neighbor gcStaleTime 0, must be positive"))
+		_, err = parse(`"route": {"metric": -1}`)
+		Expect(err).To(MatchError("invalid route metric -1"))
+		_, err = parse(`"sysctl": {"net.ipv6.route.max_size": "1"}, "route": {"ipv6MaxSize": 8192}`)
+		Expect(err).To(MatchError("sysctl net.ipv6.route.max_size is set both directly and by the neighbor or route settings"))
+	})
+})
+
+var _ = Describe("tuning tcp config", func() {
+	parse := func(settings string) (*TuningConf, error) {
+		return parseConf([]byte(fmt.Sprintf(`{
+			"name": "test",
+			"type": "tuning",
+			"cniVersion": "1.0.0",
+			%s
+		}`, settings)), "")
+	}
+
+	It("translates to sysctls of the container's network namespace", func() {
+		conf, err := parse(`"tcp": {
+			"congestionControl": "bbr",
+			"rmem": {"min": 4096, "default": 131072, "max": 16777216},
+			"mtuProbing": 1
+		}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.SysCtl).To(Equal(map[string]string{
+			"net.ipv4.tcp_congestion_control": "bbr",
+			"net.ipv4.tcp_rmem":               "4096 131072 16777216",
+			"net.ipv4.tcp_mtu_probing":        "1",
+		}))
+	})
+
+	It("rejects invalid settings", func() {
+		_, err := parse(`"tcp": {"congestionControl": "../bbr"}`)
+		Expect(err).To(MatchError(`invalid tcp congestionControl "../bbr"`))
+		_, err = parse(`"tcp": {"wmem": {"min": 4096, "default": 1024, "max": 8192}}`)
+		Expect(err).To(MatchError(`invalid tcp wmem "4096 1024 8192", must be positive and increasing`))
+		_, err = parse(`"tcp": {"mtuProbing": 3}`)
+		Expect(err).To(MatchError("invalid tcp mtuProbing 3, must be 0, 1 or 2"))
+		_, err = parse(`"sysctl": {"net.ipv4.tcp_mtu_probing": "2"}, "tcp": {"mtuProbing": 1}`)
+		Expect(err).To(MatchError("sysctl net.ipv4.tcp_mtu_probing is set both directly and by the tcp settings"))
+	})
+
+	It("requires the congestion control algorithm to be available", func() {
+		defer func(f func(string) (bool, error)) { congestionControlAvailable = f }(congestionControlAvailable)
+		congestionControlAvailable = func(name string) (bool, error) {
+			return name == "cubic", nil
+		}
+
+		Expect(validateCongestionControl(&TCPConf{CongestionControl: "cubic"})).To(Succeed())
+		Expect(validateCongestionControl(&TCPConf{CongestionControl: "bbr"})).To(MatchError(
+			`tcp congestion control "bbr" is not available, the tcp_bbr kernel module is neither loaded nor installed`))
+	})
+})
+
+var _ = Describe("tuning steering", func() {
+	parse := func(settings string) (*TuningConf, error) {
+		return parseConf([]byte(fmt.Sprintf(`{
+			"name": "test",
+			"type": "tuning",
+			"cniVersion": "1.0.0",
+			%s
+		}`, settings)), "")
+	}
+
+	It("rejects invalid cpusets and CPUs which aren't online", func() {
+		_, err := parse(`"steering": {"rpsCpus": "3-1"}`)
+		Expect(err).To(MatchError(`invalid steering rpsCpus "3-1": invalid CPU range "3-1"`))
+		_, err = parse(`"steering": {"xpsCpus": "f"}`)
+		Expect(err).To(MatchError(`invalid steering xpsCpus "f": invalid CPU "f"`))
+
+		defer func(f func() (map[int]bool, error)) { onlineCPUs = f }(onlineCPUs)
+		onlineCPUs = func() (map[int]bool, error) {
+			return map[int]bool{0: true, 1: true, 2: true, 3: true}, nil
+		}
+		conf, err := parse(`"steering": {"rpsCpus": "0-3", "xpsCpus": "2,4-5"}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validateSteeringCPUs(conf.Steering)).To(MatchError("invalid steering xpsCpus: CPUs [4 5] are not online"))
+		conf.Steering.XPSCPUs, conf.Steering.xps = "", nil
+		Expect(validateSteeringCPUs(conf.Steering)).To(Succeed())
+	})
+
+	It("writes CPU masks as the kernel does", func() {
+		Expect(formatCPUMask(cpuMask([]int{0, 1, 2, 3}))).To(Equal("0000000f"))
+		Expect(formatCPUMask(cpuMask([]int{32, 33, 34, 35, 36, 37, 38, 39}))).To(Equal("000000ff,00000000"))
+		mask, err := parseCPUMask("000000ff,00000000")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mask.Cmp(cpuMask([]int{32, 33, 34, 35, 36, 37, 38, 39}))).To(Equal(0))
+	})
+
+	It("steers the queues of the host side veth with ADD and checks them with CHECK", func() {
+		hostNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer func() {
+			Expect(hostNS.Close()).To(Succeed())
+			Expect(testutils.UnmountNS(hostNS)).To(Succeed())
+		}()
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer func() {
+			Expect(targetNS.Close()).To(Succeed())
+			Expect(testutils.UnmountNS(targetNS)).To(Succeed())
+		}()
+
+		// the test's sysfs doesn't show the links of hostNS
+		defer func(dir string) { sysClassNet = dir }(sysClassNet)
+		sysClassNet = GinkgoT().TempDir()
+		queueFile := func(queue, name string) string {
+			return filepath.Join(sysClassNet, "veth1234", "queues", queue, name)
+		}
+		for _, file := range []string{queueFile("rx-0", "rps_cpus"), queueFile("tx-0", "xps_cpus")} {
+			Expect(os.MkdirAll(filepath.Dir(file), 0o755)).To(Succeed())
+			Expect(os.WriteFile(file, []byte("00000000\n"), 0o644)).To(Succeed())
+		}
+
+		conf := `{
+			"name": "test",
+			"type": "tuning",
+			"cniVersion": "1.0.0",
+			"steering": {"rpsCpus": "0", "xpsCpus": "0"},
+			"prevResult": {
+				"cniVersion": "1.0.0",
+				"interfaces": [
+					{"name": "br0"},
+					{"name": "veth1234"},
+					{"name": "eth0", "sandbox": "/var/run/netns/test"}
+				]
+			}
+		}`
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      "eth0",
+			StdinData:   []byte(conf),
+		}
+
+		err = hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}})).To(Succeed())
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs:     netlink.LinkAttrs{Name: "veth1234"},
+				PeerName:      "eth0",
+				PeerNamespace: netlink.NsFd(int(targetNS.Fd())),
+			})).To(Succeed())
+
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.ReadFile(queueFile("rx-0", "rps_cpus"))).To(BeEquivalentTo("00000001"))
+			Expect(os.ReadFile(queueFile("tx-0", "xps_cpus"))).To(BeEquivalentTo("00000001"))
+
+			Expect(testutils.CmdCheckWithArgs(args, func() error {
+				return cmdCheck(args)
+			})).To(Succeed())
+
+			Expect(os.WriteFile(queueFile("rx-0", "rps_cpus"), []byte("00000000\n"), 0o644)).To(Succeed())
+			Expect(testutils.CmdCheckWithArgs(args, func() error {
+				return cmdCheck(args)
+			})).To(MatchError(fmt.Sprintf("Error: Tuning configured CPU mask of %s is 00000001, current value is 00000000",
+				queueFile("rx-0", "rps_cpus"))))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("requires a host side veth in prevResult", func() {
+		conf := &SteeringConf{RPSCPUs: "0"}
+		Expect(conf.validate()).To(Succeed())
+		result := &types100.Result{Interfaces: []*types100.Interface{{Name: "eth0", Sandbox: "/var/run/netns/test"}}}
+		Expect(applySteering(conf, result)).To(MatchError("steering needs a host side veth, prevResult names none"))
+	})
 })
@@ -0,0 +1,196 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vrf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/gc"
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+const defaultDataDir = "/run/cni/vrf"
+
+// attachmentState records the VRF an ADD enslaved an interface to, so GC
+// can find the VRFs of attachments whose DEL never came, e.g. in the
+// namespaces of long-lived pods.
+type attachmentState struct {
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifName"`
+	Netns       string `json:"netns"`
+	VRFName     string `json:"vrfName"`
+	Table       uint32 `json:"table"`
+}
+
+func statePath(conf *VRFNetConf, containerID, ifName string) string {
+	return filepath.Join(conf.DataDir, conf.Name, containerID+"-"+ifName+".json")
+}
+
+func readState(path string) (*attachmentState, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &attachmentState{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse state %q: %v", path, err)
+	}
+	return s, nil
+}
+
+func writeState(conf *VRFNetConf, s *attachmentState) error {
+	path := statePath(conf, s.ContainerID, s.IfName)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create state dir: %v", err)
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+func deleteState(conf *VRFNetConf, containerID, ifName string) error {
+	if err := os.Remove(statePath(conf, containerID, ifName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// releaseInterface takes the interface out of the VRF, if it is still in
+// it, and deletes the VRF, its routes and rules once no interface is left
+// in it. It runs in the namespace of the VRF.
+func releaseInterface(vrf *netlink.Vrf, ifName string) error {
+	if link, err := netlink.LinkByName(ifName); err == nil && link.Attrs().MasterIndex == vrf.Index {
+		if err := resetMaster(ifName); err != nil {
+			return err
+		}
+	}
+
+	interfaces, err := assignedInterfaces(vrf)
+	if err != nil {
+		return err
+	}
+	if len(interfaces) > 0 {
+		return nil
+	}
+	if err := netlink.LinkDel(vrf); err != nil {
+		return err
+	}
+	return flushTable(vrf.Table)
+}
+
+// flushTable deletes the routes and rules left behind in the routing table
+// of a deleted VRF.
+func flushTable(table uint32) error {
+	var errs []error
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: int(table)}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return fmt.Errorf("failed to list routes of table %d: %v", table, err)
+	}
+	for i := range routes {
+		if err := netlink.RouteDel(&routes[i]); err != nil && !errors.Is(err, syscall.ESRCH) {
+			errs = append(errs, fmt.Errorf("failed to delete route to %s from table %d: %v", routes[i].Dst, table, err))
+		}
+	}
+	rules, err := netlink.RuleListFiltered(netlink.FAMILY_ALL, &netlink.Rule{Table: int(table)}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return fmt.Errorf("failed to list rules of table %d: %v", table, err)
+	}
+	for i := range rules {
+		if err := netlink.RuleDel(&rules[i]); err != nil && !errors.Is(err, syscall.ENOENT) {
+			errs = append(errs, fmt.Errorf("failed to delete rule to table %d: %v", table, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// removeState releases the interface of the attachment from its VRF, if
+// the namespace and the VRF are still there, and removes the state.
+func removeState(conf *VRFNetConf, a types.GCAttachment) error {
+	path := statePath(conf, a.ContainerID, a.IfName)
+	s, err := readState(path)
+	if err != nil || s == nil {
+		return err
+	}
+	if s.Netns != "" {
+		err := ns.WithNetNSPath(s.Netns, func(_ ns.NetNS) error {
+			vrf, err := findVRF(s.VRFName)
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			// the name may have been taken by another VRF since
+			if s.Table != 0 && vrf.Table != s.Table {
+				return nil
+			}
+			return releaseInterface(vrf, s.IfName)
+		})
+		if _, ok := err.(ns.NSPathNotExistErr); !ok && err != nil {
+			return err
+		}
+	}
+	return deleteState(conf, a.ContainerID, a.IfName)
+}
+
+func listAttachments(conf *VRFNetConf) ([]types.GCAttachment, error) {
+	paths, err := filepath.Glob(filepath.Join(conf.DataDir, conf.Name, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var attachments []types.GCAttachment
+	for _, path := range paths {
+		s, err := readState(path)
+		if err != nil {
+			return nil, err
+		}
+		if s != nil {
+			attachments = append(attachments, types.GCAttachment{ContainerID: s.ContainerID, IfName: s.IfName})
+		}
+	}
+	return attachments, nil
+}
+
+// cmdGC releases the interfaces of the attachments the runtime no longer
+// lists from their VRFs, deleting the VRFs left without interfaces.
+func cmdGC(args *skel.CmdArgs) error {
+	conf, _, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	valid, err := gc.ValidAttachments(args.StdinData)
+	if err != nil {
+		return err
+	}
+	return gc.Collect(valid, func() ([]types.GCAttachment, error) {
+		return listAttachments(conf)
+	}, func(a types.GCAttachment) error {
+		return removeState(conf, a)
+	})
+}
@@ -12,12 +12,13 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package vrf
 
 import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"path/filepath"
 	"strings"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -782,6 +783,85 @@ var _ = Describe("vrf plugin", func() {
 		})
 	})
 
+	It("checks the table of the VRF and releases stale attachments on GC", func() {
+		dataDir := GinkgoT().TempDir()
+		confFor := func(table int, extra string) []byte {
+			return []byte(fmt.Sprintf(`{
+				"name": "test",
+				"type": "vrf",
+				"cniVersion": "1.1.0",
+				"vrfName": "%s",
+				"table": %d,
+				"dataDir": "%s"%s
+			}`, VRF0Name, table, dataDir, extra))
+		}
+		prevResult := func(intf string) string {
+			return fmt.Sprintf(`,
+				"prevResult": {
+					"interfaces": [{"name": "%s", "sandbox": "netns"}],
+					"ips": [{"address": "10.0.0.2/24", "gateway": "10.0.0.1", "interface": 0}]
+				}`, intf)
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			for id, intf := range map[string]string{"first": IF0Name, "second": IF1Name} {
+				args := &skel.CmdArgs{ContainerID: id, Netns: targetNS.Path(), IfName: intf, StdinData: confFor(0, prevResult(intf))}
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			// the table given to the VRF is checked, unless one is configured
+			args := &skel.CmdArgs{ContainerID: "first", Netns: targetNS.Path(), IfName: IF0Name, StdinData: confFor(0, prevResult(IF0Name))}
+			Expect(testutils.CmdCheckWithArgs(args, func() error {
+				return cmdCheck(args)
+			})).To(Succeed())
+			args.StdinData = confFor(100, prevResult(IF0Name))
+			Expect(testutils.CmdCheckWithArgs(args, func() error {
+				return cmdCheck(args)
+			})).To(MatchError(ContainSubstring("vrf vrf0 has routing table 1 instead of 100")))
+
+			gcArgs := &skel.CmdArgs{StdinData: confFor(0, `,
+				"cni.dev/valid-attachments": [{"containerID": "second", "ifname": "dummy1"}]`)}
+			Expect(cmdGC(gcArgs)).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			checkInterfaceOnVRF(VRF0Name, IF1Name)
+			link, err := netlink.LinkByName(IF0Name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().MasterIndex).To(BeZero())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			gcArgs := &skel.CmdArgs{StdinData: confFor(0, `,
+				"cni.dev/valid-attachments": []`)}
+			Expect(cmdGC(gcArgs)).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, err := netlink.LinkByName(VRF0Name)
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		states, err := filepath.Glob(filepath.Join(dataDir, "test", "*.json"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(states).To(BeEmpty())
+	})
+
 	It("configures and deconfigures VRF with CNI 0.4.0 ADD/DEL", func() {
 		conf := []byte(fmt.Sprintf(`{
 	"name": "test",
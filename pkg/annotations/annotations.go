@@ -0,0 +1,127 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package annotations passes metadata about the addresses of an attachment
+// down a plugin chain, e.g. the range an address was allocated from, for
+// firewalling or shaping by range later in the chain. CNI results have no
+// room for it, and runtimes drop the keys they don't know from a result
+// before passing it on as the prevResult. So the IPAM plugin records it per
+// attachment instead, and later plugins of the chain read it from there.
+package annotations
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// DefaultDir is the directory the annotations are kept in, unless a plugin
+// is configured with another one.
+const DefaultDir = "/run/cni/annotations"
+
+// Address is the metadata of an address of the result.
+type Address struct {
+	// IP is the address, as in the result, without its prefix
+	IP string `json:"ip"`
+	// RangeIndex is the index of the range set of the IPAM configuration
+	// the address was allocated from
+	RangeIndex int `json:"rangeIndex"`
+	// Pool is the name of the range the address was allocated from, if
+	// the range has one
+	Pool string `json:"pool,omitempty"`
+	// LeaseID identifies the sticky lease keeping the address for a pod
+	// across its containers, as "namespace/name", if it has one
+	LeaseID string `json:"leaseID,omitempty"`
+	// Hostname is the name of the address, if the IPAM plugin names
+	// addresses
+	Hostname string `json:"hostname,omitempty"`
+	// Expires is when the lease on the address expires, in RFC 3339, if
+	// the IPAM plugin gives leases a lifetime
+	Expires string `json:"expires,omitempty"`
+}
+
+// Annotations are the metadata of the addresses of an attachment.
+type Annotations struct {
+	Addresses []Address `json:"addresses,omitempty"`
+}
+
+// Lookup returns the metadata of ip, or nil if there is none.
+func (a *Annotations) Lookup(ip net.IP) *Address {
+	for i := range a.Addresses {
+		if addr := net.ParseIP(a.Addresses[i].IP); addr != nil && addr.Equal(ip) {
+			return &a.Addresses[i]
+		}
+	}
+	return nil
+}
+
+// Path returns the file the annotations of an attachment of the network are
+// kept in, in dir or DefaultDir.
+func Path(dir, network, containerID, ifName string) string {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return filepath.Join(dir, network, containerID+"-"+ifName+".json")
+}
+
+// Write records the annotations of an attachment, replacing any recorded
+// before. Readers never see a partial file.
+func Write(dir, network, containerID, ifName string, a *Annotations) error {
+	path := Path(dir, network, containerID, ifName)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create annotations dir: %v", err)
+	}
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write annotations: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to write annotations: %v", err)
+	}
+	return nil
+}
+
+// Read returns the annotations of an attachment, or nil if none are
+// recorded.
+func Read(dir, network, containerID, ifName string) (*Annotations, error) {
+	path := Path(dir, network, containerID, ifName)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	a := &Annotations{}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, fmt.Errorf("failed to parse annotations %q: %v", path, err)
+	}
+	return a, nil
+}
+
+// Remove removes the annotations of an attachment, if any are recorded.
+func Remove(dir, network, containerID, ifName string) error {
+	err := os.Remove(Path(dir, network, containerID, ifName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package annotations_test
+
+import (
+	"net"
+	"os"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/containernetworking/plugins/pkg/annotations"
+)
+
+var _ = Describe("annotations", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "annotations")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("records, looks up and removes the annotations of an attachment", func() {
+		a, err := annotations.Read(dir, "mynet", "c1", "eth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a).To(BeNil())
+
+		Expect(annotations.Write(dir, "mynet", "c1", "eth0", &annotations.Annotations{
+			Addresses: []annotations.Address{
+				{IP: "10.1.2.3", RangeIndex: 0, Pool: "blue", LeaseID: "default/web"},
+				{IP: "2001:db8::3", RangeIndex: 1},
+			},
+		})).To(Succeed())
+
+		a, err = annotations.Read(dir, "mynet", "c1", "eth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a.Lookup(net.ParseIP("10.1.2.3"))).To(Equal(&annotations.Address{IP: "10.1.2.3", Pool: "blue", LeaseID: "default/web"}))
+		Expect(a.Lookup(net.ParseIP("2001:0db8::3")).RangeIndex).To(Equal(1))
+		Expect(a.Lookup(net.ParseIP("10.1.2.4"))).To(BeNil())
+
+		Expect(annotations.Remove(dir, "mynet", "c1", "eth0")).To(Succeed())
+		Expect(annotations.Remove(dir, "mynet", "c1", "eth0")).To(Succeed())
+		a, err = annotations.Read(dir, "mynet", "c1", "eth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a).To(BeNil())
+	})
+})
@@ -0,0 +1,249 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cniargs parses the per-attachment arguments a runtime passes to a
+// plugin: the CNI_ARGS environment variable, the "args" section and the
+// "runtimeConfig" capability arguments of the network configuration. All
+// plugins use it, so they agree on how these are parsed.
+package cniargs
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+)
+
+// Well-known keys of CNI_ARGS.
+const (
+	KeyIgnoreUnknown       = "IgnoreUnknown"
+	KeyPodNamespace        = "K8S_POD_NAMESPACE"
+	KeyPodName             = "K8S_POD_NAME"
+	KeyPodUID              = "K8S_POD_UID"
+	KeyPodInfraContainerID = "K8S_POD_INFRA_CONTAINER_ID"
+	KeyIP                  = "IP"
+	KeyMAC                 = "MAC"
+	// KeyVLAN and KeyParent are the VLAN and the parent interface of the
+	// attachment, passed to IPAM plugins by main plugins, see
+	// ipam.ExecAddOn
+	KeyVLAN   = "VLAN"
+	KeyParent = "PARENT"
+)
+
+var wellKnownKeys = map[string]bool{
+	KeyIgnoreUnknown:       true,
+	KeyPodNamespace:        true,
+	KeyPodName:             true,
+	KeyPodUID:              true,
+	KeyPodInfraContainerID: true,
+	KeyIP:                  true,
+	KeyMAC:                 true,
+	KeyVLAN:                true,
+	KeyParent:              true,
+}
+
+// BandwidthEntry is the "bandwidth" capability argument.
+type BandwidthEntry struct {
+	IngressRate  uint64 `json:"ingressRate"`  // Bandwidth rate in bps for traffic through container. 0 for no limit. If ingressRate is set, ingressBurst must also be set
+	IngressBurst uint64 `json:"ingressBurst"` // Bandwidth burst in bits for traffic through container. 0 for no limit. If ingressBurst is set, ingressRate must also be set
+
+	EgressRate  uint64 `json:"egressRate"`  // Bandwidth rate in bps for traffic through container. 0 for no limit. If egressRate is set, egressBurst must also be set
+	EgressBurst uint64 `json:"egressBurst"` // Bandwidth burst in bits for traffic through container. 0 for no limit. If egressBurst is set, egressRate must also be set
+}
+
+// IsZero returns true if no limit is set.
+func (bw *BandwidthEntry) IsZero() bool {
+	return bw.IngressBurst == 0 && bw.IngressRate == 0 && bw.EgressBurst == 0 && bw.EgressRate == 0
+}
+
+// PortMapping is a single entry of the "portMappings" capability argument.
+// HostInterface binds the mapping to the addresses of a host interface
+// instead of a fixed HostIP. SourceCIDRs, if set, restricts the mapping to
+// clients from these networks.
+type PortMapping struct {
+	HostPort      int      `json:"hostPort"`
+	ContainerPort int      `json:"containerPort"`
+	Protocol      string   `json:"protocol"`
+	HostIP        string   `json:"hostIP,omitempty"`
+	HostInterface string   `json:"hostInterface,omitempty"`
+	SourceCIDRs   []string `json:"sourceCIDRs,omitempty"`
+}
+
+// DNS is the "dns" capability argument.
+type DNS struct {
+	Servers  []string `json:"servers,omitempty"`
+	Searches []string `json:"searches,omitempty"`
+	Options  []string `json:"options,omitempty"`
+}
+
+// RuntimeConfig holds the well-known capability arguments of the
+// "runtimeConfig" section.
+type RuntimeConfig struct {
+	IPs          []*ip.IP        `json:"ips,omitempty"`
+	MAC          string          `json:"mac,omitempty"`
+	Bandwidth    *BandwidthEntry `json:"bandwidth,omitempty"`
+	PortMappings []PortMapping   `json:"portMappings,omitempty"`
+	DNS          *DNS            `json:"dns,omitempty"`
+}
+
+// Args are the arguments of one invocation. The IPs and MAC are kept per
+// source, as plugins differ in how they combine them; IPs() and MAC()
+// implement the common rules.
+type Args struct {
+	PodNamespace        string
+	PodName             string
+	PodUID              string
+	PodInfraContainerID string
+
+	// VLAN and Parent are those of the attachment, 0 and "" if unknown
+	VLAN   int
+	Parent string
+
+	// Env holds all CNI_ARGS pairs, including the ones parsed below
+	Env map[string]string
+	// EnvIPs is the comma separated IP key of CNI_ARGS
+	EnvIPs []*ip.IP
+	EnvMAC string
+
+	// ConfigIPs and ConfigMAC are from the "args": {"cni": {}} section
+	ConfigIPs []*ip.IP
+	ConfigMAC string
+
+	RuntimeConfig RuntimeConfig
+}
+
+type netConfArgs struct {
+	Args *struct {
+		CNI *struct {
+			IPs []*ip.IP `json:"ips,omitempty"`
+			MAC string   `json:"mac,omitempty"`
+		} `json:"cni,omitempty"`
+	} `json:"args,omitempty"`
+	RuntimeConfig RuntimeConfig `json:"runtimeConfig,omitempty"`
+	StrictConfig  bool          `json:"strictConfig,omitempty"`
+}
+
+// ParseEnv splits CNI_ARGS into its key-value pairs. Pairs are separated by
+// ";" and split at the first "=", so values may contain "=". Empty pairs,
+// e.g. from a trailing ";", are skipped.
+func ParseEnv(envArgs string) (map[string]string, error) {
+	env := map[string]string{}
+	for _, pair := range strings.Split(envArgs, ";") {
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("ARGS: invalid pair %q", pair)
+		}
+		env[key] = value
+	}
+	return env, nil
+}
+
+// Parse parses CNI_ARGS and the network configuration in stdin. CNI_ARGS
+// keys other than the well-known ones and extraKeys are ignored, like the
+// unknown keys of the configuration. If it sets "strictConfig", they are
+// rejected unless IgnoreUnknown is set, as the CNI conventions require.
+func Parse(envArgs string, stdin []byte, extraKeys ...string) (*Args, error) {
+	env, err := ParseEnv(envArgs)
+	if err != nil {
+		return nil, err
+	}
+	conf := netConfArgs{}
+	if len(stdin) > 0 {
+		if err := json.Unmarshal(stdin, &conf); err != nil {
+			return nil, fmt.Errorf("failed to parse args: %v", err)
+		}
+	}
+
+	known := map[string]bool{}
+	for _, k := range extraKeys {
+		known[k] = true
+	}
+	ignoreUnknown := false
+	switch strings.ToLower(env[KeyIgnoreUnknown]) {
+	case "", "0", "false":
+	case "1", "true":
+		ignoreUnknown = true
+	default:
+		return nil, fmt.Errorf("ARGS: error parsing value of pair %q: invalid boolean", KeyIgnoreUnknown+"="+env[KeyIgnoreUnknown])
+	}
+	unknown := []string{}
+	for _, pair := range strings.Split(envArgs, ";") {
+		key, _, _ := strings.Cut(pair, "=")
+		if key != "" && !wellKnownKeys[key] && !known[key] {
+			unknown = append(unknown, pair)
+		}
+	}
+	if len(unknown) > 0 && conf.StrictConfig && !ignoreUnknown {
+		return nil, fmt.Errorf("ARGS: unknown args %q", unknown)
+	}
+
+	a := &Args{
+		PodNamespace:        env[KeyPodNamespace],
+		PodName:             env[KeyPodName],
+		PodUID:              env[KeyPodUID],
+		PodInfraContainerID: env[KeyPodInfraContainerID],
+		Env:                 env,
+		EnvMAC:              env[KeyMAC],
+		Parent:              env[KeyParent],
+	}
+	if v := env[KeyVLAN]; v != "" {
+		if a.VLAN, err = strconv.Atoi(v); err != nil || a.VLAN < 0 || a.VLAN > 4094 {
+			return nil, fmt.Errorf("ARGS: invalid VLAN %q", v)
+		}
+	}
+	if ips := env[KeyIP]; ips != "" {
+		for _, s := range strings.Split(ips, ",") {
+			addr := ip.ParseIP(strings.TrimSpace(s))
+			if addr == nil {
+				return nil, fmt.Errorf("ARGS: invalid IP %q", s)
+			}
+			a.EnvIPs = append(a.EnvIPs, addr)
+		}
+	}
+
+	if conf.Args != nil && conf.Args.CNI != nil {
+		a.ConfigIPs = conf.Args.CNI.IPs
+		a.ConfigMAC = conf.Args.CNI.MAC
+	}
+	a.RuntimeConfig = conf.RuntimeConfig
+
+	return a, nil
+}
+
+// IPs returns every requested IP: the ones from CNI_ARGS, followed by the
+// ones from the args section and the runtimeConfig.
+func (a *Args) IPs() []*ip.IP {
+	var ips []*ip.IP
+	ips = append(ips, a.EnvIPs...)
+	ips = append(ips, a.ConfigIPs...)
+	ips = append(ips, a.RuntimeConfig.IPs...)
+	return ips
+}
+
+// MAC returns the requested MAC address. The runtimeConfig takes precedence
+// over the args section, which takes precedence over CNI_ARGS.
+func (a *Args) MAC() string {
+	switch {
+	case a.RuntimeConfig.MAC != "":
+		return a.RuntimeConfig.MAC
+	case a.ConfigMAC != "":
+		return a.ConfigMAC
+	}
+	return a.EnvMAC
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cniargs_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/containernetworking/plugins/pkg/cniargs"
+	"github.com/containernetworking/plugins/pkg/ip"
+)
+
+var _ = Describe("ParseEnv", func() {
+	It("splits pairs at the first equal sign", func() {
+		env, err := cniargs.ParseEnv("K8S_POD_NAME=pod;X=a=b;")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(env).To(Equal(map[string]string{"K8S_POD_NAME": "pod", "X": "a=b"}))
+	})
+
+	It("rejects pairs without a value", func() {
+		_, err := cniargs.ParseEnv("K8S_POD_NAME=pod;foo")
+		Expect(err).To(MatchError(`ARGS: invalid pair "foo"`))
+	})
+})
+
+var _ = Describe("Parse", func() {
+	It("parses the pod and the requested IPs from CNI_ARGS", func() {
+		a, err := cniargs.Parse("K8S_POD_NAMESPACE=ns;K8S_POD_NAME=pod;K8S_POD_UID=1234;IP=10.0.0.2,10.0.1.2/24", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a.PodNamespace).To(Equal("ns"))
+		Expect(a.PodName).To(Equal("pod"))
+		Expect(a.PodUID).To(Equal("1234"))
+		Expect(a.EnvIPs).To(Equal([]*ip.IP{ip.ParseIP("10.0.0.2"), ip.ParseIP("10.0.1.2/24")}))
+	})
+
+	It("parses the VLAN and the parent interface of the attachment", func() {
+		a, err := cniargs.Parse("VLAN=20;PARENT=eth1", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a.VLAN).To(Equal(20))
+		Expect(a.Parent).To(Equal("eth1"))
+
+		_, err = cniargs.Parse("VLAN=4095", nil)
+		Expect(err).To(MatchError(`ARGS: invalid VLAN "4095"`))
+	})
+
+	It("ignores unknown keys unless the configuration is strict", func() {
+		a, err := cniargs.Parse("FOO=bar", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a.Env).To(HaveKeyWithValue("FOO", "bar"))
+
+		strict := []byte(`{"strictConfig": true}`)
+		_, err = cniargs.Parse("FOO=bar", strict)
+		Expect(err).To(MatchError(`ARGS: unknown args ["FOO=bar"]`))
+
+		a, err = cniargs.Parse("IgnoreUnknown=true;FOO=bar", strict)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a.Env).To(HaveKeyWithValue("FOO", "bar"))
+
+		a, err = cniargs.Parse("FOO=bar", strict, "FOO")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a.Env).To(HaveKeyWithValue("FOO", "bar"))
+	})
+
+	It("rejects invalid IPs", func() {
+		_, err := cniargs.Parse("IP=10.0.0.2,foo", nil)
+		Expect(err).To(MatchError(`ARGS: invalid IP "foo"`))
+	})
+
+	It("parses args and runtimeConfig of the network configuration", func() {
+		conf := `{
+			"cniVersion": "1.0.0",
+			"name": "test",
+			"type": "bridge",
+			"args": {"cni": {"ips": ["10.0.0.3"], "mac": "c2:11:22:33:44:55"}},
+			"runtimeConfig": {
+				"ips": ["10.0.0.4/24"],
+				"bandwidth": {"ingressRate": 1000, "ingressBurst": 100},
+				"portMappings": [{"hostPort": 8080, "containerPort": 80, "protocol": "tcp"}],
+				"dns": {"servers": ["10.0.0.1"]}
+			}
+		}`
+		a, err := cniargs.Parse("IP=10.0.0.2", []byte(conf))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a.IPs()).To(Equal([]*ip.IP{ip.ParseIP("10.0.0.2"), ip.ParseIP("10.0.0.3"), ip.ParseIP("10.0.0.4/24")}))
+		Expect(a.RuntimeConfig.Bandwidth).To(Equal(&cniargs.BandwidthEntry{IngressRate: 1000, IngressBurst: 100}))
+		Expect(a.RuntimeConfig.Bandwidth.IsZero()).To(BeFalse())
+		Expect(a.RuntimeConfig.PortMappings).To(Equal([]cniargs.PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}}))
+		Expect(a.RuntimeConfig.DNS.Servers).To(Equal([]string{"10.0.0.1"}))
+	})
+
+	It("prefers runtimeConfig over args over CNI_ARGS for the MAC", func() {
+		a, err := cniargs.Parse("MAC=c2:11:22:33:44:01", []byte(`{"args": {"cni": {"mac": "c2:11:22:33:44:02"}}}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a.MAC()).To(Equal("c2:11:22:33:44:02"))
+
+		a, err = cniargs.Parse("MAC=c2:11:22:33:44:01", []byte(`{"args": {"cni": {"mac": "c2:11:22:33:44:02"}}, "runtimeConfig": {"mac": "c2:11:22:33:44:03"}}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a.MAC()).To(Equal("c2:11:22:33:44:03"))
+
+		a, err = cniargs.Parse("MAC=c2:11:22:33:44:01", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a.MAC()).To(Equal("c2:11:22:33:44:01"))
+	})
+})
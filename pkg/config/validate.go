@@ -0,0 +1,451 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config validates plugin configuration against the struct it is
+// decoded into, so misspelled keys and wrongly typed values are reported
+// instead of being silently ignored by encoding/json.
+//
+// Validation is driven by the json tags of the target struct. In addition
+// fields may carry a `config` tag:
+//
+//	config:"exclusive=<group>"  at most one field of the group may be set
+//	config:"open"               unknown keys below this field are allowed
+//
+// Unknown keys are only warned about on stderr, as plugins used to ignore
+// them, unless the configuration sets "strictConfig": true.
+package config
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// FieldError describes a problem with a single configuration field.
+type FieldError struct {
+	Path    string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// Errors lists every problem found in a configuration.
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, fe := range e {
+		msgs = append(msgs, fe.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// topLevelKeys may appear in every network configuration, as they are
+// injected by the runtime whether or not the plugin understands them.
+var topLevelKeys = map[string]bool{
+	"cniVersion":    true,
+	"name":          true,
+	"type":          true,
+	"capabilities":  true,
+	"prevResult":    true,
+	"runtimeConfig": true,
+	"args":          true,
+	// strictConfig is read by Validate itself
+	strictKey: true,
+}
+
+// strictKey turns the warnings about unknown keys into errors.
+const strictKey = "strictConfig"
+
+// warnings receives the unknown keys of configurations which aren't strict.
+var warnings io.Writer = os.Stderr
+
+// openKeys are top-level keys whose contents are defined by the runtime,
+// so only the keys known to the plugin are checked.
+var openKeys = map[string]bool{
+	"runtimeConfig": true,
+	"args":          true,
+}
+
+// isTopLevelKey matches case-insensitively, like encoding/json.
+func isTopLevelKey(key string) bool {
+	for k := range topLevelKeys {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	unmarshalerType     = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	// the IPAM section is validated by the IPAM plugin
+	ipamType = reflect.TypeOf(types.IPAM{})
+)
+
+// Validate checks the JSON document data against the layout of v, the
+// struct the plugin decodes its configuration into. It reports unknown
+// fields, values of the wrong JSON type and options which are mutually
+// exclusive, each with the path of the offending field. Data which is not
+// a JSON object is left for json.Unmarshal to complain about.
+//
+// Unknown fields are written to stderr as a warning instead of being
+// returned, unless the document sets "strictConfig": true.
+func Validate(data []byte, v interface{}) error {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil
+	}
+	c := newChecker(doc)
+	c.object("", doc, reflect.TypeOf(v), true)
+	return c.result()
+}
+
+// ValidateField is like Validate but only checks the object found under
+// the top-level key field, e.g. "ipam" for IPAM plugins. It is not an error
+// for the key to be missing.
+func ValidateField(data []byte, field string, v interface{}) error {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil
+	}
+	sub, ok := doc[field]
+	if !ok {
+		return nil
+	}
+	c := newChecker(doc)
+	c.value(field, sub, reflect.TypeOf(v), false)
+	return c.result()
+}
+
+type checker struct {
+	errs Errors
+	// strict is set if unknown fields are errors, otherwise they are
+	// collected in unknown
+	strict  bool
+	unknown Errors
+}
+
+// newChecker returns a checker for the configuration doc, strict if doc
+// asks for it. A strictConfig which isn't a boolean is reported by the
+// check of the top-level keys.
+func newChecker(doc map[string]interface{}) *checker {
+	strict, _ := doc[strictKey].(bool)
+	return &checker{strict: strict}
+}
+
+func (c *checker) result() error {
+	if len(c.unknown) > 0 {
+		fmt.Fprintf(warnings, "warning: ignoring unknown fields (set %q to reject them): %v\n", strictKey, c.unknown)
+	}
+	if len(c.errs) == 0 {
+		return nil
+	}
+	return c.errs
+}
+
+// unknownField reports the unknown key at path, suggesting the closest
+// field of fs.
+func (c *checker) unknownField(path string, fs []field, key string) {
+	msg := "unknown field"
+	if s := suggest(fs, key); s != "" {
+		msg = fmt.Sprintf("unknown field, did you mean %q?", s)
+	}
+	fe := FieldError{Path: path, Message: msg}
+	if c.strict {
+		c.errs = append(c.errs, fe)
+	} else {
+		c.unknown = append(c.unknown, fe)
+	}
+}
+
+func (c *checker) errorf(path, format string, args ...interface{}) {
+	c.errs = append(c.errs, FieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+type field struct {
+	name      string
+	typ       reflect.Type
+	asString  bool
+	open      bool
+	exclusive string
+}
+
+// fields returns the JSON visible fields of struct type t, including the
+// ones promoted from embedded structs.
+func fields(t reflect.Type) []field {
+	var out []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+
+		ft := sf.Type
+		if sf.Anonymous && name == "" {
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				out = append(out, fields(ft)...)
+				continue
+			}
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+
+		f := field{name: name, typ: ft, asString: strings.Contains(opts, "string")}
+		for _, opt := range strings.Split(sf.Tag.Get("config"), ",") {
+			switch {
+			case opt == "open":
+				f.open = true
+			case strings.HasPrefix(opt, "exclusive="):
+				f.exclusive = strings.TrimPrefix(opt, "exclusive=")
+			}
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+// lookup matches key to a field the way encoding/json does: an exact match
+// wins, otherwise the first case-insensitive one.
+func lookup(fs []field, key string) *field {
+	for i := range fs {
+		if fs[i].name == key {
+			return &fs[i]
+		}
+	}
+	for i := range fs {
+		if strings.EqualFold(fs[i].name, key) {
+			return &fs[i]
+		}
+	}
+	return nil
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func (c *checker) object(path string, obj map[string]interface{}, t reflect.Type, root bool) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	fs := fields(t)
+
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	groups := map[string][]string{}
+	for _, k := range keys {
+		f := lookup(fs, k)
+		if f == nil {
+			if root && isTopLevelKey(k) {
+				if strings.EqualFold(k, strictKey) {
+					c.value(k, obj[k], reflect.TypeOf(true), false)
+				}
+				continue
+			}
+			c.unknownField(join(path, k), fs, k)
+			continue
+		}
+		if obj[k] == nil {
+			continue
+		}
+		if f.exclusive != "" {
+			groups[f.exclusive] = append(groups[f.exclusive], f.name)
+		}
+		if f.asString {
+			if _, ok := obj[k].(string); !ok {
+				c.errorf(join(path, k), "expected a string, got %s", jsonType(obj[k]))
+			}
+			continue
+		}
+		c.value(join(path, k), obj[k], f.typ, f.open || root && openKeys[f.name])
+	}
+
+	groupNames := make([]string, 0, len(groups))
+	for g := range groups {
+		groupNames = append(groupNames, g)
+	}
+	sort.Strings(groupNames)
+	for _, g := range groupNames {
+		if set := groups[g]; len(set) > 1 {
+			c.errorf(join(path, set[0]), "mutually exclusive with %s", strings.Join(set[1:], ", "))
+		}
+	}
+}
+
+// value checks a decoded JSON value against Go type t. When open is set,
+// unknown keys of objects below it are not reported.
+func (c *checker) value(path string, v interface{}, t reflect.Type, open bool) {
+	if v == nil {
+		return
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	// types with their own decoding report their own errors
+	if t == ipamType || t.Implements(unmarshalerType) || reflect.PtrTo(t).Implements(unmarshalerType) ||
+		t.Implements(textUnmarshalerType) || reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Interface:
+		return
+	case reflect.Struct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			c.errorf(path, "expected an object, got %s", jsonType(v))
+			return
+		}
+		if open {
+			c.openObject(path, obj, t)
+			return
+		}
+		c.object(path, obj, t, false)
+	case reflect.Map:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			c.errorf(path, "expected an object, got %s", jsonType(v))
+			return
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			c.value(join(path, k), obj[k], t.Elem(), open)
+		}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			if _, ok := v.(string); !ok {
+				c.errorf(path, "expected a string, got %s", jsonType(v))
+			}
+			return
+		}
+		arr, ok := v.([]interface{})
+		if !ok {
+			c.errorf(path, "expected an array, got %s", jsonType(v))
+			return
+		}
+		for i, item := range arr {
+			c.value(fmt.Sprintf("%s[%d]", path, i), item, t.Elem(), open)
+		}
+	case reflect.String:
+		if _, ok := v.(string); !ok {
+			c.errorf(path, "expected a string, got %s", jsonType(v))
+		}
+	case reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			c.errorf(path, "expected a boolean, got %s", jsonType(v))
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if _, ok := v.(float64); !ok {
+			c.errorf(path, "expected a number, got %s", jsonType(v))
+		}
+	}
+}
+
+// openObject checks the known keys of obj and ignores the rest.
+func (c *checker) openObject(path string, obj map[string]interface{}, t reflect.Type) {
+	fs := fields(t)
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if f := lookup(fs, k); f != nil {
+			c.value(join(path, k), obj[k], f.typ, true)
+		}
+	}
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "a string"
+	case float64:
+		return "a number"
+	case bool:
+		return "a boolean"
+	case []interface{}:
+		return "an array"
+	case map[string]interface{}:
+		return "an object"
+	}
+	return "null"
+}
+
+// suggest returns the known field closest to the unknown key, if any is
+// close enough to be a likely typo.
+func suggest(fs []field, key string) string {
+	best, bestDist := "", 3
+	for _, f := range fs {
+		d := distance(strings.ToLower(key), strings.ToLower(f.name))
+		if d < bestDist {
+			best, bestDist = f.name, d
+		}
+	}
+	return best
+}
+
+// distance is the Levenshtein distance between a and b.
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
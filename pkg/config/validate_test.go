@@ -0,0 +1,148 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config_test
+
+import (
+	"bytes"
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/config"
+)
+
+type testRange struct {
+	Subnet     types.IPNet `json:"subnet"`
+	RangeStart net.IP      `json:"rangeStart,omitempty"`
+}
+
+type testIPAM struct {
+	Type   string        `json:"type"`
+	Ranges [][]testRange `json:"ranges"`
+}
+
+type testConf struct {
+	types.NetConf
+	Bridge     string `json:"bridge"`
+	MTU        int    `json:"mtu"`
+	Key        string `json:"key,omitempty" config:"exclusive=key"`
+	KeyFile    string `json:"keyFile,omitempty" config:"exclusive=key"`
+	Labels     map[string]string
+	RuntimeCfg struct {
+		Mac string `json:"mac,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+}
+
+var _ = Describe("Validate", func() {
+	var warnings *bytes.Buffer
+
+	BeforeEach(func() {
+		warnings = &bytes.Buffer{}
+		DeferCleanup(config.SetWarnings(warnings))
+	})
+
+	It("accepts a valid configuration", func() {
+		conf := `{
+			"cniVersion": "1.0.0",
+			"name": "test",
+			"type": "bridge",
+			"bridge": "cni0",
+			"mtu": 1400,
+			"keyFile": "/etc/key",
+			"Labels": {"a": "b"},
+			"ipam": {"type": "host-local", "whatever": 1},
+			"prevResult": {"ips": []}
+		}`
+		Expect(config.Validate([]byte(conf), &testConf{})).To(Succeed())
+	})
+
+	It("matches keys case-insensitively like encoding/json", func() {
+		conf := `{"Bridge": "cni0", "MTU": 1400, "Args": {"cni": {}}}`
+		Expect(config.Validate([]byte(conf), &testConf{})).To(Succeed())
+	})
+
+	It("warns about unknown fields and suggests the closest known one", func() {
+		conf := `{"name": "test", "brdge": "cni0", "foo": true}`
+		Expect(config.Validate([]byte(conf), &testConf{})).To(Succeed())
+		Expect(warnings.String()).To(Equal(`warning: ignoring unknown fields (set "strictConfig" to reject them): ` +
+			`brdge: unknown field, did you mean "bridge"?; foo: unknown field` + "\n"))
+	})
+
+	It("reports unknown fields with strictConfig", func() {
+		conf := `{"name": "test", "strictConfig": true, "brdge": "cni0", "foo": true}`
+		err := config.Validate([]byte(conf), &testConf{})
+		Expect(err).To(MatchError(`brdge: unknown field, did you mean "bridge"?; foo: unknown field`))
+		Expect(warnings.String()).To(BeEmpty())
+
+		conf = `{"strictConfig": "yes"}`
+		err = config.Validate([]byte(conf), &testConf{})
+		Expect(err).To(MatchError("strictConfig: expected a boolean, got a string"))
+	})
+
+	It("reports type mismatches", func() {
+		conf := `{"bridge": 1, "mtu": "1400", "Labels": {"a": 1}, "dns": {"nameservers": "1.1.1.1"}}`
+		err := config.Validate([]byte(conf), &testConf{})
+		Expect(err).To(HaveOccurred())
+		errs := err.(config.Errors)
+		Expect(errs).To(ConsistOf(
+			config.FieldError{Path: "Labels.a", Message: "expected a string, got a number"},
+			config.FieldError{Path: "bridge", Message: "expected a string, got a number"},
+			config.FieldError{Path: "dns.nameservers", Message: "expected an array, got a string"},
+			config.FieldError{Path: "mtu", Message: "expected a number, got a string"},
+		))
+	})
+
+	It("reports mutually exclusive fields", func() {
+		conf := `{"key": "abc", "keyFile": "/etc/key"}`
+		err := config.Validate([]byte(conf), &testConf{})
+		Expect(err).To(MatchError("key: mutually exclusive with keyFile"))
+	})
+
+	It("only checks the known keys of runtimeConfig", func() {
+		conf := `{"runtimeConfig": {"mac": "c2:11:22:33:44:55", "portMappings": []}}`
+		Expect(config.Validate([]byte(conf), &testConf{})).To(Succeed())
+
+		conf = `{"runtimeConfig": {"mac": 1}}`
+		err := config.Validate([]byte(conf), &testConf{})
+		Expect(err).To(MatchError("runtimeConfig.mac: expected a string, got a number"))
+	})
+
+	It("leaves invalid JSON to the decoder", func() {
+		Expect(config.Validate([]byte(`{"bridge": `), &testConf{})).To(Succeed())
+	})
+})
+
+var _ = Describe("ValidateField", func() {
+	It("reports the path of nested fields", func() {
+		conf := `{
+			"strictConfig": true,
+			"bridge": "cni0",
+			"ipam": {
+				"type": "host-local",
+				"rangs": [[{"subnet": "10.0.0.0/24"}]],
+				"ranges": [[{"subnet": "10.0.0.0/24", "rangeStrat": "10.0.0.10"}]]
+			}
+		}`
+		err := config.ValidateField([]byte(conf), "ipam", &testIPAM{})
+		Expect(err).To(MatchError(`ipam.ranges[0][0].rangeStrat: unknown field, did you mean "rangeStart"?; ` +
+			`ipam.rangs: unknown field, did you mean "ranges"?`))
+	})
+
+	It("ignores a missing field", func() {
+		Expect(config.ValidateField([]byte(`{"name": "test"}`), "ipam", &testIPAM{})).To(Succeed())
+	})
+})
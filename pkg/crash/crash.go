@@ -0,0 +1,256 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package crash turns a panic of a plugin command into a CNI error, and
+// leaves a diagnostic bundle behind for the postmortem: the network
+// configuration and CNI arguments, with secrets scrubbed, and the stack
+// trace. Plugins call PluginMain or PluginMainFuncs instead of skel's.
+//
+// Panics of goroutines other than the command's can't be recovered, they
+// still crash the plugin.
+package crash
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/version"
+	cnierrors "github.com/containernetworking/plugins/pkg/errors"
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+const (
+	// EnvDir overrides the directory the bundles are written to. "off"
+	// disables them, panics are still turned into errors.
+	EnvDir = "CNI_CRASH_DIR"
+
+	// maxBundles is the number of bundles kept in the directory, older
+	// ones are removed
+	maxBundles = 50
+
+	redacted = "<redacted>"
+)
+
+// Bundle is the diagnostic bundle of a panic.
+type Bundle struct {
+	Plugin      string    `json:"plugin"`
+	Time        time.Time `json:"time"`
+	Command     string    `json:"command"`
+	ContainerID string    `json:"containerID"`
+	Netns       string    `json:"netns"`
+	IfName      string    `json:"ifName"`
+	Path        string    `json:"path"`
+	// Args are the CNI_ARGS, with the values of secret keys redacted
+	Args string `json:"args"`
+	// Config is the network configuration, with secret values redacted.
+	// If it isn't valid JSON, it is replaced by its length and hash.
+	Config interface{} `json:"config"`
+	Panic  string      `json:"panic"`
+	Stack  string      `json:"stack"`
+}
+
+// PluginMain is skel.PluginMain with the commands guarded by Guard.
+func PluginMain(cmdAdd, cmdCheck, cmdDel func(_ *skel.CmdArgs) error, versionInfo version.PluginInfo, about string) {
+	PluginMainFuncs(skel.CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}, versionInfo, about)
+}
+
+// PluginMainFuncs is skel.PluginMainFuncs with the commands guarded by
+// Guard.
+func PluginMainFuncs(funcs skel.CNIFuncs, versionInfo version.PluginInfo, about string) {
+	plugin := filepath.Base(os.Args[0])
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:    Guard(plugin, "ADD", funcs.Add),
+		Check:  Guard(plugin, "CHECK", funcs.Check),
+		Del:    Guard(plugin, "DEL", funcs.Del),
+		GC:     Guard(plugin, "GC", funcs.GC),
+		Status: Guard(plugin, "STATUS", funcs.Status),
+	}, versionInfo, about)
+}
+
+// Guard returns cmd recovering from panics: the bundle is written, see
+// EnvDir, and a Panic error naming it is returned. Panics of goroutines cmd
+// starts can't be recovered, except those of ns.Do callbacks, which Do
+// passes on to its caller.
+func Guard(plugin, command string, cmd func(_ *skel.CmdArgs) error) func(_ *skel.CmdArgs) error {
+	if cmd == nil {
+		return nil
+	}
+	return func(args *skel.CmdArgs) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				stack := debug.Stack()
+				// the panic of a callback of ns.Do, raised again by Do,
+				// is reported with the stack of the callback
+				if p, ok := r.(*ns.Panic); ok {
+					r, stack = p.Value, p.Stack
+				}
+				err = recovered(plugin, command, args, r, stack)
+			}
+		}()
+		return cmd(args)
+	}
+}
+
+func recovered(plugin, command string, args *skel.CmdArgs, r interface{}, stack []byte) error {
+	b := &Bundle{
+		Plugin:      plugin,
+		Time:        time.Now().UTC(),
+		Command:     command,
+		ContainerID: args.ContainerID,
+		Netns:       args.Netns,
+		IfName:      args.IfName,
+		Path:        args.Path,
+		Args:        ScrubArgs(args.Args),
+		Config:      ScrubConfig(args.StdinData),
+		Panic:       fmt.Sprint(r),
+		Stack:       string(stack),
+	}
+
+	details := cnierrors.Details{}
+	if path, err := writeBundle(Dir(), b); err != nil {
+		details["bundleError"] = err.Error()
+	} else if path != "" {
+		details["bundle"] = path
+	}
+	return cnierrors.New(cnierrors.KindPanic, fmt.Errorf("%s panicked on %s: %v", plugin, command, r), details)
+}
+
+// Dir returns the directory of the bundles, or "" if they are disabled.
+func Dir() string {
+	dir := os.Getenv(EnvDir)
+	switch {
+	case dir == "off":
+		return ""
+	case dir != "":
+		return dir
+	case runtime.GOOS == "windows":
+		return filepath.Join(os.Getenv("ProgramData"), "cni", "crash")
+	}
+	return "/var/log/cni/crash"
+}
+
+// writeBundle writes b to dir and returns its path, removing the oldest
+// bundles beyond maxBundles.
+func writeBundle(dir string, b *Bundle) (string, error) {
+	if dir == "" {
+		return "", nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create crash dir %q: %v", dir, err)
+	}
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s-%s-%d.json", b.Plugin, b.Time.Format("20060102T150405.000000000Z"), os.Getpid())
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return "", fmt.Errorf("failed to write crash bundle: %v", err)
+	}
+	prune(dir)
+	return path, nil
+}
+
+// prune removes the oldest bundles beyond maxBundles. Failures are
+// ignored, the bundle was written.
+func prune(dir string) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(paths) <= maxBundles {
+		return
+	}
+	type bundleFile struct {
+		path    string
+		modTime time.Time
+	}
+	files := make([]bundleFile, 0, len(paths))
+	for _, p := range paths {
+		if fi, err := os.Stat(p); err == nil {
+			files = append(files, bundleFile{p, fi.ModTime()})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for i := 0; i < len(files)-maxBundles; i++ {
+		_ = os.Remove(files[i].path)
+	}
+}
+
+// secret reports whether the value of the configuration or argument key is
+// a secret. The paths of files holding secrets, e.g. keyFile, are kept.
+func secret(key string) bool {
+	k := strings.ToLower(key)
+	if strings.HasSuffix(k, "file") || strings.HasSuffix(k, "path") || k == "publickey" {
+		return false
+	}
+	if strings.HasSuffix(k, "key") {
+		return true
+	}
+	for _, s := range []string{"secret", "password", "passwd", "token", "credential"} {
+		if strings.Contains(k, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// ScrubConfig returns the network configuration with the values of secret
+// keys redacted, at any depth. A configuration which isn't valid JSON can't
+// be scrubbed, so only its length and hash are returned.
+func ScrubConfig(data []byte) interface{} {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return fmt.Sprintf("<redacted: %d bytes of invalid JSON, sha256 %x>", len(data), sha256.Sum256(data))
+	}
+	return scrub(v)
+}
+
+func scrub(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if secret(k) {
+				v[k] = redacted
+			} else {
+				v[k] = scrub(e)
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = scrub(e)
+		}
+	}
+	return v
+}
+
+// ScrubArgs returns the CNI_ARGS with the values of secret keys redacted.
+func ScrubArgs(args string) string {
+	if args == "" {
+		return ""
+	}
+	pairs := strings.Split(args, ";")
+	for i, pair := range pairs {
+		if k, _, ok := strings.Cut(pair, "="); ok && secret(k) {
+			pairs[i] = k + "=" + redacted
+		}
+	}
+	return strings.Join(pairs, ";")
+}
@@ -0,0 +1,67 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crash_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+var _ = Describe("crash in a network namespace", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "crash")
+		Expect(err).NotTo(HaveOccurred())
+		os.Setenv(crash.EnvDir, dir)
+	})
+
+	AfterEach(func() {
+		os.Unsetenv(crash.EnvDir)
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("recovers from panics of ns.Do callbacks", func() {
+		cmd := crash.Guard("test", "ADD", func(*skel.CmdArgs) error {
+			netns, err := ns.GetCurrentNS()
+			if err != nil {
+				return err
+			}
+			defer netns.Close()
+			return netns.Do(func(ns.NetNS) error { panic("boom") })
+		})
+		Expect(cmd(&skel.CmdArgs{ContainerID: "dummy"})).To(MatchError(ContainSubstring("test panicked on ADD: boom")))
+
+		paths, err := filepath.Glob(filepath.Join(dir, "test-*.json"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(paths).To(HaveLen(1))
+		data, err := os.ReadFile(paths[0])
+		Expect(err).NotTo(HaveOccurred())
+		b := &crash.Bundle{}
+		Expect(json.Unmarshal(data, b)).To(Succeed())
+		Expect(b.Panic).To(Equal("boom"))
+		// the stack is the one of the callback's goroutine
+		Expect(b.Stack).To(ContainSubstring("ns.(*netNS).Do.func"))
+	})
+})
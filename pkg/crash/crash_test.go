@@ -0,0 +1,116 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crash_test
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/crash"
+)
+
+var _ = Describe("crash", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "crash")
+		Expect(err).NotTo(HaveOccurred())
+		os.Setenv(crash.EnvDir, dir)
+	})
+
+	AfterEach(func() {
+		os.Unsetenv(crash.EnvDir)
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	args := &skel.CmdArgs{
+		ContainerID: "dummy",
+		Netns:       "/var/run/netns/test",
+		IfName:      "eth0",
+		Args:        "K8S_POD_NAME=pod;API_TOKEN=abc",
+		StdinData: []byte(`{
+			"cniVersion": "1.0.0",
+			"name": "test",
+			"type": "test",
+			"privateKey": "abc",
+			"privateKeyFile": "/etc/wg/key",
+			"peers": [{"publicKey": "def", "presharedKey": "ghi"}],
+			"auth": {"password": "jkl"}
+		}`),
+	}
+
+	It("passes on the results of commands which don't panic", func() {
+		cmd := crash.Guard("test", "ADD", func(*skel.CmdArgs) error { return errors.New("failed") })
+		Expect(cmd(args)).To(MatchError("failed"))
+		Expect(crash.Guard("test", "GC", nil)).To(BeNil())
+	})
+
+	It("turns a panic into an error and writes the bundle", func() {
+		cmd := crash.Guard("test", "ADD", func(*skel.CmdArgs) error { panic("boom") })
+		err := cmd(args)
+
+		var e *types.Error
+		Expect(errors.As(err, &e)).To(BeTrue())
+		Expect(e.Code).To(Equal(uint(types.ErrInternal)))
+		Expect(e.Msg).To(Equal("test panicked on ADD: boom"))
+
+		paths, err := filepath.Glob(filepath.Join(dir, "test-*.json"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(paths).To(HaveLen(1))
+		Expect(e.Details).To(ContainSubstring(paths[0]))
+
+		data, err := os.ReadFile(paths[0])
+		Expect(err).NotTo(HaveOccurred())
+		b := &crash.Bundle{}
+		Expect(json.Unmarshal(data, b)).To(Succeed())
+		Expect(b.Command).To(Equal("ADD"))
+		Expect(b.ContainerID).To(Equal("dummy"))
+		Expect(b.Panic).To(Equal("boom"))
+		Expect(b.Stack).To(ContainSubstring("crash_test.go"))
+		Expect(b.Args).To(Equal("K8S_POD_NAME=pod;API_TOKEN=<redacted>"))
+		Expect(b.Config).To(HaveKeyWithValue("privateKey", "<redacted>"))
+		Expect(b.Config).To(HaveKeyWithValue("privateKeyFile", "/etc/wg/key"))
+		Expect(b.Config).To(HaveKeyWithValue("peers", ConsistOf(map[string]interface{}{
+			"publicKey": "def", "presharedKey": "<redacted>",
+		})))
+		Expect(b.Config).To(HaveKeyWithValue("auth", HaveKeyWithValue("password", "<redacted>")))
+		Expect(string(data)).NotTo(ContainSubstring("abc"))
+	})
+
+	It("redacts a configuration which isn't valid JSON", func() {
+		config := []byte(`{"privateKey": "abc"`)
+		Expect(crash.ScrubConfig(config)).To(Equal(fmt.Sprintf(
+			"<redacted: 20 bytes of invalid JSON, sha256 %x>", sha256.Sum256(config))))
+	})
+
+	It("only returns the error if bundles are off", func() {
+		os.Setenv(crash.EnvDir, "off")
+		cmd := crash.Guard("test", "DEL", func(*skel.CmdArgs) error { panic("boom") })
+		Expect(cmd(args)).To(MatchError(ContainSubstring("test panicked on DEL: boom")))
+		entries, err := os.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+	})
+})
@@ -0,0 +1,137 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dhcpinform announces the address of a new container interface to
+// the DHCP infrastructure of its parent network with a DHCPINFORM, so
+// systems tracking MAC and IP bindings, e.g. DHCP snooping switches or
+// relays forwarding to an IPAM, learn it before the first packet of the
+// container is dropped by their ACLs.
+package dhcpinform
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/d2g/dhcp4"
+	"golang.org/x/sys/unix"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+const (
+	clientPort = 68
+	serverPort = 67
+)
+
+// Config is the "dhcpInform" section of a network configuration.
+type Config struct {
+	// Helpers are the addresses the DHCPINFORM is sent to, e.g. the IP
+	// helpers of the parent network. Without, it is broadcast.
+	Helpers []string `json:"helpers,omitempty"`
+
+	helpers []net.IP
+}
+
+// Validate parses the helper addresses.
+func (c *Config) Validate() error {
+	c.helpers = nil
+	for _, h := range c.Helpers {
+		ip := net.ParseIP(h)
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid dhcpInform helper %q, must be an IPv4 address", h)
+		}
+		c.helpers = append(c.helpers, ip.To4())
+	}
+	return nil
+}
+
+// Send sends a DHCPINFORM for every IPv4 address of the interface ifName,
+// which must be up and have the addresses configured, to every helper. It
+// must be called in the namespace of the interface. Replies aren't waited
+// for, the point is the request being seen.
+func (c *Config) Send(ifName string, ips []*current.IPConfig) error {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to look up %q: %v", ifName, err)
+	}
+	dests := c.helpers
+	if len(dests) == 0 {
+		dests = []net.IP{net.IPv4bcast}
+	}
+
+	var errs []error
+	for _, ipc := range ips {
+		addr := ipc.Address.IP.To4()
+		if addr == nil {
+			continue
+		}
+		if err := send(iface, addr, dests); err != nil {
+			errs = append(errs, fmt.Errorf("failed to send DHCPINFORM for %s: %v", addr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func send(iface *net.Interface, addr net.IP, dests []net.IP) error {
+	lc := net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				if sockErr = unix.BindToDevice(int(fd), iface.Name); sockErr != nil {
+					return
+				}
+				if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); sockErr != nil {
+					return
+				}
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_BROADCAST, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp4", net.JoinHostPort(addr.String(), fmt.Sprint(clientPort)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	packet, err := informPacket(iface.HardwareAddr, addr)
+	if err != nil {
+		return err
+	}
+	for _, dest := range dests {
+		if _, err := conn.WriteTo(packet, &net.UDPAddr{IP: dest, Port: serverPort}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func informPacket(mac net.HardwareAddr, addr net.IP) (dhcp4.Packet, error) {
+	xid := make([]byte, 4)
+	if _, err := rand.Read(xid); err != nil {
+		return nil, err
+	}
+	var opts []dhcp4.Option
+	if len(mac) > 0 {
+		opts = append(opts, dhcp4.Option{Code: dhcp4.OptionClientIdentifier, Value: append([]byte{1}, mac...)})
+	}
+	return dhcp4.RequestPacket(dhcp4.Inform, mac, addr, xid, false, opts), nil
+}
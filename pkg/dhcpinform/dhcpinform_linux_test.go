@@ -0,0 +1,114 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcpinform_test
+
+import (
+	"net"
+	"time"
+
+	"github.com/d2g/dhcp4"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/dhcpinform"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+)
+
+var _ = Describe("DHCPINFORM", func() {
+	var contNS, helperNS ns.NetNS
+
+	BeforeEach(func() {
+		var err error
+		contNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		helperNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(contNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(contNS)).To(Succeed())
+		Expect(helperNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(helperNS)).To(Succeed())
+	})
+
+	setupLink := func(name, addr string) {
+		link, err := netlink.LinkByName(name)
+		Expect(err).NotTo(HaveOccurred())
+		a, err := netlink.ParseAddr(addr)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(netlink.AddrAdd(link, a)).To(Succeed())
+		Expect(netlink.LinkSetUp(link)).To(Succeed())
+	}
+
+	It("sends a DHCPINFORM for the IPv4 addresses to the helpers", func() {
+		var mac net.HardwareAddr
+		Expect(contNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "eth0"},
+				PeerName:  "helper0",
+			})).To(Succeed())
+			peer, err := netlink.LinkByName("helper0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetNsFd(peer, int(helperNS.Fd()))).To(Succeed())
+			setupLink("eth0", "10.9.0.2/24")
+			link, err := netlink.LinkByName("eth0")
+			Expect(err).NotTo(HaveOccurred())
+			mac = link.Attrs().HardwareAddr
+			return nil
+		})).To(Succeed())
+
+		var conn net.PacketConn
+		Expect(helperNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			setupLink("helper0", "10.9.0.1/24")
+			var err error
+			conn, err = net.ListenPacket("udp4", "10.9.0.1:67")
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})).To(Succeed())
+		defer conn.Close()
+
+		conf := &dhcpinform.Config{Helpers: []string{"10.9.0.1"}}
+		Expect(conf.Validate()).To(Succeed())
+		Expect(contNS.Do(func(ns.NetNS) error {
+			return conf.Send("eth0", []*current.IPConfig{
+				{Address: net.IPNet{IP: net.ParseIP("2001:db8::2"), Mask: net.CIDRMask(64, 128)}},
+				{Address: net.IPNet{IP: net.ParseIP("10.9.0.2"), Mask: net.CIDRMask(24, 32)}},
+			})
+		})).To(Succeed())
+
+		buf := make([]byte, 1500)
+		Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+		n, from, err := conn.ReadFrom(buf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(from.(*net.UDPAddr).Port).To(Equal(68))
+
+		p := dhcp4.Packet(buf[:n])
+		Expect(p.OpCode()).To(Equal(dhcp4.BootRequest))
+		Expect(p.CIAddr().Equal(net.ParseIP("10.9.0.2"))).To(BeTrue())
+		Expect(p.CHAddr()).To(Equal(mac))
+		Expect(p.ParseOptions()[dhcp4.OptionDHCPMessageType]).To(Equal([]byte{byte(dhcp4.Inform)}))
+	})
+
+	It("rejects helpers which aren't IPv4 addresses", func() {
+		conf := &dhcpinform.Config{Helpers: []string{"2001:db8::1"}}
+		Expect(conf.Validate()).To(MatchError(`invalid dhcpInform helper "2001:db8::1", must be an IPv4 address`))
+	})
+})
@@ -0,0 +1,164 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package errors
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// Error codes of the failures the spec has no well known code for. The
+// spec leaves codes from 100 on to plugins.
+const (
+	CodePoolExhausted uint = 100
+	CodeConflict      uint = 101
+)
+
+// Kind classifies a failure, so runtimes can tell retryable failures from
+// terminal ones.
+type Kind string
+
+const (
+	// KindPoolExhausted is an address pool without free addresses
+	KindPoolExhausted Kind = "PoolExhausted"
+	// KindStoreUnavailable is state which can't be read or locked right
+	// now, the operation can be retried
+	KindStoreUnavailable Kind = "StoreUnavailable"
+	// KindNetNSGone is a container network namespace which doesn't exist
+	// (anymore)
+	KindNetNSGone Kind = "NetNSGone"
+	// KindConflict is a resource, such as an address or an interface name,
+	// already held by someone else
+	KindConflict Kind = "Conflict"
+	// KindPanic is a bug of the plugin, which panicked, see pkg/crash
+	KindPanic Kind = "Panic"
+	// KindThrottled is an operation refused because its requester made
+	// too many of them lately, it can be retried once the limit allows
+	KindThrottled Kind = "Throttled"
+)
+
+// Code returns the CNI error code of the kind.
+func (k Kind) Code() uint {
+	switch k {
+	case KindPoolExhausted:
+		return CodePoolExhausted
+	case KindStoreUnavailable, KindThrottled:
+		return types.ErrTryAgainLater
+	case KindNetNSGone:
+		return types.ErrInvalidNetNS
+	case KindConflict:
+		return CodeConflict
+	}
+	return types.ErrInternal
+}
+
+// Retryable returns true if the same operation may succeed later without
+// any change by the runtime.
+func (k Kind) Retryable() bool {
+	return k == KindStoreUnavailable || k == KindThrottled
+}
+
+// Details are machine readable facts about a failure, such as the range
+// set that is exhausted.
+type Details map[string]string
+
+// Error is a classified failure. It keeps the message of the error it
+// wraps, and turns into a *types.Error with its kind's code when skel looks
+// for one with errors.As, so it must only be wrapped with %w. skel reports
+// that *types.Error as is, so the message should make sense on its own.
+type Error struct {
+	Kind    Kind
+	Details Details
+	Err     error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// As converts the error to a *types.Error whose details are the JSON
+// encoded kind, retryability and details.
+func (e *Error) As(target interface{}) bool {
+	t, ok := target.(**types.Error)
+	if !ok {
+		return false
+	}
+	details := map[string]interface{}{
+		"kind":      e.Kind,
+		"retryable": e.Kind.Retryable(),
+	}
+	for k, v := range e.Details {
+		details[k] = v
+	}
+	data, _ := json.Marshal(details)
+	*t = types.NewError(e.Kind.Code(), e.Error(), string(data))
+	return true
+}
+
+// New classifies err as a failure of the given kind.
+func New(kind Kind, err error, details Details) *Error {
+	return &Error{Kind: kind, Details: details, Err: err}
+}
+
+// PoolExhausted is the failure to find a free address in rangeSet.
+func PoolExhausted(rangeSet string) *Error {
+	return New(KindPoolExhausted,
+		fmt.Errorf("no IP addresses available in range set: %s", rangeSet),
+		Details{"rangeSet": rangeSet})
+}
+
+// StoreUnavailable classifies err as the failure to access a store.
+func StoreUnavailable(err error) *Error {
+	return New(KindStoreUnavailable, err, nil)
+}
+
+// NetNSGone is the failure to open the network namespace at path, which
+// doesn't exist.
+func NetNSGone(path string, err error) *Error {
+	return New(KindNetNSGone,
+		fmt.Errorf("failed to open netns %q: %v", path, err),
+		Details{"netns": path})
+}
+
+// Conflict classifies err as a clash over the resource.
+func Conflict(resource string, err error) *Error {
+	return New(KindConflict, err, Details{"resource": resource})
+}
+
+// Throttled is the refusal of an operation of requester, which may be
+// retried after retryAfter.
+func Throttled(requester string, retryAfter time.Duration) *Error {
+	return New(KindThrottled,
+		fmt.Errorf("too many operations by %s, retry in %v", requester, retryAfter),
+		Details{"requester": requester, "retryAfter": retryAfter.String()})
+}
+
+// KindOf returns the kind of the first classified error in err's chain, or
+// "" if there is none.
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return ""
+}
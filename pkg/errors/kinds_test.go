@@ -0,0 +1,120 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package errors
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestKinds(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		kind     Kind
+		code     uint
+		msg      string
+		details  map[string]interface{}
+		wrapping bool
+	}{
+		{
+			"pool exhausted",
+			PoolExhausted("10.1.2.0/24"),
+			KindPoolExhausted,
+			CodePoolExhausted,
+			"no IP addresses available in range set: 10.1.2.0/24",
+			map[string]interface{}{"kind": "PoolExhausted", "retryable": false, "rangeSet": "10.1.2.0/24"},
+			false,
+		},
+		{
+			"store unavailable",
+			fmt.Errorf("failed to allocate: %w", StoreUnavailable(errors.New("locked"))),
+			KindStoreUnavailable,
+			types.ErrTryAgainLater,
+			"locked",
+			map[string]interface{}{"kind": "StoreUnavailable", "retryable": true},
+			true,
+		},
+		{
+			"netns gone",
+			NetNSGone("/var/run/netns/x", errors.New("no such file")),
+			KindNetNSGone,
+			types.ErrInvalidNetNS,
+			`failed to open netns "/var/run/netns/x": no such file`,
+			map[string]interface{}{"kind": "NetNSGone", "retryable": false, "netns": "/var/run/netns/x"},
+			false,
+		},
+		{
+			"conflict",
+			Conflict("eth0", errors.New("eth0 already exists")),
+			KindConflict,
+			CodeConflict,
+			"eth0 already exists",
+			map[string]interface{}{"kind": "Conflict", "retryable": false, "resource": "eth0"},
+			false,
+		},
+		{
+			"throttled",
+			Throttled("kube-system", 1500*time.Millisecond),
+			KindThrottled,
+			types.ErrTryAgainLater,
+			"too many operations by kube-system, retry in 1.5s",
+			map[string]interface{}{"kind": "Throttled", "retryable": true, "requester": "kube-system", "retryAfter": "1.5s"},
+			false,
+		},
+		{
+			"panic",
+			New(KindPanic, errors.New("bridge panicked: boom"), Details{"bundle": "/var/log/cni/crash/bridge.json"}),
+			KindPanic,
+			types.ErrInternal,
+			"bridge panicked: boom",
+			map[string]interface{}{"kind": "Panic", "retryable": false, "bundle": "/var/log/cni/crash/bridge.json"},
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if kind := KindOf(test.err); kind != test.kind {
+				t.Errorf("expected kind %q, got %q", test.kind, kind)
+			}
+
+			var e *types.Error
+			if !errors.As(test.err, &e) {
+				t.Fatalf("expected a *types.Error in the chain")
+			}
+			if e.Code != test.code || e.Msg != test.msg {
+				t.Errorf("expected code %d and message %q, got %d and %q", test.code, test.msg, e.Code, e.Msg)
+			}
+			details := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(e.Details), &details); err != nil {
+				t.Fatalf("failed to parse details %q: %v", e.Details, err)
+			}
+			if !reflect.DeepEqual(details, test.details) {
+				t.Errorf("expected details %v, got %v", test.details, details)
+			}
+		})
+	}
+
+	if kind := KindOf(fmt.Errorf("flattened: %v", PoolExhausted("10.1.2.0/24"))); kind != "" {
+		t.Errorf("expected no kind for a flattened error, got %q", kind)
+	}
+}
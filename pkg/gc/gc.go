@@ -0,0 +1,97 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gc implements the comparison at the heart of the GC verb of CNI
+// spec 1.1: each plugin lists the attachments it keeps state for, such as
+// leases or traffic classes, and gc releases the ones the runtime no
+// longer lists as valid.
+package gc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// Lister lists the attachments a plugin keeps state for. An empty IfName
+// stands for all interfaces of the container, for state which doesn't
+// record them.
+type Lister func() ([]types.GCAttachment, error)
+
+// Releaser removes the state of an attachment which is no longer valid.
+type Releaser func(types.GCAttachment) error
+
+// ValidAttachments returns the attachments the runtime passed to GC in the
+// network configuration.
+func ValidAttachments(stdinData []byte) ([]types.GCAttachment, error) {
+	conf := types.NetConf{}
+	if err := json.Unmarshal(stdinData, &conf); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	return conf.ValidAttachments, nil
+}
+
+// Valid tells whether the attachment a is among valid.
+func Valid(a types.GCAttachment, valid []types.GCAttachment) bool {
+	id := strings.TrimSpace(a.ContainerID)
+	for _, v := range valid {
+		if strings.TrimSpace(v.ContainerID) == id && (a.IfName == "" || a.IfName == v.IfName) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stale returns the attachments of known which aren't valid, once each,
+// ordered by container ID and interface.
+func Stale(known, valid []types.GCAttachment) []types.GCAttachment {
+	seen := map[types.GCAttachment]bool{}
+	var stale []types.GCAttachment
+	for _, a := range known {
+		a.ContainerID = strings.TrimSpace(a.ContainerID)
+		if seen[a] || Valid(a, valid) {
+			continue
+		}
+		seen[a] = true
+		stale = append(stale, a)
+	}
+	sort.Slice(stale, func(i, j int) bool {
+		if stale[i].ContainerID != stale[j].ContainerID {
+			return stale[i].ContainerID < stale[j].ContainerID
+		}
+		return stale[i].IfName < stale[j].IfName
+	})
+	return stale
+}
+
+// Collect releases the attachments list returns which aren't valid. It
+// carries on past the ones failing, to release as much as possible, and
+// returns all failures.
+func Collect(valid []types.GCAttachment, list Lister, release Releaser) error {
+	known, err := list()
+	if err != nil {
+		return fmt.Errorf("failed to list attachments: %v", err)
+	}
+	var errs []error
+	for _, a := range Stale(known, valid) {
+		if err := release(a); err != nil {
+			errs = append(errs, fmt.Errorf("failed to release %s/%s: %v", a.ContainerID, a.IfName, err))
+		}
+	}
+	return errors.Join(errs...)
+}
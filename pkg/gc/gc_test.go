@@ -0,0 +1,94 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gc_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/gc"
+)
+
+var _ = Describe("GC", func() {
+	valid := []types.GCAttachment{
+		{ContainerID: "c1", IfName: "eth0"},
+		{ContainerID: "c2", IfName: "net1"},
+	}
+
+	It("reads the valid attachments from the network configuration", func() {
+		attachments, err := gc.ValidAttachments([]byte(`{
+			"cniVersion": "1.1.0",
+			"name": "test",
+			"type": "test",
+			"cni.dev/valid-attachments": [
+				{"containerID": "c1", "ifname": "eth0"},
+				{"containerID": "c2", "ifname": "net1"}
+			]
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(attachments).To(Equal(valid))
+	})
+
+	It("finds the stale attachments", func() {
+		known := []types.GCAttachment{
+			{ContainerID: "c3", IfName: "eth0"},
+			{ContainerID: "c1", IfName: "eth0"},
+			// another interface of a valid container
+			{ContainerID: "c2", IfName: "eth0"},
+			// state not recording the interface
+			{ContainerID: "c2"},
+			{ContainerID: "c4"},
+			{ContainerID: "c3 ", IfName: "eth0"},
+		}
+		Expect(gc.Stale(known, valid)).To(Equal([]types.GCAttachment{
+			{ContainerID: "c2", IfName: "eth0"},
+			{ContainerID: "c3", IfName: "eth0"},
+			{ContainerID: "c4"},
+		}))
+	})
+
+	It("releases the stale attachments, carrying on past failures", func() {
+		list := func() ([]types.GCAttachment, error) {
+			return []types.GCAttachment{
+				{ContainerID: "c1", IfName: "eth0"},
+				{ContainerID: "c3", IfName: "eth0"},
+				{ContainerID: "c4", IfName: "eth0"},
+			}, nil
+		}
+		var released []string
+		err := gc.Collect(valid, list, func(a types.GCAttachment) error {
+			released = append(released, a.ContainerID)
+			if a.ContainerID == "c3" {
+				return errors.New("busy")
+			}
+			return nil
+		})
+		Expect(err).To(MatchError("failed to release c3/eth0: busy"))
+		Expect(released).To(Equal([]string{"c3", "c4"}))
+	})
+
+	It("fails when the attachments can't be listed", func() {
+		err := gc.Collect(valid, func() ([]types.GCAttachment, error) {
+			return nil, errors.New("no store")
+		}, func(types.GCAttachment) error {
+			Fail("nothing to release")
+			return nil
+		})
+		Expect(err).To(MatchError("failed to list attachments: no store"))
+	})
+})
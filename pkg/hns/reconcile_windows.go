@@ -0,0 +1,238 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hns
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Microsoft/hcsshim"
+	"github.com/Microsoft/hcsshim/hcn"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+
+	"github.com/containernetworking/plugins/pkg/errors"
+)
+
+// CheckHnsEndpoint verifies that the HNSEndpoint epName is on the network
+// networkID, has the address, gateway and MAC of result and carries the
+// endpoint policies of n.
+func CheckHnsEndpoint(epName string, networkID string, result *current.Result, n *NetConf) error {
+	hnsEndpoint, err := hcsshim.GetHNSEndpointByName(epName)
+	if err != nil {
+		return errors.Annotatef(err, "failed to find HNSEndpoint %s", epName)
+	}
+	if !strings.EqualFold(hnsEndpoint.VirtualNetwork, networkID) {
+		return fmt.Errorf("HNSEndpoint %s is on network %s, expected %s", epName, hnsEndpoint.VirtualNetwork, networkID)
+	}
+	if err := checkEndpointAddrs(epName, hnsEndpoint.IPAddress, net.ParseIP(hnsEndpoint.GatewayAddress), hnsEndpoint.MacAddress, result); err != nil {
+		return err
+	}
+	for _, expected := range n.GetHNSEndpointPolicies() {
+		if !hasPolicy(hnsEndpoint.Policies, expected) {
+			return fmt.Errorf("HNSEndpoint %s lacks policy %s", epName, expected)
+		}
+	}
+	return nil
+}
+
+// CheckHcnEndpoint verifies that the HostComputeEndpoint epName is on the
+// network networkID and in the namespace, has the address, gateway and MAC
+// of result and carries the endpoint policies of n.
+func CheckHcnEndpoint(epName string, networkID string, namespace string, result *current.Result, n *NetConf) error {
+	hcnEndpoint, err := hcn.GetEndpointByName(epName)
+	if err != nil {
+		return errors.Annotatef(err, "failed to find HostComputeEndpoint %s", epName)
+	}
+	if !strings.EqualFold(hcnEndpoint.HostComputeNetwork, networkID) {
+		return fmt.Errorf("HostComputeEndpoint %s is on network %s, expected %s", epName, hcnEndpoint.HostComputeNetwork, networkID)
+	}
+	if !strings.EqualFold(hcnEndpoint.HostComputeNamespace, namespace) {
+		return fmt.Errorf("HostComputeEndpoint %s is in namespace %s, expected %s", epName, hcnEndpoint.HostComputeNamespace, namespace)
+	}
+	var ip, gw net.IP
+	if len(hcnEndpoint.IpConfigurations) > 0 {
+		ip = net.ParseIP(hcnEndpoint.IpConfigurations[0].IpAddress)
+	}
+	if len(hcnEndpoint.Routes) > 0 {
+		gw = net.ParseIP(hcnEndpoint.Routes[0].NextHop)
+	}
+	if err := checkEndpointAddrs(epName, ip, gw, hcnEndpoint.MacAddress, result); err != nil {
+		return err
+	}
+
+	actual := make([]json.RawMessage, 0, len(hcnEndpoint.Policies))
+	for _, p := range hcnEndpoint.Policies {
+		if data, err := json.Marshal(p); err == nil {
+			actual = append(actual, data)
+		}
+	}
+	for _, p := range n.GetHostComputeEndpointPolicies() {
+		expected, err := json.Marshal(p)
+		if err != nil {
+			return errors.Annotatef(err, "failed to encode policy %s", p.Type)
+		}
+		if !hasPolicy(actual, expected) {
+			return fmt.Errorf("HostComputeEndpoint %s lacks policy %s", epName, expected)
+		}
+	}
+	return nil
+}
+
+// checkEndpointAddrs compares the address, gateway and MAC of an endpoint
+// with the first ones of result. Those result leaves out are not checked.
+func checkEndpointAddrs(epName string, ip, gw net.IP, mac string, result *current.Result) error {
+	if len(result.IPs) > 0 {
+		ipc := result.IPs[0]
+		if !ipc.Address.IP.Equal(ip) {
+			return fmt.Errorf("endpoint %s has IP %s, prevResult %s", epName, ip, ipc.Address.IP)
+		}
+		if ipc.Gateway != nil && !ipc.Gateway.Equal(gw) {
+			return fmt.Errorf("endpoint %s has gateway %s, prevResult %s", epName, gw, ipc.Gateway)
+		}
+	}
+	if len(result.Interfaces) > 0 && result.Interfaces[0].Mac != "" && !sameMAC(result.Interfaces[0].Mac, mac) {
+		return fmt.Errorf("endpoint %s has MAC %s, prevResult %s", epName, mac, result.Interfaces[0].Mac)
+	}
+	return nil
+}
+
+// sameMAC compares MACs written with dashes, as HNS does, or colons.
+func sameMAC(a, b string) bool {
+	return strings.EqualFold(strings.ReplaceAll(a, "-", ":"), strings.ReplaceAll(b, "-", ":"))
+}
+
+// hasPolicy reports whether one of policies has all the fields of expected.
+// HNS adds defaults to the policies it stores, so they don't compare equal.
+func hasPolicy(policies []json.RawMessage, expected json.RawMessage) bool {
+	var want interface{}
+	if err := json.Unmarshal(expected, &want); err != nil {
+		return false
+	}
+	for _, p := range policies {
+		var have interface{}
+		if err := json.Unmarshal(p, &have); err == nil && includes(have, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// includes reports whether have has every field of want, matching object
+// keys case-insensitively, and every element of its arrays.
+func includes(have, want interface{}) bool {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		h, ok := have.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for wk, wv := range w {
+			found := false
+			for hk, hv := range h {
+				if strings.EqualFold(hk, wk) && includes(hv, wv) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		h, ok := have.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, wv := range w {
+			found := false
+			for _, hv := range h {
+				if includes(hv, wv) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	case string:
+		h, ok := have.(string)
+		return ok && strings.EqualFold(h, w)
+	default:
+		return have == want
+	}
+}
+
+// EndpointAttachments returns the attachments of the endpoints of the
+// network, named by ConstructEndpointName, for GC. Endpoints don't record
+// the interface, so each attachment stands for all of its container.
+func EndpointAttachments(apiVersion int, networkName string) ([]types.GCAttachment, error) {
+	var names []string
+	if apiVersion == 2 {
+		hcnNetwork, err := hcn.GetNetworkByName(networkName)
+		if err != nil {
+			if hcn.IsNotFoundError(err) {
+				return nil, nil
+			}
+			return nil, errors.Annotatef(err, "failed to get HostComputeNetwork %s", networkName)
+		}
+		endpoints, err := hcn.ListEndpointsOfNetwork(hcnNetwork.Id)
+		if err != nil {
+			return nil, errors.Annotatef(err, "failed to list the HostComputeEndpoints of %s", networkName)
+		}
+		for _, ep := range endpoints {
+			names = append(names, ep.Name)
+		}
+	} else {
+		endpoints, err := hcsshim.HNSListEndpointRequest()
+		if err != nil {
+			return nil, errors.Annotate(err, "failed to list HNSEndpoints")
+		}
+		for _, ep := range endpoints {
+			if strings.EqualFold(ep.VirtualNetworkName, networkName) {
+				names = append(names, ep.Name)
+			}
+		}
+	}
+	return attachmentsOf(names, networkName), nil
+}
+
+// attachmentsOf returns the attachments of the endpoint names of the
+// network, skipping endpoints the plugins didn't name.
+func attachmentsOf(names []string, networkName string) []types.GCAttachment {
+	var attachments []types.GCAttachment
+	for _, name := range names {
+		if id, ok := strings.CutSuffix(name, "_"+networkName); ok && id != "" {
+			attachments = append(attachments, types.GCAttachment{ContainerID: id})
+		}
+	}
+	return attachments
+}
+
+// RemoveEndpoint removes the endpoint of the container completely, e.g. on
+// GC once the container is gone.
+func RemoveEndpoint(apiVersion int, containerID string, networkName string) error {
+	epName := ConstructEndpointName(containerID, pauseContainerNetNS, networkName)
+	if apiVersion == 2 {
+		return RemoveHcnEndpoint(epName)
+	}
+	return RemoveHnsEndpoint(epName, pauseContainerNetNS, containerID)
+}
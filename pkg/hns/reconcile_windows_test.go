@@ -0,0 +1,56 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hns
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+var _ = Describe("Reconcile", func() {
+	Describe("hasPolicy", func() {
+		stored := []json.RawMessage{
+			json.RawMessage(`{"Type": "OutBoundNAT", "ExceptionList": ["10.0.0.0/8", "192.168.0.0/16"], "Priority": 100}`),
+			json.RawMessage(`{"Type": "NAT", "InternalPort": 80, "ExternalPort": 8080, "Protocol": "tcp"}`),
+		}
+
+		It("matches policies HNS added defaults to", func() {
+			Expect(hasPolicy(stored, json.RawMessage(`{"Type": "OutBoundNAT", "ExceptionList": ["192.168.0.0/16"]}`))).To(BeTrue())
+			Expect(hasPolicy(stored, json.RawMessage(`{"type": "nat", "InternalPort": 80, "ExternalPort": 8080, "Protocol": "TCP"}`))).To(BeTrue())
+		})
+
+		It("doesn't match policies with other values", func() {
+			Expect(hasPolicy(stored, json.RawMessage(`{"Type": "OutBoundNAT", "ExceptionList": ["172.16.0.0/12"]}`))).To(BeFalse())
+			Expect(hasPolicy(stored, json.RawMessage(`{"Type": "NAT", "InternalPort": 80, "ExternalPort": 9090, "Protocol": "tcp"}`))).To(BeFalse())
+			Expect(hasPolicy(stored, json.RawMessage(`{"Type": "PA", "PA": "10.0.0.1"}`))).To(BeFalse())
+		})
+	})
+
+	It("takes the containers of a network from the names of its endpoints", func() {
+		Expect(attachmentsOf([]string{"c1_mynet", "c2_mynet", "c3_other", "_mynet", "manual"}, "mynet")).To(Equal([]types.GCAttachment{
+			{ContainerID: "c1"},
+			{ContainerID: "c2"},
+		}))
+	})
+
+	It("compares MACs written with dashes or colons", func() {
+		Expect(sameMAC("0E-2A-0A-01-02-03", "0e:2a:0a:01:02:03")).To(BeTrue())
+		Expect(sameMAC("0E-2A-0A-01-02-03", "0e:2a:0a:01:02:04")).To(BeFalse())
+	})
+})
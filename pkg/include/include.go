@@ -0,0 +1,323 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package include resolves the "includeFrom" key of plugin configurations:
+// a JSON object, read from a file or a local HTTP metadata endpoint, which
+// is merged into the configuration before the plugin parses it. Per-site
+// parameters, e.g. ranges or VLANs, can so be managed centrally without
+// rewriting the configuration lists of every node.
+//
+// Values of the configuration win over included ones; objects are merged
+// key by key. Included documents are cached for a minute, and the last one
+// fetched is used while the source can't be read, so a restarting metadata
+// service doesn't fail pod creation.
+package include
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+const (
+	// Key is the configuration key naming the document to include, an
+	// absolute file path or an http URL of a loopback or link-local host
+	Key = "includeFrom"
+
+	// EnvCacheDir overrides the directory included documents are cached in.
+	EnvCacheDir = "CNI_INCLUDE_CACHE_DIR"
+
+	// cacheMaxAge is how long a cached document is used without fetching
+	// it again
+	cacheMaxAge = time.Minute
+
+	// fetchTimeout bounds fetching a document over HTTP
+	fetchTimeout = 5 * time.Second
+
+	// maxSize bounds the size of a document
+	maxSize = 1 << 20
+)
+
+// Funcs returns the commands of a plugin resolving the includeFrom key of
+// the configuration first, for skel.PluginMainFuncs. DEL and GC go ahead
+// with the configuration as it is if the document can't be had, see
+// WrapCleanup.
+func Funcs(funcs skel.CNIFuncs) skel.CNIFuncs {
+	return skel.CNIFuncs{
+		Add:    Wrap(funcs.Add),
+		Check:  Wrap(funcs.Check),
+		Del:    WrapCleanup(funcs.Del),
+		GC:     WrapCleanup(funcs.GC),
+		Status: Wrap(funcs.Status),
+	}
+}
+
+// Wrap returns cmd resolving the includeFrom key of the configuration of
+// its arguments first.
+func Wrap(cmd func(_ *skel.CmdArgs) error) func(_ *skel.CmdArgs) error {
+	if cmd == nil {
+		return nil
+	}
+	return func(args *skel.CmdArgs) error {
+		data, err := Resolve(args.StdinData)
+		if err != nil {
+			return err
+		}
+		args.StdinData = data
+		return cmd(args)
+	}
+}
+
+// WrapCleanup is Wrap for commands cleaning up, which must not fail because
+// the included document is unreachable and not cached: cmd is run with the
+// configuration without the includeFrom key instead, releasing what it can
+// with the values of the configuration itself.
+func WrapCleanup(cmd func(_ *skel.CmdArgs) error) func(_ *skel.CmdArgs) error {
+	if cmd == nil {
+		return nil
+	}
+	return func(args *skel.CmdArgs) error {
+		data, err := Resolve(args.StdinData)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ignoring %s: %v\n", Key, err)
+			data = strip(args.StdinData)
+		}
+		args.StdinData = data
+		return cmd(args)
+	}
+}
+
+// Resolve returns the configuration with the document its includeFrom key
+// names merged in, and the key removed. A configuration without the key is
+// returned as is.
+func Resolve(conf []byte) ([]byte, error) {
+	if !bytes.Contains(conf, []byte(`"`+Key+`"`)) {
+		return conf, nil
+	}
+	c, err := decode(conf)
+	if err != nil {
+		// the plugin reports the invalid configuration
+		return conf, nil
+	}
+	raw, ok := c[Key]
+	if !ok {
+		return conf, nil
+	}
+	source, ok := raw.(string)
+	if !ok || source == "" {
+		return nil, fmt.Errorf("invalid %s %v, must be a file path or URL", Key, raw)
+	}
+
+	included, err := load(source)
+	if err != nil {
+		return nil, err
+	}
+	delete(c, Key)
+	merge(c, included)
+	return json.Marshal(c)
+}
+
+// strip returns the configuration without the includeFrom key.
+func strip(conf []byte) []byte {
+	c, err := decode(conf)
+	if err != nil {
+		return conf
+	}
+	delete(c, Key)
+	data, err := json.Marshal(c)
+	if err != nil {
+		return conf
+	}
+	return data
+}
+
+// merge sets the keys of src dst doesn't have, merging objects both have.
+func merge(dst, src map[string]interface{}) {
+	for k, v := range src {
+		have, ok := dst[k]
+		if !ok {
+			dst[k] = v
+			continue
+		}
+		haveObj, ok1 := have.(map[string]interface{})
+		obj, ok2 := v.(map[string]interface{})
+		if ok1 && ok2 {
+			merge(haveObj, obj)
+		}
+	}
+}
+
+// load returns the document of source, from the cache while it is fresh or
+// the source fails.
+func load(source string) (map[string]interface{}, error) {
+	cache := cachePath(source)
+	if fi, err := os.Stat(cache); err == nil && time.Since(fi.ModTime()) < cacheMaxAge {
+		if doc, err := readDoc(cache); err == nil {
+			return doc, nil
+		}
+	}
+
+	data, err := fetch(source)
+	if err == nil {
+		var doc map[string]interface{}
+		if doc, err = decode(data); err == nil {
+			writeCache(cache, data)
+			return doc, nil
+		}
+		err = fmt.Errorf("failed to parse %s %q: %v", Key, source, err)
+	}
+
+	doc, cacheErr := readDoc(cache)
+	if cacheErr != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "using the cached %s %q: %v\n", Key, source, err)
+	return doc, nil
+}
+
+func readDoc(path string) (map[string]interface{}, error) {
+	data, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decode(data)
+}
+
+// decode decodes a JSON object, keeping numbers as they are, so they are
+// encoded again without losing precision.
+func decode(data []byte) (map[string]interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var obj map[string]interface{}
+	if err := d.Decode(&obj); err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, fmt.Errorf("not a JSON object")
+	}
+	return obj, nil
+}
+
+// fetch reads the document of source, a file or a local HTTP endpoint.
+func fetch(source string) ([]byte, error) {
+	u, err := url.Parse(source)
+	if err != nil || u.Scheme == "" || u.Scheme == "file" || len(u.Scheme) == 1 {
+		// a file path, on windows with a drive letter
+		path := source
+		if err == nil && u.Scheme == "file" {
+			path = u.Path
+		}
+		if !filepath.IsAbs(path) {
+			return nil, fmt.Errorf("invalid %s %q, file paths must be absolute", Key, source)
+		}
+		data, err := readFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s %q: %v", Key, source, err)
+		}
+		return data, nil
+	}
+
+	if u.Scheme != "http" {
+		return nil, fmt.Errorf("invalid %s %q, must be a file path or http URL", Key, source)
+	}
+	if !localHost(u.Hostname()) {
+		return nil, fmt.Errorf("invalid %s %q, the host must be loopback or link-local", Key, source)
+	}
+	client := &http.Client{Timeout: fetchTimeout}
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s %q: %v", Key, source, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s %q: %s", Key, source, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s %q: %v", Key, source, err)
+	}
+	if len(data) > maxSize {
+		return nil, fmt.Errorf("%s %q is larger than %d bytes", Key, source, maxSize)
+	}
+	return data, nil
+}
+
+func readFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSize {
+		return nil, fmt.Errorf("larger than %d bytes", maxSize)
+	}
+	return data, nil
+}
+
+// localHost reports whether host is the loopback or a link-local address,
+// where node metadata services listen.
+func localHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsLinkLocalUnicast())
+}
+
+// CacheDir returns the directory included documents are cached in.
+func CacheDir() string {
+	if dir := os.Getenv(EnvCacheDir); dir != "" {
+		return dir
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "cni", "include")
+	}
+	return "/var/lib/cni/include"
+}
+
+func cachePath(source string) string {
+	sum := sha256.Sum256([]byte(source))
+	return filepath.Join(CacheDir(), hex.EncodeToString(sum[:16])+".json")
+}
+
+// writeCache caches the document. Failures are ignored, the cache only
+// spares fetches and bridges outages.
+func writeCache(path string, data []byte) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package include_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/include"
+)
+
+var _ = Describe("includeFrom", func() {
+	var dir string
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		GinkgoT().Setenv(include.EnvCacheDir, filepath.Join(dir, "cache"))
+	})
+
+	resolve := func(conf string) map[string]interface{} {
+		data, err := include.Resolve([]byte(conf))
+		Expect(err).NotTo(HaveOccurred())
+		c := map[string]interface{}{}
+		Expect(json.Unmarshal(data, &c)).To(Succeed())
+		return c
+	}
+
+	It("leaves a configuration without the key as it is", func() {
+		conf := []byte(`{"name": "test",  "type": "bridge"}`)
+		Expect(include.Resolve(conf)).To(Equal(conf))
+	})
+
+	It("merges a file into the configuration, the configuration winning", func() {
+		site := filepath.Join(dir, "site.json")
+		Expect(os.WriteFile(site, []byte(`{
+			"vlan": 42,
+			"mtu": 9000,
+			"ipam": {"ranges": [[{"subnet": "10.42.0.0/24"}]], "type": "static"}
+		}`), 0o644)).To(Succeed())
+
+		c := resolve(fmt.Sprintf(`{
+			"name": "test",
+			"type": "bridge",
+			"mtu": 1400,
+			"includeFrom": %q,
+			"ipam": {"type": "host-local"}
+		}`, site))
+		Expect(c).NotTo(HaveKey("includeFrom"))
+		Expect(c).To(HaveKeyWithValue("vlan", 42.0))
+		Expect(c).To(HaveKeyWithValue("mtu", 1400.0))
+		Expect(c["ipam"]).To(HaveKeyWithValue("type", "host-local"))
+		Expect(c["ipam"]).To(HaveKey("ranges"))
+	})
+
+	It("fetches a local endpoint, caches it and falls back to the cache", func() {
+		fetches := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			fetches++
+			fmt.Fprint(w, `{"vlan": 7}`)
+		}))
+		conf := fmt.Sprintf(`{"name": "test", "type": "bridge", "includeFrom": %q}`, server.URL+"/site")
+
+		Expect(resolve(conf)).To(HaveKeyWithValue("vlan", 7.0))
+		Expect(resolve(conf)).To(HaveKeyWithValue("vlan", 7.0))
+		Expect(fetches).To(Equal(1))
+
+		// once stale and the endpoint is gone, the cached copy is used
+		server.Close()
+		cached, err := filepath.Glob(filepath.Join(dir, "cache", "*.json"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cached).To(HaveLen(1))
+		old := time.Now().Add(-time.Hour)
+		Expect(os.Chtimes(cached[0], old, old)).To(Succeed())
+		Expect(resolve(conf)).To(HaveKeyWithValue("vlan", 7.0))
+
+		// without a cached copy, the failure is reported
+		Expect(os.Remove(cached[0])).To(Succeed())
+		_, err = include.Resolve([]byte(conf))
+		Expect(err).To(MatchError(ContainSubstring("failed to fetch includeFrom")))
+	})
+
+	It("cleans up with the configuration itself if the document is gone", func() {
+		conf := []byte(`{"name": "test", "type": "bridge", "bridge": "br0", "includeFrom": "/nonexistent/site.json"}`)
+		var seen []byte
+		cmd := func(args *skel.CmdArgs) error {
+			seen = args.StdinData
+			return nil
+		}
+		funcs := include.Funcs(skel.CNIFuncs{Add: cmd, Del: cmd})
+		Expect(funcs.Check).To(BeNil())
+
+		err := funcs.Add(&skel.CmdArgs{StdinData: conf})
+		Expect(err).To(MatchError(ContainSubstring("failed to read includeFrom")))
+		Expect(seen).To(BeNil())
+
+		Expect(funcs.Del(&skel.CmdArgs{StdinData: conf})).To(Succeed())
+		c := map[string]interface{}{}
+		Expect(json.Unmarshal(seen, &c)).To(Succeed())
+		Expect(c).To(Equal(map[string]interface{}{"name": "test", "type": "bridge", "bridge": "br0"}))
+	})
+
+	It("rejects remote hosts and relative paths", func() {
+		_, err := include.Resolve([]byte(`{"includeFrom": "http://config.example/site.json"}`))
+		Expect(err).To(MatchError(`invalid includeFrom "http://config.example/site.json", the host must be loopback or link-local`))
+		_, err = include.Resolve([]byte(`{"includeFrom": "site.json"}`))
+		Expect(err).To(MatchError(`invalid includeFrom "site.json", file paths must be absolute`))
+		_, err = include.Resolve([]byte(`{"includeFrom": 1}`))
+		Expect(err).To(MatchError("invalid includeFrom 1, must be a file path or URL"))
+	})
+})
@@ -16,10 +16,13 @@ package ip
 
 import (
 	"fmt"
+	"math"
+	"net"
 	"syscall"
 	"time"
 
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 const SETTLE_INTERVAL = 50 * time.Millisecond
@@ -66,3 +69,75 @@ func SettleAddresses(ifName string, timeout int) error {
 		time.Sleep(SETTLE_INTERVAL)
 	}
 }
+
+// lifetimeForever is the lifetime of addresses which never expire, the
+// kernel's INFINITY_LIFE_TIME.
+const lifetimeForever = math.MaxUint32
+
+// AddrOptions are the properties of an address EnsureAddr sets beyond its
+// prefix. The zero value is an address which never expires, as AddrAdd
+// adds it.
+type AddrOptions struct {
+	// ValidLifetime is how long the address is kept, forever if zero. The
+	// kernel removes it once the lifetime is over.
+	ValidLifetime time.Duration
+	// PreferredLifetime is how long the address is used as the source of
+	// new connections, the whole ValidLifetime if zero. Afterwards it is
+	// deprecated.
+	PreferredLifetime time.Duration
+	// Deprecated deprecates the address at once: it still serves the
+	// connections using it, but new ones use other addresses of the link.
+	Deprecated bool
+	// NoPrefixRoute keeps the kernel from adding the route to the prefix
+	// of the address. Changing it on an IPv4 address the link has already
+	// leaves its prefix route as it is.
+	NoPrefixRoute bool
+}
+
+// lifetimeSeconds rounds d up to whole seconds, as the kernel counts them.
+func lifetimeSeconds(d time.Duration) int {
+	if d <= 0 {
+		return lifetimeForever
+	}
+	s := (d + time.Second - 1) / time.Second
+	if s >= lifetimeForever {
+		return lifetimeForever - 1
+	}
+	return int(s)
+}
+
+// EnsureAddr adds the address to the link with the options, or changes the
+// options of the address in place if the link has it already, so the
+// connections using it survive. Deprecating the addresses a link is moved
+// away from, with a valid lifetime, lets their connections drain before
+// the kernel removes them.
+func EnsureAddr(link netlink.Link, ipn *net.IPNet, opts *AddrOptions) error {
+	if opts == nil {
+		opts = &AddrOptions{}
+	}
+	if opts.ValidLifetime < 0 || opts.PreferredLifetime < 0 {
+		return fmt.Errorf("invalid lifetimes of %s, must not be negative", ipn)
+	}
+	if opts.ValidLifetime > 0 && opts.PreferredLifetime > opts.ValidLifetime {
+		return fmt.Errorf("preferred lifetime %s of %s exceeds its valid lifetime %s", opts.PreferredLifetime, ipn, opts.ValidLifetime)
+	}
+
+	addr := &netlink.Addr{IPNet: ipn}
+	valid := lifetimeSeconds(opts.ValidLifetime)
+	preferred := valid
+	if opts.PreferredLifetime > 0 {
+		preferred = lifetimeSeconds(opts.PreferredLifetime)
+	}
+	if opts.Deprecated {
+		preferred = 0
+	}
+	addr.ValidLft, addr.PreferedLft = valid, preferred
+	if opts.NoPrefixRoute {
+		addr.Flags |= unix.IFA_F_NOPREFIXROUTE
+	}
+
+	if err := netlink.AddrReplace(link, addr); err != nil {
+		return fmt.Errorf("failed to set %s on %q: %v", ipn, link.Attrs().Name, err)
+	}
+	return nil
+}
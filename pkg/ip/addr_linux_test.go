@@ -0,0 +1,103 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip_test
+
+import (
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+)
+
+var _ = Describe("EnsureAddr", func() {
+	var testNS ns.NetNS
+
+	BeforeEach(func() {
+		var err error
+		testNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(testNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(testNS)).To(Succeed())
+	})
+
+	It("sets the lifetimes and flags of an address and deprecates it in place", func() {
+		Expect(testNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "addr0"},
+				PeerName:  "addr1",
+			})).To(Succeed())
+			link, err := netlink.LinkByName("addr0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+
+			ipn := &net.IPNet{IP: net.ParseIP("192.0.2.10"), Mask: net.CIDRMask(24, 32)}
+			find := func() netlink.Addr {
+				addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(addrs).To(HaveLen(1))
+				return addrs[0]
+			}
+			prefixRoutes := func() []netlink.Route {
+				_, dst, _ := net.ParseCIDR("192.0.2.0/24")
+				routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: dst}, netlink.RT_FILTER_DST)
+				Expect(err).NotTo(HaveOccurred())
+				return routes
+			}
+
+			Expect(ip.EnsureAddr(link, ipn, &ip.AddrOptions{
+				ValidLifetime:     300 * time.Second,
+				PreferredLifetime: 120 * time.Second,
+				NoPrefixRoute:     true,
+			})).To(Succeed())
+			addr := find()
+			Expect(addr.ValidLft).To(BeNumerically("~", 300, 2))
+			Expect(addr.PreferedLft).To(BeNumerically("~", 120, 2))
+			Expect(addr.Flags & unix.IFA_F_NOPREFIXROUTE).NotTo(BeZero())
+			Expect(prefixRoutes()).To(BeEmpty())
+
+			// deprecating keeps the address, only new connections avoid it
+			Expect(ip.EnsureAddr(link, ipn, &ip.AddrOptions{ValidLifetime: time.Minute, Deprecated: true})).To(Succeed())
+			addr = find()
+			Expect(addr.ValidLft).To(BeNumerically("~", 60, 2))
+			Expect(addr.PreferedLft).To(BeZero())
+			Expect(addr.Flags & unix.IFA_F_DEPRECATED).NotTo(BeZero())
+
+			// without options it never expires
+			Expect(ip.EnsureAddr(link, ipn, nil)).To(Succeed())
+			addr = find()
+			Expect(addr.ValidLft).To(BeEquivalentTo(uint32(0xffffffff)))
+			Expect(addr.Flags & unix.IFA_F_DEPRECATED).To(BeZero())
+			return nil
+		})).To(Succeed())
+	})
+
+	It("rejects a preferred lifetime beyond the valid one", func() {
+		ipn := &net.IPNet{IP: net.ParseIP("192.0.2.10"), Mask: net.CIDRMask(24, 32)}
+		err := ip.EnsureAddr(nil, ipn, &ip.AddrOptions{ValidLifetime: time.Minute, PreferredLifetime: time.Hour})
+		Expect(err).To(MatchError("preferred lifetime 1h0m0s of 192.0.2.10/24 exceeds its valid lifetime 1m0s"))
+	})
+})
@@ -0,0 +1,72 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// SendGratuitousARP announces the IPv4 address ip of the interface ifName to
+// its LAN with an ARP request for the address itself, so the neighbors
+// update their caches, e.g. for an address which moved to this host.
+func SendGratuitousARP(ifName string, ip net.IP) error {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return fmt.Errorf("gratuitous ARP needs an IPv4 address, not %s", ip)
+	}
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to look up %q: %v", ifName, err)
+	}
+	if len(iface.HardwareAddr) != 6 {
+		return fmt.Errorf("%q has no Ethernet address to announce %s from", ifName, ip)
+	}
+
+	proto := htons(unix.ETH_P_ARP)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, int(proto))
+	if err != nil {
+		return fmt.Errorf("failed to open ARP socket: %v", err)
+	}
+	defer unix.Close(fd)
+
+	// Ethernet, IPv4, a request whose sender and target are the address
+	packet := make([]byte, 28)
+	binary.BigEndian.PutUint16(packet[0:], 1)
+	binary.BigEndian.PutUint16(packet[2:], unix.ETH_P_IP)
+	packet[4], packet[5] = 6, 4
+	binary.BigEndian.PutUint16(packet[6:], 1)
+	copy(packet[8:], iface.HardwareAddr)
+	copy(packet[14:], ip4)
+	copy(packet[24:], ip4)
+
+	to := &unix.SockaddrLinklayer{
+		Protocol: proto,
+		Ifindex:  iface.Index,
+		Halen:    6,
+		Addr:     [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+	if err := unix.Sendto(fd, packet, 0, to); err != nil {
+		return fmt.Errorf("failed to announce %s on %q: %v", ip, ifName, err)
+	}
+	return nil
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,109 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip_test
+
+import (
+	"encoding/binary"
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+)
+
+var _ = Describe("SendGratuitousARP", func() {
+	var testNS ns.NetNS
+
+	BeforeEach(func() {
+		var err error
+		testNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(testNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(testNS)).To(Succeed())
+	})
+
+	It("broadcasts an ARP request for the address from the interface", func() {
+		Expect(testNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "garp0"},
+				PeerName:  "garp1",
+			})).To(Succeed())
+			var mac net.HardwareAddr
+			for _, name := range []string{"garp0", "garp1"} {
+				link, err := netlink.LinkByName(name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.LinkSetUp(link)).To(Succeed())
+				if name == "garp0" {
+					mac = link.Attrs().HardwareAddr
+				}
+			}
+			peer, err := net.InterfaceByName("garp1")
+			Expect(err).NotTo(HaveOccurred())
+
+			arp := uint16(unix.ETH_P_ARP)
+			proto := int(arp<<8 | arp>>8)
+			fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM, proto)
+			Expect(err).NotTo(HaveOccurred())
+			defer unix.Close(fd)
+			Expect(unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: uint16(proto), Ifindex: peer.Index})).To(Succeed())
+			Expect(unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 5})).To(Succeed())
+
+			Expect(ip.SendGratuitousARP("garp0", net.ParseIP("192.0.2.10"))).To(Succeed())
+
+			packet := make([]byte, 64)
+			n, from, err := unix.Recvfrom(fd, packet, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(BeNumerically(">=", 28))
+			Expect(from.(*unix.SockaddrLinklayer).Pkttype).To(BeEquivalentTo(unix.PACKET_BROADCAST))
+			Expect(binary.BigEndian.Uint16(packet[6:])).To(BeEquivalentTo(1))
+			Expect(net.HardwareAddr(packet[8:14])).To(Equal(mac))
+			Expect(net.IP(packet[14:18]).String()).To(Equal("192.0.2.10"))
+			Expect(net.IP(packet[24:28]).String()).To(Equal("192.0.2.10"))
+			return nil
+		})).To(Succeed())
+	})
+
+	It("rejects IPv6 addresses", func() {
+		err := ip.SendGratuitousARP("lo", net.ParseIP("2001:db8::1"))
+		Expect(err).To(MatchError("gratuitous ARP needs an IPv4 address, not 2001:db8::1"))
+	})
+})
+
+var _ = Describe("StaticNAT", func() {
+	DescribeTable("validates the public address and the interface",
+		func(nat ip.StaticNAT, expected string) {
+			err := nat.Validate()
+			if expected == "" {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(err).To(MatchError(expected))
+			}
+		},
+		Entry("valid", ip.StaticNAT{PublicIP: "192.0.2.10", Interface: "eth0"}, ""),
+		Entry("IPv6", ip.StaticNAT{PublicIP: "2001:db8::10", Interface: "eth0"}, `invalid staticNAT publicIP "2001:db8::10", must be an IPv4 address`),
+		Entry("garbage", ip.StaticNAT{PublicIP: "nope", Interface: "eth0"}, `invalid staticNAT publicIP "nope", must be an IPv4 address`),
+		Entry("no interface", ip.StaticNAT{PublicIP: "192.0.2.10"}, "staticNAT requires an interface"),
+	)
+})
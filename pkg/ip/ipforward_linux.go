@@ -19,6 +19,7 @@ import (
 	"os"
 
 	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 )
 
 func EnableIP4Forward() error {
@@ -52,6 +53,29 @@ func EnableForward(ips []*current.IPConfig) error {
 	return nil
 }
 
+// EnableForwardTx enables forwarding like EnableForward, recording the
+// change in tx so it can be rolled back if a later step fails.
+func EnableForwardTx(tx *sysctl.Tx, ips []*current.IPConfig) error {
+	v4 := false
+	v6 := false
+
+	for _, ip := range ips {
+		isV4 := ip.Address.IP.To4() != nil
+		if isV4 && !v4 {
+			if err := tx.Set("net.ipv4.ip_forward", "1"); err != nil {
+				return err
+			}
+			v4 = true
+		} else if !isV4 && !v6 {
+			if err := tx.Set("net.ipv6.conf.all.forwarding", "1"); err != nil {
+				return err
+			}
+			v6 = true
+		}
+	}
+	return nil
+}
+
 func echo1(f string) error {
 	if content, err := os.ReadFile(f); err == nil {
 		if bytes.Equal(bytes.TrimSpace(content), []byte("1")) {
@@ -17,13 +17,86 @@ package ip
 import (
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 
 	"github.com/coreos/go-iptables/iptables"
+	"github.com/mattn/go-shellwords"
 )
 
+// MasqOptions bound the source NAT of masqueraded traffic, so one network
+// can't exhaust the ports, and conntrack entries, of the node unnoticed.
+type MasqOptions struct {
+	// PortRange restricts the source ports of masqueraded TCP, UDP and
+	// SCTP connections, e.g. "32768-60999"
+	PortRange string
+	// RandomFully picks source ports at random, which avoids the port
+	// clashes of many connections to the same destination
+	RandomFully bool
+	// Mark is set on the conntrack entries of masqueraded connections, so
+	// those of a network can be counted and limited by their mark
+	Mark uint32
+}
+
+// Enabled reports whether any option is set.
+func (o *MasqOptions) Enabled() bool {
+	return o != nil && (o.PortRange != "" || o.RandomFully || o.Mark != 0)
+}
+
+// Validate checks the port range.
+func (o *MasqOptions) Validate() error {
+	if o == nil || o.PortRange == "" {
+		return nil
+	}
+	first, last, isRange := strings.Cut(o.PortRange, "-")
+	lo, err := strconv.ParseUint(first, 10, 16)
+	hi := lo
+	if err == nil && isRange {
+		hi, err = strconv.ParseUint(last, 10, 16)
+	}
+	if err != nil || lo == 0 || hi < lo {
+		return fmt.Errorf("invalid masquerade port range %q", o.PortRange)
+	}
+	return nil
+}
+
+// masqRules returns the MASQUERADE rules of the chain for traffic not to
+// dst. With a port range, it is only applied to the protocols with ports,
+// the others are masqueraded without.
+func (o *MasqOptions) masqRules(dst, comment string) [][]string {
+	target := []string{"-j", "MASQUERADE"}
+	if o != nil && o.RandomFully {
+		target = append(target, "--random-fully")
+	}
+	rule := func(proto []string, extra ...string) []string {
+		r := append(append([]string{}, proto...), "!", "-d", dst)
+		r = append(r, target...)
+		r = append(r, extra...)
+		return append(r, "-m", "comment", "--comment", comment)
+	}
+
+	var rules [][]string
+	if o != nil && o.Mark != 0 {
+		mark := fmt.Sprintf("%#x/%#x", o.Mark, o.Mark)
+		rules = append(rules, []string{"!", "-d", dst, "-j", "CONNMARK", "--set-xmark", mark, "-m", "comment", "--comment", comment})
+	}
+	if o != nil && o.PortRange != "" {
+		for _, proto := range []string{"tcp", "udp", "sctp"} {
+			rules = append(rules, rule([]string{"-p", proto}, "--to-ports", o.PortRange))
+		}
+	}
+	return append(rules, rule(nil))
+}
+
 // SetupIPMasq installs iptables rules to masquerade traffic
 // coming from ip of ipn and going outside of ipn
 func SetupIPMasq(ipn *net.IPNet, chain string, comment string) error {
+	return SetupIPMasqWithOptions(ipn, chain, comment, nil)
+}
+
+// SetupIPMasqWithOptions is SetupIPMasq, masquerading as opts say. opts
+// may be nil.
+func SetupIPMasqWithOptions(ipn *net.IPNet, chain string, comment string, opts *MasqOptions) error {
 	isV6 := ipn.IP.To4() == nil
 
 	var ipt *iptables.IPTables
@@ -66,8 +139,10 @@ func SetupIPMasq(ipn *net.IPNet, chain string, comment string) error {
 
 	// Don't masquerade multicast - pods should be able to talk to other pods
 	// on the local network via multicast.
-	if err := ipt.AppendUnique("nat", chain, "!", "-d", multicastNet, "-j", "MASQUERADE", "-m", "comment", "--comment", comment); err != nil {
-		return err
+	for _, rule := range opts.masqRules(multicastNet, comment) {
+		if err := ipt.AppendUnique("nat", chain, rule...); err != nil {
+			return err
+		}
 	}
 
 	// Packets from the specific IP of this network will hit the chain
@@ -114,6 +189,42 @@ func TeardownIPMasq(ipn *net.IPNet, chain string, comment string) error {
 	return nil
 }
 
+// TeardownIPMasqChain undoes the effects of SetupIPMasq for every address
+// masqueraded through chain, for when the addresses are no longer known,
+// e.g. because the netns of the container is gone with them.
+func TeardownIPMasqChain(chain string) error {
+	for _, proto := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return fmt.Errorf("failed to locate iptables: %v", err)
+		}
+
+		rules, err := ipt.List("nat", "POSTROUTING")
+		if err != nil {
+			return fmt.Errorf("failed to list rules: %v", err)
+		}
+		for _, rule := range rules {
+			if !strings.HasSuffix(rule, "-j "+chain) {
+				continue
+			}
+			ruleParts, err := shellwords.Parse(rule)
+			if err != nil {
+				return fmt.Errorf("error parsing iptables rule: %s: %v", rule, err)
+			}
+			ruleParts = ruleParts[2:] // List results always include an -A CHAINNAME
+			if err := ipt.Delete("nat", "POSTROUTING", ruleParts...); err != nil && !isNotExist(err) {
+				return err
+			}
+		}
+
+		err = ipt.ClearAndDeleteChain("nat", chain)
+		if err != nil && !isNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
 // isNotExist returnst true if the error is from iptables indicating
 // that the target does not exist.
 func isNotExist(err error) bool {
@@ -0,0 +1,65 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MasqOptions", func() {
+	DescribeTable("validates the port range",
+		func(portRange string, valid bool) {
+			err := (&MasqOptions{PortRange: portRange}).Validate()
+			if valid {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(err).To(MatchError(`invalid masquerade port range "` + portRange + `"`))
+			}
+		},
+		Entry("range", "32768-60999", true),
+		Entry("single port", "40000", true),
+		Entry("reversed", "60999-32768", false),
+		Entry("port 0", "0-1024", false),
+		Entry("out of range", "1024-65536", false),
+		Entry("garbage", "high", false),
+	)
+
+	It("masquerades as before without options", func() {
+		var o *MasqOptions
+		Expect(o.Enabled()).To(BeFalse())
+		Expect(o.masqRules("224.0.0.0/4", "c")).To(Equal([][]string{
+			{"!", "-d", "224.0.0.0/4", "-j", "MASQUERADE", "-m", "comment", "--comment", "c"},
+		}))
+	})
+
+	It("marks the connections and restricts the ports of the protocols with ports", func() {
+		o := &MasqOptions{PortRange: "32768-60999", RandomFully: true, Mark: 0x10000}
+		Expect(o.Enabled()).To(BeTrue())
+		var rules []string
+		for _, r := range o.masqRules("224.0.0.0/4", "c") {
+			rules = append(rules, strings.Join(r, " "))
+		}
+		Expect(rules).To(Equal([]string{
+			"! -d 224.0.0.0/4 -j CONNMARK --set-xmark 0x10000/0x10000 -m comment --comment c",
+			"-p tcp ! -d 224.0.0.0/4 -j MASQUERADE --random-fully --to-ports 32768-60999 -m comment --comment c",
+			"-p udp ! -d 224.0.0.0/4 -j MASQUERADE --random-fully --to-ports 32768-60999 -m comment --comment c",
+			"-p sctp ! -d 224.0.0.0/4 -j MASQUERADE --random-fully --to-ports 32768-60999 -m comment --comment c",
+			"! -d 224.0.0.0/4 -j MASQUERADE --random-fully -m comment --comment c",
+		}))
+	})
+})
@@ -24,6 +24,7 @@ import (
 	"github.com/safchain/ethtool"
 	"github.com/vishvananda/netlink"
 
+	cnierrors "github.com/containernetworking/plugins/pkg/errors"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 )
@@ -90,7 +91,7 @@ func makeVeth(name, vethPeerName string, mtu int, mac string, hostNS ns.NetNS) (
 			if peerExists(peerName) && vethPeerName == "" {
 				continue
 			}
-			return peerName, veth, fmt.Errorf("container veth name provided (%v) already exists", name)
+			return peerName, veth, cnierrors.Conflict(name, fmt.Errorf("container veth name provided (%v) already exists", name))
 		default:
 			return peerName, veth, fmt.Errorf("failed to make veth pair: %v", err)
 		}
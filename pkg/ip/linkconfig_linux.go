@@ -0,0 +1,172 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// LinkConfig is the IP configuration of a link a plugin takes over, e.g.
+// the bridge plugin from its uplink, in a form that can be persisted to
+// give it back later.
+type LinkConfig struct {
+	Addrs  []string    `json:"addrs,omitempty"`
+	Routes []LinkRoute `json:"routes,omitempty"`
+}
+
+// LinkRoute is a route of a LinkConfig.
+type LinkRoute struct {
+	Dst      string `json:"dst,omitempty"`
+	GW       string `json:"gw,omitempty"`
+	Src      string `json:"src,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	Table    int    `json:"table,omitempty"`
+	Scope    int    `json:"scope,omitempty"`
+	Protocol int    `json:"protocol,omitempty"`
+}
+
+// GetLinkConfig returns the global addresses and the non-kernel routes
+// configured on the link.
+func GetLinkConfig(link netlink.Link) (*LinkConfig, error) {
+	conf := &LinkConfig{}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of %q: %v", link.Attrs().Name, err)
+	}
+	for _, a := range addrs {
+		if a.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		conf.Addrs = append(conf.Addrs, a.IPNet.String())
+	}
+
+	filter := &netlink.Route{LinkIndex: link.Attrs().Index, Table: unix.RT_TABLE_UNSPEC}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, filter, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes of %q: %v", link.Attrs().Name, err)
+	}
+	for _, r := range routes {
+		// kernel routes come back with the addresses
+		if r.Protocol == unix.RTPROT_KERNEL || r.Table == unix.RT_TABLE_LOCAL {
+			continue
+		}
+		if r.Dst != nil && (r.Dst.IP.IsLinkLocalUnicast() || r.Dst.IP.IsMulticast()) {
+			continue
+		}
+		lr := LinkRoute{
+			Priority: r.Priority,
+			Table:    r.Table,
+			Scope:    int(r.Scope),
+			Protocol: int(r.Protocol),
+		}
+		if r.Dst != nil {
+			lr.Dst = r.Dst.String()
+		}
+		if r.Gw != nil {
+			lr.GW = r.Gw.String()
+		}
+		if r.Src != nil {
+			lr.Src = r.Src.String()
+		}
+		conf.Routes = append(conf.Routes, lr)
+	}
+
+	return conf, nil
+}
+
+// Parse returns the addresses and routes of the configuration.
+func (c *LinkConfig) Parse() ([]netlink.Addr, []netlink.Route, error) {
+	var addrs []netlink.Addr
+	for _, a := range c.Addrs {
+		ipn, err := netlink.ParseIPNet(a)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid address %q: %v", a, err)
+		}
+		addrs = append(addrs, netlink.Addr{IPNet: ipn})
+	}
+
+	var routes []netlink.Route
+	for _, lr := range c.Routes {
+		r := netlink.Route{
+			Priority: lr.Priority,
+			Table:    lr.Table,
+			Scope:    netlink.Scope(lr.Scope),
+			Protocol: netlink.RouteProtocol(lr.Protocol),
+			Gw:       net.ParseIP(lr.GW),
+			Src:      net.ParseIP(lr.Src),
+		}
+		if lr.Dst != "" {
+			_, dst, err := net.ParseCIDR(lr.Dst)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid route %q: %v", lr.Dst, err)
+			}
+			r.Dst = dst
+		}
+		routes = append(routes, r)
+	}
+
+	return addrs, routes, nil
+}
+
+// Remove removes the addresses of the configuration from the link, and
+// with them the routes depending on them.
+func (c *LinkConfig) Remove(link netlink.Link) error {
+	addrs, _, err := c.Parse()
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if err := netlink.AddrDel(link, &a); err != nil && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+			return fmt.Errorf("failed to remove %s from %q: %v", a.IPNet, link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// Apply adds the addresses of the configuration to the link, then the
+// routes via the link.
+func (c *LinkConfig) Apply(link netlink.Link) error {
+	addrs, routes, err := c.Parse()
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if err := netlink.AddrAdd(link, &a); err != nil && !errors.Is(err, syscall.EEXIST) {
+			return fmt.Errorf("failed to add %s to %q: %v", a.IPNet, link.Attrs().Name, err)
+		}
+	}
+	for _, r := range routes {
+		r.LinkIndex = link.Attrs().Index
+		if err := netlink.RouteReplace(&r); err != nil {
+			return fmt.Errorf("failed to add route %s via %q: %v", r.String(), link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// MoveLinkConfig moves the configuration from one link to another.
+func MoveLinkConfig(c *LinkConfig, from, to netlink.Link) error {
+	if err := c.Remove(from); err != nil {
+		return err
+	}
+	return c.Apply(to)
+}
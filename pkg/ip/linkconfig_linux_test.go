@@ -0,0 +1,87 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip_test
+
+import (
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+)
+
+var _ = Describe("LinkConfig", func() {
+	var testNS ns.NetNS
+
+	BeforeEach(func() {
+		var err error
+		testNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(testNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(testNS)).To(Succeed())
+	})
+
+	It("moves the addresses and routes of a link to another", func() {
+		Expect(testNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "from0"},
+				PeerName:  "to0",
+			})).To(Succeed())
+			from, err := netlink.LinkByName("from0")
+			Expect(err).NotTo(HaveOccurred())
+			to, err := netlink.LinkByName("to0")
+			Expect(err).NotTo(HaveOccurred())
+			for _, l := range []netlink.Link{from, to} {
+				Expect(netlink.LinkSetUp(l)).To(Succeed())
+			}
+
+			addr, err := netlink.ParseAddr("192.0.2.10/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(from, addr)).To(Succeed())
+			_, dst, _ := net.ParseCIDR("198.51.100.0/24")
+			Expect(netlink.RouteAdd(&netlink.Route{
+				LinkIndex: from.Attrs().Index,
+				Dst:       dst,
+				Gw:        net.ParseIP("192.0.2.1"),
+			})).To(Succeed())
+
+			conf, err := ip.GetLinkConfig(from)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conf.Addrs).To(Equal([]string{"192.0.2.10/24"}))
+			Expect(conf.Routes).To(HaveLen(1))
+			Expect(conf.Routes[0].Dst).To(Equal("198.51.100.0/24"))
+			Expect(conf.Routes[0].GW).To(Equal("192.0.2.1"))
+
+			Expect(ip.MoveLinkConfig(conf, from, to)).To(Succeed())
+
+			addrs, err := netlink.AddrList(from, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(BeEmpty())
+			moved, err := ip.GetLinkConfig(to)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(moved).To(Equal(conf))
+			return nil
+		})).To(Succeed())
+	})
+})
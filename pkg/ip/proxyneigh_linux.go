@@ -0,0 +1,127 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+)
+
+// ProxyNeighbors makes host interfaces answer ARP (IPv4) and NDP (IPv6)
+// on behalf of container addresses routed elsewhere, so those are
+// reachable from the interfaces' LAN without NAT.
+type ProxyNeighbors struct {
+	ARP        bool
+	NDP        bool
+	Interfaces []string
+}
+
+// Enabled reports whether any address family is proxied.
+func (p *ProxyNeighbors) Enabled() bool {
+	return (p.ARP || p.NDP) && len(p.Interfaces) > 0
+}
+
+// Validate checks that proxying has interfaces to answer on.
+func (p *ProxyNeighbors) Validate() error {
+	if (p.ARP || p.NDP) && len(p.Interfaces) == 0 {
+		return fmt.Errorf("proxyARP and proxyNDP require proxyInterfaces")
+	}
+	return nil
+}
+
+func (p *ProxyNeighbors) proxies(addr net.IP) bool {
+	if addr.To4() != nil {
+		return p.ARP
+	}
+	return p.NDP
+}
+
+// Setup turns on proxy_arp or proxy_ndp on every interface, recording the
+// change in tx, and installs a proxy entry for each address. Entries of
+// interfaces handled before a failing one are removed again.
+func (p *ProxyNeighbors) Setup(tx *sysctl.Tx, addrs []net.IP) error {
+	for _, name := range p.Interfaces {
+		if p.ARP {
+			if err := tx.Set(fmt.Sprintf("net/ipv4/conf/%s/proxy_arp", name), "1"); err != nil {
+				return fmt.Errorf("failed to enable proxy ARP on %q: %v", name, err)
+			}
+		}
+		if p.NDP {
+			if err := tx.SetOptional(fmt.Sprintf("net/ipv6/conf/%s/proxy_ndp", name), "1"); err != nil {
+				return fmt.Errorf("failed to enable proxy NDP on %q: %v", name, err)
+			}
+		}
+	}
+
+	for i, name := range p.Interfaces {
+		if err := p.update(name, addrs, netlink.NeighAdd, syscall.EEXIST); err != nil {
+			_ = p.teardown(p.Interfaces[:i+1], addrs)
+			return err
+		}
+	}
+	return nil
+}
+
+// Teardown removes the proxy entries of the addresses. Entries and
+// interfaces already gone are skipped. The sysctls stay on, other
+// containers behind the same interfaces rely on them.
+func (p *ProxyNeighbors) Teardown(addrs []net.IP) error {
+	return p.teardown(p.Interfaces, addrs)
+}
+
+func (p *ProxyNeighbors) teardown(names []string, addrs []net.IP) error {
+	var errs []error
+	for _, name := range names {
+		if err := p.update(name, addrs, netlink.NeighDel, syscall.ENOENT); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *ProxyNeighbors) update(name string, addrs []net.IP, op func(*netlink.Neigh) error, ignore syscall.Errno) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok && ignore == syscall.ENOENT {
+			return nil
+		}
+		return fmt.Errorf("failed to look up proxy interface %q: %v", name, err)
+	}
+	for _, addr := range addrs {
+		if !p.proxies(addr) {
+			continue
+		}
+		family := netlink.FAMILY_V6
+		if addr.To4() != nil {
+			family = netlink.FAMILY_V4
+		}
+		neigh := &netlink.Neigh{
+			LinkIndex: link.Attrs().Index,
+			Family:    family,
+			Flags:     netlink.NTF_PROXY,
+			IP:        addr,
+		}
+		if err := op(neigh); err != nil && !errors.Is(err, ignore) {
+			return fmt.Errorf("failed to update proxy neighbor %s on %q: %v", addr, name, err)
+		}
+	}
+	return nil
+}
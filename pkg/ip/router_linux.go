@@ -0,0 +1,175 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// RouterSolicitationInterval is the time between the router solicitations
+// of SolicitRouter. It is shorter than RFC 4861's 4 seconds, as ADD waits
+// on the answer.
+const RouterSolicitationInterval = time.Second
+
+const (
+	icmpv6RouterSolicitation  = 133
+	icmpv6RouterAdvertisement = 134
+)
+
+// allRouters is the link-local all-routers multicast address, ff02::2
+var allRouters = net.ParseIP("ff02::2")
+
+// Router is a default router learned from its router advertisement.
+type Router struct {
+	// Addr is the link-local address of the router
+	Addr net.IP
+	// Lifetime is how long the router is a default router, from its
+	// advertisement
+	Lifetime time.Duration
+}
+
+// SolicitRouter sends IPv6 router solicitations from the interface ifName,
+// every RouterSolicitationInterval, until a router advertises itself as a
+// default router and the kernel has added the default route through it.
+// The kernel only does if the interface accepts router advertisements, see
+// net.ipv6.conf.<ifName>.accept_ra. It must be called in the network
+// namespace of the interface, which must be up.
+func SolicitRouter(ifName string, timeout time.Duration) (*Router, error) {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	deadline := time.Now().Add(timeout)
+
+	conn, err := net.ListenPacket("ip6:ipv6-icmp", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ICMPv6 socket: %v", err)
+	}
+	defer conn.Close()
+	if err := setSolicitationOptions(conn.(*net.IPConn), ifName); err != nil {
+		return nil, fmt.Errorf("failed to set up ICMPv6 socket on %q: %v", ifName, err)
+	}
+
+	// type, code, checksum and 4 reserved bytes; the kernel fills in the
+	// checksum of ICMPv6 sockets
+	solicitation := []byte{icmpv6RouterSolicitation, 0, 0, 0, 0, 0, 0, 0}
+	buf := make([]byte, 1500)
+	var router *Router
+	for router == nil {
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("no router advertised itself on %q within %v", ifName, timeout)
+		}
+		// the interface's link-local address may still be tentative, a
+		// failed solicitation is retried with the next one
+		_, _ = conn.WriteTo(solicitation, &net.IPAddr{IP: allRouters, Zone: ifName})
+
+		wait := time.Now().Add(RouterSolicitationInterval)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		if err := conn.SetReadDeadline(wait); err != nil {
+			return nil, err
+		}
+		for router == nil {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, fmt.Errorf("failed to read router advertisement on %q: %v", ifName, err)
+			}
+			router = parseRouterAdvertisement(buf[:n], from.(*net.IPAddr).IP)
+		}
+	}
+
+	// the kernel processes the advertisement next to the socket
+	for {
+		ok, err := hasDefaultRoute(link, router.Addr)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return router, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("router %s advertised itself on %q, but no default route through it was added within %v", router.Addr, ifName, timeout)
+		}
+		time.Sleep(SETTLE_INTERVAL)
+	}
+}
+
+// setSolicitationOptions binds the socket to the interface and sets the hop
+// limit of 255 routers require of solicitations.
+func setSolicitationOptions(conn *net.IPConn, ifName string) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if serr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, ifName); serr != nil {
+			return
+		}
+		serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_HOPS, 255)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// parseRouterAdvertisement returns the router of an advertisement from a
+// link-local address with a router lifetime, or nil for other messages.
+func parseRouterAdvertisement(msg []byte, from net.IP) *Router {
+	if len(msg) < 16 || msg[0] != icmpv6RouterAdvertisement || msg[1] != 0 || !from.IsLinkLocalUnicast() {
+		return nil
+	}
+	lifetime := binary.BigEndian.Uint16(msg[6:8])
+	if lifetime == 0 {
+		return nil
+	}
+	return &Router{Addr: from, Lifetime: time.Duration(lifetime) * time.Second}
+}
+
+// hasDefaultRoute reports whether there is an IPv6 default route through gw
+// on link, alone or as a path of a multipath route.
+func hasDefaultRoute(link netlink.Link, gw net.IP) (bool, error) {
+	routes, err := netlink.RouteList(link, netlink.FAMILY_V6)
+	if err != nil {
+		return false, fmt.Errorf("failed to list routes: %v", err)
+	}
+	for _, r := range routes {
+		if r.Dst != nil {
+			if ones, _ := r.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		if r.Gw.Equal(gw) {
+			return true, nil
+		}
+		for _, nh := range r.MultiPath {
+			if nh.Gw.Equal(gw) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip_test
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+)
+
+var _ = Describe("SolicitRouter", func() {
+	var podNS, routerNS ns.NetNS
+
+	// upWithoutDAD brings the link up with its link-local address usable
+	// right away
+	upWithoutDAD := func(name string) {
+		_, err := sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/accept_dad", name), "0")
+		Expect(err).NotTo(HaveOccurred())
+		link, err := netlink.LinkByName(name)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(netlink.LinkSetUp(link)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		podNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		routerNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(podNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs:     netlink.LinkAttrs{Name: "eth0"},
+				PeerName:      "rtr0",
+				PeerNamespace: netlink.NsFd(int(routerNS.Fd())),
+			})).To(Succeed())
+			upWithoutDAD("eth0")
+			return nil
+		})).To(Succeed())
+		Expect(routerNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			// routers join the all-routers group solicitations are sent to
+			_, err := sysctl.Sysctl("net/ipv6/conf/all/forwarding", "1")
+			Expect(err).NotTo(HaveOccurred())
+			upWithoutDAD("rtr0")
+			return nil
+		})).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(podNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(podNS)).To(Succeed())
+		Expect(routerNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(routerNS)).To(Succeed())
+	})
+
+	// advertise answers the first router solicitation on rtr0 with a
+	// router advertisement of the given lifetime
+	advertise := func(lifetime uint16) (<-chan net.IP, <-chan error) {
+		ready := make(chan net.IP, 1)
+		done := make(chan error, 1)
+		go func() {
+			done <- routerNS.Do(func(ns.NetNS) error {
+				conn, err := net.ListenPacket("ip6:ipv6-icmp", "")
+				if err != nil {
+					return err
+				}
+				defer conn.Close()
+				rc, err := conn.(*net.IPConn).SyscallConn()
+				if err != nil {
+					return err
+				}
+				_ = rc.Control(func(fd uintptr) {
+					err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_HOPS, 255)
+				})
+				if err != nil {
+					return err
+				}
+				link, err := netlink.LinkByName("rtr0")
+				if err != nil {
+					return err
+				}
+				addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+				if err != nil || len(addrs) == 0 {
+					return fmt.Errorf("no link-local address on rtr0: %v", err)
+				}
+				ready <- addrs[0].IP
+				if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+					return err
+				}
+
+				buf := make([]byte, 1500)
+				for {
+					n, _, err := conn.ReadFrom(buf)
+					if err != nil {
+						return err
+					}
+					if n >= 8 && buf[0] == 133 {
+						break
+					}
+				}
+				advertisement := []byte{134, 0, 0, 0, 64, 0, byte(lifetime >> 8), byte(lifetime), 0, 0, 0, 0, 0, 0, 0, 0}
+				_, err = conn.WriteTo(advertisement, &net.IPAddr{IP: net.ParseIP("ff02::1"), Zone: "rtr0"})
+				return err
+			})
+		}()
+		return ready, done
+	}
+
+	It("learns the default route from the router's advertisement", func() {
+		ready, done := advertise(1800)
+		var routerAddr net.IP
+		Eventually(ready).Should(Receive(&routerAddr))
+
+		Expect(podNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			router, err := ip.SolicitRouter("eth0", 5*time.Second)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(router.Addr).To(Equal(routerAddr))
+			Expect(router.Lifetime).To(Equal(30 * time.Minute))
+
+			routes, err := netlink.RouteList(nil, netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+			var learned []net.IP
+			for _, r := range routes {
+				if r.Dst == nil || r.Dst.IP.IsUnspecified() {
+					learned = append(learned, r.Gw)
+				}
+			}
+			Expect(learned).To(Equal([]net.IP{routerAddr}))
+			return nil
+		})).To(Succeed())
+		Expect(<-done).To(Succeed())
+	})
+
+	It("fails when no router advertises itself as a default router", func() {
+		ready, done := advertise(0)
+		Eventually(ready).Should(Receive())
+
+		Expect(podNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, err := ip.SolicitRouter("eth0", 1500*time.Millisecond)
+			Expect(err).To(MatchError(`no router advertised itself on "eth0" within 1.5s`))
+			return nil
+		})).To(Succeed())
+		Expect(<-done).To(Succeed())
+	})
+})
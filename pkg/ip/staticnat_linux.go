@@ -0,0 +1,188 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/utils"
+)
+
+// StaticNAT maps a container address 1:1 to a public address, which is
+// added to a host interface and announced on its LAN, so devices there
+// reach the container on a fixed address without port mappings. The
+// public address is owned by the mapping: it is removed on teardown.
+type StaticNAT struct {
+	// PublicIP is the IPv4 address the container is reachable on
+	PublicIP string `json:"publicIP"`
+	// Interface is the host interface the public address is added to
+	Interface string `json:"interface"`
+}
+
+// Validate checks the public address and the interface.
+func (s *StaticNAT) Validate() error {
+	if ip := net.ParseIP(s.PublicIP); ip == nil || ip.To4() == nil {
+		return fmt.Errorf("invalid staticNAT publicIP %q, must be an IPv4 address", s.PublicIP)
+	}
+	if s.Interface == "" {
+		return fmt.Errorf("staticNAT requires an interface")
+	}
+	return nil
+}
+
+func (s *StaticNAT) publicAddr() *netlink.Addr {
+	return &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP(s.PublicIP).To4(), Mask: net.CIDRMask(32, 32)}}
+}
+
+// rules returns the rules of the chains and the jumps to them, the DNAT
+// ones translating the public address to addr, the SNAT ones the other
+// way around for traffic leaving the network of addr.
+func (s *StaticNAT) rules(addr *net.IPNet, dnatChain, snatChain, comment string) (dnat, snat []string, jumps map[string][]string) {
+	public := s.PublicIP + "/32"
+	cmt := []string{"-m", "comment", "--comment", comment}
+	if addr != nil {
+		network := &net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask}
+		dnat = append([]string{"-d", public, "-j", "DNAT", "--to-destination", addr.IP.String()}, cmt...)
+		snat = append([]string{"-s", addr.IP.String() + "/32", "!", "-d", network.String(), "-j", "SNAT", "--to-source", s.PublicIP}, cmt...)
+	}
+	jumps = map[string][]string{
+		"PREROUTING":  append([]string{"-d", public, "-j", dnatChain}, cmt...),
+		"OUTPUT":      append([]string{"-d", public, "-j", dnatChain}, cmt...),
+		"POSTROUTING": append([]string{"-j", snatChain}, cmt...),
+	}
+	return dnat, snat, jumps
+}
+
+// Setup adds the public address to the interface, announces it with a
+// gratuitous ARP and installs the DNAT and SNAT rules for addr in their
+// own chains. The jumps to those come first, so the mapping takes
+// precedence over masquerading.
+func (s *StaticNAT) Setup(addr *net.IPNet, dnatChain, snatChain, comment string) error {
+	if addr.IP.To4() == nil {
+		return fmt.Errorf("staticNAT requires an IPv4 container address, not %s", addr.IP)
+	}
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	dnat, snat, jumps := s.rules(addr, dnatChain, snatChain, comment)
+	for chain, rule := range map[string][]string{dnatChain: dnat, snatChain: snat} {
+		if err := utils.EnsureChain(ipt, "nat", chain); err != nil {
+			return err
+		}
+		if err := ipt.AppendUnique("nat", chain, rule...); err != nil {
+			return err
+		}
+	}
+	for _, chain := range []string{"PREROUTING", "OUTPUT", "POSTROUTING"} {
+		if err := utils.InsertUnique(ipt, "nat", chain, true, jumps[chain]); err != nil {
+			return err
+		}
+	}
+
+	link, err := netlink.LinkByName(s.Interface)
+	if err != nil {
+		return fmt.Errorf("failed to look up staticNAT interface %q: %v", s.Interface, err)
+	}
+	if err := netlink.AddrAdd(link, s.publicAddr()); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return fmt.Errorf("failed to add %s to %q: %v", s.PublicIP, s.Interface, err)
+	}
+
+	// The address may have been somewhere else before, e.g. on another node
+	if link.Attrs().Flags&net.FlagUp == 0 || link.Attrs().RawFlags&syscall.IFF_NOARP != 0 {
+		return nil
+	}
+	return SendGratuitousARP(s.Interface, net.ParseIP(s.PublicIP))
+}
+
+// Teardown removes the rules and the public address. Anything already
+// gone is skipped, so it needs no container address and may be repeated.
+func (s *StaticNAT) Teardown(dnatChain, snatChain, comment string) error {
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	_, _, jumps := s.rules(nil, dnatChain, snatChain, comment)
+	for chain, rule := range jumps {
+		if err := utils.DeleteRule(ipt, "nat", chain, rule...); err != nil {
+			return err
+		}
+	}
+	for _, chain := range []string{dnatChain, snatChain} {
+		if err := ipt.ClearAndDeleteChain("nat", chain); err != nil && !isNotExist(err) {
+			return err
+		}
+	}
+
+	link, err := netlink.LinkByName(s.Interface)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to look up staticNAT interface %q: %v", s.Interface, err)
+	}
+	if err := netlink.AddrDel(link, s.publicAddr()); err != nil && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return fmt.Errorf("failed to remove %s from %q: %v", s.PublicIP, s.Interface, err)
+	}
+	return nil
+}
+
+// Check verifies that the public address is on the interface and that the
+// rules of addr are in place.
+func (s *StaticNAT) Check(addr *net.IPNet, dnatChain, snatChain, comment string) error {
+	link, err := netlink.LinkByName(s.Interface)
+	if err != nil {
+		return fmt.Errorf("failed to look up staticNAT interface %q: %v", s.Interface, err)
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of %q: %v", s.Interface, err)
+	}
+	found := false
+	for _, a := range addrs {
+		if a.IP.Equal(net.ParseIP(s.PublicIP)) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("staticNAT address %s missing on %q", s.PublicIP, s.Interface)
+	}
+
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+	dnat, snat, jumps := s.rules(addr, dnatChain, snatChain, comment)
+	jumps[dnatChain], jumps[snatChain] = dnat, snat
+	for chain, rule := range jumps {
+		exists, err := ipt.Exists("nat", chain, rule...)
+		if err != nil {
+			return fmt.Errorf("failed to check staticNAT rules of %s: %v", chain, err)
+		}
+		if !exists {
+			return fmt.Errorf("staticNAT rule missing in %s: %v", chain, rule)
+		}
+	}
+	return nil
+}
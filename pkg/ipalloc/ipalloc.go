@@ -0,0 +1,135 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ipalloc exposes the address allocation of the host-local IPAM
+// plugin, so node agents and operators can allocate from the same ranges
+// and store as the plugin without executing it.
+//
+// The API of this package is stable: within a major version of the module
+// it only changes in backwards compatible ways. The host-local packages it
+// is built on make no such promise, so use this package instead of
+// importing them.
+package ipalloc
+
+import (
+	"net"
+	"time"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+)
+
+// Range is a range of addresses to allocate from, as in the "ranges" of
+// the host-local configuration.
+type Range = allocator.Range
+
+// RangeSet is a set of ranges of the same address family, which an
+// allocator allocates one address of.
+type RangeSet = allocator.RangeSet
+
+// Owner is who addresses are allocated for. Addresses reserved for an
+// owner are only handed out to it.
+type Owner = allocator.Owner
+
+// Store persists the allocations. Its methods must be called with the
+// store locked, except for Lock, Unlock and Close.
+type Store = backend.Store
+
+// OpenStore opens the store of the host-local network named network in
+// dataDir, the same as the plugin uses. An empty dataDir is the plugin's
+// default.
+func OpenStore(network, dataDir string) (Store, error) {
+	s, err := disk.New(network, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// OpenWriteBehindStore opens the store like OpenStore, in the journal
+// format and write-behind mode, for long running processes: the changes
+// are kept in memory and written in batches, at most window after they are
+// made. Between the first change of a batch and its write the store stays
+// locked for other processes, and a crash loses the batch. Close writes
+// the pending changes.
+func OpenWriteBehindStore(network, dataDir string, window time.Duration) (Store, error) {
+	s, err := disk.NewJournal(network, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.SetWriteBehind(window); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Allocator allocates addresses of one range set from a store.
+type Allocator struct {
+	store Store
+	alloc *allocator.IPAllocator
+}
+
+// NewAllocator returns an allocator of the range set. The id tells the
+// range sets sharing a store apart; the plugin uses the index of the set in
+// its "ranges". The range set is validated and the allocator keeps a
+// canonical copy of it.
+func NewAllocator(rangeset RangeSet, store Store, id int) (*Allocator, error) {
+	rs := make(RangeSet, len(rangeset))
+	copy(rs, rangeset)
+	if err := rs.Canonicalize(); err != nil {
+		return nil, err
+	}
+	return &Allocator{
+		store: store,
+		alloc: allocator.NewIPAllocator(&rs, store, id),
+	}, nil
+}
+
+// SetOwner sets who the allocator allocates for.
+func (a *Allocator) SetOwner(owner Owner) {
+	a.alloc.SetOwner(owner)
+}
+
+// Allocate allocates an address to the interface of the container, the
+// requested one unless it is nil. It locks the store.
+func (a *Allocator) Allocate(containerID, ifName string, requested net.IP) (*current.IPConfig, error) {
+	if err := a.store.Lock(); err != nil {
+		return nil, err
+	}
+	defer a.store.Unlock()
+	return a.alloc.Get(containerID, ifName, requested)
+}
+
+// Allocated returns the address allocated to the interface of the
+// container, or nil if there is none. It locks the store.
+func (a *Allocator) Allocated(containerID, ifName string) (*current.IPConfig, error) {
+	if err := a.store.Lock(); err != nil {
+		return nil, err
+	}
+	defer a.store.Unlock()
+	return a.alloc.Allocated(containerID, ifName), nil
+}
+
+// Release releases the addresses allocated to the interface of the
+// container. It locks the store.
+func (a *Allocator) Release(containerID, ifName string) error {
+	if err := a.store.Lock(); err != nil {
+		return err
+	}
+	defer a.store.Unlock()
+	return a.alloc.Release(containerID, ifName)
+}
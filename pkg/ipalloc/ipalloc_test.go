@@ -0,0 +1,76 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipalloc_test
+
+import (
+	"net"
+	"os"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ipalloc"
+)
+
+var _ = Describe("Allocator", func() {
+	var (
+		dataDir string
+		store   ipalloc.Store
+	)
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = os.MkdirTemp("", "ipalloc")
+		Expect(err).NotTo(HaveOccurred())
+		store, err = ipalloc.OpenStore("mynet", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(store.Close()).To(Succeed())
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	It("allocates and releases addresses", func() {
+		_, subnet, _ := net.ParseCIDR("10.1.2.0/24")
+		alloc, err := ipalloc.NewAllocator(ipalloc.RangeSet{{Subnet: types.IPNet(*subnet)}}, store, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		ipc, err := alloc.Allocate("c1", "eth0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipc.Address.String()).To(Equal("10.1.2.2/24"))
+		Expect(ipc.Gateway.String()).To(Equal("10.1.2.1"))
+
+		ipc, err = alloc.Allocate("c2", "eth0", net.ParseIP("10.1.2.10"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipc.Address.String()).To(Equal("10.1.2.10/24"))
+
+		ipc, err = alloc.Allocated("c1", "eth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipc.Address.String()).To(Equal("10.1.2.2/24"))
+
+		Expect(alloc.Release("c1", "eth0")).To(Succeed())
+		ipc, err = alloc.Allocated("c1", "eth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipc).To(BeNil())
+	})
+
+	It("rejects invalid range sets", func() {
+		_, subnet, _ := net.ParseCIDR("10.1.2.0/31")
+		_, err := ipalloc.NewAllocator(ipalloc.RangeSet{{Subnet: types.IPNet(*subnet)}}, store, 0)
+		Expect(err).To(MatchError(ContainSubstring("too small to allocate from")))
+	})
+})
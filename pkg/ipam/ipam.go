@@ -16,19 +16,173 @@ package ipam
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/invoke"
 	"github.com/containernetworking/cni/pkg/types"
 )
 
+// DeadlineEnv is the environment variable ExecAdd, ExecCheck and ExecDel
+// pass the deadline of the invocation to the IPAM plugin in, as an RFC 3339
+// time, so it can give up waiting, e.g. for the lock of its store, and fail
+// cleanly before it is killed. See InvocationContext.
+const DeadlineEnv = "CNI_IPAM_DEADLINE"
+
+// killGrace is how long an IPAM plugin may overrun its deadline, to report
+// the failure, before it is killed.
+const killGrace = time.Second
+
 func ExecAdd(plugin string, netconf []byte) (types.Result, error) {
-	return invoke.DelegateAdd(context.TODO(), plugin, netconf, nil)
+	var result types.Result
+	err := execWithTimeout(plugin, netconf, func(ctx context.Context) error {
+		var err error
+		result, err = invoke.DelegateAdd(ctx, plugin, netconf, nil)
+		return err
+	})
+	return result, err
+}
+
+// ExecAddOn is ExecAdd for an attachment on the VLAN vlan of the parent
+// interface parent, e.g. a physical port, which are passed to the IPAM
+// plugin in CNI_ARGS, see cniargs.KeyVLAN, so it can allocate from the
+// ranges of that VLAN or port. Zero values aren't passed. IgnoreUnknown is
+// set along, for IPAM plugins not knowing the keys.
+func ExecAddOn(plugin string, netconf []byte, vlan int, parent string) (types.Result, error) {
+	var pairs []string
+	if vlan != 0 {
+		pairs = append(pairs, "VLAN="+strconv.Itoa(vlan))
+	}
+	if parent != "" {
+		pairs = append(pairs, "PARENT="+parent)
+	}
+	if len(pairs) == 0 {
+		return ExecAdd(plugin, netconf)
+	}
+
+	old, had := os.LookupEnv("CNI_ARGS")
+	args := strings.Join(append(pairs, "IgnoreUnknown=1"), ";")
+	if old != "" {
+		args = old + ";" + args
+	}
+	os.Setenv("CNI_ARGS", args)
+	defer func() {
+		if had {
+			os.Setenv("CNI_ARGS", old)
+		} else {
+			os.Unsetenv("CNI_ARGS")
+		}
+	}()
+	return ExecAdd(plugin, netconf)
 }
 
 func ExecCheck(plugin string, netconf []byte) error {
-	return invoke.DelegateCheck(context.TODO(), plugin, netconf, nil)
+	return execWithTimeout(plugin, netconf, func(ctx context.Context) error {
+		return invoke.DelegateCheck(ctx, plugin, netconf, nil)
+	})
 }
 
 func ExecDel(plugin string, netconf []byte) error {
-	return invoke.DelegateDel(context.TODO(), plugin, netconf, nil)
+	return execWithTimeout(plugin, netconf, func(ctx context.Context) error {
+		return invoke.DelegateDel(ctx, plugin, netconf, nil)
+	})
+}
+
+// ExecGC passes the GC of the attachments the runtime lists in netconf on
+// to the IPAM plugin, so it releases the addresses of all others.
+func ExecGC(plugin string, netconf []byte) error {
+	return execWithTimeout(plugin, netconf, func(ctx context.Context) error {
+		return invoke.DelegateGC(ctx, plugin, netconf, nil)
+	})
+}
+
+// execWithTimeout runs exec with the timeout of the IPAM configuration, if
+// it has one, passing the deadline to the plugin in DeadlineEnv. A plugin
+// still running a second after the deadline is killed, so a wedged plugin,
+// e.g. on a hung NFS mount, can't hang the attachment forever.
+func execWithTimeout(plugin string, netconf []byte, exec func(ctx context.Context) error) error {
+	timeout, err := ExecTimeout(netconf)
+	if err != nil {
+		return err
+	}
+	if timeout == 0 {
+		return exec(context.TODO())
+	}
+
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline.Add(killGrace))
+	defer cancel()
+
+	old, had := os.LookupEnv(DeadlineEnv)
+	os.Setenv(DeadlineEnv, deadline.Format(time.RFC3339Nano))
+	defer func() {
+		if had {
+			os.Setenv(DeadlineEnv, old)
+		} else {
+			os.Unsetenv(DeadlineEnv)
+		}
+	}()
+
+	err = exec(ctx)
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("IPAM plugin %s timed out after %v", plugin, timeout)
+	}
+	return err
+}
+
+// ExecTimeout returns the timeout of the IPAM plugin invocations of netconf,
+// the "timeout" of its "ipam" section, or zero if it has none.
+func ExecTimeout(netconf []byte) (time.Duration, error) {
+	conf := struct {
+		IPAM struct {
+			Timeout string `json:"timeout"`
+		} `json:"ipam"`
+	}{}
+	if err := json.Unmarshal(netconf, &conf); err != nil {
+		return 0, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	return ParseTimeout(conf.IPAM.Timeout)
+}
+
+// ParseTimeout parses the "timeout" of an IPAM configuration, a positive
+// duration, or "" for none.
+func ParseTimeout(timeout string) (time.Duration, error) {
+	if timeout == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid ipam timeout %q, must be a positive duration", timeout)
+	}
+	return d, nil
+}
+
+// InvocationContext returns the context of an invocation of an IPAM plugin.
+// It is done at the deadline the main plugin passed in DeadlineEnv, or else
+// once timeout passed, unless it is zero.
+func InvocationContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if s := os.Getenv(DeadlineEnv); s != "" {
+		if deadline, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return context.WithDeadline(context.Background(), deadline)
+		}
+	}
+	if timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// ResultDNS returns the DNS a main plugin should return: the DNS of the
+// IPAM result if the IPAM plugin set any, as it already combined it with the
+// network configuration according to its own policy, else the DNS of the
+// network configuration.
+func ResultDNS(ipamDNS, confDNS types.DNS) types.DNS {
+	if !ipamDNS.IsEmpty() {
+		return ipamDNS
+	}
+	return confDNS
 }
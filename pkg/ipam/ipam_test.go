@@ -0,0 +1,98 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("IPAM execution timeout", func() {
+	It("parses the timeout of the ipam section", func() {
+		timeout, err := ExecTimeout([]byte(`{"name": "test", "ipam": {"type": "host-local", "timeout": "15s"}}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(timeout).To(Equal(15 * time.Second))
+
+		timeout, err = ExecTimeout([]byte(`{"name": "test", "ipam": {"type": "host-local"}}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(timeout).To(BeZero())
+
+		_, err = ExecTimeout([]byte(`{"name": "test", "ipam": {"type": "host-local", "timeout": "-1s"}}`))
+		Expect(err).To(MatchError(`invalid ipam timeout "-1s", must be a positive duration`))
+	})
+
+	It("passes the deadline to the plugin and kills it once it runs over", func() {
+		dir, err := os.MkdirTemp("", "ipam")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		seen := filepath.Join(dir, "deadline")
+		script := "#!/bin/sh\necho \"$" + DeadlineEnv + "\" > " + seen + "\nexec sleep 30\n"
+		Expect(os.WriteFile(filepath.Join(dir, "wedged"), []byte(script), 0o755)).To(Succeed())
+		GinkgoT().Setenv("CNI_PATH", dir)
+		GinkgoT().Setenv("CNI_COMMAND", "ADD")
+		GinkgoT().Setenv("CNI_CONTAINERID", "dummy")
+		GinkgoT().Setenv("CNI_NETNS", "/proc/self/ns/net")
+		GinkgoT().Setenv("CNI_IFNAME", "eth0")
+
+		start := time.Now()
+		_, err = ExecAdd("wedged", []byte(`{"cniVersion": "1.0.0", "name": "test", "ipam": {"type": "wedged", "timeout": "100ms"}}`))
+		Expect(err).To(MatchError("IPAM plugin wedged timed out after 100ms"))
+		Expect(time.Since(start)).To(BeNumerically("<", 10*time.Second))
+		Expect(os.Getenv(DeadlineEnv)).To(BeEmpty())
+
+		data, err := os.ReadFile(seen)
+		Expect(err).NotTo(HaveOccurred())
+		deadline, err := time.Parse(time.RFC3339Nano, string(data[:len(data)-1]))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(deadline).To(BeTemporally("~", start.Add(100*time.Millisecond), time.Second))
+
+		// the plugin bounds its own work by the deadline it was passed
+		GinkgoT().Setenv(DeadlineEnv, string(data[:len(data)-1]))
+		ctx, cancel := InvocationContext(time.Hour)
+		defer cancel()
+		d, ok := ctx.Deadline()
+		Expect(ok).To(BeTrue())
+		Expect(d.Equal(deadline)).To(BeTrue())
+	})
+})
+
+var _ = Describe("ExecAddOn", func() {
+	It("passes the VLAN and the parent interface in CNI_ARGS", func() {
+		dir, err := os.MkdirTemp("", "ipam")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		seen := filepath.Join(dir, "args")
+		script := "#!/bin/sh\necho \"$CNI_ARGS\" > " + seen + "\n" +
+			"echo '{\"cniVersion\": \"1.0.0\", \"ips\": [{\"address\": \"10.0.20.2/24\"}]}'\n"
+		Expect(os.WriteFile(filepath.Join(dir, "recorder"), []byte(script), 0o755)).To(Succeed())
+		GinkgoT().Setenv("CNI_PATH", dir)
+		GinkgoT().Setenv("CNI_COMMAND", "ADD")
+		GinkgoT().Setenv("CNI_CONTAINERID", "dummy")
+		GinkgoT().Setenv("CNI_NETNS", "/proc/self/ns/net")
+		GinkgoT().Setenv("CNI_IFNAME", "eth0")
+		GinkgoT().Setenv("CNI_ARGS", "K8S_POD_NAME=web")
+
+		_, err = ExecAddOn("recorder", []byte(`{"cniVersion": "1.0.0", "name": "test", "ipam": {"type": "recorder"}}`), 20, "eth1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.ReadFile(seen)).To(Equal([]byte("K8S_POD_NAME=web;VLAN=20;PARENT=eth1;IgnoreUnknown=1\n")))
+		Expect(os.Getenv("CNI_ARGS")).To(Equal("K8S_POD_NAME=web"))
+	})
+})
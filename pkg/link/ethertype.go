@@ -0,0 +1,204 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package link
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/networkplumbing/go-nft/nft"
+	"github.com/networkplumbing/go-nft/nft/schema"
+)
+
+// EtherTypeLLC stands for the IEEE 802.3 frames, which carry a length
+// instead of an ethertype, e.g. those of STP.
+const EtherTypeLLC = 0
+
+// etherTypeMin is the smallest ethertype, smaller values are 802.3 lengths
+const etherTypeMin = 0x0600
+
+var etherTypeNames = map[string]uint16{
+	"ipv4":  0x0800,
+	"arp":   0x0806,
+	"ipv6":  0x86dd,
+	"vlan":  0x8100,
+	"qinq":  0x88a8,
+	"mpls":  0x8847,
+	"eapol": 0x888e,
+	"lldp":  0x88cc,
+	"ptp":   0x88f7,
+	"llc":   EtherTypeLLC,
+	"stp":   EtherTypeLLC,
+}
+
+// ParseEtherType returns the ethertype with the name, such as "ipv4",
+// "lldp" or "stp", or of the number, such as "0x88b5". STP and "llc" are
+// EtherTypeLLC.
+func ParseEtherType(s string) (uint16, error) {
+	if t, ok := etherTypeNames[strings.ToLower(s)]; ok {
+		return t, nil
+	}
+	t, err := strconv.ParseUint(s, 0, 16)
+	if err != nil || t < etherTypeMin {
+		return 0, fmt.Errorf("invalid ethertype %q", s)
+	}
+	return uint16(t), nil
+}
+
+// EtherTypeFilter restricts the ethertypes of the frames an interface
+// sends into a bridge, e.g. to keep containers from emitting LLDP or STP,
+// which upset the switches of the site. It either allows only the listed
+// ethertypes or drops them. Its rules are next to those of the
+// SpoofChecker, in the same table and base chain.
+type EtherTypeFilter struct {
+	iface      string
+	allow      bool
+	etherTypes []uint16
+	refID      string
+	configurer NftConfigurer
+}
+
+func NewEtherTypeFilter(iface string, allow bool, etherTypes []uint16, refID string) *EtherTypeFilter {
+	return NewEtherTypeFilterWithConfigurer(iface, allow, etherTypes, refID, defaultNftConfigurer{})
+}
+
+func NewEtherTypeFilterWithConfigurer(iface string, allow bool, etherTypes []uint16, refID string, configurer NftConfigurer) *EtherTypeFilter {
+	return &EtherTypeFilter{iface, allow, etherTypes, refID, configurer}
+}
+
+// Setup applies the filter to the interface, declaring the table and
+// chains first, as SpoofChecker.Setup does.
+func (f *EtherTypeFilter) Setup() error {
+	baseConfig := nft.NewConfig()
+	baseConfig.AddTable(&schema.Table{Family: schema.FamilyBridge, Name: natTableName})
+	baseConfig.AddChain((&SpoofChecker{}).baseChain())
+	chain := f.chain()
+	baseConfig.AddChain(chain)
+	if _, err := f.configurer.Apply(baseConfig); err != nil {
+		return fmt.Errorf("failed to setup ethertype filter: %v", err)
+	}
+
+	rulesConfig := nft.NewConfig()
+	rulesConfig.FlushChain(chain)
+	rulesConfig.AddRule(f.matchIfaceJumpRule(chain.Name))
+	verdict := schema.Verdict{SimpleVerdict: schema.SimpleVerdict{Drop: true}}
+	if f.allow {
+		verdict = schema.Verdict{SimpleVerdict: schema.SimpleVerdict{Return: true}}
+	}
+	for _, t := range f.etherTypes {
+		rulesConfig.AddRule(f.matchEtherTypeRule(chain.Name, t, verdict))
+	}
+	if f.allow {
+		rulesConfig.AddRule(&schema.Rule{
+			Family: schema.FamilyBridge,
+			Table:  natTableName,
+			Chain:  chain.Name,
+			Expr: []schema.Statement{
+				{Verdict: schema.Verdict{SimpleVerdict: schema.SimpleVerdict{Drop: true}}},
+			},
+		})
+	}
+	if _, err := f.configurer.Apply(rulesConfig); err != nil {
+		return fmt.Errorf("failed to setup ethertype filter: %v", err)
+	}
+	return nil
+}
+
+// Teardown removes the rule matching the interface from the base chain and
+// the chain of the filter.
+func (f *EtherTypeFilter) Teardown() error {
+	chain := f.chain()
+	ruleToFind := *f.matchIfaceJumpRule(chain.Name)
+	ruleToFind.Expr = nil
+
+	var ruleErr error
+	current, err := f.configurer.Read(listChainBridgeNatPrerouting()...)
+	if err != nil {
+		ruleErr = err
+	} else if rules := current.LookupRule(&ruleToFind); len(rules) > 0 {
+		c := nft.NewConfig()
+		for _, rule := range rules {
+			c.DeleteRule(rule)
+		}
+		if _, err := f.configurer.Apply(c); err != nil {
+			ruleErr = fmt.Errorf("failed to delete iface match rule: %v", err)
+		}
+	} else {
+		fmt.Fprintf(os.Stderr, "ethertype/teardown: unable to detect iface match rule for deletion: %+v", ruleToFind)
+	}
+
+	chainConfig := nft.NewConfig()
+	chainConfig.DeleteChain(chain)
+	var chainErr error
+	if _, err := f.configurer.Apply(chainConfig); err != nil {
+		chainErr = fmt.Errorf("failed to delete chain: %v", err)
+	}
+
+	if ruleErr != nil || chainErr != nil {
+		return fmt.Errorf("failed to teardown ethertype filter: %v, %v", ruleErr, chainErr)
+	}
+	return nil
+}
+
+func (f *EtherTypeFilter) chain() *schema.Chain {
+	return &schema.Chain{
+		Family: schema.FamilyBridge,
+		Table:  natTableName,
+		Name:   "cni-br-ethertype-" + f.refID,
+	}
+}
+
+func (f *EtherTypeFilter) matchIfaceJumpRule(toChain string) *schema.Rule {
+	return &schema.Rule{
+		Family: schema.FamilyBridge,
+		Table:  natTableName,
+		Chain:  preRoutingBaseChainName,
+		Expr: []schema.Statement{
+			{Match: &schema.Match{
+				Op:    schema.OperEQ,
+				Left:  schema.Expression{RowData: []byte(`{"meta":{"key":"iifname"}}`)},
+				Right: schema.Expression{String: &f.iface},
+			}},
+			{Verdict: schema.Verdict{Jump: &schema.ToTarget{Target: toChain}}},
+		},
+		Comment: "ethertype-" + f.refID,
+	}
+}
+
+func (f *EtherTypeFilter) matchEtherTypeRule(chain string, etherType uint16, verdict schema.Verdict) *schema.Rule {
+	// 802.3 frames are matched by their length
+	op, value := schema.OperEQ, float64(etherType)
+	if etherType == EtherTypeLLC {
+		op, value = schema.OperLS, etherTypeMin
+	}
+	return &schema.Rule{
+		Family: schema.FamilyBridge,
+		Table:  natTableName,
+		Chain:  chain,
+		Expr: []schema.Statement{
+			{Match: &schema.Match{
+				Op: op,
+				Left: schema.Expression{Payload: &schema.Payload{
+					Protocol: schema.PayloadProtocolEther,
+					Field:    schema.PayloadFieldEtherType,
+				}},
+				Right: schema.Expression{Float64: &value},
+			}},
+			{Verdict: verdict},
+		},
+	}
+}
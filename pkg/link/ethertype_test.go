@@ -0,0 +1,118 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package link_test
+
+import (
+	"github.com/networkplumbing/go-nft/nft"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/containernetworking/plugins/pkg/link"
+)
+
+var _ = Describe("ethertype filter", func() {
+	id := "container99-net1"
+
+	DescribeTable("parses ethertypes",
+		func(s string, expected uint16, valid bool) {
+			t, err := link.ParseEtherType(s)
+			if !valid {
+				Expect(err).To(MatchError(`invalid ethertype "` + s + `"`))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(t).To(Equal(expected))
+		},
+		Entry("name", "IPv6", uint16(0x86dd), true),
+		Entry("STP", "stp", uint16(link.EtherTypeLLC), true),
+		Entry("number", "0x88b5", uint16(0x88b5), true),
+		Entry("802.3 length", "0x05dc", uint16(0), false),
+		Entry("unknown name", "appletalk", uint16(0), false),
+	)
+
+	It("allows only the listed ethertypes", func() {
+		c := configurerStub{}
+		f := link.NewEtherTypeFilterWithConfigurer("net0", true, []uint16{0x0800, link.EtherTypeLLC}, id, &c)
+		Expect(f.Setup()).To(Succeed())
+
+		Expect(c.applyConfig).To(HaveLen(2))
+		rules, err := c.applyConfig[1].ToJSON()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(rules)).To(MatchJSON(`
+			{"nftables": [
+				{"flush": {"chain": {"family": "bridge", "table": "nat", "name": "cni-br-ethertype-container99-net1"}}},
+				{"rule": {
+					"family": "bridge", "table": "nat", "chain": "PREROUTING",
+					"expr": [
+						{"match": {"op": "==", "left": {"meta": {"key": "iifname"}}, "right": "net0"}},
+						{"jump": {"target": "cni-br-ethertype-container99-net1"}}
+					],
+					"comment": "ethertype-container99-net1"
+				}},
+				{"rule": {
+					"family": "bridge", "table": "nat", "chain": "cni-br-ethertype-container99-net1",
+					"expr": [
+						{"match": {"op": "==", "left": {"payload": {"protocol": "ether", "field": "type"}}, "right": 2048}},
+						{"return": null}
+					]
+				}},
+				{"rule": {
+					"family": "bridge", "table": "nat", "chain": "cni-br-ethertype-container99-net1",
+					"expr": [
+						{"match": {"op": "<", "left": {"payload": {"protocol": "ether", "field": "type"}}, "right": 1536}},
+						{"return": null}
+					]
+				}},
+				{"rule": {
+					"family": "bridge", "table": "nat", "chain": "cni-br-ethertype-container99-net1",
+					"expr": [{"drop": null}]
+				}}
+			]}`))
+	})
+
+	It("removes the rule of the interface and its chain on teardown", func() {
+		existing := nft.NewConfig()
+		existing.FromJSON([]byte(`
+			{"nftables": [
+				{"rule": {"family": "bridge", "table": "nat", "chain": "PREROUTING", "handle": 4,
+					"expr": [
+						{"match": {"op": "==", "left": {"meta": {"key": "iifname"}}, "right": "net0"}},
+						{"jump": {"target": "cni-br-iface-container99-net1"}}
+					],
+					"comment": "macspoofchk-container99-net1"}},
+				{"rule": {"family": "bridge", "table": "nat", "chain": "PREROUTING", "handle": 5,
+					"expr": [
+						{"match": {"op": "==", "left": {"meta": {"key": "iifname"}}, "right": "net0"}},
+						{"jump": {"target": "cni-br-ethertype-container99-net1"}}
+					],
+					"comment": "ethertype-container99-net1"}}
+			]}`))
+		c := configurerStub{readConfig: existing}
+		f := link.NewEtherTypeFilterWithConfigurer("", false, nil, id, &c)
+		Expect(f.Teardown()).To(Succeed())
+
+		Expect(c.applyConfig).To(HaveLen(2))
+		deleted, err := c.applyConfig[0].ToJSON()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(deleted)).To(ContainSubstring(`"handle":5`))
+		Expect(string(deleted)).NotTo(ContainSubstring(`"handle":4`))
+		chains, err := c.applyConfig[1].ToJSON()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(chains)).To(MatchJSON(`
+			{"nftables": [
+				{"delete": {"chain": {"family": "bridge", "table": "nat", "name": "cni-br-ethertype-container99-net1"}}}
+			]}`))
+	})
+})
@@ -0,0 +1,144 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package link
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/cniargs"
+)
+
+// maxIfaceNameLen is IFNAMSIZ without the terminating NUL.
+const maxIfaceNameLen = 15
+
+// hashLen is the length of the short hash used by templates and to resolve
+// name collisions.
+const hashLen = 8
+
+// HostIfaceNameData is what host interface name templates are rendered
+// with.
+type HostIfaceNameData struct {
+	PodNamespace string
+	PodName      string
+	PodUID       string
+	ContainerID  string
+	IfName       string
+	// Hash is a short hash of the container ID and interface name, unique
+	// per attachment.
+	Hash string
+}
+
+// NewHostIfaceNameData returns the template data of an attachment. The pod
+// metadata is taken from CNI_ARGS; malformed CNI_ARGS leave it empty.
+func NewHostIfaceNameData(containerID, ifName, envArgs string) *HostIfaceNameData {
+	sum := sha256.Sum256([]byte(containerID + "/" + ifName))
+	d := &HostIfaceNameData{
+		ContainerID: containerID,
+		IfName:      ifName,
+		Hash:        hex.EncodeToString(sum[:])[:hashLen],
+	}
+	if env, err := cniargs.ParseEnv(envArgs); err == nil {
+		d.PodNamespace = env[cniargs.KeyPodNamespace]
+		d.PodName = env[cniargs.KeyPodName]
+		d.PodUID = env[cniargs.KeyPodUID]
+	}
+	return d
+}
+
+var templateFuncs = template.FuncMap{
+	"trunc": func(n int, s string) string {
+		if n >= 0 && len(s) > n {
+			return s[:n]
+		}
+		return s
+	},
+	"lower": strings.ToLower,
+}
+
+func parseHostIfaceNameTemplate(tmpl string) (*template.Template, error) {
+	t, err := template.New("hostInterfaceTemplate").Funcs(templateFuncs).Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hostInterfaceTemplate %q: %v", tmpl, err)
+	}
+	return t, nil
+}
+
+// ValidateHostIfaceNameTemplate returns an error if tmpl is not a valid
+// host interface name template.
+func ValidateHostIfaceNameTemplate(tmpl string) error {
+	if tmpl == "" {
+		return nil
+	}
+	t, err := parseHostIfaceNameTemplate(tmpl)
+	if err != nil {
+		return err
+	}
+	return t.Execute(&strings.Builder{}, NewHostIfaceNameData("", "", ""))
+}
+
+// HostIfaceName renders tmpl into an interface name for the host side of an
+// attachment. Characters not allowed in interface names are replaced by
+// "-" and the result is clamped to 15 characters. If an interface of that
+// name already exists, the attachment hash is appended instead, so two pods
+// whose names render the same still get distinct interfaces. It must be
+// called in the host network namespace. An empty tmpl returns "", which
+// plugins treat as a random name.
+func HostIfaceName(tmpl string, d *HostIfaceNameData) (string, error) {
+	if tmpl == "" {
+		return "", nil
+	}
+	t, err := parseHostIfaceNameTemplate(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, d); err != nil {
+		return "", fmt.Errorf("failed to render hostInterfaceTemplate %q: %v", tmpl, err)
+	}
+	name := sanitizeIfaceName(b.String())
+	if name == "" {
+		return "", fmt.Errorf("hostInterfaceTemplate %q rendered an empty interface name", tmpl)
+	}
+
+	if len(name) > maxIfaceNameLen {
+		name = name[:maxIfaceNameLen]
+	}
+	if _, err := netlink.LinkByName(name); err != nil {
+		return name, nil
+	}
+
+	// Collision: keep as much of the rendered name as fits next to the hash
+	prefix := name[:min(len(name), maxIfaceNameLen-hashLen-1)]
+	return strings.TrimRight(prefix, "-") + "-" + d.Hash, nil
+}
+
+// sanitizeIfaceName replaces the characters the kernel rejects in interface
+// names, and the ones that are awkward in sysctl paths, by "-".
+func sanitizeIfaceName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '-'
+	}, name)
+	return strings.Trim(name, "-")
+}
@@ -0,0 +1,58 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package link
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("host interface name templates", func() {
+	data := NewHostIfaceNameData("abcdef", "eth0", "K8S_POD_NAMESPACE=kube-system;K8S_POD_NAME=CoreDNS.5d78c9869d-x7k2p")
+
+	It("rejects invalid templates", func() {
+		Expect(ValidateHostIfaceNameTemplate("")).To(Succeed())
+		Expect(ValidateHostIfaceNameTemplate("veth-{{.PodName | trunc 8}}")).To(Succeed())
+		Expect(ValidateHostIfaceNameTemplate("{{.PodName")).To(MatchError(ContainSubstring("invalid hostInterfaceTemplate")))
+		Expect(ValidateHostIfaceNameTemplate("{{.Pod}}")).To(MatchError(ContainSubstring("can't evaluate field Pod")))
+	})
+
+	It("renders, sanitizes and clamps names", func() {
+		name, err := HostIfaceName("", data)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(name).To(BeEmpty())
+
+		name, err = HostIfaceName("v-{{.PodName | lower | trunc 10}}", data)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(name).To(Equal("v-coredns-5d"))
+
+		name, err = HostIfaceName("{{.PodNamespace}}-{{.PodName}}", data)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(name).To(Equal("kube-system-Cor"))
+
+		_, err = HostIfaceName("{{.PodUID}}", data)
+		Expect(err).To(MatchError(ContainSubstring("rendered an empty interface name")))
+	})
+
+	It("appends the attachment hash on collisions", func() {
+		name, err := HostIfaceName("lo", data)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(name).To(Equal("lo-" + data.Hash))
+		Expect(len(data.Hash)).To(Equal(8))
+
+		other := NewHostIfaceNameData("123456", "eth0", "")
+		Expect(other.Hash).NotTo(Equal(data.Hash))
+	})
+})
@@ -0,0 +1,181 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package link
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Ownership modes accepted by plugins in their "interfaceOwnership" setting.
+const (
+	// OwnershipNone leaves host network managers alone (the default).
+	OwnershipNone = ""
+	// OwnershipMark marks interfaces as unmanaged for NetworkManager and
+	// systemd-networkd.
+	OwnershipMark = "mark"
+	// OwnershipWarn reports interfaces claimed by a network manager on
+	// stderr, without changing anything.
+	OwnershipWarn = "warn"
+	// OwnershipEnforce marks interfaces as unmanaged and fails if a network
+	// manager still claims them afterwards.
+	OwnershipEnforce = "enforce"
+)
+
+// Locations used by NetworkManager, udev and systemd-networkd. These are
+// variables so tests can point them at a scratch directory.
+var (
+	udevRulesDir     = "/run/udev/rules.d"
+	networkdConfDir  = "/run/systemd/network"
+	networkdLinksDir = "/run/systemd/netif/links"
+	nmDevicesDir     = "/run/NetworkManager/devices"
+)
+
+const markerPrefix = "90-cni-"
+
+// ValidateOwnership returns an error if mode is not a known ownership mode.
+func ValidateOwnership(mode string) error {
+	switch mode {
+	case OwnershipNone, OwnershipMark, OwnershipWarn, OwnershipEnforce:
+		return nil
+	}
+	return fmt.Errorf("invalid interfaceOwnership %q, must be one of %q, %q or %q",
+		mode, OwnershipMark, OwnershipWarn, OwnershipEnforce)
+}
+
+// MarkUnmanaged writes a udev rule setting NM_UNMANAGED and a
+// systemd-networkd drop-in with Unmanaged=yes for ifName. It may be called
+// before the interface exists, which avoids racing the network manager when
+// the interface appears. It is a no-op unless mode marks interfaces.
+func MarkUnmanaged(mode, ifName string) error {
+	if mode != OwnershipMark && mode != OwnershipEnforce {
+		return nil
+	}
+
+	rule := fmt.Sprintf("ACTION==\"add|change|move\", SUBSYSTEM==\"net\", ENV{INTERFACE}==%q, ENV{NM_UNMANAGED}=\"1\"\n", ifName)
+	if err := writeMarker(udevRulesDir, markerPrefix+ifName+".rules", rule); err != nil {
+		return fmt.Errorf("failed to mark %q unmanaged for NetworkManager: %v", ifName, err)
+	}
+
+	dropIn := fmt.Sprintf("[Match]\nName=%s\n\n[Link]\nUnmanaged=yes\n", ifName)
+	if err := writeMarker(networkdConfDir, markerPrefix+ifName+".network", dropIn); err != nil {
+		return fmt.Errorf("failed to mark %q unmanaged for systemd-networkd: %v", ifName, err)
+	}
+	reloadNetworkd()
+
+	return nil
+}
+
+// UnmarkUnmanaged removes the markers written by MarkUnmanaged.
+func UnmarkUnmanaged(mode, ifName string) error {
+	if mode != OwnershipMark && mode != OwnershipEnforce {
+		return nil
+	}
+
+	for _, p := range []string{
+		filepath.Join(udevRulesDir, markerPrefix+ifName+".rules"),
+		filepath.Join(networkdConfDir, markerPrefix+ifName+".network"),
+	} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %q: %v", p, err)
+		}
+	}
+	reloadNetworkd()
+
+	return nil
+}
+
+// VerifyUnmanaged checks whether NetworkManager or systemd-networkd claim the
+// interface with the given name and index. In warn mode a claim is reported
+// on stderr, in enforce mode it is returned as an error.
+func VerifyUnmanaged(mode, ifName string, ifIndex int) error {
+	if mode != OwnershipWarn && mode != OwnershipEnforce {
+		return nil
+	}
+
+	managers := ManagedBy(ifIndex)
+	if len(managers) == 0 {
+		return nil
+	}
+
+	err := fmt.Errorf("interface %q is managed by %s and may be reconfigured behind the plugin's back",
+		ifName, strings.Join(managers, " and "))
+	if mode == OwnershipEnforce {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	return nil
+}
+
+// ManagedBy returns the names of the host network managers which currently
+// manage the interface with the given index, based on the runtime state
+// NetworkManager and systemd-networkd keep under /run.
+func ManagedBy(ifIndex int) []string {
+	var managers []string
+
+	idx := strconv.Itoa(ifIndex)
+	if v, ok := readStateKey(filepath.Join(nmDevicesDir, idx), "managed"); ok && v == "true" {
+		managers = append(managers, "NetworkManager")
+	}
+	if v, ok := readStateKey(filepath.Join(networkdLinksDir, idx), "ADMIN_STATE"); ok {
+		switch v {
+		case "configuring", "configured", "failed", "linger":
+			managers = append(managers, "systemd-networkd")
+		}
+	}
+
+	return managers
+}
+
+func writeMarker(dir, name, content string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+}
+
+// readStateKey returns the value of key from a simple key=value state file.
+func readStateKey(path, key string) (string, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		k, v, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if found && k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// reloadNetworkd asks a running systemd-networkd to pick up new drop-ins.
+// Failures are ignored; networkd not running means there is nothing to reload.
+func reloadNetworkd() {
+	if _, err := os.Stat(networkdLinksDir); err != nil {
+		return
+	}
+	if path, err := exec.LookPath("networkctl"); err == nil {
+		_ = exec.Command(path, "reload").Run()
+	}
+}
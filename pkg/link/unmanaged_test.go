@@ -0,0 +1,101 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package link
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("interface ownership", func() {
+	var root string
+
+	BeforeEach(func() {
+		var err error
+		root, err = os.MkdirTemp("", "cni-ownership")
+		Expect(err).NotTo(HaveOccurred())
+
+		udevRulesDir = filepath.Join(root, "udev")
+		networkdConfDir = filepath.Join(root, "network")
+		networkdLinksDir = filepath.Join(root, "netif", "links")
+		nmDevicesDir = filepath.Join(root, "nm", "devices")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	writeState := func(dir, name, content string) {
+		Expect(os.MkdirAll(dir, 0o755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)).To(Succeed())
+	}
+
+	It("rejects unknown modes", func() {
+		Expect(ValidateOwnership("")).To(Succeed())
+		Expect(ValidateOwnership(OwnershipEnforce)).To(Succeed())
+		Expect(ValidateOwnership("unmanaged")).To(MatchError(ContainSubstring(`invalid interfaceOwnership "unmanaged"`)))
+	})
+
+	It("writes and removes markers", func() {
+		Expect(MarkUnmanaged(OwnershipMark, "br-edge")).To(Succeed())
+
+		rule, err := os.ReadFile(filepath.Join(udevRulesDir, "90-cni-br-edge.rules"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(rule)).To(ContainSubstring(`ENV{INTERFACE}=="br-edge"`))
+		Expect(string(rule)).To(ContainSubstring(`ENV{NM_UNMANAGED}="1"`))
+
+		dropIn, err := os.ReadFile(filepath.Join(networkdConfDir, "90-cni-br-edge.network"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(dropIn)).To(ContainSubstring("Name=br-edge"))
+		Expect(string(dropIn)).To(ContainSubstring("Unmanaged=yes"))
+
+		Expect(UnmarkUnmanaged(OwnershipMark, "br-edge")).To(Succeed())
+		Expect(filepath.Join(udevRulesDir, "90-cni-br-edge.rules")).NotTo(BeAnExistingFile())
+		Expect(filepath.Join(networkdConfDir, "90-cni-br-edge.network")).NotTo(BeAnExistingFile())
+
+		// removing twice is fine
+		Expect(UnmarkUnmanaged(OwnershipMark, "br-edge")).To(Succeed())
+	})
+
+	It("does not write markers in warn mode", func() {
+		Expect(MarkUnmanaged(OwnershipWarn, "br-edge")).To(Succeed())
+		Expect(udevRulesDir).NotTo(BeADirectory())
+		Expect(networkdConfDir).NotTo(BeADirectory())
+	})
+
+	It("detects managed interfaces", func() {
+		Expect(ManagedBy(7)).To(BeEmpty())
+
+		writeState(nmDevicesDir, "7", "[device]\nmanaged=true\n")
+		writeState(networkdLinksDir, "7", "ADMIN_STATE=configured\nOPER_STATE=routable\n")
+		Expect(ManagedBy(7)).To(Equal([]string{"NetworkManager", "systemd-networkd"}))
+
+		writeState(nmDevicesDir, "8", "[device]\nmanaged=false\n")
+		writeState(networkdLinksDir, "8", "ADMIN_STATE=unmanaged\n")
+		Expect(ManagedBy(8)).To(BeEmpty())
+	})
+
+	It("only fails verification in enforce mode", func() {
+		writeState(nmDevicesDir, "7", "[device]\nmanaged=true\n")
+
+		Expect(VerifyUnmanaged(OwnershipNone, "eth1", 7)).To(Succeed())
+		Expect(VerifyUnmanaged(OwnershipWarn, "eth1", 7)).To(Succeed())
+		Expect(VerifyUnmanaged(OwnershipEnforce, "eth1", 7)).To(MatchError(ContainSubstring(`interface "eth1" is managed by NetworkManager`)))
+		Expect(VerifyUnmanaged(OwnershipEnforce, "eth2", 8)).To(Succeed())
+	})
+})
@@ -0,0 +1,66 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package link
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// waitInterval is how often WaitForLink looks for the link again.
+var waitInterval = 100 * time.Millisecond
+
+// ParseWait parses a wait setting such as "masterWait", which is a Go
+// duration string. An empty setting means no wait.
+func ParseWait(name, s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s %q, must be a non-negative duration", name, s)
+	}
+	return d, nil
+}
+
+// WaitForLink returns the link named ifName of the current network
+// namespace, waiting up to timeout for it to appear and be set up. This
+// covers links that are enumerated late on boot, such as USB or LTE
+// modems. With a zero timeout, it looks the link up once and returns the
+// lookup error as is.
+func WaitForLink(ifName string, timeout time.Duration) (netlink.Link, error) {
+	l, err := netlink.LinkByName(ifName)
+	if timeout == 0 {
+		return l, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		if err == nil && l.Attrs().Flags&net.FlagUp != 0 {
+			return l, nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return nil, fmt.Errorf("timed out after %v waiting for link %q to appear: %v", timeout, ifName, err)
+			}
+			return nil, fmt.Errorf("timed out after %v waiting for link %q to come up", timeout, ifName)
+		}
+		time.Sleep(waitInterval)
+		l, err = netlink.LinkByName(ifName)
+	}
+}
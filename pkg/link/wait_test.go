@@ -0,0 +1,91 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package link_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/link"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+)
+
+var _ = Describe("WaitForLink", func() {
+	var testNS ns.NetNS
+
+	BeforeEach(func() {
+		var err error
+		testNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(testNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(testNS)).To(Succeed())
+	})
+
+	It("waits for the link to appear and come up", func() {
+		done := make(chan error)
+		go func() {
+			time.Sleep(300 * time.Millisecond)
+			done <- testNS.Do(func(ns.NetNS) error {
+				if err := netlink.LinkAdd(&netlink.Veth{
+					LinkAttrs: netlink.LinkAttrs{Name: "late0"},
+					PeerName:  "late1",
+				}); err != nil {
+					return err
+				}
+				l, err := netlink.LinkByName("late0")
+				if err != nil {
+					return err
+				}
+				return netlink.LinkSetUp(l)
+			})
+		}()
+
+		Expect(testNS.Do(func(ns.NetNS) error {
+			l, err := link.WaitForLink("late0", 10*time.Second)
+			if err != nil {
+				return err
+			}
+			Expect(l.Attrs().Name).To(Equal("late0"))
+			return nil
+		})).To(Succeed())
+		Expect(<-done).To(Succeed())
+	})
+
+	It("times out if the link doesn't appear", func() {
+		err := testNS.Do(func(ns.NetNS) error {
+			_, err := link.WaitForLink("missing0", 200*time.Millisecond)
+			return err
+		})
+		Expect(err).To(MatchError(ContainSubstring(`timed out after 200ms waiting for link "missing0" to appear`)))
+	})
+
+	It("parses the wait setting", func() {
+		d, err := link.ParseWait("masterWait", "30s")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(d).To(Equal(30 * time.Second))
+		d, err = link.ParseWait("masterWait", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(d).To(BeZero())
+		_, err = link.ParseWait("masterWait", "-1s")
+		Expect(err).To(MatchError(`invalid masterWait "-1s", must be a non-negative duration`))
+	})
+})
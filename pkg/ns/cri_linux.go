@@ -0,0 +1,365 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build cri && go1.24
+
+// The CRI lookup is only built with the "cri" build tag, so plugins don't
+// carry a CRI client they never use. It speaks gRPC over the standard
+// library's unencrypted HTTP/2 support, which needs Go 1.24 or later, and
+// encodes the few messages it needs by hand instead of depending on the CRI
+// API module.
+
+package ns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// DefaultCRIEndpoint is the CRI socket of containerd.
+const DefaultCRIEndpoint = "unix:///run/containerd/containerd.sock"
+
+// podUIDLabel is the sandbox label the kubelet sets to the pod's UID.
+const podUIDLabel = "io.kubernetes.pod.uid"
+
+// sandboxReady is the PodSandboxState of a running sandbox.
+const sandboxReady = 0
+
+// GetNSByPodUID opens the network namespace of the pod's sandbox, as
+// reported by the container runtime at the CRI endpoint. This is for tools
+// that run outside of a CNI invocation and so don't get CNI_NETNS.
+func GetNSByPodUID(ctx context.Context, endpoint, podUID string) (NetNS, error) {
+	path, err := NetNSPathByPodUID(ctx, endpoint, podUID)
+	if err != nil {
+		return nil, err
+	}
+	return GetNS(path)
+}
+
+// NetNSPathByPodUID returns the network namespace path of the pod's
+// sandbox. If the pod has several sandboxes, e.g. while one is recreated,
+// the ready one created last is used.
+func NetNSPathByPodUID(ctx context.Context, endpoint, podUID string) (string, error) {
+	c, err := newCRIClient(endpoint)
+	if err != nil {
+		return "", err
+	}
+	defer c.close()
+
+	sandboxID, err := c.sandboxOfPod(ctx, podUID)
+	if err != nil {
+		return "", err
+	}
+	return c.netNSPath(ctx, sandboxID)
+}
+
+// NetNSPathBySandboxID returns the network namespace path of the sandbox.
+func NetNSPathBySandboxID(ctx context.Context, endpoint, sandboxID string) (string, error) {
+	c, err := newCRIClient(endpoint)
+	if err != nil {
+		return "", err
+	}
+	defer c.close()
+
+	return c.netNSPath(ctx, sandboxID)
+}
+
+type criClient struct {
+	transport *http.Transport
+	client    *http.Client
+}
+
+func newCRIClient(endpoint string) (*criClient, error) {
+	path, ok := strings.CutPrefix(endpoint, "unix://")
+	if !ok {
+		return nil, fmt.Errorf("unsupported CRI endpoint %q, must be a unix:// socket", endpoint)
+	}
+
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	transport := &http.Transport{
+		Protocols: protocols,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}
+	return &criClient{
+		transport: transport,
+		client:    &http.Client{Transport: transport},
+	}, nil
+}
+
+func (c *criClient) close() {
+	c.transport.CloseIdleConnections()
+}
+
+// call makes a unary gRPC call to the CRI RuntimeService.
+func (c *criClient) call(ctx context.Context, method string, req []byte) ([]byte, error) {
+	body := make([]byte, 5, 5+len(req))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(req)))
+	body = append(body, req...)
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost/runtime.v1.RuntimeService/"+method, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/grpc")
+	httpReq.Header.Set("TE", "trailers")
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("CRI %s failed: %v", method, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CRI %s failed: HTTP status %d", method, resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("CRI %s failed: %v", method, err)
+	}
+
+	// Errors without a response come as headers only, others in the trailers
+	status, message := resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	}
+	if status != "0" {
+		return nil, fmt.Errorf("CRI %s failed: gRPC status %s: %s", method, status, message)
+	}
+
+	if len(data) < 5 {
+		return nil, fmt.Errorf("CRI %s failed: short response", method)
+	}
+	if data[0] != 0 {
+		return nil, fmt.Errorf("CRI %s failed: compressed responses are not supported", method)
+	}
+	n := binary.BigEndian.Uint32(data[1:5])
+	if uint32(len(data)-5) < n {
+		return nil, fmt.Errorf("CRI %s failed: truncated response", method)
+	}
+	return data[5 : 5+n], nil
+}
+
+// sandboxOfPod returns the ID of the pod's sandbox, preferring ready ones
+// and then the one created last.
+func (c *criClient) sandboxOfPod(ctx context.Context, podUID string) (string, error) {
+	// ListPodSandboxRequest{filter: {label_selector: {podUIDLabel: podUID}}}
+	var entry, filter, req []byte
+	entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+	entry = protowire.AppendString(entry, podUIDLabel)
+	entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+	entry = protowire.AppendString(entry, podUID)
+	filter = protowire.AppendTag(filter, 3, protowire.BytesType)
+	filter = protowire.AppendBytes(filter, entry)
+	req = protowire.AppendTag(req, 1, protowire.BytesType)
+	req = protowire.AppendBytes(req, filter)
+
+	resp, err := c.call(ctx, "ListPodSandbox", req)
+	if err != nil {
+		return "", err
+	}
+
+	var best *podSandbox
+	err = forEachField(resp, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		sb, err := parsePodSandbox(v)
+		if err != nil {
+			return err
+		}
+		if sb.uid != podUID {
+			return nil
+		}
+		if best == nil || sb.betterThan(best) {
+			best = sb
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to parse CRI ListPodSandbox response: %v", err)
+	}
+	if best == nil {
+		return "", fmt.Errorf("no sandbox found for pod %s", podUID)
+	}
+	return best.id, nil
+}
+
+// netNSPath returns the network namespace path of the sandbox from its
+// verbose status, falling back to the namespace of its process.
+func (c *criClient) netNSPath(ctx context.Context, sandboxID string) (string, error) {
+	// PodSandboxStatusRequest{pod_sandbox_id: sandboxID, verbose: true}
+	var req []byte
+	req = protowire.AppendTag(req, 1, protowire.BytesType)
+	req = protowire.AppendString(req, sandboxID)
+	req = protowire.AppendTag(req, 2, protowire.VarintType)
+	req = protowire.AppendVarint(req, 1)
+
+	resp, err := c.call(ctx, "PodSandboxStatus", req)
+	if err != nil {
+		return "", err
+	}
+
+	info := ""
+	err = forEachField(resp, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if num != 2 || typ != protowire.BytesType {
+			return nil
+		}
+		key, value, err := parseMapEntry(v)
+		if key == "info" {
+			info = value
+		}
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to parse CRI PodSandboxStatus response: %v", err)
+	}
+	if info == "" {
+		return "", fmt.Errorf("runtime reported no info for sandbox %s", sandboxID)
+	}
+	return netNSPathFromInfo(sandboxID, info)
+}
+
+// sandboxInfo is the part of the verbose sandbox info shared by containerd
+// and CRI-O that locates the network namespace.
+type sandboxInfo struct {
+	Pid         int `json:"pid"`
+	RuntimeSpec struct {
+		Linux struct {
+			Namespaces []struct {
+				Type string `json:"type"`
+				Path string `json:"path"`
+			} `json:"namespaces"`
+		} `json:"linux"`
+	} `json:"runtimeSpec"`
+}
+
+func netNSPathFromInfo(sandboxID, info string) (string, error) {
+	si := sandboxInfo{}
+	if err := json.Unmarshal([]byte(info), &si); err != nil {
+		return "", fmt.Errorf("failed to parse info of sandbox %s: %v", sandboxID, err)
+	}
+	for _, ns := range si.RuntimeSpec.Linux.Namespaces {
+		if ns.Type == "network" && ns.Path != "" {
+			return ns.Path, nil
+		}
+	}
+	if si.Pid > 0 {
+		return "/proc/" + strconv.Itoa(si.Pid) + "/ns/net", nil
+	}
+	return "", fmt.Errorf("no network namespace found for sandbox %s", sandboxID)
+}
+
+type podSandbox struct {
+	id        string
+	uid       string
+	state     uint64
+	createdAt uint64
+}
+
+func (sb *podSandbox) betterThan(other *podSandbox) bool {
+	if (sb.state == sandboxReady) != (other.state == sandboxReady) {
+		return sb.state == sandboxReady
+	}
+	return sb.createdAt > other.createdAt
+}
+
+// parsePodSandbox parses a PodSandbox{id: 1, metadata: 2{uid: 2},
+// state: 3, created_at: 4}.
+func parsePodSandbox(b []byte) (*podSandbox, error) {
+	sb := &podSandbox{}
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			sb.id = string(v)
+		case num == 2 && typ == protowire.BytesType:
+			return forEachField(v, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+				if num == 2 && typ == protowire.BytesType {
+					sb.uid = string(v)
+				}
+				return nil
+			})
+		case num == 3 && typ == protowire.VarintType:
+			sb.state = n
+		case num == 4 && typ == protowire.VarintType:
+			sb.createdAt = n
+		}
+		return nil
+	})
+	return sb, err
+}
+
+// parseMapEntry parses an entry of a map<string, string>.
+func parseMapEntry(b []byte) (string, string, error) {
+	key, value := "", ""
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1:
+			key = string(v)
+		case 2:
+			value = string(v)
+		}
+		return nil
+	})
+	return key, value, err
+}
+
+// forEachField calls f with every field of the encoded message, passing
+// length delimited values as bytes and varints as numbers. Other types
+// are skipped.
+func forEachField(b []byte, f func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		num, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		b = b[l:]
+
+		var v []byte
+		var n uint64
+		switch typ {
+		case protowire.BytesType:
+			v, l = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			n, l = protowire.ConsumeVarint(b)
+		default:
+			l = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		b = b[l:]
+
+		if typ == protowire.BytesType || typ == protowire.VarintType {
+			if err := f(num, typ, v, n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build cri && go1.24
+
+package ns_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// fakeCRI answers ListPodSandbox and PodSandboxStatus like a runtime with
+// the given sandboxes, and their verbose info.
+type fakeCRI struct {
+	sandboxes []fakeSandbox
+	info      map[string]string
+}
+
+type fakeSandbox struct {
+	id, uid          string
+	state, createdAt uint64
+}
+
+func (f *fakeCRI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer GinkgoRecover()
+
+	req, err := io.ReadAll(r.Body)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(len(req)).To(BeNumerically(">=", 5))
+
+	var resp []byte
+	switch r.URL.Path {
+	case "/runtime.v1.RuntimeService/ListPodSandbox":
+		for _, sb := range f.sandboxes {
+			var meta, item []byte
+			meta = protowire.AppendTag(meta, 2, protowire.BytesType)
+			meta = protowire.AppendString(meta, sb.uid)
+			item = protowire.AppendTag(item, 1, protowire.BytesType)
+			item = protowire.AppendString(item, sb.id)
+			item = protowire.AppendTag(item, 2, protowire.BytesType)
+			item = protowire.AppendBytes(item, meta)
+			item = protowire.AppendTag(item, 3, protowire.VarintType)
+			item = protowire.AppendVarint(item, sb.state)
+			item = protowire.AppendTag(item, 4, protowire.VarintType)
+			item = protowire.AppendVarint(item, sb.createdAt)
+			resp = protowire.AppendTag(resp, 1, protowire.BytesType)
+			resp = protowire.AppendBytes(resp, item)
+		}
+	case "/runtime.v1.RuntimeService/PodSandboxStatus":
+		id, n := protowire.ConsumeString(req[6:])
+		Expect(n).To(BeNumerically(">", 0))
+		info, ok := f.info[id]
+		if !ok {
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Grpc-Status", "5")
+			w.Header().Set("Grpc-Message", "sandbox not found")
+			return
+		}
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, "info")
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, info)
+		resp = protowire.AppendTag(resp, 2, protowire.BytesType)
+		resp = protowire.AppendBytes(resp, entry)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status")
+	frame := make([]byte, 5)
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(resp)))
+	_, _ = w.Write(append(frame, resp...))
+	w.Header().Set("Grpc-Status", "0")
+}
+
+var _ = Describe("CRI lookup", func() {
+	var endpoint string
+	var server *http.Server
+
+	BeforeEach(func() {
+		socket := filepath.Join(GinkgoT().TempDir(), "cri.sock")
+		endpoint = "unix://" + socket
+		l, err := net.Listen("unix", socket)
+		Expect(err).NotTo(HaveOccurred())
+
+		protocols := &http.Protocols{}
+		protocols.SetUnencryptedHTTP2(true)
+		server = &http.Server{
+			Protocols: protocols,
+			Handler: &fakeCRI{
+				sandboxes: []fakeSandbox{
+					{id: "old", uid: "uid-1", state: 0, createdAt: 1},
+					{id: "notready", uid: "uid-1", state: 1, createdAt: 3},
+					{id: "other", uid: "uid-2", state: 0, createdAt: 2},
+					{id: "gone", uid: "uid-3", state: 0, createdAt: 4},
+				},
+				info: map[string]string{
+					"old":   `{"pid": 42, "runtimeSpec": {"linux": {"namespaces": [{"type": "pid"}, {"type": "network", "path": "/var/run/netns/cni-1234"}]}}}`,
+					"other": `{"pid": 42}`,
+				},
+			},
+		}
+		go server.Serve(l)
+	})
+
+	AfterEach(func() {
+		Expect(server.Close()).To(Succeed())
+	})
+
+	It("resolves the network namespace of a pod's ready sandbox", func() {
+		path, err := ns.NetNSPathByPodUID(context.TODO(), endpoint, "uid-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(path).To(Equal("/var/run/netns/cni-1234"))
+
+		path, err = ns.NetNSPathBySandboxID(context.TODO(), endpoint, "other")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(path).To(Equal("/proc/42/ns/net"))
+	})
+
+	It("reports pods and sandboxes the runtime doesn't know", func() {
+		_, err := ns.NetNSPathByPodUID(context.TODO(), endpoint, "uid-4")
+		Expect(err).To(MatchError("no sandbox found for pod uid-4"))
+
+		_, err = ns.NetNSPathByPodUID(context.TODO(), endpoint, "uid-3")
+		Expect(err).To(MatchError("CRI PodSandboxStatus failed: gRPC status 5: sandbox not found"))
+
+		_, err = ns.NetNSPathBySandboxID(context.TODO(), "tcp://localhost:1234", "old")
+		Expect(err).To(MatchError(ContainSubstring("must be a unix:// socket")))
+	})
+})
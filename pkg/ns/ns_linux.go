@@ -18,10 +18,13 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"runtime/debug"
 	"sync"
 	"syscall"
 
 	"golang.org/x/sys/unix"
+
+	cnierrors "github.com/containernetworking/plugins/pkg/errors"
 )
 
 // Returns an object representing the current OS thread's network namespace
@@ -76,6 +79,7 @@ type NetNS interface {
 	// from Do() should call runtime.UnlockOSThread(), or the risk
 	// of executing code in an incorrect namespace will be greater.  See
 	// https://github.com/golang/go/wiki/LockOSThread for further details.
+	// If toRun panics, Do panics with a *Panic in the calling goroutine.
 	Do(toRun func(NetNS) error) error
 
 	// Sets the current network namespace to this object's network namespace.
@@ -152,6 +156,16 @@ func GetNS(nspath string) (NetNS, error) {
 	return &netNS{file: fd}, nil
 }
 
+// OpenError returns the error of a plugin which failed to open the network
+// namespace at nspath with GetNS. A namespace which doesn't exist is
+// reported with its own error code, see errors.NetNSGone.
+func OpenError(nspath string, err error) error {
+	if _, ok := err.(NSPathNotExistErr); ok {
+		return cnierrors.NetNSGone(nspath, err)
+	}
+	return fmt.Errorf("failed to open netns %q: %v", nspath, err)
+}
+
 func (ns *netNS) Path() string {
 	return ns.file.Name()
 }
@@ -212,13 +226,24 @@ func (ns *netNS) Do(toRun func(NetNS) error) error {
 	// leave the thread locked to die without a risk of the current thread
 	// left lingering with incorrect namespace.
 	var innerError error
+	var innerPanic *Panic
 	go func() {
 		defer wg.Done()
+		// a panic would crash the process, whatever the caller recovers
+		// from, so it is passed on to the caller
+		defer func() {
+			if r := recover(); r != nil {
+				innerPanic = &Panic{Value: r, Stack: debug.Stack()}
+			}
+		}()
 		runtime.LockOSThread()
 		innerError = containedCall(hostNS)
 	}()
 	wg.Wait()
 
+	if innerPanic != nil {
+		panic(innerPanic)
+	}
 	return innerError
 }
 
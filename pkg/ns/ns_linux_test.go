@@ -172,6 +172,20 @@ var _ = Describe("Linux namespace operations", func() {
 				})
 				Expect(err).To(MatchError("potato"))
 			})
+
+			It("passes a panic of the callback on to the caller", func() {
+				var r interface{}
+				func() {
+					defer func() { r = recover() }()
+					_ = targetNetNS.Do(func(ns.NetNS) error {
+						panic("potato")
+					})
+				}()
+				Expect(r).To(BeAssignableToTypeOf(&ns.Panic{}))
+				p := r.(*ns.Panic)
+				Expect(p.Value).To(Equal("potato"))
+				Expect(string(p.Stack)).To(ContainSubstring("ns_linux_test.go"))
+			})
 		})
 
 		Describe("validating inode mapping to namespaces", func() {
@@ -0,0 +1,30 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ns
+
+import "fmt"
+
+// Panic is what NetNS.Do panics with in the calling goroutine when the
+// callback panicked in the goroutine it runs on, so that the caller can
+// recover from it. Value is the value the callback panicked with, Stack
+// the stack of the callback's goroutine.
+type Panic struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (p *Panic) String() string {
+	return fmt.Sprintf("%v [recovered in NetNS.Do]\n\n%s", p.Value, p.Stack)
+}
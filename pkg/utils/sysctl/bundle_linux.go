@@ -0,0 +1,118 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysctl
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Bundles are the named sets of sysctls a Bundle can start from. IFNAME in
+// a key stands for the pod's interface.
+var Bundles = map[string]map[string]string{
+	// strict answers ARP only for addresses of the interface asked on,
+	// and drops packets with sources not routed back through it
+	"strict": {
+		"net.ipv4.conf.IFNAME.arp_ignore":   "1",
+		"net.ipv4.conf.IFNAME.arp_announce": "2",
+		"net.ipv4.conf.IFNAME.rp_filter":    "1",
+	},
+	// no-ra ignores router advertisements, for pods with static IPv6
+	// addresses and routes
+	"no-ra": {
+		"net.ipv6.conf.IFNAME.accept_ra": "0",
+	},
+	// router forwards packets, e.g. for pods routing for others, while
+	// still accepting router advertisements on the interface, and
+	// without dropping asymmetrically routed packets
+	"router": {
+		"net.ipv4.ip_forward":            "1",
+		"net.ipv6.conf.all.forwarding":   "1",
+		"net.ipv6.conf.IFNAME.accept_ra": "2",
+		"net.ipv4.conf.IFNAME.rp_filter": "2",
+	},
+}
+
+// Bundle is a set of sysctls of the pod's network namespace a main plugin
+// applies at ADD, as soon as the pod's interface exists and before its
+// addresses are configured. Unlike with a tuning plugin later in the chain,
+// e.g. router advertisements are then never accepted against the
+// configuration.
+type Bundle struct {
+	// Name is the set of Bundles to start from
+	Name string `json:"name,omitempty"`
+	// Sysctls add to the named set, or override its values. IFNAME in a
+	// key stands for the pod's interface.
+	Sysctls map[string]string `json:"sysctls,omitempty"`
+}
+
+// Validate checks the name of the set, and that every sysctl is one of the
+// network namespace.
+func (b *Bundle) Validate() error {
+	if b == nil {
+		return nil
+	}
+	if _, ok := Bundles[b.Name]; b.Name != "" && !ok {
+		names := make([]string, 0, len(Bundles))
+		for name := range Bundles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown sysctl bundle %q, must be one of %s", b.Name, strings.Join(names, ", "))
+	}
+	for key := range b.Sysctls {
+		if !strings.HasPrefix(key, "net.") || strings.Contains(key, "/") || strings.Contains(key, "..") {
+			return fmt.Errorf("invalid sysctl %q, must be a net. sysctl", key)
+		}
+	}
+	return nil
+}
+
+// Values returns the sysctls of the bundle for the interface ifName, by
+// their slash separated names, so interface names with dots are kept.
+func (b *Bundle) Values(ifName string) map[string]string {
+	values := map[string]string{}
+	if b == nil {
+		return values
+	}
+	set := func(key, value string) {
+		name := strings.ReplaceAll(key, ".", "/")
+		values[strings.Replace(name, "IFNAME", ifName, 1)] = value
+	}
+	for key, value := range Bundles[b.Name] {
+		set(key, value)
+	}
+	for key, value := range b.Sysctls {
+		set(key, value)
+	}
+	return values
+}
+
+// IgnoresRouterAdvertisements reports whether the bundle turns accepting
+// router advertisements off on the pod's interface.
+func (b *Bundle) IgnoresRouterAdvertisements() bool {
+	return b.Values("IFNAME")["net/ipv6/conf/IFNAME/accept_ra"] == "0"
+}
+
+// Apply sets the sysctls of the bundle for the interface ifName, in the
+// current network namespace, as a unit: if one fails, the others are put
+// back. The namespace goes away with the pod, so nothing is put back on DEL.
+func (b *Bundle) Apply(ifName string) error {
+	if b == nil {
+		return nil
+	}
+	return NewTx().Apply(b.Values(ifName))
+}
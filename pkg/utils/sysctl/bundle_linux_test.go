@@ -0,0 +1,75 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysctl_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+)
+
+var _ = Describe("Sysctl bundles", func() {
+	It("validates the name and the sysctls", func() {
+		var nilBundle *sysctl.Bundle
+		Expect(nilBundle.Validate()).To(Succeed())
+		Expect((&sysctl.Bundle{Name: "strict"}).Validate()).To(Succeed())
+		Expect((&sysctl.Bundle{Name: "lax"}).Validate()).To(MatchError(`unknown sysctl bundle "lax", must be one of no-ra, router, strict`))
+		Expect((&sysctl.Bundle{Sysctls: map[string]string{"kernel.panic": "1"}}).Validate()).To(MatchError(`invalid sysctl "kernel.panic", must be a net. sysctl`))
+		Expect((&sysctl.Bundle{Sysctls: map[string]string{"net.ipv4/../../kernel.panic": "1"}}).Validate()).To(HaveOccurred())
+	})
+
+	It("resolves the interface and overrides the named set", func() {
+		b := &sysctl.Bundle{
+			Name:    "strict",
+			Sysctls: map[string]string{"net.ipv4.conf.IFNAME.rp_filter": "2"},
+		}
+		Expect(b.Values("eth0.100")).To(Equal(map[string]string{
+			"net/ipv4/conf/eth0.100/arp_ignore":   "1",
+			"net/ipv4/conf/eth0.100/arp_announce": "2",
+			"net/ipv4/conf/eth0.100/rp_filter":    "2",
+		}))
+	})
+
+	It("applies the sysctls in the namespace", func() {
+		testNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer func() {
+			Expect(testNS.Close()).To(Succeed())
+			Expect(testutils.UnmountNS(testNS)).To(Succeed())
+		}()
+
+		inTestNS(testNS, func() {
+			b := &sysctl.Bundle{Name: "strict"}
+			Expect(b.Apply("lo")).To(Succeed())
+			Expect(sysctl.Sysctl("net.ipv4.conf.lo.arp_ignore")).To(Equal("1"))
+			Expect(sysctl.Sysctl("net.ipv4.conf.lo.arp_announce")).To(Equal("2"))
+			Expect(sysctl.Sysctl("net.ipv4.conf.lo.rp_filter")).To(Equal("1"))
+
+			// nothing is set when one of them fails
+			Expect(sysctl.Sysctl("net.ipv4.conf.lo.arp_notify", "0")).To(Equal("0"))
+			b = &sysctl.Bundle{Sysctls: map[string]string{
+				"net.ipv4.conf.IFNAME.arp_notify":      "1",
+				"net.ipv4.conf.nonexistent.arp_notify": "1",
+			}}
+			Expect(b.Apply("lo")).To(HaveOccurred())
+			Expect(sysctl.Sysctl("net.ipv4.conf.lo.arp_notify")).To(Equal("0"))
+		})
+
+		var nilBundle *sysctl.Bundle
+		Expect(nilBundle.Apply("lo")).To(Succeed())
+	})
+})
@@ -0,0 +1,131 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysctl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Prior is the value a sysctl had before a Tx changed it.
+type Prior struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Set is the value the Tx wrote in its place
+	Set string `json:"set"`
+}
+
+// Tx applies a set of sysctls as a unit: it remembers the value each one
+// had before, so all of them can be put back when a later step fails, or
+// persisted with Priors and put back with Restore on DEL.
+type Tx struct {
+	priors []Prior
+}
+
+func NewTx() *Tx {
+	return &Tx{}
+}
+
+// Set writes value to the sysctl name. Setting the value it already has
+// is a no-op and isn't rolled back.
+func (t *Tx) Set(name, value string) error {
+	prior, err := getSysctl(name)
+	if err != nil {
+		return err
+	}
+	if sameValue(prior, value) {
+		return nil
+	}
+	if _, err := setSysctl(name, value); err != nil {
+		return err
+	}
+	t.priors = append(t.priors, Prior{Name: name, Value: prior, Set: value})
+	return nil
+}
+
+// SetOptional is Set for sysctls not every kernel has, e.g. those of a
+// disabled IPv6, which are skipped.
+func (t *Tx) SetOptional(name, value string) error {
+	if err := t.Set(name, value); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Apply sets all values, in the order of their names. If one fails, the
+// whole Tx is rolled back.
+func (t *Tx) Apply(values map[string]string) error {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := t.Set(name, values[name]); err != nil {
+			err = fmt.Errorf("failed to set sysctl %s to %q: %v", name, values[name], err)
+			if rbErr := t.Rollback(); rbErr != nil {
+				return fmt.Errorf("%v, rolling back: %v", err, rbErr)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Rollback puts back the prior values, the latest first, and empties the
+// Tx.
+func (t *Tx) Rollback() error {
+	err := Restore(t.priors)
+	t.priors = nil
+	return err
+}
+
+// Priors returns the values the Tx changed, for Restore.
+func (t *Tx) Priors() []Prior {
+	return append([]Prior(nil), t.priors...)
+}
+
+// Restore puts back the prior values, the latest first. Sysctls changed
+// again since, or gone along with their interface, are left alone.
+func Restore(priors []Prior) error {
+	var errs []error
+	for i := len(priors) - 1; i >= 0; i-- {
+		p := priors[i]
+		cur, err := getSysctl(p.Name)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				errs = append(errs, fmt.Errorf("failed to read sysctl %s: %v", p.Name, err))
+			}
+			continue
+		}
+		if !sameValue(cur, p.Set) {
+			continue
+		}
+		if _, err := setSysctl(p.Name, p.Value); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("failed to restore sysctl %s to %q: %v", p.Name, p.Value, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sameValue compares sysctl values regardless of the whitespace between
+// the fields of multi-valued ones, which the kernel reports tab separated.
+func sameValue(a, b string) bool {
+	return strings.Join(strings.Fields(a), " ") == strings.Join(strings.Fields(b), " ")
+}
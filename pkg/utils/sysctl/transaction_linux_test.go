@@ -0,0 +1,118 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysctl_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+)
+
+const (
+	forwardKey = "net.ipv4.ip_forward"
+	arpKey     = "net.ipv4.conf.lo.arp_notify"
+)
+
+var _ = Describe("Sysctl transactions", func() {
+	var testNS ns.NetNS
+
+	BeforeEach(func() {
+		var err error
+		testNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		// a new network namespace may inherit the host's values
+		inTestNS(testNS, func() {
+			Expect(sysctl.Sysctl(forwardKey, "0")).To(Equal("0"))
+			Expect(sysctl.Sysctl(arpKey, "0")).To(Equal("0"))
+		})
+	})
+
+	AfterEach(func() {
+		Expect(testNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(testNS)).To(Succeed())
+	})
+
+	It("applies values and rolls them back", func() {
+		inTestNS(testNS, func() {
+			tx := sysctl.NewTx()
+			Expect(tx.Apply(map[string]string{forwardKey: "1", arpKey: "1"})).To(Succeed())
+			Expect(sysctl.Sysctl(forwardKey)).To(Equal("1"))
+			Expect(sysctl.Sysctl(arpKey)).To(Equal("1"))
+			Expect(tx.Priors()).To(ConsistOf(
+				sysctl.Prior{Name: forwardKey, Value: "0", Set: "1"},
+				sysctl.Prior{Name: arpKey, Value: "0", Set: "1"},
+			))
+
+			Expect(tx.Rollback()).To(Succeed())
+			Expect(sysctl.Sysctl(forwardKey)).To(Equal("0"))
+			Expect(sysctl.Sysctl(arpKey)).To(Equal("0"))
+		})
+	})
+
+	It("rolls back the values set so far when one fails", func() {
+		inTestNS(testNS, func() {
+			tx := sysctl.NewTx()
+			err := tx.Apply(map[string]string{
+				"net.ipv4.conf.lo.arp_notify":          "1",
+				"net.ipv4.conf.nonexistent.arp_notify": "1",
+			})
+			Expect(err).To(MatchError(ContainSubstring("failed to set sysctl net.ipv4.conf.nonexistent.arp_notify")))
+			Expect(sysctl.Sysctl(arpKey)).To(Equal("0"))
+			Expect(tx.Priors()).To(BeEmpty())
+		})
+	})
+
+	It("doesn't remember values which didn't change", func() {
+		inTestNS(testNS, func() {
+			tx := sysctl.NewTx()
+			Expect(tx.Set(forwardKey, "0")).To(Succeed())
+			Expect(tx.Priors()).To(BeEmpty())
+		})
+	})
+
+	It("skips optional sysctls the kernel doesn't have", func() {
+		inTestNS(testNS, func() {
+			tx := sysctl.NewTx()
+			Expect(tx.SetOptional("net.ipv4.conf.nonexistent.arp_notify", "1")).To(Succeed())
+			Expect(tx.Set("net.ipv4.conf.nonexistent.arp_notify", "1")).NotTo(Succeed())
+		})
+	})
+
+	It("restores persisted priors, but not values changed since", func() {
+		inTestNS(testNS, func() {
+			tx := sysctl.NewTx()
+			Expect(tx.Apply(map[string]string{forwardKey: "1", arpKey: "1"})).To(Succeed())
+			priors := tx.Priors()
+
+			Expect(sysctl.Sysctl(arpKey, "2")).To(Equal("2"))
+			Expect(sysctl.Restore(priors)).To(Succeed())
+			Expect(sysctl.Sysctl(forwardKey)).To(Equal("0"))
+			Expect(sysctl.Sysctl(arpKey)).To(Equal("2"))
+		})
+	})
+})
+
+func inTestNS(testNS ns.NetNS, f func()) {
+	err := testNS.Do(func(ns.NetNS) error {
+		defer GinkgoRecover()
+		f()
+		return nil
+	})
+	Expect(err).NotTo(HaveOccurred())
+}
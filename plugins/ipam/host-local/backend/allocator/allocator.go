@@ -19,17 +19,26 @@ import (
 	"log"
 	"net"
 	"os"
+	"sort"
 	"strconv"
 
 	current "github.com/containernetworking/cni/pkg/types/100"
+	cnierrors "github.com/containernetworking/plugins/pkg/errors"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
 )
 
+// IPAllocator allocates addresses of a range set from a store. None of its
+// methods lock the store, those using it must be called with the store
+// locked, so that the caller can combine several of them atomically.
 type IPAllocator struct {
 	rangeset *RangeSet
 	store    backend.Store
 	rangeID  string // Used for tracking last reserved ip
+	owner    Owner  // Who is allocating, see LoadReservations
+	spread   bool   // see SetSpread
+
+	stableKey []byte // see SetStable
 }
 
 func NewIPAllocator(s *RangeSet, store backend.Store, id int) *IPAllocator {
@@ -40,12 +49,30 @@ func NewIPAllocator(s *RangeSet, store backend.Store, id int) *IPAllocator {
 	}
 }
 
-// GetByPodNsAndName allocates an IP or used reserved IP for specified pod
+// SetOwner sets who the allocator allocates for, so addresses reserved for
+// the owner are handed out to it and addresses reserved for others are not.
+func (a *IPAllocator) SetOwner(owner Owner) {
+	a.owner = owner
+}
+
+// SetSpread makes the allocator start each interface of a container in the
+// range fewest of the container's other interfaces have an address from,
+// instead of filling the first range before moving on to the next.
+func (a *IPAllocator) SetSpread(spread bool) {
+	a.spread = spread
+}
+
+// GetByPodNsAndName allocates an IP or used reserved IP for specified pod.
+// The store must be locked, so that all addresses of an ADD are allocated
+// atomically.
 func (a *IPAllocator) GetByPodNsAndName(id string, ifname string, requestedIP net.IP, podNs, podName string) (*current.IPConfig, error) {
-	a.store.Lock()
-	defer a.store.Unlock()
 	if len(podName) != 0 {
 		podIPIsExist, knownIP := a.store.HasReservedIP(podNs, podName)
+		// with several range sets, the pod's address may be one of another
+		// range set
+		if podIPIsExist && !a.rangeset.Contains(knownIP) {
+			podIPIsExist = false
+		}
 
 		if podIPIsExist {
 			// podName file is exist, update ip file with new container id.
@@ -73,7 +100,9 @@ func (a *IPAllocator) GetByPodNsAndName(id string, ifname string, requestedIP ne
 		if ipCfg != nil {
 			_, err := a.store.ReservePodInfo(id, ipCfg.Address.IP, podNs, podName, podIPIsExist)
 			if err != nil {
-				return ipCfg, err
+				// don't leak the address reserved above
+				_, _ = a.store.ReleaseByIP(ipCfg.Address.IP)
+				return nil, err
 			}
 		}
 		return ipCfg, nil
@@ -82,7 +111,7 @@ func (a *IPAllocator) GetByPodNsAndName(id string, ifname string, requestedIP ne
 	return a.Get(id, ifname, requestedIP)
 }
 
-// Get allocates an IP
+// Get allocates an IP. The store must be locked.
 func (a *IPAllocator) Get(id string, ifname string, requestedIP net.IP) (*current.IPConfig, error) {
 	var reservedIP *net.IPNet
 	var gw net.IP
@@ -100,13 +129,16 @@ func (a *IPAllocator) Get(id string, ifname string, requestedIP net.IP) (*curren
 		if requestedIP.Equal(r.Gateway) {
 			return nil, fmt.Errorf("requested ip %s is subnet's gateway", requestedIP.String())
 		}
+		if owner, ok := a.rangeset.reservedFor(requestedIP); ok && !owner.matches(a.owner) {
+			return nil, cnierrors.Conflict(requestedIP.String(), fmt.Errorf("requested IP address %s is reserved for %s", requestedIP, owner))
+		}
 
 		reserved, err := a.store.Reserve(id, ifname, requestedIP, a.rangeID)
 		if err != nil {
 			return nil, err
 		}
 		if !reserved {
-			return nil, fmt.Errorf("requested IP address %s is not available in range set %s", requestedIP, a.rangeset.String())
+			return nil, cnierrors.Conflict(requestedIP.String(), fmt.Errorf("requested IP address %s is not available in range set %s", requestedIP, a.rangeset.String()))
 		}
 		reservedIP = &net.IPNet{IP: requestedIP, Mask: r.Subnet.Mask}
 		gw = r.Gateway
@@ -123,29 +155,53 @@ func (a *IPAllocator) Get(id string, ifname string, requestedIP net.IP) (*curren
 			}
 		}
 
-		iter, err := a.GetIter()
-		if err != nil {
-			return nil, err
+		// the owner's reservation is preferred; if something else holds it,
+		// e.g. as it was allocated before the reservation was added, fall
+		// back to a free address
+		if ownIP := a.rangeset.reservationOf(a.owner); ownIP != nil {
+			if err := canonicalizeIP(&ownIP); err != nil {
+				return nil, err
+			}
+			reserved, err := a.store.Reserve(id, ifname, ownIP, a.rangeID)
+			if err != nil {
+				return nil, err
+			}
+			if reserved {
+				reservedIP, gw = a.GetGWofKnowIP(ownIP)
+				return &current.IPConfig{
+					Address: *reservedIP,
+					Gateway: gw,
+				}, nil
+			}
 		}
-		for {
-			reservedIP, gw = iter.Next()
-			if reservedIP == nil {
+
+		tiers := []RangeSet{*a.rangeset}
+		if a.rangeset.hasFailover() {
+			tiers = a.rangeset.failoverTiers()
+		}
+		for i := range tiers {
+			tier := *a
+			tier.rangeset = &tiers[i]
+			var err error
+			reservedIP, gw, err = tier.getStable(id, ifname)
+			if err != nil {
+				return nil, err
+			}
+			if reservedIP != nil {
 				break
 			}
-
-			reserved, err := a.store.Reserve(id, ifname, reservedIP.IP, a.rangeID)
+			reservedIP, gw, err = tier.getFree(id, ifname)
 			if err != nil {
 				return nil, err
 			}
-
-			if reserved {
+			if reservedIP != nil {
 				break
 			}
 		}
 	}
 
 	if reservedIP == nil {
-		return nil, fmt.Errorf("no IP addresses available in range set: %s", a.rangeset.String())
+		return nil, cnierrors.PoolExhausted(a.rangeset.String())
 	}
 
 	return &current.IPConfig{
@@ -154,14 +210,121 @@ func (a *IPAllocator) Get(id string, ifname string, requestedIP net.IP) (*curren
 	}, nil
 }
 
-// Release clears all IPs allocated for the container with given ID
-func (a *IPAllocator) Release(id string, ifname string) error {
-	a.store.Lock()
-	defer a.store.Unlock()
+// getFree reserves the next free address of the range set that isn't
+// reserved for anyone, and returns nil if there is none.
+func (a *IPAllocator) getFree(id string, ifname string) (*net.IPNet, net.IP, error) {
+	startRange := -1
+	if a.spread {
+		startRange = a.spreadRange(id)
+	}
+	iter, err := a.getIter(startRange)
+	if err != nil {
+		return nil, nil, err
+	}
+	for {
+		reservedIP, gw := iter.Next()
+		if reservedIP == nil {
+			return nil, nil, nil
+		}
+		if _, ok := a.rangeset.reservedFor(reservedIP.IP); ok {
+			continue
+		}
+
+		reserved, err := a.store.Reserve(id, ifname, reservedIP.IP, a.rangeID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if reserved {
+			return reservedIP, gw, nil
+		}
+	}
+}
+
+// GetExtra allocates another free address of the range set to the
+// container, which already has one from it, see IPAMConfig.PerPodIPs.
+// Reservations, stable addresses and requested IPs only apply to the first
+// address. The store must be locked.
+func (a *IPAllocator) GetExtra(id string, ifname string) (*current.IPConfig, error) {
+	tiers := []RangeSet{*a.rangeset}
+	if a.rangeset.hasFailover() {
+		tiers = a.rangeset.failoverTiers()
+	}
+	for i := range tiers {
+		tier := *a
+		tier.rangeset = &tiers[i]
+		reservedIP, gw, err := tier.getFree(id, ifname)
+		if err != nil {
+			return nil, err
+		}
+		if reservedIP != nil {
+			return &current.IPConfig{
+				Address: *reservedIP,
+				Gateway: gw,
+			}, nil
+		}
+	}
+	return nil, cnierrors.PoolExhausted(a.rangeset.String())
+}
 
+// Release clears all IPs allocated for the container with given ID. The
+// store must be locked.
+func (a *IPAllocator) Release(id string, ifname string) error {
 	return a.store.ReleaseByID(id, ifname)
 }
 
+// Allocated returns the address allocated to the container from this range
+// set before, or nil if there is none. The store must be locked.
+func (a *IPAllocator) Allocated(id string, ifname string) *current.IPConfig {
+	if all := a.AllocatedAll(id, ifname); len(all) > 0 {
+		return all[0]
+	}
+	return nil
+}
+
+// AllocatedAll returns all addresses allocated to the container from this
+// range set before, ordered by address, see IPAMConfig.PerPodIPs. The
+// store must be locked.
+func (a *IPAllocator) AllocatedAll(id string, ifname string) []*current.IPConfig {
+	var ips []net.IP
+	for _, ip := range a.store.GetByID(id, ifname) {
+		if a.rangeset.Contains(ip) {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Slice(ips, func(i, j int) bool { return ip.Cmp(ips[i], ips[j]) < 0 })
+
+	ipConfs := make([]*current.IPConfig, 0, len(ips))
+	for _, ip := range ips {
+		reservedIP, gw := a.GetGWofKnowIP(ip)
+		ipConfs = append(ipConfs, &current.IPConfig{
+			Address: *reservedIP,
+			Gateway: gw,
+		})
+	}
+	return ipConfs
+}
+
+// spreadRange returns the index of the range in the set the fewest
+// interfaces of the container have an address from, the first one on a tie.
+func (a *IPAllocator) spreadRange(id string) int {
+	used := make([]int, len(*a.rangeset))
+	for _, ip := range a.store.GetByContainer(id) {
+		for i, r := range *a.rangeset {
+			if r.Contains(ip) {
+				used[i]++
+				break
+			}
+		}
+	}
+	least := 0
+	for i := range used {
+		if used[i] < used[least] {
+			least = i
+		}
+	}
+	return least
+}
+
 // GetGWofKnowIP returns the known IP, its mask, and its gateway
 func (a *IPAllocator) GetGWofKnowIP(ip net.IP) (*net.IPNet, net.IP) {
 	rg := Range{}
@@ -192,7 +355,14 @@ type RangeIter struct {
 // More specifically, a crash-looping container will not see the same IP until
 // the entire range has been run through.
 // We may wish to consider avoiding recently-released IPs in the future.
+// The store must be locked.
 func (a *IPAllocator) GetIter() (*RangeIter, error) {
+	return a.getIter(-1)
+}
+
+// getIter is GetIter starting in the range with index startRange, unless
+// it is negative. Round-robin is kept within that range only.
+func (a *IPAllocator) getIter(startRange int) (*RangeIter, error) {
 	iter := RangeIter{
 		rangeset: a.rangeset,
 	}
@@ -206,7 +376,11 @@ func (a *IPAllocator) GetIter() (*RangeIter, error) {
 	if err != nil && !os.IsNotExist(err) {
 		log.Printf("Error retrieving last reserved ip: %v", err)
 	} else if lastReservedIP != nil {
-		startFromLastReservedIP = a.rangeset.Contains(lastReservedIP)
+		if startRange >= 0 {
+			startFromLastReservedIP = (*a.rangeset)[startRange].Contains(lastReservedIP)
+		} else {
+			startFromLastReservedIP = a.rangeset.Contains(lastReservedIP)
+		}
 	}
 
 	// Find the range in the set with this IP
@@ -222,8 +396,8 @@ func (a *IPAllocator) GetIter() (*RangeIter, error) {
 			}
 		}
 	} else {
-		iter.rangeIdx = 0
-		iter.startIP = (*a.rangeset)[0].RangeStart
+		iter.rangeIdx = max(startRange, 0)
+		iter.startIP = (*a.rangeset)[iter.rangeIdx].RangeStart
 	}
 	return &iter, nil
 }
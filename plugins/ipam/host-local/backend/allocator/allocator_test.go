@@ -23,6 +23,8 @@ import (
 
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
+	cnierrors "github.com/containernetworking/plugins/pkg/errors"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
 	fakestore "github.com/containernetworking/plugins/plugins/ipam/host-local/backend/testing"
 )
 
@@ -282,6 +284,7 @@ var _ = Describe("host-local ip allocator", func() {
 
 				_, err = alloc.Get("ID", "eth0", requestedIP)
 				Expect(err).To(MatchError(`requested IP address 192.168.1.5 is not available in range set 192.168.1.1-192.168.1.6`))
+				Expect(cnierrors.KindOf(err)).To(Equal(cnierrors.KindConflict))
 			})
 
 			It("must return an error when the requested IP is after RangeEnd", func() {
@@ -332,6 +335,7 @@ var _ = Describe("host-local ip allocator", func() {
 				_, err := tc.run(idx)
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(HavePrefix("no IP addresses available in range set"))
+				Expect(cnierrors.KindOf(err)).To(Equal(cnierrors.KindPoolExhausted))
 			}
 		})
 	})
@@ -368,6 +372,143 @@ var _ = Describe("host-local ip allocator", func() {
 			Expect(r.startIP).To(Equal(net.IP{192, 168, 1, 0}))
 		})
 	})
+
+	Context("with a backup range", func() {
+		var (
+			alloc  IPAllocator
+			uplink map[string]bool
+		)
+
+		BeforeEach(func() {
+			uplink = map[string]bool{"eth0": true}
+			orig := carrierUp
+			carrierUp = func(ifName string) bool { return uplink[ifName] }
+			DeferCleanup(func() { carrierUp = orig })
+
+			p := RangeSet{
+				Range{Subnet: mustSubnet("192.168.1.0/30"), Name: "wired", Uplink: "eth0"},
+				Range{Subnet: mustSubnet("192.168.2.0/30"), BackupFor: "wired"},
+			}
+			Expect(p.Canonicalize()).To(Succeed())
+			alloc = IPAllocator{
+				rangeset: &p,
+				store:    fakestore.NewFakeStore(map[string]string{}, map[string]net.IP{}),
+				rangeID:  "rangeid",
+			}
+		})
+
+		It("only allocates from the backup once the primary is exhausted", func() {
+			res, err := alloc.Get("ID1", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Address.String()).To(Equal("192.168.1.2/30"))
+			res, err = alloc.Get("ID2", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Address.String()).To(Equal("192.168.2.2/30"))
+		})
+
+		It("allocates from the backup while the uplink of the primary is down", func() {
+			uplink["eth0"] = false
+			res, err := alloc.Get("ID1", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Address.String()).To(Equal("192.168.2.2/30"))
+
+			// back to the primary, despite round-robin
+			uplink["eth0"] = true
+			res, err = alloc.Get("ID2", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Address.String()).To(Equal("192.168.1.2/30"))
+		})
+
+		It("rejects invalid backups", func() {
+			for _, p := range []RangeSet{
+				{Range{Subnet: mustSubnet("192.168.1.0/30"), BackupFor: "wired"}},
+				{
+					Range{Subnet: mustSubnet("192.168.1.0/30"), Name: "wired"},
+					Range{Subnet: mustSubnet("192.168.2.0/30"), Name: "wired"},
+				},
+				{Range{Subnet: mustSubnet("192.168.1.0/30"), Name: "wired", BackupFor: "wired"}},
+				{
+					Range{Subnet: mustSubnet("192.168.1.0/30"), Name: "wired", BackupFor: "lte"},
+					Range{Subnet: mustSubnet("192.168.2.0/30"), Name: "lte", BackupFor: "wired"},
+				},
+			} {
+				Expect(p.Canonicalize()).NotTo(Succeed())
+			}
+		})
+	})
+
+	Context("with stable IPv6 addresses", func() {
+		mkStable := func(store *fakestore.FakeStore) *IPAllocator {
+			p := RangeSet{Range{Subnet: mustSubnet("2001:db8:1::/64")}}
+			Expect(p.Canonicalize()).To(Succeed())
+			alloc := NewIPAllocator(&p, store, 0)
+			alloc.SetStable([]byte("secret"))
+			return alloc
+		}
+
+		It("derives the address from the pod", func() {
+			alloc := mkStable(fakestore.NewFakeStore(map[string]string{}, map[string]net.IP{}))
+			alloc.SetOwner(Owner{PodNamespace: "default", PodName: "web-0"})
+			first, err := alloc.Get("ID1", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(first.Address.IP.String()).NotTo(Equal("2001:db8:1::2"))
+			Expect(first.Gateway.String()).To(Equal("2001:db8:1::1"))
+
+			// the recreated pod gets the same address from another store
+			alloc = mkStable(fakestore.NewFakeStore(map[string]string{}, map[string]net.IP{}))
+			alloc.SetOwner(Owner{PodNamespace: "default", PodName: "web-0"})
+			again, err := alloc.Get("ID2", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(again.Address).To(Equal(first.Address))
+
+			alloc.SetOwner(Owner{PodNamespace: "default", PodName: "web-1"})
+			other, err := alloc.Get("ID3", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(other.Address).NotTo(Equal(first.Address))
+		})
+
+		It("derives another address if the first is taken", func() {
+			store := fakestore.NewFakeStore(map[string]string{}, map[string]net.IP{})
+			alloc := mkStable(store)
+			owner := Owner{PodNamespace: "default", PodName: "web-0"}
+			alloc.SetOwner(owner)
+			taken := stableIP([]byte("secret"), &(*alloc.rangeset)[0], owner, "eth0", 0)
+			reserved, err := store.Reserve("other", "eth0", taken, "0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+
+			res, err := alloc.Get("ID1", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Address.IP).To(Equal(stableIP([]byte("secret"), &(*alloc.rangeset)[0], owner, "eth0", 1)))
+		})
+
+		It("allocates sequentially without a pod name", func() {
+			alloc := mkStable(fakestore.NewFakeStore(map[string]string{}, map[string]net.IP{}))
+			res, err := alloc.Get("ID1", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Address.IP.String()).To(Equal("2001:db8:1::2"))
+		})
+	})
+
+	Context("with a disk store", func() {
+		It("leaves locking to the caller", func() {
+			store, err := disk.New("mynet", GinkgoT().TempDir())
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+			rs := RangeSet{Range{Subnet: mustSubnet("192.168.1.0/29")}}
+			Expect(rs.Canonicalize()).To(Succeed())
+			alloc := NewIPAllocator(&rs, store, 0)
+
+			// allocating and releasing under one lock must not deadlock
+			Expect(store.Lock()).To(Succeed())
+			res, err := alloc.Get("ID", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Address.String()).To(Equal("192.168.1.2/29"))
+			Expect(alloc.Release("ID", "eth0")).To(Succeed())
+			Expect(alloc.Allocated("ID", "eth0")).To(BeNil())
+			Expect(store.Unlock()).To(Succeed())
+		})
+	})
 })
 
 // nextip is a convenience function used for testing
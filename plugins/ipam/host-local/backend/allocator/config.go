@@ -18,26 +18,31 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/version"
-	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/cniargs"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/ipam"
 )
 
 // The top-level network config - IPAM plugins are passed the full configuration
 // of the calling plugin, not just the IPAM section.
 type Net struct {
-	Name          string      `json:"name"`
-	CNIVersion    string      `json:"cniVersion"`
-	IPAM          *IPAMConfig `json:"ipam"`
+	Name       string      `json:"name"`
+	CNIVersion string      `json:"cniVersion"`
+	IPAM       *IPAMConfig `json:"ipam"`
+	DNS        types.DNS   `json:"dns"`
+	PrevResult *struct {
+		DNS types.DNS `json:"dns"`
+	} `json:"prevResult,omitempty"`
 	RuntimeConfig struct {
 		// The capability arg
 		IPRanges []RangeSet `json:"ipRanges,omitempty"`
-		IPs      []*ip.IP   `json:"ips,omitempty"`
 	} `json:"runtimeConfig,omitempty"`
-	Args *struct {
-		A *IPAMArgs `json:"cni"`
-	} `json:"args"`
 }
 
 // IPAMConfig represents the IP related network configuration.
@@ -51,16 +56,262 @@ type IPAMConfig struct {
 	DataDir    string         `json:"dataDir"`
 	ResolvConf string         `json:"resolvConf"`
 	Ranges     []RangeSet     `json:"ranges"`
-	IPArgs     []net.IP       `json:"-"` // Requested IPs from CNI_ARGS, args and capabilities
+	// StoreFormat is "files" (default) or "journal", see disk.NewJournal
+	StoreFormat string `json:"storeFormat,omitempty"`
+	// OnDuplicate is the policy for an ADD of a container ID and interface
+	// which already has addresses, see DuplicateError
+	OnDuplicate string `json:"onDuplicate,omitempty"`
+	// DNSPolicy is how the resolvConf DNS is combined with ProvidedDNS,
+	// see DNSReplace
+	DNSPolicy string `json:"dnsPolicy,omitempty"`
+	// Handover lets a new container of a pod take over the pod's addresses
+	// while the old container keeps its lease, see Handover
+	Handover *Handover `json:"handover,omitempty"`
+	// Integrity protects the lease files with a node key, see Integrity
+	Integrity *Integrity `json:"integrity,omitempty"`
+	// Snapshots keeps periodic copies of the store, see Snapshots
+	Snapshots *Snapshots `json:"snapshots,omitempty"`
+	// Tombstones makes DELs of recently deleted attachments deterministic,
+	// see Tombstones
+	Tombstones *Tombstones `json:"tombstones,omitempty"`
+	// Quarantine holds released addresses back from new attachments for a
+	// while, see Quarantine
+	Quarantine *Quarantine `json:"quarantine,omitempty"`
+	// RateLimit throttles the ADDs of each requester, see RateLimit
+	RateLimit *RateLimit `json:"rateLimit,omitempty"`
+	// LeaseTTL makes the leases of the network expire, see LeaseTTL
+	LeaseTTL *LeaseTTL `json:"leaseTTL,omitempty"`
+	// SpreadInterfaces spreads the interfaces of a container over the
+	// ranges of a range set, see IPAllocator.SetSpread
+	SpreadInterfaces bool `json:"spreadInterfaces,omitempty"`
+	// StableIPv6 derives the IPv6 addresses of pods from their identity,
+	// see StableIPv6
+	StableIPv6 *StableIPv6 `json:"stableIPv6,omitempty"`
+	// WriteBehind is rejected: the plugin exits right after its changes,
+	// so it writes them right away. Long running processes batch their
+	// writes with ipalloc.OpenWriteBehindStore instead.
+	WriteBehind json.RawMessage `json:"writeBehind,omitempty"`
+	// SecondaryStore is written along with the store while the network is
+	// migrated to it, see SecondaryStore
+	SecondaryStore *SecondaryStore `json:"secondaryStore,omitempty"`
+	// SELinuxContext labels the store, see disk.Store.SetLabel
+	SELinuxContext string `json:"selinuxContext,omitempty"`
+	// PerPodIPs is the number of addresses allocated to the interface from
+	// each range set, e.g. for pods with many listeners which need an
+	// address each. CNI_ARGS PER_POD_IPS overrides it. 0 means 1.
+	PerPodIPs int `json:"perPodIPs,omitempty"`
+	// Annotate records the range set, range and sticky lease each address
+	// was allocated from, for later plugins of the chain, see package
+	// annotations. AnnotationsDir is where, annotations.DefaultDir unless
+	// set.
+	Annotate       bool   `json:"annotate,omitempty"`
+	AnnotationsDir string `json:"annotationsDir,omitempty"`
+	// Hostname is the template the names of the addresses are computed
+	// by, e.g. "${POD_NAME}.${POD_NAMESPACE}.site.example", see HostnameOf.
+	// The domain of the names is the domain of the DNS result, and the
+	// names are recorded with annotate, so DNS registration later in the
+	// chain agrees on them.
+	Hostname string `json:"hostname,omitempty"`
+	// Timeout bounds an invocation, waiting for the store lock included,
+	// e.g. "10s", see ipam.ExecTimeout. Main plugins kill the plugin once
+	// it runs over.
+	Timeout     string        `json:"timeout,omitempty"`
+	ExecTimeout time.Duration `json:"-"`
+	// ProvidedDNS is the DNS of the previous result, the network
+	// configuration and the runtime, in that order
+	ProvidedDNS []types.DNS `json:"-"`
+	IPArgs      []net.IP    `json:"-"` // Requested IPs from CNI_ARGS, args and capabilities
+	// LegacyIPArgs is set when IPs are requested by CNI_ARGS IP or
+	// args.cni.ips, which are deprecated for the ips capability
+	LegacyIPArgs bool `json:"-"`
+	// requestedMasks are the prefixes IPs were requested with, by IP
+	requestedMasks map[string]net.IPMask
+	// PodNamespace and PodName are taken from CNI_ARGS
+	PodNamespace string `json:"-"`
+	PodName      string `json:"-"`
+	// MAC is the requested MAC address, see cniargs.Args.MAC
+	MAC string `json:"-"`
+	// VLAN and Parent are those of the attachment, passed by the main
+	// plugin in CNI_ARGS, see cniargs.KeyVLAN
+	VLAN   int    `json:"-"`
+	Parent string `json:"-"`
 }
 
-type IPAMEnvArgs struct {
-	types.CommonArgs
-	IP ip.IP `json:"ip,omitempty"`
+// KeyPerPodIPs is the CNI_ARGS key overriding IPAMConfig.PerPodIPs.
+const KeyPerPodIPs = "PER_POD_IPS"
+
+// MaxPerPodIPs is the most addresses an interface is allocated from a range
+// set.
+const MaxPerPodIPs = 64
+
+// Policies for an ADD of a container ID and interface which already has
+// addresses allocated, e.g. because the runtime retried a timed out ADD.
+const (
+	// DuplicateError fails the ADD, the default
+	DuplicateError = "error"
+	// DuplicateReuse returns the addresses allocated before
+	DuplicateReuse = "reuse"
+	// DuplicateReplace releases the addresses allocated before and
+	// allocates new ones
+	DuplicateReplace = "replace"
+)
+
+// Policies for combining the DNS read from resolvConf with the DNS provided
+// by the runtime, the network configuration or an earlier plugin.
+const (
+	// DNSReplace returns only the resolvConf DNS, the default
+	DNSReplace = "replace"
+	// DNSAppend returns the provided DNS followed by the resolvConf DNS
+	DNSAppend = "append"
+	// DNSIgnore returns the provided DNS, and the resolvConf DNS only if
+	// none was provided
+	DNSIgnore = "ignore"
+)
+
+// DefaultHandoverGracePeriod is how long the old container of a pod keeps
+// its lease on addresses handed over to a new one, unless configured.
+const DefaultHandoverGracePeriod = 30 * time.Second
+
+// Handover configures back-to-back allocation for pods recreated before
+// their old sandbox is deleted: the new container is given the pod's
+// addresses, while the old one keeps its lease until its DEL or the end of
+// the grace period, so it isn't reported broken while it is torn down.
+type Handover struct {
+	GracePeriod string `json:"gracePeriod,omitempty"`
+	// Grace is the parsed GracePeriod
+	Grace time.Duration `json:"-"`
+}
+
+// Defaults for Snapshots.
+const (
+	DefaultSnapshotCount    = 5
+	DefaultSnapshotInterval = time.Hour
+)
+
+// Snapshots makes ADDs copy the store to a snapshot once the newest one is
+// older than Interval, keeping the Count newest. A store corrupted e.g. by
+// a failing SD card is recovered with "host-local restore". Dir defaults
+// to the ".snapshots" directory next to the store.
+type Snapshots struct {
+	Count    int    `json:"count,omitempty"`
+	Interval string `json:"interval,omitempty"`
+	Dir      string `json:"dir,omitempty"`
+	// Every is the parsed Interval
+	Every time.Duration `json:"-"`
+}
+
+// DefaultTombstonePeriod is how long the tombstone of a DEL is kept, unless
+// configured.
+const DefaultTombstonePeriod = 5 * time.Minute
+
+// Tombstones makes a DEL record the addresses it released for Period. While
+// the tombstone lasts, a DEL of the attachment which was added again since
+// only releases the new addresses if its prevResult names them; otherwise
+// it is taken for a repeated or late DEL of the deleted attachment, and
+// does nothing.
+type Tombstones struct {
+	Period string `json:"period,omitempty"`
+	// Expire is the parsed Period
+	Expire time.Duration `json:"-"`
+}
+
+// Quarantine keeps the addresses released by a DEL, or by GC, from other
+// attachments for Period, so traffic in flight to them and stale DNS
+// records don't reach a new pod which got them seconds later. The released
+// attachment can get them back meanwhile. "host-local quarantine" lists
+// the quarantined addresses.
+type Quarantine struct {
+	Period string `json:"period"`
+	// Expire is the parsed Period
+	Expire time.Duration `json:"-"`
+}
+
+// LeaseTTL makes the addresses of an ADD expire TTL after it, for pools of
+// time-limited addresses. The expiry is recorded with the leases, in the
+// annotations of the addresses with annotate, and in File if set, so agents
+// in the pod can renew or react before the addresses are reclaimed. File
+// is a template like Hostname, e.g. "/run/cni/expiry/${POD_NAMESPACE}/${POD_NAME}",
+// see ExpiryFileOf; it holds the expiry in RFC 3339, as a downward API file
+// holds a field. An ADD of the attachment with onDuplicate "reuse" renews
+// its leases. Expired leases are reclaimed by the next ADD of the network.
+type LeaseTTL struct {
+	TTL  string `json:"ttl"`
+	File string `json:"file,omitempty"`
+	// Expire is the parsed TTL
+	Expire time.Duration `json:"-"`
+}
+
+// Rate limit requesters and defaults.
+const (
+	// RateLimitByNamespace limits the ADDs of the pods of a namespace
+	// together, the default. ADDs without a pod namespace in CNI_ARGS are
+	// limited by container ID prefix.
+	RateLimitByNamespace = "namespace"
+	// RateLimitByContainerID limits the ADDs of the containers whose IDs
+	// share a prefix together
+	RateLimitByContainerID = "containerID"
+
+	DefaultRateLimitBurst        = 10
+	DefaultRateLimitInterval     = time.Second
+	DefaultRateLimitPrefixLength = 12
+)
+
+// RateLimit throttles ADDs with a leaky bucket per requester, so a runaway
+// reconciliation loop creating and deleting sandboxes in a tight loop can't
+// wear out the store. A requester may make Burst ADDs at once, then one
+// per Interval; ADDs beyond that fail with a retryable error telling when
+// to retry. With By "containerID", the requester is the first PrefixLength
+// characters of the container ID.
+type RateLimit struct {
+	By           string `json:"by,omitempty"`
+	PrefixLength int    `json:"prefixLength,omitempty"`
+	Burst        int    `json:"burst,omitempty"`
+	Interval     string `json:"interval,omitempty"`
+	// Leak is the parsed Interval
+	Leak time.Duration `json:"-"`
+}
+
+// Requester returns who the ADD of the container is accounted to.
+func (r *RateLimit) Requester(containerID, podNamespace string) string {
+	if r.By != RateLimitByContainerID && podNamespace != "" {
+		return "namespace " + podNamespace
+	}
+	id := strings.TrimSpace(containerID)
+	if len(id) > r.PrefixLength {
+		id = id[:r.PrefixLength]
+	}
+	return "container " + id
 }
 
-type IPAMArgs struct {
-	IPs []*ip.IP `json:"ips"`
+// Integrity makes the store sign its lease files with the node key in
+// KeyFile, or encrypt them with Encrypt, so tampering with them is
+// detected. Leases failing verification are reported by STATUS and
+// "host-local verify". It requires the files store format.
+type Integrity struct {
+	KeyFile string `json:"keyFile"`
+	Encrypt bool   `json:"encrypt,omitempty"`
+}
+
+// StableIPv6 allocates the IPv6 address of a pod's interface at a position
+// of the range derived from a keyed hash of the pod's namespace, name and
+// interface, in the style of RFC 7217, instead of the next free one. The
+// address stays the same when the pod is recreated, yet can't be guessed
+// without the secret in SecretFile; without it, the network name is the
+// key. If the derived addresses are taken, or the pod has no name in
+// CNI_ARGS, the next free address is allocated.
+type StableIPv6 struct {
+	SecretFile string `json:"secretFile,omitempty"`
+}
+
+// SecondaryStore is a second store of the network, in another data
+// directory and possibly another format, which every change of the
+// allocations is mirrored to, so nodes can be moved to it without being
+// drained. "host-local migrate" copies the allocations made before,
+// verifies that both stores agree and cuts over to the secondary store,
+// which from then on is written first.
+type SecondaryStore struct {
+	DataDir     string `json:"dataDir"`
+	StoreFormat string `json:"storeFormat,omitempty"`
 }
 
 type RangeSet []Range
@@ -68,13 +319,39 @@ type RangeSet []Range
 type Range struct {
 	RangeStart net.IP      `json:"rangeStart,omitempty"` // The first ip, inclusive
 	RangeEnd   net.IP      `json:"rangeEnd,omitempty"`   // The last ip, inclusive
-	Subnet     types.IPNet `json:"subnet"`
+	Subnet     types.IPNet `json:"subnet" config:"exclusive=subnet"`
 	Gateway    net.IP      `json:"gateway,omitempty"`
+	// Generate derives the subnet on the node instead, see GenerateULA
+	Generate string `json:"generate,omitempty" config:"exclusive=subnet"`
+	// Reservations is a file of addresses reserved for their owners, see
+	// LoadReservations
+	Reservations string `json:"reservations,omitempty"`
+	// DNS is added to the result when an address of the range is
+	// allocated, ahead of the DNS of the network
+	DNS *types.DNS `json:"dns,omitempty"`
+	// Name identifies the range for BackupFor
+	Name string `json:"name,omitempty"`
+	// Uplink is an interface without which the addresses of the range are
+	// of no use, so the range is skipped while the uplink has no carrier
+	Uplink string `json:"uplink,omitempty"`
+	// BackupFor is the name of a range of the same set this range backs
+	// up. It is only allocated from once the primary ranges of the set are
+	// exhausted, or right away when the uplink of its primary is down
+	BackupFor string `json:"backupFor,omitempty"`
+	// VLAN and Parent pin the range to the attachments on that VLAN or
+	// parent interface, e.g. a trunk port, see RangeSet.ForAttachment
+	VLAN   int    `json:"vlan,omitempty"`
+	Parent string `json:"parent,omitempty"`
+
+	reserved map[string]Owner
 }
 
 // NewIPAMConfig creates a NetworkConfig from the given network name.
 func LoadIPAMConfig(bytes []byte, envArgs string) (*IPAMConfig, string, error) {
 	n := Net{}
+	if err := config.ValidateField(bytes, "ipam", &IPAMConfig{}); err != nil {
+		return nil, "", fmt.Errorf("invalid IPAM configuration: %v", err)
+	}
 	if err := json.Unmarshal(bytes, &n); err != nil {
 		return nil, "", err
 	}
@@ -83,42 +360,204 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*IPAMConfig, string, error) {
 		return nil, "", fmt.Errorf("IPAM config missing 'ipam' key")
 	}
 
-	// parse custom IP from env args
-	if envArgs != "" {
-		e := IPAMEnvArgs{}
-		err := types.LoadArgs(envArgs, &e)
-		if err != nil {
-			return nil, "", err
+	// parse custom IPs from CNI_ARGS, args and runtime configuration
+	a, err := cniargs.Parse(envArgs, bytes, KeyPerPodIPs)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, i := range a.IPs() {
+		ip := i.ToIP()
+		n.IPAM.IPArgs = append(n.IPAM.IPArgs, ip)
+		if i.Mask != nil {
+			if n.IPAM.requestedMasks == nil {
+				n.IPAM.requestedMasks = map[string]net.IPMask{}
+			}
+			n.IPAM.requestedMasks[ip.String()] = i.Mask
+		}
+	}
+	n.IPAM.LegacyIPArgs = len(a.EnvIPs)+len(a.ConfigIPs) > 0
+	n.IPAM.PodNamespace = a.PodNamespace
+	n.IPAM.PodName = a.PodName
+	n.IPAM.MAC = a.MAC()
+	n.IPAM.VLAN = a.VLAN
+	n.IPAM.Parent = a.Parent
+	if v, ok := a.Env[KeyPerPodIPs]; ok {
+		if n.IPAM.PerPodIPs, err = strconv.Atoi(v); err != nil {
+			return nil, "", fmt.Errorf("ARGS: invalid %s %q", KeyPerPodIPs, v)
 		}
+	}
+	if n.IPAM.PerPodIPs < 0 || n.IPAM.PerPodIPs > MaxPerPodIPs {
+		return nil, "", fmt.Errorf("invalid perPodIPs %d, must be between 1 and %d", n.IPAM.PerPodIPs, MaxPerPodIPs)
+	}
 
-		if e.IP.ToIP() != nil {
-			n.IPAM.IPArgs = []net.IP{e.IP.ToIP()}
+	for idx := range n.IPAM.IPArgs {
+		if err := canonicalizeIP(&n.IPAM.IPArgs[idx]); err != nil {
+			return nil, "", fmt.Errorf("cannot understand ip: %v", err)
 		}
 	}
 
-	// parse custom IPs from CNI args in network config
-	if n.Args != nil && n.Args.A != nil && len(n.Args.A.IPs) != 0 {
-		for _, i := range n.Args.A.IPs {
-			n.IPAM.IPArgs = append(n.IPAM.IPArgs, i.ToIP())
+	switch n.IPAM.StoreFormat {
+	case "", "files", "journal":
+	default:
+		return nil, "", fmt.Errorf("invalid storeFormat %q, must be \"files\" or \"journal\"", n.IPAM.StoreFormat)
+	}
+
+	if sec := n.IPAM.SecondaryStore; sec != nil {
+		switch sec.StoreFormat {
+		case "", "files", "journal":
+		default:
+			return nil, "", fmt.Errorf("invalid secondaryStore storeFormat %q, must be \"files\" or \"journal\"", sec.StoreFormat)
+		}
+		if sec.DataDir == "" || sec.DataDir == n.IPAM.DataDir {
+			return nil, "", fmt.Errorf("secondaryStore requires a dataDir other than the one of the network")
+		}
+		if n.IPAM.Integrity != nil && sec.StoreFormat == "journal" {
+			return nil, "", fmt.Errorf("integrity is not supported with secondaryStore storeFormat \"journal\"")
 		}
 	}
 
-	// parse custom IPs from runtime configuration
-	if len(n.RuntimeConfig.IPs) > 0 {
-		for _, i := range n.RuntimeConfig.IPs {
-			n.IPAM.IPArgs = append(n.IPAM.IPArgs, i.ToIP())
+	switch n.IPAM.OnDuplicate {
+	case "", DuplicateError, DuplicateReuse, DuplicateReplace:
+	default:
+		return nil, "", fmt.Errorf("invalid onDuplicate %q, must be one of %q, %q or %q",
+			n.IPAM.OnDuplicate, DuplicateError, DuplicateReuse, DuplicateReplace)
+	}
+
+	if h := n.IPAM.Handover; h != nil {
+		h.Grace = DefaultHandoverGracePeriod
+		if h.GracePeriod != "" {
+			grace, err := time.ParseDuration(h.GracePeriod)
+			if err != nil || grace <= 0 {
+				return nil, "", fmt.Errorf("invalid handover gracePeriod %q, must be a positive duration", h.GracePeriod)
+			}
+			h.Grace = grace
 		}
 	}
 
-	for idx := range n.IPAM.IPArgs {
-		if err := canonicalizeIP(&n.IPAM.IPArgs[idx]); err != nil {
-			return nil, "", fmt.Errorf("cannot understand ip: %v", err)
+	if sn := n.IPAM.Snapshots; sn != nil {
+		if sn.Count < 0 {
+			return nil, "", fmt.Errorf("invalid snapshots count %d, must not be negative", sn.Count)
+		}
+		if sn.Count == 0 {
+			sn.Count = DefaultSnapshotCount
+		}
+		sn.Every = DefaultSnapshotInterval
+		if sn.Interval != "" {
+			every, err := time.ParseDuration(sn.Interval)
+			if err != nil || every <= 0 {
+				return nil, "", fmt.Errorf("invalid snapshots interval %q, must be a positive duration", sn.Interval)
+			}
+			sn.Every = every
+		}
+	}
+
+	if t := n.IPAM.Tombstones; t != nil {
+		t.Expire = DefaultTombstonePeriod
+		if t.Period != "" {
+			expire, err := time.ParseDuration(t.Period)
+			if err != nil || expire <= 0 {
+				return nil, "", fmt.Errorf("invalid tombstones period %q, must be a positive duration", t.Period)
+			}
+			t.Expire = expire
+		}
+	}
+
+	if q := n.IPAM.Quarantine; q != nil {
+		expire, err := time.ParseDuration(q.Period)
+		if err != nil || expire <= 0 {
+			return nil, "", fmt.Errorf("invalid quarantine period %q, must be a positive duration", q.Period)
+		}
+		q.Expire = expire
+	}
+
+	if lt := n.IPAM.LeaseTTL; lt != nil {
+		expire, err := time.ParseDuration(lt.TTL)
+		if err != nil || expire <= 0 {
+			return nil, "", fmt.Errorf("invalid leaseTTL ttl %q, must be a positive duration", lt.TTL)
+		}
+		lt.Expire = expire
+		if lt.File != "" {
+			if err := checkExpiryFileTemplate(lt.File); err != nil {
+				return nil, "", fmt.Errorf("invalid leaseTTL file %q: %v", lt.File, err)
+			}
+		}
+	}
+
+	if rl := n.IPAM.RateLimit; rl != nil {
+		switch rl.By {
+		case "", RateLimitByNamespace, RateLimitByContainerID:
+		default:
+			return nil, "", fmt.Errorf("invalid rateLimit by %q, must be %q or %q", rl.By, RateLimitByNamespace, RateLimitByContainerID)
+		}
+		if rl.Burst < 0 || rl.PrefixLength < 0 {
+			return nil, "", fmt.Errorf("invalid rateLimit, burst and prefixLength must not be negative")
+		}
+		if rl.Burst == 0 {
+			rl.Burst = DefaultRateLimitBurst
+		}
+		if rl.PrefixLength == 0 {
+			rl.PrefixLength = DefaultRateLimitPrefixLength
+		}
+		rl.Leak = DefaultRateLimitInterval
+		if rl.Interval != "" {
+			leak, err := time.ParseDuration(rl.Interval)
+			if err != nil || leak <= 0 {
+				return nil, "", fmt.Errorf("invalid rateLimit interval %q, must be a positive duration", rl.Interval)
+			}
+			rl.Leak = leak
+		}
+	}
+
+	if n.IPAM.WriteBehind != nil {
+		return nil, "", fmt.Errorf("writeBehind is only supported by long running processes allocating through pkg/ipalloc")
+	}
+
+	if in := n.IPAM.Integrity; in != nil {
+		if in.KeyFile == "" {
+			return nil, "", fmt.Errorf("integrity requires a keyFile")
+		}
+		if n.IPAM.StoreFormat == "journal" {
+			return nil, "", fmt.Errorf("integrity is not supported with storeFormat \"journal\"")
+		}
+	}
+
+	if n.IPAM.ExecTimeout, err = ipam.ParseTimeout(n.IPAM.Timeout); err != nil {
+		return nil, "", err
+	}
+
+	if n.IPAM.Hostname != "" {
+		if err := checkHostnameTemplate(n.IPAM.Hostname); err != nil {
+			return nil, "", fmt.Errorf("invalid hostname %q: %v", n.IPAM.Hostname, err)
+		}
+	}
+
+	switch n.IPAM.DNSPolicy {
+	case "", DNSReplace, DNSAppend, DNSIgnore:
+	default:
+		return nil, "", fmt.Errorf("invalid dnsPolicy %q, must be one of %q, %q or %q",
+			n.IPAM.DNSPolicy, DNSReplace, DNSAppend, DNSIgnore)
+	}
+	provided := []types.DNS{}
+	if n.PrevResult != nil {
+		provided = append(provided, n.PrevResult.DNS)
+	}
+	provided = append(provided, n.DNS)
+	if dns := a.RuntimeConfig.DNS; dns != nil {
+		provided = append(provided, types.DNS{
+			Nameservers: dns.Servers,
+			Search:      dns.Searches,
+			Options:     dns.Options,
+		})
+	}
+	for _, dns := range provided {
+		if !dns.IsEmpty() {
+			n.IPAM.ProvidedDNS = append(n.IPAM.ProvidedDNS, dns)
 		}
 	}
 
 	// If a single range (old-style config) is specified, prepend it to
 	// the Ranges array
-	if n.IPAM.Range != nil && n.IPAM.Range.Subnet.IP != nil {
+	if n.IPAM.Range != nil && (n.IPAM.Range.Subnet.IP != nil || n.IPAM.Range.Generate != "") {
 		n.IPAM.Ranges = append([]RangeSet{{*n.IPAM.Range}}, n.IPAM.Ranges...)
 	}
 	n.IPAM.Range = nil
@@ -136,6 +575,14 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*IPAMConfig, string, error) {
 	numV4 := 0
 	numV6 := 0
 	for i := range n.IPAM.Ranges {
+		// generated ranges are resolved against the store, see
+		// ResolveGeneratedRanges
+		if generated, err := checkGenerated(n.IPAM.Ranges[i]); err != nil {
+			return nil, "", fmt.Errorf("invalid range set %d: %s", i, err)
+		} else if generated {
+			numV6++
+			continue
+		}
 		if err := n.IPAM.Ranges[i].Canonicalize(); err != nil {
 			return nil, "", fmt.Errorf("invalid range set %d: %s", i, err)
 		}
@@ -158,6 +605,9 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*IPAMConfig, string, error) {
 	l := len(n.IPAM.Ranges)
 	for i, p1 := range n.IPAM.Ranges[:l-1] {
 		for j, p2 := range n.IPAM.Ranges[i+1:] {
+			if p1.Generated() || p2.Generated() {
+				continue
+			}
 			if p1.Overlaps(&p2) {
 				return nil, "", fmt.Errorf("range set %d overlaps with %d", i, (i + j + 1))
 			}
@@ -169,3 +619,23 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*IPAMConfig, string, error) {
 
 	return n.IPAM, n.CNIVersion, nil
 }
+
+// checkGenerated reports whether the range set uses a generated subnet, in
+// which case every range of it must be generated and leave addresses unset.
+func checkGenerated(rs RangeSet) (bool, error) {
+	if !rs.Generated() {
+		return false, nil
+	}
+	for _, r := range rs {
+		if r.Generate == "" {
+			return false, fmt.Errorf("generated and static ranges can't be mixed")
+		}
+		if r.Generate != GenerateULA {
+			return false, fmt.Errorf("unknown generator %q", r.Generate)
+		}
+		if r.RangeStart != nil || r.RangeEnd != nil || r.Gateway != nil {
+			return false, fmt.Errorf("rangeStart, rangeEnd and gateway can't be set on a generated range")
+		}
+	}
+	return true, nil
+}
@@ -15,7 +15,10 @@
 package allocator
 
 import (
+	"fmt"
 	"net"
+	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -418,6 +421,327 @@ var _ = Describe("IPAM config", func() {
 		Expect(err).To(MatchError("invalid range set 0: mixed address families"))
 	})
 
+	It("Should parse a generated range", func() {
+		input := `{
+			"cniVersion": "0.3.1",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"ranges": [
+					[{ "subnet": "10.1.0.0/22" }],
+					[{ "generate": "ula" }]
+				]
+			}
+		}`
+		conf, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.Ranges).To(HaveLen(2))
+		Expect(conf.Ranges[1].Generated()).To(BeTrue())
+		Expect(conf.Ranges[1][0].Subnet.IP).To(BeNil())
+	})
+
+	DescribeTable("should error on invalid generated ranges",
+		func(ranges, expected string) {
+			input := fmt.Sprintf(`{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"ipam": {
+					"type": "host-local",
+					"ranges": %s
+				}
+			}`, ranges)
+			_, _, err := LoadIPAMConfig([]byte(input), "")
+			Expect(err).To(MatchError(expected))
+		},
+		Entry("unknown generator", `[[{"generate": "gua"}]]`,
+			`invalid range set 0: unknown generator "gua"`),
+		Entry("mixed with a static range", `[[{"generate": "ula"}, {"subnet": "2001:db8::/64"}]]`,
+			"invalid range set 0: generated and static ranges can't be mixed"),
+		Entry("addresses set", `[[{"generate": "ula", "gateway": "fd00::1"}]]`,
+			"invalid range set 0: rangeStart, rangeEnd and gateway can't be set on a generated range"),
+		Entry("subnet set", `[[{"generate": "ula", "subnet": "fd00::/64"}]]`,
+			"invalid IPAM configuration: ipam.ranges[0][0].generate: mutually exclusive with subnet"),
+	)
+
+	It("should error on an unknown onDuplicate policy", func() {
+		input := `{
+			"cniVersion": "0.3.1",
+			"name": "mynet",
+			"type": "ipvlan",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24",
+				"onDuplicate": "ignore"
+			}
+		}`
+		_, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).To(MatchError(`invalid onDuplicate "ignore", must be one of "error", "reuse" or "replace"`))
+	})
+
+	It("rejects writeBehind", func() {
+		input := `{
+			"cniVersion": "0.3.1",
+			"name": "mynet",
+			"type": "ipvlan",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24",
+				"storeFormat": "journal",
+				"writeBehind": {"window": "500ms"}
+			}
+		}`
+		_, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).To(MatchError("writeBehind is only supported by long running processes allocating through pkg/ipalloc"))
+	})
+
+	It("validates the rateLimit and tells requesters apart", func() {
+		conf := func(rateLimit string) string {
+			return fmt.Sprintf(`{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.2.0/24",
+					"rateLimit": %s
+				}
+			}`, rateLimit)
+		}
+		ipamConf, _, err := LoadIPAMConfig([]byte(conf(`{}`)), "")
+		Expect(err).NotTo(HaveOccurred())
+		rl := ipamConf.RateLimit
+		Expect(rl.Burst).To(Equal(DefaultRateLimitBurst))
+		Expect(rl.Leak).To(Equal(DefaultRateLimitInterval))
+		Expect(rl.Requester("0123456789abcdef", "kube-system")).To(Equal("namespace kube-system"))
+		Expect(rl.Requester("0123456789abcdef", "")).To(Equal("container 0123456789ab"))
+
+		ipamConf, _, err = LoadIPAMConfig([]byte(conf(`{"by": "containerID", "prefixLength": 4, "burst": 3, "interval": "2s"}`)), "")
+		Expect(err).NotTo(HaveOccurred())
+		rl = ipamConf.RateLimit
+		Expect(rl.Burst).To(Equal(3))
+		Expect(rl.Leak).To(Equal(2 * time.Second))
+		Expect(rl.Requester("0123456789abcdef", "kube-system")).To(Equal("container 0123"))
+
+		_, _, err = LoadIPAMConfig([]byte(conf(`{"by": "pod"}`)), "")
+		Expect(err).To(MatchError(`invalid rateLimit by "pod", must be "namespace" or "containerID"`))
+		_, _, err = LoadIPAMConfig([]byte(conf(`{"burst": -1}`)), "")
+		Expect(err).To(MatchError("invalid rateLimit, burst and prefixLength must not be negative"))
+		_, _, err = LoadIPAMConfig([]byte(conf(`{"interval": "0s"}`)), "")
+		Expect(err).To(MatchError(`invalid rateLimit interval "0s", must be a positive duration`))
+	})
+
+	It("validates the leaseTTL and computes the expiry files", func() {
+		conf := func(leaseTTL string) string {
+			return fmt.Sprintf(`{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.2.0/24",
+					"leaseTTL": %s
+				}
+			}`, leaseTTL)
+		}
+		ipamConf, _, err := LoadIPAMConfig([]byte(conf(`{"ttl": "24h", "file": "/run/expiry/${POD_NAMESPACE}/${POD_NAME}-${IFNAME}"}`)),
+			"K8S_POD_NAMESPACE=Edge_1;K8S_POD_NAME=web")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipamConf.LeaseTTL.Expire).To(Equal(24 * time.Hour))
+		Expect(ipamConf.ExpiryFileOf("c1", "eth0")).To(Equal("/run/expiry/edge-1/web-eth0"))
+
+		// without a pod, there is no file
+		ipamConf, _, err = LoadIPAMConfig([]byte(conf(`{"ttl": "24h", "file": "/run/expiry/${POD_NAME}"}`)), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipamConf.ExpiryFileOf("c1", "eth0")).To(BeEmpty())
+		ipamConf, _, err = LoadIPAMConfig([]byte(conf(`{"ttl": "24h", "file": "/run/expiry/${CONTAINER_ID}"}`)), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipamConf.ExpiryFileOf("../c1", "eth0")).To(Equal("/run/expiry/---c1"))
+
+		_, _, err = LoadIPAMConfig([]byte(conf(`{"ttl": "0s"}`)), "")
+		Expect(err).To(MatchError(`invalid leaseTTL ttl "0s", must be a positive duration`))
+		_, _, err = LoadIPAMConfig([]byte(conf(`{"ttl": "1h", "file": "/run/${IP}"}`)), "")
+		Expect(err).To(MatchError(`invalid leaseTTL file "/run/${IP}": unknown variable "IP", must be one of ["POD_NAME" "POD_NAMESPACE" "CONTAINER_ID" "IFNAME"]`))
+		_, _, err = LoadIPAMConfig([]byte(conf(`{"ttl": "1h", "file": "expiry/${POD_NAME}"}`)), "")
+		Expect(err).To(MatchError(`invalid leaseTTL file "expiry/${POD_NAME}": must be an absolute path`))
+	})
+
+	It("parses the quarantine period", func() {
+		conf := func(period string) string {
+			return fmt.Sprintf(`{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.2.0/24",
+					"quarantine": {"period": %q}
+				}
+			}`, period)
+		}
+		ipamConf, _, err := LoadIPAMConfig([]byte(conf("30s")), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipamConf.Quarantine.Expire).To(Equal(30 * time.Second))
+
+		_, _, err = LoadIPAMConfig([]byte(conf("")), "")
+		Expect(err).To(MatchError(`invalid quarantine period "", must be a positive duration`))
+		_, _, err = LoadIPAMConfig([]byte(conf("-1m")), "")
+		Expect(err).To(MatchError(`invalid quarantine period "-1m", must be a positive duration`))
+	})
+
+	It("takes perPodIPs from the configuration or CNI_ARGS", func() {
+		conf := func(perPodIPs int) string {
+			return fmt.Sprintf(`{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.2.0/24",
+					"perPodIPs": %d
+				}
+			}`, perPodIPs)
+		}
+		ipamConf, _, err := LoadIPAMConfig([]byte(conf(4)), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipamConf.PerPodIPs).To(Equal(4))
+		ipamConf, _, err = LoadIPAMConfig([]byte(conf(4)), "PER_POD_IPS=8")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipamConf.PerPodIPs).To(Equal(8))
+
+		_, _, err = LoadIPAMConfig([]byte(conf(65)), "")
+		Expect(err).To(MatchError("invalid perPodIPs 65, must be between 1 and 64"))
+		_, _, err = LoadIPAMConfig([]byte(conf(1)), "PER_POD_IPS=many")
+		Expect(err).To(MatchError(`ARGS: invalid PER_POD_IPS "many"`))
+	})
+
+	It("names addresses by the hostname template", func() {
+		conf := func(hostname string) string {
+			return fmt.Sprintf(`{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.2.0/24",
+					"hostname": %q
+				}
+			}`, hostname)
+		}
+		ipamConf, _, err := LoadIPAMConfig([]byte(conf("${POD_NAME}.${POD_NAMESPACE}.site.example")),
+			"K8S_POD_NAMESPACE=Edge_1;K8S_POD_NAME=web")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipamConf.HostnameOf("eth0", net.ParseIP("10.1.2.3"))).To(Equal("web.edge-1.site.example"))
+
+		ipamConf, _, err = LoadIPAMConfig([]byte(conf("ip-${IP}.pods.example")), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipamConf.HostnameOf("eth0", net.ParseIP("10.1.2.3"))).To(Equal("ip-10-1-2-3.pods.example"))
+		Expect(ipamConf.HostnameOf("eth0", net.ParseIP("2001:db8::3"))).To(
+			Equal("ip-2001-0db8-0000-0000-0000-0000-0000-0003.pods.example"))
+
+		// without a pod, there is no pod name
+		ipamConf, _, err = LoadIPAMConfig([]byte(conf("${POD_NAME}.site.example")), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipamConf.HostnameOf("eth0", net.ParseIP("10.1.2.3"))).To(BeEmpty())
+
+		_, _, err = LoadIPAMConfig([]byte(conf("${POD}.site.example")), "")
+		Expect(err).To(MatchError(`invalid hostname "${POD}.site.example": unknown variable "POD", must be one of ["POD_NAME" "POD_NAMESPACE" "NODE_NAME" "IFNAME" "IP"]`))
+		_, _, err = LoadIPAMConfig([]byte(conf("${POD_NAME}..example")), "")
+		Expect(err).To(MatchError(`invalid hostname "${POD_NAME}..example": label "" must be 1 to 63 characters`))
+	})
+
+	It("parses the invocation timeout", func() {
+		conf := func(timeout string) string {
+			return fmt.Sprintf(`{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.2.0/24",
+					"timeout": %q
+				}
+			}`, timeout)
+		}
+		ipamConf, _, err := LoadIPAMConfig([]byte(conf("20s")), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipamConf.ExecTimeout).To(Equal(20 * time.Second))
+
+		_, _, err = LoadIPAMConfig([]byte(conf("forever")), "")
+		Expect(err).To(MatchError(`invalid ipam timeout "forever", must be a positive duration`))
+	})
+
+	It("validates the secondaryStore", func() {
+		conf := func(secondaryStore string) string {
+			return fmt.Sprintf(`{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.2.0/24",
+					"dataDir": "/var/lib/cni/networks",
+					"secondaryStore": %s
+				}
+			}`, secondaryStore)
+		}
+		ipamConf, _, err := LoadIPAMConfig([]byte(conf(`{"dataDir": "/var/lib/cni/next", "storeFormat": "journal"}`)), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipamConf.SecondaryStore).To(Equal(&SecondaryStore{DataDir: "/var/lib/cni/next", StoreFormat: "journal"}))
+
+		_, _, err = LoadIPAMConfig([]byte(conf(`{"dataDir": "/var/lib/cni/networks"}`)), "")
+		Expect(err).To(MatchError("secondaryStore requires a dataDir other than the one of the network"))
+		_, _, err = LoadIPAMConfig([]byte(conf(`{"dataDir": "/var/lib/cni/next", "storeFormat": "sqlite"}`)), "")
+		Expect(err).To(MatchError(`invalid secondaryStore storeFormat "sqlite", must be "files" or "journal"`))
+	})
+
+	It("collects the provided DNS and validates the dnsPolicy", func() {
+		input := `{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"dns": {"nameservers": ["10.96.0.10"]},
+			"prevResult": {"cniVersion": "1.0.0", "dns": {"search": ["svc.cluster.local"]}},
+			"runtimeConfig": {"dns": {"servers": ["10.96.0.11"], "options": ["ndots:5"]}},
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24",
+				"dnsPolicy": "append"
+			}
+		}`
+		conf, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.DNSPolicy).To(Equal(DNSAppend))
+		Expect(conf.ProvidedDNS).To(Equal([]types.DNS{
+			{Search: []string{"svc.cluster.local"}},
+			{Nameservers: []string{"10.96.0.10"}},
+			{Nameservers: []string{"10.96.0.11"}, Options: []string{"ndots:5"}},
+		}))
+
+		_, _, err = LoadIPAMConfig([]byte(strings.Replace(input, `"append"`, `"merge"`, 1)), "")
+		Expect(err).To(MatchError(`invalid dnsPolicy "merge", must be one of "replace", "append" or "ignore"`))
+	})
+
+	It("should error on misspelled keys with strictConfig", func() {
+		input := `{
+			"cniVersion": "0.3.1",
+			"name": "mynet",
+			"strictConfig": true,
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"rangs": [
+					[{ "subnet": "10.1.0.0/22" }]
+				]
+			}
+		}`
+		_, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).To(MatchError(`invalid IPAM configuration: ipam.rangs: unknown field, did you mean "ranges"?`))
+	})
+
 	It("Should should error on too many ranges", func() {
 		input := `{
 				"cniVersion": "0.2.0",
@@ -478,4 +802,129 @@ var _ = Describe("IPAM config", func() {
 			net.ParseIP("2001:db8::1"),
 		}))
 	})
+
+	It("assigns the requested IPs to their range sets, failing requests which can't be fulfilled", func() {
+		load := func(ips, envArgs string) (*IPAMConfig, error) {
+			conf, _, err := LoadIPAMConfig([]byte(fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "ipvlan",
+				"runtimeConfig": {"ips": %s},
+				"ipam": {
+					"type": "host-local",
+					"ranges": [
+						[{"subnet": "10.1.2.0/24"}],
+						[{"subnet": "2001:db8:1::/64"}]
+					]
+				}
+			}`, ips)), envArgs)
+			return conf, err
+		}
+
+		conf, err := load(`["2001:db8:1::5/64", "10.1.2.5/24"]`, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.LegacyIPArgs).To(BeFalse())
+		Expect(conf.RequestedIPsBySet()).To(Equal(map[int]net.IP{
+			0: net.IPv4(10, 1, 2, 5).To4(),
+			1: net.ParseIP("2001:db8:1::5"),
+		}))
+
+		// the same IP from CNI_ARGS is requested once, but deprecated
+		conf, err = load(`["10.1.2.5"]`, "IP=10.1.2.5")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.LegacyIPArgs).To(BeTrue())
+		Expect(conf.RequestedIPsBySet()).To(HaveLen(1))
+
+		for ips, msg := range map[string]string{
+			`["10.9.9.9"]`:                "failed to allocate all requested IPs: 10.9.9.9 is in no range of the network",
+			`["10.1.2.5/16"]`:             "failed to allocate all requested IPs: 10.1.2.5/16 doesn't match the prefix /24 of its range",
+			`["10.1.2.5", "10.1.2.6/24"]`: "failed to allocate all requested IPs: 10.1.2.5 and 10.1.2.6 are both in range set 0, only one address of a range set can be requested",
+		} {
+			conf, err := load(ips, "")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = conf.RequestedIPsBySet()
+			Expect(err).To(MatchError(msg), ips)
+		}
+	})
+
+	It("selects the ranges pinned to the VLAN and parent interface of the attachment", func() {
+		load := func(envArgs string) (*IPAMConfig, error) {
+			conf, _, err := LoadIPAMConfig([]byte(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvlan",
+				"ipam": {
+					"type": "host-local",
+					"ranges": [
+						[
+							{"subnet": "10.0.10.0/24", "vlan": 10},
+							{"subnet": "10.0.20.0/24", "vlan": 20},
+							{"subnet": "10.0.99.0/24", "parent": "eth1"},
+							{"subnet": "10.1.0.0/24"}
+						],
+						[{"subnet": "2001:db8:20::/64", "vlan": 20}]
+					]
+				}
+			}`), envArgs)
+			return conf, err
+		}
+		subnets := func(sets []RangeSet) [][]string {
+			out := [][]string{}
+			for _, set := range sets {
+				subnets := []string{}
+				for _, r := range set {
+					subnets = append(subnets, (*net.IPNet)(&r.Subnet).String())
+				}
+				out = append(out, subnets)
+			}
+			return out
+		}
+
+		conf, err := load("VLAN=20;PARENT=eth1")
+		Expect(err).NotTo(HaveOccurred())
+		sets, err := conf.AttachmentRanges(nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(subnets(sets)).To(Equal([][]string{
+			{"10.0.20.0/24", "10.0.99.0/24", "10.1.0.0/24"},
+			{"2001:db8:20::/64"},
+		}))
+
+		// without a VLAN, only the ranges open to any are
+		conf, err = load("")
+		Expect(err).NotTo(HaveOccurred())
+		sets, err = conf.AttachmentRanges(nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(subnets(sets)).To(Equal([][]string{{"10.1.0.0/24"}, {}}))
+
+		conf, err = load("VLAN=10")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = conf.AttachmentRanges(map[int]net.IP{0: net.ParseIP("10.0.20.5")})
+		Expect(err).To(MatchError(`requested IP 10.0.20.5 is in no range of vlan 10 of parent ""`))
+	})
+
+	It("validates the pinning of ranges", func() {
+		load := func(ranges string) error {
+			_, _, err := LoadIPAMConfig([]byte(fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvlan",
+				"ipam": {"type": "host-local", "ranges": [%s]}
+			}`, ranges)), "")
+			return err
+		}
+		Expect(load(`[{"subnet": "10.0.10.0/24", "vlan": 4095}]`)).To(MatchError(
+			"invalid range set 0: invalid vlan 4095 of range 10.0.10.1-10.0.10.254, must be [1, 4094]"))
+		Expect(load(`[{"subnet": "10.0.10.0/24", "vlan": 10, "name": "a"}, {"subnet": "10.0.20.0/24", "backupFor": "a"}]`)).To(MatchError(
+			`invalid range set 0: range 10.0.20.1-10.0.20.254 is pinned unlike range "a" it is backupFor`))
+
+		conf, _, err := LoadIPAMConfig([]byte(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "macvlan",
+			"ipam": {"type": "host-local", "ranges": [[{"subnet": "10.0.10.0/24", "vlan": 10}]]}
+		}`), "VLAN=20")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = conf.AttachmentRanges(nil)
+		Expect(err).To(MatchError(`no range of the network is open to vlan 20 of parent ""`))
+	})
 })
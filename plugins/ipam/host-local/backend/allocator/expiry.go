@@ -0,0 +1,72 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// expiryFileVars are the variables of the expiry file template, see
+// LeaseTTL.File.
+var expiryFileVars = []string{"POD_NAME", "POD_NAMESPACE", "CONTAINER_ID", "IFNAME"}
+
+// ExpiryFileOf returns the expiry file of the attachment by the template of
+// LeaseTTL.File, or "" if none is configured or a variable the template
+// uses has no value, e.g. POD_NAME outside Kubernetes. The values are made
+// DNS labels, as for HostnameOf, so they can't reach out of the directory.
+func (c *IPAMConfig) ExpiryFileOf(containerID, ifName string) string {
+	if c.LeaseTTL == nil || c.LeaseTTL.File == "" {
+		return ""
+	}
+	values := map[string]string{
+		"POD_NAME":      c.PodName,
+		"POD_NAMESPACE": c.PodNamespace,
+		"CONTAINER_ID":  strings.TrimSpace(containerID),
+		"IFNAME":        ifName,
+	}
+	missing := false
+	path := os.Expand(c.LeaseTTL.File, func(v string) string {
+		value := values[v]
+		missing = missing || value == ""
+		return dnsLabel(value)
+	})
+	if missing {
+		return ""
+	}
+	return path
+}
+
+// checkExpiryFileTemplate validates the variables of the template, and that
+// it gives an absolute path.
+func checkExpiryFileTemplate(tmpl string) error {
+	var err error
+	path := os.Expand(tmpl, func(v string) string {
+		if !slices.Contains(expiryFileVars, v) && err == nil {
+			err = fmt.Errorf("unknown variable %q, must be one of %q", v, expiryFileVars)
+		}
+		return "x"
+	})
+	if err != nil {
+		return err
+	}
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("must be an absolute path")
+	}
+	return nil
+}
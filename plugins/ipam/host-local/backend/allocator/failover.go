@@ -0,0 +1,109 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// carrierUp reports whether the link named ifName has carrier. It is a
+// variable so tests can fake the uplinks.
+var carrierUp = func(ifName string) bool {
+	l, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return false
+	}
+	return l.Attrs().RawFlags&unix.IFF_LOWER_UP != 0
+}
+
+// validateFailover checks the names of the ranges and what they are
+// backups for.
+func (s *RangeSet) validateFailover() error {
+	byName := map[string]*Range{}
+	for i, r := range *s {
+		if r.Name == "" {
+			continue
+		}
+		if byName[r.Name] != nil {
+			return fmt.Errorf("duplicate range name %q", r.Name)
+		}
+		byName[r.Name] = &(*s)[i]
+	}
+	for _, r := range *s {
+		if r.BackupFor == "" {
+			continue
+		}
+		primary := byName[r.BackupFor]
+		switch {
+		case primary == nil:
+			return fmt.Errorf("range %s is backupFor unknown range %q", r.String(), r.BackupFor)
+		case primary.Name == r.Name:
+			return fmt.Errorf("range %s can't be its own backup", r.String())
+		case primary.BackupFor != "":
+			return fmt.Errorf("range %s is backupFor range %q, which is a backup itself", r.String(), r.BackupFor)
+		}
+	}
+	return nil
+}
+
+func (s *RangeSet) hasFailover() bool {
+	for _, r := range *s {
+		if r.Uplink != "" || r.BackupFor != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// failoverTiers splits the set into the ranges to allocate from first and
+// the backups used once those are exhausted. A range whose uplink has no
+// carrier is left out, and the backups of such a primary move up to the
+// first tier.
+func (s *RangeSet) failoverTiers() []RangeSet {
+	up := func(r *Range) bool {
+		return r.Uplink == "" || carrierUp(r.Uplink)
+	}
+	byName := map[string]*Range{}
+	for i, r := range *s {
+		if r.Name != "" {
+			byName[r.Name] = &(*s)[i]
+		}
+	}
+
+	var first, backups RangeSet
+	for i := range *s {
+		r := &(*s)[i]
+		switch {
+		case !up(r):
+		case r.BackupFor == "":
+			first = append(first, *r)
+		case !up(byName[r.BackupFor]):
+			first = append(first, *r)
+		default:
+			backups = append(backups, *r)
+		}
+	}
+
+	var tiers []RangeSet
+	for _, t := range []RangeSet{first, backups} {
+		if len(t) > 0 {
+			tiers = append(tiers, t)
+		}
+	}
+	return tiers
+}
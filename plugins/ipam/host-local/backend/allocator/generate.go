@@ -0,0 +1,105 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
+)
+
+// GenerateULA derives the subnet of a range from the node's machine-id as
+// an RFC 4193 unique local /64.
+const GenerateULA = "ula"
+
+// MachineIDFile is read to derive generated subnets.
+var MachineIDFile = "/etc/machine-id"
+
+// ulaSalt makes the global ID specific to host-local, so the machine-id
+// itself can't be recovered from the prefix.
+const ulaSalt = "cni-host-local-ula:"
+
+// ULASubnet returns the unique local /64 for the given machine-id. The
+// 40 bit global ID is taken from a SHA-1 of the machine-id as in RFC 4193
+// section 3.2.2, the subnet ID from one of network and key, so every
+// generated range of a node gets its own /64.
+func ULASubnet(machineID, network, key string) *net.IPNet {
+	global := sha1.Sum([]byte(ulaSalt + machineID))
+	subnet := sha1.Sum([]byte(network + "/" + key))
+
+	prefix := make(net.IP, net.IPv6len)
+	prefix[0] = 0xfd
+	copy(prefix[1:6], global[len(global)-5:])
+	copy(prefix[6:8], subnet[:2])
+	return &net.IPNet{IP: prefix, Mask: net.CIDRMask(64, 128)}
+}
+
+func readMachineID() (string, error) {
+	data, err := os.ReadFile(MachineIDFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read machine-id: %v", err)
+	}
+	id := strings.TrimSpace(string(data))
+	if id == "" {
+		return "", fmt.Errorf("machine-id %s is empty", MachineIDFile)
+	}
+	return id, nil
+}
+
+// ResolveGeneratedRanges fills in the subnet of every range which sets
+// "generate". A subnet generated before is taken from the store, so the
+// range stays stable even if the machine-id changes; otherwise it is
+// derived and persisted on first use.
+func ResolveGeneratedRanges(conf *IPAMConfig, store backend.Store) error {
+	for i := range conf.Ranges {
+		generated := false
+		for j := range conf.Ranges[i] {
+			r := &conf.Ranges[i][j]
+			if r.Generate == "" {
+				continue
+			}
+			generated = true
+
+			key := fmt.Sprintf("%d-%d", i, j)
+			subnet, err := store.GeneratedSubnet(key)
+			if err != nil {
+				return err
+			}
+			if subnet == nil {
+				machineID, err := readMachineID()
+				if err != nil {
+					return err
+				}
+				subnet = ULASubnet(machineID, conf.Name, key)
+				if err := store.SaveGeneratedSubnet(key, subnet); err != nil {
+					return err
+				}
+			}
+			r.Subnet = types.IPNet(*subnet)
+		}
+		if !generated {
+			continue
+		}
+		if err := conf.Ranges[i].Canonicalize(); err != nil {
+			return fmt.Errorf("invalid range set %d: %s", i, err)
+		}
+	}
+	return nil
+}
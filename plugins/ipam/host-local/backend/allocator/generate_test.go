@@ -0,0 +1,77 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	fakestore "github.com/containernetworking/plugins/plugins/ipam/host-local/backend/testing"
+)
+
+var _ = Describe("generated ranges", func() {
+	It("derives a stable unique local /64 per network and range", func() {
+		subnet := ULASubnet("0123456789abcdef0123456789abcdef", "mynet", "0-0")
+		Expect(subnet.IP[0]).To(Equal(byte(0xfd)))
+		Expect(subnet.Mask).To(Equal(net.CIDRMask(64, 128)))
+		Expect(subnet.IP[8:]).To(Equal(net.IP(make([]byte, 8))))
+
+		Expect(ULASubnet("0123456789abcdef0123456789abcdef", "mynet", "0-0")).To(Equal(subnet))
+
+		other := ULASubnet("0123456789abcdef0123456789abcdef", "othernet", "0-0")
+		Expect(other.IP[:6]).To(Equal(subnet.IP[:6]))
+		Expect(other.IP[6:8]).NotTo(Equal(subnet.IP[6:8]))
+
+		node := ULASubnet("fedcba9876543210fedcba9876543210", "mynet", "0-0")
+		Expect(node.IP[1:6]).NotTo(Equal(subnet.IP[1:6]))
+	})
+
+	It("resolves generated ranges and persists the subnet", func() {
+		tmpDir, err := os.MkdirTemp("", "host-local-generate")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+		defer func(orig string) { MachineIDFile = orig }(MachineIDFile)
+		MachineIDFile = filepath.Join(tmpDir, "machine-id")
+		Expect(os.WriteFile(MachineIDFile, []byte("0123456789abcdef0123456789abcdef\n"), 0o644)).To(Succeed())
+
+		conf := &IPAMConfig{
+			Name:   "mynet",
+			Ranges: []RangeSet{{{Generate: GenerateULA}}},
+		}
+		store := fakestore.NewFakeStore(map[string]string{}, map[string]net.IP{})
+		Expect(ResolveGeneratedRanges(conf, store)).To(Succeed())
+
+		expected := ULASubnet("0123456789abcdef0123456789abcdef", "mynet", "0-0")
+		Expect((*net.IPNet)(&conf.Ranges[0][0].Subnet).String()).To(Equal(expected.String()))
+		Expect(conf.Ranges[0][0].Gateway).To(Equal(append(expected.IP[:15:15], 1)))
+
+		saved, err := store.GeneratedSubnet("0-0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(saved).To(Equal(expected))
+	})
+
+	It("fails without a machine-id", func() {
+		defer func(orig string) { MachineIDFile = orig }(MachineIDFile)
+		MachineIDFile = "/non/existent/machine-id"
+
+		conf := &IPAMConfig{Ranges: []RangeSet{{{Generate: GenerateULA}}}}
+		store := fakestore.NewFakeStore(map[string]string{}, map[string]net.IP{})
+		Expect(ResolveGeneratedRanges(conf, store)).To(MatchError(HavePrefix("failed to read machine-id")))
+	})
+})
@@ -0,0 +1,127 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+)
+
+// hostnameVars are the variables of the hostname template, see
+// IPAMConfig.Hostname.
+var hostnameVars = []string{"POD_NAME", "POD_NAMESPACE", "NODE_NAME", "IFNAME", "IP"}
+
+// HostnameOf returns the name of an address of the interface ifName by the
+// hostname template, or "" if none is configured or a variable the template
+// uses has no value, e.g. POD_NAME outside Kubernetes. The values are made
+// DNS labels: lowercased, with the characters other than letters, digits
+// and dashes replaced by dashes. IPv6 addresses are written out in full, so
+// "ip-${IP}.pods.example" gives a valid name for any address, as a PTR
+// record of it would have.
+func (c *IPAMConfig) HostnameOf(ifName string, ip net.IP) (string, error) {
+	if c.Hostname == "" {
+		return "", nil
+	}
+	values := map[string]string{
+		"POD_NAME":      c.PodName,
+		"POD_NAMESPACE": c.PodNamespace,
+		"NODE_NAME":     os.Getenv("NODE_NAME"),
+		"IFNAME":        ifName,
+		"IP":            ipLabel(ip),
+	}
+	if values["NODE_NAME"] == "" {
+		values["NODE_NAME"], _ = os.Hostname()
+	}
+	missing := false
+	name := os.Expand(c.Hostname, func(v string) string {
+		value := values[v]
+		missing = missing || value == ""
+		return dnsLabel(value)
+	})
+	if missing {
+		return "", nil
+	}
+	if err := checkDNSName(name); err != nil {
+		return "", fmt.Errorf("invalid hostname %q: %v", name, err)
+	}
+	return name, nil
+}
+
+// checkHostnameTemplate validates the variables of the template, and that
+// it gives a valid name.
+func checkHostnameTemplate(tmpl string) error {
+	var err error
+	name := os.Expand(tmpl, func(v string) string {
+		if !slices.Contains(hostnameVars, v) && err == nil {
+			err = fmt.Errorf("unknown variable %q, must be one of %q", v, hostnameVars)
+		}
+		return "x"
+	})
+	if err != nil {
+		return err
+	}
+	return checkDNSName(name)
+}
+
+func ipLabel(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	ip = ip.To16()
+	groups := make([]string, 0, 8)
+	for i := 0; i < net.IPv6len; i += 2 {
+		groups = append(groups, fmt.Sprintf("%02x%02x", ip[i], ip[i+1]))
+	}
+	return strings.Join(groups, "-")
+}
+
+func dnsLabel(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, value)
+}
+
+// checkDNSName validates a hostname as RFC 1123 does.
+func checkDNSName(name string) error {
+	if len(name) > 253 {
+		return fmt.Errorf("longer than 253 characters")
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("label %q must be 1 to 63 characters", label)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("label %q must not start or end with a dash", label)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+				return fmt.Errorf("label %q must consist of lowercase letters, digits and dashes", label)
+			}
+		}
+	}
+	return nil
+}
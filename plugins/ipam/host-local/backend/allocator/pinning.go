@@ -0,0 +1,84 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"fmt"
+	"net"
+)
+
+// validatePinning checks the VLANs of the ranges, and that backups are
+// pinned like their primaries, so both are in or out of a set together.
+func (s *RangeSet) validatePinning() error {
+	byName := map[string]*Range{}
+	for i, r := range *s {
+		if r.VLAN < 0 || r.VLAN > 4094 {
+			return fmt.Errorf("invalid vlan %d of range %s, must be [1, 4094]", r.VLAN, r.String())
+		}
+		if r.Name != "" {
+			byName[r.Name] = &(*s)[i]
+		}
+	}
+	for _, r := range *s {
+		if primary := byName[r.BackupFor]; primary != nil && (primary.VLAN != r.VLAN || primary.Parent != r.Parent) {
+			return fmt.Errorf("range %s is pinned unlike range %q it is backupFor", r.String(), r.BackupFor)
+		}
+	}
+	return nil
+}
+
+// matches reports whether an attachment on the VLAN vlan of the parent
+// interface parent may be allocated from the range. A range is pinned to
+// its VLAN and parent, if set, and open to any attachment otherwise.
+func (r *Range) matches(vlan int, parent string) bool {
+	return (r.VLAN == 0 || r.VLAN == vlan) && (r.Parent == "" || r.Parent == parent)
+}
+
+// ForAttachment returns the ranges of the set an attachment on the VLAN
+// vlan of the parent interface parent may be allocated from, as passed by
+// the main plugin in CNI_ARGS, see IPAMConfig.VLAN. A trunked network then
+// addresses the attachments of each VLAN or port from its own ranges with
+// a single configuration.
+func (s *RangeSet) ForAttachment(vlan int, parent string) RangeSet {
+	matching := RangeSet{}
+	for _, r := range *s {
+		if r.matches(vlan, parent) {
+			matching = append(matching, r)
+		}
+	}
+	return matching
+}
+
+// AttachmentRanges returns the ranges of each range set the attachment may
+// be allocated from, empty for sets it has no range of. requested are the
+// requested IPs by range set, see RequestedIPsBySet, which must be in those
+// ranges.
+func (c *IPAMConfig) AttachmentRanges(requested map[int]net.IP) ([]RangeSet, error) {
+	sets := make([]RangeSet, len(c.Ranges))
+	matched := false
+	for idx := range c.Ranges {
+		sets[idx] = c.Ranges[idx].ForAttachment(c.VLAN, c.Parent)
+		if len(sets[idx]) > 0 {
+			matched = true
+		}
+		if ip := requested[idx]; ip != nil && !sets[idx].Contains(ip) {
+			return nil, fmt.Errorf("requested IP %s is in no range of vlan %d of parent %q", ip, c.VLAN, c.Parent)
+		}
+	}
+	if !matched {
+		return nil, fmt.Errorf("no range of the network is open to vlan %d of parent %q", c.VLAN, c.Parent)
+	}
+	return sets, nil
+}
@@ -41,6 +41,16 @@ func (s *RangeSet) RangeFor(addr net.IP) (*Range, error) {
 	return nil, fmt.Errorf("%s not in range set %s", addr.String(), s.String())
 }
 
+// Generated returns true if any range in this set has its subnet generated
+func (s *RangeSet) Generated() bool {
+	for _, r := range *s {
+		if r.Generate != "" {
+			return true
+		}
+	}
+	return false
+}
+
 // Overlaps returns true if any ranges in any set overlap with this one
 func (s *RangeSet) Overlaps(p1 *RangeSet) bool {
 	for _, r := range *s {
@@ -82,7 +92,10 @@ func (s *RangeSet) Canonicalize() error {
 		}
 	}
 
-	return nil
+	if err := s.validateFailover(); err != nil {
+		return err
+	}
+	return s.validatePinning()
 }
 
 func (s *RangeSet) String() string {
@@ -0,0 +1,62 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"fmt"
+	"net"
+)
+
+// RequestedIPsBySet returns the requested IPs by the index of the range set
+// they are in. The request can't be fulfilled, and an error naming the IP is
+// returned, for an IP in no range set of the network, an IP with a prefix
+// other than the one of its range, or more than one IP in a range set, as
+// one address of each range set is allocated. Generated ranges must be
+// resolved first.
+func (c *IPAMConfig) RequestedIPsBySet() (map[int]net.IP, error) {
+	bySet := map[int]net.IP{}
+	for _, ip := range c.IPArgs {
+		idx := -1
+		for i := range c.Ranges {
+			if c.Ranges[i].Contains(ip) {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return nil, requestedError("%s is in no range of the network", ip)
+		}
+		if prev, ok := bySet[idx]; ok {
+			if prev.Equal(ip) {
+				continue
+			}
+			return nil, requestedError("%s and %s are both in range set %d, only one address of a range set can be requested", prev, ip, idx)
+		}
+		if mask := c.requestedMasks[ip.String()]; mask != nil {
+			if r, err := c.Ranges[idx].RangeFor(ip); err == nil {
+				ones, _ := mask.Size()
+				if subnetOnes, _ := r.Subnet.Mask.Size(); ones != subnetOnes {
+					return nil, requestedError("%s/%d doesn't match the prefix /%d of its range", ip, ones, subnetOnes)
+				}
+			}
+		}
+		bySet[idx] = ip
+	}
+	return bySet, nil
+}
+
+func requestedError(format string, args ...interface{}) error {
+	return fmt.Errorf("failed to allocate all requested IPs: "+format, args...)
+}
@@ -0,0 +1,144 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Owner identifies who an address is reserved for: a pod, or an interface
+// by its MAC address.
+type Owner struct {
+	PodNamespace string
+	PodName      string
+	MAC          net.HardwareAddr
+}
+
+func (o Owner) String() string {
+	if o.MAC != nil {
+		return o.MAC.String()
+	}
+	return o.PodNamespace + "/" + o.PodName
+}
+
+// matches returns true if the reservation owner o is the requester.
+func (o Owner) matches(requester Owner) bool {
+	if o.MAC != nil {
+		return bytes.Equal(o.MAC, requester.MAC)
+	}
+	return o.PodName != "" && o.PodNamespace == requester.PodNamespace && o.PodName == requester.PodName
+}
+
+// LoadReservations reads the reservations file of every range in the set.
+// Each line of the file holds an address and its owner, either a pod as
+// "namespace/name" or a MAC address:
+//
+//	10.1.2.10 kube-system/coredns
+//	10.1.2.11 0a:58:0a:01:02:0b
+//
+// Addresses outside the range are rejected.
+func (s *RangeSet) LoadReservations() error {
+	for i := range *s {
+		r := &(*s)[i]
+		if r.Reservations == "" {
+			continue
+		}
+		reserved, err := readReservations(r.Reservations)
+		if err != nil {
+			return fmt.Errorf("failed to load reservations %s: %v", r.Reservations, err)
+		}
+		for ip := range reserved {
+			if !r.Contains(net.ParseIP(ip)) {
+				return fmt.Errorf("failed to load reservations %s: %s is not in range %s", r.Reservations, ip, r.String())
+			}
+		}
+		r.reserved = reserved
+	}
+	return nil
+}
+
+func readReservations(path string) (map[string]Owner, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reserved := map[string]Owner{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		addr := net.ParseIP(fields[0])
+		if addr == nil {
+			return nil, fmt.Errorf("invalid IP %q", fields[0])
+		}
+		if err := canonicalizeIP(&addr); err != nil {
+			return nil, err
+		}
+
+		owner := Owner{}
+		if ns, name, ok := strings.Cut(fields[1], "/"); ok {
+			if ns == "" || name == "" {
+				return nil, fmt.Errorf("invalid owner %q", fields[1])
+			}
+			owner.PodNamespace, owner.PodName = ns, name
+		} else if owner.MAC, err = net.ParseMAC(fields[1]); err != nil {
+			return nil, fmt.Errorf("invalid owner %q, must be a namespace/name or MAC address", fields[1])
+		}
+
+		if prev, ok := reserved[addr.String()]; ok {
+			return nil, fmt.Errorf("%s is reserved for both %s and %s", addr, prev, owner)
+		}
+		reserved[addr.String()] = owner
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return reserved, nil
+}
+
+// reservedFor returns the owner addr is reserved for, if any.
+func (s *RangeSet) reservedFor(addr net.IP) (Owner, bool) {
+	for _, r := range *s {
+		if owner, ok := r.reserved[addr.String()]; ok {
+			return owner, true
+		}
+	}
+	return Owner{}, false
+}
+
+// reservationOf returns the address reserved for the requester, if any.
+func (s *RangeSet) reservationOf(requester Owner) net.IP {
+	for _, r := range *s {
+		for addr, owner := range r.reserved {
+			if owner.matches(requester) {
+				return net.ParseIP(addr)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("reservations", func() {
+	var path string
+
+	BeforeEach(func() {
+		path = filepath.Join(GinkgoT().TempDir(), "reservations")
+	})
+
+	load := func(contents string) (*IPAllocator, error) {
+		Expect(os.WriteFile(path, []byte(contents), 0o644)).To(Succeed())
+		a := mkalloc()
+		(*a.rangeset)[0].Reservations = path
+		return &a, a.rangeset.LoadReservations()
+	}
+
+	It("rejects malformed files", func() {
+		_, err := load("192.168.1.2\n")
+		Expect(err).To(MatchError(ContainSubstring(`invalid line "192.168.1.2"`)))
+		_, err = load("192.168.1.2 coredns\n")
+		Expect(err).To(MatchError(ContainSubstring(`invalid owner "coredns"`)))
+		_, err = load("192.168.2.2 kube-system/coredns\n")
+		Expect(err).To(MatchError(ContainSubstring("192.168.2.2 is not in range")))
+		_, err = load("192.168.1.2 kube-system/coredns\n192.168.1.2 kube-system/kube-proxy\n")
+		Expect(err).To(MatchError(ContainSubstring("192.168.1.2 is reserved for both kube-system/coredns and kube-system/kube-proxy")))
+	})
+
+	It("hands reserved addresses only to their owners", func() {
+		a, err := load(`
+# static reservations
+192.168.1.2 kube-system/coredns
+192.168.1.3 0A:58:C0:A8:01:03
+`)
+		Expect(err).NotTo(HaveOccurred())
+
+		ipc, err := a.Get("other", "eth0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipc.Address.IP).To(Equal(net.IP{192, 168, 1, 4}))
+
+		_, err = a.Get("other2", "eth0", net.IP{192, 168, 1, 2})
+		Expect(err).To(MatchError("requested IP address 192.168.1.2 is reserved for kube-system/coredns"))
+
+		a.SetOwner(Owner{PodNamespace: "kube-system", PodName: "coredns"})
+		ipc, err = a.Get("coredns", "eth0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipc.Address.IP).To(Equal(net.IP{192, 168, 1, 2}))
+
+		mac, _ := net.ParseMAC("0a:58:c0:a8:01:03")
+		a.SetOwner(Owner{MAC: mac})
+		ipc, err = a.Get("vm", "eth0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipc.Address.IP).To(Equal(net.IP{192, 168, 1, 3}))
+	})
+})
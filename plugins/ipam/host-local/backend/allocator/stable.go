@@ -0,0 +1,79 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"net"
+)
+
+// stableAttempts is how many addresses are derived for an interface, like
+// the DAD_Counter of RFC 7217, before falling back to the next free one.
+const stableAttempts = 8
+
+// SetStable makes the allocator derive the IPv6 addresses of pods from
+// their identity keyed with secret, see StableIPv6.
+func (a *IPAllocator) SetStable(secret []byte) {
+	a.stableKey = secret
+}
+
+// getStable reserves the address derived for the owner's interface in the
+// first IPv6 range of the set it is free in, or returns nil if there is
+// none or the owner isn't a pod.
+func (a *IPAllocator) getStable(id string, ifname string) (*net.IPNet, net.IP, error) {
+	if a.stableKey == nil || a.owner.PodName == "" {
+		return nil, nil, nil
+	}
+	for _, r := range *a.rangeset {
+		if len(r.Subnet.IP) != net.IPv6len {
+			continue
+		}
+		for counter := 0; counter < stableAttempts; counter++ {
+			addr := stableIP(a.stableKey, &r, a.owner, ifname, counter)
+			if !r.Contains(addr) || addr.Equal(r.Gateway) {
+				continue
+			}
+			if _, ok := a.rangeset.reservedFor(addr); ok {
+				continue
+			}
+			reserved, err := a.store.Reserve(id, ifname, addr, a.rangeID)
+			if err != nil {
+				return nil, nil, err
+			}
+			if reserved {
+				return &net.IPNet{IP: addr, Mask: r.Subnet.Mask}, r.Gateway, nil
+			}
+		}
+	}
+	return nil, nil, nil
+}
+
+// stableIP derives the host bits of the address from a keyed hash of the
+// prefix, the pod and its interface, and the attempt.
+func stableIP(key []byte, r *Range, owner Owner, ifname string, counter int) net.IP {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(r.Subnet.IP)
+	mac.Write(r.Subnet.Mask)
+	mac.Write([]byte(owner.PodNamespace + "/" + owner.PodName + "/" + ifname))
+	mac.Write([]byte{byte(counter)})
+	sum := mac.Sum(nil)
+
+	addr := make(net.IP, net.IPv6len)
+	for i := range addr {
+		addr[i] = r.Subnet.IP[i] | (sum[i] &^ r.Subnet.Mask[i])
+	}
+	return addr
+}
@@ -15,36 +15,71 @@
 package disk
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
 )
 
 const (
-	lastIPFilePrefix = "last_reserved_ip."
-	LineBreak        = "\r\n"
+	lastIPFilePrefix          = "last_reserved_ip."
+	generatedSubnetFilePrefix = "generated_subnet."
+	LineBreak                 = "\r\n"
 )
 
 var defaultDataDir = "/var/lib/cni/networks"
 
 // Store is a simple disk-backed store that creates one file per IP
 // address in a given directory. The contents of the file are the container ID.
+// Alternatively the allocations are kept in a journal, see NewJournal.
 type Store struct {
 	*FileLock
 	dataDir string
+
+	// journal is set if the store uses FormatJournal
+	journal bool
+	locked  bool
+	state   *journalState
+
+	// integrity is set if lease files are signed or encrypted, see SetKey
+	integrity *integrity
+
+	// snapshotDir overrides where snapshots are kept, see SetSnapshotDir
+	snapshotDir string
+	// label is the SELinux context of the store, see SetLabel
+	label string
+
+	// mu serializes the users of the store within the process, it is held
+	// from Lock to Unlock
+	mu sync.Mutex
+	// wb is set in write-behind mode, see SetWriteBehind
+	wb *writeBehind
+	// lockLatencies are the most recent lock acquisition times of this
+	// process, oldest first
+	lockLatencies []time.Duration
+	// quarantine is the list of quarantines read while the store is
+	// locked, see loadQuarantine
+	quarantine []Quarantined
 }
 
 // Store implements the Store interface
 var _ backend.Store = &Store{}
 
+// New opens the store of the network in dataDir or, if empty, in the
+// default data dir, see DefaultDataDir.
 func New(network, dataDir string) (*Store, error) {
 	if dataDir == "" {
-		dataDir = defaultDataDir
+		var err error
+		if dataDir, err = DefaultDataDir(); err != nil {
+			return nil, err
+		}
 	}
 	dir := filepath.Join(dataDir, network)
 	if err := os.MkdirAll(dir, 0o755); err != nil {
@@ -55,12 +90,49 @@ func New(network, dataDir string) (*Store, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Store{lk, dir}, nil
+	s := &Store{FileLock: lk, dataDir: dir}
+	// once a network has a journal it stays on it
+	if _, err := os.Stat(s.journalPath()); err == nil {
+		s.journal = true
+	}
+	return s, nil
 }
 
+// Reserve allocates ip to the attachment and records it as the last
+// reserved IP of the range. It returns false if ip is allocated, or
+// quarantined from the attachment, see Quarantine.
 func (s *Store) Reserve(id string, ifname string, ip net.IP, rangeID string) (bool, error) {
+	quarantined, err := s.quarantinedFrom(id, ifname, ip)
+	if quarantined || err != nil {
+		return false, err
+	}
+	reserved, err := s.reserveLease(id, ifname, ip)
+	if !reserved || err != nil {
+		return reserved, err
+	}
+	if err := s.saveLastReservedIP(ip, rangeID); err != nil {
+		if s.journal {
+			_, _ = s.journalReleaseByIP(ip)
+		} else {
+			os.Remove(GetEscapedPath(s.dataDir, ip.String()))
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// reserveLease is Reserve, leaving the last reserved IP alone.
+func (s *Store) reserveLease(id string, ifname string, ip net.IP) (bool, error) {
+	if s.journal {
+		return s.journalReserve(id, ifname, ip)
+	}
+
 	fname := GetEscapedPath(s.dataDir, ip.String())
 
+	data, err := s.encodeLease(ip.String(), strings.TrimSpace(id)+LineBreak+ifname)
+	if err != nil {
+		return false, err
+	}
 	f, err := os.OpenFile(fname, os.O_RDWR|os.O_EXCL|os.O_CREATE, 0o600)
 	if os.IsExist(err) {
 		return false, nil
@@ -68,7 +140,7 @@ func (s *Store) Reserve(id string, ifname string, ip net.IP, rangeID string) (bo
 	if err != nil {
 		return false, err
 	}
-	if _, err := f.WriteString(strings.TrimSpace(id) + LineBreak + ifname); err != nil {
+	if _, err := f.Write(data); err != nil {
 		f.Close()
 		os.Remove(f.Name())
 		return false, err
@@ -77,17 +149,38 @@ func (s *Store) Reserve(id string, ifname string, ip net.IP, rangeID string) (bo
 		os.Remove(f.Name())
 		return false, err
 	}
-	// store the reserved ip in lastIPFile
+	return true, nil
+}
+
+// saveLastReservedIP stores the reserved ip in lastIPFile
+// saveLastReservedIP replaces the file atomically, so an interrupted write
+// can't leave a truncated address behind.
+func (s *Store) saveLastReservedIP(ip net.IP, rangeID string) error {
+	if s.wb != nil {
+		s.wb.lastIPs[rangeID] = ip
+		return nil
+	}
+	return s.writeLastReservedIP(ip, rangeID)
+}
+
+func (s *Store) writeLastReservedIP(ip net.IP, rangeID string) error {
 	ipfile := GetEscapedPath(s.dataDir, lastIPFilePrefix+rangeID)
-	err = os.WriteFile(ipfile, []byte(ip.String()), 0o600)
-	if err != nil {
-		return false, err
+	tmpfile := ipfile + ".tmp"
+	if err := os.WriteFile(tmpfile, []byte(ip.String()), 0o600); err != nil {
+		return err
 	}
-	return true, nil
+	if err := os.Rename(tmpfile, ipfile); err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	return nil
 }
 
 // LastReservedIP returns the last reserved IP if exists
 func (s *Store) LastReservedIP(rangeID string) (net.IP, error) {
+	if s.wb != nil && s.wb.lastIPs[rangeID] != nil {
+		return s.wb.lastIPs[rangeID], nil
+	}
 	ipfile := GetEscapedPath(s.dataDir, lastIPFilePrefix+rangeID)
 	data, err := os.ReadFile(ipfile)
 	if err != nil {
@@ -96,6 +189,33 @@ func (s *Store) LastReservedIP(rangeID string) (net.IP, error) {
 	return net.ParseIP(string(data)), nil
 }
 
+// GeneratedSubnet returns the subnet saved for a generated range, or nil if
+// there is none yet
+func (s *Store) GeneratedSubnet(key string) (*net.IPNet, error) {
+	data, err := os.ReadFile(GetEscapedPath(s.dataDir, generatedSubnetFilePrefix+key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, subnet, err := net.ParseCIDR(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid generated subnet for range %s: %v", key, err)
+	}
+	return subnet, nil
+}
+
+// SaveGeneratedSubnet persists the subnet of a generated range
+func (s *Store) SaveGeneratedSubnet(key string, subnet *net.IPNet) error {
+	fname := GetEscapedPath(s.dataDir, generatedSubnetFilePrefix+key)
+	tmp := fname + ".tmp"
+	if err := os.WriteFile(tmp, []byte(subnet.String()), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fname)
+}
+
 func (s *Store) FindByKey(match string) (bool, error) {
 	found := false
 
@@ -103,11 +223,7 @@ func (s *Store) FindByKey(match string) (bool, error) {
 		if err != nil || info.IsDir() {
 			return nil
 		}
-		data, err := os.ReadFile(path)
-		if err != nil {
-			return nil
-		}
-		if strings.TrimSpace(string(data)) == match {
+		if content, ok := s.readLease(path); ok && content == match {
 			found = true
 		}
 		return nil
@@ -115,9 +231,13 @@ func (s *Store) FindByKey(match string) (bool, error) {
 	return found, err
 }
 
+// FindByID returns whether an address is allocated to the interface of
+// the container, or with no interface matching, to the container. The
+// store must be locked.
 func (s *Store) FindByID(id string, ifname string) bool {
-	s.Lock()
-	defer s.Unlock()
+	if s.journal {
+		return s.journalFindByID(id, ifname)
+	}
 
 	match := strings.TrimSpace(id) + LineBreak + ifname
 	found, err := s.FindByKey(match)
@@ -137,11 +257,7 @@ func (s *Store) ReleaseByKey(match string) (bool, error) {
 		if err != nil || info.IsDir() {
 			return nil
 		}
-		data, err := os.ReadFile(path)
-		if err != nil {
-			return nil
-		}
-		if strings.TrimSpace(string(data)) == match {
+		if content, ok := s.readLease(path); ok && content == match {
 			if err := os.Remove(path); err != nil {
 				return nil
 			}
@@ -155,6 +271,10 @@ func (s *Store) ReleaseByKey(match string) (bool, error) {
 // N.B. This function eats errors to be tolerant and
 // release as much as possible
 func (s *Store) ReleaseByID(id string, ifname string) error {
+	if s.journal {
+		return s.journalReleaseByID(id, ifname)
+	}
+
 	match := strings.TrimSpace(id) + LineBreak + ifname
 	found, err := s.ReleaseByKey(match)
 
@@ -166,8 +286,71 @@ func (s *Store) ReleaseByID(id string, ifname string) error {
 	return err
 }
 
+// ReleaseByIP removes the allocation of ip along with the pod reservation
+// pointing to it, so no container ID is needed.
+func (s *Store) ReleaseByIP(ip net.IP) (bool, error) {
+	if s.journal {
+		return s.journalReleaseByIP(ip)
+	}
+
+	err := os.Remove(GetEscapedPath(s.dataDir, ip.String()))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	found := err == nil
+
+	podFile, err := s.findPodFileName(ip.String(), "", "")
+	if err != nil {
+		return found, err
+	}
+	if podFile != "" {
+		if err := os.Remove(GetEscapedPath(s.dataDir, podFile)); err != nil && !os.IsNotExist(err) {
+			return found, err
+		}
+	}
+	return found, nil
+}
+
+// ReleaseByPod removes every IP reserved for the pod, one per range, and
+// the reservations themselves.
+func (s *Store) ReleaseByPod(podNs, podName string) ([]net.IP, error) {
+	if podNs == "" || podName == "" {
+		return nil, fmt.Errorf("pod namespace and name are required")
+	}
+	if s.journal {
+		return s.journalReleaseByPod(podNs, podName)
+	}
+
+	podFiles, err := filepath.Glob(GetEscapedPath(s.dataDir, podFileName("*", podNs, podName)))
+	if err != nil {
+		return nil, err
+	}
+
+	var released []net.IP
+	for _, path := range podFiles {
+		_, fName := filepath.Split(path)
+		ipStr, ns, name := resolvePodFileName(fName)
+		ip := net.ParseIP(ipStr)
+		if ip == nil || ns != podNs || name != podName {
+			continue
+		}
+		if err := os.Remove(GetEscapedPath(s.dataDir, ip.String())); err != nil && !os.IsNotExist(err) {
+			return released, err
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return released, err
+		}
+		released = append(released, ip)
+	}
+	return released, nil
+}
+
 // GetByID returns the IPs which have been allocated to the specific ID
 func (s *Store) GetByID(id string, ifname string) []net.IP {
+	if s.journal {
+		return s.journalGetByID(id, ifname)
+	}
+
 	var ips []net.IP
 
 	match := strings.TrimSpace(id) + LineBreak + ifname
@@ -179,11 +362,40 @@ func (s *Store) GetByID(id string, ifname string) []net.IP {
 		if err != nil || info.IsDir() {
 			return nil
 		}
-		data, err := os.ReadFile(path)
-		if err != nil {
+		content, ok := s.readLease(path)
+		if !ok {
+			return nil
+		}
+		if content == match || content == matchOld {
+			_, ipString := filepath.Split(path)
+			if ip := net.ParseIP(ipString); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		return nil
+	})
+
+	return ips
+}
+
+// GetByContainer returns the IPs which have been allocated to any interface
+// of the specific ID
+func (s *Store) GetByContainer(id string) []net.IP {
+	if s.journal {
+		return s.journalGetByContainer(id)
+	}
+
+	var ips []net.IP
+	id = strings.TrimSpace(id)
+	_ = filepath.Walk(s.dataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		content, ok := s.readLease(path)
+		if !ok {
 			return nil
 		}
-		if strings.TrimSpace(string(data)) == match || strings.TrimSpace(string(data)) == matchOld {
+		if owner, _, _ := strings.Cut(content, LineBreak); strings.TrimSpace(owner) == id {
 			_, ipString := filepath.Split(path)
 			if ip := net.ParseIP(ipString); ip != nil {
 				ips = append(ips, ip)
@@ -209,6 +421,9 @@ func (s *Store) HasReservedIP(podNs, podName string) (bool, net.IP) {
 	if len(podName) == 0 {
 		return false, ip
 	}
+	if s.journal {
+		return s.journalHasReservedIP(podNs, podName)
+	}
 
 	// Pod, ip mapping info are recorded with file name: PodIP_PodNs_PodName
 	podIPNsNameFileName, err := s.findPodFileName("", podNs, podName)
@@ -229,16 +444,45 @@ func (s *Store) HasReservedIP(podNs, podName string) (bool, net.IP) {
 	return false, ip
 }
 
+// PodIPs returns the addresses the store keeps for pods across restarts,
+// keyed by "namespace/name".
+func (s *Store) PodIPs() (map[string][]net.IP, error) {
+	if s.journal {
+		return s.journalPodIPs()
+	}
+
+	podFiles, err := filepath.Glob(GetEscapedPath(s.dataDir, podFileName("*", "*", "*")))
+	if err != nil {
+		return nil, err
+	}
+	pods := map[string][]net.IP{}
+	for _, path := range podFiles {
+		_, fName := filepath.Split(path)
+		ipStr, ns, name := resolvePodFileName(fName)
+		if ip := net.ParseIP(ipStr); ip != nil {
+			pods[ns+"/"+name] = append(pods[ns+"/"+name], ip)
+		}
+	}
+	return pods, nil
+}
+
 // ReservePodInfo create podName file for storing ip or update ip file with container id
 // in terms of podIPIsExist
 func (s *Store) ReservePodInfo(id string, ip net.IP, podNs, podName string, podIPIsExist bool) (bool, error) {
+	if s.journal {
+		return s.journalReservePodInfo(id, ip, podNs, podName, podIPIsExist)
+	}
+
 	if podIPIsExist {
 		// pod Ns/Name file is exist, update ip file with new container id.
 		fname := GetEscapedPath(s.dataDir, ip.String())
-		err := os.WriteFile(fname, []byte(strings.TrimSpace(id)), 0o644)
+		data, err := s.encodeLease(ip.String(), strings.TrimSpace(id))
 		if err != nil {
 			return false, err
 		}
+		if err := os.WriteFile(fname, data, 0o644); err != nil {
+			return false, err
+		}
 	} else if len(podName) != 0 {
 		// for new pod, create a new file named "PodIP_PodNs_PodName",
 		// if there is already file named with prefix "ip_", rename the old file with new PodNs and PodName.
@@ -315,3 +559,52 @@ func (s *Store) findPodFileName(ip, ns, name string) (string, error) {
 
 	return "", nil
 }
+
+// readRecords reads the JSON records of the store in the file name, e.g.
+// its handovers, into v. It is not an error if there are none.
+func (s *Store) readRecords(name string, v interface{}) error {
+	fname := GetEscapedPath(s.dataDir, name)
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", fname, err)
+	}
+	return nil
+}
+
+// dropState forgets what was read from the store, once other processes
+// may change it or its files were replaced.
+func (s *Store) dropState() {
+	s.state = nil
+	s.quarantine = nil
+}
+
+// writeRecords replaces the file name with the n records in v, or removes
+// it if there are none.
+func (s *Store) writeRecords(name string, v interface{}, n int) error {
+	fname := GetEscapedPath(s.dataDir, name)
+	if n == 0 {
+		if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := fname + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, fname); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
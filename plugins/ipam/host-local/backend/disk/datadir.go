@@ -0,0 +1,67 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// DataDirEnv is the environment variable setting the data dir of all
+// networks which don't set their own.
+const DataDirEnv = "HOST_LOCAL_DATA_DIR"
+
+// nodeConfigPath is the node-level configuration file of host-local. Like
+// DataDirEnv, it moves the store of all networks without editing them,
+// e.g. to persistent storage on image-based systems whose updates wipe
+// /var/lib.
+var nodeConfigPath = "/etc/cni/host-local.json"
+
+type nodeConfig struct {
+	DataDir string `json:"dataDir,omitempty"`
+}
+
+// DefaultDataDir returns the data dir of networks which don't set one. It
+// is taken from DataDirEnv, else from the node configuration file, else it
+// is /var/lib/cni/networks.
+func DefaultDataDir() (string, error) {
+	if dir := os.Getenv(DataDirEnv); dir != "" {
+		if !filepath.IsAbs(dir) {
+			return "", fmt.Errorf("invalid %s %q, must be an absolute path", DataDirEnv, dir)
+		}
+		return dir, nil
+	}
+
+	data, err := os.ReadFile(nodeConfigPath)
+	if os.IsNotExist(err) {
+		return defaultDataDir, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", nodeConfigPath, err)
+	}
+	conf := nodeConfig{}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return "", fmt.Errorf("failed to parse %s: %v", nodeConfigPath, err)
+	}
+	if conf.DataDir == "" {
+		return defaultDataDir, nil
+	}
+	if !filepath.IsAbs(conf.DataDir) {
+		return "", fmt.Errorf("invalid dataDir %q in %s, must be an absolute path", conf.DataDir, nodeConfigPath)
+	}
+	return conf.DataDir, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Default data dir", func() {
+	var dir, origConfigPath string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "")
+		Expect(err).ToNot(HaveOccurred())
+		origConfigPath = nodeConfigPath
+		nodeConfigPath = filepath.Join(dir, "host-local.json")
+	})
+
+	AfterEach(func() {
+		nodeConfigPath = origConfigPath
+		os.Unsetenv(DataDirEnv)
+		os.RemoveAll(dir)
+	})
+
+	It("takes the environment over the node config over the built-in default", func() {
+		Expect(DefaultDataDir()).To(Equal("/var/lib/cni/networks"))
+
+		Expect(os.WriteFile(nodeConfigPath, []byte(`{"dataDir": "/persist/cni"}`), 0o644)).To(Succeed())
+		Expect(DefaultDataDir()).To(Equal("/persist/cni"))
+
+		os.Setenv(DataDirEnv, "/mnt/cni")
+		Expect(DefaultDataDir()).To(Equal("/mnt/cni"))
+	})
+
+	It("keeps a network's own data dir", func() {
+		os.Setenv(DataDirEnv, filepath.Join(dir, "env"))
+		s, err := New("net", filepath.Join(dir, "own"))
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.DataDir()).To(Equal(filepath.Join(dir, "own", "net")))
+
+		s2, err := New("net", "")
+		Expect(err).ToNot(HaveOccurred())
+		defer s2.Close()
+		Expect(s2.DataDir()).To(Equal(filepath.Join(dir, "env", "net")))
+	})
+
+	It("rejects relative data dirs", func() {
+		Expect(os.WriteFile(nodeConfigPath, []byte(`{"dataDir": "cni"}`), 0o644)).To(Succeed())
+		_, err := DefaultDataDir()
+		Expect(err).To(MatchError(ContainSubstring(`invalid dataDir "cni"`)))
+
+		os.Setenv(DataDirEnv, "cni")
+		_, err = New("net", "")
+		Expect(err).To(MatchError(`invalid HOST_LOCAL_DATA_DIR "cni", must be an absolute path`))
+	})
+})
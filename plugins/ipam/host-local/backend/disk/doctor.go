@@ -0,0 +1,104 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// LeaseFile is a lease file of the store, with the address it is named
+// for in canonical form.
+type LeaseFile struct {
+	Lease
+	Name string
+}
+
+// Canonical reports whether the file is the one the store reads and writes
+// the lease of its address in.
+func (f LeaseFile) Canonical() bool {
+	return f.Name == GetEscapedPath("", f.IP)
+}
+
+// LeaseFiles returns the lease files of the store. Unlike Leases, it
+// returns every file of an address, for files spelling it differently,
+// e.g. IPv4-mapped. A journal store has none. Lease files failing
+// verification are left to "host-local verify". The store must be locked.
+func (s *Store) LeaseFiles() ([]LeaseFile, error) {
+	if s.journal {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(s.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	var files []LeaseFile
+	for _, e := range entries {
+		ip := parseIPFileName(e.Name())
+		if e.IsDir() || ip == nil {
+			continue
+		}
+		content, ok := s.readLease(GetEscapedPath(s.dataDir, e.Name()))
+		if !ok {
+			continue
+		}
+		id, ifname, _ := strings.Cut(content, LineBreak)
+		files = append(files, LeaseFile{
+			Lease: Lease{IP: ip.String(), ID: strings.TrimSpace(id), IfName: ifname},
+			Name:  e.Name(),
+		})
+	}
+	return files, nil
+}
+
+// RemoveLeaseFile removes a lease file returned by LeaseFiles. The store
+// must be locked.
+func (s *Store) RemoveLeaseFile(name string) error {
+	return os.Remove(GetEscapedPath(s.dataDir, name))
+}
+
+// LastReservedIPs returns the last reserved addresses of the store, by the
+// ID of their range set. The store must be locked.
+func (s *Store) LastReservedIPs() (map[string]net.IP, error) {
+	entries, err := os.ReadDir(s.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	ips := map[string]net.IP{}
+	for _, e := range entries {
+		rangeID, ok := strings.CutPrefix(e.Name(), lastIPFilePrefix)
+		if e.IsDir() || !ok || strings.HasSuffix(rangeID, ".tmp") {
+			continue
+		}
+		data, err := os.ReadFile(GetEscapedPath(s.dataDir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		ips[rangeID] = net.ParseIP(string(data))
+	}
+	return ips, nil
+}
+
+// RemoveLastReservedIP forgets the last reserved address of a range set,
+// whose allocations then start over from the beginning of the set. The
+// store must be locked.
+func (s *Store) RemoveLastReservedIP(rangeID string) error {
+	err := os.Remove(GetEscapedPath(s.dataDir, lastIPFilePrefix+rangeID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,131 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+const expiryFile = "expiries.json"
+
+// Expiry records when the lease of an address of an attachment expires.
+// File is the expiry file written for the attachment, if any.
+type Expiry struct {
+	IP     string    `json:"ip"`
+	ID     string    `json:"id"`
+	IfName string    `json:"ifname"`
+	Until  time.Time `json:"until"`
+	File   string    `json:"file,omitempty"`
+}
+
+// SetExpiries records the expiries, replacing earlier ones of their
+// addresses. The store must be locked.
+func (s *Store) SetExpiries(expiries []Expiry) error {
+	set := map[string]bool{}
+	for i := range expiries {
+		expiries[i].ID = strings.TrimSpace(expiries[i].ID)
+		set[expiries[i].IP] = true
+	}
+	current, err := s.readExpiries()
+	if err != nil {
+		return err
+	}
+	kept := []Expiry{}
+	for _, e := range current {
+		if !set[e.IP] {
+			kept = append(kept, e)
+		}
+	}
+	kept = append(kept, expiries...)
+	return s.writeRecords(expiryFile, kept, len(kept))
+}
+
+// ExpiriesOf returns the expiries of the leases of the attachment. The
+// store must be locked.
+func (s *Store) ExpiriesOf(id, ifname string) ([]Expiry, error) {
+	current, err := s.readExpiries()
+	if err != nil {
+		return nil, err
+	}
+	id = strings.TrimSpace(id)
+	expiries := []Expiry{}
+	for _, e := range current {
+		if e.ID == id && e.IfName == ifname {
+			expiries = append(expiries, e)
+		}
+	}
+	return expiries, nil
+}
+
+// DropExpiries forgets the expiries of the attachment, e.g. on its DEL, and
+// returns them. The store must be locked.
+func (s *Store) DropExpiries(id, ifname string) ([]Expiry, error) {
+	current, err := s.readExpiries()
+	if err != nil {
+		return nil, err
+	}
+	id = strings.TrimSpace(id)
+	kept, dropped := []Expiry{}, []Expiry{}
+	for _, e := range current {
+		if e.ID == id && e.IfName == ifname {
+			dropped = append(dropped, e)
+		} else {
+			kept = append(kept, e)
+		}
+	}
+	if len(dropped) == 0 {
+		return nil, nil
+	}
+	return dropped, s.writeRecords(expiryFile, kept, len(kept))
+}
+
+// ReclaimExpired releases the addresses whose leases expired by now, unless
+// they were released and allocated to another attachment since, and
+// returns the expiries of the addresses released. The store must be locked.
+func (s *Store) ReclaimExpired(now time.Time) ([]Expiry, error) {
+	expiries, err := s.readExpiries()
+	if err != nil {
+		return nil, err
+	}
+	kept, reclaimed := []Expiry{}, []Expiry{}
+	for _, e := range expiries {
+		if e.Until.After(now) {
+			kept = append(kept, e)
+			continue
+		}
+		ip := net.ParseIP(e.IP)
+		for _, held := range s.GetByID(e.ID, e.IfName) {
+			if held.Equal(ip) {
+				if _, err := s.ReleaseByIP(ip); err != nil {
+					return reclaimed, err
+				}
+				reclaimed = append(reclaimed, e)
+				break
+			}
+		}
+	}
+	if len(kept) == len(expiries) {
+		return nil, nil
+	}
+	return reclaimed, s.writeRecords(expiryFile, kept, len(kept))
+}
+
+func (s *Store) readExpiries() ([]Expiry, error) {
+	var expiries []Expiry
+	err := s.readRecords(expiryFile, &expiries)
+	return expiries, err
+}
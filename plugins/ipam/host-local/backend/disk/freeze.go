@@ -0,0 +1,51 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"os"
+	"time"
+)
+
+const freezeFile = "frozen.json"
+
+// Freeze records that no new addresses are allocated from the store, e.g.
+// while it is backed up or migrated during a node drain. Releases go on.
+type Freeze struct {
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// Freeze stops allocations from the store until Thaw. The store must be
+// locked.
+func (s *Store) Freeze(reason string) error {
+	return s.writeRecords(freezeFile, Freeze{Reason: reason, Since: time.Now().UTC()}, 1)
+}
+
+// Thaw resumes allocations from the store. The store must be locked.
+func (s *Store) Thaw() error {
+	return s.writeRecords(freezeFile, nil, 0)
+}
+
+// Frozen returns the freeze of the store, if it is frozen. A freeze record
+// which can't be read still freezes the store. The store must be locked.
+func (s *Store) Frozen() (Freeze, bool) {
+	if _, err := os.Stat(GetEscapedPath(s.dataDir, freezeFile)); err != nil {
+		return Freeze{}, false
+	}
+	var f Freeze
+	_ = s.readRecords(freezeFile, &f)
+	return f, true
+}
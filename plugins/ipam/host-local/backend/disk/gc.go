@@ -0,0 +1,64 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"os"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// Attachments returns the attachments holding a lease in the store, on
+// allocated or on handed over addresses. Allocations which predate
+// per-interface tracking have an empty IfName. The store must be locked.
+func (s *Store) Attachments() ([]types.GCAttachment, error) {
+	var attachments []types.GCAttachment
+	if s.journal {
+		st, err := s.loadJournal()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range st.ips {
+			attachments = append(attachments, types.GCAttachment{ContainerID: a.id, IfName: a.ifname})
+		}
+	} else {
+		entries, err := os.ReadDir(s.dataDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.IsDir() || parseIPFileName(e.Name()) == nil {
+				continue
+			}
+			// leases failing verification are left to "host-local verify"
+			content, ok := s.readLease(GetEscapedPath(s.dataDir, e.Name()))
+			if !ok {
+				continue
+			}
+			id, ifname, _ := strings.Cut(content, LineBreak)
+			attachments = append(attachments, types.GCAttachment{ContainerID: strings.TrimSpace(id), IfName: ifname})
+		}
+	}
+
+	handovers, err := s.readHandovers()
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range handovers {
+		attachments = append(attachments, types.GCAttachment{ContainerID: h.ID, IfName: h.IfName})
+	}
+	return attachments, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+const handoverFile = "handovers.json"
+
+// Handover is the lease an attachment keeps on an address that was handed
+// over to a new container of the same pod, until its DEL or the deadline.
+type Handover struct {
+	IP     string    `json:"ip"`
+	ID     string    `json:"id"`
+	IfName string    `json:"ifname,omitempty"`
+	Until  time.Time `json:"until"`
+}
+
+func (h Handover) matches(id, ifname string) bool {
+	return h.ID == strings.TrimSpace(id) && (h.IfName == "" || h.IfName == ifname)
+}
+
+// HolderOf returns the container ID and interface ip is allocated to. The
+// interface is empty for allocations which predate per-interface tracking.
+// The store must be locked.
+func (s *Store) HolderOf(ip net.IP) (string, string, bool) {
+	if s.journal {
+		st, err := s.loadJournal()
+		if err != nil {
+			return "", "", false
+		}
+		a, ok := st.ips[ip.String()]
+		return a.id, a.ifname, ok
+	}
+
+	content, ok := s.readLease(GetEscapedPath(s.dataDir, ip.String()))
+	if !ok {
+		return "", "", false
+	}
+	id, ifname, _ := strings.Cut(content, LineBreak)
+	return strings.TrimSpace(id), ifname, true
+}
+
+// AddHandover records that the attachment keeps its lease on the address
+// until h.Until. The store must be locked.
+func (s *Store) AddHandover(h Handover) error {
+	current, err := s.readHandovers()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	handovers := []Handover{}
+	for _, o := range current {
+		if o.Until.After(now) && !(o.IP == h.IP && o.matches(h.ID, h.IfName)) {
+			handovers = append(handovers, o)
+		}
+	}
+	return s.writeHandovers(append(handovers, h))
+}
+
+// HandedOver returns true if the attachment still has the lease on an
+// address handed over to another container. The store must be locked.
+func (s *Store) HandedOver(id, ifname string) (bool, error) {
+	handovers, err := s.readHandovers()
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	for _, h := range handovers {
+		if h.matches(id, ifname) && h.Until.After(now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ReleaseHandover ends the leases of the attachment on handed over
+// addresses, and drops expired ones. The addresses themselves stay with
+// the containers they were handed over to. The store must be locked.
+func (s *Store) ReleaseHandover(id, ifname string) error {
+	all, err := s.readHandovers()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	handovers := []Handover{}
+	for _, h := range all {
+		if h.Until.After(now) && !h.matches(id, ifname) {
+			handovers = append(handovers, h)
+		}
+	}
+	if len(handovers) == len(all) {
+		return nil
+	}
+	return s.writeHandovers(handovers)
+}
+
+func (s *Store) readHandovers() ([]Handover, error) {
+	var handovers []Handover
+	err := s.readRecords(handoverFile, &handovers)
+	return handovers, err
+}
+
+func (s *Store) writeHandovers(handovers []Handover) error {
+	return s.writeRecords(handoverFile, handovers, len(handovers))
+}
@@ -0,0 +1,228 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Lease files of a store with a key either end in a signature line, or are
+// encrypted, which authenticates them as well. Both cover the file name, so
+// a lease can't be moved to another address either.
+const (
+	signaturePrefix = "hmac-sha256:"
+	encryptedPrefix = "aes-gcm:"
+
+	// MinKeySize is the minimum size of the node key
+	MinKeySize = 32
+)
+
+type integrity struct {
+	macKey  []byte
+	aead    cipher.AEAD
+	encrypt bool
+}
+
+// LoadKey reads the node key from file.
+func LoadKey(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %v", err)
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) < MinKeySize {
+		return nil, fmt.Errorf("key in %s is too short, it needs at least %d bytes", file, MinKeySize)
+	}
+	return key, nil
+}
+
+// SetKey makes the store sign the lease files it writes with key, or
+// encrypt them if encrypt is set, and ignore lease files which fail
+// verification. Their addresses stay reserved, as they can't be attributed
+// to any container; Verify reports them.
+func (s *Store) SetKey(key []byte, encrypt bool) error {
+	if s.journal {
+		return errors.New("integrity is not supported with the journal format")
+	}
+	block, err := aes.NewCipher(deriveKey(key, "host-local lease encryption"))
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	s.integrity = &integrity{
+		macKey:  deriveKey(key, "host-local lease signing"),
+		aead:    aead,
+		encrypt: encrypt,
+	}
+	return nil
+}
+
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func (in *integrity) sign(name, content string) string {
+	mac := hmac.New(sha256.New, in.macKey)
+	mac.Write([]byte(name + "\x00" + content))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// encodeLease returns the data of the lease file of the address name.
+func (s *Store) encodeLease(name, content string) ([]byte, error) {
+	in := s.integrity
+	if in == nil {
+		return []byte(content), nil
+	}
+	if !in.encrypt {
+		return []byte(content + LineBreak + signaturePrefix + in.sign(name, content)), nil
+	}
+	nonce := make([]byte, in.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := in.aead.Seal(nonce, nonce, []byte(content), []byte(name))
+	return []byte(encryptedPrefix + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// decodeLease returns the content of the lease file of the address name.
+func (s *Store) decodeLease(name string, data []byte) (string, error) {
+	in := s.integrity
+	if in == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	text := strings.TrimSpace(string(data))
+	if sealed, ok := strings.CutPrefix(text, encryptedPrefix); ok {
+		raw, err := base64.StdEncoding.DecodeString(sealed)
+		if err != nil || len(raw) < in.aead.NonceSize() {
+			return "", errors.New("malformed encrypted lease")
+		}
+		nonce, ciphertext := raw[:in.aead.NonceSize()], raw[in.aead.NonceSize():]
+		content, err := in.aead.Open(nil, nonce, ciphertext, []byte(name))
+		if err != nil {
+			return "", errors.New("decryption failed")
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+
+	idx := strings.LastIndex(text, LineBreak+signaturePrefix)
+	if idx < 0 {
+		return "", errors.New("not signed")
+	}
+	content, sig := text[:idx], text[idx+len(LineBreak+signaturePrefix):]
+	if !hmac.Equal([]byte(sig), []byte(in.sign(name, content))) {
+		return "", errors.New("signature mismatch")
+	}
+	return strings.TrimSpace(content), nil
+}
+
+// readLease returns the content of the lease file at path, and false if it
+// isn't a lease file or fails verification.
+func (s *Store) readLease(path string) (string, bool) {
+	name := ""
+	if ip := parseIPFileName(filepath.Base(path)); ip != nil {
+		name = ip.String()
+	} else if s.integrity != nil {
+		return "", false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	content, err := s.decodeLease(name, data)
+	return content, err == nil
+}
+
+// VerifyFailure is a lease file which failed verification.
+type VerifyFailure struct {
+	File   string `json:"file"`
+	Reason string `json:"reason"`
+}
+
+// Verify checks all lease files against the key, and returns the ones
+// which fail. With sign set, lease files without a signature, e.g. written
+// before the key was set, are signed instead. The store must be locked.
+func (s *Store) Verify(sign bool) ([]VerifyFailure, error) {
+	if s.integrity == nil {
+		return nil, errors.New("no key is set")
+	}
+	entries, err := os.ReadDir(s.dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	failures := []VerifyFailure{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		ip := parseIPFileName(e.Name())
+		if ip == nil {
+			continue
+		}
+		path := filepath.Join(s.dataDir, e.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		_, err = s.decodeLease(ip.String(), data)
+		if err == nil {
+			continue
+		}
+		text := strings.TrimSpace(string(data))
+		if sign && !strings.HasPrefix(text, encryptedPrefix) && !strings.Contains(text, signaturePrefix) {
+			if err := s.rewriteLease(path, ip.String(), text); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		failures = append(failures, VerifyFailure{File: e.Name(), Reason: err.Error()})
+	}
+	return failures, nil
+}
+
+// rewriteLease replaces the lease file at path atomically.
+func (s *Store) rewriteLease(path, name, content string) error {
+	data, err := s.encodeLease(name, content)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store integrity", func() {
+	var dir string
+	key := []byte(strings.Repeat("k", MinKeySize))
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	newStore := func(encrypt bool) *Store {
+		s, err := New("net", dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.SetKey(key, encrypt)).To(Succeed())
+		Expect(s.Lock()).To(Succeed())
+		DeferCleanup(func() {
+			s.Unlock()
+			s.Close()
+		})
+		return s
+	}
+	leaseFile := func(ip string) string {
+		return filepath.Join(dir, "net", ip)
+	}
+
+	DescribeTable("ignores tampered lease files", func(encrypt bool) {
+		s := newStore(encrypt)
+		for _, ip := range []string{"10.0.0.2", "10.0.0.3"} {
+			reserved, err := s.Reserve("c1", "eth0", net.ParseIP(ip), "0")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+		}
+		data, err := os.ReadFile(leaseFile("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(strings.Contains(string(data), "c1")).To(Equal(!encrypt))
+		Expect(s.GetByID("c1", "eth0")).To(HaveLen(2))
+
+		// a lease copied to another address doesn't verify
+		Expect(os.WriteFile(leaseFile("10.0.0.3"), data, 0o600)).To(Succeed())
+		Expect(s.GetByID("c1", "eth0")).To(Equal([]net.IP{net.ParseIP("10.0.0.2")}))
+
+		failures, err := s.Verify(false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(failures).To(HaveLen(1))
+		Expect(failures[0].File).To(Equal("10.0.0.3"))
+
+		// the address stays reserved
+		reserved, err := s.Reserve("c2", "eth0", net.ParseIP("10.0.0.3"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeFalse())
+	},
+		Entry("signed", false),
+		Entry("encrypted", true),
+	)
+
+	It("detects a forged container ID", func() {
+		s := newStore(false)
+		_, err := s.Reserve("c1", "eth0", net.ParseIP("10.0.0.2"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		data, err := os.ReadFile(leaseFile("10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		forged := strings.Replace(string(data), "c1", "c2", 1)
+		Expect(os.WriteFile(leaseFile("10.0.0.2"), []byte(forged), 0o600)).To(Succeed())
+
+		Expect(s.GetByID("c2", "eth0")).To(BeEmpty())
+		Expect(s.ReleaseByID("c2", "eth0")).To(Succeed())
+		Expect(leaseFile("10.0.0.2")).To(BeAnExistingFile())
+
+		failures, err := s.Verify(false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(failures).To(Equal([]VerifyFailure{{File: "10.0.0.2", Reason: "signature mismatch"}}))
+	})
+
+	It("signs lease files written without a key", func() {
+		s, err := New("net", dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Lock()).To(Succeed())
+		_, err = s.Reserve("c1", "eth0", net.ParseIP("10.0.0.2"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Unlock()).To(Succeed())
+		s.Close()
+
+		s = newStore(false)
+		failures, err := s.Verify(false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(failures).To(Equal([]VerifyFailure{{File: "10.0.0.2", Reason: "not signed"}}))
+
+		failures, err = s.Verify(true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(failures).To(BeEmpty())
+		Expect(s.GetByID("c1", "eth0")).To(HaveLen(1))
+	})
+
+	It("is not supported with the journal format", func() {
+		s, err := NewJournal("net", dir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.SetKey(key, false)).To(MatchError("integrity is not supported with the journal format"))
+	})
+})
@@ -0,0 +1,519 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The journal layout keeps all allocations of a network in a single
+// append-only file instead of one file per IP. Every change appends a
+// record; the file is rewritten from the current state once it holds
+// mostly stale records.
+const (
+	journalFile = "allocations.journal"
+
+	journalOpReserve = "reserve"
+	journalOpRelease = "release"
+	journalOpPod     = "pod"
+	journalOpUnpod   = "unpod"
+
+	// compactMinRecords is the journal size below which it is never
+	// compacted
+	compactMinRecords = 512
+)
+
+// Formats of the store on disk.
+const (
+	// FormatFiles keeps one file per allocated IP
+	FormatFiles = "files"
+	// FormatJournal keeps all allocations in a single journal file
+	FormatJournal = "journal"
+)
+
+type journalRecord struct {
+	Op      string `json:"op"`
+	IP      string `json:"ip"`
+	ID      string `json:"id,omitempty"`
+	IfName  string `json:"ifname,omitempty"`
+	PodNs   string `json:"podNs,omitempty"`
+	PodName string `json:"podName,omitempty"`
+}
+
+type journalAllocation struct {
+	id     string
+	ifname string // empty for allocations which predate per-interface tracking
+}
+
+type journalPod struct {
+	ns   string
+	name string
+}
+
+// journalState is the content of the journal, replayed in memory.
+type journalState struct {
+	ips  map[string]journalAllocation
+	pods map[string]journalPod
+
+	// records is the number of records in the journal file
+	records int
+	// needsCompaction is set if the journal is damaged or files of the old
+	// layout were imported, which a compaction cleans up
+	needsCompaction bool
+	// legacyFiles are the files of the old layout read into the state
+	legacyFiles []string
+}
+
+// NewJournal opens the store of network like New, using the journal format
+// for it from now on. Allocations made in the one-file-per-IP format are
+// taken over on the first write.
+func NewJournal(network, dataDir string) (*Store, error) {
+	s, err := New(network, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if !s.journal {
+		f, err := os.OpenFile(s.journalPath(), os.O_WRONLY|os.O_CREATE, 0o600)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		f.Close()
+		s.journal = true
+	}
+	return s, nil
+}
+
+// Format returns the format of the store, FormatFiles or FormatJournal.
+func (s *Store) Format() string {
+	if s.journal {
+		return FormatJournal
+	}
+	return FormatFiles
+}
+
+func (s *Store) journalPath() string {
+	return GetEscapedPath(s.dataDir, journalFile)
+}
+
+// loadJournal returns the replayed journal. The state is cached while the
+// store is locked, other processes can't change it in the meantime.
+func (s *Store) loadJournal() (*journalState, error) {
+	if s.state != nil {
+		return s.state, nil
+	}
+
+	st := &journalState{
+		ips:  map[string]journalAllocation{},
+		pods: map[string]journalPod{},
+	}
+	if err := st.importLegacy(s.dataDir); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(s.journalPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		// the last append was cut short
+		st.needsCompaction = true
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		rec := journalRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			st.needsCompaction = true
+			continue
+		}
+		st.apply(rec)
+		st.records++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", s.journalPath(), err)
+	}
+
+	if s.locked {
+		s.state = st
+		if st.needsCompaction {
+			if err := s.compactJournal(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return st, nil
+}
+
+// importLegacy reads the allocation and pod files of the one-file-per-IP
+// layout.
+func (st *journalState) importLegacy(dataDir string) error {
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if ip := parseIPFileName(e.Name()); ip != nil {
+			data, err := os.ReadFile(GetEscapedPath(dataDir, e.Name()))
+			if err != nil {
+				continue
+			}
+			id, ifname, _ := strings.Cut(strings.TrimSpace(string(data)), LineBreak)
+			st.ips[ip.String()] = journalAllocation{id: strings.TrimSpace(id), ifname: ifname}
+		} else if ipStr, ns, name := resolvePodFileName(e.Name()); net.ParseIP(ipStr) != nil {
+			st.pods[net.ParseIP(ipStr).String()] = journalPod{ns: ns, name: name}
+		} else {
+			continue
+		}
+		st.legacyFiles = append(st.legacyFiles, GetEscapedPath(dataDir, e.Name()))
+		st.needsCompaction = true
+	}
+	return nil
+}
+
+func (st *journalState) apply(rec journalRecord) {
+	switch rec.Op {
+	case journalOpReserve:
+		st.ips[rec.IP] = journalAllocation{id: rec.ID, ifname: rec.IfName}
+	case journalOpRelease:
+		delete(st.ips, rec.IP)
+	case journalOpPod:
+		st.pods[rec.IP] = journalPod{ns: rec.PodNs, name: rec.PodName}
+	case journalOpUnpod:
+		delete(st.pods, rec.IP)
+	}
+}
+
+// snapshot returns the records which recreate the current state.
+func (st *journalState) snapshot() []journalRecord {
+	recs := make([]journalRecord, 0, len(st.ips)+len(st.pods))
+	for ip, a := range st.ips {
+		recs = append(recs, journalRecord{Op: journalOpReserve, IP: ip, ID: a.id, IfName: a.ifname})
+	}
+	for ip, p := range st.pods {
+		recs = append(recs, journalRecord{Op: journalOpPod, IP: ip, PodNs: p.ns, PodName: p.name})
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		if recs[i].IP != recs[j].IP {
+			return recs[i].IP < recs[j].IP
+		}
+		return recs[i].Op < recs[j].Op
+	})
+	return recs
+}
+
+func (a journalAllocation) matches(id, ifname string) bool {
+	return a.id == strings.TrimSpace(id) && (a.ifname == "" || a.ifname == ifname)
+}
+
+func encodeRecords(recs []journalRecord) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// appendJournal applies recs to the state and appends them to the journal.
+// It must be called with the store locked.
+func (s *Store) appendJournal(recs ...journalRecord) error {
+	st, err := s.loadJournal()
+	if err != nil {
+		return err
+	}
+	if s.wb != nil {
+		// written in a batch with the other pending changes
+		for _, rec := range recs {
+			st.apply(rec)
+		}
+		st.records += len(recs)
+		s.wb.records = append(s.wb.records, recs...)
+		return nil
+	}
+
+	data, err := encodeRecords(recs)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.journalPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	for _, rec := range recs {
+		st.apply(rec)
+	}
+	st.records += len(recs)
+
+	if st.records >= compactMinRecords && st.records > 2*(len(st.ips)+len(st.pods)) {
+		return s.compactJournal()
+	}
+	return nil
+}
+
+// compactJournal replaces the journal with a snapshot of the state and
+// removes files of the old layout which were taken over. It must be called
+// with the store locked.
+func (s *Store) compactJournal() error {
+	st := s.state
+	recs := st.snapshot()
+	data, err := encodeRecords(recs)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.journalPath() + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	// the rename must not become visible before the data
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, s.journalPath()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	st.records = len(recs)
+	st.needsCompaction = false
+
+	for _, path := range st.legacyFiles {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	st.legacyFiles = nil
+	return nil
+}
+
+// CompactJournal rewrites the journal from the current allocations. It is
+// done automatically once most records are stale, so this is only needed
+// to reclaim space right away.
+func (s *Store) CompactJournal() error {
+	if !s.journal {
+		return fmt.Errorf("store %s is not in journal format", s.dataDir)
+	}
+	if _, err := s.loadJournal(); err != nil {
+		return err
+	}
+	if s.state == nil {
+		return fmt.Errorf("store must be locked for compaction")
+	}
+	return s.compactJournal()
+}
+
+func (s *Store) journalReserve(id, ifname string, ip net.IP) (bool, error) {
+	st, err := s.loadJournal()
+	if err != nil {
+		return false, err
+	}
+	if _, ok := st.ips[ip.String()]; ok {
+		return false, nil
+	}
+	rec := journalRecord{Op: journalOpReserve, IP: ip.String(), ID: strings.TrimSpace(id), IfName: ifname}
+	if err := s.appendJournal(rec); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Store) journalFindByID(id, ifname string) bool {
+	st, err := s.loadJournal()
+	if err != nil {
+		return false
+	}
+	for _, a := range st.ips {
+		if a.matches(id, ifname) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Store) journalReleaseByID(id, ifname string) error {
+	st, err := s.loadJournal()
+	if err != nil {
+		return err
+	}
+	var recs []journalRecord
+	for ip, a := range st.ips {
+		if a.matches(id, ifname) {
+			recs = append(recs, journalRecord{Op: journalOpRelease, IP: ip})
+		}
+	}
+	if len(recs) == 0 {
+		return nil
+	}
+	return s.appendJournal(recs...)
+}
+
+func (s *Store) journalReleaseByIP(ip net.IP) (bool, error) {
+	st, err := s.loadJournal()
+	if err != nil {
+		return false, err
+	}
+	key := ip.String()
+	_, found := st.ips[key]
+	var recs []journalRecord
+	if found {
+		recs = append(recs, journalRecord{Op: journalOpRelease, IP: key})
+	}
+	if _, ok := st.pods[key]; ok {
+		recs = append(recs, journalRecord{Op: journalOpUnpod, IP: key})
+	}
+	if len(recs) == 0 {
+		return false, nil
+	}
+	return found, s.appendJournal(recs...)
+}
+
+func (s *Store) journalReleaseByPod(podNs, podName string) ([]net.IP, error) {
+	st, err := s.loadJournal()
+	if err != nil {
+		return nil, err
+	}
+	var released []net.IP
+	var recs []journalRecord
+	for ip, p := range st.pods {
+		if p.ns != podNs || p.name != podName {
+			continue
+		}
+		recs = append(recs, journalRecord{Op: journalOpRelease, IP: ip}, journalRecord{Op: journalOpUnpod, IP: ip})
+		released = append(released, net.ParseIP(ip))
+	}
+	if len(recs) == 0 {
+		return nil, nil
+	}
+	sort.Slice(released, func(i, j int) bool { return bytes.Compare(released[i], released[j]) < 0 })
+	return released, s.appendJournal(recs...)
+}
+
+func (s *Store) journalGetByID(id, ifname string) []net.IP {
+	st, err := s.loadJournal()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for ip, a := range st.ips {
+		if a.matches(id, ifname) {
+			ips = append(ips, net.ParseIP(ip))
+		}
+	}
+	return ips
+}
+
+func (s *Store) journalGetByContainer(id string) []net.IP {
+	st, err := s.loadJournal()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for ip, a := range st.ips {
+		if a.id == strings.TrimSpace(id) {
+			ips = append(ips, net.ParseIP(ip))
+		}
+	}
+	return ips
+}
+
+func (s *Store) journalHasReservedIP(podNs, podName string) (bool, net.IP) {
+	st, err := s.loadJournal()
+	if err != nil {
+		return false, net.IP{}
+	}
+	// like the pod files, a reservation is only used if it is unambiguous
+	var found net.IP
+	for ip, p := range st.pods {
+		if p.ns == podNs && p.name == podName {
+			if found != nil {
+				return false, net.IP{}
+			}
+			found = net.ParseIP(ip)
+		}
+	}
+	if found == nil {
+		return false, net.IP{}
+	}
+	return true, found
+}
+
+func (s *Store) journalPodIPs() (map[string][]net.IP, error) {
+	st, err := s.loadJournal()
+	if err != nil {
+		return nil, err
+	}
+	pods := map[string][]net.IP{}
+	for ip, p := range st.pods {
+		pods[p.ns+"/"+p.name] = append(pods[p.ns+"/"+p.name], net.ParseIP(ip))
+	}
+	return pods, nil
+}
+
+func (s *Store) journalReservePodInfo(id string, ip net.IP, podNs, podName string, podIPIsExist bool) (bool, error) {
+	if podIPIsExist {
+		err := s.appendJournal(journalRecord{Op: journalOpReserve, IP: ip.String(), ID: strings.TrimSpace(id)})
+		return err == nil, err
+	}
+	if len(podName) != 0 {
+		err := s.appendJournal(journalRecord{Op: journalOpPod, IP: ip.String(), PodNs: podNs, PodName: podName})
+		return err == nil, err
+	}
+	return true, nil
+}
+
+func (s *Store) journalAllocations() ([]net.IP, error) {
+	st, err := s.loadJournal()
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(st.ips))
+	for ip := range st.ips {
+		ips = append(ips, net.ParseIP(ip))
+	}
+	return ips, nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Journal store", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	journalLines := func() int {
+		data, err := os.ReadFile(filepath.Join(dir, "net", journalFile))
+		Expect(err).ToNot(HaveOccurred())
+		return bytes.Count(data, []byte("\n"))
+	}
+
+	It("keeps allocations in a single file", func() {
+		s, err := NewJournal("net", dir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Format()).To(Equal(FormatJournal))
+
+		Expect(s.Lock()).To(Succeed())
+		reserved, err := s.Reserve("c1", "eth0", net.ParseIP("10.0.0.2"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+		reserved, err = s.Reserve("c2", "eth0", net.ParseIP("10.0.0.2"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeFalse())
+		_, err = s.ReservePodInfo("c1", net.ParseIP("10.0.0.2"), "ns", "pod", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Unlock()).To(Succeed())
+
+		Expect(filepath.Join(dir, "net", "10.0.0.2")).NotTo(BeAnExistingFile())
+
+		// a new process sees the allocations
+		s2, err := New("net", dir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s2.Close()
+		Expect(s2.Format()).To(Equal(FormatJournal))
+		Expect(s2.Lock()).To(Succeed())
+		Expect(s2.GetByID("c1", "eth0")).To(Equal([]net.IP{net.ParseIP("10.0.0.2")}))
+		found, ip := s2.HasReservedIP("ns", "pod")
+		Expect(found).To(BeTrue())
+		Expect(ip.String()).To(Equal("10.0.0.2"))
+		last, err := s2.LastReservedIP("0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("10.0.0.2"))
+
+		Expect(s2.ReleaseByID("c1", "eth0")).To(Succeed())
+		Expect(s2.GetByID("c1", "eth0")).To(BeEmpty())
+		Expect(s2.Unlock()).To(Succeed())
+	})
+
+	It("takes over allocations of the one-file-per-IP layout", func() {
+		s, err := New("net", dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Lock()).To(Succeed())
+		_, err = s.Reserve("c1", "eth0", net.ParseIP("10.0.0.2"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = s.ReservePodInfo("c1", net.ParseIP("10.0.0.2"), "ns", "pod", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Unlock()).To(Succeed())
+		s.Close()
+		Expect(filepath.Join(dir, "net", "10.0.0.2")).To(BeAnExistingFile())
+
+		s, err = NewJournal("net", dir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Lock()).To(Succeed())
+		Expect(s.GetByID("c1", "eth0")).To(Equal([]net.IP{net.ParseIP("10.0.0.2")}))
+		found, _ := s.HasReservedIP("ns", "pod")
+		Expect(found).To(BeTrue())
+		Expect(s.Unlock()).To(Succeed())
+
+		Expect(filepath.Join(dir, "net", "10.0.0.2")).NotTo(BeAnExistingFile())
+		Expect(filepath.Join(dir, "net", "10.0.0.2_ns_pod")).NotTo(BeAnExistingFile())
+		Expect(journalLines()).To(Equal(2))
+	})
+
+	It("compacts the journal once most records are stale", func() {
+		s, err := NewJournal("net", dir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+
+		Expect(s.Lock()).To(Succeed())
+		_, err = s.Reserve("keep", "eth0", net.ParseIP("10.0.0.1"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		for i := 0; i < compactMinRecords; i++ {
+			_, err = s.Reserve("c1", "eth0", net.ParseIP("10.0.0.2"), "0")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.ReleaseByID("c1", "eth0")).To(Succeed())
+		}
+		Expect(s.Unlock()).To(Succeed())
+
+		Expect(journalLines()).To(BeNumerically("<", compactMinRecords))
+		Expect(s.Lock()).To(Succeed())
+		Expect(s.GetByID("keep", "eth0")).To(HaveLen(1))
+		Expect(s.GetByID("c1", "eth0")).To(BeEmpty())
+		Expect(s.Unlock()).To(Succeed())
+	})
+
+	It("recovers from a torn append", func() {
+		s, err := NewJournal("net", dir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Lock()).To(Succeed())
+		_, err = s.Reserve("c1", "eth0", net.ParseIP("10.0.0.2"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Unlock()).To(Succeed())
+
+		f, err := os.OpenFile(filepath.Join(dir, "net", journalFile), os.O_WRONLY|os.O_APPEND, 0)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.WriteString(`{"op":"reserve","ip":"10.0`)
+		Expect(err).ToNot(HaveOccurred())
+		f.Close()
+
+		Expect(s.Lock()).To(Succeed())
+		_, err = s.Reserve("c2", "eth0", net.ParseIP("10.0.0.3"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Unlock()).To(Succeed())
+
+		Expect(journalLines()).To(Equal(2))
+		Expect(s.Lock()).To(Succeed())
+		Expect(s.GetByID("c1", "eth0")).To(HaveLen(1))
+		Expect(s.GetByID("c2", "eth0")).To(HaveLen(1))
+		Expect(s.Unlock()).To(Succeed())
+	})
+})
@@ -0,0 +1,108 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/selinux/go-selinux"
+)
+
+// preflightFile is created, renamed and removed by Preflight
+const preflightFile = ".preflight"
+
+// SetLabel labels the store, and its snapshots, with the SELinux context
+// label, unless the store is labeled so already. The files created in them
+// later inherit the label of their directory, so processes whose policy
+// only allows them e.g. container files, such as node agents reading the
+// store on RHEL edge or Fedora CoreOS, keep access to it. It does nothing
+// where SELinux is disabled.
+func (s *Store) SetLabel(label string) error {
+	s.label = label
+	if label == "" || !selinux.GetEnabled() {
+		return nil
+	}
+	for _, dir := range []string{s.dataDir, s.snapshots()} {
+		if current, err := selinux.FileLabel(dir); err == nil && current == label {
+			continue
+		} else if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err := selinux.Chcon(dir, label, true); err != nil {
+			return fmt.Errorf("failed to label %s as %s: %v", dir, label, err)
+		}
+	}
+	return nil
+}
+
+// Preflight returns the conflicts of the store with the security policy
+// of the node: the file operations of the store it denies and, with a
+// label set, the files of the store labeled otherwise. The store must be
+// locked.
+func (s *Store) Preflight() []string {
+	var conflicts []string
+	denied := func(op string, err error) {
+		if errors.Is(err, os.ErrPermission) {
+			conflicts = append(conflicts, fmt.Sprintf("%s in %s denied%s: %v", op, s.dataDir, confinement(), err))
+		}
+	}
+
+	probe := filepath.Join(s.dataDir, preflightFile)
+	if err := os.WriteFile(probe, nil, 0o600); err != nil {
+		denied("creating files", err)
+	} else {
+		if err := os.Rename(probe, probe+".tmp"); err != nil {
+			denied("renaming files", err)
+		} else {
+			probe += ".tmp"
+		}
+		if err := os.Remove(probe); err != nil {
+			denied("removing files", err)
+		}
+	}
+
+	if s.label == "" || !selinux.GetEnabled() {
+		return conflicts
+	}
+	_ = filepath.WalkDir(s.dataDir, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if label, err := selinux.FileLabel(path); err == nil && label != s.label {
+			conflicts = append(conflicts, fmt.Sprintf("%s is labeled %s instead of %s", path, label, s.label))
+		}
+		return nil
+	})
+	return conflicts
+}
+
+// confinement describes the LSM context of the process, SELinux or
+// AppArmor, if it is confined.
+func confinement() string {
+	data, err := os.ReadFile("/proc/self/attr/current")
+	if err != nil {
+		return ""
+	}
+	current := strings.TrimRight(string(data), "\x00\n")
+	if current == "" || current == "unconfined" {
+		return ""
+	}
+	return " for " + current
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/selinux/go-selinux"
+)
+
+var _ = Describe("Store labels", func() {
+	var dir string
+	var s *Store
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "")
+		Expect(err).ToNot(HaveOccurred())
+		s, err = New("net", dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Lock()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(s.Unlock()).To(Succeed())
+		s.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("finds no conflicts and leaves no files behind in a writable store", func() {
+		_, err := s.Reserve("c1", "eth0", net.ParseIP("10.0.0.2"), "0")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(s.Preflight()).To(BeEmpty())
+		entries, err := os.ReadDir(filepath.Join(dir, "net"))
+		Expect(err).ToNot(HaveOccurred())
+		for _, e := range entries {
+			Expect(e.Name()).NotTo(HavePrefix(preflightFile))
+		}
+		Expect(s.GetByID("c1", "eth0")).To(Equal([]net.IP{net.ParseIP("10.0.0.2")}))
+	})
+
+	It("leaves the store alone without SELinux", func() {
+		if selinux.GetEnabled() {
+			Skip("SELinux is enabled")
+		}
+		Expect(s.SetLabel("system_u:object_r:container_file_t:s0")).To(Succeed())
+		Expect(s.Preflight()).To(BeEmpty())
+	})
+})
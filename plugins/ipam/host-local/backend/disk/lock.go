@@ -54,6 +54,16 @@ func (l *FileLock) Lock() error {
 	return l.f.Lock()
 }
 
+// TryLock acquires the exclusive lock unless someone else holds it, and
+// reports whether it did
+func (l *FileLock) TryLock() (bool, error) {
+	err := l.f.TryLock()
+	if err == filemutex.AlreadyLocked {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 // Unlock releases the lock
 func (l *FileLock) Unlock() error {
 	return l.f.Unlock()
@@ -15,8 +15,10 @@
 package disk
 
 import (
+	"context"
 	"os"
 	"path/filepath"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -59,4 +61,33 @@ var _ = Describe("Lock Operations", func() {
 		err = m.Unlock()
 		Expect(err).ToNot(HaveOccurred())
 	})
+
+	It("gives up locking a store held elsewhere once the context is done", func() {
+		dir, err := os.MkdirTemp("", "")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		s, err := New("net", dir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+
+		// another process holds the lock
+		other, err := NewFileLock(filepath.Join(dir, "net"))
+		Expect(err).ToNot(HaveOccurred())
+		defer other.Close()
+		Expect(other.Lock()).To(Succeed())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		err = s.LockContext(ctx)
+		Expect(err).To(MatchError(ContainSubstring("gave up locking the store in")))
+		Expect(err).To(MatchError(ContainSubstring("context deadline exceeded")))
+
+		// once it is released, the store locks
+		Expect(other.Unlock()).To(Succeed())
+		ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		Expect(s.LockContext(ctx)).To(Succeed())
+		Expect(s.Unlock()).To(Succeed())
+	})
 })
@@ -0,0 +1,220 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const cutoverFile = "cutover.json"
+
+// Lease is an address allocated in the store, with the attachment holding
+// it and the pod it is kept for, as "namespace/name", if any.
+type Lease struct {
+	IP     string `json:"ip"`
+	ID     string `json:"id"`
+	IfName string `json:"ifname"`
+	Pod    string `json:"pod,omitempty"`
+}
+
+func (l Lease) String() string {
+	s := l.ID + "/" + l.IfName
+	if l.Pod != "" {
+		s += " of pod " + l.Pod
+	}
+	return s
+}
+
+// Leases returns the leases of the store, ordered by address. The store
+// must be locked.
+func (s *Store) Leases() ([]Lease, error) {
+	ips, err := s.Allocations()
+	if err != nil {
+		return nil, err
+	}
+	pods, err := s.PodIPs()
+	if err != nil {
+		return nil, err
+	}
+	podOf := map[string]string{}
+	for pod, podIPs := range pods {
+		for _, ip := range podIPs {
+			podOf[ip.String()] = pod
+		}
+	}
+
+	sort.Slice(ips, func(i, j int) bool { return bytes.Compare(ips[i].To16(), ips[j].To16()) < 0 })
+	leases := make([]Lease, 0, len(ips))
+	for _, ip := range ips {
+		id, ifname, ok := s.HolderOf(ip)
+		if !ok {
+			continue
+		}
+		leases = append(leases, Lease{IP: ip.String(), ID: id, IfName: ifname, Pod: podOf[ip.String()]})
+	}
+	return leases, nil
+}
+
+// SyncTo makes the leases of dst, and its last reserved IPs of the ranges
+// rangeIDs, those of s. Only the leases which differ are written. Both
+// stores must be locked.
+func (s *Store) SyncTo(dst *Store, rangeIDs []string) error {
+	want, err := s.Leases()
+	if err != nil {
+		return err
+	}
+	have, err := dst.Leases()
+	if err != nil {
+		return err
+	}
+	wanted := map[string]Lease{}
+	for _, l := range want {
+		wanted[l.IP] = l
+	}
+	kept := map[string]bool{}
+	for _, l := range have {
+		if wanted[l.IP] == l {
+			kept[l.IP] = true
+			continue
+		}
+		if _, err := dst.ReleaseByIP(net.ParseIP(l.IP)); err != nil {
+			return fmt.Errorf("failed to release %s: %v", l.IP, err)
+		}
+	}
+	for _, l := range want {
+		if kept[l.IP] {
+			continue
+		}
+		ip := net.ParseIP(l.IP)
+		if _, err := dst.reserveLease(l.ID, l.IfName, ip); err != nil {
+			return fmt.Errorf("failed to reserve %s: %v", l.IP, err)
+		}
+		if podNs, podName, ok := strings.Cut(l.Pod, "/"); ok {
+			if _, err := dst.ReservePodInfo(l.ID, ip, podNs, podName, false); err != nil {
+				return fmt.Errorf("failed to reserve %s for pod %s: %v", l.IP, l.Pod, err)
+			}
+		}
+	}
+
+	for _, rangeID := range rangeIDs {
+		ip, err := s.LastReservedIP(rangeID)
+		if err != nil || ip == nil {
+			continue
+		}
+		if last, err := dst.LastReservedIP(rangeID); err == nil && ip.Equal(last) {
+			continue
+		}
+		if err := dst.saveLastReservedIP(ip, rangeID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Diff returns the differences of the leases of dst from those of s, one
+// per address. Both stores must be locked.
+func (s *Store) Diff(dst *Store) ([]string, error) {
+	want, err := s.Leases()
+	if err != nil {
+		return nil, err
+	}
+	have, err := dst.Leases()
+	if err != nil {
+		return nil, err
+	}
+	haveByIP := map[string]Lease{}
+	for _, l := range have {
+		haveByIP[l.IP] = l
+	}
+
+	var diffs []string
+	for _, l := range want {
+		h, ok := haveByIP[l.IP]
+		delete(haveByIP, l.IP)
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("%s: missing, held by %s", l.IP, l))
+		case h != l:
+			diffs = append(diffs, fmt.Sprintf("%s: held by %s instead of %s", l.IP, h, l))
+		}
+	}
+	for _, l := range have {
+		if _, ok := haveByIP[l.IP]; ok {
+			diffs = append(diffs, fmt.Sprintf("%s: held by %s, but free", l.IP, l))
+		}
+	}
+	return diffs, nil
+}
+
+// LockWithin is Lock, giving up after timeout. Processes mirroring changes
+// between two stores lock the second one with it, so around a cutover,
+// when they mirror in opposite directions, they can't deadlock. It must not
+// be used in write-behind mode.
+func (s *Store) LockWithin(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	s.mu.Lock()
+	for {
+		locked, err := s.FileLock.TryLock()
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		if locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			s.mu.Unlock()
+			return fmt.Errorf("timed out locking the store in %s", s.dataDir)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.locked = true
+	s.dropState()
+	return nil
+}
+
+// cutover is the record of a cutover to the secondary store.
+type cutover struct {
+	Since time.Time `json:"since"`
+}
+
+// CutOver reports whether the network in dataDir, or the default data
+// dir, was cut over to its secondary store, see SetCutOver.
+func CutOver(network, dataDir string) bool {
+	if dataDir == "" {
+		var err error
+		if dataDir, err = DefaultDataDir(); err != nil {
+			return false
+		}
+	}
+	_, err := os.Stat(GetEscapedPath(filepath.Join(dataDir, network), cutoverFile))
+	return err == nil
+}
+
+// SetCutOver records in the store that the network is cut over to its
+// secondary store, or that it is no longer. The store must be locked.
+func (s *Store) SetCutOver(on bool) error {
+	if !on {
+		return s.writeRecords(cutoverFile, nil, 0)
+	}
+	return s.writeRecords(cutoverFile, cutover{Since: time.Now().UTC()}, 1)
+}
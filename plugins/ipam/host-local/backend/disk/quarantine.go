@@ -0,0 +1,109 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+const quarantineFile = "quarantine.json"
+
+// Quarantined records that an address released by an attachment is not
+// allocated to another attachment until Until.
+type Quarantined struct {
+	IP     string    `json:"ip"`
+	ID     string    `json:"id"`
+	IfName string    `json:"ifname"`
+	Until  time.Time `json:"until"`
+}
+
+// Quarantine records the quarantines, replacing earlier ones of their
+// addresses, and drops expired ones. The store must be locked.
+func (s *Store) Quarantine(quarantined []Quarantined) error {
+	current, err := s.loadQuarantine()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	set := map[string]bool{}
+	for i := range quarantined {
+		quarantined[i].ID = strings.TrimSpace(quarantined[i].ID)
+		set[quarantined[i].IP] = true
+	}
+	kept := []Quarantined{}
+	for _, q := range current {
+		if q.Until.After(now) && !set[q.IP] {
+			kept = append(kept, q)
+		}
+	}
+	kept = append(kept, quarantined...)
+	if err := s.writeRecords(quarantineFile, kept, len(kept)); err != nil {
+		return err
+	}
+	s.quarantine = kept
+	return nil
+}
+
+// Quarantined returns the unexpired quarantines. The store must be locked.
+func (s *Store) Quarantined() ([]Quarantined, error) {
+	current, err := s.loadQuarantine()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	quarantined := []Quarantined{}
+	for _, q := range current {
+		if q.Until.After(now) {
+			quarantined = append(quarantined, q)
+		}
+	}
+	return quarantined, nil
+}
+
+// quarantinedFrom returns true if ip is quarantined from the attachment,
+// i.e. released by another one less than the quarantine period ago.
+func (s *Store) quarantinedFrom(id, ifname string, ip net.IP) (bool, error) {
+	current, err := s.loadQuarantine()
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	id = strings.TrimSpace(id)
+	for _, q := range current {
+		if q.IP == ip.String() && q.Until.After(now) && !(q.ID == id && q.IfName == ifname) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// loadQuarantine returns the quarantines of the store, read once while it
+// is locked, as Reserve checks them for every candidate address.
+func (s *Store) loadQuarantine() ([]Quarantined, error) {
+	if s.quarantine != nil {
+		return s.quarantine, nil
+	}
+	quarantine := []Quarantined{}
+	if err := s.readRecords(quarantineFile, &quarantine); err != nil {
+		return nil, err
+	}
+	if quarantine == nil {
+		quarantine = []Quarantined{}
+	}
+	s.quarantine = quarantine
+	return quarantine, nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Quarantine", func() {
+	var (
+		store *Store
+		path  string
+	)
+
+	BeforeEach(func() {
+		var err error
+		store, err = New("mynet", GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(store.Close)
+		path = filepath.Join(store.DataDir(), quarantineFile)
+
+		Expect(store.Lock()).To(Succeed())
+		Expect(store.Quarantine([]Quarantined{{
+			IP: "10.1.2.2", ID: "c1", IfName: "eth0", Until: time.Now().Add(time.Hour),
+		}})).To(Succeed())
+		Expect(store.Unlock()).To(Succeed())
+	})
+
+	It("reads the quarantines once while the store is locked", func() {
+		Expect(store.Lock()).To(Succeed())
+		reserved, err := store.Reserve("c2", "eth0", net.ParseIP("10.1.2.2"), "0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reserved).To(BeFalse())
+
+		Expect(os.Remove(path)).To(Succeed())
+		quarantined, err := store.Quarantined()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(quarantined).To(HaveLen(1))
+		Expect(store.Unlock()).To(Succeed())
+
+		// locking again reads them again
+		Expect(store.Lock()).To(Succeed())
+		defer store.Unlock()
+		quarantined, err = store.Quarantined()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(quarantined).To(BeEmpty())
+	})
+
+	It("reports a quarantine list which can't be parsed", func() {
+		Expect(os.WriteFile(path, []byte("["), 0o600)).To(Succeed())
+		Expect(store.Lock()).To(Succeed())
+		defer store.Unlock()
+		_, err := store.Reserve("c2", "eth0", net.ParseIP("10.1.2.3"), "0")
+		Expect(err).To(MatchError(ContainSubstring("failed to parse " + path)))
+		_, err = store.Quarantined()
+		Expect(err).To(HaveOccurred())
+	})
+})
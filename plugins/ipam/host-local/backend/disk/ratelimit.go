@@ -0,0 +1,64 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import "time"
+
+const rateLimitFile = "ratelimit.json"
+
+// bucket is the level of the leaky bucket of a requester when it was last
+// filled.
+type bucket struct {
+	Level float64   `json:"level"`
+	At    time.Time `json:"at"`
+}
+
+// Throttle adds an operation of requester to its leaky bucket, which holds
+// capacity operations and drains one per leak. If the bucket is full, the
+// operation is not added and Throttle returns how long until there is room
+// for it. The buckets which drained are dropped. The store must be locked.
+func (s *Store) Throttle(requester string, capacity int, leak time.Duration) (time.Duration, error) {
+	now := time.Now()
+	buckets := map[string]bucket{}
+	if err := s.readRecords(rateLimitFile, &buckets); err != nil {
+		return 0, err
+	}
+	if buckets == nil {
+		buckets = map[string]bucket{}
+	}
+
+	level := func(b bucket) float64 {
+		drained := float64(now.Sub(b.At)) / float64(leak)
+		if drained < 0 {
+			drained = 0
+		}
+		if b.Level <= drained {
+			return 0
+		}
+		return b.Level - drained
+	}
+	for r, b := range buckets {
+		if level(b) == 0 {
+			delete(buckets, r)
+		}
+	}
+
+	current := level(buckets[requester])
+	if current+1 > float64(capacity) {
+		return time.Duration((current + 1 - float64(capacity)) * float64(leak)), nil
+	}
+	buckets[requester] = bucket{Level: current + 1, At: now}
+	return 0, s.writeRecords(rateLimitFile, buckets, len(buckets))
+}
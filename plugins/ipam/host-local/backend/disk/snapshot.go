@@ -0,0 +1,268 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotSuffix     = ".tar.gz"
+	snapshotTimeFormat = "20060102T150405.000000000Z"
+
+	// maxSnapshotFileSize bounds the files read back from a snapshot,
+	// leases and the journal are far smaller
+	maxSnapshotFileSize = 64 << 20
+)
+
+// SetSnapshotDir sets where the snapshots of the store are kept. By default
+// that is the ".snapshots" directory next to the store, named after the
+// network.
+func (s *Store) SetSnapshotDir(dir string) {
+	s.snapshotDir = dir
+}
+
+func (s *Store) snapshots() string {
+	if s.snapshotDir != "" {
+		return s.snapshotDir
+	}
+	return filepath.Join(filepath.Dir(s.dataDir), ".snapshots", filepath.Base(s.dataDir))
+}
+
+// Snapshot writes a copy of every file of the store, but the lock, to a new
+// snapshot and returns its name. The store must be locked.
+func (s *Store) Snapshot() (string, error) {
+	dir := s.snapshots()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	entries, err := os.ReadDir(s.dataDir)
+	if err != nil {
+		return "", err
+	}
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		if !e.Type().IsRegular() || e.Name() == "lock" {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return "", err
+		}
+		data, err := os.ReadFile(filepath.Join(s.dataDir, e.Name()))
+		if err != nil {
+			return "", err
+		}
+		hdr := &tar.Header{
+			Name:     e.Name(),
+			Mode:     int64(info.Mode().Perm()),
+			Size:     int64(len(data)),
+			ModTime:  info.ModTime(),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return "", err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return "", err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+
+	name := time.Now().UTC().Format(snapshotTimeFormat) + snapshotSuffix
+	if err := writeFileSync(filepath.Join(dir, name), buf.Bytes(), 0o600); err != nil {
+		return "", fmt.Errorf("failed to write snapshot %s: %v", name, err)
+	}
+	return name, nil
+}
+
+// Snapshots returns the names of the snapshots of the store, the newest
+// first.
+func (s *Store) Snapshots() ([]string, error) {
+	entries, err := os.ReadDir(s.snapshots())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if _, ok := snapshotTime(e.Name()); ok && e.Type().IsRegular() {
+			names = append(names, e.Name())
+		}
+	}
+	// the names sort by the time they were taken
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names, nil
+}
+
+// SnapshotIfDue takes a snapshot if the newest one is older than interval
+// and then removes all but the count newest. It reports whether a snapshot
+// was taken. The store must be locked.
+func (s *Store) SnapshotIfDue(interval time.Duration, count int) (bool, error) {
+	names, err := s.Snapshots()
+	if err != nil {
+		return false, err
+	}
+	if len(names) > 0 {
+		if taken, _ := snapshotTime(names[0]); time.Since(taken) < interval {
+			return false, nil
+		}
+	}
+	name, err := s.Snapshot()
+	if err != nil {
+		return false, err
+	}
+	names = append([]string{name}, names...)
+	for _, old := range names[min(count, len(names)):] {
+		if err := os.Remove(filepath.Join(s.snapshots(), old)); err != nil && !os.IsNotExist(err) {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// RestoreSnapshot replaces the files of the store with the ones of the
+// snapshot name, e.g. after the filesystem got corrupted. The snapshot is
+// read completely before anything is replaced. The store must be locked.
+func (s *Store) RestoreSnapshot(name string) error {
+	if _, ok := snapshotTime(name); !ok || filepath.Base(name) != name {
+		return fmt.Errorf("invalid snapshot name %q", name)
+	}
+	files, err := readSnapshot(filepath.Join(s.snapshots(), name))
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot %s: %v", name, err)
+	}
+
+	entries, err := os.ReadDir(s.dataDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || e.Name() == "lock" {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dataDir, e.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for fname, f := range files {
+		if err := writeFileSync(filepath.Join(s.dataDir, fname), f.data, f.mode); err != nil {
+			return fmt.Errorf("failed to restore %s: %v", fname, err)
+		}
+	}
+	s.dropState()
+	if s.wb != nil {
+		// the restored journal replaces the pending changes
+		s.wb.records = nil
+		s.wb.lastIPs = map[string]net.IP{}
+	}
+	return nil
+}
+
+type snapshotFile struct {
+	data []byte
+	mode os.FileMode
+}
+
+func readSnapshot(path string) (map[string]snapshotFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	files := map[string]snapshotFile{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg || filepath.Base(hdr.Name) != hdr.Name ||
+			strings.HasPrefix(hdr.Name, ".") || hdr.Name == "lock" {
+			return nil, fmt.Errorf("unexpected entry %q", hdr.Name)
+		}
+		if hdr.Size > maxSnapshotFileSize {
+			return nil, fmt.Errorf("entry %q is too large", hdr.Name)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[hdr.Name] = snapshotFile{data: data, mode: os.FileMode(hdr.Mode).Perm()}
+	}
+}
+
+func snapshotTime(name string) (time.Time, bool) {
+	stamp, ok := strings.CutSuffix(name, snapshotSuffix)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(snapshotTimeFormat, stamp)
+	return t, err == nil
+}
+
+// writeFileSync writes the file under a temporary name and renames it once
+// it is on disk, so a crash never leaves it half written.
+func writeFileSync(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
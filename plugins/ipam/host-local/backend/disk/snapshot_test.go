@@ -0,0 +1,89 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store snapshots", func() {
+	var dir string
+	var s *Store
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "")
+		Expect(err).ToNot(HaveOccurred())
+		s, err = New("net", dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Lock()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(s.Unlock()).To(Succeed())
+		s.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("restores the leases of a snapshot", func() {
+		reserved, err := s.Reserve("c1", "eth0", net.ParseIP("10.0.0.2"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+		name, err := s.Snapshot()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(filepath.Join(dir, ".snapshots", "net", name)).To(BeAnExistingFile())
+
+		// a lease allocated after the snapshot and a corrupted one
+		_, err = s.Reserve("c2", "eth0", net.ParseIP("10.0.0.3"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(dir, "net", "10.0.0.2"), []byte{0, 0, 0}, 0o600)).To(Succeed())
+
+		Expect(s.RestoreSnapshot(name)).To(Succeed())
+		Expect(s.GetByID("c1", "eth0")).To(Equal([]net.IP{net.ParseIP("10.0.0.2")}))
+		Expect(s.GetByID("c2", "eth0")).To(BeEmpty())
+		Expect(s.LastReservedIP("0")).To(Equal(net.ParseIP("10.0.0.2")))
+		Expect(filepath.Join(dir, "net", "lock")).To(BeAnExistingFile())
+	})
+
+	It("takes snapshots once due and keeps the newest", func() {
+		taken, err := s.SnapshotIfDue(time.Hour, 2)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(taken).To(BeTrue())
+		taken, err = s.SnapshotIfDue(time.Hour, 2)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(taken).To(BeFalse())
+
+		for i := 0; i < 3; i++ {
+			taken, err = s.SnapshotIfDue(0, 2)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(taken).To(BeTrue())
+		}
+		names, err := s.Snapshots()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(names).To(HaveLen(2))
+		Expect(names[0] > names[1]).To(BeTrue())
+	})
+
+	It("rejects snapshot names outside the snapshots dir", func() {
+		Expect(s.RestoreSnapshot("../20240102T030405.000000000Z.tar.gz")).To(MatchError(ContainSubstring("invalid snapshot name")))
+		Expect(s.RestoreSnapshot("lock")).To(MatchError(ContainSubstring("invalid snapshot name")))
+	})
+})
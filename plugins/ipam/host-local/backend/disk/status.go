@@ -0,0 +1,161 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	healthCheckFile = "health_check"
+
+	// maxLockLatencySamples is the number of lock acquisitions kept for
+	// reporting latency percentiles.
+	maxLockLatencySamples = 256
+)
+
+// Lock acquires the store lock and records how long that took.
+func (s *Store) Lock() error {
+	return s.LockContext(context.Background())
+}
+
+// LockContext is Lock, giving up once ctx is done, e.g. at the deadline of
+// the invocation, so a store on a wedged mount fails the invocation instead
+// of hanging it.
+func (s *Store) LockContext(ctx context.Context) error {
+	s.mu.Lock()
+	if wb := s.wb; wb != nil && wb.held {
+		// the file lock and the state were kept for the pending changes
+		if wb.err != nil {
+			if err := s.writePending(); err != nil {
+				s.mu.Unlock()
+				return err
+			}
+			wb.err = nil
+		}
+		s.locked = true
+		return nil
+	}
+
+	start := time.Now()
+	if err := s.lockFile(ctx); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.recordLockLatency(time.Since(start))
+	s.locked = true
+	s.dropState()
+	return nil
+}
+
+// lockFile acquires the file lock, polling for it if ctx can be done.
+func (s *Store) lockFile(ctx context.Context) error {
+	if ctx.Done() == nil {
+		return s.FileLock.Lock()
+	}
+	for {
+		locked, err := s.FileLock.TryLock()
+		if err != nil || locked {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up locking the store in %s: %v", s.dataDir, ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// Unlock releases the store lock. State read while it was held is dropped,
+// other processes may change the store from now on. In write-behind mode
+// the file lock and the state are kept until pending changes are written.
+func (s *Store) Unlock() error {
+	defer s.mu.Unlock()
+	s.locked = false
+	if s.unlockBehind() {
+		return nil
+	}
+	s.dropState()
+	return s.FileLock.Unlock()
+}
+
+// recordLockLatency appends d to the latency samples. The samples are kept
+// in memory only, writing them to the store would slow down every
+// invocation for the sake of STATUS. It must be called with s.mu held.
+func (s *Store) recordLockLatency(d time.Duration) {
+	s.lockLatencies = append(s.lockLatencies, d)
+	if len(s.lockLatencies) > maxLockLatencySamples {
+		s.lockLatencies = s.lockLatencies[len(s.lockLatencies)-maxLockLatencySamples:]
+	}
+}
+
+// LockLatencies returns the most recent lock acquisition times of this
+// process, oldest first. A plugin invocation only sees its own, processes
+// keeping the store open, like those allocating through pkg/ipalloc, see
+// their recent history.
+func (s *Store) LockLatencies() []time.Duration {
+	return append([]time.Duration(nil), s.lockLatencies...)
+}
+
+// Allocations returns all addresses currently reserved in the store.
+func (s *Store) Allocations() ([]net.IP, error) {
+	if s.journal {
+		return s.journalAllocations()
+	}
+
+	entries, err := os.ReadDir(s.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if ip := parseIPFileName(e.Name()); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+// parseIPFileName returns the address of an allocation file, undoing the
+// escaping of GetEscapedPath.
+func parseIPFileName(name string) net.IP {
+	if runtime.GOOS == "windows" {
+		name = strings.ReplaceAll(name, "_", ":")
+	}
+	return net.ParseIP(name)
+}
+
+// CheckHealth verifies the store directory can be written to.
+func (s *Store) CheckHealth() error {
+	path := GetEscapedPath(s.dataDir, healthCheckFile)
+	if err := os.WriteFile(path, []byte(time.Now().UTC().Format(time.RFC3339)), 0o600); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// DataDir returns the directory holding the network's allocations.
+func (s *Store) DataDir() string {
+	return s.dataDir
+}
@@ -0,0 +1,74 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"strings"
+	"time"
+)
+
+const tombstoneFile = "tombstones.json"
+
+// Tombstone records that the addresses of an attachment were released by a
+// DEL, so a repeated DEL can be told from the DEL of a newer ADD of the
+// same attachment until the tombstone expires.
+type Tombstone struct {
+	ID     string    `json:"id"`
+	IfName string    `json:"ifname"`
+	IPs    []string  `json:"ips,omitempty"`
+	Until  time.Time `json:"until"`
+}
+
+// AddTombstone records the tombstone, replacing an earlier one of the
+// attachment, and drops expired ones. The store must be locked.
+func (s *Store) AddTombstone(t Tombstone) error {
+	current, err := s.readTombstones()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	t.ID = strings.TrimSpace(t.ID)
+	tombstones := []Tombstone{}
+	for _, o := range current {
+		if o.Until.After(now) && !(o.ID == t.ID && o.IfName == t.IfName) {
+			tombstones = append(tombstones, o)
+		}
+	}
+	tombstones = append(tombstones, t)
+	return s.writeRecords(tombstoneFile, tombstones, len(tombstones))
+}
+
+// TombstoneOf returns the unexpired tombstone of the attachment, if any.
+// The store must be locked.
+func (s *Store) TombstoneOf(id, ifname string) (Tombstone, bool, error) {
+	tombstones, err := s.readTombstones()
+	if err != nil {
+		return Tombstone{}, false, err
+	}
+	now := time.Now()
+	id = strings.TrimSpace(id)
+	for _, t := range tombstones {
+		if t.ID == id && t.IfName == ifname && t.Until.After(now) {
+			return t, true, nil
+		}
+	}
+	return Tombstone{}, false, nil
+}
+
+func (s *Store) readTombstones() ([]Tombstone, error) {
+	var tombstones []Tombstone
+	err := s.readRecords(tombstoneFile, &tombstones)
+	return tombstones, err
+}
@@ -0,0 +1,172 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// writeBehind holds the changes of a store in write-behind mode which are
+// not on disk yet.
+type writeBehind struct {
+	window time.Duration
+	// held is set while the file lock is kept past Unlock, because of
+	// pending changes
+	held    bool
+	records []journalRecord
+	lastIPs map[string]net.IP
+	timer   *time.Timer
+	// err is the error of the last flush of the timer. The next Lock
+	// retries the flush and fails if it fails again.
+	err error
+}
+
+func (wb *writeBehind) pending() bool {
+	return len(wb.records) > 0 || len(wb.lastIPs) > 0
+}
+
+// SetWriteBehind puts a journal store in write-behind mode: the changes are
+// kept in memory and appended to the journal in one write, window after
+// the first of them, or on Flush or Close.
+//
+// The file lock is kept from Unlock until the changes are written, so the
+// in-memory state stays authoritative and other processes wait at most
+// window. The changes of the last window are lost if the process crashes.
+func (s *Store) SetWriteBehind(window time.Duration) error {
+	if !s.journal {
+		return fmt.Errorf("write-behind requires the journal format")
+	}
+	if window <= 0 {
+		return fmt.Errorf("invalid write-behind window %v", window)
+	}
+	s.wb = &writeBehind{window: window, lastIPs: map[string]net.IP{}}
+	return nil
+}
+
+// WriteBehindWindow returns the write-behind window, or 0 if the store
+// writes its changes right away.
+func (s *Store) WriteBehindWindow() time.Duration {
+	if s.wb == nil {
+		return 0
+	}
+	return s.wb.window
+}
+
+// unlockBehind keeps the file lock and the state past Unlock if changes
+// are pending, until the timer writes them. It returns false if there are
+// none and the lock is to be released.
+func (s *Store) unlockBehind() bool {
+	wb := s.wb
+	if wb == nil || !wb.pending() {
+		return false
+	}
+	wb.held = true
+	if wb.timer == nil {
+		wb.timer = time.AfterFunc(wb.window, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			wb.timer = nil
+			wb.err = s.flushBehind()
+		})
+	}
+	return true
+}
+
+// flushBehind writes the pending changes and releases the file lock kept
+// for them. It must be called with s.mu held and the store not locked.
+func (s *Store) flushBehind() error {
+	wb := s.wb
+	if wb == nil || !wb.held {
+		return nil
+	}
+	if err := s.writePending(); err != nil {
+		// the lock and the state are kept, the next Lock retries
+		return err
+	}
+	wb.held = false
+	s.dropState()
+	return s.FileLock.Unlock()
+}
+
+// writePending appends the pending records to the journal, or compacts it
+// if that is due, and writes the last reserved addresses.
+func (s *Store) writePending() error {
+	wb := s.wb
+	for rangeID, ip := range wb.lastIPs {
+		if err := s.writeLastReservedIP(ip, rangeID); err != nil {
+			return err
+		}
+		delete(wb.lastIPs, rangeID)
+	}
+	if len(wb.records) == 0 {
+		return nil
+	}
+
+	st := s.state
+	if st.needsCompaction || (st.records >= compactMinRecords && st.records > 2*(len(st.ips)+len(st.pods))) {
+		// the snapshot includes the pending records
+		if err := s.compactJournal(); err != nil {
+			return err
+		}
+		wb.records = nil
+		return nil
+	}
+
+	data, err := encodeRecords(wb.records)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.journalPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	wb.records = nil
+	return nil
+}
+
+// Flush writes the changes pending in write-behind mode right away, e.g.
+// before a daemon exits. It must not be called with the store locked.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wb == nil {
+		return nil
+	}
+	if s.wb.timer != nil {
+		s.wb.timer.Stop()
+		s.wb.timer = nil
+	}
+	return s.flushBehind()
+}
+
+// Close writes the changes pending in write-behind mode and closes the
+// store.
+func (s *Store) Close() error {
+	err := s.Flush()
+	if cerr := s.FileLock.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
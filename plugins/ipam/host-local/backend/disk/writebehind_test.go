@@ -0,0 +1,112 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Write-behind store", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	journal := func() string {
+		data, err := os.ReadFile(filepath.Join(dir, "net", journalFile))
+		Expect(err).ToNot(HaveOccurred())
+		return string(data)
+	}
+
+	reserve := func(s *Store, id, ip string) {
+		Expect(s.Lock()).To(Succeed())
+		reserved, err := s.Reserve(id, "eth0", net.ParseIP(ip), "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+		Expect(s.Unlock()).To(Succeed())
+	}
+
+	It("requires the journal format", func() {
+		s, err := New("net", dir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.SetWriteBehind(time.Second)).To(MatchError("write-behind requires the journal format"))
+	})
+
+	It("writes the changes of a window in one batch", func() {
+		s, err := NewJournal("net", dir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.SetWriteBehind(200 * time.Millisecond)).To(Succeed())
+		Expect(s.WriteBehindWindow()).To(Equal(200 * time.Millisecond))
+
+		start := time.Now()
+		reserve(s, "c1", "10.0.0.2")
+		reserve(s, "c2", "10.0.0.3")
+		Expect(journal()).To(BeEmpty())
+
+		// the process's state is authoritative in the meantime
+		Expect(s.Lock()).To(Succeed())
+		Expect(s.GetByID("c2", "eth0")).To(Equal([]net.IP{net.ParseIP("10.0.0.3")}))
+		last, err := s.LastReservedIP("0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("10.0.0.3"))
+		Expect(s.Unlock()).To(Succeed())
+
+		// other processes wait for the batch
+		s2, err := New("net", dir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s2.Close()
+		Expect(s2.Lock()).To(Succeed())
+		Expect(time.Since(start)).To(BeNumerically(">=", 200*time.Millisecond))
+		Expect(s2.GetByID("c1", "eth0")).To(Equal([]net.IP{net.ParseIP("10.0.0.2")}))
+		Expect(s2.GetByID("c2", "eth0")).To(Equal([]net.IP{net.ParseIP("10.0.0.3")}))
+		last, err = s2.LastReservedIP("0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("10.0.0.3"))
+		Expect(s2.Unlock()).To(Succeed())
+	})
+
+	It("writes the pending changes on Close", func() {
+		s, err := NewJournal("net", dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.SetWriteBehind(time.Hour)).To(Succeed())
+
+		reserve(s, "c1", "10.0.0.2")
+		Expect(journal()).To(BeEmpty())
+		Expect(s.Close()).To(Succeed())
+		Expect(journal()).To(ContainSubstring(`"ip":"10.0.0.2"`))
+
+		s2, err := New("net", dir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s2.Close()
+		Expect(s2.Lock()).To(Succeed())
+		Expect(s2.GetByID("c1", "eth0")).To(Equal([]net.IP{net.ParseIP("10.0.0.2")}))
+		Expect(s2.Unlock()).To(Succeed())
+	})
+})
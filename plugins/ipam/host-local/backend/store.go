@@ -23,7 +23,17 @@ type Store interface {
 	Reserve(id string, ifname string, ip net.IP, rangeID string) (bool, error)
 	LastReservedIP(rangeID string) (net.IP, error)
 	ReleaseByID(id string, ifname string) error
+	// ReleaseByIP releases ip, whoever it is allocated to, and reports
+	// whether it was allocated at all
+	ReleaseByIP(ip net.IP) (bool, error)
+	// ReleaseByPod releases the IPs reserved for a pod and returns them
+	ReleaseByPod(podNs, podName string) ([]net.IP, error)
 	GetByID(id string, ifname string) []net.IP
+	// GetByContainer returns the IPs allocated to any interface of the
+	// container
+	GetByContainer(id string) []net.IP
 	HasReservedIP(podNs, podName string) (bool, net.IP)
 	ReservePodInfo(id string, ip net.IP, podNs, podName string, podIPIsExist bool) (bool, error)
+	GeneratedSubnet(key string) (*net.IPNet, error)
+	SaveGeneratedSubnet(key string, subnet *net.IPNet) error
 }
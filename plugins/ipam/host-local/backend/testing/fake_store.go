@@ -22,15 +22,16 @@ import (
 )
 
 type FakeStore struct {
-	ipMap          map[string]string
-	lastReservedIP map[string]net.IP
+	ipMap            map[string]string
+	lastReservedIP   map[string]net.IP
+	generatedSubnets map[string]*net.IPNet
 }
 
 // FakeStore implements the Store interface
 var _ backend.Store = &FakeStore{}
 
 func NewFakeStore(ipmap map[string]string, lastIPs map[string]net.IP) *FakeStore {
-	return &FakeStore{ipmap, lastIPs}
+	return &FakeStore{ipmap, lastIPs, map[string]*net.IPNet{}}
 }
 
 func (s *FakeStore) Lock() error {
@@ -76,6 +77,17 @@ func (s *FakeStore) ReleaseByID(id string, _ string) error {
 	return nil
 }
 
+func (s *FakeStore) ReleaseByIP(ip net.IP) (bool, error) {
+	key := ip.String()
+	_, ok := s.ipMap[key]
+	delete(s.ipMap, key)
+	return ok, nil
+}
+
+func (s *FakeStore) ReleaseByPod(_, _ string) ([]net.IP, error) {
+	return nil, nil
+}
+
 func (s *FakeStore) GetByID(id string, _ string) []net.IP {
 	var ips []net.IP
 	for k, v := range s.ipMap {
@@ -86,6 +98,10 @@ func (s *FakeStore) GetByID(id string, _ string) []net.IP {
 	return ips
 }
 
+func (s *FakeStore) GetByContainer(id string) []net.IP {
+	return s.GetByID(id, "")
+}
+
 func (s *FakeStore) SetIPMap(m map[string]string) {
 	s.ipMap = m
 }
@@ -105,3 +121,12 @@ func (s *FakeStore) HasReservedIP(_, podName string) (bool, net.IP) {
 func (s *FakeStore) ReservePodInfo(_ string, _ net.IP, _, _ string, _ bool) (bool, error) {
 	return true, nil
 }
+
+func (s *FakeStore) GeneratedSubnet(key string) (*net.IPNet, error) {
+	return s.generatedSubnets[key], nil
+}
+
+func (s *FakeStore) SaveGeneratedSubnet(key string, subnet *net.IPNet) error {
+	s.generatedSubnets[key] = subnet
+	return nil
+}
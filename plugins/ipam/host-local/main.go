@@ -14,187 +14,8 @@
 
 package main
 
-import (
-	"fmt"
-	"net"
-	"strings"
-
-	"github.com/containernetworking/cni/pkg/skel"
-	"github.com/containernetworking/cni/pkg/types"
-	current "github.com/containernetworking/cni/pkg/types/100"
-	"github.com/containernetworking/cni/pkg/version"
-	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
-	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
-	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
-)
+import "github.com/containernetworking/plugins/internal/plugins/ipam/host-local"
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("host-local"))
-}
-
-func cmdCheck(args *skel.CmdArgs) error {
-	ipamConf, _, err := allocator.LoadIPAMConfig(args.StdinData, args.Args)
-	if err != nil {
-		return err
-	}
-
-	// Look to see if there is at least one IP address allocated to the container
-	// in the data dir, irrespective of what that address actually is
-	store, err := disk.New(ipamConf.Name, ipamConf.DataDir)
-	if err != nil {
-		return err
-	}
-	defer store.Close()
-
-	containerIPFound := store.FindByID(args.ContainerID, args.IfName)
-	if !containerIPFound {
-		return fmt.Errorf("host-local: Failed to find address added by container %v", args.ContainerID)
-	}
-
-	return nil
-}
-
-// Args: [][2]string{
-// {"IgnoreUnknown", "1"},
-// {"K8S_POD_NAMESPACE", podNs},
-// {"K8S_POD_NAME", podName},
-// {"K8S_POD_INFRA_CONTAINER_ID", podSandboxID.ID},
-// },
-func resolvePodNsAndNameFromEnvArgs(envArgs string) (string, string, error) {
-	var ns, name string
-	if envArgs == "" {
-		return ns, name, nil
-	}
-
-	pairs := strings.Split(envArgs, ";")
-	for _, pair := range pairs {
-		kv := strings.Split(pair, "=")
-		if len(kv) != 2 {
-			return ns, name, fmt.Errorf("ARGS: invalid pair %q", pair)
-		}
-
-		if kv[0] == "K8S_POD_NAMESPACE" {
-			ns = kv[1]
-		} else if kv[0] == "K8S_POD_NAME" {
-			name = kv[1]
-		}
-	}
-
-	if len(ns)+len(name) > 230 {
-		return "", "", fmt.Errorf("ARGS: length of pod ns and name exceed the length limit")
-	}
-	return ns, name, nil
-}
-
-func cmdAdd(args *skel.CmdArgs) error {
-	ipamConf, confVersion, err := allocator.LoadIPAMConfig(args.StdinData, args.Args)
-	if err != nil {
-		return err
-	}
-
-	result := &current.Result{CNIVersion: current.ImplementedSpecVersion}
-
-	if ipamConf.ResolvConf != "" {
-		dns, err := parseResolvConf(ipamConf.ResolvConf)
-		if err != nil {
-			return err
-		}
-		result.DNS = *dns
-	}
-
-	store, err := disk.New(ipamConf.Name, ipamConf.DataDir)
-	if err != nil {
-		return err
-	}
-	defer store.Close()
-
-	// Keep the allocators we used, so we can release all IPs if an error
-	// occurs after we start allocating
-	allocs := []*allocator.IPAllocator{}
-
-	// Store all requested IPs in a map, so we can easily remove ones we use
-	// and error if some remain
-	requestedIPs := map[string]net.IP{} // net.IP cannot be a key
-
-	for _, ip := range ipamConf.IPArgs {
-		requestedIPs[ip.String()] = ip
-	}
-
-	for idx, rangeset := range ipamConf.Ranges {
-		allocator := allocator.NewIPAllocator(&rangeset, store, idx)
-
-		// Check to see if there are any custom IPs requested in this range.
-		var requestedIP net.IP
-		for k, ip := range requestedIPs {
-			if rangeset.Contains(ip) {
-				requestedIP = ip
-				delete(requestedIPs, k)
-				break
-			}
-		}
-
-		// get pod namespace and pod name
-		podNs, podName, err := resolvePodNsAndNameFromEnvArgs(args.Args)
-		if err != nil {
-			return fmt.Errorf("failed to get pod ns/name from env args: %s", err)
-		}
-
-		ipConf, err := allocator.GetByPodNsAndName(args.ContainerID, args.IfName, requestedIP, podNs, podName)
-		if err != nil {
-			// Deallocate all already allocated IPs
-			for _, alloc := range allocs {
-				_ = alloc.Release(args.ContainerID, args.IfName)
-			}
-			return fmt.Errorf("failed to allocate for range %d: %v", idx, err)
-		}
-
-		allocs = append(allocs, allocator)
-
-		result.IPs = append(result.IPs, ipConf)
-	}
-
-	// If an IP was requested that wasn't fulfilled, fail
-	if len(requestedIPs) != 0 {
-		for _, alloc := range allocs {
-			_ = alloc.Release(args.ContainerID, args.IfName)
-		}
-		errstr := "failed to allocate all requested IPs:"
-		for _, ip := range requestedIPs {
-			errstr = errstr + " " + ip.String()
-		}
-		return fmt.Errorf(errstr)
-	}
-
-	result.Routes = ipamConf.Routes
-
-	return types.PrintResult(result, confVersion)
-}
-
-func cmdDel(args *skel.CmdArgs) error {
-	ipamConf, _, err := allocator.LoadIPAMConfig(args.StdinData, args.Args)
-	if err != nil {
-		return err
-	}
-
-	store, err := disk.New(ipamConf.Name, ipamConf.DataDir)
-	if err != nil {
-		return err
-	}
-	defer store.Close()
-
-	// Loop through all ranges, releasing all IPs, even if an error occurs
-	var errors []string
-	for idx, rangeset := range ipamConf.Ranges {
-		ipAllocator := allocator.NewIPAllocator(&rangeset, store, idx)
-
-		err := ipAllocator.Release(args.ContainerID, args.IfName)
-		if err != nil {
-			errors = append(errors, err.Error())
-		}
-	}
-
-	if errors != nil {
-		return fmt.Errorf(strings.Join(errors, ";"))
-	}
-	return nil
+	hostlocal.Main()
 }
@@ -0,0 +1,290 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// soak hammers a host-local binary with concurrent ADD and DEL invocations,
+// each in its own process as a runtime would run them, and verifies that no
+// address is handed out twice and none is leaked:
+//
+//	soak -plugin ./bin/host-local -workers 32 -iterations 1000
+//
+// Every few iterations an ADD requests an unavailable address in the second
+// range set, so the allocation of the first one has to be rolled back.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+)
+
+const network = "soak"
+
+type config struct {
+	plugin      string
+	dataDir     string
+	storeFormat string
+	workers     int
+	iterations  int
+	// failEvery is how often an ADD is made to fail, 0 for never
+	failEvery int
+}
+
+type report struct {
+	Adds         int           `json:"adds"`
+	Dels         int           `json:"dels"`
+	FailedAdds   int           `json:"failedAdds"`
+	Duplicates   []string      `json:"duplicates,omitempty"`
+	Leaked       []string      `json:"leaked,omitempty"`
+	Errors       []string      `json:"errors,omitempty"`
+	Duration     time.Duration `json:"duration"`
+	AddsBySecond float64       `json:"addsBySecond"`
+}
+
+func (r *report) ok() bool {
+	return len(r.Duplicates) == 0 && len(r.Leaked) == 0 && len(r.Errors) == 0
+}
+
+// netConf has a range set per family. The IPv4 one is small, so workers
+// keep reusing the same addresses.
+func netConf(cfg config) []byte {
+	return []byte(fmt.Sprintf(`{
+		"cniVersion": "1.0.0",
+		"name": %q,
+		"type": "host-local",
+		"ipam": {
+			"type": "host-local",
+			"dataDir": %q,
+			"storeFormat": %q,
+			"ranges": [
+				[{"subnet": "10.99.0.0/26"}],
+				[{"subnet": "fd99::/120"}]
+			]
+		}
+	}`, network, cfg.dataDir, cfg.storeFormat))
+}
+
+// owners tracks which container holds each address.
+type owners struct {
+	sync.Mutex
+	byIP map[string]string
+}
+
+func run(cfg config) (*report, error) {
+	if cfg.workers < 1 || cfg.iterations < 1 {
+		return nil, fmt.Errorf("-workers and -iterations must be positive")
+	}
+	// the IPv4 range has 61 addresses, and each worker holds up to two
+	if cfg.workers > 30 {
+		return nil, fmt.Errorf("at most 30 workers are supported")
+	}
+
+	conf := netConf(cfg)
+	held := &owners{byIP: map[string]string{}}
+	rep := &report{}
+	var mu sync.Mutex
+	record := func(f func()) {
+		mu.Lock()
+		defer mu.Unlock()
+		f()
+	}
+
+	// release forgets the addresses before they are released, so their
+	// next holder is not taken for a duplicate
+	release := func(id string, ips []string) {
+		held.Lock()
+		for _, ip := range ips {
+			if held.byIP[ip] == id {
+				delete(held.byIP, ip)
+			}
+		}
+		held.Unlock()
+
+		if _, err := execPlugin(cfg.plugin, conf, "DEL", id, "K8S_POD_NAMESPACE=soak;K8S_POD_NAME="+id); err != nil {
+			record(func() { rep.Errors = append(rep.Errors, fmt.Sprintf("%s: DEL: %v", id, err)) })
+			return
+		}
+		record(func() { rep.Dels++ })
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < cfg.workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			// each worker keeps its previous container until the next one
+			// is added, so addresses are held while others allocate
+			prevID, prevIPs := "", []string{}
+			for i := 0; i < cfg.iterations; i++ {
+				id := fmt.Sprintf("soak-%d-%d", w, i)
+				fail := cfg.failEvery > 0 && i%cfg.failEvery == cfg.failEvery-1
+
+				ips, err := add(cfg.plugin, conf, id, fail)
+				switch {
+				case fail && err == nil:
+					record(func() { rep.Errors = append(rep.Errors, fmt.Sprintf("%s: ADD should have failed", id)) })
+					release(id, ips)
+					continue
+				case fail:
+					record(func() { rep.FailedAdds++ })
+					continue
+				case err != nil:
+					record(func() { rep.Errors = append(rep.Errors, fmt.Sprintf("%s: ADD: %v", id, err)) })
+					continue
+				}
+
+				held.Lock()
+				for _, ip := range ips {
+					if owner, ok := held.byIP[ip]; ok {
+						record(func() {
+							rep.Duplicates = append(rep.Duplicates, fmt.Sprintf("%s allocated to %s and %s", ip, owner, id))
+						})
+					}
+					held.byIP[ip] = id
+				}
+				held.Unlock()
+				record(func() { rep.Adds++ })
+
+				if prevID != "" {
+					release(prevID, prevIPs)
+				}
+				prevID, prevIPs = id, ips
+			}
+			if prevID != "" {
+				release(prevID, prevIPs)
+			}
+		}(w)
+	}
+	wg.Wait()
+	rep.Duration = time.Since(start)
+	rep.AddsBySecond = float64(rep.Adds) / rep.Duration.Seconds()
+
+	leaked, err := allocations(cfg.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	rep.Leaked = leaked
+	return rep, nil
+}
+
+// add runs an ADD and returns the allocated addresses. If fail is set, the
+// ADD requests the gateway of the second range set, which is refused after
+// the first range set got its address.
+func add(plugin string, conf []byte, id string, fail bool) ([]string, error) {
+	// a pod name per container makes host-local track pods too
+	cniArgs := "K8S_POD_NAMESPACE=soak;K8S_POD_NAME=" + id
+	if fail {
+		cniArgs += ";IP=fd99::1"
+	}
+	out, err := execPlugin(plugin, conf, "ADD", id, cniArgs)
+	if err != nil {
+		return nil, err
+	}
+	result := &current.Result{}
+	if err := json.Unmarshal(out, result); err != nil {
+		return nil, fmt.Errorf("failed to parse result: %v", err)
+	}
+	ips := []string{}
+	for _, ipc := range result.IPs {
+		ips = append(ips, ipc.Address.IP.String())
+	}
+	return ips, nil
+}
+
+// execPlugin runs the plugin in its own process and returns its output.
+func execPlugin(plugin string, conf []byte, command, id, cniArgs string) ([]byte, error) {
+	args := &invoke.Args{
+		Command:       command,
+		ContainerID:   id,
+		NetNS:         "/var/run/netns/" + id,
+		PluginArgsStr: cniArgs,
+		IfName:        "eth0",
+		Path:          "/nonexistent",
+	}
+	raw := &invoke.RawExec{Stderr: io.Discard}
+	return raw.ExecPlugin(context.TODO(), plugin, conf, args.AsEnv())
+}
+
+// allocations returns the addresses still allocated in the store.
+func allocations(dataDir string) ([]string, error) {
+	store, err := disk.New(network, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	if err := store.Lock(); err != nil {
+		return nil, err
+	}
+	defer store.Unlock()
+
+	ips, err := store.Allocations()
+	if err != nil {
+		return nil, err
+	}
+	leaked := []string{}
+	for _, ip := range ips {
+		leaked = append(leaked, ip.String())
+	}
+	return leaked, nil
+}
+
+func main() {
+	os.Exit(soak())
+}
+
+func soak() int {
+	cfg := config{}
+	flag.StringVar(&cfg.plugin, "plugin", "host-local", "path of the host-local binary")
+	flag.StringVar(&cfg.dataDir, "datadir", "", "data directory, a temporary one by default")
+	flag.StringVar(&cfg.storeFormat, "store-format", "files", `store format, "files" or "journal"`)
+	flag.IntVar(&cfg.workers, "workers", 16, "concurrent invocations")
+	flag.IntVar(&cfg.iterations, "iterations", 100, "ADD/DEL cycles per worker")
+	flag.IntVar(&cfg.failEvery, "fail-every", 7, "make every nth ADD fail, 0 for none")
+	flag.Parse()
+
+	if cfg.dataDir == "" {
+		dir, err := os.MkdirTemp("", "host-local-soak")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer os.RemoveAll(dir)
+		cfg.dataDir = dir
+	}
+
+	rep, err := run(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(rep)
+	if !rep.ok() {
+		problems := append(append(rep.Duplicates, rep.Leaked...), rep.Errors...)
+		fmt.Fprintf(os.Stderr, "soak failed: %s\n", strings.Join(problems, "; "))
+		return 1
+	}
+	return 0
+}
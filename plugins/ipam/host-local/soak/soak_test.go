@@ -0,0 +1,44 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("host-local under concurrent ADD and DEL", func() {
+	DescribeTable("neither duplicates nor leaks addresses",
+		func(storeFormat string) {
+			rep, err := run(config{
+				plugin:      pluginPath,
+				dataDir:     GinkgoT().TempDir(),
+				storeFormat: storeFormat,
+				workers:     8,
+				iterations:  12,
+				failEvery:   4,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rep.Duplicates).To(BeEmpty())
+			Expect(rep.Leaked).To(BeEmpty())
+			Expect(rep.Errors).To(BeEmpty())
+			Expect(rep.Adds).To(Equal(8 * 9))
+			Expect(rep.FailedAdds).To(Equal(8 * 3))
+			Expect(rep.Dels).To(Equal(rep.Adds))
+		},
+		Entry("files", "files"),
+		Entry("journal", "journal"),
+	)
+})
@@ -74,7 +74,7 @@ var _ = Describe("Loopback", func() {
 				session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
 				Expect(err).NotTo(HaveOccurred())
 
-				Eventually(session).Should(gbytes.Say(`{.*}`))
+				Eventually(session).Should(gbytes.Say(`(?s){.*}`))
 				Eventually(session).Should(gexec.Exit(0))
 
 				var lo *net.Interface
@@ -109,5 +109,29 @@ var _ = Describe("Loopback", func() {
 				Expect(lo.Flags & net.FlagUp).NotTo(Equal(net.FlagUp))
 			})
 		})
+
+		Context("when the network namespace is gone", func() {
+			It(fmt.Sprintf("[%s] succeeds on DEL and reports it on CHECK", ver), func() {
+				environ[1] = "CNI_NETNS=/var/run/netns/gone"
+
+				command.Stdin = generateConfig(ver)
+				command.Env = append(environ, "CNI_COMMAND=DEL")
+				session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(session).Should(gexec.Exit(0))
+
+				if !testutils.SpecVersionHasCHECK(ver) {
+					return
+				}
+				command = exec.Command(pathToLoPlugin)
+				command.Stdin = generateConfig(ver)
+				command.Env = append(environ, "CNI_COMMAND=CHECK")
+				session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Out).To(gbytes.Say(`"code": 8,`))
+				Expect(session.Out).To(gbytes.Say(`NetNSGone`))
+			})
+		})
 	}
 })
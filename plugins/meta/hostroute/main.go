@@ -0,0 +1,27 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a chained plugin that routes a pod's addresses on the host: it
+// adds a host route for each of them through the host side interface the
+// pod is reached by, with a configurable metric, table and route protocol.
+// Unlike route-reflector's, the routes are routed by. They are recorded per
+// attachment, so DEL and GC remove exactly the routes ADD added.
+
+package main
+
+import "github.com/containernetworking/plugins/internal/plugins/meta/hostroute"
+
+func main() {
+	hostroute.Main()
+}
@@ -0,0 +1,27 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a chained plugin that emulates WAN conditions for a pod: it adds
+// delay, jitter, loss and reordering to the traffic of the pod's interface
+// with the netem qdisc. Everything it sets up lives in the pod's namespace,
+// so it composes with the bandwidth plugin, which shapes on the host side,
+// and goes away with the namespace.
+
+package main
+
+import "github.com/containernetworking/plugins/internal/plugins/meta/latency"
+
+func main() {
+	latency.Main()
+}
@@ -0,0 +1,28 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a chained plugin for pods with several interfaces, a generalized
+// sbr: every interface of the prevResult gets a routing table and rules
+// routing traffic from its addresses by that table, so replies leave by
+// the interface the traffic arrived on. The default route of the pod is
+// put on the first of its uplinks, and "multihome monitor" moves it to the
+// next one while health checks of the uplink fail.
+
+package main
+
+import "github.com/containernetworking/plugins/internal/plugins/meta/multihome"
+
+func main() {
+	multihome.Main()
+}
@@ -0,0 +1,29 @@
+//go:build linux
+
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a chained plugin that probes the network from inside the pod
+// before ADD succeeds: it pings the gateways or other hosts, resolves names
+// and connects to TCP services, retrying each probe, and fails the ADD when
+// one of them keeps failing. A broken uplink is then caught when the pod is
+// created, rather than by its crash loops.
+
+package main
+
+import "github.com/containernetworking/plugins/internal/plugins/meta/netns-ready"
+
+func main() {
+	netnsready.Main()
+}
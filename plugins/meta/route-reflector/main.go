@@ -0,0 +1,28 @@
+// Copyright 2024 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a chained plugin that makes a pod's addresses reachable across
+// the site without an overlay: it keeps a host route for each of them in a
+// dedicated routing table, which the node's BGP daemon announces to its
+// upstream peers. The routes are added on ADD and withdrawn on DEL. A CNI
+// plugin only lives for one invocation, too short for a BGP session, whose
+// routes are withdrawn when it closes, so the session is left to the daemon.
+
+package main
+
+import "github.com/containernetworking/plugins/internal/plugins/meta/route-reflector"
+
+func main() {
+	routereflector.Main()
+}
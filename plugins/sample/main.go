@@ -24,6 +24,9 @@ import (
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/config"
+	"github.com/containernetworking/plugins/pkg/crash"
+	"github.com/containernetworking/plugins/pkg/include"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 )
 
@@ -49,6 +52,10 @@ type PluginConf struct {
 func parseConfig(stdin []byte) (*PluginConf, error) {
 	conf := PluginConf{}
 
+	if err := config.Validate(stdin, &conf); err != nil {
+		return nil, fmt.Errorf("invalid network configuration: %v", err)
+	}
+
 	if err := json.Unmarshal(stdin, &conf); err != nil {
 		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
 	}
@@ -150,7 +157,7 @@ func cmdDel(args *skel.CmdArgs) error {
 
 func main() {
 	// replace TODO with your plugin name
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("TODO"))
+	crash.PluginMainFuncs(include.Funcs(skel.CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}), version.All, bv.BuildString("TODO"))
 }
 
 func cmdCheck(_ *skel.CmdArgs) error {